@@ -0,0 +1,559 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/dnsstamp"
+	"blitiri.com.ar/go/dnss/internal/httpresolver"
+	"blitiri.com.ar/go/dnss/internal/httpserver"
+	"blitiri.com.ar/go/dnss/internal/mqtt"
+	"blitiri.com.ar/go/dnss/internal/statsfile"
+	"blitiri.com.ar/go/dnss/internal/syslog"
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/dnss/internal/webhook"
+)
+
+// checkConfig validates the flags, and returns all the problems found (so
+// they can be fixed at once, instead of one by one). We validate everything
+// we can without side effects, like listening or contacting upstreams.
+func checkConfig() []error {
+	c := &configChecker{}
+
+	switch *mode {
+	case "", "dns_to_https", "https_to_dns", "both":
+	default:
+		c.errorf("-mode: unknown mode %q (expected dns_to_https,"+
+			" https_to_dns or both)", *mode)
+	}
+	if !(*enableDNStoHTTPS || *enableHTTPStoDNS) {
+		c.errorf("need to set one of --enable_dns_to_https or" +
+			" --enable_https_to_dns (or --mode)")
+	}
+
+	if _, err := strconv.ParseUint(*unixSocketMode, 8, 32); err != nil {
+		c.errorf("-unix_socket_mode is not a valid octal mode: %v", err)
+	}
+	if err := util.ValidDSCP(*dscp); err != nil {
+		c.errorf("-dscp: %v", err)
+	}
+	c.listenAddr("monitoring_listen_addr", *monitoringListenAddr)
+	if *syslogRemote != "" {
+		if _, _, err := syslog.ParseURL(*syslogRemote); err != nil {
+			c.errorf("-syslog_remote: %v", err)
+		}
+	}
+	for _, u := range strings.Fields(*webhooks) {
+		if _, _, err := webhook.ParseURL(u); err != nil {
+			c.errorf("-webhooks: %q: %v", u, err)
+		}
+	}
+	for _, k := range strings.Fields(*webhookEvents) {
+		if !webhook.IsKnown(k) {
+			c.errorf("-webhook_events: unknown event %q", k)
+		}
+	}
+	if *mqttBroker != "" {
+		if _, err := mqtt.New(*mqttBroker, *mqttTopic); err != nil {
+			c.errorf("-mqtt_broker: %v", err)
+		}
+		if *mqttInterval <= 0 {
+			c.errorf("-mqtt_interval must be positive")
+		}
+	}
+	if *watchdogMaxHeap < 0 || *watchdogMaxGoroutines < 0 || *watchdogMaxStall < 0 {
+		c.errorf("-watchdog_max_heap_mb, -watchdog_max_goroutines and" +
+			" -watchdog_max_stall must not be negative")
+	}
+	if *watchdogDumpDir != "" {
+		if fi, err := os.Stat(*watchdogDumpDir); err != nil {
+			c.errorf("-watchdog_dump_dir: %v", err)
+		} else if !fi.IsDir() {
+			c.errorf("-watchdog_dump_dir: %q is not a directory",
+				*watchdogDumpDir)
+		}
+	}
+	if *watchdogRestart && *watchdogMaxHeap == 0 &&
+		*watchdogMaxGoroutines == 0 && *watchdogMaxStall == 0 {
+		c.errorf("-watchdog_restart needs at least one of the watchdog limits")
+	}
+	if *recentErrors < 0 {
+		c.errorf("-recent_errors must not be negative")
+	}
+	if *statsFile != "" {
+		if _, err := os.Stat(filepath.Dir(*statsFile)); err != nil {
+			c.errorf("-stats_file: %v", err)
+		}
+		if err := statsfile.Check(strings.Fields(*statsPersist)); err != nil {
+			c.errorf("-stats_persist: %v", err)
+		}
+		if *statsSaveInterval <= 0 {
+			c.errorf("-stats_save_interval must be positive")
+		}
+	}
+	if *profileName != "" && *profilesFile == "" {
+		c.errorf("-profile needs -profiles")
+	}
+	if *profilesFile != "" {
+		if profiles, err := readProfiles(*profilesFile); err != nil {
+			c.errorf("-profiles: %v", err)
+		} else if *profileName != "" {
+			if _, err := profileValues(profiles, *profileName); err != nil {
+				c.errorf("-profile: %v", err)
+			}
+		}
+	}
+	if *takeover != "" && *takeover != "resolved" {
+		c.errorf("-takeover: unknown program %q (only \"resolved\" is"+
+			" supported)", *takeover)
+	}
+
+	if *enableDNStoHTTPS {
+		c.listenAddr("dns_listen_addr", *dnsListenAddr)
+		c.httpsUpstream("https_upstream", *httpsUpstream)
+		for _, f := range strings.Fields(*upstreamAuth) {
+			sp := strings.SplitN(f, "=", 2)
+			if len(sp) != 2 || sp[0] == "" {
+				c.errorf("-upstream_auth: %q: expected host=auth", f)
+			} else if _, err := httpresolver.ParseAuth(sp[1]); err != nil {
+				c.errorf("-upstream_auth: %q: %v", sp[0], err)
+			}
+		}
+		hc, err := httpresolver.ParseHealthCheck(
+			*healthCheck, httpresolver.DefaultHealthCheck)
+		if err != nil {
+			c.errorf("-health_check: %v", err)
+		}
+		for _, f := range strings.Fields(*upstreamHealthChecks) {
+			sp := strings.SplitN(f, "=", 2)
+			if len(sp) != 2 || sp[0] == "" {
+				c.errorf("-upstream_health_checks: %q: expected host=checks", f)
+			} else if _, err := httpresolver.ParseHealthCheck(sp[1], hc); err != nil {
+				c.errorf("-upstream_health_checks: %q: %v", sp[0], err)
+			}
+		}
+		if _, err := httpresolver.ParseDevices(*upstreamDevices); err != nil {
+			c.errorf("-upstream_devices: %v", err)
+		}
+		if *upstreamClientID && !*dohMode && !dnsstamp.IsStamp(*httpsUpstream) {
+			c.errorf("-upstream_client_id needs the DoH protocol" +
+				" (-experimental__doh_mode, or a DoH stamp)")
+		}
+		c.readableFile("https_client_cafile", *httpsClientCAFile)
+		c.plainDNSAddr("dns_unqualified_upstream", *dnsUnqualifiedUpstream)
+		c.plainDNSAddr("fallback_upstream", *fallbackUpstream)
+		c.domainList("fallback_domains", *fallbackDomains)
+		c.domainList("flatten_cnames", *flattenCNAMEs)
+
+		if *manageResolvConfFlag && *dnsListenAddr != "systemd" {
+			// resolv.conf can't say which port to use.
+			if _, port, err := localDNSAddr(*dnsListenAddr); err == nil && port != 53 {
+				c.errorf("-manage_resolv_conf needs -dns_listen_addr" +
+					" on port 53")
+			}
+		}
+		if *dnsCookieSecret != "" {
+			if b, err := hex.DecodeString(*dnsCookieSecret); err != nil || len(b) != 16 {
+				c.errorf("-dns_cookie_secret must be 16 bytes in hex")
+			}
+		}
+		if *udpRateLimit < 0 || *udpRateLimitSlip < 0 {
+			c.errorf("-udp_rate_limit and -udp_rate_limit_slip must not be" +
+				" negative")
+		}
+		if *maxAnswers < 0 {
+			c.errorf("-max_answers must not be negative")
+		}
+		if *autoTransportSampleRate < 0 || *autoTransportSampleRate > 1 {
+			c.errorf("-auto_transport_sample_rate must be between 0 and 1")
+		}
+		if *maxUpstreamRequests < 0 {
+			c.errorf("-max_upstream_requests must not be negative")
+		}
+		if *maxUpstreamResponseSize < 512 {
+			c.errorf("-max_upstream_response_size must be at least 512")
+		}
+		if *upstreamProxyProtocol < 0 || *upstreamProxyProtocol > 2 {
+			c.errorf("-upstream_proxy_protocol must be 0, 1 or 2")
+		}
+		if *upstreamKeepAlive < 0 {
+			c.errorf("-upstream_keepalive must not be negative")
+		}
+		if *upstreamAttempts < 0 {
+			c.errorf("-upstream_attempts must not be negative")
+		}
+		if *diffUpstream != "" {
+			c.httpsUpstream("diff_upstream", *diffUpstream)
+		}
+		if *diffSampleRate < 0 || *diffSampleRate > 1 {
+			c.errorf("-diff_sample_rate must be between 0 and 1")
+		}
+		if *nat64Prefix != "" {
+			if _, err := httpresolver.ParseNAT64Prefix(*nat64Prefix); err != nil {
+				c.errorf("-nat64_prefix: %v", err)
+			}
+		}
+		if err := dnsserver.ValidCachePolicy(*cachePolicy); err != nil {
+			c.errorf("-cache_policy: %v", err)
+		}
+		if _, err := dnsserver.ParseCachePartitions(*cachePartitions); err != nil {
+			c.errorf("-cache_partitions: %v", err)
+		}
+		if _, err := parseIPList(*hijackIPs); err != nil {
+			c.errorf("-nxdomain_hijack_ips: %v", err)
+		}
+		if *ednsUDPSize < 512 || *ednsUDPSize > 65535 {
+			c.errorf("-edns_udp_size must be between 512 and 65535")
+		}
+
+		keys := map[string]*dnsserver.TSIGKey{}
+		if *tsigKeysFile != "" {
+			var err error
+			if keys, err = dnsserver.LoadTSIGKeys(*tsigKeysFile); err != nil {
+				c.errorf("-tsig_keys: %v", err)
+			}
+		}
+		if _, err := dnsserver.ParseForwardZones(*forwardZones, keys); err != nil {
+			c.errorf("-forward_zones: %v", err)
+		}
+		if _, err := dnsserver.ParseSecondaryZones(*secondaryZones, keys); err != nil {
+			c.errorf("-secondary_zones: %v", err)
+		}
+		if *dnsUpdateServer != "" {
+			c.plainDNSAddr("dns_update_server", *dnsUpdateServer)
+		}
+		if _, err := dnsserver.ParseUpdateRules(*dnsUpdateAllow); err != nil {
+			c.errorf("-dns_update_allow: %v", err)
+		}
+		if *dnsUpdateKey != "" {
+			if dnsserver.FindTSIGKey(keys, *dnsUpdateKey) == nil {
+				c.errorf("-dns_update_key: unknown key %q", *dnsUpdateKey)
+			}
+		}
+
+		for _, path := range strings.Fields(*blocklists) {
+			c.readableFile("blocklists", path)
+		}
+		if *negativeTTL < 0 {
+			c.errorf("-negative_ttl must not be negative")
+		}
+		for _, src := range strings.Fields(*rpzSources) {
+			c.zoneSource("rpz", src)
+		}
+		if *rpzRefresh < 0 {
+			c.errorf("-rpz_refresh_interval must not be negative")
+		}
+		if schedules, err := dnsserver.ParseRPZSchedules(*rpzSchedules); err != nil {
+			c.errorf("-rpz_schedules: %v", err)
+		} else {
+			sources := map[string]bool{}
+			for _, src := range strings.Fields(*rpzSources) {
+				sources[src] = true
+			}
+			for source := range schedules {
+				if !sources[source] {
+					c.errorf("-rpz_schedules: %q is not one of the -rpz sources",
+						source)
+				}
+			}
+		}
+		if *warmupDomainsFile != "" {
+			if _, err := dnsserver.LoadWarmupDomains(*warmupDomainsFile); err != nil {
+				c.errorf("-warmup_domains_file: %v", err)
+			}
+			if !*enableCache {
+				c.errorf("-warmup_domains_file needs -enable_cache")
+			}
+		}
+		if *policyRules != "" {
+			if _, err := dnsserver.LoadPolicy(*policyRules); err != nil {
+				c.errorf("-policy_rules: %v", err)
+			}
+		}
+		if *execHook != "" {
+			if fields := strings.Fields(*execHook); len(fields) == 0 {
+				c.errorf("-exec_hook: missing command")
+			} else if _, err := exec.LookPath(fields[0]); err != nil {
+				c.errorf("-exec_hook: %v", err)
+			}
+			if *execHookTimeout <= 0 {
+				c.errorf("-exec_hook_timeout must be positive")
+			}
+		}
+		c.readableFile("static_records", *staticRecords)
+		if *dhcpLeases != "" {
+			c.readableFile("dhcp_leases", *dhcpLeases)
+			if err := dnsserver.ValidLeasesFormat(*dhcpLeasesFormat); err != nil {
+				c.errorf("-dhcp_leases_format: %v", err)
+			}
+			if *dhcpDomain == "" {
+				c.errorf("-dhcp_domain must not be empty")
+			}
+		}
+		if _, err := dnsserver.ParseReverseZones(*reverseZones); err != nil {
+			c.errorf("-reverse_zones: %v", err)
+		}
+		if *reverseHosts != "" {
+			c.readableFile("reverse_hosts", *reverseHosts)
+			if *reverseZones == "" {
+				c.errorf("-reverse_hosts needs -reverse_zones")
+			}
+		}
+		if _, err := dnsserver.ParseSpecialDomains(*specialDomains); err != nil {
+			c.errorf("-special_domains: %v", err)
+		}
+	}
+
+	if *enableHTTPStoDNS {
+		c.listenAddr("https_server_addr", *httpsAddr)
+		for _, u := range strings.Fields(*dnsUpstream) {
+			c.plainDNSAddr("dns_upstream", u)
+		}
+		c.certificate(*httpsCertFile, *httpsKeyFile)
+		c.extraCertificates(*httpsExtraCerts)
+		if _, err := httpserver.ParseTLSVersion(*httpsTLSMinVersion); err != nil {
+			c.errorf("-https_tls_min_version: %v", err)
+		}
+		if _, err := httpserver.ParseCipherSuites(*httpsTLSCiphers); err != nil {
+			c.errorf("-https_tls_ciphers: %v", err)
+		}
+		if _, err := httpserver.ParseCurves(*httpsTLSCurves); err != nil {
+			c.errorf("-https_tls_curves: %v", err)
+		}
+		if *httpsTicketRotation < 0 {
+			c.errorf("-https_ticket_key_rotation must not be negative")
+		}
+		c.readableFile("https_ocsp_staple", *httpsOCSPStaple)
+		if _, err := httpserver.ParseEndpoints(*httpsEndpoints); err != nil {
+			c.errorf("-https_endpoints: %v", err)
+		}
+		if *httpsLogSampleRate < 0 || *httpsLogSampleRate > 1 {
+			c.errorf("-https_log_sample_rate must be between 0 and 1")
+		}
+		if *httpsLogMaxQPS < 0 {
+			c.errorf("-https_log_max_qps must not be negative")
+		}
+		if *httpsWorkers < 0 || *httpsWorkerQueue < 0 {
+			c.errorf("-https_workers and -https_worker_queue must not be" +
+				" negative")
+		}
+		if *httpsRecursiveLocalRoot {
+			if len(strings.Fields(*httpsRecursiveRootSources)) == 0 {
+				c.errorf("-https_recursive_root_sources must not be empty")
+			}
+			for _, src := range strings.Fields(*httpsRecursiveRootSources) {
+				c.zoneSource("https_recursive_root_sources", src)
+			}
+		}
+	}
+
+	// When running both, each half can send its queries to the other (like
+	// the HTTPS server to the DNS front-end, to terminate DoH locally), but
+	// not both ways, or they would go around in circles.
+	if *enableDNStoHTTPS && *enableHTTPStoDNS && isOwnHTTPSServer(*httpsUpstream) {
+		for _, u := range strings.Fields(*dnsUpstream) {
+			if isOwnAddr(u, *dnsListenAddr) {
+				c.errorf("-https_upstream and -dns_upstream point to each" +
+					" other's listening addresses, the queries would loop")
+				break
+			}
+		}
+	}
+
+	return c.errs
+}
+
+// isOwnHTTPSServer returns true if the HTTPS upstream is our own HTTPS
+// server (-https_server_addr).
+func isOwnHTTPSServer(upstream string) bool {
+	u, err := url.Parse(upstream)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	return isOwnAddr(addr, *httpsAddr)
+}
+
+// isOwnAddr returns true if addr (host:port) reaches the given listening
+// address of ours: the ports are the same, and the host is either the one we
+// listen on, or a loopback one when listening on all addresses.
+func isOwnAddr(addr, listenAddr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	lhost, lport, err := net.SplitHostPort(listenAddr)
+	if err != nil || port != lport {
+		return false
+	}
+	if host == lhost {
+		return true
+	}
+	if lip := net.ParseIP(lhost); lhost != "" && (lip == nil || !lip.IsUnspecified()) {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// configChecker accumulates the errors found while checking the
+// configuration.
+type configChecker struct {
+	errs []error
+}
+
+func (c *configChecker) errorf(format string, a ...interface{}) {
+	c.errs = append(c.errs, fmt.Errorf(format, a...))
+}
+
+func (c *configChecker) listenAddr(name, addr string) {
+	if addr == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		c.errorf("-%s is not a valid address: %v", name, err)
+	}
+}
+
+func (c *configChecker) httpsUpstream(name, s string) {
+	if dnsstamp.IsStamp(s) {
+		stamp, err := dnsstamp.Parse(s)
+		if err != nil {
+			c.errorf("-%s is not a valid DNS stamp: %v", name, err)
+		} else if stamp.Proto != dnsstamp.ProtoDoH {
+			c.errorf("-%s: unsupported stamp protocol (%v)",
+				name, stamp.Proto)
+		}
+		return
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		c.errorf("-%s is not a valid URL: %v", name, err)
+		return
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		c.errorf("-%s: unknown scheme %q (expected https)",
+			name, u.Scheme)
+	}
+	if u.Host == "" {
+		c.errorf("-%s: missing host", name)
+	}
+}
+
+func (c *configChecker) plainDNSAddr(name, s string) {
+	if s == "" {
+		return
+	}
+
+	if dnsstamp.IsStamp(s) {
+		stamp, err := dnsstamp.Parse(s)
+		if err != nil {
+			c.errorf("-%s is not a valid DNS stamp: %v", name, err)
+		} else if stamp.Proto != dnsstamp.ProtoPlain {
+			c.errorf("-%s: unsupported stamp protocol (%v)",
+				name, stamp.Proto)
+		}
+		return
+	}
+
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		c.errorf("-%s is not a valid host:port address: %v", name, err)
+	} else if host == "" {
+		c.errorf("-%s: missing host", name)
+	}
+}
+
+// domainList checks a list of domains that are used to route queries. They
+// are matched in their canonical form (see util.CanonicalName), so the final
+// dot and the case don't matter, and listing one more than once (in any form)
+// is likely a mistake.
+func (c *configChecker) domainList(name, s string) {
+	seen := map[string]bool{}
+	for _, d := range strings.Fields(s) {
+		canonical := util.CanonicalName(d)
+		if seen[canonical] {
+			c.errorf("-%s: %q is listed more than once", name, d)
+			continue
+		}
+		seen[canonical] = true
+	}
+}
+
+func (c *configChecker) zoneSource(name, src string) {
+	if strings.HasPrefix(src, "axfr://") ||
+		strings.HasPrefix(src, "http://") ||
+		strings.HasPrefix(src, "https://") {
+		u, err := url.Parse(src)
+		if err != nil {
+			c.errorf("-%s: %q is not a valid URL: %v", name, src, err)
+		} else if u.Host == "" {
+			c.errorf("-%s: %q is missing the host", name, src)
+		}
+		return
+	}
+
+	c.readableFile(name, src)
+}
+
+func (c *configChecker) readableFile(name, path string) {
+	if path == "" {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		c.errorf("-%s: %v", name, err)
+		return
+	}
+	f.Close()
+}
+
+func (c *configChecker) certificate(certFile, keyFile string) {
+	if *insecureForTesting {
+		return
+	}
+
+	if certFile == "" || keyFile == "" {
+		c.errorf("-https_cert and -https_key are needed for the" +
+			" HTTPS-to-DNS proxy")
+		return
+	}
+
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		c.errorf("-https_cert/-https_key: %v", err)
+	}
+}
+
+func (c *configChecker) extraCertificates(s string) {
+	cfs, err := httpserver.ParseCertFiles(s)
+	if err != nil {
+		c.errorf("-https_extra_certs: %v", err)
+		return
+	}
+	for _, cf := range cfs {
+		if _, err := tls.LoadX509KeyPair(cf.CertFile, cf.KeyFile); err != nil {
+			c.errorf("-https_extra_certs: %s: %v", cf.CertFile, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package blocklist implements compiled blocklists: large lists of domains
+// (millions of entries) in a compact binary format, which can be used
+// straight from the file, via mmap, so loading them is instant and they
+// take almost no heap. That way, huge lists can be used on small routers.
+//
+// The lists are compiled offline (see Builder, and "dnss
+// compile-blocklist"), from plain lists of domains or hosts files. Each
+// domain in the list blocks itself and all its subdomains.
+//
+// The file is a trie of labels, starting from the TLDs:
+//
+//	magic    "DNSSBL1\n"
+//	entries  uint32, number of domains in the list
+//	nodes    uint32, number of nodes
+//	labels   uint32, size of the labels table
+//	node     [nodes], 16 bytes each:
+//	           label offset (uint32) and length (uint8) in the labels table
+//	           flags (uint8), 1 if the node is a listed domain
+//	           padding (uint16)
+//	           first child (uint32) and number of children (uint32)
+//	labels   [labels]byte
+//
+// All integers are little endian. The first node is the root; the children
+// of each node are consecutive, and sorted by label, so they can be found
+// with a binary search. The children always come after their parent, which
+// keeps lookups from looping on corrupt files.
+package blocklist
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const magic = "DNSSBL1\n"
+
+const (
+	headerSize = len(magic) + 3*4
+	nodeSize   = 16
+)
+
+// Node flags.
+const flagListed = 1
+
+// List is a compiled blocklist. It's safe for concurrent use, until it's
+// closed.
+type List struct {
+	data    []byte
+	entries int
+	nodes   []byte
+	labels  []byte
+
+	// Releases the data.
+	release func() error
+}
+
+var errBadFile = errors.New("not a compiled blocklist")
+
+// Open the compiled blocklist at the given path.
+func Open(path string) (*List, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := parse(data)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	l.release = release
+	return l, nil
+}
+
+// parse the list, checking it's consistent, so the lookups don't need to.
+func parse(data []byte) (*List, error) {
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return nil, errBadFile
+	}
+	h := data[len(magic):]
+	entries := binary.LittleEndian.Uint32(h[0:])
+	nNodes := uint64(binary.LittleEndian.Uint32(h[4:]))
+	nLabels := uint64(binary.LittleEndian.Uint32(h[8:]))
+	if nNodes == 0 ||
+		uint64(len(data)) != uint64(headerSize)+nNodes*nodeSize+nLabels {
+		return nil, fmt.Errorf("%v: wrong size", errBadFile)
+	}
+
+	l := &List{
+		data:    data,
+		entries: int(entries),
+		nodes:   data[headerSize : uint64(headerSize)+nNodes*nodeSize],
+		labels:  data[uint64(headerSize)+nNodes*nodeSize:],
+	}
+
+	for i := uint64(0); i < nNodes; i++ {
+		n := l.node(uint32(i))
+		if uint64(n.labelOff)+uint64(n.labelLen) > nLabels {
+			return nil, fmt.Errorf("%v: node %d: label out of range",
+				errBadFile, i)
+		}
+		if n.children > 0 && (uint64(n.first) <= i ||
+			uint64(n.first)+uint64(n.children) > nNodes) {
+			return nil, fmt.Errorf("%v: node %d: children out of range",
+				errBadFile, i)
+		}
+	}
+	return l, nil
+}
+
+type node struct {
+	labelOff uint32
+	labelLen uint8
+	flags    uint8
+	first    uint32
+	children uint32
+}
+
+func (l *List) node(i uint32) node {
+	b := l.nodes[i*nodeSize : (i+1)*nodeSize]
+	return node{
+		labelOff: binary.LittleEndian.Uint32(b[0:]),
+		labelLen: b[4],
+		flags:    b[5],
+		first:    binary.LittleEndian.Uint32(b[8:]),
+		children: binary.LittleEndian.Uint32(b[12:]),
+	}
+}
+
+func (l *List) label(n node) []byte {
+	return l.labels[n.labelOff : n.labelOff+uint32(n.labelLen)]
+}
+
+// Len returns the number of domains in the list.
+func (l *List) Len() int {
+	return l.entries
+}
+
+// Contains returns true if the name, or one of its parents, is in the list.
+// The name must be in canonical form (lower case, see util.CanonicalName);
+// the trailing dot is optional.
+func (l *List) Contains(name string) bool {
+	_, ok := l.Match(name)
+	return ok
+}
+
+// Match is like Contains, but also returns the entry of the list that
+// matched (the name itself, or one of its parents), with the trailing dot.
+func (l *List) Match(name string) (string, bool) {
+	full := strings.TrimSuffix(name, ".")
+	name = full
+	n := l.node(0)
+	for name != "" {
+		var label string
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			label, name = name[i+1:], name[:i]
+		} else {
+			label, name = name, ""
+		}
+
+		var ok bool
+		n, ok = l.child(n, label)
+		if !ok {
+			return "", false
+		}
+		if n.flags&flagListed != 0 {
+			if name == "" {
+				return full + ".", true
+			}
+			return full[len(name)+1:] + ".", true
+		}
+	}
+	return "", false
+}
+
+// child returns the child of n with the given label.
+func (l *List) child(n node, label string) (node, bool) {
+	lo, hi := n.first, n.first+n.children
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		c := l.node(mid)
+		switch cmp := compareLabel(l.label(c), label); {
+		case cmp == 0:
+			return c, true
+		case cmp < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return node{}, false
+}
+
+// compareLabel compares the labels like bytes.Compare, without having to
+// convert them.
+func compareLabel(a []byte, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// Close the list, releasing its memory. It can't be used afterwards.
+func (l *List) Close() error {
+	if l.release == nil {
+		return nil
+	}
+	err := l.release()
+	l.release = nil
+	return err
+}
@@ -0,0 +1,134 @@
+package blocklist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testList = `
+# A hosts file.
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.net # Trailing comment.
+0.0.0.0 sub.ads.example.com
+
+# A domain list.
+Malware.Example
+*.wild.example
+||adblock.example^
+! Adblock comment.
+
+not a valid domain..
+`
+
+func compileTestList(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "blocklist_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "list.dnssbl")
+
+	b := NewBuilder()
+	if err := b.AddList(strings.NewReader(testList)); err != nil {
+		t.Fatalf("error adding the list: %v", err)
+	}
+	// localhost, "not", "a", "valid", "domain..".
+	if b.Skipped != 5 {
+		t.Errorf("expected 5 skipped, got %d", b.Skipped)
+	}
+	if err := b.WriteFile(path); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	return path
+}
+
+func TestCompileAndLookup(t *testing.T) {
+	path := compileTestList(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("error opening: %v", err)
+	}
+	defer l.Close()
+
+	// sub.ads.example.com is covered by ads.example.com, and not counted.
+	if l.Len() != 5 {
+		t.Errorf("expected 5 entries, got %d", l.Len())
+	}
+
+	cases := map[string]bool{
+		"ads.example.com.":         true,
+		"ads.example.com":          true,
+		"sub.ads.example.com.":     true,
+		"x.y.ads.example.com.":     true,
+		"example.com.":             false,
+		"com.":                     false,
+		"xads.example.com.":        false,
+		"tracker.example.net.":     true,
+		"malware.example.":         true,
+		"wild.example.":            true,
+		"a.wild.example.":          true,
+		"adblock.example.":         true,
+		"localhost.":               false,
+		"other.example.":           false,
+		".":                        false,
+		"":                         false,
+		"tracker.example.net.evil": false,
+	}
+	for name, expected := range cases {
+		if got := l.Contains(name); got != expected {
+			t.Errorf("%q: expected %v, got %v", name, expected, got)
+		}
+	}
+
+	matches := map[string]string{
+		"ads.example.com.":     "ads.example.com.",
+		"x.y.ads.example.com":  "ads.example.com.",
+		"a.wild.example.":      "wild.example.",
+		"tracker.example.net.": "tracker.example.net.",
+		"example.com.":         "",
+	}
+	for name, expected := range matches {
+		if got, _ := l.Match(name); got != expected {
+			t.Errorf("Match(%q): expected %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestBadFiles(t *testing.T) {
+	b := NewBuilder()
+	b.Add("example.com")
+	b.Add("example.net")
+	buf := &bytes.Buffer{}
+	if err := b.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+	if _, err := parse(good); err != nil {
+		t.Fatalf("error parsing a good list: %v", err)
+	}
+
+	corrupt := func(f func(data []byte) []byte) []byte {
+		data := append([]byte{}, good...)
+		return f(data)
+	}
+	for i, data := range [][]byte{
+		nil,
+		[]byte("DNSSBL1\n"),
+		[]byte("not a blocklist at all"),
+		good[:len(good)-1],
+		// A label out of range.
+		corrupt(func(d []byte) []byte { d[headerSize+nodeSize+4] = 200; return d }),
+		// Children pointing back to the root.
+		corrupt(func(d []byte) []byte { d[headerSize+8] = 0; return d }),
+	} {
+		if _, err := parse(data); err == nil {
+			t.Errorf("%d: no error", i)
+		}
+	}
+}
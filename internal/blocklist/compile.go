@@ -0,0 +1,214 @@
+package blocklist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+// Builder compiles blocklists. Domains which are already covered by a
+// parent in the list are left out, as they would never be used.
+type Builder struct {
+	root *buildNode
+
+	// Entries which were not valid domains, and were skipped.
+	Skipped int
+}
+
+type buildNode struct {
+	children map[string]*buildNode
+	listed   bool
+}
+
+// NewBuilder returns a new, empty, Builder.
+func NewBuilder() *Builder {
+	return &Builder{root: &buildNode{}}
+}
+
+// Names found in hosts files which are not meant to be blocked.
+var hostsNames = map[string]bool{
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+}
+
+// Add the given domain (and, with it, all its subdomains) to the list. It
+// returns false if the name is not valid, and was skipped.
+func (b *Builder) Add(name string) bool {
+	name = util.CanonicalName(name)
+	if _, ok := dns.IsDomainName(name); !ok || name == "." ||
+		hostsNames[name] || !strings.Contains(name[:len(name)-1], ".") {
+		b.Skipped++
+		return false
+	}
+
+	n := b.root
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.listed {
+			// A parent is already in the list.
+			return true
+		}
+		c, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = map[string]*buildNode{}
+			}
+			c = &buildNode{}
+			n.children[labels[i]] = c
+		}
+		n = c
+	}
+
+	// The subdomains we had are now covered by this one.
+	n.listed = true
+	n.children = nil
+	return true
+}
+
+// AddList adds the domains from a list in text format, one per line. Hosts
+// files ("0.0.0.0 example.com") and Adblock-style domain rules
+// ("||example.com^") work too. Comments start with "#" or "!". Entries
+// which are not valid domains are skipped (see Skipped), as the big lists
+// usually have some.
+func (b *Builder) AddList(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#!"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, f := range fields {
+			f = strings.TrimPrefix(f, "||")
+			f = strings.TrimSuffix(f, "^")
+			f = strings.TrimPrefix(f, "*.")
+			b.Add(f)
+		}
+	}
+	return scanner.Err()
+}
+
+// Len returns the number of domains in the list.
+func (b *Builder) Len() int {
+	return countListed(b.root)
+}
+
+func countListed(n *buildNode) int {
+	count := 0
+	if n.listed {
+		count++
+	}
+	for _, c := range n.children {
+		count += countListed(c)
+	}
+	return count
+}
+
+// Write the compiled list.
+func (b *Builder) Write(w io.Writer) error {
+	// Lay out the nodes breadth-first, so the children of each node are
+	// consecutive, and come after it.
+	type flatNode struct {
+		label           string
+		listed          bool
+		first, children uint32
+	}
+	order := []*buildNode{b.root}
+	flat := []flatNode{{listed: b.root.listed}}
+	for i := 0; i < len(order); i++ {
+		n := order[i]
+		labels := make([]string, 0, len(n.children))
+		for l := range n.children {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+
+		flat[i].first = uint32(len(order))
+		flat[i].children = uint32(len(labels))
+		for _, l := range labels {
+			c := n.children[l]
+			order = append(order, c)
+			flat = append(flat, flatNode{label: l, listed: c.listed})
+		}
+	}
+
+	// The same labels (like "com") are stored only once.
+	labelOffs := map[string]uint32{}
+	labels := []byte{}
+	entries := 0
+	for _, n := range flat {
+		if _, ok := labelOffs[n.label]; !ok {
+			labelOffs[n.label] = uint32(len(labels))
+			labels = append(labels, n.label...)
+		}
+		if n.listed {
+			entries++
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(magic)
+	buf := make([]byte, nodeSize)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(entries))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(flat)))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(labels)))
+	bw.Write(buf[:12])
+
+	for _, n := range flat {
+		for i := range buf {
+			buf[i] = 0
+		}
+		binary.LittleEndian.PutUint32(buf[0:], labelOffs[n.label])
+		buf[4] = uint8(len(n.label))
+		if n.listed {
+			buf[5] = flagListed
+		}
+		binary.LittleEndian.PutUint32(buf[8:], n.first)
+		binary.LittleEndian.PutUint32(buf[12:], n.children)
+		bw.Write(buf)
+	}
+	bw.Write(labels)
+	return bw.Flush()
+}
+
+// WriteFile writes the compiled list to the given path. It's written to a
+// temporary file first, and then renamed, so the daemon never sees (or has
+// mapped) a partially written one.
+func (b *Builder) WriteFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".blocklist-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := b.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// TempFile creates it only readable by us, but the daemon may run as
+	// another user.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,327 @@
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/dnsjson"
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/httpresolver"
+	"blitiri.com.ar/go/dnss/internal/httpserver"
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// vector is a test case: the query, the reply the DNS server gives to it,
+// and the data of the answers we expect in the JSON API.
+type vector struct {
+	qname string
+	qtype uint16
+
+	// Reply of the DNS server, with the records in zone file format.
+	rcode     int
+	ad        bool
+	answer    []string
+	authority []string
+
+	// Data of each answer in the JSON reply.
+	data []string
+}
+
+var vectors = []vector{
+	// Record types.
+	{qname: "a.example.", qtype: dns.TypeA,
+		answer: []string{"a.example. 300 IN A 192.0.2.1"},
+		data:   []string{"192.0.2.1"}},
+	{qname: "many.example.", qtype: dns.TypeA,
+		answer: []string{
+			"many.example. 300 IN A 192.0.2.1",
+			"many.example. 300 IN A 192.0.2.2",
+			"many.example. 300 IN A 192.0.2.3",
+		},
+		data: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+	{qname: "aaaa.example.", qtype: dns.TypeAAAA,
+		answer: []string{"aaaa.example. 300 IN AAAA 2001:db8::1"},
+		data:   []string{"2001:db8::1"}},
+	{qname: "example.", qtype: dns.TypeMX,
+		answer: []string{
+			"example. 3600 IN MX 10 mx1.example.",
+			"example. 3600 IN MX 20 mx2.example.",
+		},
+		data: []string{"10 mx1.example.", "20 mx2.example."}},
+	{qname: "example.", qtype: dns.TypeNS,
+		answer: []string{"example. 86400 IN NS ns1.example."},
+		data:   []string{"ns1.example."}},
+	{qname: "example.", qtype: dns.TypeSOA,
+		answer: []string{"example. 3600 IN SOA ns1.example. admin.example." +
+			" 2020010101 7200 3600 1209600 300"},
+		data: []string{"ns1.example. admin.example." +
+			" 2020010101 7200 3600 1209600 300"}},
+	{qname: "_https._tcp.example.", qtype: dns.TypeSRV,
+		answer: []string{"_https._tcp.example. 300 IN SRV 10 5 443 www.example."},
+		data:   []string{"10 5 443 www.example."}},
+	{qname: "1.2.0.192.in-addr.arpa.", qtype: dns.TypePTR,
+		answer: []string{"1.2.0.192.in-addr.arpa. 300 IN PTR a.example."},
+		data:   []string{"a.example."}},
+	{qname: "example.", qtype: dns.TypeCAA,
+		answer: []string{`example. 300 IN CAA 0 issue "letsencrypt.org"`},
+		data:   []string{`0 issue "letsencrypt.org"`}},
+	{qname: "ssh.example.", qtype: dns.TypeSSHFP,
+		answer: []string{"ssh.example. 300 IN SSHFP 4 2" +
+			" 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"},
+		data: []string{"4 2" +
+			" 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"}},
+
+	// TXT records, with the quoting and escaping.
+	{qname: "txt.example.", qtype: dns.TypeTXT,
+		answer: []string{`txt.example. 300 IN TXT "v=spf1 -all"`},
+		data:   []string{`"v=spf1 -all"`}},
+	{qname: "quotes.example.", qtype: dns.TypeTXT,
+		answer: []string{`quotes.example. 300 IN TXT "say \"hi\""`},
+		data:   []string{`"say \"hi\""`}},
+	{qname: "strings.example.", qtype: dns.TypeTXT,
+		answer: []string{`strings.example. 300 IN TXT "back\\slash" "semi;colon" ""`},
+		data:   []string{`"back\\slash" "semi;colon" ""`}},
+	{qname: "binary.example.", qtype: dns.TypeTXT,
+		answer: []string{`binary.example. 300 IN TXT "bell\007 \195\177"`},
+		data:   []string{`"bell\007 \195\177"`}},
+
+	// CNAME chains, complete and dangling.
+	{qname: "www.example.", qtype: dns.TypeA,
+		answer: []string{
+			"www.example. 300 IN CNAME web.example.",
+			"web.example. 300 IN CNAME cdn.example.net.",
+			"cdn.example.net. 60 IN A 192.0.2.10",
+		},
+		data: []string{"web.example.", "cdn.example.net.", "192.0.2.10"}},
+	{qname: "dangling.example.", qtype: dns.TypeA,
+		answer: []string{"dangling.example. 300 IN CNAME gone.example.net."},
+		data:   []string{"gone.example.net."}},
+
+	// Empty answers: NODATA and NXDOMAIN, with the SOA in the authority
+	// section, and server failures.
+	{qname: "a.example.", qtype: dns.TypeAAAA,
+		authority: []string{"example. 300 IN SOA ns1.example. admin.example." +
+			" 2020010101 7200 3600 1209600 300"}},
+	{qname: "nx.example.", qtype: dns.TypeA, rcode: dns.RcodeNameError,
+		authority: []string{"example. 300 IN SOA ns1.example. admin.example." +
+			" 2020010101 7200 3600 1209600 300"}},
+	{qname: "fail.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure},
+	{qname: "refused.example.", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+
+	// Flags.
+	{qname: "signed.example.", qtype: dns.TypeA, ad: true,
+		answer: []string{"signed.example. 300 IN A 192.0.2.20"},
+		data:   []string{"192.0.2.20"}},
+
+	// Names: IDN (as punycode), in the query and in the data, and case
+	// preservation.
+	{qname: "xn--and-6ma2c.example.", qtype: dns.TypeA,
+		answer: []string{"xn--and-6ma2c.example. 300 IN A 192.0.2.30"},
+		data:   []string{"192.0.2.30"}},
+	{qname: "idn.example.", qtype: dns.TypeCNAME,
+		answer: []string{"idn.example. 300 IN CNAME xn--and-6ma2c.example."},
+		data:   []string{"xn--and-6ma2c.example."}},
+	{qname: "MiXeD.ExAmPlE.", qtype: dns.TypeA,
+		answer: []string{"MiXeD.ExAmPlE. 300 IN A 192.0.2.40"},
+		data:   []string{"192.0.2.40"}},
+
+	// TTL limits.
+	{qname: "zero.example.", qtype: dns.TypeA,
+		answer: []string{"zero.example. 0 IN A 192.0.2.50"},
+		data:   []string{"192.0.2.50"}},
+	{qname: "max.example.", qtype: dns.TypeA,
+		answer: []string{"max.example. 2147483647 IN A 192.0.2.51"},
+		data:   []string{"192.0.2.51"}},
+}
+
+func (v *vector) String() string {
+	return fmt.Sprintf("%s %s", v.qname, dns.TypeToString[v.qtype])
+}
+
+func (v *vector) key() string {
+	return fmt.Sprintf("%s %d", strings.ToLower(v.qname), v.qtype)
+}
+
+// reply is the reply of the DNS server to the given query.
+func (v *vector) reply(tb testing.TB, req *dns.Msg) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Rcode = v.rcode
+	m.AuthenticatedData = v.ad
+	for _, s := range v.answer {
+		m.Answer = append(m.Answer, testutil.NewRR(tb, s))
+	}
+	for _, s := range v.authority {
+		m.Ns = append(m.Ns, testutil.NewRR(tb, s))
+	}
+	return m
+}
+
+// setup the proxy for the given mode (JSON or DoH), a DNS-to-HTTPS server in
+// front of an HTTPS-to-DNS server, in front of a DNS server answering from
+// the vectors. Returns the addresses of the DNS-to-HTTPS and HTTPS-to-DNS
+// servers.
+func setup(tb testing.TB, mode string) (string, string) {
+	dnsToHTTPSAddr := testutil.GetFreePort()
+	httpsToDNSAddr := testutil.GetFreePort()
+	dnsServerAddr := testutil.GetFreePort()
+
+	// The replies are built in advance, as the handler runs in its own
+	// goroutine and can't fail the test.
+	replies := map[string]*dns.Msg{}
+	for i := range vectors {
+		v := &vectors[i]
+		req := &dns.Msg{}
+		req.SetQuestion(v.qname, v.qtype)
+		replies[v.key()] = v.reply(tb, req)
+	}
+
+	u, err := url.Parse("http://" + httpsToDNSAddr + "/resolve")
+	if err != nil {
+		tb.Fatalf("invalid URL: %v", err)
+	}
+	var r dnsserver.Resolver
+	if mode == "DoH" {
+		r = httpresolver.NewDoH(u, "")
+	} else {
+		r = httpresolver.NewJSON(u, "")
+	}
+	go dnsserver.New(dnsToHTTPSAddr, r, "").ListenAndServe()
+
+	htod := httpserver.Server{
+		Addr:     httpsToDNSAddr,
+		Upstream: dnsServerAddr,
+	}
+	httpserver.InsecureForTesting = true
+	go htod.ListenAndServe()
+
+	go testutil.ServeTestDNSServer(dnsServerAddr,
+		func(w dns.ResponseWriter, req *dns.Msg) {
+			q := req.Question[0]
+			key := fmt.Sprintf("%s %d", strings.ToLower(q.Name), q.Qtype)
+			if reply, ok := replies[key]; ok {
+				m := reply.Copy()
+				m.Id = req.Id
+				m.Question = req.Question
+				m.RecursionDesired = req.RecursionDesired
+				w.WriteMsg(m)
+				return
+			}
+			m := &dns.Msg{}
+			m.SetRcode(req, dns.RcodeNameError)
+			w.WriteMsg(m)
+		})
+
+	err1 := testutil.WaitForDNSServer(dnsToHTTPSAddr)
+	err2 := testutil.WaitForHTTPServer(httpsToDNSAddr)
+	err3 := testutil.WaitForDNSServer(dnsServerAddr)
+	if err1 != nil || err2 != nil || err3 != nil {
+		tb.Fatalf("error waiting for the test servers: %v, %v, %v",
+			err1, err2, err3)
+	}
+	return dnsToHTTPSAddr, httpsToDNSAddr
+}
+
+// wire returns the message in wire format, uncompressed so the comparisons
+// don't depend on how each side compresses.
+func wire(tb testing.TB, m *dns.Msg) []byte {
+	m = m.Copy()
+	m.Compress = false
+	buf, err := m.Pack()
+	if err != nil {
+		tb.Fatalf("error packing %v: %v", m, err)
+	}
+	return buf
+}
+
+func TestConformance(t *testing.T) {
+	for _, mode := range []string{"JSON", "DoH"} {
+		mode := mode
+		t.Run("mode="+mode, func(t *testing.T) {
+			dnsAddr, httpAddr := setup(t, mode)
+			if mode == "JSON" {
+				for i := range vectors {
+					checkJSON(t, httpAddr, &vectors[i])
+				}
+			}
+			for i := range vectors {
+				checkWire(t, dnsAddr, mode, &vectors[i])
+			}
+		})
+	}
+}
+
+// checkJSON checks the JSON the HTTPS-to-DNS server gives for the vector.
+func checkJSON(t *testing.T, addr string, v *vector) {
+	t.Helper()
+	u := fmt.Sprintf("http://%s/resolve?name=%s&type=%s",
+		addr, url.QueryEscape(v.qname), dns.TypeToString[v.qtype])
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Errorf("%v: GET error: %v", v, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	jr := &dnsjson.Response{}
+	if err := json.NewDecoder(resp.Body).Decode(jr); err != nil {
+		t.Errorf("%v: invalid JSON: %v", v, err)
+		return
+	}
+
+	if jr.Status != v.rcode || jr.AD != v.ad || !jr.RA {
+		t.Errorf("%v: unexpected status/flags: %+v", v, jr)
+	}
+	if len(jr.Question) != 1 || jr.Question[0].Type != v.qtype ||
+		!strings.EqualFold(jr.Question[0].Name, v.qname) {
+		t.Errorf("%v: unexpected question: %+v", v, jr.Question)
+	}
+
+	data := []string{}
+	for i, a := range jr.Answer {
+		data = append(data, a.Data)
+		rr := testutil.NewRR(t, v.answer[i])
+		if a.Name != rr.Header().Name || a.Type != rr.Header().Rrtype ||
+			a.TTL != rr.Header().Ttl {
+			t.Errorf("%v: answer %d: got %+v, expected %v", v, i, a, rr)
+		}
+	}
+	if len(data) != len(v.data) ||
+		(len(data) > 0 && !reflect.DeepEqual(data, v.data)) {
+		t.Errorf("%v: got data %q, expected %q", v, data, v.data)
+	}
+}
+
+// checkWire checks that the reply the DNS client gets is the same as the one
+// from the DNS server, on the wire. With JSON, the authority section and the
+// AA bit are lost on the way, so they are not expected.
+func checkWire(t *testing.T, addr, mode string, v *vector) {
+	t.Helper()
+	req := &dns.Msg{}
+	req.SetQuestion(v.qname, v.qtype)
+	got, err := dns.Exchange(req, addr)
+	if err != nil {
+		t.Errorf("%v: query error: %v", v, err)
+		return
+	}
+
+	expected := v.reply(t, req)
+	if mode == "JSON" {
+		expected.Authoritative = false
+		expected.Ns = nil
+		expected.Extra = nil
+	}
+
+	if w, e := wire(t, got), wire(t, expected); string(w) != string(e) {
+		t.Errorf("%v: reply differs on the wire:\n  got:      %x\n"+
+			"  expected: %x\n\n%v\n\nexpected:\n%v", v, w, e, got, expected)
+	}
+}
@@ -0,0 +1,12 @@
+// Package conformance has the conformance tests for the JSON API: a table of
+// canonical test vectors (record types, flags, and edge cases like CNAME
+// chains, TXT records with quotes and escapes, or IDN names), which go
+// through both directions of the proxy.
+//
+// For each one, we check the JSON the HTTPS-to-DNS server writes, and that
+// the reply the DNS client gets back through the DNS-to-HTTPS server is the
+// same, on the wire, as the one from the DNS server (minus what JSON can't
+// carry). They guard the translation against regressions when refactoring.
+//
+// There is no code here, just the tests.
+package conformance
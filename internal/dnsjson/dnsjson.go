@@ -15,6 +15,29 @@ type Response struct {
 	CD       bool // Whether the client asked to disable DNSSEC
 	Question []RR // Question we're responding to.
 	Answer   []RR // Answer to the question.
+
+	// Authority and additional sections. We don't use them, but some
+	// servers include them, and we want to know when they do (see
+	// httpresolver's fidelity.go).
+	Authority  []RR `json:",omitempty"`
+	Additional []RR `json:",omitempty"`
+
+	// Metadata about how the response was obtained. Not part of the API,
+	// and only included by servers configured to.
+	Metadata *Metadata `json:",omitempty"`
+}
+
+// Metadata describes how a response was obtained, for debugging. It's an
+// extension (only dnss uses it), so clients must not rely on it being there.
+type Metadata struct {
+	Upstream       string  `json:",omitempty"` // Upstream server used, if any.
+	ResponseTimeMs float64 // How long it took to get the response.
+	Validated      bool    // Whether the upstream validated it (set AD).
+	Truncated      bool    // Whether the response was truncated.
+
+	// Whether the upstream truncated its response over UDP, and it was
+	// retried over TCP.
+	RetriedTCP bool `json:",omitempty"`
 }
 
 // RR represents a JSON-encoded DNS RR.
@@ -0,0 +1,246 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Abandoned queries.
+
+// Clients give up on their queries when they take too long. Over TCP,
+// they close the connection; when that happens we cancel the work on its
+// queries (see util.Context), so a retry storm against a slow upstream
+// doesn't pile up HTTPS requests nobody is waiting for. (Over UDP, they
+// send them again, see duplicates.go.)
+//
+// To notice closed connections while their queries are being resolved, we
+// read from them in the background (see watchedConn). Clients which
+// half-close the connection after sending their queries look the same, but
+// they are rare.
+
+// Exported variables for statistics.
+var abandonStats = struct {
+	// Queries abandoned by their clients, by reason: "disconnected" (the
+	// client closed the TCP connection).
+	reasons *expvar.Map
+}{}
+
+func init() {
+	abandonStats.reasons = expvar.NewMap("dns-abandoned-queries")
+}
+
+// abandonTracker keeps track of the TCP connections, to cancel their queries
+// when their clients close them.
+type abandonTracker struct {
+	// Protects the fields below.
+	mu *sync.Mutex
+
+	// TCP connections, by their addresses (see connKey).
+	conns map[string]*watchedConn
+}
+
+func newAbandonTracker() *abandonTracker {
+	return &abandonTracker{
+		mu:    &sync.Mutex{},
+		conns: map[string]*watchedConn{},
+	}
+}
+
+// connKey returns the key of the connection with the given addresses.
+func connKey(local, remote net.Addr) string {
+	return local.String() + " " + remote.String()
+}
+
+// track returns the context for a query from the given client, which is
+// cancelled if the client abandons it, and a function to call when we are
+// done with it.
+func (t *abandonTracker) track(w dns.ResponseWriter) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if t == nil {
+		return ctx, cancel
+	}
+
+	t.mu.Lock()
+	c := t.conns[connKey(w.LocalAddr(), w.RemoteAddr())]
+	t.mu.Unlock()
+	if c == nil {
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-c.gone:
+			abandonStats.reasons.Add("disconnected", 1)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// watchListener wraps the TCP listener, so the connections it accepts are
+// watched (see watchedConn).
+func (t *abandonTracker) watchListener(l net.Listener) net.Listener {
+	if t == nil {
+		return l
+	}
+	return &watchListener{Listener: l, t: t}
+}
+
+type watchListener struct {
+	net.Listener
+	t *abandonTracker
+}
+
+func (l *watchListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &watchedConn{
+		Conn: conn,
+		t:    l.t,
+		gone: make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.readAhead()
+	return c, nil
+}
+
+// Maximum amount of data to read ahead from a connection: one query of the
+// largest size, with its length prefix. Beyond it we stop reading, so we
+// can't tell if the client goes away.
+const maxReadAhead = 2 + 65535
+
+// watchedConn is a connection which reads ahead in the background, to
+// notice (via gone) when the client closes it, even while we are busy
+// resolving its queries. As the underlying connection is always being read,
+// it implements the read deadlines itself.
+type watchedConn struct {
+	net.Conn
+	t *abandonTracker
+
+	// Closed when the client closes the connection (or reading from it
+	// fails).
+	gone chan struct{}
+
+	// Protects the fields below, and cond signals their changes.
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Data read ahead, and the error that ended the reading (if any).
+	buf []byte
+	err error
+
+	readDeadline time.Time
+	closed       bool
+}
+
+// readAhead reads from the connection until it's closed, or there's an error.
+func (c *watchedConn) readAhead() {
+	// The addresses may not be known until we start reading (see
+	// proxyproto), and no queries can come before we read them, so
+	// registering here is early enough.
+	key := connKey(c.LocalAddr(), c.RemoteAddr())
+	c.t.mu.Lock()
+	c.t.conns[key] = c
+	c.t.mu.Unlock()
+	defer func() {
+		c.t.mu.Lock()
+		delete(c.t.conns, key)
+		c.t.mu.Unlock()
+	}()
+
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Conn.Read(b)
+
+		c.mu.Lock()
+		c.buf = append(c.buf, b[:n]...)
+		if err != nil {
+			c.err = err
+			close(c.gone)
+		}
+		c.cond.Broadcast()
+		for err == nil && !c.closed && len(c.buf) >= maxReadAhead {
+			c.cond.Wait()
+		}
+		closed := c.closed
+		c.mu.Unlock()
+
+		if err != nil || closed {
+			return
+		}
+	}
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.readDeadline.IsZero() {
+		// Wake up at the deadline, to check it.
+		timer := time.AfterFunc(time.Until(c.readDeadline), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for len(c.buf) == 0 && c.err == nil && !c.closed {
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		c.cond.Broadcast()
+		return n, nil
+	}
+	if c.closed {
+		return 0, errClosedConn
+	}
+	return 0, c.err
+}
+
+func (c *watchedConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *watchedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *watchedConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// timeoutError is returned by watchedConn.Read when the deadline passes.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// errClosedConn is returned by watchedConn.Read after it was closed.
+var errClosedConn = errors.New("use of closed network connection")
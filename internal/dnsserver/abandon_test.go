@@ -0,0 +1,141 @@
+package dnsserver
+
+// Tests for the cancellation of abandoned queries.
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// connWriter is a recordingWriter for queries which came over the given
+// connection.
+type connWriter struct {
+	recordingWriter
+	conn net.Conn
+}
+
+func (w *connWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *connWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+// blockingResolver blocks the queries until they are abandoned, or the
+// channel is closed.
+type blockingResolver struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingResolver) Init() error { return nil }
+func (r *blockingResolver) Maintain()   {}
+func (r *blockingResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	r.started <- struct{}{}
+	select {
+	case <-util.Context(tr).Done():
+		return nil, util.Context(tr).Err()
+	case <-r.release:
+	}
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	return reply, nil
+}
+
+func waitDone(t *testing.T, ctx context.Context) {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context not cancelled")
+	}
+}
+
+func TestWatchedConn(t *testing.T) {
+	at := newAbandonTracker()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l := at.watchListener(ln)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	defer conn.Close()
+
+	// Reads work as usual, including the deadlines.
+	client.Write([]byte("hello"))
+	buf := make([]byte, 10)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = conn.Read(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// A query arrives, and the client goes away while we resolve it.
+	w := &connWriter{conn: conn}
+	ctx, done := at.track(w)
+	defer done()
+	if ctx.Err() != nil {
+		t.Errorf("context cancelled too early")
+	}
+	client.Close()
+	waitDone(t, ctx)
+}
+
+func TestAbandonedNotReplied(t *testing.T) {
+	res := &blockingResolver{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	srv := New("", res, "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l := srv.listenerFor(ln)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	defer conn.Close()
+
+	// Wait for the connection to be watched.
+	client.Write([]byte("x"))
+	conn.Read(make([]byte, 1))
+
+	w := &connWriter{conn: conn}
+	handled := make(chan struct{})
+	go func() {
+		srv.Handler(w, newQuery("example.com.", dns.TypeA))
+		close(handled)
+	}()
+	<-res.started
+
+	// The client goes away, so the query is cancelled, and not replied to.
+	client.Close()
+	<-handled
+	if w.reply != nil {
+		t.Errorf("abandoned query got a reply: %v", w.reply)
+	}
+}
@@ -0,0 +1,225 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/blocklist"
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/dnss/internal/webhook"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Compiled blocklists resolver.
+
+// blocklistResolver implements a Resolver which replies NXDOMAIN to the
+// queries for the domains in compiled blocklists (see the blocklist
+// package), and passes the rest to the backing resolver.
+//
+// The lists are used straight from the files, so they take almost no heap
+// even when they are huge. When a file is replaced (by compiling it again),
+// the new one is loaded; if that fails, the previous one is kept.
+type blocklistResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// The compiled lists.
+	paths []string
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// mu protects the lists, so they are not closed while in use.
+	mu    *sync.RWMutex
+	lists []*loadedBlocklist
+
+	negativeReplier
+}
+
+// loadedBlocklist is a list, and the file it was loaded from, to notice when
+// it changes.
+type loadedBlocklist struct {
+	list *blocklist.List
+	fi   os.FileInfo
+}
+
+// NewBlocklistResolver returns a new resolver which blocks the domains in
+// the given compiled blocklists, and passes the rest to the given resolver.
+func NewBlocklistResolver(back Resolver, paths []string) *blocklistResolver {
+	return &blocklistResolver{
+		back:  back,
+		paths: paths,
+		clock: util.RealClock,
+		mu:    &sync.RWMutex{},
+		lists: make([]*loadedBlocklist, len(paths)),
+
+		negativeReplier: newNegativeReplier(),
+	}
+}
+
+// How often to check if the lists have changed, declared as a variable so
+// we can tweak it for testing.
+var blocklistCheckPeriod = 1 * time.Minute
+
+// Exported variables for statistics.
+var blocklistStats = struct {
+	// Number of domains in the lists.
+	entries *expvar.Int
+
+	// Queries that were blocked.
+	matches *expvar.Int
+
+	// Failed reloads.
+	loadErrors *expvar.Int
+}{}
+
+func init() {
+	blocklistStats.entries = expvar.NewInt("blocklist-entries")
+	blocklistStats.matches = expvar.NewInt("blocklist-matches")
+	blocklistStats.loadErrors = expvar.NewInt("blocklist-load-errors")
+}
+
+// load the lists whose files have changed since the last time (all of them,
+// the first time). Lists which fail to load are left as they were.
+func (r *blocklistResolver) load() error {
+	var err error
+	for i, path := range r.paths {
+		fi, serr := os.Stat(path)
+		if serr != nil {
+			err = serr
+			continue
+		}
+
+		r.mu.RLock()
+		prev := r.lists[i]
+		r.mu.RUnlock()
+		if prev != nil && os.SameFile(prev.fi, fi) &&
+			prev.fi.ModTime().Equal(fi.ModTime()) {
+			continue
+		}
+
+		l, lerr := blocklist.Open(path)
+		if lerr != nil {
+			err = lerr
+			continue
+		}
+		log.Infof("Blocklist %q: loaded %d domains", path, l.Len())
+
+		r.mu.Lock()
+		r.lists[i] = &loadedBlocklist{list: l, fi: fi}
+		r.mu.Unlock()
+		if prev != nil {
+			prev.list.Close()
+		}
+	}
+
+	r.mu.RLock()
+	entries := 0
+	for _, l := range r.lists {
+		if l != nil {
+			entries += l.list.Len()
+		}
+	}
+	r.mu.RUnlock()
+	blocklistStats.entries.Set(int64(entries))
+
+	if err != nil {
+		blocklistStats.loadErrors.Add(1)
+	}
+	return err
+}
+
+// RegisterDebugHandlers registers http debug handlers, which can be accessed
+// from the monitoring server.
+// Note these are global by nature, if you try to register them multiple
+// times, you will get a panic.
+func (r *blocklistResolver) RegisterDebugHandlers() {
+	http.HandleFunc("/debug/dnsserver/blocklists", r.HandleStatus)
+}
+
+// HandleStatus shows the lists, and when they were loaded.
+func (r *blocklistResolver) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for i, path := range r.paths {
+		l := r.lists[i]
+		if l == nil {
+			fmt.Fprintf(w, "%s\n  not loaded\n\n", path)
+			continue
+		}
+		fmt.Fprintf(w, "%s\n  %d domains, modified %v\n\n",
+			path, l.list.Len(), l.fi.ModTime())
+	}
+}
+
+func (r *blocklistResolver) Init() error {
+	if err := r.load(); err != nil {
+		return fmt.Errorf("error loading the blocklists: %v", err)
+	}
+
+	return r.back.Init()
+}
+
+func (r *blocklistResolver) Maintain() {
+	go r.back.Maintain()
+
+	r.clock.Every(blocklistCheckPeriod, func() {
+		if err := r.load(); err != nil {
+			log.Errorf("Blocklist reload failed, keeping the previous"+
+				" one: %v", err)
+			webhook.Notify(webhook.BlocklistFailed, "",
+				"blocklist reload failed, keeping the previous one: %v", err)
+		}
+	})
+}
+
+// blocked returns the entry of the lists that matches the name (the name
+// itself, or one of its parents), if any.
+func (r *blocklistResolver) blocked(name string) (string, bool) {
+	name = util.CanonicalName(name)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, l := range r.lists {
+		if l == nil {
+			continue
+		}
+		if entry, ok := l.list.Match(name); ok {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+func (r *blocklistResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return r.back.Query(req, tr)
+	}
+	entry, ok := r.blocked(req.Question[0].Name)
+	if !ok {
+		return r.back.Query(req, tr)
+	}
+	if blockingPaused() {
+		tr.LazyPrintf("blocklist: blocked, but the blocking is paused")
+		return r.back.Query(req, tr)
+	}
+
+	tr.LazyPrintf("blocklist: blocked by %q", entry)
+	blocklistStats.matches.Add(1)
+
+	// The denial covers the whole listed subtree, so that's the zone the SOA
+	// is for.
+	return r.negativeReply(req, dns.RcodeNameError, entry), nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &blocklistResolver{}
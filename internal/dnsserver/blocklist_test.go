@@ -0,0 +1,222 @@
+package dnsserver
+
+// Tests for the compiled blocklists resolver.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/blocklist"
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+func writeTestBlocklist(t *testing.T, path string, names ...string) {
+	t.Helper()
+	b := blocklist.NewBuilder()
+	for _, name := range names {
+		b.Add(name)
+	}
+	if err := b.WriteFile(path); err != nil {
+		t.Fatalf("error writing the blocklist: %v", err)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.dnssbl")
+	writeTestBlocklist(t, path, "ads.example")
+
+	back := testutil.NewTestResolver()
+	back.Response = &dns.Msg{}
+	r := NewBlocklistResolver(back, []string{path})
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	query := func(name string) *dns.Msg {
+		t.Helper()
+		tr := testutil.NewTestTrace(t)
+		defer tr.Finish()
+		back.LastQuery = nil
+		reply, err := r.Query(newQuery(name, dns.TypeA), tr)
+		if err != nil {
+			t.Fatalf("%q: query error: %v", name, err)
+		}
+		return reply
+	}
+
+	for _, name := range []string{"ads.example.", "Sub.ADS.example."} {
+		if reply := query(name); reply.Rcode != dns.RcodeNameError ||
+			back.LastQuery != nil {
+			t.Errorf("%q was not blocked: %v", name, reply)
+		} else if len(reply.Ns) != 1 ||
+			reply.Ns[0].Header().Name != "ads.example." {
+			t.Errorf("%q: expected an SOA for the listed name, got %v",
+				name, reply.Ns)
+		}
+	}
+	if query("ok.example."); back.LastQuery == nil {
+		t.Errorf("ok.example. was not passed through")
+	}
+
+	// A new version of the list replaces the old one.
+	writeTestBlocklist(t, path, "ok.example")
+	if err := r.load(); err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if query("ok.example."); back.LastQuery != nil {
+		t.Errorf("new list not loaded")
+	}
+	if query("ads.example."); back.LastQuery == nil {
+		t.Errorf("old list still in use")
+	}
+
+	// And a broken one is not used.
+	ioutil.WriteFile(path+".tmp", []byte("garbage"), 0644)
+	os.Rename(path+".tmp", path)
+	if err := r.load(); err == nil {
+		t.Errorf("broken list loaded without errors")
+	}
+	if query("ok.example."); back.LastQuery != nil {
+		t.Errorf("previous list not kept")
+	}
+}
+
+func TestBlockingPause(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.dnssbl")
+	writeTestBlocklist(t, path, "ads.example")
+
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer func(c util.Clock) { blockingPause.clock = c }(blockingPause.clock)
+	blockingPause.clock = clock
+	defer ResumeBlocking()
+
+	back := testutil.NewTestResolver()
+	back.Response = &dns.Msg{}
+	r := NewBlocklistResolver(back, []string{path})
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	blocked := func() bool {
+		t.Helper()
+		tr := testutil.NewTestTrace(t)
+		defer tr.Finish()
+		back.LastQuery = nil
+		if _, err := r.Query(newQuery("ads.example.", dns.TypeA), tr); err != nil {
+			t.Fatalf("query error: %v", err)
+		}
+		return back.LastQuery == nil
+	}
+
+	PauseBlocking(10 * time.Minute)
+	if until := BlockingPausedUntil(); !until.Equal(clock.Now().Add(10 * time.Minute)) {
+		t.Errorf("unexpected pause end: %v", until)
+	}
+	if blocked() {
+		t.Errorf("blocked while paused")
+	}
+
+	clock.Advance(10 * time.Minute)
+	if !blocked() || !BlockingPausedUntil().IsZero() {
+		t.Errorf("pause did not end")
+	}
+
+	PauseBlocking(time.Hour)
+	ResumeBlocking()
+	if !blocked() {
+		t.Errorf("not blocked after resuming")
+	}
+}
+
+// Memory benchmarks: load a blocklist of b.N domains as an RPZ zone, and as
+// a compiled blocklist, and report how much heap each domain takes. Run
+// them with:
+//   go test -run=NONE -bench=BlocklistMemory -benchtime=100000x ./internal/dnsserver/
+
+func BenchmarkBlocklistMemoryRPZ(b *testing.B) {
+	rrs := []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{Name: "rpz.test.", Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: 300},
+		Ns: "ns.rpz.test.", Mbox: "admin.rpz.test.", Minttl: 60,
+	}}
+	for i := 0; i < b.N; i++ {
+		rrs = append(rrs, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name: fmt.Sprintf("host%d.domain%d.example.rpz.test.",
+					i, i%1000),
+				Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: ".",
+		})
+	}
+
+	var policy *rpzPolicy
+	benchBlocklistMemory(b, func() {
+		var err error
+		policy, err = newRPZZonePolicy(rrs)
+		if err != nil {
+			b.Fatalf("error loading the policy: %v", err)
+		}
+	})
+	runtime.KeepAlive(rrs)
+	runtime.KeepAlive(policy)
+}
+
+func BenchmarkBlocklistMemoryCompiled(b *testing.B) {
+	dir, err := ioutil.TempDir("", "blocklist_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.dnssbl")
+
+	builder := blocklist.NewBuilder()
+	for i := 0; i < b.N; i++ {
+		builder.Add(fmt.Sprintf("host%d.domain%d.example", i, i%1000))
+	}
+	if err := builder.WriteFile(path); err != nil {
+		b.Fatalf("error writing the blocklist: %v", err)
+	}
+	builder = nil
+
+	var l *blocklist.List
+	benchBlocklistMemory(b, func() {
+		l, err = blocklist.Open(path)
+		if err != nil {
+			b.Fatalf("error opening the blocklist: %v", err)
+		}
+	})
+	l.Close()
+}
+
+func benchBlocklistMemory(b *testing.B, load func()) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+
+	load()
+
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.Logf("%d domains: %d bytes/domain", b.N,
+		(int64(after.HeapAlloc)-int64(before.HeapAlloc))/int64(b.N))
+}
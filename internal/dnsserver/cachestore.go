@@ -0,0 +1,351 @@
+package dnsserver
+
+import (
+	"container/list"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Cache stores and eviction policies.
+
+// cacheStore is a bounded collection of cached answers, which evicts entries
+// according to some policy when it's full.
+// They are not safe for concurrent use.
+type cacheStore interface {
+	// get returns the answer for the question, and counts it as a use.
+	get(q dns.Question) (*packedAnswer, bool)
+
+	// set the answer for the question, evicting entries if needed. It
+	// returns the number of evicted entries.
+	set(q dns.Question, ans *packedAnswer) int
+
+	// contains returns true if the question is in the store, without
+	// counting it as a use.
+	contains(q dns.Question) bool
+
+	// update the answer for the question, if present, without counting it
+	// as a use.
+	update(q dns.Question, ans *packedAnswer)
+
+	// remove the question from the store.
+	remove(q dns.Question)
+
+	// len returns the number of cached answers.
+	len() int
+
+	// each calls f for every cached answer. f must not modify the store.
+	each(f func(q dns.Question, ans *packedAnswer))
+}
+
+// Supported eviction policies.
+var cacheStores = map[string]func(size int) cacheStore{
+	"lru": newLRUStore,
+	"arc": newARCStore,
+}
+
+// ValidCachePolicy returns an error if the given cache eviction policy is not
+// supported.
+func ValidCachePolicy(policy string) error {
+	if _, ok := cacheStores[policy]; !ok {
+		return fmt.Errorf("unknown policy %q (expected lru or arc)", policy)
+	}
+	return nil
+}
+
+// qentry is an entry in a qlist.
+type qentry struct {
+	q   dns.Question
+	ans *packedAnswer
+}
+
+// qlist is a list of entries ordered by recency (most recent first), indexed
+// by question.
+type qlist struct {
+	l *list.List
+	m map[dns.Question]*list.Element
+}
+
+func newQList() *qlist {
+	return &qlist{
+		l: list.New(),
+		m: map[dns.Question]*list.Element{},
+	}
+}
+
+func (l *qlist) len() int {
+	return l.l.Len()
+}
+
+func (l *qlist) lookup(q dns.Question) (*qentry, bool) {
+	e, ok := l.m[q]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*qentry), true
+}
+
+// touch moves the entry for q to the front, and returns whether it was
+// present.
+func (l *qlist) touch(q dns.Question) bool {
+	e, ok := l.m[q]
+	if ok {
+		l.l.MoveToFront(e)
+	}
+	return ok
+}
+
+func (l *qlist) pushFront(q dns.Question, ans *packedAnswer) {
+	l.m[q] = l.l.PushFront(&qentry{q, ans})
+}
+
+func (l *qlist) remove(q dns.Question) (*qentry, bool) {
+	e, ok := l.m[q]
+	if !ok {
+		return nil, false
+	}
+	l.l.Remove(e)
+	delete(l.m, q)
+	return e.Value.(*qentry), true
+}
+
+func (l *qlist) removeOldest() *qentry {
+	e := l.l.Back()
+	if e == nil {
+		return nil
+	}
+	qe := e.Value.(*qentry)
+	l.remove(qe.q)
+	return qe
+}
+
+func (l *qlist) each(f func(q dns.Question, ans *packedAnswer)) {
+	for e := l.l.Front(); e != nil; e = e.Next() {
+		qe := e.Value.(*qentry)
+		f(qe.q, qe.ans)
+	}
+}
+
+// lruStore is a cacheStore which evicts the least recently used entries.
+type lruStore struct {
+	size    int
+	entries *qlist
+}
+
+func newLRUStore(size int) cacheStore {
+	return &lruStore{size: size, entries: newQList()}
+}
+
+func (s *lruStore) get(q dns.Question) (*packedAnswer, bool) {
+	qe, ok := s.entries.lookup(q)
+	if !ok {
+		return nil, false
+	}
+	s.entries.touch(q)
+	return qe.ans, true
+}
+
+func (s *lruStore) set(q dns.Question, ans *packedAnswer) int {
+	if s.size <= 0 {
+		return 0
+	}
+
+	if qe, ok := s.entries.lookup(q); ok {
+		qe.ans = ans
+		s.entries.touch(q)
+		return 0
+	}
+
+	evicted := 0
+	for s.entries.len() >= s.size {
+		s.entries.removeOldest()
+		evicted++
+	}
+	s.entries.pushFront(q, ans)
+	return evicted
+}
+
+func (s *lruStore) contains(q dns.Question) bool {
+	_, ok := s.entries.lookup(q)
+	return ok
+}
+
+func (s *lruStore) update(q dns.Question, ans *packedAnswer) {
+	if qe, ok := s.entries.lookup(q); ok {
+		qe.ans = ans
+	}
+}
+
+func (s *lruStore) remove(q dns.Question) {
+	s.entries.remove(q)
+}
+
+func (s *lruStore) len() int {
+	return s.entries.len()
+}
+
+func (s *lruStore) each(f func(q dns.Question, ans *packedAnswer)) {
+	s.entries.each(f)
+}
+
+// arcStore is a cacheStore which implements the Adaptive Replacement Cache
+// policy, as described in "ARC: A Self-Tuning, Low Overhead Replacement
+// Cache" (Megiddo and Modha, 2003).
+//
+// It keeps recently used entries (seen once) and frequently used entries
+// (seen at least twice) in separate lists, and tracks the questions recently
+// evicted from each of them to adapt their relative sizes. This makes it
+// resistant to scans, like a flood of queries for random names.
+type arcStore struct {
+	// Maximum number of cached answers.
+	size int
+
+	// Target size for t1.
+	p int
+
+	// Cached entries seen once (t1), and at least twice (t2).
+	t1, t2 *qlist
+
+	// "Ghost" entries recently evicted from t1 and t2; we only keep the
+	// questions.
+	b1, b2 *qlist
+}
+
+func newARCStore(size int) cacheStore {
+	return &arcStore{
+		size: size,
+		t1:   newQList(),
+		t2:   newQList(),
+		b1:   newQList(),
+		b2:   newQList(),
+	}
+}
+
+func (s *arcStore) get(q dns.Question) (*packedAnswer, bool) {
+	if qe, ok := s.t1.remove(q); ok {
+		s.t2.pushFront(q, qe.ans)
+		return qe.ans, true
+	}
+	if qe, ok := s.t2.lookup(q); ok {
+		s.t2.touch(q)
+		return qe.ans, true
+	}
+	return nil, false
+}
+
+func (s *arcStore) set(q dns.Question, ans *packedAnswer) int {
+	if s.size <= 0 {
+		return 0
+	}
+
+	// Already cached: update it, and count it as a use.
+	if _, ok := s.t1.remove(q); ok {
+		s.t2.pushFront(q, ans)
+		return 0
+	}
+	if qe, ok := s.t2.lookup(q); ok {
+		qe.ans = ans
+		s.t2.touch(q)
+		return 0
+	}
+
+	// Recently evicted from t1: we should have kept more recent entries.
+	if _, ok := s.b1.remove(q); ok {
+		s.p = min(s.size, s.p+max(s.b2.len()/max(s.b1.len(), 1), 1))
+		evicted := s.replace(false)
+		s.t2.pushFront(q, ans)
+		return evicted
+	}
+
+	// Recently evicted from t2: we should have kept more frequent entries.
+	if _, ok := s.b2.remove(q); ok {
+		s.p = max(0, s.p-max(s.b1.len()/max(s.b2.len(), 1), 1))
+		evicted := s.replace(true)
+		s.t2.pushFront(q, ans)
+		return evicted
+	}
+
+	// Completely new entry.
+	evicted := 0
+	if s.t1.len()+s.b1.len() >= s.size {
+		if s.t1.len() < s.size {
+			s.b1.removeOldest()
+			evicted = s.replace(false)
+		} else {
+			s.t1.removeOldest()
+			evicted = 1
+		}
+	} else if total := s.t1.len() + s.t2.len() + s.b1.len() + s.b2.len(); total >= s.size {
+		if total >= 2*s.size {
+			s.b2.removeOldest()
+		}
+		evicted = s.replace(false)
+	}
+	s.t1.pushFront(q, ans)
+	return evicted
+}
+
+// replace evicts an entry from t1 or t2 (into its ghost list), if the cache
+// is full. inB2 is true if the entry being added was found in b2.
+func (s *arcStore) replace(inB2 bool) int {
+	if s.t1.len()+s.t2.len() < s.size {
+		return 0
+	}
+
+	t1len := s.t1.len()
+	if t1len > 0 && (t1len > s.p || (inB2 && t1len == s.p)) {
+		qe := s.t1.removeOldest()
+		s.b1.pushFront(qe.q, nil)
+	} else {
+		qe := s.t2.removeOldest()
+		s.b2.pushFront(qe.q, nil)
+	}
+	return 1
+}
+
+func (s *arcStore) contains(q dns.Question) bool {
+	_, ok1 := s.t1.lookup(q)
+	_, ok2 := s.t2.lookup(q)
+	return ok1 || ok2
+}
+
+func (s *arcStore) update(q dns.Question, ans *packedAnswer) {
+	if qe, ok := s.t1.lookup(q); ok {
+		qe.ans = ans
+	} else if qe, ok := s.t2.lookup(q); ok {
+		qe.ans = ans
+	}
+}
+
+func (s *arcStore) remove(q dns.Question) {
+	s.t1.remove(q)
+	s.t2.remove(q)
+}
+
+func (s *arcStore) len() int {
+	return s.t1.len() + s.t2.len()
+}
+
+func (s *arcStore) each(f func(q dns.Question, ans *packedAnswer)) {
+	s.t1.each(f)
+	s.t2.each(f)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Compile-time check that the implementations match the interface.
+var _ cacheStore = &lruStore{}
+var _ cacheStore = &arcStore{}
@@ -0,0 +1,174 @@
+package dnsserver
+
+// Tests for the cache stores.
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testQ(i int) dns.Question {
+	return dns.Question{
+		Name:   fmt.Sprintf("test%d.", i),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+}
+
+func checkCached(t *testing.T, s cacheStore, policy string, present, absent []int) {
+	t.Helper()
+	for _, i := range present {
+		if _, ok := s.get(testQ(i)); !ok {
+			t.Errorf("%s: %d should be cached", policy, i)
+		}
+	}
+	for _, i := range absent {
+		if _, ok := s.get(testQ(i)); ok {
+			t.Errorf("%s: %d should not be cached", policy, i)
+		}
+	}
+}
+
+func TestStoreBasic(t *testing.T) {
+	for policy, newStore := range cacheStores {
+		s := newStore(3)
+		for i := 0; i < 3; i++ {
+			if evicted := s.set(testQ(i), nil); evicted != 0 {
+				t.Errorf("%s: unexpected eviction on %d", policy, i)
+			}
+		}
+		if s.len() != 3 {
+			t.Errorf("%s: expected 3 entries, got %d", policy, s.len())
+		}
+
+		// Use 0, so 1 is the one evicted, in both policies.
+		checkCached(t, s, policy, []int{0}, nil)
+		if evicted := s.set(testQ(3), nil); evicted != 1 {
+			t.Errorf("%s: expected 1 eviction, got %d", policy, evicted)
+		}
+		checkCached(t, s, policy, []int{0, 2, 3}, []int{1})
+
+		s.remove(testQ(2))
+		checkCached(t, s, policy, []int{0, 3}, []int{2})
+		if s.len() != 2 {
+			t.Errorf("%s: expected 2 entries, got %d", policy, s.len())
+		}
+
+		// Updates replace the answer.
+		ans := &packedAnswer{}
+		s.update(testQ(0), ans)
+		if got, _ := s.get(testQ(0)); got != ans {
+			t.Errorf("%s: update did not replace the answer", policy)
+		}
+
+		// Updating something not in the cache should not add it.
+		s.update(testQ(10), ans)
+		checkCached(t, s, policy, nil, []int{10})
+
+		n := 0
+		s.each(func(dns.Question, *packedAnswer) { n++ })
+		if n != s.len() {
+			t.Errorf("%s: each returned %d entries, expected %d",
+				policy, n, s.len())
+		}
+	}
+}
+
+func TestStoreZeroSize(t *testing.T) {
+	for policy, newStore := range cacheStores {
+		s := newStore(0)
+		s.set(testQ(0), nil)
+		checkCached(t, s, policy, nil, []int{0})
+	}
+}
+
+func TestLRUOrder(t *testing.T) {
+	s := newLRUStore(3)
+	for i := 0; i < 3; i++ {
+		s.set(testQ(i), nil)
+	}
+	checkCached(t, s, "lru", []int{0, 1}, nil)
+
+	// 2 is the least recently used now.
+	s.set(testQ(3), nil)
+	checkCached(t, s, "lru", []int{0, 1, 3}, []int{2})
+}
+
+// Test that ARC keeps frequently used entries through a scan of entries which
+// are used only once, unlike LRU.
+func TestARCScanResistance(t *testing.T) {
+	for policy, newStore := range cacheStores {
+		s := newStore(10)
+
+		// Hot entries, used a few times.
+		for i := 0; i < 5; i++ {
+			s.set(testQ(i), nil)
+			s.get(testQ(i))
+		}
+
+		// A scan of entries used only once.
+		for i := 100; i < 200; i++ {
+			s.set(testQ(i), nil)
+		}
+
+		hot := 0
+		for i := 0; i < 5; i++ {
+			if _, ok := s.get(testQ(i)); ok {
+				hot++
+			}
+		}
+
+		if policy == "arc" && hot != 5 {
+			t.Errorf("arc: only %d hot entries survived the scan", hot)
+		} else if policy == "lru" && hot != 0 {
+			t.Errorf("lru: %d hot entries survived the scan", hot)
+		}
+		if s.len() > 10 {
+			t.Errorf("%s: store grew to %d entries", policy, s.len())
+		}
+	}
+}
+
+// Test that ARC adapts when the working set changes.
+func TestARCAdaptation(t *testing.T) {
+	s := newARCStore(4).(*arcStore)
+
+	// Fill t2 with frequently used entries.
+	for i := 0; i < 4; i++ {
+		s.set(testQ(i), nil)
+		s.get(testQ(i))
+	}
+
+	// Now switch to a new working set, used repeatedly: it should replace the
+	// old one.
+	for round := 0; round < 3; round++ {
+		for i := 10; i < 14; i++ {
+			if _, ok := s.get(testQ(i)); !ok {
+				s.set(testQ(i), nil)
+			}
+		}
+	}
+	checkCached(t, s, "arc", []int{10, 11, 12, 13}, nil)
+
+	total := s.t1.len() + s.t2.len() + s.b1.len() + s.b2.len()
+	if s.len() > 4 || total > 8 {
+		t.Errorf("arc: lists too big: t1:%d t2:%d b1:%d b2:%d",
+			s.t1.len(), s.t2.len(), s.b1.len(), s.b2.len())
+	}
+	if s.p < 0 || s.p > 4 {
+		t.Errorf("arc: p out of range: %d", s.p)
+	}
+}
+
+func TestValidCachePolicy(t *testing.T) {
+	for _, p := range []string{"lru", "arc"} {
+		if err := ValidCachePolicy(p); err != nil {
+			t.Errorf("%q: unexpected error: %v", p, err)
+		}
+	}
+	if err := ValidCachePolicy("fifo"); err == nil {
+		t.Errorf("expected error for unknown policy")
+	}
+}
@@ -4,14 +4,19 @@ package dnsserver
 
 import (
 	"fmt"
+	"math/rand"
+	"net/http/httptest"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"blitiri.com.ar/go/dnss/internal/testutil"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
 )
 
 //
@@ -53,6 +58,8 @@ func TestBasic(t *testing.T) {
 func TestTTL(t *testing.T) {
 	r := testutil.NewTestResolver()
 	c := NewCachingResolver(r)
+	clock := testutil.NewFakeClock(time.Now())
+	c.clock = clock
 	c.Init()
 	resetStats()
 
@@ -79,34 +86,40 @@ func TestTTL(t *testing.T) {
 		t.Errorf("expected max TTL (%v), got %v", maxTTL, ttl)
 	}
 
-	// To test that the TTL is reduced appropriately, set a small maintenance
-	// period, and then repeatedly query the record. We should see its TTL
-	// shrinking down within 1s.
-	// Even though the TTL resolution in the protocol is in seconds, we don't
-	// need to wait that much "thanks" to rounding artifacts.
-	maintenancePeriod = 50 * time.Millisecond
+	// Start the maintenance, and check that the back resolver's Maintain()
+	// is called.
 	go c.Maintain()
 	resetStats()
 
-	// Check that the back resolver's Maintain() is called.
 	select {
 	case <-r.MaintainC:
 		t.Log("Maintain() called")
 	case <-time.After(1 * time.Second):
 		t.Errorf("back resolver Maintain() was not called")
 	}
+	clock.WaitForTasks(1)
 
-	start := time.Now()
-	for time.Since(start) < 1*time.Second {
-		resp = queryA(t, c, "", "test.", "1.2.3.4")
-		t.Logf("TTL %v", getTTL(resp.Answer))
-		if ttl := getTTL(resp.Answer); ttl <= (maxTTL - 1*time.Second) {
-			break
-		}
-		time.Sleep(maintenancePeriod)
+	// Advancing the time must reduce the TTL accordingly.
+	clock.Advance(maintenancePeriod)
+	resp = queryA(t, c, "", "test.", "1.2.3.4")
+	if ttl := getTTL(resp.Answer); ttl != maxTTL-maintenancePeriod {
+		t.Errorf("expected %v, got %v", maxTTL-maintenancePeriod, ttl)
+	}
+
+	clock.Advance(10 * maintenancePeriod)
+	resp = queryA(t, c, "", "test.", "1.2.3.4")
+	if ttl := getTTL(resp.Answer); ttl != maxTTL-11*maintenancePeriod {
+		t.Errorf("expected %v, got %v", maxTTL-11*maintenancePeriod, ttl)
+	}
+	if !statsEquals(2, 2, 0) {
+		t.Errorf("bad stats: %v", dumpStats())
 	}
-	if ttl := getTTL(resp.Answer); ttl > (maxTTL - 1*time.Second) {
-		t.Errorf("expected maxTTL-1s, got %v", ttl)
+
+	// Once the TTL runs out, the entry must be gone.
+	clock.Advance(maxTTL)
+	queryA(t, c, "", "test.", "1.2.3.4")
+	if !statsEquals(3, 2, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
 	}
 }
 
@@ -129,10 +142,24 @@ func TestFailedQueries(t *testing.T) {
 	}
 }
 
-// Test that we handle the cache filling up.
-// Note this test is tied to the current behaviour of not doing any eviction
-// when we're full, which is not ideal and will likely be changed in the
-// future.
+// Test that truncated replies are not cached, as they're incomplete.
+func TestTruncatedNotCached(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	r.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	r.Response.Truncated = true
+	queryA(t, c, "", "test.", "1.2.3.4")
+	queryA(t, c, "", "test.", "1.2.3.4")
+	if !statsEquals(2, 0, 2) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+}
+
+// Test that we handle the cache filling up, by evicting the least recently
+// used entries.
 func TestCacheFull(t *testing.T) {
 	r := testutil.NewTestResolver()
 	c := NewCachingResolver(r)
@@ -149,36 +176,163 @@ func TestCacheFull(t *testing.T) {
 		}
 	}
 
-	// Query up to maxCacheSize, they should all be hits.
+	// Query from 1 up to maxCacheSize+1, they should all be hits.
 	resetStats()
-	for i := 0; i < maxCacheSize; i++ {
+	for i := 1; i < maxCacheSize+1; i++ {
 		queryA(t, c, "", fmt.Sprintf("test%d.", i), "1.2.3.4")
-		if !statsEquals(i+1, i+1, 0) {
+		if !statsEquals(i, i, 0) {
 			t.Errorf("bad stats: %v", dumpStats())
 		}
 	}
 
-	// Querying maxCacheSize+1 should be a miss, because the cache was full.
+	// Querying the first one should be a miss, because it was evicted to
+	// make room for the last one.
 	resetStats()
-	queryA(t, c, "", fmt.Sprintf("test%d.", maxCacheSize), "1.2.3.4")
+	queryA(t, c, "", "test0.", "1.2.3.4")
 	if !statsEquals(1, 0, 1) {
 		t.Errorf("bad stats: %v", dumpStats())
 	}
 }
 
-// Test behaviour when the size of the cache is 0 (so users can disable it
-// that way).
-func TestZeroSize(t *testing.T) {
+// Test that a partition filling up does not affect the others.
+func TestCachePartitions(t *testing.T) {
+	for _, policy := range []string{"lru", "arc"} {
+		r := testutil.NewTestResolver()
+		c := NewCachingResolver(r)
+		c.SetPolicy(policy)
+		c.SetPartitions(map[uint16]int{dns.TypeA: 10, dns.TypeNone: 5})
+		c.Init()
+		resetStats()
+
+		r.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+		queryA(t, c, "", "hot.", "1.2.3.4")
+
+		// Flood the other partition.
+		r.Response = newReply(mustNewRR(t, "test. TXT \"flood\""))
+		for i := 0; i < 50; i++ {
+			tr := testutil.NewTestTrace(t)
+			_, err := c.Query(newQuery(fmt.Sprintf("f%d.", i), dns.TypeTXT), tr)
+			if err != nil {
+				t.Fatalf("%s: query failed: %v", policy, err)
+			}
+			tr.Finish()
+		}
+		if n := c.other.len(); n != 5 {
+			t.Errorf("%s: other partition has %d entries, expected 5",
+				policy, n)
+		}
+
+		// The A entry should still be there.
+		resetStats()
+		r.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+		queryA(t, c, "", "hot.", "1.2.3.4")
+		if !statsEquals(1, 1, 0) {
+			t.Errorf("%s: bad stats: %v", policy, dumpStats())
+		}
+	}
+}
+
+func TestNumShards(t *testing.T) {
+	cases := []struct {
+		size, cpus, expected int
+	}{
+		{maxCacheSize, 64, 1},
+		{minShardSize, 64, 1},
+		{2 * minShardSize, 1, 1},
+		{2 * minShardSize, 2, 2},
+		{3 * minShardSize, 8, 2},
+		{100 * minShardSize, 6, 4},
+		{100 * minShardSize, 64, 64},
+	}
+	for _, c := range cases {
+		if n := numShards(c.size, c.cpus); n != c.expected {
+			t.Errorf("numShards(%d, %d) = %d, expected %d",
+				c.size, c.cpus, n, c.expected)
+		}
+	}
+}
+
+func TestShardedCache(t *testing.T) {
 	r := testutil.NewTestResolver()
 	c := NewCachingResolver(r)
+	c.other = newShardedPartition("other", 63, "lru", 4)
 	c.Init()
 	resetStats()
 
+	// The sizes of the shards must add up.
+	total := 0
+	for _, s := range c.other.shards {
+		total += s.size
+	}
+	if total != 63 {
+		t.Errorf("shard sizes add up to %d, expected 63", total)
+	}
+
+	r.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	for i := 0; i < 20; i++ {
+		queryA(t, c, "", fmt.Sprintf("test%d.", i), "1.2.3.4")
+	}
+	resetStats()
+	for i := 0; i < 20; i++ {
+		queryA(t, c, "", fmt.Sprintf("test%d.", i), "1.2.3.4")
+	}
+	if !statsEquals(20, 20, 0) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// The entries should be spread across the shards.
+	for i, s := range c.other.shards {
+		if s.store.len() == 0 {
+			t.Errorf("shard %d is empty", i)
+		}
+	}
+	if n := c.other.len(); n != 20 {
+		t.Errorf("expected 20 entries, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	c.DumpCache(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "20/63 entries") {
+		t.Errorf("unexpected dump: %q", w.Body.String())
+	}
+
+	c.FlushCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := c.other.len(); n != 0 {
+		t.Errorf("expected an empty cache after flush, got %d entries", n)
+	}
+}
+
+func TestParseCachePartitions(t *testing.T) {
+	sizes, err := ParseCachePartitions("A=100 aaaa=50 other=10")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[uint16]int{
+		dns.TypeA: 100, dns.TypeAAAA: 50, dns.TypeNone: 10}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("got %v, expected %v", sizes, expected)
+	}
+
+	for _, s := range []string{"A", "A=x", "A=-1", "BLAH=3", "A=1 A=2"} {
+		if _, err := ParseCachePartitions(s); err == nil {
+			t.Errorf("%q: expected error, got nil", s)
+		}
+	}
+}
+
+// Test behaviour when the size of the cache is 0 (so users can disable it
+// that way).
+func TestZeroSize(t *testing.T) {
 	// Override the max cache size to 0.
 	prevMaxCacheSize := maxCacheSize
 	maxCacheSize = 0
 	defer func() { maxCacheSize = prevMaxCacheSize }()
 
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
 	r.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
 
 	// Do 5 different requests.
@@ -199,6 +353,111 @@ func TestZeroSize(t *testing.T) {
 	}
 }
 
+// typeResolver answers queries with the records for their type, and counts
+// them. It's safe for concurrent use, unlike testutil.TestResolver.
+type typeResolver struct {
+	mu      sync.Mutex
+	answers map[uint16]dns.RR
+	queries map[uint16]int
+}
+
+func (r *typeResolver) Init() error { return nil }
+func (r *typeResolver) Maintain()   {}
+func (r *typeResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	qtype := req.Question[0].Qtype
+	r.queries[qtype]++
+	reply := newReply(dns.Copy(r.answers[qtype]))
+	reply.Question = req.Question
+	return reply, nil
+}
+
+func (r *typeResolver) count(qtype uint16) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries[qtype]
+}
+
+// waitForInflight waits until the cache has no queries in flight.
+func waitForInflight(t *testing.T, c *cachingResolver) {
+	t.Helper()
+	start := time.Now()
+	for time.Since(start) < 1*time.Second {
+		c.inflightMu.Lock()
+		n := len(c.inflight)
+		c.inflightMu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("queries still in flight")
+}
+
+// Test speculative queries for AAAA on A misses (and vice versa).
+func TestSpeculative(t *testing.T) {
+	r := &typeResolver{
+		answers: map[uint16]dns.RR{
+			dns.TypeA:    mustNewRR(t, "test. 3600 A 1.2.3.4"),
+			dns.TypeAAAA: mustNewRR(t, "test. 3600 AAAA 2001:db8::1"),
+			dns.TypeMX:   mustNewRR(t, "test. 3600 MX 10 mail.test."),
+		},
+		queries: map[uint16]int{},
+	}
+	c := NewCachingResolver(r)
+	c.SetSpeculative(true)
+	c.Init()
+	resetStats()
+
+	tr := testutil.NewTestTrace(t)
+	query := func(qtype uint16) {
+		t.Helper()
+		if _, err := c.Query(newQuery("test.", qtype), tr); err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+	}
+
+	// An A miss also gets the AAAA, so querying for it is a hit.
+	query(dns.TypeA)
+	waitForInflight(t, c)
+	query(dns.TypeAAAA)
+	if !statsEquals(2, 1, 1) || stats.cacheSpeculative.Value() != 1 {
+		t.Errorf("bad stats: %v, %v speculative",
+			dumpStats(), stats.cacheSpeculative)
+	}
+	if r.count(dns.TypeA) != 1 || r.count(dns.TypeAAAA) != 1 {
+		t.Errorf("unexpected upstream queries: %v", r.queries)
+	}
+
+	// Other types are not speculated on.
+	query(dns.TypeMX)
+	waitForInflight(t, c)
+	if stats.cacheSpeculative.Value() != 1 {
+		t.Errorf("unexpected speculative queries: %v",
+			stats.cacheSpeculative)
+	}
+
+	// Nothing is speculated when disabled.
+	c.SetSpeculative(false)
+	c.FlushCache(httptest.NewRecorder(), nil)
+	query(dns.TypeAAAA)
+	waitForInflight(t, c)
+	if stats.cacheSpeculative.Value() != 1 || r.count(dns.TypeA) != 1 {
+		t.Errorf("unexpected speculative queries: %v",
+			stats.cacheSpeculative)
+	}
+
+	// Nor when the sibling is already cached (the AAAA, from above).
+	c.SetSpeculative(true)
+	c.Query(newQuery("test.", dns.TypeA), tr)
+	waitForInflight(t, c)
+	if stats.cacheSpeculative.Value() != 1 || r.count(dns.TypeAAAA) != 2 {
+		t.Errorf("unexpected speculative queries: %v",
+			stats.cacheSpeculative)
+	}
+}
+
 //
 // === Benchmarks ===
 //
@@ -224,6 +483,107 @@ func BenchmarkCacheSimple(b *testing.B) {
 	}
 }
 
+// Mixed workload on a cache of 200 entries: A queries for 1000 names, with a
+// Zipf distribution (so some are much more popular than others), interleaved
+// with a flood of unique TXT queries (which will never be hits).
+func benchmarkCacheMixed(b *testing.B, policy string, partitions map[uint16]int) {
+	prevMaxCacheSize := maxCacheSize
+	maxCacheSize = 200
+	defer func() { maxCacheSize = prevMaxCacheSize }()
+
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.SetPolicy(policy)
+	if partitions != nil {
+		c.SetPartitions(partitions)
+	}
+	c.Init()
+
+	aReply := newReply(mustNewRR(b, "test. A 1.2.3.4"))
+	txtReply := newReply(mustNewRR(b, "test. TXT \"flood\""))
+	tr := &testutil.NullTrace{}
+	resetStats()
+
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 999)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var req *dns.Msg
+		if i%2 == 0 {
+			r.Response = aReply
+			req = newQuery(fmt.Sprintf("a%d.", zipf.Uint64()), dns.TypeA)
+		} else {
+			r.Response = txtReply
+			req = newQuery(fmt.Sprintf("flood%d.", i), dns.TypeTXT)
+		}
+		if _, err := c.Query(req, tr); err != nil {
+			b.Errorf("query failed: %v", err)
+		}
+	}
+	b.StopTimer()
+
+	b.Logf("%s %v: %d queries, hits: %s (by type: %s)", policy, partitions,
+		b.N, stats.cacheHits, stats.cacheHitsByType)
+}
+
+func BenchmarkCacheMixedLRU(b *testing.B) {
+	benchmarkCacheMixed(b, "lru", nil)
+}
+
+func BenchmarkCacheMixedARC(b *testing.B) {
+	benchmarkCacheMixed(b, "arc", nil)
+}
+
+func BenchmarkCacheMixedPartitionedLRU(b *testing.B) {
+	benchmarkCacheMixed(b, "lru",
+		map[uint16]int{dns.TypeA: 150, dns.TypeNone: 50})
+}
+
+func BenchmarkCacheMixedPartitionedARC(b *testing.B) {
+	benchmarkCacheMixed(b, "arc",
+		map[uint16]int{dns.TypeA: 150, dns.TypeNone: 50})
+}
+
+// Lock contention: parallel queries (all hits) on a large cache, with
+// different numbers of shards. Run them with -cpu to see how they scale:
+//
+//	go test -run=NONE -bench=CacheContention -cpu=1,4,16 ./internal/dnsserver/
+func BenchmarkCacheContention(b *testing.B) {
+	const names = 10000
+
+	var reqs []*dns.Msg
+	for i := 0; i < names; i++ {
+		reqs = append(reqs, newQuery(fmt.Sprintf("test%d.", i), dns.TypeA))
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		r := testutil.NewTestResolver()
+		r.Response = newReply(mustNewRR(b, "test. 3600 A 1.2.3.4"))
+		c := NewCachingResolver(r)
+		c.other = newShardedPartition("other", 2*names, "lru", shards)
+		c.Init()
+
+		tr := &testutil.NullTrace{}
+		for _, req := range reqs {
+			if _, err := c.Query(req, tr); err != nil {
+				b.Fatalf("query failed: %v", err)
+			}
+		}
+
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(rand.Int63()))
+				tr := &testutil.NullTrace{}
+				for pb.Next() {
+					req := reqs[rnd.Intn(names)]
+					if _, err := c.Query(req, tr); err != nil {
+						b.Errorf("query failed: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
 //
 // === Helpers ===
 //
@@ -234,6 +594,10 @@ func resetStats() {
 	stats.cacheHits.Set(0)
 	stats.cacheMisses.Set(0)
 	stats.cacheRecorded.Set(0)
+	stats.cacheEvicted.Set(0)
+	stats.cacheHitsByType.Init()
+	stats.cacheMissesByType.Init()
+	stats.cacheSpeculative.Set(0)
 }
 
 func statsEquals(total, hits, misses int) bool {
@@ -0,0 +1,70 @@
+package dnsserver
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Client identification options.
+
+// Some providers can apply per-device policies, if the queries say which
+// device they come from. There is no standard for it, but dnsmasq's EDNS
+// options are widely understood: the client's MAC address (--add-mac), and
+// an opaque identifier (--add-cpe-id), which we use for the client's name.
+//
+// As they identify the devices on the local network to a third party, this
+// is strictly opt-in: unless enabled, these options are removed from the
+// queries, so not even a downstream dnsmasq can send them upstream through
+// us by accident.
+//
+// Only the DoH protocol carries the EDNS options; the JSON API can't.
+const (
+	ednsMACOption   = 65001
+	ednsCPEIDOption = 65074
+)
+
+// SetClientID enables sending the clients' identity upstream: the MAC and
+// CPE-ID options in the queries are passed through, and if names is not nil,
+// queries without a CPE-ID get one with the name it returns for the client
+// (if any).
+func (s *Server) SetClientID(names func(net.IP) string) {
+	s.clientID = true
+	s.clientNames = names
+}
+
+// handleClientID removes the client identification options from the query,
+// or adds the client's name, depending on the configuration.
+func (s *Server) handleClientID(r *dns.Msg, client net.IP, tr trace.Trace) {
+	if !s.clientID {
+		for _, code := range []uint16{ednsMACOption, ednsCPEIDOption} {
+			for takeOption(r, code) != nil {
+				tr.LazyPrintf("removed client id option %d", code)
+			}
+		}
+		return
+	}
+
+	// Only queries with EDNS, as adding an OPT record to the others would
+	// also give the client one in the reply, which it didn't ask for.
+	opt := r.IsEdns0()
+	if s.clientNames == nil || opt == nil || client == nil {
+		return
+	}
+	if replyOption(r, ednsCPEIDOption) != nil {
+		// Given by the client (usually, a downstream dnsmasq).
+		return
+	}
+
+	name := s.clientNames(client)
+	if name == "" {
+		return
+	}
+	tr.LazyPrintf("client id: %q", name)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: ednsCPEIDOption,
+		Data: []byte(name),
+	})
+}
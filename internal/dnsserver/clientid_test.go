@@ -0,0 +1,82 @@
+package dnsserver
+
+// Tests for the client identification options.
+
+import (
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func clientIDMsg(edns bool, options ...dns.EDNS0) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion("example.com.", dns.TypeA)
+	if edns {
+		m.SetEdns0(1232, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, options...)
+	}
+	return m
+}
+
+func cpeID(m *dns.Msg) string {
+	if o, ok := replyOption(m, ednsCPEIDOption).(*dns.EDNS0_LOCAL); ok {
+		return string(o.Data)
+	}
+	return ""
+}
+
+func TestClientID(t *testing.T) {
+	mac := &dns.EDNS0_LOCAL{Code: ednsMACOption,
+		Data: []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}}
+	given := &dns.EDNS0_LOCAL{Code: ednsCPEIDOption, Data: []byte("given")}
+	client := net.ParseIP("192.168.1.10")
+	tr := testutil.NewTestTrace(t)
+
+	// Disabled by default: the options are removed.
+	s := New("", nil, "")
+	m := clientIDMsg(true, mac, given)
+	s.handleClientID(m, client, tr)
+	if len(m.IsEdns0().Option) != 0 {
+		t.Errorf("client id options not removed: %v", m.IsEdns0().Option)
+	}
+
+	s.SetClientID(func(ip net.IP) string {
+		if ip.Equal(client) {
+			return "laptop"
+		}
+		return ""
+	})
+
+	// The ones given by the client are passed through.
+	m = clientIDMsg(true, mac, given)
+	s.handleClientID(m, client, tr)
+	if replyOption(m, ednsMACOption) == nil || cpeID(m) != "given" {
+		t.Errorf("client id options not passed through: %v",
+			m.IsEdns0().Option)
+	}
+
+	// Otherwise, we add the client's name.
+	m = clientIDMsg(true)
+	s.handleClientID(m, client, tr)
+	if cpeID(m) != "laptop" {
+		t.Errorf("client name not added: %v", m.IsEdns0().Option)
+	}
+
+	// Unless we don't know it.
+	m = clientIDMsg(true)
+	s.handleClientID(m, net.ParseIP("192.168.1.99"), tr)
+	if len(m.IsEdns0().Option) != 0 {
+		t.Errorf("unexpected options: %v", m.IsEdns0().Option)
+	}
+
+	// Queries without EDNS don't get it.
+	m = clientIDMsg(false)
+	s.handleClientID(m, client, tr)
+	if m.IsEdns0() != nil {
+		t.Errorf("OPT record added to a query without EDNS")
+	}
+}
@@ -0,0 +1,196 @@
+package dnsserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"expvar"
+	"net"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// DNS cookies (RFC 7873).
+
+// cookieChecker generates and verifies server cookies, which let clients
+// that support them detect spoofed replies, and let us know which queries
+// come from a client that has talked to us before (and thus, not from a
+// spoofed address).
+//
+// The server cookies follow the layout of RFC 9018 (version, reserved,
+// timestamp and hash), but use HMAC-SHA256 instead of SipHash, as it's in
+// the standard library; that only matters if they had to be verified by
+// other implementations, which is not the case.
+//
+// Cookies end with us: the client's cookie is not forwarded upstream (it's
+// meant for us only, and would let the upstream track the client), and the
+// upstream's cookies are not passed to the client.
+type cookieChecker struct {
+	secret []byte
+
+	// Clock, so tests can control time.
+	clock util.Clock
+}
+
+// Sizes and version of the cookies.
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16
+	cookieVersion   = 1
+
+	// Maximum size of the server cookies we accept (RFC 7873 section 4).
+	maxServerCookieLen = 32
+)
+
+// Constants that tune the cookies, declared as variables so we can tweak
+// them for testing.
+var (
+	// How long our server cookies are valid for. Clients get a new one with
+	// every reply, so this only needs to cover the time between queries.
+	cookieLifetime = 1 * time.Hour
+
+	// How far in the future we accept the cookie timestamps, in case of
+	// clock skew between instances sharing the secret.
+	cookieFutureSkew = 5 * time.Minute
+)
+
+// cookieStatus is the result of checking the cookie of a query.
+type cookieStatus int
+
+const (
+	// No cookie at all.
+	cookieNone cookieStatus = iota
+
+	// Only a client cookie, or a server cookie we can't verify (e.g. it's
+	// expired, or from before a restart). The client just gets a new one.
+	cookieClientOnly
+
+	// A valid server cookie, which means the client has received a reply
+	// from us recently.
+	cookieValid
+
+	// A malformed cookie option, which gets FORMERR.
+	cookieMalformed
+)
+
+// Exported variables for statistics.
+var cookieStats = struct {
+	// Queries with a valid server cookie.
+	valid *expvar.Int
+
+	// Queries with only a client cookie (or an invalid server cookie).
+	clientOnly *expvar.Int
+
+	// Queries with a malformed cookie option.
+	malformed *expvar.Int
+}{}
+
+func init() {
+	cookieStats.valid = expvar.NewInt("cookies-valid")
+	cookieStats.clientOnly = expvar.NewInt("cookies-client-only")
+	cookieStats.malformed = expvar.NewInt("cookies-malformed")
+}
+
+// newCookieChecker returns a new cookieChecker using the given secret, or a
+// random one if it's nil.
+func newCookieChecker(secret []byte) *cookieChecker {
+	if secret == nil {
+		secret = make([]byte, 16)
+		rand.Read(secret)
+	}
+	return &cookieChecker{secret: secret, clock: util.RealClock}
+}
+
+// takeCookie removes the cookie option from the request (so it's not sent
+// upstream), and checks it. It returns the client cookie, to give it back in
+// the reply.
+func (c *cookieChecker) takeCookie(r *dns.Msg, ip net.IP) ([]byte, cookieStatus) {
+	co, ok := takeOption(r, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if !ok {
+		return nil, cookieNone
+	}
+
+	cookie, err := hex.DecodeString(co.Cookie)
+	if err != nil {
+		cookie = nil
+	}
+	if len(cookie) != clientCookieLen && (len(cookie) < clientCookieLen+8 ||
+		len(cookie) > clientCookieLen+maxServerCookieLen) {
+		cookieStats.malformed.Add(1)
+		return nil, cookieMalformed
+	}
+
+	client, server := cookie[:clientCookieLen], cookie[clientCookieLen:]
+	if c.verify(client, server, ip) {
+		cookieStats.valid.Add(1)
+		return client, cookieValid
+	}
+	cookieStats.clientOnly.Add(1)
+	return client, cookieClientOnly
+}
+
+// serverCookie returns a new server cookie for the given client cookie and
+// address.
+func (c *cookieChecker) serverCookie(client []byte, ip net.IP) []byte {
+	sc := make([]byte, serverCookieLen)
+	sc[0] = cookieVersion
+	binary.BigEndian.PutUint32(sc[4:], uint32(c.clock.Now().Unix()))
+	copy(sc[8:], c.hash(client, sc[:8], ip))
+	return sc
+}
+
+// verify that the server cookie is one we gave to the client recently.
+func (c *cookieChecker) verify(client, server []byte, ip net.IP) bool {
+	if len(server) != serverCookieLen || server[0] != cookieVersion {
+		return false
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint32(server[4:])), 0)
+	now := c.clock.Now()
+	if ts.Before(now.Add(-cookieLifetime)) || ts.After(now.Add(cookieFutureSkew)) {
+		return false
+	}
+
+	return hmac.Equal(server[8:], c.hash(client, server[:8], ip))
+}
+
+// hash of the client cookie, the start of the server cookie (version,
+// reserved and timestamp), and the client address.
+func (c *cookieChecker) hash(client, start []byte, ip net.IP) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	h.Write(client)
+	h.Write(start)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h.Write(ip)
+	return h.Sum(nil)[:serverCookieLen-8]
+}
+
+// setCookie adds our cookie for the client to the reply, replacing any
+// cookie the upstream may have put there.
+func (c *cookieChecker) setCookie(reply *dns.Msg, client []byte, ip net.IP) {
+	cookie := append(append([]byte{}, client...), c.serverCookie(client, ip)...)
+	setReplyOption(reply, dns.EDNS0COOKIE, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(cookie),
+	})
+}
+
+// addrIP returns the IP of the given address, or nil if it doesn't have one
+// (e.g. for unix sockets).
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
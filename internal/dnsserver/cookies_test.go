@@ -0,0 +1,110 @@
+package dnsserver
+
+// Tests for the DNS cookies.
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// cookieQuery returns a query with the given cookie (in hex).
+func cookieQuery(cookie string) *dns.Msg {
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return r
+}
+
+// replyCookie returns the cookie in the reply (in hex).
+func replyCookie(t *testing.T, reply *dns.Msg) string {
+	t.Helper()
+	cookie := ""
+	for _, o := range reply.IsEdns0().Option {
+		if co, ok := o.(*dns.EDNS0_COOKIE); ok {
+			if cookie != "" {
+				t.Errorf("more than one cookie in the reply")
+			}
+			cookie = co.Cookie
+		}
+	}
+	return cookie
+}
+
+func TestCookies(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newCookieChecker([]byte("0123456789abcdef"))
+	c.clock = clock
+	ip := net.ParseIP("192.0.2.1")
+	clientCookie := "0102030405060708"
+
+	// No cookie.
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	if _, status := c.takeCookie(r, ip); status != cookieNone {
+		t.Errorf("query without EDNS: got status %v", status)
+	}
+	r.SetEdns0(1232, false)
+	if _, status := c.takeCookie(r, ip); status != cookieNone {
+		t.Errorf("query without cookie: got status %v", status)
+	}
+
+	// Only a client cookie: it is removed from the query, and the reply
+	// gets it back, with a server cookie.
+	r = cookieQuery(clientCookie)
+	client, status := c.takeCookie(r, ip)
+	if status != cookieClientOnly || hex.EncodeToString(client) != clientCookie {
+		t.Fatalf("got client cookie %x, status %v", client, status)
+	}
+	if opts := r.IsEdns0().Option; len(opts) != 1 || opts[0].Option() != dns.EDNS0SUBNET {
+		t.Errorf("cookie not removed from the query: %v", opts)
+	}
+
+	reply := &dns.Msg{}
+	reply.SetReply(r)
+	reply.SetEdns0(1232, false)
+	upstreamOpt := reply.IsEdns0()
+	upstreamOpt.Option = append(upstreamOpt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "ffffffffffffffff"})
+	c.setCookie(reply, client, ip)
+
+	full := replyCookie(t, reply)
+	if len(full) != 2*(clientCookieLen+serverCookieLen) || full[:16] != clientCookie {
+		t.Fatalf("unexpected cookie in reply: %q", full)
+	}
+	if len(upstreamOpt.Option) != 1 {
+		t.Errorf("the upstream's OPT record was modified: %v", upstreamOpt.Option)
+	}
+
+	// The full cookie is valid for the same client, for a while.
+	check := func(cookie string, ip net.IP, expected cookieStatus) {
+		t.Helper()
+		if _, status := c.takeCookie(cookieQuery(cookie), ip); status != expected {
+			t.Errorf("cookie %q from %v: got status %v, expected %v",
+				cookie, ip, status, expected)
+		}
+	}
+	check(full, ip, cookieValid)
+	check(full, net.ParseIP("192.0.2.2"), cookieClientOnly)
+	check("1111111111111111"+full[16:], ip, cookieClientOnly)
+	check(full[:len(full)-2]+"00", ip, cookieClientOnly)
+
+	clock.Advance(30 * time.Minute)
+	check(full, ip, cookieValid)
+	clock.Advance(time.Hour)
+	check(full, ip, cookieClientOnly)
+
+	// Malformed cookies.
+	check("01020304", ip, cookieMalformed)
+	check(clientCookie+"0102", ip, cookieMalformed)
+	check("not hex", ip, cookieMalformed)
+}
@@ -0,0 +1,192 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Differential testing resolver.
+
+// Constants that tune the differential testing, declared as variables so we
+// can tweak them for testing.
+var (
+	// Maximum number of comparisons in flight; queries sampled beyond it
+	// are not compared, so a slow reference can't make us pile them up.
+	diffMaxInFlight = 20
+)
+
+// Exported variables for statistics.
+var diffStats = struct {
+	// Comparisons made, by result ("match", or the kind of discrepancy).
+	results *expvar.Map
+}{}
+
+func init() {
+	diffStats.results = expvar.NewMap("diff-results")
+}
+
+// diffResolver resolves queries using the back resolver, and sends a sample
+// of them to a reference resolver too, in the background. The replies are
+// compared, and the discrepancies logged; this is useful to validate a new
+// upstream (or our own translation) before switching to it.
+type diffResolver struct {
+	back      Resolver
+	reference Resolver
+
+	// Fraction of the queries to compare (0 to 1).
+	rate float64
+
+	// Maximum difference between the TTLs of the answers before it's
+	// considered a discrepancy (0 means TTLs are not compared).
+	maxTTLDivergence time.Duration
+
+	// Semaphore to enforce diffMaxInFlight.
+	sem chan bool
+
+	// Comparisons in progress, so tests can wait for them.
+	pending sync.WaitGroup
+}
+
+// NewDiffResolver returns a resolver which compares the replies for a
+// sample of the queries (the given fraction, 0 to 1) with the ones from the
+// reference resolver.
+func NewDiffResolver(back, reference Resolver, rate float64) *diffResolver {
+	return &diffResolver{
+		back:             back,
+		reference:        reference,
+		rate:             rate,
+		maxTTLDivergence: time.Hour,
+		sem:              make(chan bool, diffMaxInFlight),
+	}
+}
+
+// SetMaxTTLDivergence sets how much the TTLs of the answers can differ
+// before we report it (0 means TTLs are not compared).
+func (d *diffResolver) SetMaxTTLDivergence(max time.Duration) {
+	d.maxTTLDivergence = max
+}
+
+func (d *diffResolver) Init() error {
+	if err := d.back.Init(); err != nil {
+		return err
+	}
+	return d.reference.Init()
+}
+
+func (d *diffResolver) Maintain() {
+	go d.reference.Maintain()
+	d.back.Maintain()
+}
+
+func (d *diffResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	reply, err := d.back.Query(r, tr)
+	if err != nil || d.rate <= 0 || rand.Float64() >= d.rate {
+		return reply, err
+	}
+
+	select {
+	case d.sem <- true:
+	default:
+		diffStats.results.Add("skipped", 1)
+		return reply, err
+	}
+
+	// Both the query and the reply may be changed by our callers, so the
+	// comparison works on copies.
+	m := r.Copy()
+	m.Id = dns.Id()
+	primary := reply.Copy()
+	d.pending.Add(1)
+	go func() {
+		defer func() {
+			<-d.sem
+			d.pending.Done()
+		}()
+		d.compare(m, primary)
+	}()
+	return reply, err
+}
+
+// compare queries the reference resolver, and compares its reply with the
+// primary one.
+func (d *diffResolver) compare(m, primary *dns.Msg) {
+	tr := trace.New("dnsserver.Diff", "compare")
+	defer tr.Finish()
+
+	q := m.Question[0]
+	tr.LazyPrintf("%s %s", q.Name, dns.Type(q.Qtype))
+
+	ref, err := d.reference.Query(m, tr)
+	if err != nil {
+		diffStats.results.Add("reference-error", 1)
+		tr.LazyPrintf("reference error: %v", err)
+		tr.SetError()
+		return
+	}
+
+	kind, detail := diffReplies(primary, ref, d.maxTTLDivergence)
+	diffStats.results.Add(kind, 1)
+	if kind == "match" {
+		tr.LazyPrintf("match")
+		return
+	}
+
+	tr.LazyPrintf("%s: %s", kind, detail)
+	tr.SetError()
+	log.Infof("Diff: name=%s type=%s kind=%s %s",
+		q.Name, dns.Type(q.Qtype), kind, detail)
+}
+
+// diffReplies compares the primary and the reference replies, and returns
+// the kind of discrepancy ("match" if there are none), and the details.
+func diffReplies(primary, ref *dns.Msg, maxTTLDivergence time.Duration) (string, string) {
+	if primary.Rcode != ref.Rcode {
+		return "rcode", fmt.Sprintf("primary=%s reference=%s",
+			dns.RcodeToString[primary.Rcode], dns.RcodeToString[ref.Rcode])
+	}
+
+	pa, ra := rrsetKeys(primary.Answer), rrsetKeys(ref.Answer)
+	if strings.Join(pa, "\n") != strings.Join(ra, "\n") {
+		return "answer", fmt.Sprintf("primary=%q reference=%q", pa, ra)
+	}
+
+	if maxTTLDivergence > 0 && len(primary.Answer) > 0 {
+		pt, rt := getTTL(primary.Answer), getTTL(ref.Answer)
+		div := pt - rt
+		if div < 0 {
+			div = -div
+		}
+		if div > maxTTLDivergence {
+			return "ttl", fmt.Sprintf("primary=%v reference=%v", pt, rt)
+		}
+	}
+
+	return "match", ""
+}
+
+// rrsetKeys returns the RRs in a form that can be compared regardless of
+// their order, TTL and case.
+func rrsetKeys(rrs []dns.RR) []string {
+	keys := []string{}
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		keys = append(keys, strings.ToLower(rr.String()))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &diffResolver{}
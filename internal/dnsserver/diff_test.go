@@ -0,0 +1,111 @@
+package dnsserver
+
+// Tests for the differential testing resolver.
+
+import (
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestDiffReplies(t *testing.T) {
+	reply := func(rcode int, rrs ...string) *dns.Msg {
+		m := &dns.Msg{}
+		m.Rcode = rcode
+		for _, s := range rrs {
+			m.Answer = append(m.Answer, testutil.NewRR(t, s))
+		}
+		return m
+	}
+
+	cases := []struct {
+		primary, ref *dns.Msg
+		kind         string
+	}{
+		{reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.1"),
+			reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.1"), "match"},
+
+		// Order, case and small TTL differences don't matter.
+		{reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.1", "a.example. 60 A 192.0.2.2"),
+			reply(dns.RcodeSuccess, "A.example. 50 A 192.0.2.2", "a.example. 50 A 192.0.2.1"),
+			"match"},
+
+		{reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.1"),
+			reply(dns.RcodeNameError), "rcode"},
+		{reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.1"),
+			reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.9"), "answer"},
+		{reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.1"),
+			reply(dns.RcodeSuccess), "answer"},
+		{reply(dns.RcodeSuccess, "a.example. 60 A 192.0.2.1"),
+			reply(dns.RcodeSuccess, "a.example. 86400 A 192.0.2.1"), "ttl"},
+	}
+	for i, c := range cases {
+		kind, detail := diffReplies(c.primary, c.ref, time.Hour)
+		if kind != c.kind {
+			t.Errorf("%d: got %q (%s), expected %q", i, kind, detail, c.kind)
+		}
+	}
+
+	// The TTLs are not compared if there's no limit.
+	kind, _ := diffReplies(cases[5].primary, cases[5].ref, 0)
+	if kind != "match" {
+		t.Errorf("TTLs compared without a limit: %q", kind)
+	}
+}
+
+func TestDiffResolver(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(testutil.NewRR(t, "www.example. 60 A 192.0.2.1"))
+	ref := testutil.NewTestResolver()
+	ref.Response = newReply(testutil.NewRR(t, "www.example. 60 A 192.0.2.2"))
+
+	d := NewDiffResolver(back, ref, 1)
+	if err := d.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	if !back.Initialized || !ref.Initialized {
+		t.Errorf("resolvers not initialized")
+	}
+
+	before := expvarInt(diffStats.results, "answer")
+	reply, err := d.Query(newQuery("www.example.", dns.TypeA), testutil.NewTestTrace(t))
+	if err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+	d.pending.Wait()
+
+	// We always use the primary reply.
+	if !strings.HasSuffix(reply.Answer[0].String(), "192.0.2.1") {
+		t.Errorf("unexpected reply: %v", reply)
+	}
+	if ref.LastQuery == nil {
+		t.Errorf("reference not queried")
+	}
+	if n := expvarInt(diffStats.results, "answer"); n != before+1 {
+		t.Errorf("answer discrepancies: %d, expected %d", n, before+1)
+	}
+
+	// With a 0 rate, nothing is compared.
+	d.rate = 0
+	ref.LastQuery = nil
+	d.Query(newQuery("www.example.", dns.TypeA), testutil.NewTestTrace(t))
+	d.pending.Wait()
+	if ref.LastQuery != nil {
+		t.Errorf("reference queried with 0 rate")
+	}
+}
+
+// expvarInt returns the value of the given key of the map, or 0 if it's not
+// set.
+func expvarInt(m *expvar.Map, key string) int64 {
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
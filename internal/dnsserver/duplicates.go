@@ -0,0 +1,116 @@
+package dnsserver
+
+import (
+	"expvar"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Duplicate UDP queries.
+
+// UDP clients which don't get a reply in time send their queries again, with
+// the same ID. If the original is still in progress (likely, if the upstream
+// is slow), resolving the retransmission too would only double the load on
+// the upstream. Instead, we attach it to the one in progress, and when that
+// is done, we send its reply again for the retransmission.
+
+// Exported variables for statistics.
+var duplicateStats = struct {
+	// Retransmitted queries attached to the one in progress.
+	attached *expvar.Int
+}{}
+
+func init() {
+	duplicateStats.attached = expvar.NewInt("dns-duplicate-queries")
+}
+
+// queryKey identifies a UDP query, to recognize its retransmissions.
+type queryKey struct {
+	local, client string
+	id            uint16
+	question      dns.Question
+}
+
+// pendingQuery is a UDP query in progress.
+type pendingQuery struct {
+	// Request ID of the query, for tracing.
+	reqID string
+
+	// Closed when the query is done; then, reply has what we replied (nil
+	// if we didn't reply).
+	done  chan struct{}
+	reply *dns.Msg
+}
+
+// duplicateTracker keeps track of the UDP queries in progress.
+type duplicateTracker struct {
+	mu      *sync.Mutex
+	pending map[queryKey]*pendingQuery
+}
+
+func newDuplicateTracker() *duplicateTracker {
+	return &duplicateTracker{
+		mu:      &sync.Mutex{},
+		pending: map[queryKey]*pendingQuery{},
+	}
+}
+
+// handle checks if the query is a retransmission of one in progress. If it
+// is, it waits for that one to be done, replies the same way, and returns
+// true. Otherwise, it returns a writer to reply with, and a function to call
+// when we are done with the query.
+func (d *duplicateTracker) handle(w dns.ResponseWriter, r *dns.Msg, reqID string, tr trace.Trace) (bool, dns.ResponseWriter, func()) {
+	nop := func() {}
+	if d == nil || len(r.Question) != 1 {
+		return false, w, nop
+	}
+	if _, isUDP := w.LocalAddr().(*net.UDPAddr); !isUDP {
+		return false, w, nop
+	}
+
+	key := queryKey{w.LocalAddr().String(), w.RemoteAddr().String(), r.Id,
+		r.Question[0]}
+	d.mu.Lock()
+	p, ok := d.pending[key]
+	if !ok {
+		p = &pendingQuery{reqID: reqID, done: make(chan struct{})}
+		d.pending[key] = p
+	}
+	d.mu.Unlock()
+
+	if ok {
+		duplicateStats.attached.Add(1)
+		tr.LazyPrintf("retransmission of req:%s, waiting for it", p.reqID)
+		<-p.done
+		if p.reply == nil {
+			tr.LazyPrintf("original got no reply, neither do we")
+			return true, w, nop
+		}
+		w.WriteMsg(p.reply)
+		return true, w, nop
+	}
+
+	cw := &capturingWriter{ResponseWriter: w}
+	return false, cw, func() {
+		d.mu.Lock()
+		delete(d.pending, key)
+		d.mu.Unlock()
+		p.reply = cw.reply
+		close(p.done)
+	}
+}
+
+// capturingWriter is a dns.ResponseWriter which remembers the reply.
+type capturingWriter struct {
+	dns.ResponseWriter
+	reply *dns.Msg
+}
+
+func (w *capturingWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,75 @@
+package dnsserver
+
+// Tests for the handling of duplicate UDP queries.
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDuplicateQueries(t *testing.T) {
+	res := &blockingResolver{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	srv := New("", res, "")
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	q := newQuery("example.com.", dns.TypeA)
+
+	handle := func(w dns.ResponseWriter, r *dns.Msg) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			srv.Handler(w, r)
+			close(done)
+		}()
+		return done
+	}
+
+	w1 := &recordingWriter{remote: client}
+	first := handle(w1, q.Copy())
+	<-res.started
+
+	// The retransmission is attached to the first one.
+	prev := duplicateStats.attached.Value()
+	w2 := &recordingWriter{remote: client}
+	second := handle(w2, q.Copy())
+	for duplicateStats.attached.Value() == prev {
+		// Wait for it to be attached.
+		time.Sleep(time.Millisecond)
+	}
+
+	// Queries with other IDs, or from other clients, are not.
+	other := q.Copy()
+	other.Id = q.Id + 1
+	w3 := &recordingWriter{remote: client}
+	third := handle(w3, other.Copy())
+	<-res.started
+	w4 := &recordingWriter{remote: &net.UDPAddr{
+		IP: net.ParseIP("192.0.2.2"), Port: 1234}}
+	fourth := handle(w4, q.Copy())
+	<-res.started
+
+	close(res.release)
+	for _, done := range []chan struct{}{first, second, third, fourth} {
+		<-done
+	}
+
+	if len(res.started) != 0 {
+		t.Errorf("the retransmission was resolved again")
+	}
+	for i, w := range []*recordingWriter{w1, w2, w4} {
+		if w.reply == nil || w.reply.Id != q.Id ||
+			w.reply.Rcode != dns.RcodeSuccess {
+			t.Errorf("%d: unexpected reply: %v", i, w.reply)
+		}
+	}
+	if w3.reply == nil || w3.reply.Id != other.Id {
+		t.Errorf("unexpected reply: %v", w3.reply)
+	}
+	if len(srv.dups.pending) != 0 {
+		t.Errorf("queries left behind: %v", srv.dups.pending)
+	}
+}
@@ -0,0 +1,83 @@
+package dnsserver
+
+import (
+	"github.com/miekg/dns"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// EDNS options handled by the server itself.
+
+// clientOptions are the EDNS options of a query which are meant for us (like
+// cookies and NSID), and which we reply to ourselves instead of leaving it
+// to the upstream.
+type clientOptions struct {
+	// Client cookie, to give it back with ours (nil if none).
+	cookie []byte
+
+	// Whether the client asked for our NSID.
+	nsid bool
+}
+
+// takeOption removes the first option with the given code from the query's
+// OPT record, and returns it (or nil if there is none).
+func takeOption(r *dns.Msg, code uint16) dns.EDNS0 {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for i, o := range opt.Option {
+		if o.Option() == code {
+			opt.Option = append(opt.Option[:i:i], opt.Option[i+1:]...)
+			return o
+		}
+	}
+	return nil
+}
+
+// replyOption returns the first option with the given code in the reply's
+// OPT record, or nil if there is none.
+func replyOption(reply *dns.Msg, code uint16) dns.EDNS0 {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return o
+		}
+	}
+	return nil
+}
+
+// setReplyOption replaces the options with the given code in the reply's OPT
+// record with the given one (or removes them, if it's nil). It does nothing
+// if the reply has no OPT record.
+func setReplyOption(reply *dns.Msg, code uint16, o dns.EDNS0) {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	// Use a new OPT record, as the reply's may be shared with others (e.g.
+	// the static resolvers give the same records to everyone).
+	nopt := &dns.OPT{Hdr: opt.Hdr}
+	for _, old := range opt.Option {
+		if old.Option() != code {
+			nopt.Option = append(nopt.Option, old)
+		}
+	}
+	if o != nil {
+		nopt.Option = append(nopt.Option, o)
+	}
+
+	extra := make([]dns.RR, 0, len(reply.Extra))
+	for _, rr := range reply.Extra {
+		if rr == opt {
+			rr = nopt
+		}
+		extra = append(extra, rr)
+	}
+	reply.Extra = extra
+}
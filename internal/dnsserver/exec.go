@@ -0,0 +1,461 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// External program hook.
+
+// execHookResolver implements a Resolver which lets an external program
+// decide what to do with the queries (and optionally, with the responses),
+// so custom policies can be written in any language.
+//
+// The program is started once, and kept running. For each query, we write a
+// line with a JSON object to its stdin:
+//
+//	{"id": 1, "phase": "query", "name": "www.example.com.", "type": "A"}
+//
+// and it must write a line with a JSON object to its stdout, with the same
+// id, and the action to take:
+//
+//	{"id": 1, "action": "pass"}
+//	{"id": 1, "action": "reply", "rcode": "NXDOMAIN"}
+//	{"id": 1, "action": "reply", "answer": ["www.example.com. 60 A 10.0.0.1"]}
+//
+// With "pass", the query is resolved as usual; with "reply", we reply with
+// the given rcode (NOERROR by default) and answer records, in zone file
+// format. If the responses are hooked too, once the query is resolved we
+// send the program the response, in the same format:
+//
+//	{"id": 2, "phase": "response", "name": "www.example.com.", "type": "A",
+//	 "rcode": "NOERROR", "answer": ["www.example.com.\t60\tIN\tA\t192.0.2.1"]}
+//
+// and it replies as above, with "reply" replacing the response.
+//
+// Several exchanges can be in flight at once, and the program can reply to
+// them in any order: the replies are matched by id. If the program doesn't
+// reply within the timeout (which includes the time waiting to send it the
+// message), replies something invalid, or exits, the query goes on as if it
+// had said "pass" (so a broken program can't take the resolution down), and
+// the program is restarted.
+type execHookResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Program to run, and its arguments.
+	command []string
+
+	// Whether to send the program the responses too.
+	responses bool
+
+	// How long to wait for the program to reply.
+	timeout time.Duration
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Protects the fields below.
+	mu *sync.Mutex
+
+	// The running program, or nil if it's not running.
+	proc *hookProcess
+
+	// ID of the last message sent to the program.
+	lastID uint64
+
+	// When the program last failed, to avoid restarting it in a loop.
+	failed time.Time
+}
+
+// hookProcess is a running hook program.
+type hookProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	// Lines to write to the program's stdin.
+	writes chan []byte
+
+	// Protects pending and err.
+	mu *sync.Mutex
+
+	// Channels of the messages waiting for a reply, by id.
+	pending map[uint64]chan *execHookMessage
+
+	// Why the program stopped; set before closing done.
+	err error
+
+	// Closed when the program exits, or we stop it.
+	done chan struct{}
+}
+
+// execHookMessage is the message exchanged with the program, in both
+// directions.
+type execHookMessage struct {
+	ID     uint64   `json:"id"`
+	Phase  string   `json:"phase,omitempty"`
+	Action string   `json:"action,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Type   string   `json:"type,omitempty"`
+	Rcode  string   `json:"rcode,omitempty"`
+	Answer []string `json:"answer,omitempty"`
+}
+
+// Constants that tune the exec hook, declared as variables so we can tweak
+// them for testing.
+var (
+	// Default time to wait for the program to reply.
+	execHookTimeout = 200 * time.Millisecond
+
+	// How long to wait before restarting a program that failed.
+	execHookRestartDelay = 5 * time.Second
+)
+
+// Exported variables for statistics.
+var execHookStats = struct {
+	// Exchanges with the program, by result (pass, reply or error).
+	results *expvar.Map
+}{}
+
+func init() {
+	execHookStats.results = expvar.NewMap("exec-hook-results")
+}
+
+var (
+	errHookDown    = errors.New("program is not running")
+	errHookTimeout = errors.New("timed out waiting for the program")
+	errHookExited  = errors.New("program exited")
+)
+
+// NewExecHookResolver returns a new resolver which lets the given program
+// (with its arguments) decide what to do with the queries, before they're
+// given to back.
+func NewExecHookResolver(back Resolver, command []string) *execHookResolver {
+	return &execHookResolver{
+		back:    back,
+		command: command,
+		timeout: execHookTimeout,
+		clock:   util.RealClock,
+		mu:      &sync.Mutex{},
+	}
+}
+
+// SetResponses sets whether the program gets the responses too.
+func (e *execHookResolver) SetResponses(responses bool) {
+	e.responses = responses
+}
+
+// SetTimeout sets how long to wait for the program to reply (if 0, the
+// default is used).
+func (e *execHookResolver) SetTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		e.timeout = timeout
+	}
+}
+
+func (e *execHookResolver) Init() error {
+	if err := e.back.Init(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.start()
+}
+
+func (e *execHookResolver) Maintain() {
+	e.back.Maintain()
+}
+
+// start the program. Must be called with the lock held.
+func (e *execHookResolver) start() error {
+	cmd := exec.Command(e.command[0], e.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		e.failed = e.clock.Now()
+		return fmt.Errorf("starting %q: %v", e.command[0], err)
+	}
+
+	p := &hookProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		writes:  make(chan []byte),
+		mu:      &sync.Mutex{},
+		pending: map[uint64]chan *execHookMessage{},
+		done:    make(chan struct{}),
+	}
+	go p.read(stdout)
+	go p.write()
+	e.proc = p
+	return nil
+}
+
+// read the replies the program writes, and give them to the messages
+// waiting for them, until it exits or we stop it.
+func (p *hookProcess) read(stdout io.Reader) {
+	defer p.cmd.Wait()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		reply := &execHookMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), reply); err != nil {
+			p.close(fmt.Errorf("invalid reply %q: %v", scanner.Bytes(), err))
+			return
+		}
+
+		p.mu.Lock()
+		c, ok := p.pending[reply.ID]
+		delete(p.pending, reply.ID)
+		p.mu.Unlock()
+
+		// If nobody is waiting, it's a late reply to a message that timed
+		// out; skip it.
+		if ok {
+			c <- reply
+		}
+	}
+	p.close(errHookExited)
+}
+
+// write the lines to the program's stdin, until it exits or we stop it.
+func (p *hookProcess) write() {
+	for {
+		select {
+		case line := <-p.writes:
+			if _, err := p.stdin.Write(line); err != nil {
+				p.close(err)
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// expect a reply to the message with the given id; it will be sent to the
+// returned channel.
+func (p *hookProcess) expect(id uint64) chan *execHookMessage {
+	// Buffered, so the reader doesn't block if we've given up waiting.
+	c := make(chan *execHookMessage, 1)
+	p.mu.Lock()
+	p.pending[id] = c
+	p.mu.Unlock()
+	return c
+}
+
+// forget about the message with the given id.
+func (p *hookProcess) forget(id uint64) {
+	p.mu.Lock()
+	delete(p.pending, id)
+	p.mu.Unlock()
+}
+
+// close stops the program (if it's still running) because of err. It can be
+// called more than once; only the first err is kept.
+func (p *hookProcess) close(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	close(p.done)
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+}
+
+// stop the program. Must be called with the lock held.
+func (e *execHookResolver) stop() {
+	e.proc.close(errHookExited)
+	e.proc = nil
+	e.failed = e.clock.Now()
+}
+
+// fail stops the program p, after an exchange with it failed, unless it was
+// already replaced.
+func (e *execHookResolver) fail(p *hookProcess, err error) {
+	p.close(err)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.proc == p {
+		e.stop()
+	}
+}
+
+// running returns the running program, starting it if needed, and the id
+// for a new message to it.
+func (e *execHookResolver) running() (*hookProcess, uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.proc == nil {
+		if e.clock.Now().Sub(e.failed) < execHookRestartDelay {
+			return nil, 0, errHookDown
+		}
+		if err := e.start(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	e.lastID++
+	return e.proc, e.lastID, nil
+}
+
+// call sends the message to the program, and returns its reply.
+func (e *execHookResolver) call(m *execHookMessage) (*execHookMessage, error) {
+	// The time waiting to send the message counts too, so a stuck program
+	// can't hold the queries for longer than the timeout.
+	timeout := time.NewTimer(e.timeout)
+	defer timeout.Stop()
+
+	p, id, err := e.running()
+	if err != nil {
+		return nil, err
+	}
+
+	m.ID = id
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := p.expect(m.ID)
+	defer p.forget(m.ID)
+
+	select {
+	case p.writes <- append(buf, '\n'):
+	case <-p.done:
+		e.fail(p, errHookExited)
+		return nil, p.err
+	case <-timeout.C:
+		e.fail(p, errHookTimeout)
+		return nil, errHookTimeout
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-p.done:
+		e.fail(p, errHookExited)
+		return nil, p.err
+	case <-timeout.C:
+		e.fail(p, errHookTimeout)
+		return nil, errHookTimeout
+	}
+}
+
+// hook sends the message to the program, and returns the reply to give
+// instead of r's resolution, or nil to go on as usual.
+func (e *execHookResolver) hook(m *execHookMessage, r *dns.Msg, tr trace.Trace) *dns.Msg {
+	hr, err := e.call(m)
+	var reply *dns.Msg
+	if err == nil {
+		reply, err = hookReply(hr, r)
+	}
+	if err != nil {
+		execHookStats.results.Add("error", 1)
+		util.TraceErrorf(tr, "exec hook (%s): %v, passing", m.Phase, err)
+		return nil
+	}
+
+	if reply == nil {
+		execHookStats.results.Add("pass", 1)
+		tr.LazyPrintf("exec hook (%s): pass", m.Phase)
+		return nil
+	}
+	execHookStats.results.Add("reply", 1)
+	tr.LazyPrintf("exec hook (%s): reply, rcode %d, %d answers",
+		m.Phase, reply.Rcode, len(reply.Answer))
+	return reply
+}
+
+// hookReply returns the reply to r that the program asked for, or nil if it
+// said to pass.
+func hookReply(hr *execHookMessage, r *dns.Msg) (*dns.Msg, error) {
+	switch hr.Action {
+	case "", "pass":
+		return nil, nil
+	case "reply":
+	default:
+		return nil, fmt.Errorf("unknown action %q", hr.Action)
+	}
+
+	reply := newReplyTo(r)
+	if hr.Rcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(hr.Rcode)]
+		if !ok {
+			return nil, fmt.Errorf("unknown rcode %q", hr.Rcode)
+		}
+		reply.Rcode = rcode
+	}
+	for _, s := range hr.Answer {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("invalid answer %q: %v", s, err)
+		}
+		reply.Answer = append(reply.Answer, rr)
+	}
+	return reply, nil
+}
+
+func (e *execHookResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return e.back.Query(r, tr)
+	}
+	q := r.Question[0]
+
+	m := &execHookMessage{
+		Phase: "query",
+		Name:  q.Name,
+		Type:  dns.Type(q.Qtype).String(),
+	}
+	if reply := e.hook(m, r, tr); reply != nil {
+		return reply, nil
+	}
+
+	reply, err := e.back.Query(r, tr)
+	if err != nil || !e.responses {
+		return reply, err
+	}
+
+	m = &execHookMessage{
+		Phase: "response",
+		Name:  q.Name,
+		Type:  dns.Type(q.Qtype).String(),
+		Rcode: dns.RcodeToString[reply.Rcode],
+	}
+	for _, rr := range reply.Answer {
+		m.Answer = append(m.Answer, rr.String())
+	}
+	if hooked := e.hook(m, r, tr); hooked != nil {
+		return hooked, nil
+	}
+	return reply, nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &execHookResolver{}
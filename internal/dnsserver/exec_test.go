@@ -0,0 +1,204 @@
+package dnsserver
+
+// Tests for the external program hook.
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// The test binary is also the hook program: we tell it to behave like one
+// using this environment variable.
+const envTestHook = "DNSSERVER_TEST_EXEC_HOOK"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envTestHook) != "" {
+		runTestHook()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runTestHook is a hook program with a policy for the tests.
+func runTestHook() {
+	scanner := bufio.NewScanner(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+	encMu := &sync.Mutex{}
+	for scanner.Scan() {
+		m := execHookMessage{}
+		json.Unmarshal(scanner.Bytes(), &m)
+		reply := execHookMessage{ID: m.ID, Action: "pass"}
+
+		switch {
+		case m.Phase == "query" && m.Name == "blocked.example.":
+			reply.Action = "reply"
+			reply.Rcode = "NXDOMAIN"
+		case m.Phase == "query" && m.Name == "fixed.example.":
+			reply.Action = "reply"
+			reply.Answer = []string{"fixed.example. 60 A 10.0.0.1"}
+		case m.Phase == "query" && m.Name == "slow.example.":
+			time.Sleep(time.Minute)
+		case m.Phase == "query" && m.Name == "delayed.example.":
+			// Reply later, while we keep handling the other messages.
+			go func() {
+				time.Sleep(300 * time.Millisecond)
+				encMu.Lock()
+				enc.Encode(execHookMessage{ID: m.ID, Action: "reply"})
+				encMu.Unlock()
+			}()
+			continue
+		case m.Phase == "query" && m.Name == "crash.example.":
+			os.Exit(1)
+		case m.Phase == "query" && m.Name == "invalid.example.":
+			os.Stdout.WriteString("this is not json\n")
+			continue
+		case m.Phase == "response" && len(m.Answer) == 1 &&
+			strings.HasSuffix(m.Answer[0], "192.0.2.1"):
+			reply.Action = "reply"
+			reply.Answer = []string{m.Name + " 60 A 192.0.2.2"}
+		}
+		encMu.Lock()
+		enc.Encode(reply)
+		encMu.Unlock()
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	os.Setenv(envTestHook, "1")
+	defer os.Unsetenv(envTestHook)
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(testutil.NewRR(t, "www.example. 60 A 192.0.2.1"))
+
+	e := NewExecHookResolver(back, []string{os.Args[0]})
+	e.SetResponses(true)
+	e.SetTimeout(time.Second)
+	clock := testutil.NewFakeClock(time.Now())
+	e.clock = clock
+	if err := e.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	defer func() {
+		e.mu.Lock()
+		if e.proc != nil {
+			e.stop()
+		}
+		e.mu.Unlock()
+	}()
+
+	query := func(name string) *dns.Msg {
+		t.Helper()
+		back.LastQuery = nil
+		reply, err := e.Query(newQuery(name, dns.TypeA), testutil.NewTestTrace(t))
+		if err != nil {
+			t.Fatalf("%s: query error: %v", name, err)
+		}
+		return reply
+	}
+	expectA := func(name string, reply *dns.Msg, ip string) {
+		t.Helper()
+		if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != ip {
+			t.Errorf("%s: expected %s, got %v", name, ip, reply)
+		}
+	}
+
+	// Vetoed by the program, without resolving.
+	reply := query("blocked.example.")
+	if reply.Rcode != dns.RcodeNameError || back.LastQuery != nil {
+		t.Errorf("blocked.example.: unexpected reply %v, resolved: %v",
+			reply, back.LastQuery)
+	}
+
+	reply = query("fixed.example.")
+	expectA("fixed.example.", reply, "10.0.0.1")
+	if back.LastQuery != nil {
+		t.Errorf("fixed.example. was resolved")
+	}
+
+	// Resolved, and the response replaced.
+	reply = query("www.example.")
+	expectA("www.example.", reply, "192.0.2.2")
+	if back.LastQuery == nil {
+		t.Errorf("www.example. was not resolved")
+	}
+
+	// Several exchanges can be in flight at once: the delayed replies don't
+	// hold the other queries, nor each other (one at a time, they would take
+	// longer than the timeout).
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := e.Query(newQuery("delayed.example.", dns.TypeA),
+				testutil.NewTestTrace(t))
+			if err != nil || reply.Rcode != dns.RcodeSuccess ||
+				len(reply.Answer) != 0 {
+				t.Errorf("delayed.example.: got %v, %v", reply, err)
+			}
+		}()
+	}
+	reply = query("fixed.example.")
+	expectA("fixed.example.", reply, "10.0.0.1")
+	wg.Wait()
+	if e.proc == nil {
+		t.Errorf("program stopped after the delayed replies")
+	}
+
+	// Errors make the query pass, and restart the program (after a while).
+	for _, name := range []string{"slow.example.", "crash.example.",
+		"invalid.example."} {
+		back.Response = newReply(testutil.NewRR(t, name+" 60 A 192.0.2.3"))
+		reply = query(name)
+		expectA(name, reply, "192.0.2.3")
+		if e.proc != nil {
+			t.Errorf("%s: program still running", name)
+		}
+
+		// While it's down, queries just pass.
+		reply = query("blocked.example.")
+		if reply.Rcode != dns.RcodeSuccess || back.LastQuery == nil {
+			t.Errorf("%s: blocked.example. not passed: %v", name, reply)
+		}
+
+		clock.Advance(execHookRestartDelay)
+		reply = query("blocked.example.")
+		if reply.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: program not restarted: %v", name, reply)
+		}
+	}
+}
+
+func TestHookReply(t *testing.T) {
+	r := newQuery("www.example.", dns.TypeA)
+	cases := []struct {
+		hr    execHookMessage
+		rcode int
+		nil   bool
+		err   bool
+	}{
+		{execHookMessage{}, 0, true, false},
+		{execHookMessage{Action: "pass"}, 0, true, false},
+		{execHookMessage{Action: "reply"}, dns.RcodeSuccess, false, false},
+		{execHookMessage{Action: "reply", Rcode: "refused"}, dns.RcodeRefused, false, false},
+		{execHookMessage{Action: "reply", Rcode: "BLAH"}, 0, true, true},
+		{execHookMessage{Action: "reply", Answer: []string{"blah"}}, 0, true, true},
+		{execHookMessage{Action: "drop"}, 0, true, true},
+	}
+	for i, c := range cases {
+		reply, err := hookReply(&c.hr, r)
+		if (err != nil) != c.err || (reply == nil) != c.nil ||
+			(reply != nil && reply.Rcode != c.rcode) {
+			t.Errorf("%d: %+v: got %v, %v", i, c.hr, reply, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package dnsserver
+
+import (
+	"expvar"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// CNAME flattening resolver.
+
+// flatteningResolver implements a Resolver which flattens the CNAME chains
+// in the A and AAAA replies for some domains: it follows the chain
+// (resolving the targets the reply doesn't include), and replies with only
+// the final records, renamed to the question, and with the lowest TTL of the
+// chain. This is for clients which mishandle the chains, like some IoT
+// stubs.
+//
+// As this changes the records, the replies are no longer authenticated by
+// DNSSEC (the signatures are dropped, and the AD bit cleared).
+type flatteningResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Domains to flatten, indexed by (lowercased, fully qualified) name;
+	// "." means all of them.
+	domains map[string]bool
+}
+
+// Maximum number of CNAMEs we follow, declared as a variable so we can tweak
+// it for testing.
+var flattenMaxChain = 8
+
+// Exported variables for statistics.
+var flattenStats = struct {
+	// Replies we flattened.
+	flattened *expvar.Int
+
+	// Queries for the targets of the chains not included in the replies.
+	lookups *expvar.Int
+
+	// Chains we could not flatten (too long, or failed to resolve), and
+	// were returned as they are.
+	failed *expvar.Int
+}{}
+
+func init() {
+	flattenStats.flattened = expvar.NewInt("flatten-replies")
+	flattenStats.lookups = expvar.NewInt("flatten-lookups")
+	flattenStats.failed = expvar.NewInt("flatten-failed")
+}
+
+// NewFlatteningResolver returns a new resolver which flattens the CNAME
+// chains of the queries for the given domains (and their subdomains), and
+// passes everything else as is.
+func NewFlatteningResolver(back Resolver, domains []string) *flatteningResolver {
+	f := &flatteningResolver{
+		back:    back,
+		domains: map[string]bool{},
+	}
+	for _, d := range domains {
+		f.domains[util.CanonicalName(d)] = true
+	}
+	return f
+}
+
+func (f *flatteningResolver) Init() error {
+	return f.back.Init()
+}
+
+func (f *flatteningResolver) Maintain() {
+	f.back.Maintain()
+}
+
+// applies returns true if the name is in one of the domains to flatten.
+func (f *flatteningResolver) applies(name string) bool {
+	name = util.CanonicalName(name)
+	for {
+		if f.domains[name] {
+			return true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return f.domains["."]
+		}
+		name = name[i+1:]
+	}
+}
+
+func (f *flatteningResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 || !f.applies(r.Question[0].Name) {
+		return f.back.Query(r, tr)
+	}
+	q := r.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return f.back.Query(r, tr)
+	}
+
+	reply, err := f.back.Query(r, tr)
+	if err != nil || reply == nil || reply.Rcode != dns.RcodeSuccess {
+		return reply, err
+	}
+
+	// Follow the chain through the replies, resolving the target whenever
+	// a reply ends in a CNAME.
+	last := reply
+	name, ttl, hops := q.Name, ^uint32(0), 0
+	var records []dns.RR
+	for {
+		var n int
+		var chainTTL uint32
+		name, chainTTL, records, n = followChain(last.Answer, name, q.Qtype)
+		if last == reply && n == 0 {
+			// Not a chain, nothing to do.
+			return reply, nil
+		}
+		hops += n
+		if chainTTL < ttl {
+			ttl = chainTTL
+		}
+		if hops > flattenMaxChain {
+			flattenStats.failed.Add(1)
+			tr.LazyPrintf("flatten: chain too long, returning as is")
+			return reply, nil
+		}
+		if len(records) > 0 || n == 0 || last.Rcode != dns.RcodeSuccess {
+			break
+		}
+
+		flattenStats.lookups.Add(1)
+		tr.LazyPrintf("flatten: resolving target %q", name)
+		m := r.Copy()
+		m.Id = <-newID
+		m.Question[0].Name = name
+		last, err = f.back.Query(m, tr)
+		if err != nil || last == nil {
+			flattenStats.failed.Add(1)
+			tr.LazyPrintf("flatten: error resolving %q: %v", name, err)
+			return reply, nil
+		}
+	}
+
+	flattened := newReplyTo(r)
+	flattened.Rcode = last.Rcode
+	for _, rr := range records {
+		rr = renameRR(rr, q.Name)
+		if rr.Header().Ttl > ttl {
+			rr.Header().Ttl = ttl
+		}
+		flattened.Answer = append(flattened.Answer, rr)
+	}
+	if len(records) == 0 {
+		// The chain ends in a negative reply, keep its authority section
+		// so it can be cached as such.
+		flattened.Ns = last.Ns
+	}
+	if opt := reply.IsEdns0(); opt != nil {
+		flattened.Extra = []dns.RR{opt}
+	}
+
+	flattenStats.flattened.Add(1)
+	tr.LazyPrintf("flatten: %d CNAMEs to %q, TTL %d", hops, name, ttl)
+	return flattened, nil
+}
+
+// followChain follows the CNAME chain from name in the given records (which
+// may be in any order). It returns the last name of the chain, the lowest TTL
+// of its CNAMEs, the records of the given type for it, and how many CNAMEs
+// were followed.
+func followChain(rrs []dns.RR, name string, qtype uint16) (string, uint32, []dns.RR, int) {
+	ttl, n := ^uint32(0), 0
+	seen := map[string]bool{}
+	for !seen[strings.ToLower(name)] {
+		seen[strings.ToLower(name)] = true
+		var next *dns.CNAME
+		for _, rr := range rrs {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		name = next.Target
+		if next.Hdr.Ttl < ttl {
+			ttl = next.Hdr.Ttl
+		}
+		n++
+	}
+
+	var records []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			records = append(records, rr)
+		}
+	}
+	return name, ttl, records, n
+}
@@ -0,0 +1,182 @@
+package dnsserver
+
+// Tests for the CNAME flattening resolver.
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// chainResolver is a Resolver for testing, which answers with the records
+// for the query name, or NXDOMAIN if there are none.
+type chainResolver struct {
+	answers map[string][]dns.RR
+}
+
+func (r *chainResolver) Init() error { return nil }
+func (r *chainResolver) Maintain()   {}
+
+func (r *chainResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	name := req.Question[0].Name
+	reply := newReplyTo(req)
+	rrs, ok := r.answers[strings.ToLower(name)]
+	if !ok {
+		reply.Rcode = dns.RcodeNameError
+		reply.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA,
+				Class: dns.ClassINET, Ttl: 30},
+			Ns: "ns.test.", Mbox: "admin.test.", Minttl: 30,
+		}}
+		return reply, nil
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == req.Question[0].Qtype ||
+			rr.Header().Rrtype == dns.TypeCNAME {
+			reply.Answer = append(reply.Answer, rr)
+		}
+	}
+	return reply, nil
+}
+
+func newChainResolver(t *testing.T, answers map[string][]string) *chainResolver {
+	r := &chainResolver{answers: map[string][]dns.RR{}}
+	for name, rrs := range answers {
+		for _, s := range rrs {
+			r.answers[name] = append(r.answers[name], mustNewRR(t, s))
+		}
+	}
+	return r
+}
+
+func answersString(rrs []dns.RR) string {
+	s := []string{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		data := ""
+		switch rr := rr.(type) {
+		case *dns.A:
+			data = rr.A.String()
+		case *dns.AAAA:
+			data = rr.AAAA.String()
+		case *dns.CNAME:
+			data = rr.Target
+		}
+		s = append(s, fmt.Sprintf("%s %d %s %s", h.Name, h.Ttl,
+			dns.TypeToString[h.Rrtype], data))
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestFlatten(t *testing.T) {
+	back := newChainResolver(t, map[string][]string{
+		// Complete chain, out of order.
+		"www.test.": {
+			"cdn.example. 30 A 1.1.1.1",
+			"www.test. 300 CNAME web.test.",
+			"cdn.example. 30 A 2.2.2.2",
+			"web.test. 120 CNAME cdn.example.",
+			"cdn.example. 30 AAAA ::1",
+		},
+
+		// Chain without the final records, which must be resolved.
+		"partial.test.": {"partial.test. 100 CNAME next.test."},
+		"next.test.": {
+			"next.test. 200 CNAME last.test.",
+			"last.test. 300 A 3.3.3.3",
+		},
+
+		// Chain to a name that doesn't exist.
+		"dangling.test.": {"dangling.test. 60 CNAME missing.test."},
+
+		// Loop.
+		"loop1.test.": {"loop1.test. 60 CNAME loop2.test."},
+		"loop2.test.": {"loop2.test. 60 CNAME loop1.test."},
+
+		// Not a chain.
+		"plain.test.": {"plain.test. 60 A 4.4.4.4"},
+		"other.example.": {
+			"other.example. 60 CNAME cdn.example.",
+			"cdn.example. 30 A 1.1.1.1",
+		},
+	})
+	f := NewFlatteningResolver(back, []string{"test."})
+
+	cases := []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		expected string
+	}{
+		{"www.test.", dns.TypeA, dns.RcodeSuccess,
+			"www.test. 30 A 1.1.1.1, www.test. 30 A 2.2.2.2"},
+		{"WWW.Test.", dns.TypeAAAA, dns.RcodeSuccess, "WWW.Test. 30 AAAA ::1"},
+		{"partial.test.", dns.TypeA, dns.RcodeSuccess,
+			"partial.test. 100 A 3.3.3.3"},
+		{"dangling.test.", dns.TypeA, dns.RcodeNameError, ""},
+
+		// Loops are returned as they are.
+		{"loop1.test.", dns.TypeA, dns.RcodeSuccess,
+			"loop1.test. 60 CNAME loop2.test."},
+
+		// Other types, names not in the domains, and replies without
+		// chains are not changed.
+		{"www.test.", dns.TypeCNAME, dns.RcodeSuccess,
+			"www.test. 300 CNAME web.test., web.test. 120 CNAME cdn.example."},
+		{"other.example.", dns.TypeA, dns.RcodeSuccess,
+			"other.example. 60 CNAME cdn.example., cdn.example. 30 A 1.1.1.1"},
+		{"plain.test.", dns.TypeA, dns.RcodeSuccess, "plain.test. 60 A 4.4.4.4"},
+	}
+	for _, c := range cases {
+		tr := testutil.NewTestTrace(t)
+		reply, err := f.Query(newQuery(c.name, c.qtype), tr)
+		tr.Finish()
+		if err != nil {
+			t.Errorf("%s: error: %v", c.name, err)
+			continue
+		}
+		if reply.Rcode != c.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", c.name, c.rcode, reply.Rcode)
+		}
+		if got := answersString(reply.Answer); got != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, got)
+		}
+	}
+
+	// The records in the backing resolver must not be changed.
+	if got := answersString(back.answers["www.test."]); !strings.Contains(
+		got, "cdn.example. 30 A 1.1.1.1") {
+		t.Errorf("backing records modified: %q", got)
+	}
+
+	// The negative reply keeps the authority section.
+	reply, _ := f.Query(newQuery("dangling.test.", dns.TypeA),
+		testutil.NewTestTrace(t))
+	if len(reply.Ns) != 1 || reply.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("expected an SOA in the authority section: %v", reply.Ns)
+	}
+}
+
+func TestFlattenAll(t *testing.T) {
+	back := newChainResolver(t, map[string][]string{
+		"a.example.": {
+			"a.example. 60 CNAME b.example.",
+			"b.example. 60 A 1.1.1.1",
+		},
+	})
+	f := NewFlatteningResolver(back, []string{"."})
+
+	reply, err := f.Query(newQuery("a.example.", dns.TypeA),
+		testutil.NewTestTrace(t))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := answersString(reply.Answer); got != "a.example. 60 A 1.1.1.1" {
+		t.Errorf("unexpected answer: %q", got)
+	}
+}
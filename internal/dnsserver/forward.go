@@ -0,0 +1,304 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Per-zone forwarding resolver.
+
+// forwardingResolver implements a Resolver which sends the queries for some
+// zones directly to specific DNS servers (like the internal servers of a
+// split-horizon setup), optionally authenticated with TSIG (RFC 8945).
+// Everything else is passed to the backing resolver.
+type forwardingResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Zones to forward, indexed by (lowercased, fully qualified) name.
+	zones map[string]*ForwardZone
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Function to send a query to a server, so tests can fake it.
+	exchange func(m *dns.Msg, addr string, key *TSIGKey) (*dns.Msg, error)
+}
+
+// ForwardZone is a zone whose queries are sent to specific servers.
+type ForwardZone struct {
+	Zone string
+
+	// Addresses (host:port) of the servers, tried in order.
+	Servers []string
+
+	// Key to sign the queries with, and to check the replies against; nil
+	// if the server doesn't use TSIG.
+	Key *TSIGKey
+}
+
+// TSIGKey is a shared secret used to authenticate DNS messages.
+type TSIGKey struct {
+	// Name of the key, fully qualified, as the server knows it.
+	Name string
+
+	// Algorithm, like dns.HmacSHA256.
+	Algorithm string
+
+	// The secret, in base64.
+	Secret string
+}
+
+// Supported TSIG algorithms, by the names used in the key files.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Constants that tune the forwarding, declared as variables so we can tweak
+// them for testing.
+var (
+	// Timeout for each query to a server.
+	forwardTimeout = 2 * time.Second
+
+	// How far the clocks of the server and ours can be apart, for TSIG.
+	tsigFudge uint16 = 300
+)
+
+// Exported variables for statistics.
+var forwardStats = struct {
+	// Queries forwarded, by zone.
+	queries *expvar.Map
+
+	// Forwarded queries that failed (including replies failing the TSIG
+	// verification).
+	errors *expvar.Int
+}{}
+
+func init() {
+	forwardStats.queries = expvar.NewMap("forward-zone-queries")
+	forwardStats.errors = expvar.NewInt("forward-zone-errors")
+}
+
+// LoadTSIGKeys loads the TSIG keys from the given file, which has one key
+// per line, as "name algorithm secret" (e.g. "corp-key. hmac-sha256
+// c2VjcmV0..."). Empty lines and lines starting with # are ignored.
+// It returns the keys indexed by name (fully qualified).
+func LoadTSIGKeys(path string) (map[string]*TSIGKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string]*TSIGKey{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected \"name algorithm secret\"", n)
+		}
+		algorithm, ok := tsigAlgorithms[strings.ToLower(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown algorithm %q", n, fields[1])
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[2]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid secret: %v", n, err)
+		}
+
+		name := util.CanonicalName(fields[0])
+		keys[name] = &TSIGKey{
+			Name:      name,
+			Algorithm: algorithm,
+			Secret:    fields[2],
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// FindTSIGKey returns the key with the given name (which doesn't need to be
+// fully qualified), or nil if there is none.
+func FindTSIGKey(keys map[string]*TSIGKey, name string) *TSIGKey {
+	return keys[util.CanonicalName(name)]
+}
+
+// ParseForwardZones parses a space-separated list of zones to forward, each
+// in the form "zone=server1[;server2...][,key=name]", with the servers as
+// host:port, and the key one of the given ones (see LoadTSIGKeys).
+func ParseForwardZones(s string, keys map[string]*TSIGKey) ([]ForwardZone, error) {
+	zones := []ForwardZone{}
+	seen := map[string]bool{}
+	for _, f := range strings.Fields(s) {
+		z, err := parseForwardZone(f, keys)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", f, err)
+		}
+		if seen[z.Zone] {
+			return nil, fmt.Errorf("%q: zone %q is listed more than once",
+				f, z.Zone)
+		}
+		seen[z.Zone] = true
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+func parseForwardZone(s string, keys map[string]*TSIGKey) (ForwardZone, error) {
+	z := ForwardZone{}
+	parts := strings.Split(s, ",")
+
+	kv := strings.SplitN(parts[0], "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return z, fmt.Errorf("expected zone=servers")
+	}
+	z.Zone = util.CanonicalName(kv[0])
+	for _, addr := range strings.Split(kv[1], ";") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return z, fmt.Errorf("invalid server: %v", err)
+		}
+		z.Servers = append(z.Servers, addr)
+	}
+
+	for _, opt := range parts[1:] {
+		if !strings.HasPrefix(opt, "key=") {
+			return z, fmt.Errorf("unknown option %q", opt)
+		}
+		name := opt[len("key="):]
+		z.Key = FindTSIGKey(keys, name)
+		if z.Key == nil {
+			return z, fmt.Errorf("unknown key %q", name)
+		}
+	}
+	return z, nil
+}
+
+// NewForwardingResolver returns a new resolver which sends the queries for
+// the given zones to their servers, and uses back for everything else.
+func NewForwardingResolver(back Resolver, zones []ForwardZone) *forwardingResolver {
+	f := &forwardingResolver{
+		back:     back,
+		zones:    map[string]*ForwardZone{},
+		clock:    util.RealClock,
+		exchange: exchangeWithKey,
+	}
+	for i := range zones {
+		f.zones[zones[i].Zone] = &zones[i]
+	}
+	return f
+}
+
+func (f *forwardingResolver) Init() error {
+	return f.back.Init()
+}
+
+func (f *forwardingResolver) Maintain() {
+	f.back.Maintain()
+}
+
+// zoneFor returns the closest forwarded zone containing the name, or nil.
+func (f *forwardingResolver) zoneFor(name string) *ForwardZone {
+	name = util.CanonicalName(name)
+	for {
+		if z, ok := f.zones[name]; ok {
+			return z
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return f.zones["."]
+		}
+		name = name[i+1:]
+	}
+}
+
+var errUnsignedReply = errors.New("reply is not signed")
+
+func (f *forwardingResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return f.back.Query(r, tr)
+	}
+
+	z := f.zoneFor(r.Question[0].Name)
+	if z == nil {
+		return f.back.Query(r, tr)
+	}
+	forwardStats.queries.Add(z.Zone, 1)
+
+	// Don't pass along any TSIG the client may have used with us.
+	m := r.Copy()
+	if m.IsTsig() != nil {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+	if z.Key != nil {
+		m.SetTsig(z.Key.Name, z.Key.Algorithm, tsigFudge, f.clock.Now().Unix())
+	}
+
+	err := errors.New("no servers")
+	for _, addr := range z.Servers {
+		var reply *dns.Msg
+		reply, err = f.exchange(m, addr, z.Key)
+		if err == nil && z.Key != nil && reply.IsTsig() == nil {
+			// The client verifies the signature if there is one, but
+			// doesn't complain if there's none.
+			err = errUnsignedReply
+		}
+		if err != nil {
+			forwardStats.errors.Add(1)
+			tr.LazyPrintf("forward %q: %s: %v", z.Zone, addr, err)
+			continue
+		}
+
+		tr.LazyPrintf("forward %q: reply from %s", z.Zone, addr)
+		if reply.IsTsig() != nil {
+			reply.Extra = reply.Extra[:len(reply.Extra)-1]
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("forwarding to %q servers: %v", z.Zone, err)
+}
+
+// exchangeWithKey sends the query to the server over UDP (and over TCP if
+// the reply is truncated), verifying the reply's signature with the key, if
+// given.
+func exchangeWithKey(m *dns.Msg, addr string, key *TSIGKey) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: forwardTimeout}
+	if key != nil {
+		c.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	reply, _, err := c.Exchange(m, addr)
+	if err == nil && reply == nil {
+		err = errors.New("no reply")
+	}
+	if err != nil || !reply.Truncated {
+		return reply, err
+	}
+
+	c.Net = "tcp"
+	reply, _, err = c.Exchange(m, addr)
+	if err == nil && reply == nil {
+		err = errors.New("no reply")
+	}
+	return reply, err
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &forwardingResolver{}
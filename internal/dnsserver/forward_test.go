@@ -0,0 +1,199 @@
+package dnsserver
+
+// Tests for the per-zone forwarding resolver.
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+const testTSIGKeys = `
+# Keys for the internal servers.
+corp-key. hmac-sha256 c2VjcmV0IGtleSBmb3IgdGVzdGluZw==
+lab-key   HMAC-SHA512 YW5vdGhlciBzZWNyZXQ=
+`
+
+func loadTestKeys(t *testing.T, contents string) (map[string]*TSIGKey, error) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "dnss_forward_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(contents)
+	f.Close()
+
+	return LoadTSIGKeys(f.Name())
+}
+
+func TestLoadTSIGKeys(t *testing.T) {
+	keys, err := loadTestKeys(t, testTSIGKeys)
+	if err != nil {
+		t.Fatalf("error loading keys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %v", keys)
+	}
+	if k := keys["lab-key."]; k == nil || k.Algorithm != dns.HmacSHA512 {
+		t.Errorf("unexpected key: %+v", k)
+	}
+
+	for _, s := range []string{
+		"corp-key. hmac-sha256",
+		"corp-key. hmac-md5 c2VjcmV0",
+		"corp-key. hmac-sha256 not-base64!",
+	} {
+		if _, err := loadTestKeys(t, s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestParseForwardZones(t *testing.T) {
+	keys, _ := loadTestKeys(t, testTSIGKeys)
+	zones, err := ParseForwardZones(
+		"corp.example=10.0.0.53:53;10.0.0.54:53,key=corp-key"+
+			" Lab.Example.=[fd00::53]:53", keys)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if len(zones) != 2 {
+		t.Fatalf("expected 2 zones, got %v", zones)
+	}
+	if zones[0].Zone != "corp.example." || len(zones[0].Servers) != 2 ||
+		zones[0].Key != keys["corp-key."] {
+		t.Errorf("unexpected zone: %+v", zones[0])
+	}
+	if zones[1].Zone != "lab.example." || len(zones[1].Servers) != 1 ||
+		zones[1].Key != nil {
+		t.Errorf("unexpected zone: %+v", zones[1])
+	}
+
+	for _, s := range []string{
+		"corp.example",
+		"corp.example=",
+		"=10.0.0.53:53",
+		"corp.example=10.0.0.53",
+		"corp.example=10.0.0.53:53,key=unknown",
+		"corp.example=10.0.0.53:53,blah",
+		"a.example=10.0.0.53:53 A.example.=10.0.0.54:53",
+	} {
+		if _, err := ParseForwardZones(s, keys); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	keys, _ := loadTestKeys(t, testTSIGKeys)
+	zones, _ := ParseForwardZones(
+		"corp.example=10.0.0.53:53;10.0.0.54:53,key=corp-key"+
+			" lab.example=10.0.1.53:53", keys)
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(testutil.NewRR(t, "www.example. 60 A 192.0.2.1"))
+	f := NewForwardingResolver(back, zones)
+
+	// Servers that are down, or don't sign their replies, are skipped.
+	var used []string
+	signReplies := true
+	f.exchange = func(m *dns.Msg, addr string, key *TSIGKey) (*dns.Msg, error) {
+		used = append(used, addr)
+		if addr == "10.0.0.53:53" {
+			return nil, errors.New("timeout")
+		}
+		if (key != nil) != (m.IsTsig() != nil) {
+			t.Errorf("%s: query signed: %v, key: %v", addr, m.IsTsig(), key)
+		}
+
+		reply := &dns.Msg{}
+		reply.SetReply(m)
+		reply.Answer = []dns.RR{testutil.NewRR(t, m.Question[0].Name+" 60 A 10.0.0.1")}
+		reply.Extra = nil
+		if key != nil && signReplies {
+			reply.SetTsig(key.Name, key.Algorithm, 300, 0)
+		}
+		return reply, nil
+	}
+
+	query := func(name string) (*dns.Msg, error) {
+		used = nil
+		back.LastQuery = nil
+		return f.Query(newQuery(name, dns.TypeA), testutil.NewTestTrace(t))
+	}
+
+	reply, err := query("www.Corp.example.")
+	if err != nil || len(reply.Answer) != 1 || reply.IsTsig() != nil {
+		t.Errorf("unexpected reply: %v, %v", reply, err)
+	}
+	if len(used) != 2 || back.LastQuery != nil {
+		t.Errorf("unexpected servers used: %v", used)
+	}
+
+	if _, err := query("lab.example."); err != nil || len(used) != 1 {
+		t.Errorf("lab.example.: %v, servers used: %v", err, used)
+	}
+
+	if _, err := query("www.example."); err != nil || len(used) != 0 ||
+		back.LastQuery == nil {
+		t.Errorf("www.example.: %v, servers used: %v", err, used)
+	}
+
+	signReplies = false
+	if _, err := query("www.corp.example."); err == nil {
+		t.Errorf("unsigned reply accepted")
+	}
+}
+
+func TestForwardingBadNetwork(t *testing.T) {
+	defer func(d time.Duration) { forwardTimeout = d }(forwardTimeout)
+	forwardTimeout = 300 * time.Millisecond
+
+	addr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(addr,
+		testutil.MakeStaticHandler(t, "www.corp.example. 60 A 10.0.0.1"))
+	if err := testutil.WaitForDNSServer(addr); err != nil {
+		t.Fatalf("DNS server did not start: %v", err)
+	}
+
+	// The first server is unreachable, and the second one is slow (but not
+	// too slow).
+	lossy := testutil.NewNetShim(t, addr)
+	defer lossy.Close()
+	lossy.SetConditions(testutil.NetConditions{Loss: 1})
+	slow := testutil.NewNetShim(t, addr)
+	defer slow.Close()
+	slow.SetConditions(testutil.NetConditions{
+		Latency: 50 * time.Millisecond,
+		Jitter:  50 * time.Millisecond,
+	})
+
+	zones, _ := ParseForwardZones(
+		"corp.example="+lossy.Addr+";"+slow.Addr, nil)
+	f := NewForwardingResolver(testutil.NewTestResolver(), zones)
+	query := func() (*dns.Msg, error) {
+		return f.Query(newQuery("www.corp.example.", dns.TypeA),
+			testutil.NewTestTrace(t))
+	}
+
+	reply, err := query()
+	if err != nil || len(reply.Answer) != 1 {
+		t.Errorf("unexpected reply: %v, %v", reply, err)
+	}
+	if lossy.Dropped() == 0 {
+		t.Errorf("the query didn't go to the first server")
+	}
+
+	// Too slow, and we give up.
+	slow.SetConditions(testutil.NetConditions{Latency: 200 * time.Millisecond})
+	if reply, err := query(); err == nil {
+		t.Errorf("expected a timeout, got %v", reply)
+	}
+}
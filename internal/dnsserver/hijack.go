@@ -0,0 +1,203 @@
+package dnsserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// NXDOMAIN hijacking guard.
+
+// hijackGuardResolver implements a Resolver which detects upstreams that
+// replace NXDOMAIN replies with the address of a "search portal" (usually to
+// show ads), and turns those replies back into NXDOMAIN.
+//
+// The hijacking addresses come from a configured list, and (optionally) from
+// periodically probing the upstream with random names, which should not
+// exist: any address given for them is considered a hijacking one.
+type hijackGuardResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Whether to probe the upstream to detect hijacking addresses.
+	probe bool
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	negativeReplier
+
+	// Protects the fields below.
+	mu *sync.RWMutex
+
+	// Known hijacking addresses: the configured ones, and the detected ones.
+	configured map[string]bool
+	detected   map[string]bool
+}
+
+// NewHijackGuardResolver returns a new resolver which detects NXDOMAIN
+// hijacking in the replies from back. The given IPs are known hijacking
+// addresses; if probe is true, the upstream is also probed with random names
+// to detect them.
+func NewHijackGuardResolver(back Resolver, ips []net.IP, probe bool) *hijackGuardResolver {
+	g := &hijackGuardResolver{
+		back:       back,
+		probe:      probe,
+		mu:         &sync.RWMutex{},
+		configured: map[string]bool{},
+		detected:   map[string]bool{},
+		clock:      util.RealClock,
+
+		negativeReplier: newNegativeReplier(),
+	}
+	for _, ip := range ips {
+		g.configured[ip.String()] = true
+	}
+	return g
+}
+
+// Exported variables for statistics.
+var hijackStats = struct {
+	// Replies turned back into NXDOMAIN.
+	replies *expvar.Int
+
+	// Hijacking addresses detected by probing.
+	detected *expvar.Int
+}{}
+
+func init() {
+	hijackStats.replies = expvar.NewInt("nxdomain-hijacked-replies")
+	hijackStats.detected = expvar.NewInt("nxdomain-hijack-detected-ips")
+}
+
+// How often to probe the upstream, and the TLDs to use for the probes (as
+// hijackers may only target some of them).
+var (
+	hijackProbePeriod = 1 * time.Hour
+	hijackProbeTLDs   = []string{"com.", "net.", "org."}
+)
+
+func (g *hijackGuardResolver) Init() error {
+	if err := g.back.Init(); err != nil {
+		return err
+	}
+
+	if g.probe {
+		g.probeUpstream()
+	}
+	return nil
+}
+
+func (g *hijackGuardResolver) Maintain() {
+	go g.back.Maintain()
+
+	if !g.probe {
+		return
+	}
+
+	g.clock.Every(hijackProbePeriod, g.probeUpstream)
+}
+
+// probeUpstream queries random (non-existing) names, and records any
+// addresses given for them as hijacking addresses.
+func (g *hijackGuardResolver) probeUpstream() {
+	tr := trace.New("dnsserver.HijackGuard", "probe")
+	defer tr.Finish()
+
+	for _, tld := range hijackProbeTLDs {
+		name := randomLabel() + "." + tld
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			req := &dns.Msg{}
+			req.SetQuestion(name, qtype)
+			reply, err := g.back.Query(req, tr)
+			if err != nil {
+				tr.LazyPrintf("probe for %q failed: %v", name, err)
+				continue
+			}
+
+			for _, ip := range answerIPs(reply) {
+				g.mu.Lock()
+				isNew := !g.detected[ip.String()]
+				g.detected[ip.String()] = true
+				g.mu.Unlock()
+
+				if isNew {
+					hijackStats.detected.Add(1)
+					tr.LazyPrintf("detected hijacking address %v", ip)
+					log.Infof("Upstream hijacks NXDOMAIN replies, using %v"+
+						" (found probing %q)", ip, name)
+				}
+			}
+		}
+	}
+}
+
+// randomLabel returns a random label, long enough to be (almost certainly)
+// non-existing.
+func randomLabel() string {
+	buf := make([]byte, 10)
+	rand.Read(buf)
+	return "dnss-probe-" + hex.EncodeToString(buf)
+}
+
+// answerIPs returns the addresses in the A and AAAA records of the answer.
+func answerIPs(m *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips
+}
+
+// isHijacked returns true if the reply has addresses, and all of them are
+// known hijacking ones.
+func (g *hijackGuardResolver) isHijacked(reply *dns.Msg) bool {
+	ips := answerIPs(reply)
+	if len(ips) == 0 {
+		return false
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, ip := range ips {
+		s := ip.String()
+		if !g.configured[s] && !g.detected[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *hijackGuardResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	reply, err := g.back.Query(r, tr)
+	if err != nil || reply.Rcode != dns.RcodeSuccess || !g.isHijacked(reply) {
+		return reply, err
+	}
+
+	tr.LazyPrintf("hijacked NXDOMAIN detected, fixing reply")
+	hijackStats.replies.Add(1)
+
+	// We don't know where the zone cut is, so the SOA is for the name
+	// itself.
+	fixed := g.negativeReply(r, dns.RcodeNameError, r.Question[0].Name)
+	fixed.RecursionAvailable = reply.RecursionAvailable
+	return fixed, nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &hijackGuardResolver{}
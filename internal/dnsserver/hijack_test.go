@@ -0,0 +1,118 @@
+package dnsserver
+
+// Tests for the NXDOMAIN hijacking guard.
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// hijackingResolver is a Resolver for testing, which answers with the
+// records for the query name, or with the given address instead of NXDOMAIN
+// (like hijacking upstreams do).
+type hijackingResolver struct {
+	answers map[string][]dns.RR
+	portal  string
+}
+
+func (r *hijackingResolver) Init() error { return nil }
+func (r *hijackingResolver) Maintain()   {}
+
+func (r *hijackingResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	name := req.Question[0].Name
+	reply := newReplyTo(req)
+	if rrs, ok := r.answers[name]; ok {
+		reply.Answer = rrs
+		return reply, nil
+	}
+
+	if req.Question[0].Qtype == dns.TypeA {
+		rr, _ := dns.NewRR(name + " 60 A " + r.portal)
+		reply.Answer = []dns.RR{rr}
+	}
+	return reply, nil
+}
+
+func newHijackingResolver(t *testing.T) *hijackingResolver {
+	return &hijackingResolver{
+		answers: map[string][]dns.RR{
+			"example.com.": {mustNewRR(t, "example.com. 60 A 1.2.3.4")},
+			"mixed.com.": {
+				mustNewRR(t, "mixed.com. 60 A 1.2.3.4"),
+				mustNewRR(t, "mixed.com. 60 A 10.9.9.9"),
+			},
+		},
+		portal: "10.9.9.9",
+	}
+}
+
+func checkHijack(t *testing.T, g *hijackGuardResolver, name string, rcode, answers int) {
+	t.Helper()
+	tr := testutil.NewTestTrace(t)
+	defer tr.Finish()
+
+	reply, err := g.Query(newQuery(name, dns.TypeA), tr)
+	if err != nil {
+		t.Fatalf("%q: query error: %v", name, err)
+	}
+	if reply.Rcode != rcode || len(reply.Answer) != answers {
+		t.Errorf("%q: got rcode %d with %d answers, expected %d with %d",
+			name, reply.Rcode, len(reply.Answer), rcode, answers)
+	}
+}
+
+func TestHijackConfigured(t *testing.T) {
+	g := NewHijackGuardResolver(newHijackingResolver(t),
+		[]net.IP{net.ParseIP("10.9.9.9")}, false)
+	if err := g.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	checkHijack(t, g, "example.com.", dns.RcodeSuccess, 1)
+	checkHijack(t, g, "unknown.com.", dns.RcodeNameError, 0)
+
+	// Only some of the addresses are hijacking ones: leave it alone.
+	checkHijack(t, g, "mixed.com.", dns.RcodeSuccess, 2)
+}
+
+func TestHijackProbe(t *testing.T) {
+	back := newHijackingResolver(t)
+	g := NewHijackGuardResolver(back, nil, true)
+
+	// Before probing, we don't know about the hijacking address.
+	checkHijack(t, g, "unknown.com.", dns.RcodeSuccess, 1)
+
+	if err := g.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	if !g.detected["10.9.9.9"] || len(g.detected) != 1 {
+		t.Errorf("unexpected detected addresses: %v", g.detected)
+	}
+
+	checkHijack(t, g, "example.com.", dns.RcodeSuccess, 1)
+	checkHijack(t, g, "unknown.com.", dns.RcodeNameError, 0)
+}
+
+func TestHijackNoHijacking(t *testing.T) {
+	// An upstream which behaves: probing finds nothing.
+	g := NewHijackGuardResolver(&nameResolver{}, nil, true)
+	if err := g.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	if len(g.detected) != 0 {
+		t.Errorf("unexpected detected addresses: %v", g.detected)
+	}
+}
+
+func TestRandomLabel(t *testing.T) {
+	a, b := randomLabel(), randomLabel()
+	if a == b || !strings.HasPrefix(a, "dnss-probe-") || len(a) > 63 {
+		t.Errorf("bad random labels: %q, %q", a, b)
+	}
+}
@@ -0,0 +1,460 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/csv"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// DHCP leases resolver.
+
+// leasesResolver implements a Resolver which answers for the hosts in a DHCP
+// server's lease file: A/AAAA records for "<hostname>.<domain>", and the
+// corresponding PTR records. Everything else is forwarded to the backing
+// resolver.
+//
+// The lease file is checked periodically, and reloaded when it changes.
+type leasesResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Lease file, its format, and the domain to put the hosts under.
+	path   string
+	format string
+	domain string
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	negativeReplier
+
+	// Protects the fields below.
+	mu *sync.RWMutex
+
+	// Records, indexed by (lowercased) name, including the PTR ones.
+	records map[string][]dns.RR
+
+	// Modification time of the lease file when we last loaded it.
+	mtime time.Time
+}
+
+// Supported lease file formats.
+var leaseParsers = map[string]func(io.Reader, time.Time) ([]lease, error){
+	"dnsmasq": parseDnsmasqLeases,
+	"isc":     parseISCLeases,
+	"kea":     parseKeaLeases,
+}
+
+// ValidLeasesFormat returns an error if the given lease file format is not
+// supported.
+func ValidLeasesFormat(format string) error {
+	if _, ok := leaseParsers[format]; !ok {
+		return fmt.Errorf("unknown format %q (expected dnsmasq, isc, or kea)",
+			format)
+	}
+	return nil
+}
+
+// NewLeasesResolver returns a new resolver which answers for the hosts in
+// the given lease file (in the given format, see ValidLeasesFormat) under
+// domain, and uses back to resolve everything else.
+func NewLeasesResolver(back Resolver, path, format, domain string) *leasesResolver {
+	return &leasesResolver{
+		back:    back,
+		path:    path,
+		format:  format,
+		domain:  util.CanonicalName(domain),
+		mu:      &sync.RWMutex{},
+		records: map[string][]dns.RR{},
+		clock:   util.RealClock,
+
+		negativeReplier: newNegativeReplier(),
+	}
+}
+
+// Exported variables for statistics.
+var leasesStats = struct {
+	// Number of active leases we have loaded.
+	leases *expvar.Int
+
+	// Queries answered from the leases.
+	answers *expvar.Int
+
+	// Errors loading the lease file.
+	loadErrors *expvar.Int
+}{}
+
+func init() {
+	leasesStats.leases = expvar.NewInt("dhcp-leases")
+	leasesStats.answers = expvar.NewInt("dhcp-lease-answers")
+	leasesStats.loadErrors = expvar.NewInt("dhcp-lease-load-errors")
+}
+
+// How often to check the lease file for changes, and the TTL of the records
+// we give (short, as leases can change at any time).
+const (
+	leasesCheckPeriod = 30 * time.Second
+	leasesTTL         = 60
+)
+
+// lease is a single active DHCP lease.
+type lease struct {
+	hostname string
+	ip       net.IP
+}
+
+func (r *leasesResolver) Init() error {
+	if err := r.reload(); err != nil {
+		return err
+	}
+	return r.back.Init()
+}
+
+func (r *leasesResolver) Maintain() {
+	go r.back.Maintain()
+
+	r.clock.Every(leasesCheckPeriod, func() {
+		if err := r.reload(); err != nil {
+			leasesStats.loadErrors.Add(1)
+			log.Errorf("Error reloading DHCP leases: %v", err)
+		}
+	})
+}
+
+// reload the lease file, if it has changed since the last time.
+func (r *leasesResolver) reload() error {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	unchanged := fi.ModTime().Equal(r.mtime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	leases, err := leaseParsers[r.format](f, r.clock.Now())
+	if err != nil {
+		return fmt.Errorf("error parsing %q: %v", r.path, err)
+	}
+
+	records := r.leasesToRecords(leases)
+
+	r.mu.Lock()
+	r.records = records
+	r.mtime = fi.ModTime()
+	r.mu.Unlock()
+
+	leasesStats.leases.Set(int64(len(leases)))
+	log.Infof("Loaded %d DHCP leases from %q", len(leases), r.path)
+	return nil
+}
+
+// leasesToRecords builds the DNS records for the given leases.
+func (r *leasesResolver) leasesToRecords(leases []lease) map[string][]dns.RR {
+	records := map[string][]dns.RR{}
+	for _, l := range leases {
+		name := l.hostname + "." + r.domain
+		hdr := dns.RR_Header{
+			Name:  name,
+			Class: dns.ClassINET,
+			Ttl:   leasesTTL,
+		}
+
+		var rr dns.RR
+		if ip4 := l.ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: hdr, A: ip4}
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: hdr, AAAA: l.ip}
+		}
+		records[name] = append(records[name], rr)
+
+		rev, err := dns.ReverseAddr(l.ip.String())
+		if err != nil {
+			continue
+		}
+		records[rev] = append(records[rev], &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   rev,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    leasesTTL,
+			},
+			Ptr: name,
+		})
+	}
+	return records
+}
+
+// reverseRecords returns the records from the leases, for the reverse zones
+// (see reverseResolver).
+func (r *leasesResolver) reverseRecords() map[string][]dns.RR {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.records
+}
+
+// Hostname returns the name of the host with the given address (without the
+// domain), or "" if it has no lease.
+func (r *leasesResolver) Hostname(ip net.IP) string {
+	rev, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ""
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rr := range r.records[rev] {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			return strings.TrimSuffix(ptr.Ptr, "."+r.domain)
+		}
+	}
+	return ""
+}
+
+func (r *leasesResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return r.back.Query(req, tr)
+	}
+
+	question := req.Question[0]
+	name := util.CanonicalName(question.Name)
+
+	r.mu.RLock()
+	rrs, ok := r.records[name]
+	r.mu.RUnlock()
+
+	if !ok {
+		// Names under our domain are all ours, so if we don't have it, it
+		// does not exist.
+		if dns.IsSubDomain(r.domain, name) && name != r.domain {
+			tr.LazyPrintf("leases: unknown host")
+			reply := r.negativeReply(req, dns.RcodeNameError, r.domain)
+			reply.Authoritative = true
+			return reply, nil
+		}
+		return r.back.Query(req, tr)
+	}
+
+	tr.LazyPrintf("answering from DHCP leases")
+	leasesStats.answers.Add(1)
+
+	reply := newReplyTo(req)
+	reply.Authoritative = true
+	reply.Answer = matchingRRs(rrs, question)
+	return reply, nil
+}
+
+// sanitizeHostname returns the given hostname as a valid DNS label, or ""
+// if it can't be used.
+func sanitizeHostname(h string) string {
+	h = strings.ToLower(strings.TrimSpace(h))
+
+	// Some clients send their FQDN, we only want the first label.
+	if i := strings.Index(h, "."); i >= 0 {
+		h = h[:i]
+	}
+
+	if h == "" || h == "*" || len(h) > 63 {
+		return ""
+	}
+	for _, c := range h {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return h
+}
+
+// parseDnsmasqLeases parses a dnsmasq lease file, with lines like:
+//
+//	<expiry> <mac> <ip> <hostname> <client id>
+//
+// IPv6 leases come after a "duid" line, and have the IAID instead of the
+// MAC. Expiry is in seconds since the epoch, or 0 for infinite leases.
+func parseDnsmasqLeases(rd io.Reader, now time.Time) ([]lease, error) {
+	var leases []lease
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", fields[0])
+		}
+		if expiry != 0 && time.Unix(expiry, 0).Before(now) {
+			continue
+		}
+
+		ip := net.ParseIP(fields[2])
+		hostname := sanitizeHostname(fields[3])
+		if ip == nil || hostname == "" {
+			continue
+		}
+		leases = append(leases, lease{hostname, ip})
+	}
+	return leases, scanner.Err()
+}
+
+// parseISCLeases parses an ISC dhcpd (IPv4) lease file, with entries like:
+//
+//	lease 192.168.1.10 {
+//	  ends 4 2019/01/10 22:00:00;
+//	  binding state active;
+//	  client-hostname "nas";
+//	}
+//
+// Entries are appended as leases change, so later ones take precedence.
+func parseISCLeases(rd io.Reader, now time.Time) ([]lease, error) {
+	type entry struct {
+		hostname string
+		active   bool
+		expired  bool
+	}
+	entries := map[string]*entry{}
+	var order []string
+
+	var cur *entry
+	var curIP string
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch {
+		case fields[0] == "lease" && len(fields) >= 3 && fields[2] == "{":
+			curIP = fields[1]
+			cur = &entry{}
+		case fields[0] == "}" && cur != nil:
+			if _, ok := entries[curIP]; !ok {
+				order = append(order, curIP)
+			}
+			entries[curIP] = cur
+			cur = nil
+		case cur == nil:
+			continue
+		case fields[0] == "binding" && len(fields) >= 3:
+			cur.active = fields[2] == "active"
+		case fields[0] == "ends" && len(fields) >= 4:
+			t, err := time.Parse("2006/01/02 15:04:05",
+				fields[2]+" "+fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid end time %q", line)
+			}
+			cur.expired = t.Before(now)
+		case fields[0] == "client-hostname" && len(fields) >= 2:
+			cur.hostname = strings.Trim(fields[1], `"`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var leases []lease
+	for _, ip := range order {
+		e := entries[ip]
+		hostname := sanitizeHostname(e.hostname)
+		if !e.active || e.expired || hostname == "" {
+			continue
+		}
+		if parsed := net.ParseIP(ip); parsed != nil {
+			leases = append(leases, lease{hostname, parsed})
+		}
+	}
+	return leases, nil
+}
+
+// parseKeaLeases parses a Kea "memfile" lease file (CSV, for IPv4 or IPv6).
+// Kea appends to the file as leases change, so later entries take
+// precedence.
+func parseKeaLeases(rd io.Reader, now time.Time) ([]lease, error) {
+	r := csv.NewReader(rd)
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	col := map[string]int{}
+	for i, name := range rows[0] {
+		col[name] = i
+	}
+	for _, name := range []string{"address", "expire", "hostname", "state"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("missing %q column", name)
+		}
+	}
+
+	type entry struct {
+		hostname string
+		valid    bool
+	}
+	entries := map[string]*entry{}
+	var order []string
+	for _, row := range rows[1:] {
+		if len(row) != len(rows[0]) {
+			continue
+		}
+
+		expire, _ := strconv.ParseInt(row[col["expire"]], 10, 64)
+		addr := row[col["address"]]
+		if _, ok := entries[addr]; !ok {
+			order = append(order, addr)
+		}
+		entries[addr] = &entry{
+			hostname: row[col["hostname"]],
+			// State 0 is "default", which means the lease is assigned.
+			valid: row[col["state"]] == "0" &&
+				time.Unix(expire, 0).After(now),
+		}
+	}
+
+	var leases []lease
+	for _, addr := range order {
+		e := entries[addr]
+		hostname := sanitizeHostname(e.hostname)
+		ip := net.ParseIP(addr)
+		if !e.valid || hostname == "" || ip == nil {
+			continue
+		}
+		leases = append(leases, lease{hostname, ip})
+	}
+	return leases, nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &leasesResolver{}
@@ -0,0 +1,181 @@
+package dnsserver
+
+// Tests for the DHCP leases resolver.
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// Time to use as "now" when parsing the test leases: 2019-01-10 12:00 UTC.
+var leasesNow = time.Date(2019, 1, 10, 12, 0, 0, 0, time.UTC)
+
+const testDnsmasqLeases = `1547164800 aa:bb:cc:dd:ee:01 192.168.1.10 nas 01:aa:bb:cc:dd:ee:01
+1547164800 aa:bb:cc:dd:ee:02 192.168.1.11 * 01:aa:bb:cc:dd:ee:02
+1500000000 aa:bb:cc:dd:ee:03 192.168.1.12 expired *
+0 aa:bb:cc:dd:ee:04 192.168.1.13 Printer.example.com *
+1547164800 aa:bb:cc:dd:ee:05 192.168.1.14 bad_name *
+duid 00:01:00:01:23:45:67:89:aa:bb:cc:dd:ee:01
+1547164800 1234 fd00::10 nas 00:01:00:01:23:45:67:89:aa:bb:cc:dd:ee:01
+`
+
+const testISCLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.1.10 {
+  starts 4 2019/01/10 10:00:00;
+  ends 4 2019/01/10 22:00:00;
+  binding state active;
+  client-hostname "nas";
+}
+lease 192.168.1.11 {
+  starts 4 2019/01/10 10:00:00;
+  ends 4 2019/01/10 11:00:00;
+  binding state active;
+  client-hostname "expired";
+}
+lease 192.168.1.12 {
+  ends never;
+  binding state active;
+  client-hostname "printer";
+}
+lease 192.168.1.13 {
+  binding state active;
+  client-hostname "released";
+}
+lease 192.168.1.13 {
+  binding state free;
+  client-hostname "released";
+}
+`
+
+const testKeaLeases = `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+192.168.1.10,aa:bb:cc:dd:ee:01,,3600,1547164800,1,0,0,nas,0,
+192.168.1.11,aa:bb:cc:dd:ee:02,,3600,1500000000,1,0,0,expired,0,
+192.168.1.12,aa:bb:cc:dd:ee:03,,3600,1547164800,1,0,0,declined,1,
+192.168.1.13,aa:bb:cc:dd:ee:04,,3600,1547164800,1,0,0,printer.lan,0,
+`
+
+func leasesToString(leases []lease) string {
+	var s []string
+	for _, l := range leases {
+		s = append(s, l.hostname+"="+l.ip.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func TestParseLeases(t *testing.T) {
+	cases := []struct {
+		format   string
+		data     string
+		expected string
+	}{
+		{"dnsmasq", testDnsmasqLeases,
+			"nas=192.168.1.10 printer=192.168.1.13 nas=fd00::10"},
+		{"isc", testISCLeases, "nas=192.168.1.10 printer=192.168.1.12"},
+		{"kea", testKeaLeases, "nas=192.168.1.10 printer=192.168.1.13"},
+	}
+
+	for _, c := range cases {
+		leases, err := leaseParsers[c.format](
+			strings.NewReader(c.data), leasesNow)
+		if err != nil {
+			t.Errorf("%s: error parsing: %v", c.format, err)
+			continue
+		}
+		if got := leasesToString(leases); got != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.format, c.expected, got)
+		}
+	}
+
+	if _, err := parseDnsmasqLeases(
+		strings.NewReader("abc mac ip host id\n"), leasesNow); err == nil {
+		t.Errorf("dnsmasq: invalid expiry parsed fine")
+	}
+	if _, err := parseKeaLeases(
+		strings.NewReader("address,hostname\n"), leasesNow); err == nil {
+		t.Errorf("kea: missing columns parsed fine")
+	}
+}
+
+func TestLeases(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnss_leases_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("0 aa:bb:cc:dd:ee:01 192.168.1.10 nas *\n" +
+		"duid 00:01\n" +
+		"0 1234 fd00::10 nas *\n")
+	f.Close()
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "upstream. A 1.2.3.4"))
+	r := NewLeasesResolver(back, f.Name(), "dnsmasq", "Lan")
+	if err := r.Init(); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+
+	if h := r.Hostname(net.ParseIP("192.168.1.10")); h != "nas" {
+		t.Errorf("unexpected hostname for 192.168.1.10: %q", h)
+	}
+	if h := r.Hostname(net.ParseIP("192.168.1.11")); h != "" {
+		t.Errorf("unexpected hostname for 192.168.1.11: %q", h)
+	}
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+		passed bool
+	}{
+		{"nas.lan.", dns.TypeA, dns.RcodeSuccess, "192.168.1.10", false},
+		{"NAS.lan.", dns.TypeAAAA, dns.RcodeSuccess, "fd00::10", false},
+		{"nas.lan.", dns.TypeMX, dns.RcodeSuccess, "", false},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess,
+			"nas.lan.", false},
+		{"unknown.lan.", dns.TypeA, dns.RcodeNameError, "", false},
+		{"lan.", dns.TypeSOA, dns.RcodeSuccess, "1.2.3.4", true},
+		{"example.com.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4", true},
+	}
+
+	for _, c := range cases {
+		back.LastQuery = nil
+		tr := testutil.NewTestTrace(t)
+		resp, err := r.Query(newQuery(c.name, c.qtype), tr)
+		if err != nil {
+			t.Errorf("%s: query failed: %v", c.name, err)
+			continue
+		}
+
+		if resp.Rcode != c.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", c.name, c.rcode, resp.Rcode)
+		}
+		answer := ""
+		if len(resp.Answer) == 1 {
+			switch rr := resp.Answer[0].(type) {
+			case *dns.A:
+				answer = rr.A.String()
+			case *dns.AAAA:
+				answer = rr.AAAA.String()
+			case *dns.PTR:
+				answer = rr.Ptr
+			}
+		}
+		if answer != c.answer {
+			t.Errorf("%s: expected answer %q, got %v",
+				c.name, c.answer, resp.Answer)
+		}
+		if passed := back.LastQuery != nil; passed != c.passed {
+			t.Errorf("%s: expected passthrough %v, got %v",
+				c.name, c.passed, passed)
+		}
+	}
+}
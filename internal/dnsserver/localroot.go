@@ -0,0 +1,262 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Local copy of the root zone.
+
+// localRoot is a local copy of the root zone, which the recursive resolver
+// uses to answer the queries it would send to the root servers (RFC 8806).
+// This way it doesn't depend on reaching them, and they don't see our
+// queries.
+//
+// Like the rest of the recursive resolver, it does no DNSSEC validation of
+// the zone; it only checks that it looks like the root zone, and that its
+// serial doesn't go backwards.
+type localRoot struct {
+	// Where to load the zone from, in order: the first one that works is
+	// used.
+	sources []string
+
+	// HTTP client used to download the zone.
+	client *http.Client
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Protects the fields below.
+	mu *sync.RWMutex
+
+	// SOA of the zone (nil if we haven't loaded it yet), and when we did.
+	soa    *dns.SOA
+	loaded time.Time
+
+	// Records of the zone, by (lowercase) name.
+	records map[string][]dns.RR
+}
+
+// RootZoneSources are the places where ICANN publishes the root zone
+// (https://www.iana.org/domains/root/files), in our order of preference.
+var RootZoneSources = []string{
+	"https://www.internic.net/domain/root.zone",
+	"axfr://lax.xfr.dns.icann.org",
+	"axfr://iad.xfr.dns.icann.org",
+}
+
+// How often to reload the root zone; this is its SOA refresh value.
+var localRootRefresh = 30 * time.Minute
+
+// Exported variables for statistics.
+var localRootStats = struct {
+	// Queries answered from the local copy of the root zone.
+	answers *expvar.Int
+
+	// Serial of the loaded zone.
+	serial *expvar.Int
+
+	// Failed loads.
+	errors *expvar.Int
+}{}
+
+func init() {
+	localRootStats.answers = expvar.NewInt("local-root-answers")
+	localRootStats.serial = expvar.NewInt("local-root-serial")
+	localRootStats.errors = expvar.NewInt("local-root-errors")
+}
+
+func newLocalRoot(sources []string) *localRoot {
+	return &localRoot{
+		sources: sources,
+		client:  &http.Client{Timeout: 1 * time.Minute},
+		clock:   util.RealClock,
+		mu:      &sync.RWMutex{},
+	}
+}
+
+// reload the zone from the first source that works. If none does, we keep
+// the zone we have (until it expires).
+func (l *localRoot) reload() {
+	tr := trace.New("dnsserver.LocalRoot", "reload")
+	defer tr.Finish()
+
+	for _, source := range l.sources {
+		rrs, err := l.fetch(source)
+		if err == nil {
+			err = l.set(rrs)
+		}
+		if err != nil {
+			localRootStats.errors.Add(1)
+			util.TraceErrorf(tr, "loading root zone from %q: %v", source, err)
+			continue
+		}
+
+		tr.LazyPrintf("loaded root zone from %q: %d records", source, len(rrs))
+		return
+	}
+
+	log.Errorf("Could not load the root zone from any source, see traces")
+}
+
+// fetch the records of the zone from the source, which can be a file, an
+// http(s) URL, or "axfr://server[:port]" for a zone transfer.
+func (l *localRoot) fetch(source string) ([]dns.RR, error) {
+	if strings.HasPrefix(source, "axfr://") {
+		return transferZone(source)
+	}
+
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") ||
+		strings.HasPrefix(source, "https://") {
+		resp, err := l.client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("response status: %s", resp.Status)
+		}
+		r = io.LimitReader(resp.Body, maxRPZDownloadSize)
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return parseZone(r, source)
+}
+
+// set the records of the zone, after checking they are (plausibly) the root
+// zone, and not older than the ones we have.
+func (l *localRoot) set(rrs []dns.RR) error {
+	var soa *dns.SOA
+	records := map[string][]dns.RR{}
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if s, ok := rr.(*dns.SOA); ok {
+			if name != "." || soa != nil {
+				return fmt.Errorf("unexpected SOA for %q", name)
+			}
+			soa = s
+		}
+		records[name] = append(records[name], rr)
+	}
+	if soa == nil {
+		return fmt.Errorf("no SOA for the root")
+	}
+	if len(lookupType(records["."], dns.TypeNS)) == 0 {
+		return fmt.Errorf("no NS for the root")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Serial number arithmetic (RFC 1982): the new one must not be behind.
+	if l.soa != nil && int32(soa.Serial-l.soa.Serial) < 0 {
+		return fmt.Errorf("serial %d is older than the current one (%d)",
+			soa.Serial, l.soa.Serial)
+	}
+
+	l.soa = soa
+	l.loaded = l.clock.Now()
+	l.records = records
+	localRootStats.serial.Set(int64(soa.Serial))
+	return nil
+}
+
+// answer the query as a root server would, or return nil if we don't have
+// a (non-expired) zone to answer from.
+func (l *localRoot) answer(m *dns.Msg) *dns.Msg {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.soa == nil {
+		return nil
+	}
+	expire := time.Duration(l.soa.Expire) * time.Second
+	if l.clock.Now().After(l.loaded.Add(expire)) {
+		return nil
+	}
+	localRootStats.answers.Add(1)
+
+	q := m.Question[0]
+	name := strings.ToLower(q.Name)
+	do := m.IsEdns0() != nil && m.IsEdns0().Do()
+
+	reply := &dns.Msg{}
+	reply.SetReply(m)
+
+	if name != "." && !(q.Qtype == dns.TypeDS && dns.CountLabel(name) == 1) {
+		tld := lastLabels(name, 1)
+		ns := lookupType(l.records[tld], dns.TypeNS)
+		if len(ns) == 0 {
+			reply.Authoritative = true
+			reply.Rcode = dns.RcodeNameError
+			reply.Ns = withSignatures(l.records["."], dns.TypeSOA, do)
+			return reply
+		}
+
+		// Referral to the TLD, with glue.
+		reply.Ns = ns
+		if do {
+			reply.Ns = append(reply.Ns,
+				withSignatures(l.records[tld], dns.TypeDS, true)...)
+		}
+		for _, rr := range ns {
+			target := strings.ToLower(rr.(*dns.NS).Ns)
+			for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				reply.Extra = append(reply.Extra,
+					lookupType(l.records[target], t)...)
+			}
+		}
+		return reply
+	}
+
+	reply.Authoritative = true
+	if len(l.records[name]) == 0 {
+		reply.Rcode = dns.RcodeNameError
+	}
+	reply.Answer = withSignatures(l.records[name], q.Qtype, do)
+	if len(reply.Answer) == 0 {
+		reply.Ns = withSignatures(l.records["."], dns.TypeSOA, do)
+	}
+	return reply
+}
+
+// withSignatures returns the records of the given type, and if do is set, their
+// signatures.
+func withSignatures(rrs []dns.RR, rrtype uint16, do bool) []dns.RR {
+	found := lookupType(rrs, rrtype)
+	if do && len(found) > 0 {
+		found = append(found, signatures(rrs, found[0].Header().Name, rrtype)...)
+	}
+	return found
+}
+
+// lookupType returns the records of the given type.
+func lookupType(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var found []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
@@ -0,0 +1,35 @@
+package dnsserver
+
+import "github.com/miekg/dns"
+
+// SetMinimalResponses makes the server strip the authority and additional
+// sections from the replies, like BIND's minimal-responses. Stub clients
+// ignore them anyway, so this makes the replies smaller (and less likely to
+// be truncated), and gives away less about the upstream's data.
+func (s *Server) SetMinimalResponses(enabled bool) {
+	s.minimalResponses = enabled
+}
+
+// minimizeReply removes the authority and additional sections from the
+// reply, except for what the clients need: the OPT record, and the SOA of
+// negative replies, which tells them how long to cache them (RFC 2308).
+func minimizeReply(reply *dns.Msg) {
+	negative := reply.Rcode == dns.RcodeNameError ||
+		(reply.Rcode == dns.RcodeSuccess && len(reply.Answer) == 0)
+
+	var ns []dns.RR
+	for _, rr := range reply.Ns {
+		if _, ok := rr.(*dns.SOA); ok && negative {
+			ns = append(ns, rr)
+		}
+	}
+	reply.Ns = ns
+
+	var extra []dns.RR
+	for _, rr := range reply.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	reply.Extra = extra
+}
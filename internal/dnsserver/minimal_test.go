@@ -0,0 +1,69 @@
+package dnsserver
+
+// Tests for the minimal responses.
+
+import (
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestMinimizeReply(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: 300},
+		Ns: "ns.test.", Mbox: "admin.test.", Serial: 1, Minttl: 60,
+	}
+	reply := func(rcode int, answers ...string) *dns.Msg {
+		m := newQuery("www.test.", dns.TypeA)
+		m.Response = true
+		m.Rcode = rcode
+		for _, a := range answers {
+			m.Answer = append(m.Answer, mustNewRR(t, a))
+		}
+		m.Ns = []dns.RR{soa, mustNewRR(t, "test. 300 IN NS ns.test.")}
+		m.Extra = []dns.RR{mustNewRR(t, "ns.test. 300 IN A 10.0.0.53")}
+		m.SetEdns0(1232, true)
+		return m
+	}
+
+	// Positive replies lose the authority and additional sections, except
+	// for the OPT record.
+	m := reply(dns.RcodeSuccess, "www.test. 300 IN A 1.2.3.4")
+	minimizeReply(m)
+	if len(m.Answer) != 1 || len(m.Ns) != 0 || len(m.Extra) != 1 ||
+		m.IsEdns0() == nil {
+		t.Errorf("unexpected positive reply: %v", m)
+	}
+
+	// Negative replies keep their SOA.
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+		m = reply(rcode)
+		minimizeReply(m)
+		if len(m.Ns) != 1 || m.Ns[0] != soa || len(m.Extra) != 1 {
+			t.Errorf("unexpected negative reply (rcode %d): %v", rcode, m)
+		}
+	}
+
+	// Through the server, only if enabled.
+	srv := New("", nil, "")
+	w := &recordingWriter{remote: &net.UDPAddr{
+		IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+	q := newQuery("www.test.", dns.TypeA)
+	q.SetEdns0(1232, true)
+	srv.writeReply(w, q, reply(dns.RcodeSuccess, "www.test. 300 IN A 1.2.3.4"),
+		&clientOptions{}, testutil.NewTestTrace(t))
+	if len(w.reply.Ns) != 2 || len(w.reply.Extra) != 2 {
+		t.Errorf("reply minimized by default: %v", w.reply)
+	}
+
+	srv.SetMinimalResponses(true)
+	srv.writeReply(w, q, reply(dns.RcodeSuccess, "www.test. 300 IN A 1.2.3.4"),
+		&clientOptions{}, testutil.NewTestTrace(t))
+	if len(w.reply.Ns) != 0 || len(w.reply.Extra) != 1 {
+		t.Errorf("reply not minimized: %v", w.reply)
+	}
+}
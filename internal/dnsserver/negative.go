@@ -0,0 +1,63 @@
+package dnsserver
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The negative replies we make up for the names we block or own (with the
+// blocklists, the policies, the special-use domains, the static records and
+// the DHCP domain) include an SOA in the authority section, so the clients
+// and the caches downstream can cache the denial (RFC 2308), instead of
+// asking again every time.
+
+// Default for how long our negative replies can be cached.
+const defaultNegativeTTL = 60
+
+// negativeReplier makes up the negative replies; it's embedded in the
+// resolvers that need them, so each has its own TTL (see SetNegativeTTL).
+type negativeReplier struct {
+	// TTL of the SOA; 0 means we don't include it.
+	ttl uint32
+}
+
+func newNegativeReplier() negativeReplier {
+	return negativeReplier{ttl: defaultNegativeTTL}
+}
+
+// SetNegativeTTL sets for how long our negative replies can be cached. It
+// must be called before serving.
+func (n *negativeReplier) SetNegativeTTL(d time.Duration) {
+	n.ttl = uint32(d / time.Second)
+}
+
+// negativeReply returns a negative reply to req, with the given rcode, and
+// an SOA for zone: the one we own, or the name itself if we don't know where
+// the zone cut would be.
+func (n *negativeReplier) negativeReply(req *dns.Msg, rcode int, zone string) *dns.Msg {
+	reply := newReplyTo(req)
+	reply.Rcode = rcode
+	if n.ttl == 0 {
+		return reply
+	}
+
+	// Like the ones for the reverse zones, the SOA points to the zone
+	// itself; the serial doesn't matter, as there is nothing to transfer.
+	reply.Ns = []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    n.ttl,
+		},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  n.ttl,
+	}}
+	return reply
+}
@@ -0,0 +1,52 @@
+package dnsserver
+
+// Tests for the synthesized negative replies.
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNegativeReply(t *testing.T) {
+	req := newQuery("ads.example.", dns.TypeA)
+	cases := []struct {
+		ttl      time.Duration
+		expected uint32
+	}{
+		{time.Minute, 60},
+		{90 * time.Second, 90},
+		{1500 * time.Millisecond, 1},
+	}
+	for _, c := range cases {
+		n := newNegativeReplier()
+		n.SetNegativeTTL(c.ttl)
+		reply := n.negativeReply(req, dns.RcodeNameError, "example.")
+		if reply.Rcode != dns.RcodeNameError || reply.Id != req.Id {
+			t.Errorf("%v: unexpected reply: %v", c.ttl, reply)
+		}
+		if len(reply.Ns) != 1 {
+			t.Errorf("%v: expected an SOA, got %v", c.ttl, reply.Ns)
+			continue
+		}
+		soa, ok := reply.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Name != "example." ||
+			soa.Hdr.Ttl != c.expected || soa.Minttl != c.expected {
+			t.Errorf("%v: unexpected SOA: %v", c.ttl, reply.Ns[0])
+		}
+	}
+
+	// By default, the TTL is one minute.
+	n := newNegativeReplier()
+	reply := n.negativeReply(req, dns.RcodeNameError, ".")
+	if len(reply.Ns) != 1 || reply.Ns[0].Header().Ttl != 60 {
+		t.Errorf("unexpected default authority section: %v", reply.Ns)
+	}
+
+	// With 0, there is no SOA.
+	n.SetNegativeTTL(0)
+	if reply := n.negativeReply(req, dns.RcodeNameError, "."); len(reply.Ns) != 0 {
+		t.Errorf("unexpected authority section: %v", reply.Ns)
+	}
+}
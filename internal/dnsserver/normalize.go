@@ -0,0 +1,103 @@
+package dnsserver
+
+import (
+	"expvar"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Name normalizing resolver.
+
+// normalizingResolver implements a Resolver which normalizes the query names
+// (see util.NormalizeName) before passing them on, so the filters, routes
+// and caches behind it see mixed-case and internationalized names
+// consistently.
+//
+// The replies are given back in terms of the original names, as that is
+// what clients expect.
+type normalizingResolver struct {
+	// Backing resolver.
+	back Resolver
+}
+
+// NewNormalizingResolver returns a new resolver which normalizes the query
+// names, and uses back to resolve them.
+func NewNormalizingResolver(back Resolver) *normalizingResolver {
+	return &normalizingResolver{back: back}
+}
+
+// Exported variables for statistics.
+var normalizeStats = struct {
+	// Queries whose names were changed by the normalization.
+	normalized *expvar.Int
+
+	// Queries whose names could not be normalized, and were passed on
+	// as-is.
+	invalid *expvar.Int
+}{}
+
+func init() {
+	normalizeStats.normalized = expvar.NewInt("normalize-changed-queries")
+	normalizeStats.invalid = expvar.NewInt("normalize-invalid-queries")
+}
+
+func (n *normalizingResolver) Init() error {
+	return n.back.Init()
+}
+
+func (n *normalizingResolver) Maintain() {
+	n.back.Maintain()
+}
+
+func (n *normalizingResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return n.back.Query(r, tr)
+	}
+
+	orig := r.Question[0].Name
+	name, err := util.NormalizeName(orig)
+	if err != nil {
+		tr.LazyPrintf("normalize: %v", err)
+		normalizeStats.invalid.Add(1)
+		return n.back.Query(r, tr)
+	}
+	if name == orig {
+		return n.back.Query(r, tr)
+	}
+
+	tr.LazyPrintf("normalize: %q -> %q", orig, name)
+	normalizeStats.normalized.Add(1)
+
+	q := r.Copy()
+	q.Question[0].Name = name
+	fromUp, err := n.back.Query(q, tr)
+	if err != nil {
+		return nil, err
+	}
+	if fromUp == nil {
+		return nil, errNoReply
+	}
+
+	// Copy the reply, as the resolvers behind us may keep a reference to it
+	// (e.g. the static ones).
+	reply := fromUp.Copy()
+	if len(reply.Question) == 1 {
+		reply.Question[0].Name = orig
+	}
+	for _, rrs := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range rrs {
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = orig
+			}
+		}
+	}
+	return reply, nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &normalizingResolver{}
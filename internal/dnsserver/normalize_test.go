@@ -0,0 +1,164 @@
+package dnsserver
+
+// Tests for the name normalizing resolver.
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+func TestNormalize(t *testing.T) {
+	back := &nameResolver{answers: map[string][]dns.RR{
+		"example.com.": {mustNewRR(t, "example.com. 60 A 1.2.3.4")},
+		"xn--and-6ma2c.com.": {
+			mustNewRR(t, "xn--and-6ma2c.com. 60 A 1.2.3.5")},
+		"_dmarc.example.com.": {
+			mustNewRR(t, `_dmarc.example.com. 60 TXT "v=DMARC1"`)},
+	}}
+	n := NewNormalizingResolver(back)
+
+	cases := []struct {
+		name    string
+		queried string
+		answer  int
+	}{
+		{"example.com.", "example.com.", 1},
+		{"ExAmPlE.CoM.", "example.com.", 1},
+		{"ñandú.com.", "xn--and-6ma2c.com.", 1},
+		{"ÑANDÚ.com.", "xn--and-6ma2c.com.", 1},
+
+		// How the dns library gives us non-ASCII names from the wire.
+		{`\195\177and\195\186.com.`, "xn--and-6ma2c.com.", 1},
+
+		// Underscores are fine, even if IDNA doesn't allow them.
+		{"_DMARC.example.com.", "_dmarc.example.com.", 1},
+
+		// Other escapes are left alone.
+		{`a\.b.example.com.`, `a\.b.example.com.`, 0},
+
+		// Invalid UTF-8 can't be normalized, it's passed on as-is.
+		{`\255.com.`, `\255.com.`, 0},
+	}
+	for _, c := range cases {
+		back.queried = nil
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, dns.TypeA)
+		reply, err := n.Query(req, &testutil.NullTrace{})
+		if err != nil {
+			t.Errorf("%q: query error: %v", c.name, err)
+			continue
+		}
+
+		if len(back.queried) != 1 || back.queried[0] != c.queried {
+			t.Errorf("%q: queried %v, expected %q",
+				c.name, back.queried, c.queried)
+		}
+
+		// The reply must be in terms of the original name.
+		if reply.Question[0].Name != c.name {
+			t.Errorf("%q: reply question is %q", c.name,
+				reply.Question[0].Name)
+		}
+		if len(reply.Answer) != c.answer {
+			t.Errorf("%q: expected %d answers, got %v",
+				c.name, c.answer, reply.Answer)
+			continue
+		}
+		for _, rr := range reply.Answer {
+			if rr.Header().Name != c.name {
+				t.Errorf("%q: answer with name %q", c.name, rr.Header().Name)
+			}
+		}
+	}
+
+	// The backing resolver's records must be left alone.
+	if rr := back.answers["example.com."][0]; rr.Header().Name != "example.com." {
+		t.Errorf("backing record was modified: %v", rr)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	defer func() { util.UnicodeNames = false }()
+
+	name := "www.xn--and-6ma2c.com."
+	if got := util.DisplayName(name); got != name {
+		t.Errorf("DisplayName(%q) = %q, expected no change", name, got)
+	}
+
+	util.UnicodeNames = true
+	if got := util.DisplayName(name); got != "www.ñandú.com." {
+		t.Errorf("DisplayName(%q) = %q", name, got)
+	}
+
+	// Invalid punycode is shown as-is.
+	if got := util.DisplayName("xn--99999999.com."); got != "xn--99999999.com." {
+		t.Errorf("invalid punycode displayed as %q", got)
+	}
+}
+
+func TestCanonicalMatching(t *testing.T) {
+	// The same domain, as it may be configured, and as it may come in the
+	// queries.
+	configured := []string{
+		"bücher.example", "Bücher.Example.", "xn--bcher-kva.example",
+		"XN--BCHER-KVA.EXAMPLE.",
+	}
+	queried := []string{
+		"bücher.example.", "BÜCHER.example.", "xn--bcher-kva.example.",
+		"Xn--Bcher-Kva.Example.", `b\195\188cher.example.`,
+	}
+	client := net.ParseIP("10.0.0.1")
+
+	for _, conf := range configured {
+		fzs, _ := ParseForwardZones(conf+"=10.0.0.53:53", nil)
+		forward := NewForwardingResolver(nil, fzs)
+
+		special := NewSpecialResolver(nil, map[string]string{conf: "refuse"})
+
+		rules, _ := ParseUpdateRules(conf + "=10.0.0.0/8")
+		update := &updateForwarder{rules: rules}
+
+		policy, err := parsePolicy(strings.NewReader(
+			"block if qname matches \"*." + conf + "\""))
+		if err != nil {
+			t.Fatalf("%q: error parsing policy: %v", conf, err)
+		}
+
+		static := NewStaticResolver(nil, "")
+		static.load([]dns.RR{mustNewRR(t, "www."+dns.Fqdn(conf)+" A 1.2.3.4")})
+
+		srv := New("", nil, "")
+		srv.SetFallback("", []string{conf})
+
+		for _, q := range queried {
+			www := "www." + q
+			if forward.zoneFor(www) == nil {
+				t.Errorf("%q: forward zone doesn't match %q", conf, www)
+			}
+			if _, _, ok := special.policy(www); !ok {
+				t.Errorf("%q: special domain doesn't match %q", conf, www)
+			}
+			if !update.allowed(q, client) {
+				t.Errorf("%q: update rule doesn't match %q", conf, q)
+			}
+			if rule, _ := policy.match(newQuery(www, dns.TypeA), client); rule == nil {
+				t.Errorf("%q: policy doesn't match %q", conf, www)
+			}
+			r, err := static.Query(newQuery(www, dns.TypeA),
+				testutil.NewTestTrace(t))
+			if err != nil || len(r.Answer) != 1 {
+				t.Errorf("%q: static record doesn't match %q: %v, %v",
+					conf, www, r, err)
+			}
+			if !srv.isFallbackDomain(q) {
+				t.Errorf("%q: fallback domain doesn't match %q", conf, q)
+			}
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package dnsserver
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Aggressive NSEC resolver.
+
+// nsecResolver implements a Resolver which uses the NSEC records from
+// validated negative replies to answer queries for other names they prove
+// don't exist, without going to the upstream (RFC 8198).
+//
+// We don't validate the records ourselves: we rely on the upstream doing it,
+// and only use replies with the AD bit set. NSEC3 records are not used, as
+// their hashed names can't be checked without implementing the hashing.
+type nsecResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Protects the fields below.
+	mu *sync.Mutex
+
+	// Zones we have NSEC records for, by (lowercase) apex name.
+	zones map[string]*nsecZone
+}
+
+// nsecZone holds the NSEC records we know of for a zone.
+type nsecZone struct {
+	// SOA record of the zone, and its signatures, to include in the
+	// synthesized replies.
+	soa     *dns.SOA
+	soaSigs []dns.RR
+
+	// NSEC records, by (lowercase) owner name.
+	records map[string]*nsecEntry
+}
+
+type nsecEntry struct {
+	nsec    *dns.NSEC
+	sigs    []dns.RR
+	expires time.Time
+}
+
+// Constants that tune the NSEC resolver, declared as variables so we can
+// tweak them for testing.
+var (
+	// Maximum number of NSEC records to keep for each zone.
+	nsecMaxPerZone = 1000
+
+	// How often to remove the expired records.
+	nsecGCPeriod = 10 * time.Minute
+)
+
+// NewAggressiveNSECResolver returns a new resolver which synthesizes negative
+// replies from the NSEC records in the (validated) replies from back.
+func NewAggressiveNSECResolver(back Resolver) *nsecResolver {
+	return &nsecResolver{
+		back:  back,
+		clock: util.RealClock,
+		mu:    &sync.Mutex{},
+		zones: map[string]*nsecZone{},
+	}
+}
+
+// Exported variables for statistics.
+var nsecStats = struct {
+	// NSEC records cached.
+	cached *expvar.Int
+
+	// Replies synthesized from the NSEC records, by kind.
+	nxdomain *expvar.Int
+	nodata   *expvar.Int
+}{}
+
+func init() {
+	nsecStats.cached = expvar.NewInt("nsec-cached")
+	nsecStats.nxdomain = expvar.NewInt("nsec-synthesized-nxdomain")
+	nsecStats.nodata = expvar.NewInt("nsec-synthesized-nodata")
+}
+
+func (n *nsecResolver) Init() error {
+	return n.back.Init()
+}
+
+func (n *nsecResolver) Maintain() {
+	go n.back.Maintain()
+
+	n.clock.Every(nsecGCPeriod, n.gc)
+}
+
+// gc removes the expired records, and the zones left without any.
+func (n *nsecResolver) gc() {
+	now := n.clock.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for apex, z := range n.zones {
+		for owner, e := range z.records {
+			if now.After(e.expires) {
+				delete(z.records, owner)
+			}
+		}
+		if len(z.records) == 0 {
+			delete(n.zones, apex)
+		}
+	}
+}
+
+func (n *nsecResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	// Clients setting CD want to do the validation themselves, so they get
+	// the upstream's replies untouched.
+	if len(r.Question) != 1 || r.CheckingDisabled {
+		return n.back.Query(r, tr)
+	}
+
+	opt := r.IsEdns0()
+	do := opt != nil && opt.Do()
+
+	if reply := n.synthesize(r, do, tr); reply != nil {
+		return reply, nil
+	}
+
+	// Ask for the DNSSEC records, so we get the NSEC records to cache.
+	req := r
+	if !do {
+		req = r.Copy()
+		if ropt := req.IsEdns0(); ropt != nil {
+			ropt.SetDo()
+		} else {
+			req.SetEdns0(4096, true)
+		}
+	}
+
+	reply, err := n.back.Query(req, tr)
+	if err != nil {
+		return reply, err
+	}
+	n.record(reply, tr)
+
+	if !do {
+		reply = stripDNSSEC(reply, opt != nil)
+	}
+	return reply, nil
+}
+
+// record saves the NSEC records of the reply, if it's a validated negative
+// one.
+func (n *nsecResolver) record(reply *dns.Msg, tr trace.Trace) {
+	if !reply.AuthenticatedData {
+		return
+	}
+	nodata := reply.Rcode == dns.RcodeSuccess && len(reply.Answer) == 0
+	if reply.Rcode != dns.RcodeNameError && !nodata {
+		return
+	}
+
+	var soa *dns.SOA
+	for _, rr := range reply.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+	if soa == nil {
+		return
+	}
+	apex := strings.ToLower(soa.Hdr.Name)
+
+	// Negative replies can be cached for the smaller of the SOA TTL and its
+	// minimum field (RFC 2308), and so can the NSEC records (RFC 8198).
+	ttl := soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+	now := n.clock.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	z, ok := n.zones[apex]
+	if !ok {
+		z = &nsecZone{records: map[string]*nsecEntry{}}
+		n.zones[apex] = z
+	}
+	z.soa = soa
+	z.soaSigs = signatures(reply.Ns, soa.Hdr.Name, dns.TypeSOA)
+
+	for _, rr := range reply.Ns {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok || !dns.IsSubDomain(apex, strings.ToLower(nsec.Hdr.Name)) ||
+			!dns.IsSubDomain(apex, strings.ToLower(nsec.NextDomain)) {
+			continue
+		}
+
+		owner := strings.ToLower(nsec.Hdr.Name)
+		if _, ok := z.records[owner]; !ok && len(z.records) >= nsecMaxPerZone {
+			tr.LazyPrintf("too many NSEC records for %q, not caching", apex)
+			continue
+		}
+
+		t := ttl
+		if nsec.Hdr.Ttl < t {
+			t = nsec.Hdr.Ttl
+		}
+		z.records[owner] = &nsecEntry{
+			nsec:    nsec,
+			sigs:    signatures(reply.Ns, nsec.Hdr.Name, dns.TypeNSEC),
+			expires: now.Add(time.Duration(t) * time.Second),
+		}
+		nsecStats.cached.Add(1)
+	}
+}
+
+// synthesize returns a negative reply to the query if the cached NSEC
+// records prove the name or type don't exist, or nil otherwise.
+func (n *nsecResolver) synthesize(r *dns.Msg, do bool, tr trace.Trace) *dns.Msg {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	now := n.clock.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	z := n.zoneFor(name)
+	if z == nil {
+		return nil
+	}
+
+	var proof []*nsecEntry
+	rcode := dns.RcodeSuccess
+	if e, ok := z.records[name]; ok && now.Before(e.expires) {
+		// The name exists: check that the type doesn't.
+		if hasType(e.nsec, q.Qtype) || hasType(e.nsec, dns.TypeCNAME) {
+			return nil
+		}
+
+		// At delegations, the parent's NSEC only tells about the DS.
+		if hasType(e.nsec, dns.TypeNS) && !hasType(e.nsec, dns.TypeSOA) &&
+			q.Qtype != dns.TypeDS {
+			return nil
+		}
+		proof = []*nsecEntry{e}
+	} else {
+		// The name must be covered, and so must be the wildcard that could
+		// have matched it.
+		e := z.covering(name, now)
+		if e == nil {
+			return nil
+		}
+
+		ce := closestEncloser(name, e.nsec)
+		w := z.covering(dns.Fqdn("*."+strings.TrimSuffix(ce, ".")), now)
+		if w == nil {
+			return nil
+		}
+
+		proof = []*nsecEntry{e}
+		if w != e {
+			proof = append(proof, w)
+		}
+		rcode = dns.RcodeNameError
+	}
+
+	reply := newReplyTo(r)
+	reply.Rcode = rcode
+	reply.AuthenticatedData = true
+
+	// Use the remaining TTL of the proofs, which is at most that of the SOA.
+	ttl := uint32(proof[0].expires.Sub(now) / time.Second)
+	for _, e := range proof[1:] {
+		if t := uint32(e.expires.Sub(now) / time.Second); t < ttl {
+			ttl = t
+		}
+	}
+
+	reply.Ns = append(reply.Ns, withTTL(z.soa, ttl))
+	if do {
+		for _, rr := range z.soaSigs {
+			reply.Ns = append(reply.Ns, withTTL(rr, ttl))
+		}
+		for _, e := range proof {
+			reply.Ns = append(reply.Ns, withTTL(e.nsec, ttl))
+			for _, rr := range e.sigs {
+				reply.Ns = append(reply.Ns, withTTL(rr, ttl))
+			}
+		}
+	}
+
+	if rcode == dns.RcodeNameError {
+		nsecStats.nxdomain.Add(1)
+		tr.LazyPrintf("NXDOMAIN synthesized from NSEC %q -> %q",
+			proof[0].nsec.Hdr.Name, proof[0].nsec.NextDomain)
+	} else {
+		nsecStats.nodata.Add(1)
+		tr.LazyPrintf("NODATA synthesized from NSEC %q", proof[0].nsec.Hdr.Name)
+	}
+	return reply
+}
+
+// zoneFor returns the closest zone containing the name, or nil if we have
+// none. Must be called with the lock held.
+func (n *nsecResolver) zoneFor(name string) *nsecZone {
+	labels := dns.SplitDomainName(name)
+	for i := 0; i <= len(labels); i++ {
+		if z, ok := n.zones[lastLabels(name, len(labels)-i)]; ok {
+			return z
+		}
+	}
+	return nil
+}
+
+// covering returns an unexpired NSEC record which covers the name (that is,
+// the name falls in between its owner and the next name), or nil.
+func (z *nsecZone) covering(name string, now time.Time) *nsecEntry {
+	for _, e := range z.records {
+		if now.Before(e.expires) && covers(e.nsec, name) {
+			// A delegation's NSEC covers the names in the parent only.
+			if hasType(e.nsec, dns.TypeNS) && !hasType(e.nsec, dns.TypeSOA) &&
+				dns.IsSubDomain(strings.ToLower(e.nsec.Hdr.Name), name) {
+				continue
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+// covers returns true if the name falls in between the owner and the next
+// name of the NSEC record, in canonical order.
+func covers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 &&
+			canonicalCompare(name, next) < 0
+	}
+
+	// The last record of the zone, whose next name is the apex.
+	return canonicalCompare(owner, name) < 0
+}
+
+// closestEncloser returns the closest existing ancestor of the name covered
+// by the NSEC record: the longest one it shares with either end of the
+// record (RFC 4592).
+func closestEncloser(name string, nsec *dns.NSEC) string {
+	n := commonLabels(name, nsec.Hdr.Name)
+	if c := commonLabels(name, nsec.NextDomain); c > n {
+		n = c
+	}
+	return lastLabels(name, n)
+}
+
+// commonLabels returns how many labels the names have in common, from the
+// right.
+func commonLabels(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+	return n
+}
+
+// canonicalCompare compares the two names in the canonical DNS order
+// (RFC 4034 section 6.1): label by label from the right, case-insensitively.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// hasType returns true if the NSEC record says its owner has the given type.
+func hasType(nsec *dns.NSEC, qtype uint16) bool {
+	for _, t := range nsec.TypeBitMap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// signatures returns the RRSIG records for the given name and type.
+func signatures(rrs []dns.RR, name string, rrtype uint16) []dns.RR {
+	var sigs []dns.RR
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype &&
+			strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, rr)
+		}
+	}
+	return sigs
+}
+
+// withTTL returns a copy of the record, with the given TTL.
+func withTTL(rr dns.RR, ttl uint32) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = ttl
+	return rr
+}
+
+// stripDNSSEC returns a copy of the reply without the DNSSEC records, for
+// clients that didn't ask for them; the OPT record is removed too if the
+// client didn't send one.
+func stripDNSSEC(reply *dns.Msg, withOPT bool) *dns.Msg {
+	reply = reply.Copy()
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				continue
+			case dns.TypeOPT:
+				if !withOPT {
+					continue
+				}
+				rr.(*dns.OPT).SetDo(false)
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	reply.Answer = strip(reply.Answer)
+	reply.Ns = strip(reply.Ns)
+	reply.Extra = strip(reply.Extra)
+	return reply
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &nsecResolver{}
@@ -0,0 +1,216 @@
+package dnsserver
+
+// Tests for the aggressive NSEC resolver.
+
+import (
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// signedZoneResolver is a Resolver for testing, which serves the zone
+// example. with the names in the NSEC chain below, as a validating
+// upstream would.
+type signedZoneResolver struct {
+	// Whether to set the AD bit in the replies.
+	validated bool
+
+	// Names asked for.
+	queries []string
+}
+
+// The NSEC chain of the zone: owner, next name, and types.
+var testNSECChain = []struct {
+	owner, next string
+	types       []uint16
+}{
+	{"example.", "a.example.", []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeNSEC}},
+	{"a.example.", "d.example.", []uint16{dns.TypeA, dns.TypeNSEC}},
+	{"d.example.", "m.example.", []uint16{dns.TypeNS, dns.TypeNSEC}},
+	{"m.example.", "example.", []uint16{dns.TypeA, dns.TypeNSEC}},
+}
+
+func testNSEC(i int) *dns.NSEC {
+	c := testNSECChain[i]
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{Name: c.owner, Rrtype: dns.TypeNSEC,
+			Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: c.next,
+		TypeBitMap: c.types,
+	}
+}
+
+func (r *signedZoneResolver) Init() error { return nil }
+func (r *signedZoneResolver) Maintain()   {}
+
+func (r *signedZoneResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	q := req.Question[0]
+	r.queries = append(r.queries, q.Name)
+
+	reply := newReplyTo(req)
+	reply.AuthenticatedData = r.validated
+	do := req.IsEdns0() != nil && req.IsEdns0().Do()
+
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: 3600},
+		Ns: "ns.example.", Mbox: "hostmaster.example.", Minttl: 300,
+	}
+	reply.Ns = []dns.RR{soa}
+
+	for i, c := range testNSECChain {
+		if c.owner != q.Name {
+			continue
+		}
+		for _, t := range c.types {
+			if t == q.Qtype {
+				rr, _ := dns.NewRR(q.Name + " 300 A 192.0.2.1")
+				reply.Answer = []dns.RR{rr}
+				reply.Ns = nil
+				return reply, nil
+			}
+		}
+		if do {
+			reply.Ns = append(reply.Ns, testNSEC(i))
+		}
+		return reply, nil
+	}
+
+	reply.Rcode = dns.RcodeNameError
+	if do {
+		for i := range testNSECChain {
+			nsec := testNSEC(i)
+			if covers(nsec, q.Name) || covers(nsec, "*.example.") {
+				reply.Ns = append(reply.Ns, nsec)
+			}
+		}
+	}
+	return reply, nil
+}
+
+func newTestNSEC() (*nsecResolver, *signedZoneResolver) {
+	back := &signedZoneResolver{validated: true}
+	n := NewAggressiveNSECResolver(back)
+	n.clock = testutil.NewFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	return n, back
+}
+
+func nsecQuery(t *testing.T, n *nsecResolver, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	reply, err := n.Query(newQuery(name, qtype), testutil.NewTestTrace(t))
+	if err != nil {
+		t.Fatalf("%s: query error: %v", name, err)
+	}
+	return reply
+}
+
+func TestNSECSynthesis(t *testing.T) {
+	n, back := newTestNSEC()
+
+	check := func(name string, qtype uint16, rcode int, upstream bool) {
+		t.Helper()
+		back.queries = nil
+		reply := nsecQuery(t, n, name, qtype)
+		if reply.Rcode != rcode {
+			t.Errorf("%s %s: got rcode %d, expected %d",
+				name, dns.Type(qtype), reply.Rcode, rcode)
+		}
+		if (len(back.queries) > 0) != upstream {
+			t.Errorf("%s %s: upstream queries %v, expected: %v",
+				name, dns.Type(qtype), back.queries, upstream)
+		}
+		for _, rr := range reply.Ns {
+			if rr.Header().Rrtype == dns.TypeNSEC {
+				t.Errorf("%s: NSEC given to a non-DNSSEC client", name)
+			}
+		}
+	}
+
+	// NXDOMAIN for b.example. gives us a.example. -> d.example., and the
+	// proof that there's no wildcard.
+	check("b.example.", dns.TypeA, dns.RcodeNameError, true)
+	check("c.example.", dns.TypeA, dns.RcodeNameError, false)
+	check("b.example.", dns.TypeAAAA, dns.RcodeNameError, false)
+
+	// Names below the empty range don't exist either.
+	check("x.c.example.", dns.TypeA, dns.RcodeNameError, false)
+
+	// Outside of the known range, we need to ask.
+	check("n.example.", dns.TypeA, dns.RcodeNameError, true)
+	check("z.example.", dns.TypeA, dns.RcodeNameError, false)
+
+	// Existing names and types.
+	check("a.example.", dns.TypeA, dns.RcodeSuccess, true)
+	check("a.example.", dns.TypeAAAA, dns.RcodeSuccess, false)
+	check("a.example.", dns.TypeTXT, dns.RcodeSuccess, false)
+
+	// d.example. is a delegation, so names below it are not covered.
+	check("e.example.", dns.TypeA, dns.RcodeNameError, true)
+	check("d.example.", dns.TypeDS, dns.RcodeSuccess, false)
+	check("d.example.", dns.TypeA, dns.RcodeSuccess, true)
+	check("x.d.example.", dns.TypeA, dns.RcodeNameError, true)
+
+	// The records expire.
+	n.clock.(*testutil.FakeClock).Advance(301 * time.Second)
+	check("c.example.", dns.TypeA, dns.RcodeNameError, true)
+	n.gc()
+	if len(n.zones["example."].records) != 2 {
+		t.Errorf("unexpected records after gc: %v", n.zones["example."].records)
+	}
+}
+
+func TestNSECDNSSECClient(t *testing.T) {
+	n, back := newTestNSEC()
+	nsecQuery(t, n, "b.example.", dns.TypeA)
+
+	req := newQuery("c.example.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	reply, err := n.Query(req, testutil.NewTestTrace(t))
+	if err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+	if len(back.queries) != 1 || !reply.AuthenticatedData {
+		t.Errorf("reply not synthesized: %v", reply)
+	}
+	nsecs := 0
+	for _, rr := range reply.Ns {
+		if rr.Header().Rrtype == dns.TypeNSEC {
+			nsecs++
+		}
+	}
+	if nsecs != 2 {
+		t.Errorf("expected 2 NSEC records, got %d: %v", nsecs, reply.Ns)
+	}
+}
+
+func TestNSECNotValidated(t *testing.T) {
+	n, back := newTestNSEC()
+	back.validated = false
+
+	nsecQuery(t, n, "b.example.", dns.TypeA)
+	nsecQuery(t, n, "c.example.", dns.TypeA)
+	if len(back.queries) != 2 || len(n.zones) != 0 {
+		t.Errorf("unvalidated records used: %v %v", back.queries, n.zones)
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// In canonical order, from RFC 4034 section 6.1.
+	names := []string{
+		"example.", "a.example.", "yljkjljk.a.example.",
+		"Z.a.example.", "zABC.a.EXAMPLE.", "z.example.",
+		"*.z.example.",
+	}
+	for i := 0; i < len(names)-1; i++ {
+		if c := canonicalCompare(names[i], names[i+1]); c >= 0 {
+			t.Errorf("%q >= %q", names[i], names[i+1])
+		}
+	}
+	if canonicalCompare("A.Example.", "a.example.") != 0 {
+		t.Errorf("comparison is case-sensitive")
+	}
+}
@@ -0,0 +1,48 @@
+package dnsserver
+
+import (
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Name server identifier (NSID, RFC 5001).
+
+// takeNSID checks if the query asks for the NSID. Unless we forward the
+// requests upstream, it's removed from the query, as it's for us.
+func (s *Server) takeNSID(r *dns.Msg) bool {
+	if s.nsidForward {
+		return replyOption(r, dns.EDNS0NSID) != nil
+	}
+	return takeOption(r, dns.EDNS0NSID) != nil
+}
+
+// setNSID sets the NSID of the reply, if the client asked for it: our own
+// identifier and the upstream's (if we forwarded the request and got one),
+// separated by "/".
+func (s *Server) setNSID(reply *dns.Msg, asked bool) {
+	var upstream []byte
+	o, fromUpstream := replyOption(reply, dns.EDNS0NSID).(*dns.EDNS0_NSID)
+	if fromUpstream && s.nsidForward {
+		upstream, _ = hex.DecodeString(o.Nsid)
+	}
+
+	id := []byte(s.nsid)
+	if len(upstream) > 0 {
+		if len(id) > 0 {
+			id = append(id, '/')
+		}
+		id = append(id, upstream...)
+	}
+
+	if asked && len(id) > 0 {
+		setReplyOption(reply, dns.EDNS0NSID, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID,
+			Nsid: hex.EncodeToString(id),
+		})
+	} else if fromUpstream {
+		// Don't give out the upstream's NSID if not asked to.
+		setReplyOption(reply, dns.EDNS0NSID, nil)
+	}
+}
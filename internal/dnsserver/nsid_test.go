@@ -0,0 +1,67 @@
+package dnsserver
+
+// Tests for the NSID support.
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func nsidMsg(nsid string) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	if nsid != "-" {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(nsid))})
+	}
+	return m
+}
+
+func TestNSID(t *testing.T) {
+	cases := []struct {
+		id       string
+		forward  bool
+		query    string
+		upstream string
+		expected string
+	}{
+		// "-" means no NSID option at all.
+		{"node1", false, "", "-", "node1"},
+		{"node1", false, "-", "-", "-"},
+		{"node1", false, "", "up", "node1"},
+		{"node1", false, "-", "up", "-"},
+		{"node1", true, "", "up", "node1/up"},
+		{"node1", true, "", "-", "node1"},
+		{"", true, "", "up", "up"},
+		{"", true, "-", "up", "-"},
+	}
+	for _, c := range cases {
+		s := &Server{}
+		s.SetNSID(c.id, c.forward)
+
+		r := nsidMsg(c.query)
+		asked := s.takeNSID(r)
+		if asked != (c.query != "-") {
+			t.Errorf("%+v: asked = %v", c, asked)
+		}
+		forwarded := replyOption(r, dns.EDNS0NSID) != nil
+		if forwarded != (asked && c.forward) {
+			t.Errorf("%+v: forwarded = %v", c, forwarded)
+		}
+
+		reply := nsidMsg(c.upstream)
+		s.setNSID(reply, asked)
+		got := "-"
+		if o, ok := replyOption(reply, dns.EDNS0NSID).(*dns.EDNS0_NSID); ok {
+			b, _ := hex.DecodeString(o.Nsid)
+			got = string(b)
+		}
+		if got != c.expected {
+			t.Errorf("%+v: got NSID %q", c, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Packed answers, for the cache.
+
+// packedAnswer is a cached answer in wire format (a compressed DNS message
+// with only the answer section). It takes several times less memory than
+// the parsed records, which matters for large caches; the price is having
+// to unpack it on every hit.
+//
+// The TTLs are adjusted in place, so the cache maintenance doesn't have to
+// unpack and repack the entries. That's what limits the TTLs we store to
+// maxTTL in the first place, so it's no problem that they are all the same.
+//
+// It is not safe for concurrent use; the cache partition locks protect it.
+type packedAnswer struct {
+	buf []byte
+}
+
+// Offsets within the wire format, see RFC 1035 section 4.1.
+const (
+	// Answer count, within the header.
+	ancountOffset = 6
+
+	// Size of the header, where the first record starts (we don't pack any
+	// questions).
+	headerSize = 12
+
+	// TTL and RDLENGTH, from the end of the record's name.
+	ttlOffset      = 4
+	rdlengthOffset = 8
+	rrFixedSize    = 10
+)
+
+func packAnswer(ans []dns.RR) (*packedAnswer, error) {
+	m := &dns.Msg{Answer: ans, Compress: true}
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &packedAnswer{buf: buf}, nil
+}
+
+// unpack returns the records of the answer. They are new every time, so the
+// caller can modify them.
+func (pa *packedAnswer) unpack() ([]dns.RR, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(pa.buf); err != nil {
+		return nil, err
+	}
+	return m.Answer, nil
+}
+
+// ttl returns the TTL of the answer (that is, of its first record), or 0 if
+// it's empty.
+func (pa *packedAnswer) ttl() time.Duration {
+	var ttl time.Duration
+	pa.eachTTL(func(off int) bool {
+		ttl = time.Duration(binary.BigEndian.Uint32(pa.buf[off:])) * time.Second
+		return false
+	})
+	return ttl
+}
+
+// setTTL sets the TTL of all the records in the answer.
+func (pa *packedAnswer) setTTL(ttl time.Duration) {
+	pa.eachTTL(func(off int) bool {
+		binary.BigEndian.PutUint32(pa.buf[off:], uint32(ttl.Seconds()))
+		return true
+	})
+}
+
+// len returns the number of records in the answer.
+func (pa *packedAnswer) len() int {
+	return int(binary.BigEndian.Uint16(pa.buf[ancountOffset:]))
+}
+
+// size returns the memory used by the answer, in bytes.
+func (pa *packedAnswer) size() int {
+	return len(pa.buf)
+}
+
+// eachTTL calls f with the offset of the TTL of every record, until it
+// returns false.
+func (pa *packedAnswer) eachTTL(f func(off int) bool) {
+	off := headerSize
+	for i := 0; i < pa.len(); i++ {
+		off = skipName(pa.buf, off)
+		if off < 0 || off+rrFixedSize > len(pa.buf) {
+			// Should not happen, as we packed it ourselves; if it does, the
+			// answer will look expired, and be removed.
+			return
+		}
+
+		if !f(off + ttlOffset) {
+			return
+		}
+
+		rdlength := int(binary.BigEndian.Uint16(pa.buf[off+rdlengthOffset:]))
+		off += rrFixedSize + rdlength
+	}
+}
+
+// skipName returns the offset right after the (possibly compressed) name
+// starting at off, or -1 if it's invalid.
+func skipName(buf []byte, off int) int {
+	for off < len(buf) {
+		l := int(buf[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xC0 == 0xC0:
+			// Compression pointer: it's always the end of the name.
+			return off + 2
+		default:
+			off += 1 + l
+		}
+	}
+	return -1
+}
@@ -0,0 +1,129 @@
+package dnsserver
+
+// Tests for the packed answers.
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func testAnswer(tb testing.TB, i int) []dns.RR {
+	// Several records with the same names, as is usual, so the packing
+	// uses compression.
+	name := fmt.Sprintf("www%d.example.com.", i)
+	return []dns.RR{
+		mustNewRR(tb, name+" 300 CNAME lb.example.com."),
+		mustNewRR(tb, "lb.example.com. 300 A 1.2.3.4"),
+		mustNewRR(tb, "lb.example.com. 300 A 1.2.3.5"),
+		mustNewRR(tb, `lb.example.com. 300 TXT "some text"`),
+	}
+}
+
+func TestPackedAnswer(t *testing.T) {
+	ans := testAnswer(t, 1)
+	pa, err := packAnswer(ans)
+	if err != nil {
+		t.Fatalf("error packing: %v", err)
+	}
+
+	if pa.len() != 4 {
+		t.Errorf("expected 4 records, got %d", pa.len())
+	}
+	if pa.ttl() != 300*time.Second {
+		t.Errorf("expected TTL 300s, got %v", pa.ttl())
+	}
+
+	pa.setTTL(120 * time.Second)
+	got, err := pa.unpack()
+	if err != nil {
+		t.Fatalf("error unpacking: %v", err)
+	}
+	if len(got) != len(ans) {
+		t.Fatalf("expected %v, got %v", ans, got)
+	}
+	for i, rr := range got {
+		h := rr.Header()
+		if h.Ttl != 120 {
+			t.Errorf("record %d: expected TTL 120, got %d", i, h.Ttl)
+		}
+		if h.Name != ans[i].Header().Name || h.Rrtype != ans[i].Header().Rrtype {
+			t.Errorf("record %d: expected %v, got %v", i, ans[i], rr)
+		}
+	}
+	if a := got[1].(*dns.A); a.A.String() != "1.2.3.4" {
+		t.Errorf("unexpected A record: %v", a)
+	}
+
+	// Every unpack gives new records, so users can't mess with the cache.
+	got[0].Header().Ttl = 1
+	again, _ := pa.unpack()
+	if again[0].Header().Ttl != 120 {
+		t.Errorf("modifying the unpacked records changed the cache")
+	}
+}
+
+func TestPackedAnswerCorrupt(t *testing.T) {
+	pa, _ := packAnswer(testAnswer(t, 1))
+	pa.buf = pa.buf[:len(pa.buf)/2]
+
+	if _, err := pa.unpack(); err == nil {
+		t.Errorf("unpacking a corrupt answer did not fail")
+	}
+
+	p := newCachePartition("test", 10, "lru")
+	q := testQ(1)
+	p.shardFor(q).store.set(q, pa)
+	if _, ok := p.get(q, &testutil.NullTrace{}); ok {
+		t.Errorf("got a corrupt answer from the cache")
+	}
+	if p.shardFor(q).store.contains(q) {
+		t.Errorf("corrupt answer was not removed")
+	}
+}
+
+// Memory benchmarks: store b.N answers, the way the cache used to (parsed
+// records) and the way it does now (packed), and report how much memory
+// each entry takes. Run them with:
+//   go test -run=NONE -bench=CacheMemory -benchtime=100000x ./internal/dnsserver/
+
+func BenchmarkCacheMemoryParsed(b *testing.B) {
+	benchMemory(b, func(ans []dns.RR) interface{} {
+		return ans
+	})
+}
+
+func BenchmarkCacheMemoryPacked(b *testing.B) {
+	benchMemory(b, func(ans []dns.RR) interface{} {
+		pa, err := packAnswer(ans)
+		if err != nil {
+			b.Fatalf("error packing: %v", err)
+		}
+		return pa
+	})
+}
+
+func benchMemory(b *testing.B, store func([]dns.RR) interface{}) {
+	entries := make([]interface{}, b.N)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < b.N; i++ {
+		entries[i] = store(testAnswer(b, i))
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.StopTimer()
+
+	b.Logf("%d entries: %d bytes/entry", b.N,
+		(int64(after.HeapAlloc)-int64(before.HeapAlloc))/int64(b.N))
+	runtime.KeepAlive(entries)
+}
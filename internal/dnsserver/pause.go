@@ -0,0 +1,53 @@
+package dnsserver
+
+import (
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+)
+
+// The blocking (the RPZ policies and the compiled blocklists) can be paused
+// for a while, to quickly check if a broken site is being caused by it. While
+// paused, the queries go through as if the policies and lists weren't there.
+//
+// It's global because it's meant to be controlled from outside (like from a
+// home-automation setup, see the mqtt package), for all the resolvers at
+// once.
+var blockingPause = struct {
+	mu    sync.Mutex
+	until time.Time
+
+	// Clock, so tests can control time.
+	clock util.Clock
+}{clock: util.RealClock}
+
+// PauseBlocking pauses the blocking for the given duration, replacing any
+// previous pause.
+func PauseBlocking(d time.Duration) {
+	blockingPause.mu.Lock()
+	blockingPause.until = blockingPause.clock.Now().Add(d)
+	blockingPause.mu.Unlock()
+}
+
+// ResumeBlocking ends the pause, if there is one.
+func ResumeBlocking() {
+	blockingPause.mu.Lock()
+	blockingPause.until = time.Time{}
+	blockingPause.mu.Unlock()
+}
+
+// BlockingPausedUntil returns when the current pause ends, or the zero time
+// if the blocking is not paused.
+func BlockingPausedUntil() time.Time {
+	blockingPause.mu.Lock()
+	defer blockingPause.mu.Unlock()
+	if !blockingPause.clock.Now().Before(blockingPause.until) {
+		return time.Time{}
+	}
+	return blockingPause.until
+}
+
+func blockingPaused() bool {
+	return !BlockingPausedUntil().IsZero()
+}
@@ -0,0 +1,640 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Query policy rules.
+
+// queryPolicy is a list of rules deciding what to do with each query, based
+// on its name and type, the client, and the (local) time. They are evaluated
+// in order, and the first one that matches decides; if none does, the query
+// is resolved as usual.
+//
+// There is one rule per line, as "action [argument] [if condition]".
+// The actions are:
+//
+//	allow             resolve the query as usual
+//	block             reply with NXDOMAIN
+//	route-to addr     send the query to the DNS server at addr (host:port)
+//	rewrite name      resolve name instead, and reply with a CNAME to it
+//
+// The conditions compare fields with values, combined with "and", "or",
+// "not", and parentheses. The fields are:
+//
+//	qname     the query name               ==, !=, in, matches (a glob)
+//	qtype     the query type (like "A")    ==, !=, in
+//	client    the client address           ==, !=, in (networks)
+//	weekday   mon, tue, ..., sun           ==, !=, in
+//	hour      0 to 23                      ==, !=, <, <=, >, >=, in
+//	minute    0 to 59                      ==, !=, <, <=, >, >=, in
+//	time      HH:MM                        ==, !=, <, <=, >, >=, in (range)
+//
+// Values can be quoted, and the ones for "in" are space-separated lists,
+// except for time, which takes a range that can wrap around midnight.
+// For example:
+//
+//	block if qname matches "*.games.example." and time in "21:30-07:00"
+//	allow if client in "10.0.0.0/24 192.168.0.5"
+//	route-to 10.0.0.53:53 if qname matches "*.corp.example."
+//	rewrite forcesafesearch.google.com. if qname == www.google.com.
+//
+// Empty lines and lines starting with # are ignored, and rules can be split
+// across files with include directives (see util.LineScanner).
+//
+// This is deliberately a small, fixed language instead of an embedded one
+// (like Lua, or an expression library): it keeps us free of dependencies,
+// every rule is checked when loading, and evaluating a rule can't loop or
+// allocate much, which matters as it runs for every query.
+type queryPolicy struct {
+	rules []*policyRule
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Function to send the route-to queries, so tests can fake it.
+	exchange func(m *dns.Msg, addr string) (*dns.Msg, error)
+
+	// For the replies to the blocked queries.
+	negativeReplier
+}
+
+// policyRule is a rule of the policy.
+type policyRule struct {
+	// Line where the rule is, for tracing.
+	line int
+
+	action string
+	arg    string
+
+	// Condition for the rule to apply; nil means it always does.
+	cond policyCond
+}
+
+// policyQuery has the details of the query the conditions look at.
+type policyQuery struct {
+	qname  string
+	qtype  string
+	client net.IP
+	now    time.Time
+
+	// The zone a qname pattern matched, if known (see globZone); set by the
+	// conditions as they are evaluated.
+	zone string
+}
+
+// policyCond is a condition of a rule.
+type policyCond func(q *policyQuery) bool
+
+// TTL of the CNAMEs in the replies to rewritten queries, declared as a
+// variable so we can tweak it for testing.
+var policyRewriteTTL uint32 = 60
+
+// Exported variables for statistics.
+var policyStats = struct {
+	// Queries matching a rule, by action.
+	matches *expvar.Map
+}{}
+
+func init() {
+	policyStats.matches = expvar.NewMap("policy-matches")
+}
+
+// LoadPolicy loads the policy rules from the given file (see queryPolicy
+// for the format), following its include directives (see util.LineScanner).
+func LoadPolicy(path string) (*queryPolicy, error) {
+	lines, err := util.OpenLineScanner(path)
+	if err != nil {
+		return nil, err
+	}
+	defer lines.Close()
+	return parsePolicyLines(lines)
+}
+
+func parsePolicy(r io.Reader) (*queryPolicy, error) {
+	return parsePolicyLines(util.NewLineScanner(r))
+}
+
+func parsePolicyLines(lines *util.LineScanner) (*queryPolicy, error) {
+	p := &queryPolicy{
+		clock:           util.RealClock,
+		exchange:        dns.Exchange,
+		negativeReplier: newNegativeReplier(),
+	}
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", lines.Pos(), err)
+		}
+		rule.line = lines.Line()
+		p.rules = append(p.rules, rule)
+	}
+	return p, lines.Err()
+}
+
+func parsePolicyRule(line string) (*policyRule, error) {
+	tokens, err := lexPolicy(line)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &policyRule{action: tokens[0].s}
+	tokens = tokens[1:]
+
+	switch rule.action {
+	case "allow", "block":
+	case "route-to", "rewrite":
+		if len(tokens) == 0 || tokens[0].s == "if" {
+			return nil, fmt.Errorf("%s needs an argument", rule.action)
+		}
+		rule.arg = tokens[0].s
+		tokens = tokens[1:]
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.action)
+	}
+
+	switch rule.action {
+	case "route-to":
+		if _, _, err := net.SplitHostPort(rule.arg); err != nil {
+			return nil, fmt.Errorf("invalid address: %v", err)
+		}
+	case "rewrite":
+		rule.arg = util.CanonicalName(rule.arg)
+	}
+
+	if len(tokens) == 0 {
+		return rule, nil
+	}
+	if tokens[0].s != "if" || tokens[0].quoted {
+		return nil, fmt.Errorf("expected \"if\", got %q", tokens[0].s)
+	}
+
+	p := &policyParser{tokens: tokens[1:]}
+	rule.cond, err = p.or()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tokens) > 0 {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[0].s)
+	}
+	return rule, nil
+}
+
+// policyToken is a token of a rule.
+type policyToken struct {
+	s      string
+	quoted bool
+}
+
+// lexPolicy splits the line in tokens: quoted strings, parentheses,
+// comparison operators, and words.
+func lexPolicy(s string) ([]policyToken, error) {
+	var tokens []policyToken
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return tokens, nil
+		}
+
+		switch {
+		case s[0] == '"':
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, policyToken{s[1 : end+1], true})
+			s = s[end+2:]
+		case s[0] == '(' || s[0] == ')':
+			tokens = append(tokens, policyToken{s[:1], false})
+			s = s[1:]
+		case strings.IndexByte("=!<>", s[0]) >= 0:
+			n := 1
+			if len(s) > 1 && s[1] == '=' {
+				n = 2
+			}
+			op := s[:n]
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, policyToken{op, false})
+			s = s[n:]
+		default:
+			end := strings.IndexAny(s, " \t\"()=!<>")
+			if end < 0 {
+				end = len(s)
+			}
+			tokens = append(tokens, policyToken{s[:end], false})
+			s = s[end:]
+		}
+	}
+}
+
+// policyParser parses the conditions of a rule.
+type policyParser struct {
+	tokens []policyToken
+}
+
+// next returns the next token (which must exist), and consumes it.
+func (p *policyParser) next() (policyToken, error) {
+	if len(p.tokens) == 0 {
+		return policyToken{}, fmt.Errorf("unexpected end of condition")
+	}
+	t := p.tokens[0]
+	p.tokens = p.tokens[1:]
+	return t, nil
+}
+
+// accept consumes the next token if it's the given keyword.
+func (p *policyParser) accept(keyword string) bool {
+	if len(p.tokens) > 0 && !p.tokens[0].quoted && p.tokens[0].s == keyword {
+		p.tokens = p.tokens[1:]
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) or() (policyCond, error) {
+	left, err := p.and()
+	for err == nil && p.accept("or") {
+		var right policyCond
+		right, err = p.and()
+		l, r := left, right
+		left = func(q *policyQuery) bool { return l(q) || r(q) }
+	}
+	return left, err
+}
+
+func (p *policyParser) and() (policyCond, error) {
+	left, err := p.unary()
+	for err == nil && p.accept("and") {
+		var right policyCond
+		right, err = p.unary()
+		l, r := left, right
+		left = func(q *policyQuery) bool { return l(q) && r(q) }
+	}
+	return left, err
+}
+
+func (p *policyParser) unary() (policyCond, error) {
+	if p.accept("not") {
+		c, err := p.unary()
+		return func(q *policyQuery) bool { return !c(q) }, err
+	}
+	if p.accept("(") {
+		c, err := p.or()
+		if err == nil && !p.accept(")") {
+			err = fmt.Errorf("missing \")\"")
+		}
+		return c, err
+	}
+
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if field.quoted || op.quoted {
+		return nil, fmt.Errorf("expected field and operator, got %q %q",
+			field.s, op.s)
+	}
+
+	if op.s == "!=" {
+		c, err := newPolicyComparison(field.s, "==", value.s)
+		if err != nil {
+			return nil, err
+		}
+		return func(q *policyQuery) bool { return !c(q) }, nil
+	}
+	return newPolicyComparison(field.s, op.s, value.s)
+}
+
+// Names of the weekdays, as used in the rules.
+var policyWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// newPolicyComparison returns the condition comparing the field with the
+// value, using the operator ("!=" is handled by the caller).
+func newPolicyComparison(field, op, value string) (policyCond, error) {
+	switch field {
+	case "qname", "qtype", "weekday":
+		return stringComparison(field, op, value)
+	case "client":
+		return clientComparison(op, value)
+	case "hour", "minute", "time":
+		return intComparison(field, op, value)
+	}
+	return nil, fmt.Errorf("unknown field %q", field)
+}
+
+func stringComparison(field, op, value string) (policyCond, error) {
+	var get func(q *policyQuery) string
+	var normalize func(s string) (string, error)
+	switch field {
+	case "qname":
+		get = func(q *policyQuery) string { return q.qname }
+		normalize = func(s string) (string, error) {
+			return util.CanonicalName(s), nil
+		}
+	case "qtype":
+		get = func(q *policyQuery) string { return q.qtype }
+		normalize = func(s string) (string, error) {
+			s = strings.ToUpper(s)
+			if _, ok := dns.StringToType[s]; !ok {
+				return "", fmt.Errorf("unknown type %q", s)
+			}
+			return s, nil
+		}
+	case "weekday":
+		get = func(q *policyQuery) string {
+			return strings.ToLower(q.now.Weekday().String()[:3])
+		}
+		normalize = func(s string) (string, error) {
+			s = strings.ToLower(s)
+			if _, ok := policyWeekdays[s]; !ok {
+				return "", fmt.Errorf("unknown weekday %q", s)
+			}
+			return s, nil
+		}
+	}
+
+	if op == "matches" && field == "qname" {
+		pattern, _ := normalize(value)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", value, err)
+		}
+		zone := globZone(pattern)
+		return func(q *policyQuery) bool {
+			ok, _ := path.Match(pattern, q.qname)
+			if ok && zone != "" {
+				q.zone = zone
+			}
+			return ok
+		}, nil
+	}
+
+	var values []string
+	switch op {
+	case "==":
+		values = []string{value}
+	case "in":
+		values = strings.Fields(value)
+	default:
+		return nil, fmt.Errorf("can't use %q with %s", op, field)
+	}
+
+	set := map[string]bool{}
+	for _, v := range values {
+		n, err := normalize(v)
+		if err != nil {
+			return nil, err
+		}
+		set[n] = true
+	}
+	return func(q *policyQuery) bool { return set[get(q)] }, nil
+}
+
+func clientComparison(op, value string) (policyCond, error) {
+	var values []string
+	switch op {
+	case "==":
+		values = []string{value}
+	case "in":
+		values = strings.Fields(value)
+	default:
+		return nil, fmt.Errorf("can't use %q with client", op)
+	}
+
+	var nets []*net.IPNet
+	for _, v := range values {
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if op == "==" {
+			return nil, fmt.Errorf("invalid address %q", v)
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", v)
+		}
+		nets = append(nets, n)
+	}
+
+	return func(q *policyQuery) bool {
+		for _, n := range nets {
+			if q.client != nil && n.Contains(q.client) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func intComparison(field, op, value string) (policyCond, error) {
+	var get func(q *policyQuery) int
+	var parse func(s string) (int, error)
+	switch field {
+	case "hour":
+		get = func(q *policyQuery) int { return q.now.Hour() }
+		parse = func(s string) (int, error) { return parseIntIn(s, 0, 23) }
+	case "minute":
+		get = func(q *policyQuery) int { return q.now.Minute() }
+		parse = func(s string) (int, error) { return parseIntIn(s, 0, 59) }
+	case "time":
+		get = func(q *policyQuery) int { return q.now.Hour()*60 + q.now.Minute() }
+		parse = parseTimeOfDay
+	}
+
+	if op == "in" && field == "time" {
+		sp := strings.SplitN(value, "-", 2)
+		if len(sp) != 2 {
+			return nil, fmt.Errorf("invalid time range %q", value)
+		}
+		from, err := parse(sp[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parse(sp[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(q *policyQuery) bool {
+			t := get(q)
+			if from <= to {
+				return from <= t && t < to
+			}
+			return t >= from || t < to
+		}, nil
+	}
+
+	if op == "in" {
+		set := map[int]bool{}
+		for _, v := range strings.Fields(value) {
+			n, err := parse(v)
+			if err != nil {
+				return nil, err
+			}
+			set[n] = true
+		}
+		return func(q *policyQuery) bool { return set[get(q)] }, nil
+	}
+
+	n, err := parse(value)
+	if err != nil {
+		return nil, err
+	}
+	var cmp func(a int) bool
+	switch op {
+	case "==":
+		cmp = func(a int) bool { return a == n }
+	case "<":
+		cmp = func(a int) bool { return a < n }
+	case "<=":
+		cmp = func(a int) bool { return a <= n }
+	case ">":
+		cmp = func(a int) bool { return a > n }
+	case ">=":
+		cmp = func(a int) bool { return a >= n }
+	default:
+		return nil, fmt.Errorf("can't use %q with %s", op, field)
+	}
+	return func(q *policyQuery) bool { return cmp(get(q)) }, nil
+}
+
+func parseIntIn(s string, min, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%q is not a number from %d to %d", s, min, max)
+	}
+	return n, nil
+}
+
+// parseTimeOfDay parses HH:MM, returning the minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	sp := strings.SplitN(s, ":", 2)
+	if len(sp) == 2 {
+		h, err1 := parseIntIn(sp[0], 0, 23)
+		m, err2 := parseIntIn(sp[1], 0, 59)
+		if err1 == nil && err2 == nil {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+}
+
+// match returns the first rule matching the query, or nil if there is none,
+// and the zone it matched: the one covered by its qname pattern, or the name
+// itself if there isn't one.
+func (p *queryPolicy) match(r *dns.Msg, client net.IP) (*policyRule, string) {
+	q := &policyQuery{
+		qname:  util.CanonicalName(r.Question[0].Name),
+		qtype:  dns.Type(r.Question[0].Qtype).String(),
+		client: client,
+		now:    p.clock.Now().Local(),
+	}
+	for _, rule := range p.rules {
+		q.zone = ""
+		if rule.cond == nil || rule.cond(q) {
+			if q.zone == "" {
+				q.zone = q.qname
+			}
+			return rule, q.zone
+		}
+	}
+	return nil, ""
+}
+
+// globZone returns the zone covered by a qname pattern: what is left once
+// the leading labels with wildcards are removed (like "example." for
+// "*.ads*.example."), or "" if there are wildcards after those.
+func globZone(pattern string) string {
+	labels := dns.SplitDomainName(pattern)
+	for i, l := range labels {
+		if !strings.ContainsAny(l, `*?[\`) {
+			rest := strings.Join(labels[i:], ".") + "."
+			if strings.ContainsAny(rest, `*?[\`) {
+				return ""
+			}
+			return rest
+		}
+	}
+	return ""
+}
+
+// SetPolicy makes the server apply the given policy (see LoadPolicy) to the
+// queries.
+func (s *Server) SetPolicy(p *queryPolicy) {
+	s.policy = p
+}
+
+// applyPolicy applies the policy to the query, and returns the reply to give
+// for it, or nil if it should be resolved as usual.
+func (s *Server) applyPolicy(w dns.ResponseWriter, r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	rule, zone := s.policy.match(r, addrIP(w.RemoteAddr()))
+	if rule == nil {
+		return nil, nil
+	}
+
+	tr.LazyPrintf("policy: line %d: %s %s", rule.line, rule.action, rule.arg)
+	policyStats.matches.Add(rule.action, 1)
+
+	switch rule.action {
+	case "block":
+		return s.policy.negativeReply(r, dns.RcodeNameError, zone), nil
+	case "route-to":
+		return s.policy.exchange(r, rule.arg)
+	case "rewrite":
+		q := r.Question[0]
+		m := r.Copy()
+		m.Id = <-newID
+		m.Question[0].Name = rule.arg
+
+		fromUp, err := s.resolver.Query(m, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := newReplyTo(r)
+		reply.Rcode = fromUp.Rcode
+		cname := &dns.CNAME{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME,
+				Class: dns.ClassINET, Ttl: policyRewriteTTL},
+			Target: rule.arg,
+		}
+		reply.Answer = append([]dns.RR{cname}, fromUp.Answer...)
+		return reply, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,213 @@
+package dnsserver
+
+// Tests for the query policy rules.
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+const testPolicy = `
+# Parental controls.
+block if qname matches "*.games.example." and client in 10.0.0.64/26 and time in "21:30-07:00"
+block if qname matches "*.games.example." and weekday in "mon tue wed thu" and client == 10.0.0.65 and hour < 18
+
+route-to 10.0.0.53:53 if qname matches "*.corp.example." or qname == corp.example
+rewrite safe.example if qname == www.search.example. and not qtype in "MX TXT"
+allow
+block
+`
+
+func mustParsePolicy(t *testing.T, s string) *queryPolicy {
+	t.Helper()
+	p, err := parsePolicy(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("error parsing policy: %v", err)
+	}
+	return p
+}
+
+func TestParsePolicy(t *testing.T) {
+	p := mustParsePolicy(t, testPolicy)
+	if len(p.rules) != 6 {
+		t.Fatalf("expected 6 rules, got %d", len(p.rules))
+	}
+	if r := p.rules[3]; r.action != "rewrite" || r.arg != "safe.example." {
+		t.Errorf("unexpected rule: %+v", r)
+	}
+
+	for _, s := range []string{
+		"drop",
+		"route-to",
+		"route-to 10.0.0.53",
+		"rewrite if qname == a.example",
+		"block qname == a.example",
+		"block if",
+		"block if qname",
+		"block if qname ==",
+		"block if qname = a.example",
+		"block if qname < a.example",
+		"block if size > 512",
+		"block if qtype == BLAH",
+		"block if qname matches \"[\"",
+		"block if client == 10.0.0.0/8",
+		"block if client in 10.0.0.0/33",
+		"block if client > 10.0.0.1",
+		"block if hour > 24",
+		"block if minute in \"1 2 x\"",
+		"block if time > 7",
+		"block if time in 07:00",
+		"block if weekday == funday",
+		"block if (hour > 1",
+		"block if hour > 1)",
+		"block if hour > 1 and",
+		"block if \"hour\" > 1",
+		"block if qname == \"a.example",
+	} {
+		if _, err := parsePolicy(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	p := mustParsePolicy(t, testPolicy)
+
+	cases := []struct {
+		hour   int
+		name   string
+		qtype  uint16
+		client string
+		line   int
+	}{
+		{22, "a.games.example.", dns.TypeA, "10.0.0.70", 3},
+		{6, "A.Games.example.", dns.TypeA, "10.0.0.70", 3},
+		{7, "a.games.example.", dns.TypeA, "10.0.0.70", 8},
+		{7, "a.games.example.", dns.TypeA, "10.0.0.65", 4},
+		{18, "a.games.example.", dns.TypeA, "10.0.0.65", 8},
+		{12, "a.games.example.", dns.TypeA, "192.0.2.1", 8},
+		{12, "www.corp.example.", dns.TypeA, "192.0.2.1", 6},
+		{12, "corp.example.", dns.TypeA, "192.0.2.1", 6},
+		{12, "www.search.example.", dns.TypeA, "192.0.2.1", 7},
+		{12, "www.search.example.", dns.TypeMX, "192.0.2.1", 8},
+	}
+	for _, c := range cases {
+		// 2026-10-12 is a Monday.
+		p.clock = testutil.NewFakeClock(
+			time.Date(2026, 10, 12, c.hour, 0, 0, 0, time.Local))
+		rule, _ := p.match(newQuery(c.name, c.qtype), net.ParseIP(c.client))
+		line := 0
+		if rule != nil {
+			line = rule.line
+		}
+		if line != c.line {
+			t.Errorf("%d:00 %s %d from %s: matched line %d, expected %d",
+				c.hour, c.name, c.qtype, c.client, line, c.line)
+		}
+	}
+
+	// On weekends, the second rule doesn't apply.
+	p.clock = testutil.NewFakeClock(time.Date(2026, 10, 17, 7, 0, 0, 0, time.Local))
+	rule, _ := p.match(newQuery("a.games.example.", dns.TypeA), net.ParseIP("10.0.0.65"))
+	if rule == nil || rule.line != 8 {
+		t.Errorf("weekend: unexpected rule %+v", rule)
+	}
+}
+
+func TestPolicyServer(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = newReply(testutil.NewRR(t, "safe.example. 60 A 192.0.2.1"))
+	srv := New("", res, "")
+
+	p := mustParsePolicy(t, `
+		block if qname == blocked.example
+		block if qname matches "*.ads.example."
+		route-to 10.0.0.53:53 if qname matches "*.corp.example."
+		rewrite safe.example if qname == www.search.example.`)
+	var routed []string
+	p.exchange = func(m *dns.Msg, addr string) (*dns.Msg, error) {
+		routed = append(routed, addr)
+		reply := &dns.Msg{}
+		reply.SetReply(m)
+		reply.Answer = []dns.RR{testutil.NewRR(t, m.Question[0].Name+" 60 A 10.0.0.1")}
+		return reply, nil
+	}
+	srv.SetPolicy(p)
+
+	send := func(name string) *dns.Msg {
+		t.Helper()
+		res.LastQuery = nil
+		routed = nil
+		w := &recordingWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 1234}}
+		m := newQuery(name, dns.TypeA)
+		id := m.Id
+		srv.Handler(w, m)
+		if w.reply == nil {
+			t.Fatalf("%s: no reply", name)
+		}
+		if w.reply.Id != id {
+			t.Errorf("%s: reply id %d != %d", name, w.reply.Id, id)
+		}
+		return w.reply
+	}
+
+	// The SOA of the denial is for the zone the rule covers.
+	blocked := map[string]string{
+		"blocked.example.": "blocked.example.",
+		"x.y.ads.example.": "ads.example.",
+		"WWW.Ads.Example.": "ads.example.",
+	}
+	for name, zone := range blocked {
+		reply := send(name)
+		if reply.Rcode != dns.RcodeNameError || res.LastQuery != nil {
+			t.Errorf("%s: unexpected reply %v", name, reply)
+		}
+		if len(reply.Ns) != 1 || reply.Ns[0].Header().Name != zone {
+			t.Errorf("%s: expected an SOA for %q, got %v", name, zone, reply.Ns)
+		}
+	}
+
+	reply := send("www.corp.example.")
+	if len(routed) != 1 || routed[0] != "10.0.0.53:53" ||
+		len(reply.Answer) != 1 || res.LastQuery != nil {
+		t.Errorf("www.corp.example.: routed to %v, reply %v", routed, reply)
+	}
+
+	reply = send("www.search.example.")
+	if res.LastQuery == nil || res.LastQuery.Question[0].Name != "safe.example." {
+		t.Errorf("www.search.example.: resolved %v", res.LastQuery)
+	}
+	if len(reply.Answer) != 2 || reply.Answer[0].(*dns.CNAME).Target != "safe.example." ||
+		reply.Answer[0].Header().Name != "www.search.example." {
+		t.Errorf("www.search.example.: unexpected reply %v", reply)
+	}
+
+	send("www.example.")
+	if res.LastQuery == nil || len(routed) != 0 {
+		t.Errorf("www.example.: not resolved as usual")
+	}
+}
+
+func TestGlobZone(t *testing.T) {
+	cases := map[string]string{
+		"*.games.example.":   "games.example.",
+		"*.ads*.example.":    "example.",
+		"ads?.example.":      "example.",
+		"www.example.":       "www.example.",
+		"*":                  "",
+		"*example.":          "",
+		"*.ads.*.example.":   "",
+		"[ab].test.example.": "test.example.",
+	}
+	for pattern, expected := range cases {
+		if got := globZone(pattern); got != expected {
+			t.Errorf("%q: expected %q, got %q", pattern, expected, got)
+		}
+	}
+}
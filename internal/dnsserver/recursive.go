@@ -0,0 +1,527 @@
+package dnsserver
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Recursive resolver.
+
+// recursiveResolver implements a Resolver which resolves the queries
+// itself: starting from the root servers, it follows the referrals down to
+// the authoritative servers of each name, like a recursive DNS server does.
+//
+// It's meant to be used with a cache in front, as it only caches the
+// delegations (which servers are authoritative for which zones), not the
+// answers.
+//
+// There is no DNSSEC validation; the DO bit is passed along to the
+// authorities, so clients can validate the replies themselves.
+type recursiveResolver struct {
+	// Addresses of the root servers.
+	roots []string
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Use QNAME minimization (RFC 9156): only reveal to each server the
+	// labels it needs to tell us who is next.
+	minimize bool
+
+	// Local copy of the root zone, to use instead of the root servers (nil
+	// if disabled).
+	localRoot *localRoot
+
+	// Function to send a query to an authority, so tests can fake it.
+	exchange func(m *dns.Msg, addr string) (*dns.Msg, error)
+
+	mu          *sync.Mutex
+	delegations map[string]*delegation
+}
+
+// delegation tells us the servers for a zone.
+type delegation struct {
+	zone    string
+	servers []string
+	expires time.Time
+}
+
+// Addresses of the root servers (https://www.iana.org/domains/root/servers).
+// They have been stable for years, and if one changes, the others still
+// work.
+var rootServers = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+// Constants that tune the recursive resolver, declared as variables so we
+// can tweak them for testing.
+var (
+	// Timeout for each query to an authority.
+	recursiveTimeout = 2 * time.Second
+
+	// Maximum number of referrals to follow for a single name.
+	maxReferrals = 30
+
+	// Maximum number of minimized queries for a single name, after which we
+	// ask for the full name (like RFC 9156's MAX_MINIMISE_COUNT), so long
+	// names don't cause too many queries.
+	maxMinimizedQueries = 10
+
+	// Maximum length of CNAME chains.
+	maxCNAMEs = 10
+
+	// Maximum depth of the recursion to find the addresses of the
+	// nameservers without glue.
+	maxRecursionDepth = 6
+
+	// Limits on how long we keep delegations.
+	minDelegationTTL = 1 * time.Minute
+	maxDelegationTTL = 24 * time.Hour
+
+	// How often to remove the expired delegations.
+	delegationGCPeriod = 10 * time.Minute
+)
+
+// Exported variables for statistics.
+var recursiveStats = struct {
+	// Queries sent to authoritative servers.
+	queries *expvar.Int
+
+	// Queries to authoritative servers that failed.
+	errors *expvar.Int
+
+	// Referrals followed.
+	referrals *expvar.Int
+
+	// Queries sent with a minimized name.
+	minimized *expvar.Int
+
+	// Records dropped from the replies because they were out of the zone
+	// of the server that sent them.
+	outOfZone *expvar.Int
+}{}
+
+func init() {
+	recursiveStats.queries = expvar.NewInt("recursive-queries")
+	recursiveStats.errors = expvar.NewInt("recursive-errors")
+	recursiveStats.referrals = expvar.NewInt("recursive-referrals")
+	recursiveStats.minimized = expvar.NewInt("recursive-minimized-queries")
+	recursiveStats.outOfZone = expvar.NewInt("recursive-out-of-zone-records")
+}
+
+var errTooDeep = errors.New("too many referrals or indirections")
+
+// NewRecursiveResolver returns a new resolver which resolves the queries
+// iteratively, starting from the root servers.
+func NewRecursiveResolver() *recursiveResolver {
+	r := &recursiveResolver{
+		minimize:    true,
+		clock:       util.RealClock,
+		mu:          &sync.Mutex{},
+		delegations: map[string]*delegation{},
+	}
+	for _, ip := range rootServers {
+		r.roots = append(r.roots, net.JoinHostPort(ip, "53"))
+	}
+	r.exchange = r.exchangeUDPThenTCP
+	return r
+}
+
+// SetQNAMEMinimization enables or disables QNAME minimization (RFC 9156),
+// which means only revealing to each server the part of the name it needs
+// to refer us to the next one. It's enabled by default.
+func (r *recursiveResolver) SetQNAMEMinimization(enabled bool) {
+	r.minimize = enabled
+}
+
+// SetLocalRoot makes the resolver keep a local copy of the root zone,
+// loaded from the given sources (see RootZoneSources), and answer the
+// queries for the root servers from it (RFC 8806). If the zone can't be
+// loaded, or expires without being refreshed, the root servers are used.
+func (r *recursiveResolver) SetLocalRoot(sources []string) {
+	r.localRoot = newLocalRoot(sources)
+	r.localRoot.clock = r.clock
+}
+
+func (r *recursiveResolver) Init() error {
+	if r.localRoot != nil {
+		r.localRoot.reload()
+	}
+	return nil
+}
+
+func (r *recursiveResolver) Maintain() {
+	if r.localRoot != nil {
+		go r.clock.Every(localRootRefresh, r.localRoot.reload)
+	}
+
+	r.clock.Every(delegationGCPeriod, r.gc)
+}
+
+// gc removes the expired delegations.
+func (r *recursiveResolver) gc() {
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for zone, d := range r.delegations {
+		if now.After(d.expires) {
+			delete(r.delegations, zone)
+		}
+	}
+}
+
+func (r *recursiveResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("unsupported number of questions: %d",
+			len(req.Question))
+	}
+	q := req.Question[0]
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	// Follow the CNAME chain, accumulating the answers.
+	var chain []dns.RR
+	name := q.Name
+	for i := 0; i <= maxCNAMEs; i++ {
+		final, err := r.resolve(name, q.Qtype, do, 0, tr)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, final.Answer...)
+
+		target := cnameTarget(final, name, q.Qtype)
+		if target == "" {
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+			reply.RecursionAvailable = true
+			reply.Rcode = final.Rcode
+			reply.Answer = chain
+			reply.Ns = final.Ns
+			return reply, nil
+		}
+		tr.LazyPrintf("recursive: following CNAME %q -> %q", name, target)
+		name = target
+	}
+	return nil, errTooDeep
+}
+
+// cnameTarget returns the target of the CNAME for the name in the reply, if
+// the reply doesn't already have the answer for it.
+func cnameTarget(reply *dns.Msg, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME {
+		return ""
+	}
+
+	target := ""
+	for _, rr := range reply.Answer {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if rr.Header().Rrtype == qtype {
+			return ""
+		}
+		if c, ok := rr.(*dns.CNAME); ok {
+			target = c.Target
+		}
+	}
+
+	// The authority may have followed the chain already (if it's also
+	// authoritative for the target).
+	if target != "" {
+		for _, rr := range reply.Answer {
+			if strings.EqualFold(rr.Header().Name, target) {
+				return cnameTarget(reply, target, qtype)
+			}
+		}
+	}
+	return target
+}
+
+// resolve the name, following the referrals from the closest delegation we
+// know about. It returns the authoritative reply.
+func (r *recursiveResolver) resolve(name string, qtype uint16, do bool, depth int, tr trace.Trace) (*dns.Msg, error) {
+	if depth > maxRecursionDepth {
+		return nil, errTooDeep
+	}
+
+	zone, servers := r.closestDelegation(name)
+
+	// With QNAME minimization, how many labels of the name we reveal to the
+	// servers of the current zone, and how many such queries we've done.
+	total := dns.CountLabel(name)
+	revealed := dns.CountLabel(zone) + 1
+	minimized := 0
+
+	for i := 0; i < maxReferrals+maxMinimizedQueries; i++ {
+		qname, qt := name, qtype
+		if r.minimize && revealed < total && minimized < maxMinimizedQueries {
+			qname, qt = lastLabels(name, revealed), dns.TypeA
+			minimized++
+			recursiveStats.minimized.Add(1)
+		}
+
+		m := &dns.Msg{}
+		m.SetQuestion(qname, qt)
+		m.RecursionDesired = false
+		m.SetEdns0(1232, do)
+
+		var reply *dns.Msg
+		var err error
+		if zone == "." && r.localRoot != nil {
+			reply = r.localRoot.answer(m)
+		}
+		if reply == nil {
+			reply, err = r.queryAny(m, servers, tr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("querying %q servers: %v", zone, err)
+		}
+
+		child, nsNames := referral(reply, zone, qname)
+		if child == "" && qname != name {
+			// The minimized name is not a zone cut. If it doesn't exist,
+			// neither does anything below it (RFC 8020); otherwise, reveal
+			// one more label to the same servers.
+			if reply.Rcode == dns.RcodeNameError {
+				tr.LazyPrintf("recursive: %q does not exist", qname)
+				return inZone(reply, zone, tr), nil
+			}
+			revealed++
+			continue
+		}
+		if child == "" {
+			return inZone(reply, zone, tr), nil
+		}
+		recursiveStats.referrals.Add(1)
+		tr.LazyPrintf("recursive: %q referred to %q", zone, child)
+
+		addrs := glue(reply, child, zone, nsNames)
+		if len(addrs) == 0 {
+			addrs = r.resolveNS(nsNames, do, depth, tr)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no usable servers for %q", child)
+		}
+
+		r.addDelegation(child, addrs, reply.Ns)
+		zone, servers = child, addrs
+		revealed = dns.CountLabel(zone) + 1
+	}
+	return nil, errTooDeep
+}
+
+// inZone removes the records of the answer and authority sections which are
+// not within the zone of the server that sent the reply: it has no
+// authority over them, and they could be an attempt to poison us. The
+// targets of the CNAMEs out of the zone are then resolved on their own (see
+// Query).
+func inZone(reply *dns.Msg, zone string, tr trace.Trace) *dns.Msg {
+	filter := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			if !dns.IsSubDomain(zone, rr.Header().Name) {
+				recursiveStats.outOfZone.Add(1)
+				tr.LazyPrintf("recursive: dropping out of zone record: %v", rr)
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	reply.Answer = filter(reply.Answer)
+	reply.Ns = filter(reply.Ns)
+	return reply
+}
+
+// lastLabels returns the name made of the last n labels of the given name.
+func lastLabels(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n >= len(labels) {
+		return name
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// referral checks if the reply is a referral to a zone below the current
+// one (which contains the name), and returns the zone and the names of its
+// servers.
+func referral(reply *dns.Msg, zone, name string) (string, []string) {
+	if reply.Rcode != dns.RcodeSuccess || reply.Authoritative ||
+		len(reply.Answer) > 0 {
+		return "", nil
+	}
+
+	child := ""
+	var nsNames []string
+	for _, rr := range reply.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == strings.ToLower(zone) ||
+			!dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child != "" && child != owner {
+			continue
+		}
+		child = owner
+		nsNames = append(nsNames, ns.Ns)
+	}
+	return child, nsNames
+}
+
+// glue returns the addresses of the servers of the child zone included in
+// the reply. We only trust them if they are within the zone of the server
+// that sent them.
+func glue(reply *dns.Msg, child, zone string, nsNames []string) []string {
+	isNS := map[string]bool{}
+	for _, n := range nsNames {
+		isNS[strings.ToLower(n)] = true
+	}
+
+	var addrs []string
+	for _, rr := range reply.Extra {
+		name := strings.ToLower(rr.Header().Name)
+		if !isNS[name] || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		// Only IPv4, as we may not have IPv6 connectivity.
+		if a, ok := rr.(*dns.A); ok {
+			addrs = append(addrs, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+	return addrs
+}
+
+// resolveNS finds the addresses of the given nameservers, for delegations
+// without glue. It stops at the first one that works.
+func (r *recursiveResolver) resolveNS(nsNames []string, do bool, depth int, tr trace.Trace) []string {
+	for _, n := range nsNames {
+		tr.LazyPrintf("recursive: resolving nameserver %q", n)
+		reply, err := r.resolve(n, dns.TypeA, do, depth+1, tr)
+		if err != nil {
+			continue
+		}
+
+		var addrs []string
+		for _, rr := range reply.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// closestDelegation returns the deepest zone containing the name for which
+// we know the servers; the root if there's nothing better.
+func (r *recursiveResolver) closestDelegation(name string) (string, []string) {
+	now := r.clock.Now()
+	name = strings.ToLower(dns.Fqdn(name))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if d, ok := r.delegations[name]; ok && now.Before(d.expires) {
+			return d.zone, d.servers
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return ".", r.roots
+		}
+		name = name[i+1:]
+	}
+}
+
+func (r *recursiveResolver) addDelegation(zone string, servers []string, ns []dns.RR) {
+	ttl := maxDelegationTTL
+	for _, rr := range ns {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if ttl < minDelegationTTL {
+		ttl = minDelegationTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delegations[zone] = &delegation{
+		zone:    zone,
+		servers: servers,
+		expires: r.clock.Now().Add(ttl),
+	}
+}
+
+// queryAny sends the query to the servers, in order, until one replies.
+func (r *recursiveResolver) queryAny(m *dns.Msg, servers []string, tr trace.Trace) (*dns.Msg, error) {
+	err := errors.New("no servers")
+	for _, addr := range servers {
+		recursiveStats.queries.Add(1)
+		var reply *dns.Msg
+		reply, err = r.exchange(m, addr)
+		if err == nil && reply == nil {
+			err = errors.New("no reply")
+		}
+		// These mean the server is not working for this zone (lame, or
+		// broken), so try the next one.
+		if err == nil && (reply.Rcode == dns.RcodeServerFailure ||
+			reply.Rcode == dns.RcodeRefused) {
+			err = fmt.Errorf("rcode %s", dns.RcodeToString[reply.Rcode])
+		}
+		if err == nil {
+			return reply, nil
+		}
+		recursiveStats.errors.Add(1)
+		tr.LazyPrintf("recursive: %s: %v", addr, err)
+	}
+	return nil, err
+}
+
+// exchangeUDPThenTCP sends the query over UDP, and if the reply is
+// truncated, again over TCP.
+func (r *recursiveResolver) exchangeUDPThenTCP(m *dns.Msg, addr string) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: recursiveTimeout}
+	reply, _, err := c.Exchange(m, addr)
+	if err != nil || reply == nil || !reply.Truncated {
+		return reply, err
+	}
+
+	c = &dns.Client{Net: "tcp", Timeout: recursiveTimeout}
+	reply, _, err = c.Exchange(m, addr)
+	return reply, err
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &recursiveResolver{}
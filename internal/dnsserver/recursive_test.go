@@ -0,0 +1,362 @@
+package dnsserver
+
+// Tests for the recursive resolver.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// fakeAuthority is an authoritative server for a zone, for testing.
+type fakeAuthority struct {
+	zone    string
+	records []dns.RR
+
+	// NS and glue records for the zones delegated to other servers.
+	delegations map[string][]dns.RR
+}
+
+// fakeInternet is a set of authoritative servers, by address, which
+// implements the recursive resolver's exchange function.
+type fakeInternet struct {
+	t       *testing.T
+	servers map[string]*fakeAuthority
+
+	mu      *sync.Mutex
+	queries []string
+}
+
+func newFakeInternet(t *testing.T) *fakeInternet {
+	return &fakeInternet{
+		t:       t,
+		servers: map[string]*fakeAuthority{},
+		mu:      &sync.Mutex{},
+	}
+}
+
+// add an authoritative server for the zone, with the given records; NS
+// records for names below the zone are delegations (and the A records for
+// their targets, glue).
+func (fi *fakeInternet) add(addr, zone string, records ...string) {
+	a := &fakeAuthority{zone: zone, delegations: map[string][]dns.RR{}}
+	for _, s := range records {
+		rr := testutil.NewRR(fi.t, s)
+		if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name != zone {
+			a.delegations[ns.Hdr.Name] = append(a.delegations[ns.Hdr.Name], rr)
+			continue
+		}
+		a.records = append(a.records, rr)
+	}
+	fi.servers[addr+":53"] = a
+}
+
+// take returns the queries received so far (as "addr name type"), and
+// forgets them.
+func (fi *fakeInternet) take() []string {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	qs := fi.queries
+	fi.queries = nil
+	return qs
+}
+
+func (fi *fakeInternet) exchange(m *dns.Msg, addr string) (*dns.Msg, error) {
+	q := m.Question[0]
+	fi.mu.Lock()
+	fi.queries = append(fi.queries, fmt.Sprintf("%s %s %s",
+		strings.TrimSuffix(addr, ":53"), q.Name, dns.Type(q.Qtype)))
+	fi.mu.Unlock()
+
+	a, ok := fi.servers[addr]
+	if !ok {
+		return nil, fmt.Errorf("timeout")
+	}
+
+	reply := &dns.Msg{}
+	reply.SetReply(m)
+
+	for child, ns := range a.delegations {
+		if dns.IsSubDomain(child, q.Name) {
+			reply.Ns = ns
+			for _, rr := range ns {
+				target := rr.(*dns.NS).Ns
+				for _, g := range a.records {
+					if g.Header().Name == target {
+						reply.Extra = append(reply.Extra, g)
+					}
+				}
+			}
+			return reply, nil
+		}
+	}
+
+	reply.Authoritative = true
+	exists := false
+	for _, rr := range a.records {
+		if !strings.EqualFold(rr.Header().Name, q.Name) {
+			// Empty non-terminals exist too.
+			if dns.IsSubDomain(q.Name, rr.Header().Name) {
+				exists = true
+			}
+			continue
+		}
+		exists = true
+		if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			reply.Answer = append(reply.Answer, rr)
+		}
+	}
+	if !exists {
+		reply.Rcode = dns.RcodeNameError
+	}
+
+	// Records out of the zone are added to all the answers, like a server
+	// trying to poison the caches would.
+	for _, rr := range a.records {
+		if !dns.IsSubDomain(a.zone, rr.Header().Name) {
+			reply.Answer = append(reply.Answer, rr)
+		}
+	}
+	return reply, nil
+}
+
+// newTestInternet returns a fake internet with a few zones:
+//   - example. has glue, and an alias to www.other.
+//   - other. is delegated to a server in example. (without glue).
+func newTestInternet(t *testing.T) *fakeInternet {
+	fi := newFakeInternet(t)
+	fi.add("root", ".",
+		"example. 86400 NS ns1.example.",
+		"ns1.example. 86400 A 192.0.2.1",
+		"other. 86400 NS ns.glueless.example.")
+	fi.add("192.0.2.1", "example.",
+		"www.example. 300 A 192.0.2.10",
+		"alias.example. 300 CNAME www.other.",
+		"ns.glueless.example. 300 A 192.0.2.2",
+		"a.b.c.example. 300 A 192.0.2.11")
+	fi.add("192.0.2.2", "other.",
+		"www.other. 300 A 192.0.2.20")
+	return fi
+}
+
+func newTestRecursive(fi *fakeInternet) *recursiveResolver {
+	r := NewRecursiveResolver()
+	r.roots = []string{"root:53"}
+	r.exchange = fi.exchange
+	r.clock = testutil.NewFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	return r
+}
+
+func recursiveQuery(t *testing.T, r *recursiveResolver, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	reply, err := r.Query(req, testutil.NewTestTrace(t))
+	if err != nil {
+		t.Fatalf("%s %s: error: %v", name, dns.Type(qtype), err)
+	}
+	if !reply.RecursionAvailable || reply.Id != req.Id {
+		t.Errorf("%s: unexpected reply header: %v", name, reply)
+	}
+	return reply
+}
+
+func answers(reply *dns.Msg) string {
+	var as []string
+	for _, rr := range reply.Answer {
+		as = append(as, rr.String())
+	}
+	return strings.Join(as, " | ")
+}
+
+func TestRecursive(t *testing.T) {
+	fi := newTestInternet(t)
+	r := newTestRecursive(fi)
+
+	reply := recursiveQuery(t, r, "www.example.", dns.TypeA)
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "192.0.2.10" {
+		t.Errorf("unexpected answer: %s", answers(reply))
+	}
+	if qs := fi.take(); len(qs) != 2 {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+
+	// The delegation of example. is known now, so the root is not queried.
+	recursiveQuery(t, r, "www.example.", dns.TypeA)
+	if qs := fi.take(); len(qs) != 1 || !strings.HasPrefix(qs[0], "192.0.2.1 ") {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+
+	// CNAME to a zone delegated without glue.
+	reply = recursiveQuery(t, r, "alias.example.", dns.TypeA)
+	if len(reply.Answer) != 2 ||
+		reply.Answer[1].(*dns.A).A.String() != "192.0.2.20" {
+		t.Errorf("unexpected answer: %s", answers(reply))
+	}
+
+	reply = recursiveQuery(t, r, "doesnotexist.example.", dns.TypeA)
+	if reply.Rcode != dns.RcodeNameError || len(reply.Answer) != 0 {
+		t.Errorf("expected NXDOMAIN, got: %v", reply)
+	}
+
+	// Delegations expire.
+	fi.take()
+	r.clock.(*testutil.FakeClock).Advance(25 * time.Hour)
+	r.gc()
+	recursiveQuery(t, r, "www.example.", dns.TypeA)
+	if qs := fi.take(); len(qs) != 2 {
+		t.Errorf("unexpected queries after expiration: %q", qs)
+	}
+}
+
+func TestRecursiveOutOfZone(t *testing.T) {
+	fi := newTestInternet(t)
+	fi.add("root", ".",
+		"example. 86400 NS ns1.example.",
+		"ns1.example. 86400 A 192.0.2.1",
+		"other. 86400 NS ns.glueless.example.",
+		"evil. 86400 NS ns.evil.",
+		"ns.evil. 86400 A 192.0.2.66")
+	fi.add("192.0.2.66", "evil.",
+		"www.evil. 300 CNAME www.example.",
+		"www.example. 300 A 203.0.113.66")
+	r := newTestRecursive(fi)
+
+	// The forged record for www.example. is dropped, and the target of the
+	// CNAME is resolved from its own servers.
+	reply := recursiveQuery(t, r, "www.evil.", dns.TypeA)
+	if len(reply.Answer) != 2 ||
+		reply.Answer[1].(*dns.A).A.String() != "192.0.2.10" {
+		t.Errorf("unexpected answer: %s", answers(reply))
+	}
+}
+
+func TestRecursiveErrors(t *testing.T) {
+	fi := newTestInternet(t)
+	r := newTestRecursive(fi)
+
+	// The servers for other. are down.
+	delete(fi.servers, "192.0.2.2:53")
+	req := &dns.Msg{}
+	req.SetQuestion("www.other.", dns.TypeA)
+	if _, err := r.Query(req, testutil.NewTestTrace(t)); err == nil {
+		t.Errorf("no error with the authority down")
+	}
+
+	// Delegations whose nameservers are in each other, without glue.
+	fi.add("192.0.2.2", "other.",
+		"loop.other. 86400 NS ns.loop.example.")
+	fi.add("192.0.2.1", "example.",
+		"ns.glueless.example. 300 A 192.0.2.2",
+		"loop.example. 86400 NS ns.loop.other.")
+	req.SetQuestion("www.loop.other.", dns.TypeA)
+	if _, err := r.Query(req, testutil.NewTestTrace(t)); err == nil {
+		t.Errorf("no error with a referral loop")
+	}
+}
+
+func TestQNAMEMinimization(t *testing.T) {
+	fi := newTestInternet(t)
+	r := newTestRecursive(fi)
+
+	reply := recursiveQuery(t, r, "a.b.c.example.", dns.TypeAAAA)
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 {
+		t.Errorf("expected NODATA, got: %v", reply)
+	}
+	expected := []string{
+		"root example. A",
+		"192.0.2.1 c.example. A",
+		"192.0.2.1 b.c.example. A",
+		"192.0.2.1 a.b.c.example. AAAA",
+	}
+	if qs := fi.take(); strings.Join(qs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+
+	// Nothing below a name that doesn't exist is asked for.
+	reply = recursiveQuery(t, r, "x.y.doesnotexist.example.", dns.TypeA)
+	if reply.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got: %v", reply)
+	}
+	if qs := fi.take(); len(qs) != 1 || qs[0] != "192.0.2.1 doesnotexist.example. A" {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+
+	// Without minimization, the full name goes everywhere.
+	r = newTestRecursive(fi)
+	r.SetQNAMEMinimization(false)
+	recursiveQuery(t, r, "a.b.c.example.", dns.TypeAAAA)
+	expected = []string{
+		"root a.b.c.example. AAAA",
+		"192.0.2.1 a.b.c.example. AAAA",
+	}
+	if qs := fi.take(); strings.Join(qs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+}
+
+func TestLocalRoot(t *testing.T) {
+	fi := newTestInternet(t)
+	root := fi.servers["root:53"]
+	delete(fi.servers, "root:53")
+
+	r := newTestRecursive(fi)
+	r.SetLocalRoot(nil)
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: 86400},
+		Ns: "a.root-servers.net.", Mbox: "nstld.verisign-grs.com.",
+		Serial: 2020010200, Expire: 604800, Minttl: 86400,
+	}
+	rrs := []dns.RR{soa, testutil.NewRR(t, ". 518400 NS a.root-servers.net.")}
+	rrs = append(rrs, root.records...)
+	for _, ns := range root.delegations {
+		rrs = append(rrs, ns...)
+	}
+	if err := r.localRoot.set(rrs); err != nil {
+		t.Fatalf("error setting the root zone: %v", err)
+	}
+
+	reply := recursiveQuery(t, r, "www.example.", dns.TypeA)
+	if len(reply.Answer) != 1 {
+		t.Errorf("unexpected answer: %s", answers(reply))
+	}
+	if qs := fi.take(); len(qs) != 1 || !strings.HasPrefix(qs[0], "192.0.2.1 ") {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+
+	reply = recursiveQuery(t, r, "www.doesnotexist.", dns.TypeA)
+	if reply.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got: %v", reply)
+	}
+	if qs := fi.take(); len(qs) != 0 {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+
+	// Older zones are rejected.
+	old := *soa
+	old.Serial--
+	if err := r.localRoot.set([]dns.RR{&old, rrs[1]}); err == nil {
+		t.Errorf("older zone accepted")
+	}
+	if err := r.localRoot.set([]dns.RR{rrs[1]}); err == nil {
+		t.Errorf("zone without SOA accepted")
+	}
+
+	// Once the zone expires, the root servers are used again.
+	r.clock.(*testutil.FakeClock).Advance(8 * 24 * time.Hour)
+	req := &dns.Msg{}
+	req.SetQuestion("www.other.", dns.TypeA)
+	if _, err := r.Query(req, testutil.NewTestTrace(t)); err == nil {
+		t.Errorf("expired zone used")
+	}
+	if qs := fi.take(); len(qs) != 1 || !strings.HasPrefix(qs[0], "root ") {
+		t.Errorf("unexpected queries: %q", qs)
+	}
+}
@@ -5,9 +5,14 @@ import (
 	"expvar"
 	"fmt"
 	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"blitiri.com.ar/go/dnss/internal/util"
 	"blitiri.com.ar/go/log"
 
 	"github.com/miekg/dns"
@@ -32,36 +37,250 @@ type Resolver interface {
 
 // cachingResolver implements a caching Resolver.
 // It is backed by another Resolver, but will cache results.
+//
+// The cache can be split in partitions by query type, each with its own size
+// limit, so a flood of queries of one type (e.g. TXT) does not evict the
+// entries of the others (e.g. A).
 type cachingResolver struct {
 	// Backing resolver.
 	back Resolver
 
-	// The cache where we keep the records.
-	answer map[dns.Question][]dns.RR
+	// Eviction policy, see cacheStores.
+	policy string
 
-	// mu protects the answer map.
-	mu *sync.RWMutex
+	// Partitions for specific query types.
+	partitions map[uint16]*cachePartition
+
+	// Partition for all the other query types.
+	other *cachePartition
+
+	// Speculatively query for AAAA on A misses, and vice versa.
+	speculate bool
+
+	// Questions we are querying the backing resolver for, so we don't
+	// speculate on them. Protected by inflightMu.
+	inflightMu *sync.Mutex
+	inflight   map[dns.Question]int
+
+	// Clock, so tests can control time.
+	clock util.Clock
+}
+
+// cachePartition is a part of the cache, with its own size limit.
+//
+// Large partitions are split in shards by question, each with its own lock
+// and store, so queries on many-core machines don't all contend for the same
+// lock. Each shard evicts entries on its own, so the eviction policy is
+// applied per shard, which is a close enough approximation when they are
+// big.
+//
+// Reads take the shard's lock too: they are not lock-free (like with
+// sync.Map or copy-on-write snapshots), because both eviction policies
+// update their recency lists on every hit.
+type cachePartition struct {
+	// Name, for debugging.
+	name string
+
+	// Maximum number of entries.
+	size int
+
+	// The shards; their number is always a power of 2, see numShards.
+	shards []*cacheShard
+}
+
+// cacheShard is a part of a partition.
+type cacheShard struct {
+	// Maximum number of entries.
+	size int
+
+	// mu protects the store.
+	mu *sync.Mutex
+
+	// The store where we keep the records.
+	store cacheStore
+}
+
+func newCachePartition(name string, size int, policy string) *cachePartition {
+	return newShardedPartition(name, size, policy,
+		numShards(size, runtime.NumCPU()))
+}
+
+func newShardedPartition(name string, size int, policy string, n int) *cachePartition {
+	p := &cachePartition{
+		name: name,
+		size: size,
+	}
+
+	for i := 0; i < n; i++ {
+		// Spread the remainder over the first shards, so the sizes add up.
+		shardSize := size / n
+		if i < size%n {
+			shardSize++
+		}
+		p.shards = append(p.shards, &cacheShard{
+			size:  shardSize,
+			mu:    &sync.Mutex{},
+			store: cacheStores[policy](shardSize),
+		})
+	}
+	return p
+}
+
+// numShards returns how many shards to use for a partition of the given
+// size: one per CPU (rounded down to a power of 2), as long as each gets at
+// least minShardSize entries.
+func numShards(size, cpus int) int {
+	n := 1
+	for n*2 <= cpus && n*2*minShardSize <= size {
+		n *= 2
+	}
+	return n
+}
+
+// shardFor returns the shard for the given question.
+func (p *cachePartition) shardFor(q dns.Question) *cacheShard {
+	if len(p.shards) == 1 {
+		return p.shards[0]
+	}
+
+	// FNV-1a, inlined to avoid allocations.
+	h := uint32(2166136261)
+	for i := 0; i < len(q.Name); i++ {
+		h ^= uint32(q.Name[i])
+		h *= 16777619
+	}
+	h ^= uint32(q.Qtype)
+	h *= 16777619
+	return p.shards[h&uint32(len(p.shards)-1)]
+}
+
+// len returns the number of entries in the partition.
+func (p *cachePartition) len() int {
+	n := 0
+	for _, s := range p.shards {
+		s.mu.Lock()
+		n += s.store.len()
+		s.mu.Unlock()
+	}
+	return n
 }
 
 // NewCachingResolver returns a new resolver which implements a cache on top
 // of the given one.
+// By default, the cache has a single partition of maxCacheSize entries, and
+// evicts the least recently used ones.
 func NewCachingResolver(back Resolver) *cachingResolver {
 	return &cachingResolver{
-		back:   back,
-		answer: map[dns.Question][]dns.RR{},
-		mu:     &sync.RWMutex{},
+		back:       back,
+		policy:     "lru",
+		partitions: map[uint16]*cachePartition{},
+		other:      newCachePartition("other", maxCacheSize, "lru"),
+		inflightMu: &sync.Mutex{},
+		inflight:   map[dns.Question]int{},
+		clock:      util.RealClock,
+	}
+}
+
+// SetPolicy sets the eviction policy (see ValidCachePolicy), and clears the
+// cache. Must be called before Init.
+func (c *cachingResolver) SetPolicy(policy string) {
+	c.policy = policy
+	c.other = newCachePartition("other", c.other.size, policy)
+	for qtype, p := range c.partitions {
+		c.partitions[qtype] = newCachePartition(p.name, p.size, policy)
+	}
+}
+
+// SetPartitions splits the cache in partitions, with the given sizes indexed
+// by query type (see ParseCachePartitions), and clears the cache. Must be
+// called before Init.
+func (c *cachingResolver) SetPartitions(sizes map[uint16]int) {
+	c.partitions = map[uint16]*cachePartition{}
+	for qtype, size := range sizes {
+		if qtype == dns.TypeNone {
+			c.other = newCachePartition("other", size, c.policy)
+			continue
+		}
+		c.partitions[qtype] = newCachePartition(
+			dns.TypeToString[qtype], size, c.policy)
 	}
 }
 
+// SetSpeculative enables speculative queries: on a cache miss for an A query,
+// we also query for AAAA in the background (and vice versa), and cache the
+// result, as clients almost always ask for both back to back.
+// This saves a round trip for them, at the cost of some extra upstream
+// queries. Must be called before Init.
+func (c *cachingResolver) SetSpeculative(speculate bool) {
+	c.speculate = speculate
+}
+
+// ParseCachePartitions parses a space-separated list of "type=size" entries,
+// where type is a query type (like A or TXT) or "other" for the types not
+// listed. It returns the sizes indexed by query type (with dns.TypeNone for
+// "other"), as expected by SetPartitions.
+func ParseCachePartitions(s string) (map[uint16]int, error) {
+	sizes := map[uint16]int{}
+	for _, entry := range strings.Fields(s) {
+		sp := strings.SplitN(entry, "=", 2)
+		if len(sp) != 2 {
+			return nil, fmt.Errorf("invalid entry %q (expected type=size)",
+				entry)
+		}
+
+		qtype := dns.TypeNone
+		if !strings.EqualFold(sp[0], "other") {
+			var ok bool
+			qtype, ok = dns.StringToType[strings.ToUpper(sp[0])]
+			if !ok || qtype == dns.TypeNone {
+				return nil, fmt.Errorf("unknown query type %q", sp[0])
+			}
+		}
+		if _, dup := sizes[qtype]; dup {
+			return nil, fmt.Errorf("duplicated entry for %q", sp[0])
+		}
+
+		size, err := strconv.Atoi(sp[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid size %q for %q", sp[1], sp[0])
+		}
+		sizes[qtype] = size
+	}
+	return sizes, nil
+}
+
+// partitionFor returns the partition for the given query type.
+func (c *cachingResolver) partitionFor(qtype uint16) *cachePartition {
+	if p, ok := c.partitions[qtype]; ok {
+		return p
+	}
+	return c.other
+}
+
+// allPartitions returns all the partitions, sorted by name (with "other"
+// last).
+func (c *cachingResolver) allPartitions() []*cachePartition {
+	ps := []*cachePartition{}
+	for _, p := range c.partitions {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].name < ps[j].name })
+	return append(ps, c.other)
+}
+
 // Constants that tune the cache.
 // They are declared as variables so we can tweak them for testing.
 var (
-	// Maximum number of entries we keep in the cache.
+	// Maximum number of entries we keep in the cache, by default.
 	// 2k should be reasonable for a small network.
 	// Keep in mind that increasing this too much will interact negatively
 	// with Maintain().
 	maxCacheSize = 2000
 
+	// Minimum number of entries per cache shard. Below this, the lock
+	// contention is not worth the less accurate eviction.
+	minShardSize = 4096
+
 	// Minimum TTL for entries we consider for the cache.
 	minTTL = 2 * time.Minute
 
@@ -91,6 +310,16 @@ var stats = struct {
 
 	// Entries we decided to record in the cache.
 	cacheRecorded *expvar.Int
+
+	// Entries evicted to make room for new ones.
+	cacheEvicted *expvar.Int
+
+	// Hits and misses by query type, useful to decide on the partitions.
+	cacheHitsByType   *expvar.Map
+	cacheMissesByType *expvar.Map
+
+	// Speculative queries we sent (see SetSpeculative).
+	cacheSpeculative *expvar.Int
 }{}
 
 func init() {
@@ -99,6 +328,10 @@ func init() {
 	stats.cacheHits = expvar.NewInt("cache-hits")
 	stats.cacheMisses = expvar.NewInt("cache-misses")
 	stats.cacheRecorded = expvar.NewInt("cache-recorded")
+	stats.cacheEvicted = expvar.NewInt("cache-evicted")
+	stats.cacheHitsByType = expvar.NewMap("cache-hits-by-type")
+	stats.cacheMissesByType = expvar.NewMap("cache-misses-by-type")
+	stats.cacheSpeculative = expvar.NewInt("cache-speculative-queries")
 }
 
 func (c *cachingResolver) Init() error {
@@ -116,71 +349,140 @@ func (c *cachingResolver) RegisterDebugHandlers() {
 
 func (c *cachingResolver) DumpCache(w http.ResponseWriter, r *http.Request) {
 	buf := bytes.NewBuffer(nil)
-
-	c.mu.RLock()
-	for q, ans := range c.answer {
-		// Only include names and records if we are running verbosily.
-		name := "<hidden>"
-		if log.V(3) {
-			name = q.Name
+	now := c.clock.Now()
+
+	for _, p := range c.allPartitions() {
+		ebuf := bytes.NewBuffer(nil)
+		entries, size := 0, 0
+		for _, s := range p.shards {
+			s.mu.Lock()
+			s.store.each(func(q dns.Question, ans *packedAnswer) {
+				dumpCacheEntry(ebuf, q, ans, now)
+				entries++
+				size += ans.size()
+			})
+			s.mu.Unlock()
 		}
+		fmt.Fprintf(buf, "Partition %s: %d/%d entries, %d bytes, %d shards (%s)\n\n\n",
+			p.name, entries, p.size, size, len(p.shards), c.policy)
+		ebuf.WriteTo(buf)
+	}
+
+	buf.WriteTo(w)
+}
 
-		fmt.Fprintf(buf, "Q: %s %s %s\n", name, dns.TypeToString[q.Qtype],
-			dns.ClassToString[q.Qclass])
+func dumpCacheEntry(buf *bytes.Buffer, q dns.Question, pa *packedAnswer, now time.Time) {
+	// Only include names and records if we are running verbosily.
+	name := "<hidden>"
+	if log.V(3) {
+		name = util.DisplayName(q.Name)
+	}
 
-		ttl := getTTL(ans)
-		fmt.Fprintf(buf, "   expires in %s (%s)\n", ttl, time.Now().Add(ttl))
+	fmt.Fprintf(buf, "Q: %s %s %s\n", name, dns.TypeToString[q.Qtype],
+		dns.ClassToString[q.Qclass])
 
-		if log.V(3) {
-			for _, rr := range ans {
-				fmt.Fprintf(buf, "   %s\n", rr.String())
-			}
-		} else {
-			fmt.Fprintf(buf, "   %d RRs in answer\n", len(ans))
+	ttl := pa.ttl()
+	fmt.Fprintf(buf, "   expires in %s (%s)\n", ttl, now.Add(ttl))
+
+	if log.V(3) {
+		ans, err := pa.unpack()
+		if err != nil {
+			fmt.Fprintf(buf, "   error unpacking answer: %v\n", err)
+		}
+		for _, rr := range ans {
+			fmt.Fprintf(buf, "   %s\n", rr.String())
 		}
-		fmt.Fprintf(buf, "\n\n")
+	} else {
+		fmt.Fprintf(buf, "   %d RRs in answer (%d bytes)\n",
+			pa.len(), pa.size())
 	}
-	c.mu.RUnlock()
-
-	buf.WriteTo(w)
+	fmt.Fprintf(buf, "\n\n")
 }
 
 func (c *cachingResolver) FlushCache(w http.ResponseWriter, r *http.Request) {
-	c.mu.Lock()
-	c.answer = map[dns.Question][]dns.RR{}
-	c.mu.Unlock()
-
+	c.Flush()
 	w.Write([]byte("cache flush complete"))
 }
 
+// Flush removes all the entries from the cache.
+func (c *cachingResolver) Flush() {
+	for _, p := range c.allPartitions() {
+		for _, s := range p.shards {
+			s.mu.Lock()
+			s.store = cacheStores[c.policy](s.size)
+			s.mu.Unlock()
+		}
+	}
+}
+
 func (c *cachingResolver) Maintain() {
 	go c.back.Maintain()
 
-	for range time.Tick(maintenancePeriod) {
+	c.clock.Every(maintenancePeriod, func() {
 		tr := trace.New("dnsserver.Cache", "GC")
-		var total, expired int
-
-		c.mu.Lock()
-		total = len(c.answer)
-		for q, ans := range c.answer {
-			newTTL := getTTL(ans) - maintenancePeriod
-			if newTTL > 0 {
-				// Don't modify in place, create a copy and override.
-				// That way, we avoid races with users that have gotten a
-				// cached answer and are returning it.
-				newans := copyRRSlice(ans)
-				setTTL(newans, newTTL)
-				c.answer[q] = newans
-				continue
-			}
-
-			delete(c.answer, q)
-			expired++
+		for _, p := range c.allPartitions() {
+			total, expired := p.gc()
+			tr.LazyPrintf("%s: total: %d   expired: %d",
+				p.name, total, expired)
 		}
-		c.mu.Unlock()
-		tr.LazyPrintf("total: %d   expired: %d", total, expired)
 		tr.Finish()
+	})
+}
+
+// get the answer for the question from the partition, unpacked.
+func (p *cachePartition) get(q dns.Question, tr trace.Trace) ([]dns.RR, bool) {
+	s := p.shardFor(q)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	packed, ok := s.store.get(q)
+	if !ok {
+		return nil, false
+	}
+
+	answer, err := packed.unpack()
+	if err != nil {
+		// Should not happen, as we packed it ourselves; drop it so we get
+		// a fresh one.
+		tr.LazyPrintf("cache error unpacking answer: %v", err)
+		s.store.remove(q)
+		return nil, false
+	}
+	return answer, true
+}
+
+// gc decrements the TTL of the entries in the partition, and removes the
+// expired ones.
+func (p *cachePartition) gc() (total, expired int) {
+	for _, s := range p.shards {
+		t, e := s.gc()
+		total += t
+		expired += e
 	}
+	return total, expired
+}
+
+func (s *cacheShard) gc() (total, expired int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// We can update the TTLs in place, as the hits unpack the answers
+	// while holding the lock, and users get their own copy of the records.
+	var expiredQs []dns.Question
+	s.store.each(func(q dns.Question, ans *packedAnswer) {
+		total++
+		newTTL := ans.ttl() - maintenancePeriod
+		if newTTL > 0 {
+			ans.setTTL(newTTL)
+		} else {
+			expiredQs = append(expiredQs, q)
+		}
+	})
+
+	for _, q := range expiredQs {
+		s.store.remove(q)
+	}
+	return total, len(expiredQs)
 }
 
 func wantToCache(question dns.Question, reply *dns.Msg) error {
@@ -192,6 +494,8 @@ func wantToCache(question dns.Question, reply *dns.Msg) error {
 		return fmt.Errorf("opcode %d != query", reply.Opcode)
 	} else if len(reply.Answer) == 0 {
 		return fmt.Errorf("answer is empty")
+	} else if reply.Truncated {
+		return fmt.Errorf("truncated")
 	} else if len(reply.Question) != 1 {
 		return fmt.Errorf("too many/few questions (%d)", len(reply.Question))
 	} else if reply.Question[0] != question {
@@ -229,14 +533,6 @@ func setTTL(answer []dns.RR, newTTL time.Duration) {
 	}
 }
 
-func copyRRSlice(a []dns.RR) []dns.RR {
-	b := make([]dns.RR, 0, len(a))
-	for _, rr := range a {
-		b = append(b, dns.Copy(rr))
-	}
-	return b
-}
-
 func (c *cachingResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
 	stats.cacheTotal.Add(1)
 
@@ -248,14 +544,14 @@ func (c *cachingResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
 	}
 
 	question := r.Question[0]
+	qtype := dns.TypeToString[question.Qtype]
+	p := c.partitionFor(question.Qtype)
 
-	c.mu.RLock()
-	answer, hit := c.answer[question]
-	c.mu.RUnlock()
-
+	answer, hit := p.get(question, tr)
 	if hit {
 		tr.LazyPrintf("cache hit")
 		stats.cacheHits.Add(1)
+		stats.cacheHitsByType.Add(qtype, 1)
 
 		reply := &dns.Msg{
 			MsgHdr: dns.MsgHdr{
@@ -273,37 +569,130 @@ func (c *cachingResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
 
 	tr.LazyPrintf("cache miss")
 	stats.cacheMisses.Add(1)
+	stats.cacheMissesByType.Add(qtype, 1)
+
+	c.startQuery(question)
+	defer c.endQuery(question)
+	if c.speculate {
+		c.maybeSpeculate(r)
+	}
 
 	reply, err := c.back.Query(r, tr)
 	if err != nil {
 		return reply, err
 	}
 
-	if err = wantToCache(question, reply); err != nil {
+	c.record(p, question, reply, tr)
+	return reply, nil
+}
+
+// record the reply in the cache, if it's worth it.
+func (c *cachingResolver) record(p *cachePartition, question dns.Question, reply *dns.Msg, tr trace.Trace) {
+	if err := wantToCache(question, reply); err != nil {
 		tr.LazyPrintf("cache not recording reply: %v", err)
-		return reply, nil
+		return
 	}
 
-	answer = reply.Answer
+	answer := reply.Answer
 	ttl := limitTTL(answer)
 
 	// Only store answers if they're going to stay around for a bit,
 	// there's not much point in caching things we have to expire quickly.
 	if ttl < minTTL {
-		return reply, nil
+		return
 	}
 
-	// Store the answer in the cache, but don't exceed 2k entries.
-	// TODO: Do usage based eviction when we're approaching ~1.5k.
-	c.mu.Lock()
-	if len(c.answer) < maxCacheSize {
+	// Store the answer in the cache; the store will evict entries if the
+	// partition is full.
+	if p.size > 0 {
 		setTTL(answer, ttl)
-		c.answer[question] = answer
+		packed, err := packAnswer(answer)
+		if err != nil {
+			tr.LazyPrintf("cache not recording reply: error packing: %v", err)
+			return
+		}
+
+		s := p.shardFor(question)
+		s.mu.Lock()
+		evicted := s.store.set(question, packed)
+		s.mu.Unlock()
+
 		stats.cacheRecorded.Add(1)
+		stats.cacheEvicted.Add(int64(evicted))
+		if evicted > 0 {
+			tr.LazyPrintf("cache evicted %d entries from %s",
+				evicted, p.name)
+		}
 	}
-	c.mu.Unlock()
+}
 
-	return reply, nil
+// startQuery and endQuery keep track of the questions we are querying the
+// backing resolver for.
+func (c *cachingResolver) startQuery(q dns.Question) {
+	c.inflightMu.Lock()
+	c.inflight[q]++
+	c.inflightMu.Unlock()
+}
+
+func (c *cachingResolver) endQuery(q dns.Question) {
+	c.inflightMu.Lock()
+	c.inflight[q]--
+	if c.inflight[q] <= 0 {
+		delete(c.inflight, q)
+	}
+	c.inflightMu.Unlock()
+}
+
+// maybeSpeculate sends a query for the sibling of the given one (AAAA for A,
+// and vice versa) in the background, and caches the result, unless it's
+// already cached or in flight.
+func (c *cachingResolver) maybeSpeculate(r *dns.Msg) {
+	sibling := r.Question[0]
+	switch sibling.Qtype {
+	case dns.TypeA:
+		sibling.Qtype = dns.TypeAAAA
+	case dns.TypeAAAA:
+		sibling.Qtype = dns.TypeA
+	default:
+		return
+	}
+
+	p := c.partitionFor(sibling.Qtype)
+	s := p.shardFor(sibling)
+	s.mu.Lock()
+	cached := s.store.contains(sibling)
+	s.mu.Unlock()
+	if cached || p.size <= 0 {
+		return
+	}
+
+	c.inflightMu.Lock()
+	if c.inflight[sibling] > 0 {
+		c.inflightMu.Unlock()
+		return
+	}
+	c.inflight[sibling]++
+	c.inflightMu.Unlock()
+
+	req := r.Copy()
+	req.Id = dns.Id()
+	req.Question = []dns.Question{sibling}
+	stats.cacheSpeculative.Add(1)
+
+	go func() {
+		defer c.endQuery(sibling)
+
+		tr := trace.New("dnsserver.Cache", "speculate")
+		defer tr.Finish()
+		util.TraceQuestion(tr, req.Question)
+
+		reply, err := c.back.Query(req, tr)
+		if err != nil {
+			util.TraceError(tr, err)
+			return
+		}
+		c.record(p, sibling, reply, tr)
+	}()
 }
 
 // Compile-time check that the implementation matches the interface.
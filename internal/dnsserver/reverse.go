@@ -0,0 +1,435 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Reverse zones resolver.
+
+// reverseResolver implements a Resolver which is authoritative for a set of
+// reverse zones (like 1.168.192.in-addr.arpa.), answering the PTR queries in
+// them from a hosts file and other local sources (like the DHCP leases),
+// instead of sending them upstream, where they would leak the local
+// addresses and get no useful answer anyway.
+//
+// The zones look like the locally served empty zones of RFC 6303, plus the
+// records we know of: names we don't know get NXDOMAIN, and the negative
+// replies include the zone's SOA, so they can be cached.
+type reverseResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Zones we are authoritative for (lowercased, fully qualified).
+	zones []string
+
+	// Hosts file (in /etc/hosts format, plus include directives) to load
+	// records from, and the domain for the unqualified names in it.
+	// Optional.
+	hostsPath string
+	domain    string
+
+	// Other sources of records for the zones.
+	sources []reverseSource
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Protects the fields below.
+	mu *sync.RWMutex
+
+	// PTR records from the hosts file, indexed by (lowercased) name.
+	records map[string][]dns.RR
+
+	// Modification time of the hosts files (the newest, if there are
+	// includes) when we last loaded them, which is also the serial of the
+	// zones.
+	mtime time.Time
+
+	// The files we loaded (including the included ones), and their
+	// version, to notice when they change.
+	hostsFiles   []string
+	hostsVersion string
+}
+
+// reverseSource is a source of records for the reverse zones.
+type reverseSource interface {
+	// reverseRecords returns the records, indexed by (lowercased) name.
+	// Only the PTR records in the zones are used.
+	reverseRecords() map[string][]dns.RR
+}
+
+// NewReverseResolver returns a new resolver which is authoritative for the
+// given reverse zones, with the records from the given hosts file (if any;
+// the unqualified names in it go under domain), and uses back to resolve
+// everything else.
+func NewReverseResolver(back Resolver, zones []string, hostsPath, domain string) *reverseResolver {
+	r := &reverseResolver{
+		back:      back,
+		hostsPath: hostsPath,
+		domain:    util.CanonicalName(domain),
+		clock:     util.RealClock,
+		mu:        &sync.RWMutex{},
+		records:   map[string][]dns.RR{},
+	}
+	for _, z := range zones {
+		r.zones = append(r.zones, util.CanonicalName(z))
+	}
+	return r
+}
+
+// AddSource adds the records of the given resolver to the zones. It must be
+// a resolver which has them, like the one from NewLeasesResolver.
+func (r *reverseResolver) AddSource(s Resolver) error {
+	rs, ok := s.(reverseSource)
+	if !ok {
+		return fmt.Errorf("resolver has no records for the reverse zones")
+	}
+	r.sources = append(r.sources, rs)
+	return nil
+}
+
+// Exported variables for statistics.
+var reverseStats = struct {
+	// Number of PTR records loaded from the hosts file.
+	records *expvar.Int
+
+	// Queries answered for the reverse zones, by rcode.
+	answers *expvar.Map
+}{}
+
+func init() {
+	reverseStats.records = expvar.NewInt("reverse-zone-records")
+	reverseStats.answers = expvar.NewMap("reverse-zone-answers")
+}
+
+// Constants that tune the reverse zones, declared as variables so we can
+// tweak them for testing.
+var (
+	// How often to check the hosts file for changes.
+	reverseCheckPeriod = 30 * time.Second
+
+	// TTL of the records, and of the negative replies (as the SOA minimum).
+	// Short, as the sources can change at any time.
+	reverseTTL uint32 = 60
+)
+
+// ParseReverseZones parses a space-separated list of reverse zones, which
+// can be given by name (like "1.168.192.in-addr.arpa") or as networks (like
+// "192.168.1.0/24" or "fd00::/8"). Networks must be on a label boundary:
+// multiples of 8 bits for IPv4, and of 4 bits for IPv6.
+func ParseReverseZones(s string) ([]string, error) {
+	zones := []string{}
+	for _, f := range strings.Fields(s) {
+		z, err := parseReverseZone(f)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", f, err)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+func parseReverseZone(s string) (string, error) {
+	if !strings.Contains(s, "/") {
+		z := util.CanonicalName(s)
+		if !dns.IsSubDomain("in-addr.arpa.", z) &&
+			!dns.IsSubDomain("ip6.arpa.", z) {
+			return "", fmt.Errorf("not under in-addr.arpa or ip6.arpa")
+		}
+		return z, nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := ipnet.Mask.Size()
+
+	// Take the reverse name of the network address, and remove the labels
+	// for the host part.
+	rev, err := dns.ReverseAddr(ipnet.IP.String())
+	if err != nil {
+		return "", err
+	}
+	labels := dns.SplitDomainName(rev)
+	var keep int
+	if bits == 32 {
+		if ones%8 != 0 {
+			return "", fmt.Errorf("prefix length must be a multiple of 8")
+		}
+		keep = ones / 8
+	} else {
+		if ones%4 != 0 {
+			return "", fmt.Errorf("prefix length must be a multiple of 4")
+		}
+		keep = ones / 4
+	}
+	labels = labels[len(labels)-2-keep:]
+	return strings.Join(labels, ".") + ".", nil
+}
+
+func (r *reverseResolver) Init() error {
+	if err := r.reload(); err != nil {
+		return err
+	}
+	return r.back.Init()
+}
+
+func (r *reverseResolver) Maintain() {
+	go r.back.Maintain()
+
+	if r.hostsPath == "" {
+		return
+	}
+	r.clock.Every(reverseCheckPeriod, func() {
+		if err := r.reload(); err != nil {
+			log.Errorf("Error reloading hosts for the reverse zones: %v", err)
+		}
+	})
+}
+
+// reload the hosts file, if it has changed since the last time.
+func (r *reverseResolver) reload() error {
+	if r.hostsPath == "" {
+		r.mu.Lock()
+		r.mtime = r.clock.Now()
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.mu.RLock()
+	files, version := r.hostsFiles, r.hostsVersion
+	r.mu.RUnlock()
+	if files != nil && util.FilesVersion(files) == version {
+		return nil
+	}
+
+	lines, err := util.OpenLineScanner(r.hostsPath)
+	if err != nil {
+		return err
+	}
+	defer lines.Close()
+
+	records, err := parseHostsLines(lines, r.domain)
+	if err != nil {
+		return fmt.Errorf("error parsing %q: %v", r.hostsPath, err)
+	}
+
+	mtime := time.Time{}
+	for _, path := range lines.Files() {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+
+	r.mu.Lock()
+	r.records = records
+	r.mtime = mtime
+	r.hostsFiles = lines.Files()
+	r.hostsVersion = util.FilesVersion(r.hostsFiles)
+	r.mu.Unlock()
+
+	reverseStats.records.Set(int64(len(records)))
+	log.Infof("Loaded %d hosts for the reverse zones from %q",
+		len(records), r.hostsPath)
+	return nil
+}
+
+// parseHostsPTRs parses a hosts file, and returns the PTR records for it:
+// each address points to the first name in its line.
+func parseHostsPTRs(f io.Reader, domain string) (map[string][]dns.RR, error) {
+	return parseHostsLines(util.NewLineScanner(f), domain)
+}
+
+func parseHostsLines(lines *util.LineScanner, domain string) (map[string][]dns.RR, error) {
+	records := map[string][]dns.RR{}
+	for lines.Scan() {
+		line := lines.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s: missing host name", lines.Pos())
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid address %q",
+				lines.Pos(), fields[0])
+		}
+		rev, _ := dns.ReverseAddr(ip.String())
+
+		name := strings.ToLower(fields[1])
+		if !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+			name = strings.TrimSuffix(name, ".") + "." + domain
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("%s: invalid name %q",
+				lines.Pos(), fields[1])
+		}
+
+		records[rev] = append(records[rev], &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   rev,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    reverseTTL,
+			},
+			Ptr: dns.Fqdn(name),
+		})
+	}
+	return records, lines.Err()
+}
+
+// zoneFor returns the zone the name is in, or "" if it's not in any of
+// ours. With nested zones, the most specific one wins.
+func (r *reverseResolver) zoneFor(name string) string {
+	zone := ""
+	for _, z := range r.zones {
+		if dns.IsSubDomain(z, name) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// lookup returns the PTR records for the given name, and whether the name
+// exists (it may exist without records, when it has names under it).
+func (r *reverseResolver) lookup(name string) ([]dns.RR, bool) {
+	r.mu.RLock()
+	maps := []map[string][]dns.RR{r.records}
+	r.mu.RUnlock()
+	for _, s := range r.sources {
+		maps = append(maps, s.reverseRecords())
+	}
+
+	var ptrs []dns.RR
+	for _, m := range maps {
+		for _, rr := range m[name] {
+			if rr.Header().Rrtype == dns.TypePTR {
+				ptrs = append(ptrs, rr)
+			}
+		}
+	}
+	if len(ptrs) > 0 {
+		return ptrs, true
+	}
+
+	for _, m := range maps {
+		for n, rrs := range m {
+			if n != name && dns.IsSubDomain(name, n) && hasPTR(rrs) {
+				return nil, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func hasPTR(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypePTR {
+			return true
+		}
+	}
+	return false
+}
+
+// soa returns the SOA record for the zone. Like the ones in RFC 6303, it
+// points to the zone itself.
+func (r *reverseResolver) soa(zone string) *dns.SOA {
+	r.mu.RLock()
+	serial := uint32(r.mtime.Unix())
+	r.mu.RUnlock()
+
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    reverseTTL,
+		},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  reverseTTL,
+	}
+}
+
+func (r *reverseResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return r.back.Query(req, tr)
+	}
+
+	question := req.Question[0]
+	name := util.CanonicalName(question.Name)
+	zone := r.zoneFor(name)
+	if zone == "" {
+		return r.back.Query(req, tr)
+	}
+
+	tr.LazyPrintf("reverse zone %q", zone)
+	reply := newReplyTo(req)
+	reply.Authoritative = true
+
+	ptrs, exists := r.lookup(name)
+	if name == zone {
+		exists = true
+		switch question.Qtype {
+		case dns.TypeSOA, dns.TypeANY:
+			reply.Answer = append(reply.Answer,
+				renameRR(r.soa(zone), question.Name))
+		case dns.TypeNS:
+			reply.Answer = append(reply.Answer, &dns.NS{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypeNS,
+					Class:  dns.ClassINET,
+					Ttl:    reverseTTL,
+				},
+				Ns: zone,
+			})
+		}
+	}
+
+	if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+		for _, rr := range ptrs {
+			reply.Answer = append(reply.Answer, renameRR(rr, question.Name))
+		}
+	}
+
+	if !exists {
+		reply.Rcode = dns.RcodeNameError
+	}
+	if len(reply.Answer) == 0 {
+		// NXDOMAIN or NODATA: give the SOA, so they can be cached
+		// (RFC 2308).
+		reply.Ns = []dns.RR{r.soa(zone)}
+	}
+
+	reverseStats.answers.Add(dns.RcodeToString[reply.Rcode], 1)
+	return reply, nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &reverseResolver{}
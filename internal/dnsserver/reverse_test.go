@@ -0,0 +1,212 @@
+package dnsserver
+
+// Tests for the reverse zones resolver.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseReverseZones(t *testing.T) {
+	zones, err := ParseReverseZones("1.168.192.IN-ADDR.ARPA 10.0.0.0/8" +
+		" 172.16.0.0/16 192.168.0.0/24 fd00::/8 2001:db8:1::/48")
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	expected := []string{
+		"1.168.192.in-addr.arpa.",
+		"10.in-addr.arpa.",
+		"16.172.in-addr.arpa.",
+		"0.168.192.in-addr.arpa.",
+		"d.f.ip6.arpa.",
+		"1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	}
+	if strings.Join(zones, " ") != strings.Join(expected, " ") {
+		t.Errorf("got %v, expected %v", zones, expected)
+	}
+
+	for _, s := range []string{"example.com", "10.0.0.0/12", "fd00::/9",
+		"10.0.0.0/99"} {
+		if _, err := ParseReverseZones(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnss_reverse_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# Local hosts.\n" +
+		"127.0.0.1 localhost\n" +
+		"192.168.1.2 router router.lan  # The router.\n" +
+		"192.168.1.3 NAS.home.example.\n" +
+		"fd00::2 router\n")
+	f.Close()
+
+	leasesFile, err := ioutil.TempFile("", "dnss_reverse_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(leasesFile.Name())
+	leasesFile.WriteString("0 aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n")
+	leasesFile.Close()
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "upstream. A 1.2.3.4"))
+	leases := NewLeasesResolver(back, leasesFile.Name(), "dnsmasq", "lan")
+
+	zones, _ := ParseReverseZones("192.168.0.0/16 fd00::/8")
+	r := NewReverseResolver(leases, zones, f.Name(), "lan")
+	if err := r.AddSource(leases); err != nil {
+		t.Fatalf("failed to add source: %v", err)
+	}
+	if err := r.AddSource(back); err == nil {
+		t.Errorf("added a resolver without records as a source")
+	}
+	if err := r.Init(); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+		soa    bool
+		passed bool
+	}{
+		{"2.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess,
+			"router.lan.", false, false},
+		{"3.1.168.192.IN-ADDR.ARPA.", dns.TypePTR, dns.RcodeSuccess,
+			"nas.home.example.", false, false},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess,
+			"laptop.lan.", false, false},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+			dns.TypePTR, dns.RcodeSuccess, "router.lan.", false, false},
+
+		// Other types for known names, and names with others under them,
+		// give NODATA.
+		{"2.1.168.192.in-addr.arpa.", dns.TypeTXT, dns.RcodeSuccess,
+			"", true, false},
+		{"1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess,
+			"", true, false},
+
+		// Unknown names don't exist.
+		{"99.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError,
+			"", true, false},
+		{"1.2.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError,
+			"", true, false},
+
+		// The apex has our SOA and NS.
+		{"168.192.in-addr.arpa.", dns.TypeSOA, dns.RcodeSuccess,
+			"168.192.in-addr.arpa.", false, false},
+		{"168.192.in-addr.arpa.", dns.TypeNS, dns.RcodeSuccess,
+			"168.192.in-addr.arpa.", false, false},
+
+		// Outside the zones, queries go through.
+		{"1.0.0.127.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess,
+			"1.2.3.4", false, true},
+		{"example.com.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4", false, true},
+	}
+
+	for _, c := range cases {
+		back.LastQuery = nil
+		tr := testutil.NewTestTrace(t)
+		resp, err := r.Query(newQuery(c.name, c.qtype), tr)
+		if err != nil {
+			t.Errorf("%s: query failed: %v", c.name, err)
+			continue
+		}
+
+		if resp.Rcode != c.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", c.name, c.rcode, resp.Rcode)
+		}
+		answer := ""
+		if len(resp.Answer) == 1 {
+			switch rr := resp.Answer[0].(type) {
+			case *dns.A:
+				answer = rr.A.String()
+			case *dns.PTR:
+				answer = rr.Ptr
+			case *dns.SOA:
+				answer = rr.Ns
+			case *dns.NS:
+				answer = rr.Ns
+			}
+		}
+		if answer != c.answer {
+			t.Errorf("%s: expected answer %q, got %v",
+				c.name, c.answer, resp.Answer)
+		}
+		soa := len(resp.Ns) == 1 && resp.Ns[0].Header().Rrtype == dns.TypeSOA
+		if soa != c.soa {
+			t.Errorf("%s: expected SOA in authority %v, got %v",
+				c.name, c.soa, resp.Ns)
+		}
+		if !c.passed && !resp.Authoritative {
+			t.Errorf("%s: reply is not authoritative", c.name)
+		}
+		if passed := back.LastQuery != nil; passed != c.passed {
+			t.Errorf("%s: expected passthrough %v, got %v",
+				c.name, c.passed, passed)
+		}
+	}
+}
+
+func TestHostsIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss_reverse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "hosts.d"), 0755)
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path,
+		[]byte("192.168.1.2 router\ninclude hosts.d/*.hosts\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "hosts.d/nas.hosts"),
+		[]byte("192.168.1.3 nas\n"), 0644)
+
+	zones, _ := ParseReverseZones("192.168.0.0/16")
+	r := NewReverseResolver(testutil.NewTestResolver(), zones, path, "lan")
+	ptr := func(rev string) string {
+		t.Helper()
+		if err := r.reload(); err != nil {
+			t.Fatalf("reload error: %v", err)
+		}
+		rrs, _ := r.lookup(rev)
+		if len(rrs) != 1 {
+			return ""
+		}
+		return rrs[0].(*dns.PTR).Ptr
+	}
+
+	if p := ptr("3.1.168.192.in-addr.arpa."); p != "nas.lan." {
+		t.Errorf("included host not found: %q", p)
+	}
+
+	// New files in the included directory are noticed.
+	ioutil.WriteFile(filepath.Join(dir, "hosts.d/printer.hosts"),
+		[]byte("192.168.1.4 printer\n"), 0644)
+	if p := ptr("4.1.168.192.in-addr.arpa."); p != "printer.lan." {
+		t.Errorf("new included host not found: %q", p)
+	}
+
+	// Errors in the included files say where they are.
+	ioutil.WriteFile(filepath.Join(dir, "hosts.d/printer.hosts"),
+		[]byte("192.168.1.4 printer\nbad\n"), 0644)
+	err = r.reload()
+	if err == nil || !strings.Contains(err.Error(), "line 2 of") ||
+		!strings.Contains(err.Error(), "printer.hosts") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,787 @@
+package dnsserver
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/dnss/internal/webhook"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// RPZ resolver.
+
+// rpzResolver implements a Resolver which filters queries according to
+// Response Policy Zones (RPZ), as described in
+// https://tools.ietf.org/html/draft-vixie-dnsop-dns-rpz-00.
+//
+// Only QNAME triggers are supported, which is what most feeds use. The
+// policies that don't match are passed through to the backing resolver.
+type rpzResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Where to load the zones from, in order of precedence.
+	sources []string
+
+	// How often to reload the zones (0 means never).
+	refresh time.Duration
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Schedules of the sources that are only active at some times, by
+	// source.
+	schedules map[string]*Schedule
+
+	// The policy built from all the active zones.
+	policy *rpzPolicy
+
+	// The policies of each zone, by source, and which sources are active.
+	zones  map[string]*rpzPolicy
+	active map[string]bool
+
+	// mu protects the policies.
+	mu *sync.RWMutex
+
+	// loadMu makes sure only one load happens at a time, and protects the
+	// fields below.
+	loadMu *sync.Mutex
+
+	// HTTP client used to download zones, and the previous downloads, used
+	// for conditional requests.
+	client    *http.Client
+	downloads map[string]*rpzDownload
+
+	// Sources that failed to load the last time we tried, to retry them.
+	failed map[string]bool
+}
+
+// rpzDownload is a zone previously downloaded via HTTP.
+type rpzDownload struct {
+	etag         string
+	lastModified string
+	rrs          []dns.RR
+}
+
+// NewRPZResolver returns a new resolver which filters queries according to
+// the RPZ zones loaded from the given sources, and passes the rest to the
+// given resolver.
+// The sources can be zone files, http(s) URLs to download them from, or
+// "axfr://server[:port]/zone" to get the zone via a zone transfer.
+func NewRPZResolver(back Resolver, sources []string) *rpzResolver {
+	return &rpzResolver{
+		back:      back,
+		sources:   sources,
+		policy:    newRPZPolicy(),
+		mu:        &sync.RWMutex{},
+		loadMu:    &sync.Mutex{},
+		client:    &http.Client{Timeout: 1 * time.Minute},
+		downloads: map[string]*rpzDownload{},
+		failed:    map[string]bool{},
+		clock:     util.RealClock,
+	}
+}
+
+// SetRefreshInterval makes the resolver reload the zones periodically, with
+// the given interval. If a reload fails, the previous policy is kept.
+func (r *rpzResolver) SetRefreshInterval(d time.Duration) {
+	r.refresh = d
+}
+
+// SetSchedules makes the given sources active only during their schedules
+// (see ParseRPZSchedules). The sources not in the map are always active.
+func (r *rpzResolver) SetSchedules(schedules map[string]*Schedule) {
+	r.schedules = schedules
+}
+
+// ParseRPZSchedules parses a space-separated list of "source=schedule"
+// entries (see Schedule for the format), and returns the schedules by
+// source, as expected by SetSchedules.
+func ParseRPZSchedules(s string) (map[string]*Schedule, error) {
+	schedules := map[string]*Schedule{}
+	for _, entry := range strings.Fields(s) {
+		// Split on the last "=", as URLs can contain them too.
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("invalid entry %q (expected source=schedule)",
+				entry)
+		}
+		sched, err := ParseSchedule(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("schedule for %q: %v", entry[:i], err)
+		}
+		schedules[entry[:i]] = sched
+	}
+	return schedules, nil
+}
+
+// How often to check if the scheduled sources need to be enabled or
+// disabled, declared as a variable so we can tweak it for testing.
+var rpzScheduleCheckPeriod = 1 * time.Minute
+
+// How often to retry loading the sources that failed, declared as a variable
+// so we can tweak it for testing.
+var rpzRetryPeriod = 1 * time.Minute
+
+// errDropQuery is returned by resolvers to indicate that the query should be
+// dropped entirely, and not get any reply.
+var errDropQuery = errors.New("query dropped by policy")
+
+// Exported variables for statistics.
+var rpzStats = struct {
+	// Number of rules loaded.
+	rules *expvar.Int
+
+	// Number of rules loaded from each source.
+	sourceRules *expvar.Map
+
+	// Queries that matched a rule, by action.
+	matches *expvar.Map
+
+	// Time of the last successful load, as seconds since the epoch.
+	lastUpdate *expvar.Int
+
+	// Failed reloads.
+	updateErrors *expvar.Int
+}{}
+
+func init() {
+	rpzStats.rules = expvar.NewInt("rpz-rules")
+	rpzStats.sourceRules = expvar.NewMap("rpz-source-rules")
+	rpzStats.matches = expvar.NewMap("rpz-matches")
+	rpzStats.lastUpdate = expvar.NewInt("rpz-last-update")
+	rpzStats.updateErrors = expvar.NewInt("rpz-update-errors")
+}
+
+// The policy actions.
+type rpzAction int
+
+const (
+	rpzNXDomain = rpzAction(iota)
+	rpzNoData
+	rpzPassthru
+	rpzDrop
+	rpzLocalData
+)
+
+var rpzActionToString = map[rpzAction]string{
+	rpzNXDomain:  "NXDOMAIN",
+	rpzNoData:    "NODATA",
+	rpzPassthru:  "PASSTHRU",
+	rpzDrop:      "DROP",
+	rpzLocalData: "Local-Data",
+}
+
+func (a rpzAction) String() string {
+	return rpzActionToString[a]
+}
+
+// rpzRule is the policy for a single trigger name.
+type rpzRule struct {
+	action rpzAction
+
+	// Records to answer with, for Local-Data rules.
+	rrs []dns.RR
+
+	// SOA of the zone the rule came from, used for negative answers.
+	soa *dns.SOA
+}
+
+// rpzPolicy is a set of rules, indexed by trigger name.
+type rpzPolicy struct {
+	// Exact names, and wildcards (indexed without the leading "*.").
+	exact    map[string]*rpzRule
+	wildcard map[string]*rpzRule
+}
+
+func newRPZPolicy() *rpzPolicy {
+	return &rpzPolicy{
+		exact:    map[string]*rpzRule{},
+		wildcard: map[string]*rpzRule{},
+	}
+}
+
+func (p *rpzPolicy) len() int {
+	return len(p.exact) + len(p.wildcard)
+}
+
+// lookup the rule for the given name. Exact matches take precedence over
+// wildcards, and more specific wildcards take precedence over less specific
+// ones.
+func (p *rpzPolicy) lookup(name string) *rpzRule {
+	name = util.CanonicalName(name)
+	if rule, ok := p.exact[name]; ok {
+		return rule
+	}
+
+	// Wildcards only match strict subdomains.
+	for {
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+
+		if rule, ok := p.wildcard[name]; ok {
+			return rule
+		}
+	}
+}
+
+// merge the rules from q into p. Rules already present in p take
+// precedence.
+func (p *rpzPolicy) merge(q *rpzPolicy) {
+	for name, rule := range q.exact {
+		if _, ok := p.exact[name]; !ok {
+			p.exact[name] = rule
+		}
+	}
+	for name, rule := range q.wildcard {
+		if _, ok := p.wildcard[name]; !ok {
+			p.wildcard[name] = rule
+		}
+	}
+}
+
+// Trigger types we don't support; their rules are skipped.
+var rpzUnsupportedTriggers = []string{
+	".rpz-client-ip.", ".rpz-ip.", ".rpz-nsdname.", ".rpz-nsip.",
+}
+
+// newRPZZonePolicy builds the policy from the records of a single RPZ zone.
+// The zone must have a SOA record, which determines its origin.
+func newRPZZonePolicy(rrs []dns.RR) (*rpzPolicy, error) {
+	var soa *dns.SOA
+	for _, rr := range rrs {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+			break
+		}
+	}
+	if soa == nil {
+		return nil, fmt.Errorf("zone has no SOA")
+	}
+
+	origin := util.CanonicalName(soa.Hdr.Name)
+	p := newRPZPolicy()
+	unsupported := 0
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		owner := util.CanonicalName(hdr.Name)
+		if owner == origin || !strings.HasSuffix(owner, "."+origin) {
+			// Zone apex records (SOA, NS), or out of zone junk.
+			continue
+		}
+
+		trigger := owner[:len(owner)-len(origin)]
+		if hasAnySuffix(trigger, rpzUnsupportedTriggers) {
+			unsupported++
+			continue
+		}
+
+		index := p.exact
+		if strings.HasPrefix(trigger, "*.") {
+			index = p.wildcard
+			trigger = trigger[2:]
+		}
+
+		rule := &rpzRule{action: rpzLocalData, soa: soa}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				rule.action = rpzNXDomain
+			case "*.":
+				rule.action = rpzNoData
+			case "rpz-passthru.":
+				rule.action = rpzPassthru
+			case "rpz-drop.":
+				rule.action = rpzDrop
+			case "rpz-tcp-only.":
+				unsupported++
+				continue
+			}
+		}
+
+		if rule.action != rpzLocalData {
+			index[trigger] = rule
+			continue
+		}
+
+		// Local-Data: accumulate the records for the same trigger.
+		if prev, ok := index[trigger]; ok && prev.action == rpzLocalData {
+			rule = prev
+		}
+		rule.rrs = append(rule.rrs, rr)
+		index[trigger] = rule
+	}
+
+	if unsupported > 0 {
+		log.Infof("RPZ %s: skipped %d rules with unsupported triggers/actions",
+			origin, unsupported)
+	}
+
+	return p, nil
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadZones loads the zones from the given sources, and returns the
+// policies of all of them: for the ones that fail to load, we keep the
+// previous policy (if we had one), and return the error.
+// Must be called with loadMu held.
+func (r *rpzResolver) loadZones(sources []string) (map[string]*rpzPolicy, error) {
+	zones := map[string]*rpzPolicy{}
+	r.mu.RLock()
+	for source, p := range r.zones {
+		zones[source] = p
+	}
+	r.mu.RUnlock()
+
+	errs := []string{}
+	for _, source := range sources {
+		p, err := r.loadSourcePolicy(source)
+		if err != nil {
+			errs = append(errs,
+				fmt.Sprintf("error loading RPZ %q: %v", source, err))
+			r.failed[source] = true
+			continue
+		}
+
+		log.Infof("RPZ %q: loaded %d rules", source, p.len())
+		zones[source] = p
+		delete(r.failed, source)
+	}
+
+	for source, p := range zones {
+		v := &expvar.Int{}
+		v.Set(int64(p.len()))
+		rpzStats.sourceRules.Set(source, v)
+	}
+
+	if len(errs) > 0 {
+		return zones, errors.New(strings.Join(errs, "; "))
+	}
+	return zones, nil
+}
+
+// loadSourcePolicy loads the zone from the given source, and returns its
+// policy.
+func (r *rpzResolver) loadSourcePolicy(source string) (*rpzPolicy, error) {
+	rrs, err := r.loadZone(source)
+	if err != nil {
+		return nil, err
+	}
+	return newRPZZonePolicy(rrs)
+}
+
+// activeSources returns the sources that are active at the given time.
+func (r *rpzResolver) activeSources(now time.Time) map[string]bool {
+	active := map[string]bool{}
+	for _, source := range r.sources {
+		if sched, ok := r.schedules[source]; !ok || sched.Active(now) {
+			active[source] = true
+		}
+	}
+	return active
+}
+
+// merge the policies of the active zones, in order of precedence.
+func (r *rpzResolver) merge(zones map[string]*rpzPolicy, active map[string]bool) *rpzPolicy {
+	policy := newRPZPolicy()
+	for _, source := range r.sources {
+		if active[source] && zones[source] != nil {
+			policy.merge(zones[source])
+		}
+	}
+	return policy
+}
+
+// reload the zones from all the sources, and rebuild the policy. The zones
+// that fail to load keep their previous policy.
+func (r *rpzResolver) reload() error {
+	return r.load(r.sources)
+}
+
+// retryFailed loads the zones that failed to load the last time, if any.
+func (r *rpzResolver) retryFailed() {
+	r.loadMu.Lock()
+	failed := []string{}
+	for _, source := range r.sources {
+		if r.failed[source] {
+			failed = append(failed, source)
+		}
+	}
+	r.loadMu.Unlock()
+	if len(failed) == 0 {
+		return
+	}
+
+	if err := r.load(failed); err != nil {
+		log.Errorf("RPZ retry failed, will try again: %v", err)
+		return
+	}
+	log.Infof("RPZ: all sources loaded")
+}
+
+// load the zones from the given sources, and rebuild the policy.
+func (r *rpzResolver) load(sources []string) error {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+
+	tr := trace.New("dnsserver.RPZ", "reload")
+	defer tr.Finish()
+
+	zones, err := r.loadZones(sources)
+	if err != nil {
+		rpzStats.updateErrors.Add(1)
+		util.TraceErrorf(tr, "keeping the previous policy for them: %v", err)
+	}
+
+	active := r.activeSources(r.clock.Now())
+	policy := r.merge(zones, active)
+
+	r.mu.Lock()
+	r.zones = zones
+	r.active = active
+	r.policy = policy
+	r.mu.Unlock()
+
+	rpzStats.rules.Set(int64(policy.len()))
+	tr.LazyPrintf("loaded %d rules", policy.len())
+	if err != nil {
+		return err
+	}
+	rpzStats.lastUpdate.Set(r.clock.Now().Unix())
+	return nil
+}
+
+// applySchedules rebuilds the policy if the set of active sources has
+// changed since the last time.
+func (r *rpzResolver) applySchedules() {
+	active := r.activeSources(r.clock.Now())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reflect.DeepEqual(active, r.active) {
+		return
+	}
+
+	for _, source := range r.sources {
+		if active[source] != r.active[source] {
+			log.Infof("RPZ %q: schedule %q, active: %v",
+				source, r.schedules[source], active[source])
+		}
+	}
+	r.active = active
+	r.policy = r.merge(r.zones, active)
+	rpzStats.rules.Set(int64(r.policy.len()))
+}
+
+// loadZone loads the records of an RPZ zone from the given source.
+func (r *rpzResolver) loadZone(source string) ([]dns.RR, error) {
+	if strings.HasPrefix(source, "axfr://") {
+		return transferZone(source)
+	}
+	if strings.HasPrefix(source, "http://") ||
+		strings.HasPrefix(source, "https://") {
+		return r.download(source)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseZone(f, source)
+}
+
+// parseZone parses a zone in master file format. Names must be absolute, or
+// the zone must set $ORIGIN.
+func parseZone(r io.Reader, file string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, "", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	return rrs, zp.Err()
+}
+
+// Maximum size of the zones we download.
+const maxRPZDownloadSize = 256 * 1024 * 1024
+
+// download the zone from the given URL. If we have downloaded it before, we
+// use a conditional request so the server can avoid sending it again when it
+// has not changed.
+func (r *rpzResolver) download(source string) ([]dns.RR, error) {
+	req, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := r.downloads[source]
+	if prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		return prev.rrs, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status: %s", resp.Status)
+	}
+
+	rrs, err := parseZone(io.LimitReader(resp.Body, maxRPZDownloadSize), source)
+	if err != nil {
+		return nil, err
+	}
+
+	r.downloads[source] = &rpzDownload{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		rrs:          rrs,
+	}
+	return rrs, nil
+}
+
+// transferZone gets the records of a zone via AXFR, from a source of the
+// form "axfr://server[:port]/zone".
+func transferZone(source string) ([]dns.RR, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	server := u.Host
+	if u.Port() == "" {
+		server = net.JoinHostPort(u.Hostname(), "53")
+	}
+	zone := dns.Fqdn(strings.TrimPrefix(u.Path, "/"))
+
+	m := &dns.Msg{}
+	m.SetAxfr(zone)
+
+	t := &dns.Transfer{}
+	envs, err := t.In(m, server)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs, nil
+}
+
+// RegisterDebugHandlers registers http debug handlers, which can be accessed
+// from the monitoring server.
+// Note these are global by nature, if you try to register them multiple
+// times, you will get a panic.
+func (r *rpzResolver) RegisterDebugHandlers() {
+	http.HandleFunc("/debug/dnsserver/rpz", r.HandleStatus)
+}
+
+// HandleStatus shows the sources, and whether they're active.
+func (r *rpzResolver) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	fmt.Fprintf(w, "%d rules active\n\n", r.policy.len())
+	for _, source := range r.sources {
+		rules := 0
+		if p := r.zones[source]; p != nil {
+			rules = p.len()
+		}
+		schedule := "always"
+		if s, ok := r.schedules[source]; ok {
+			schedule = s.String()
+		}
+		fmt.Fprintf(w, "%s\n  %d rules, schedule: %s, active: %v\n\n",
+			source, rules, schedule, r.active[source])
+	}
+}
+
+func (r *rpzResolver) Init() error {
+	// A source we can't reach shouldn't keep us from serving: start with
+	// the ones that loaded, and retry the rest (see Maintain).
+	if err := r.reload(); err != nil {
+		log.Errorf("%v; starting without them, will retry", err)
+		webhook.Notify(webhook.BlocklistFailed, "",
+			"RPZ load failed, starting without them: %v", err)
+	}
+
+	return r.back.Init()
+}
+
+func (r *rpzResolver) Maintain() {
+	go r.back.Maintain()
+
+	if len(r.schedules) > 0 {
+		go r.clock.Every(rpzScheduleCheckPeriod, r.applySchedules)
+	}
+
+	// Retry the sources that failed to load (at startup, or on a reload),
+	// without waiting for the next refresh.
+	if r.refresh == 0 || r.refresh > rpzRetryPeriod {
+		go r.clock.Every(rpzRetryPeriod, r.retryFailed)
+	}
+
+	if r.refresh == 0 {
+		return
+	}
+
+	r.clock.Every(r.refresh, func() {
+		if err := r.reload(); err != nil {
+			log.Errorf("RPZ reload failed, keeping the previous policy"+
+				" for the failed sources: %v", err)
+			webhook.Notify(webhook.BlocklistFailed, "",
+				"RPZ reload failed, keeping the previous policy for the"+
+					" failed sources: %v", err)
+		}
+	})
+}
+
+func (r *rpzResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return r.back.Query(req, tr)
+	}
+	question := req.Question[0]
+
+	r.mu.RLock()
+	rule := r.policy.lookup(question.Name)
+	r.mu.RUnlock()
+
+	if rule == nil {
+		return r.back.Query(req, tr)
+	}
+	if blockingPaused() {
+		tr.LazyPrintf("rpz: %v, but the blocking is paused", rule.action)
+		return r.back.Query(req, tr)
+	}
+
+	tr.LazyPrintf("rpz: %v", rule.action)
+	rpzStats.matches.Add(rule.action.String(), 1)
+
+	switch rule.action {
+	case rpzPassthru:
+		return r.back.Query(req, tr)
+	case rpzDrop:
+		return nil, errDropQuery
+	case rpzNXDomain:
+		return rule.negativeReply(req, dns.RcodeNameError), nil
+	case rpzNoData:
+		return rule.negativeReply(req, dns.RcodeSuccess), nil
+	}
+
+	return r.localData(req, rule, tr)
+}
+
+// localData builds the reply for Local-Data rules.
+func (r *rpzResolver) localData(req *dns.Msg, rule *rpzRule, tr trace.Trace) (*dns.Msg, error) {
+	question := req.Question[0]
+
+	// A CNAME rewrites the query, so we resolve the target normally.
+	cname, isCNAME := rule.rrs[0].(*dns.CNAME)
+	if isCNAME && question.Qtype != dns.TypeCNAME {
+		target := &dns.Msg{}
+		target.SetQuestion(cname.Target, question.Qtype)
+		target.Id = req.Id
+		target.RecursionDesired = req.RecursionDesired
+
+		fromUp, err := r.back.Query(target, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := newReplyTo(req)
+		reply.Rcode = fromUp.Rcode
+		reply.Answer = append(
+			[]dns.RR{renameRR(cname, question.Name)}, fromUp.Answer...)
+		return reply, nil
+	}
+
+	reply := newReplyTo(req)
+	for _, rr := range rule.rrs {
+		if rr.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+			reply.Answer = append(reply.Answer, renameRR(rr, question.Name))
+		}
+	}
+
+	if len(reply.Answer) == 0 {
+		return rule.negativeReply(req, dns.RcodeSuccess), nil
+	}
+	return reply, nil
+}
+
+// negativeReply builds a negative reply with the given rcode, including the
+// zone's SOA in the authority section so clients can cache it.
+func (rule *rpzRule) negativeReply(req *dns.Msg, rcode int) *dns.Msg {
+	reply := newReplyTo(req)
+	reply.Rcode = rcode
+
+	soa := dns.Copy(rule.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	reply.Ns = []dns.RR{soa}
+
+	return reply
+}
+
+// newReplyTo returns a new, empty, reply to the given request.
+func newReplyTo(req *dns.Msg) *dns.Msg {
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	reply.RecursionAvailable = true
+	return reply
+}
+
+// renameRR returns a copy of the given RR, with the new name.
+// This is needed as the names in the zone are the triggers (which may be
+// wildcards), and the answer must match the question.
+func renameRR(rr dns.RR, name string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &rpzResolver{}
@@ -0,0 +1,399 @@
+package dnsserver
+
+// Tests for the RPZ resolver.
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+const testRPZ = `
+$ORIGIN rpz.test.
+$TTL 300
+@		SOA	ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60
+@		NS	ns.rpz.test.
+
+nx.example		CNAME	.
+*.nx.example		CNAME	.
+nodata.example		CNAME	*.
+drop.example		CNAME	rpz-drop.
+*.wild.example		CNAME	.
+pass.wild.example	CNAME	rpz-passthru.
+local.example		A	10.0.0.1
+local.example		A	10.0.0.2
+local.example		TXT	"local"
+cname.example		CNAME	other.example.
+24.0.0.0.10.rpz-ip	CNAME	.
+`
+
+func newTestRPZ(t *testing.T) (*rpzResolver, *testutil.TestResolver) {
+	rrs, err := parseZone(strings.NewReader(testRPZ), "test")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+
+	policy, err := newRPZZonePolicy(rrs)
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	back := testutil.NewTestResolver()
+	r := NewRPZResolver(back, nil)
+	r.policy = policy
+	return r, back
+}
+
+func rpzQuery(t *testing.T, r *rpzResolver, name string, qtype uint16) (*dns.Msg, error) {
+	tr := testutil.NewTestTrace(t)
+	defer tr.Finish()
+	return r.Query(newQuery(name, qtype), tr)
+}
+
+func TestRPZActions(t *testing.T) {
+	r, back := newTestRPZ(t)
+	back.Response = newReply(mustNewRR(t, "upstream. A 1.2.3.4"))
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer int
+		soa    bool
+		passed bool
+	}{
+		{"nx.example.", dns.TypeA, dns.RcodeNameError, 0, true, false},
+		{"sub.nx.example.", dns.TypeA, dns.RcodeNameError, 0, true, false},
+		{"nodata.example.", dns.TypeA, dns.RcodeSuccess, 0, true, false},
+		{"a.wild.example.", dns.TypeA, dns.RcodeNameError, 0, true, false},
+		{"pass.wild.example.", dns.TypeA, dns.RcodeSuccess, 1, false, true},
+		{"local.example.", dns.TypeA, dns.RcodeSuccess, 2, false, false},
+		{"local.example.", dns.TypeTXT, dns.RcodeSuccess, 1, false, false},
+		{"local.example.", dns.TypeMX, dns.RcodeSuccess, 0, true, false},
+		{"other.test.", dns.TypeA, dns.RcodeSuccess, 1, false, true},
+
+		// Wildcards don't match the name itself.
+		{"wild.example.", dns.TypeA, dns.RcodeSuccess, 1, false, true},
+
+		// Matching is case-insensitive.
+		{"NX.Example.", dns.TypeA, dns.RcodeNameError, 0, true, false},
+
+		// The rpz-ip trigger is not supported, so it shouldn't be loaded.
+		{"24.0.0.0.10.rpz-ip.", dns.TypeA, dns.RcodeSuccess, 1, false, true},
+	}
+
+	for _, c := range cases {
+		back.LastQuery = nil
+		resp, err := rpzQuery(t, r, c.name, c.qtype)
+		if err != nil {
+			t.Errorf("%s: query failed: %v", c.name, err)
+			continue
+		}
+
+		if resp.Rcode != c.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", c.name, c.rcode, resp.Rcode)
+		}
+		if len(resp.Answer) != c.answer {
+			t.Errorf("%s: expected %d answers, got %v",
+				c.name, c.answer, resp.Answer)
+		}
+		if hasSOA := len(resp.Ns) == 1; hasSOA != c.soa {
+			t.Errorf("%s: expected SOA %v, got %v", c.name, c.soa, resp.Ns)
+		}
+		if passed := back.LastQuery != nil; passed != c.passed {
+			t.Errorf("%s: expected passthrough %v, got %v",
+				c.name, c.passed, passed)
+		}
+		for _, rr := range resp.Answer {
+			if rr.Header().Name != c.name && !c.passed {
+				t.Errorf("%s: answer does not match the question: %v",
+					c.name, rr)
+			}
+		}
+	}
+}
+
+func TestRPZNegativeTTL(t *testing.T) {
+	r, _ := newTestRPZ(t)
+
+	resp, err := rpzQuery(t, r, "nx.example.", dns.TypeA)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	// The SOA TTL is capped to the SOA minimum.
+	if ttl := resp.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("expected SOA TTL 60, got %d", ttl)
+	}
+}
+
+func TestRPZDrop(t *testing.T) {
+	r, _ := newTestRPZ(t)
+
+	_, err := rpzQuery(t, r, "drop.example.", dns.TypeA)
+	if err != errDropQuery {
+		t.Errorf("expected errDropQuery, got %v", err)
+	}
+}
+
+func TestRPZCNAME(t *testing.T) {
+	r, back := newTestRPZ(t)
+	back.Response = newReply(mustNewRR(t, "other.example. A 1.2.3.4"))
+
+	resp, err := rpzQuery(t, r, "cname.example.", dns.TypeA)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	if back.LastQuery.Question[0].Name != "other.example." {
+		t.Errorf("expected query for the CNAME target, got %v",
+			back.LastQuery.Question)
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatalf("expected CNAME + A, got %v", resp.Answer)
+	}
+	if c, ok := resp.Answer[0].(*dns.CNAME); !ok || c.Hdr.Name != "cname.example." {
+		t.Errorf("expected CNAME first, got %v", resp.Answer[0])
+	}
+}
+
+func TestRPZLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnss_rpz_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testRPZ)
+	f.Close()
+
+	// Load it twice, to check merging does not duplicate rules.
+	back := testutil.NewTestResolver()
+	r := NewRPZResolver(back, []string{f.Name(), f.Name()})
+	zones, err := r.loadZones(r.sources)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	policy := r.merge(zones, r.activeSources(time.Now()))
+	if policy.len() != 8 {
+		t.Errorf("expected 8 rules, got %d", policy.len())
+	}
+
+	missing := NewRPZResolver(back, []string{"/doesnotexist"})
+	_, err = missing.loadZones(missing.sources)
+	if err == nil {
+		t.Errorf("loading a missing file worked")
+	}
+
+	// Zones must have a SOA.
+	_, err = newRPZZonePolicy(nil)
+	if err == nil {
+		t.Errorf("loading a zone without SOA worked")
+	}
+}
+
+// scheduledZone returns the policy of an RPZ zone giving NXDOMAIN for the
+// given names.
+func scheduledZone(t *testing.T, origin string, names ...string) *rpzPolicy {
+	t.Helper()
+	rrs := []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: 300},
+		Ns: "ns." + origin, Mbox: "admin." + origin, Minttl: 60,
+	}}
+	for _, name := range names {
+		rrs = append(rrs, &dns.CNAME{
+			Hdr: dns.RR_Header{Name: name + "." + origin,
+				Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: ".",
+		})
+	}
+	p, err := newRPZZonePolicy(rrs)
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+	return p
+}
+
+func TestRPZSchedules(t *testing.T) {
+	schedules, err := ParseRPZSchedules(
+		"social.rpz=mon-fri/09:00-17:00 https://x.example/z?a=b=22:00-07:00")
+	if err != nil {
+		t.Fatalf("error parsing schedules: %v", err)
+	}
+	if len(schedules) != 2 || schedules["https://x.example/z?a=b"] == nil {
+		t.Errorf("unexpected schedules: %v", schedules)
+	}
+	for _, s := range []string{"social.rpz", "social.rpz=", "=mon",
+		"social.rpz=funday"} {
+		if _, err := ParseRPZSchedules(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "upstream. A 1.2.3.4"))
+	r := NewRPZResolver(back, []string{"social.rpz", "ads.rpz"})
+	delete(schedules, "https://x.example/z?a=b")
+	r.SetSchedules(schedules)
+
+	// Monday, before work.
+	clock := testutil.NewFakeClock(time.Date(2026, 10, 12, 8, 0, 0, 0, time.Local))
+	r.clock = clock
+	r.zones = map[string]*rpzPolicy{
+		"social.rpz": scheduledZone(t, "social.rpz.", "social.example"),
+		"ads.rpz":    scheduledZone(t, "ads.rpz.", "ads.example"),
+	}
+	r.applySchedules()
+
+	go r.Maintain()
+	<-back.MaintainC
+	// The schedules, and the retries of the failed sources.
+	clock.WaitForTasks(2)
+
+	blocked := func(name string) bool {
+		t.Helper()
+		reply, err := rpzQuery(t, r, name, dns.TypeA)
+		if err != nil {
+			t.Fatalf("%s: query error: %v", name, err)
+		}
+		return reply.Rcode == dns.RcodeNameError
+	}
+	if blocked("social.example.") || !blocked("ads.example.") {
+		t.Errorf("8:00: unexpected policy")
+	}
+
+	clock.Advance(1 * time.Hour)
+	if !blocked("social.example.") || !blocked("ads.example.") {
+		t.Errorf("9:00: unexpected policy")
+	}
+
+	clock.Advance(8 * time.Hour)
+	if blocked("social.example.") || !blocked("ads.example.") {
+		t.Errorf("17:00: unexpected policy")
+	}
+}
+
+func TestRPZInitUnreachable(t *testing.T) {
+	var mu sync.Mutex
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if fail {
+				http.Error(w, "failing for testing", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(testRPZ))
+		}))
+	defer srv.Close()
+
+	// We start anyway, without the rules.
+	back := testutil.NewTestResolver()
+	r := NewRPZResolver(back, []string{srv.URL})
+	if err := r.Init(); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	if r.policy.len() != 0 || !r.failed[srv.URL] {
+		t.Errorf("unexpected state: %d rules, failed %v",
+			r.policy.len(), r.failed)
+	}
+
+	// Retrying while it's still failing changes nothing.
+	r.retryFailed()
+	if r.policy.len() != 0 {
+		t.Errorf("expected no rules, got %d", r.policy.len())
+	}
+
+	// Once it works, the retry loads it.
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	r.retryFailed()
+	if r.policy.len() != 8 || len(r.failed) != 0 {
+		t.Errorf("unexpected state: %d rules, failed %v",
+			r.policy.len(), r.failed)
+	}
+}
+
+func TestRPZDownload(t *testing.T) {
+	var mu sync.Mutex
+	zone := testRPZ
+	fail := false
+	conditional := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if fail {
+				http.Error(w, "failing for testing", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				conditional++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte(zone))
+		}))
+	defer srv.Close()
+
+	back := testutil.NewTestResolver()
+	r := NewRPZResolver(back, []string{srv.URL})
+	if err := r.Init(); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	if r.policy.len() != 8 {
+		t.Errorf("expected 8 rules, got %d", r.policy.len())
+	}
+
+	// Reload: we should do a conditional request, and keep the same rules.
+	if err := r.reload(); err != nil {
+		t.Errorf("failed to reload: %v", err)
+	}
+	mu.Lock()
+	if conditional != 1 {
+		t.Errorf("expected 1 conditional request, got %d", conditional)
+	}
+	mu.Unlock()
+	if r.policy.len() != 8 {
+		t.Errorf("expected 8 rules, got %d", r.policy.len())
+	}
+
+	// Make the server fail, the old policy must be kept.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	if err := r.reload(); err == nil {
+		t.Errorf("reload worked, but the server is failing")
+	}
+	if r.policy.len() != 8 {
+		t.Errorf("expected 8 rules, got %d", r.policy.len())
+	}
+
+	// Serve an invalid zone, the old policy must be kept too.
+	mu.Lock()
+	fail = false
+	zone = "this is not a valid zone"
+	r.downloads = map[string]*rpzDownload{}
+	mu.Unlock()
+	if err := r.reload(); err == nil {
+		t.Errorf("reload worked, but the zone is invalid")
+	}
+	if r.policy.len() != 8 {
+		t.Errorf("expected 8 rules, got %d", r.policy.len())
+	}
+}
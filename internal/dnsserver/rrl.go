@@ -0,0 +1,171 @@
+package dnsserver
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/dnss/internal/webhook"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Response rate limiting (RRL).
+
+// rateLimiter limits the rate of the UDP responses to each client netblock,
+// so we can't be used effectively as an amplification reflector (with
+// spoofed source addresses) if we are accidentally exposed to the internet.
+//
+// It works like the classic RRL in authoritative servers: each netblock has
+// a budget of responses per second (a token bucket, with up to a second
+// worth of burst). Once it's exhausted, queries are dropped, except one
+// every "slip" of them, which gets an empty truncated reply instead: that's
+// too small to be useful for an attack, but lets legitimate clients retry
+// over TCP.
+type rateLimiter struct {
+	// Responses per second allowed for each netblock.
+	rate int
+
+	// Send a truncated reply to one in every this many limited queries (0
+	// to drop them all).
+	slip int
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	mu      *sync.Mutex
+	buckets map[string]*rrlBucket
+}
+
+// rrlBucket is the token bucket of a netblock.
+type rrlBucket struct {
+	tokens float64
+	last   time.Time
+
+	// Number of limited queries, to decide when to slip.
+	limited int
+}
+
+// Constants that tune the rate limiting, declared as variables so we can
+// tweak them for testing.
+var (
+	// Size of the netblocks the clients are grouped in. Spoofed traffic
+	// usually comes from a single address, but this helps against the
+	// attacker spreading it over a network.
+	rrlIPv4Prefix = 24
+	rrlIPv6Prefix = 56
+
+	// How often to remove the buckets of the netblocks which are not
+	// limited anymore.
+	rrlGCPeriod = 1 * time.Minute
+)
+
+// rrlAction is what to do with a query, as decided by the rate limiter.
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// Exported variables for statistics.
+var rrlStats = struct {
+	// Queries dropped because of the rate limiting.
+	dropped *expvar.Int
+
+	// Queries answered with a truncated reply because of the rate limiting.
+	slipped *expvar.Int
+}{}
+
+func init() {
+	rrlStats.dropped = expvar.NewInt("rrl-dropped")
+	rrlStats.slipped = expvar.NewInt("rrl-slipped")
+}
+
+func newRateLimiter(rate, slip int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		slip:    slip,
+		clock:   util.RealClock,
+		mu:      &sync.Mutex{},
+		buckets: map[string]*rrlBucket{},
+	}
+}
+
+// netblock returns the key for the netblock of the given address.
+func netblock(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return addr.String()
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rrlIPv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(rrlIPv6Prefix, 128)).String()
+}
+
+// check a query from the given address, and decide what to do with it.
+func (l *rateLimiter) check(addr net.Addr) rrlAction {
+	key := netblock(addr)
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rrlBucket{tokens: float64(l.rate), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, l.rate)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return rrlAllow
+	}
+
+	b.limited++
+	if b.limited == 1 {
+		webhook.Notify(webhook.RateLimited, key,
+			"rate limit triggered for netblock %s", key)
+	}
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		rrlStats.slipped.Add(1)
+		return rrlSlip
+	}
+	rrlStats.dropped.Add(1)
+	return rrlDrop
+}
+
+// refill the bucket according to the time passed since the last refill.
+func (b *rrlBucket) refill(now time.Time, rate int) {
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+}
+
+// gc removes the buckets which are full, as they are the same as new ones.
+func (l *rateLimiter) gc() {
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		b.refill(now, l.rate)
+		if b.tokens >= float64(l.rate) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// maintain the rate limiter, removing unused buckets periodically. It never
+// returns.
+func (l *rateLimiter) maintain() {
+	l.clock.Every(rrlGCPeriod, l.gc)
+}
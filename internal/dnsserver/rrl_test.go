@@ -0,0 +1,91 @@
+package dnsserver
+
+// Tests for the response rate limiting.
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+)
+
+func udpAddr(s string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(s), Port: 5353}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newRateLimiter(5, 2)
+	l.clock = clock
+
+	checkN := func(addr string, n int) map[rrlAction]int {
+		actions := map[rrlAction]int{}
+		for i := 0; i < n; i++ {
+			actions[l.check(udpAddr(addr))]++
+		}
+		return actions
+	}
+
+	// The first 5 are allowed, then half are dropped and half slip.
+	got := checkN("1.2.3.4", 15)
+	if got[rrlAllow] != 5 || got[rrlDrop] != 5 || got[rrlSlip] != 5 {
+		t.Errorf("unexpected actions: %v", got)
+	}
+
+	// The same netblock shares the budget; others don't.
+	if a := l.check(udpAddr("1.2.3.99")); a == rrlAllow {
+		t.Errorf("query from the same netblock allowed")
+	}
+	if a := l.check(udpAddr("1.2.4.4")); a != rrlAllow {
+		t.Errorf("query from another netblock limited: %v", a)
+	}
+	if a := l.check(udpAddr("2001:db8:1:ff::1")); a != rrlAllow {
+		t.Errorf("IPv6 query limited: %v", a)
+	}
+	if a := l.check(udpAddr("2001:db8:1:ff::2")); a != rrlAllow {
+		t.Errorf("IPv6 query from the same netblock limited: %v", a)
+	}
+
+	// After some time, the budget is refilled at the given rate.
+	clock.Advance(400 * time.Millisecond)
+	got = checkN("1.2.3.4", 3)
+	if got[rrlAllow] != 2 {
+		t.Errorf("after 400ms, expected 2 allowed, got %v", got)
+	}
+
+	// The burst is limited to one second's worth.
+	clock.Advance(time.Hour)
+	got = checkN("1.2.3.4", 10)
+	if got[rrlAllow] != 5 {
+		t.Errorf("after an hour, expected 5 allowed, got %v", got)
+	}
+
+	// With slip 0, all limited queries are dropped.
+	l.slip = 0
+	got = checkN("1.2.3.4", 4)
+	if got[rrlDrop] != 4 {
+		t.Errorf("with slip 0, expected all dropped, got %v", got)
+	}
+
+	// Full buckets are garbage collected, the others are kept.
+	clock.Advance(time.Hour)
+	l.check(udpAddr("1.2.3.4"))
+	l.gc()
+	if len(l.buckets) != 1 {
+		t.Errorf("expected 1 bucket after gc, got %v", l.buckets)
+	}
+}
+
+func TestNetblock(t *testing.T) {
+	cases := []struct{ addr, block string }{
+		{"1.2.3.4", "1.2.3.0"},
+		{"::ffff:1.2.3.4", "1.2.3.0"},
+		{"2001:db8:1:2ff::1", "2001:db8:1:200::"},
+	}
+	for _, c := range cases {
+		if got := netblock(udpAddr(c.addr)); got != c.block {
+			t.Errorf("netblock(%q) = %q, expected %q", c.addr, got, c.block)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Sanitizing resolver.
+
+// sanitizingResolver implements a Resolver which cleans up the replies from
+// its backing resolver, to protect clients (and our cache) from misbehaving
+// or malicious upstreams.
+//
+// It drops answers which are not related to the question (the classic cache
+// poisoning attempt), removes duplicate records, and limits the number of
+// answers. Replies over the limit are marked as truncated, so clients know
+// they're partial, and they're not cached.
+type sanitizingResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Maximum number of answers in a reply (0 means no limit).
+	maxAnswers int
+}
+
+// NewSanitizingResolver returns a new resolver which sanitizes the replies
+// from the given one. Replies are limited to maxAnswers answers, unless it's
+// 0.
+func NewSanitizingResolver(back Resolver, maxAnswers int) *sanitizingResolver {
+	return &sanitizingResolver{
+		back:       back,
+		maxAnswers: maxAnswers,
+	}
+}
+
+// Exported variables for statistics.
+var sanitizeStats = struct {
+	// Answers dropped because they were not related to the question.
+	unrelated *expvar.Int
+
+	// Duplicate answers removed.
+	duplicates *expvar.Int
+
+	// Replies which had too many answers.
+	clamped *expvar.Int
+}{}
+
+func init() {
+	sanitizeStats.unrelated = expvar.NewInt("sanitize-unrelated-rrs")
+	sanitizeStats.duplicates = expvar.NewInt("sanitize-duplicate-rrs")
+	sanitizeStats.clamped = expvar.NewInt("sanitize-clamped-replies")
+}
+
+func (s *sanitizingResolver) Init() error {
+	return s.back.Init()
+}
+
+func (s *sanitizingResolver) Maintain() {
+	s.back.Maintain()
+}
+
+func (s *sanitizingResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	reply, err := s.back.Query(r, tr)
+	if err != nil || reply == nil || len(r.Question) != 1 {
+		return reply, err
+	}
+
+	s.sanitize(r.Question[0], reply, tr)
+	return reply, nil
+}
+
+// sanitize the reply to the given question, in place.
+func (s *sanitizingResolver) sanitize(q dns.Question, reply *dns.Msg, tr trace.Trace) {
+	// Names we consider part of the answer: the question, and the targets
+	// of the CNAMEs in the chain starting from it. We don't rely on the
+	// records being in order.
+	related := map[string]bool{strings.ToLower(q.Name): true}
+	for changed := true; changed; {
+		changed = false
+		for _, rr := range reply.Answer {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !related[strings.ToLower(cname.Hdr.Name)] {
+				continue
+			}
+			target := strings.ToLower(cname.Target)
+			if !related[target] {
+				related[target] = true
+				changed = true
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	answer := make([]dns.RR, 0, len(reply.Answer))
+	for _, rr := range reply.Answer {
+		if !isRelated(rr, q.Name, related) {
+			sanitizeStats.unrelated.Add(1)
+			tr.LazyPrintf("sanitize: dropping unrelated answer: %v", rr)
+			continue
+		}
+
+		key := rrKey(rr)
+		if seen[key] {
+			sanitizeStats.duplicates.Add(1)
+			tr.LazyPrintf("sanitize: dropping duplicate answer: %v", rr)
+			continue
+		}
+		seen[key] = true
+
+		answer = append(answer, rr)
+	}
+
+	if s.maxAnswers > 0 && len(answer) > s.maxAnswers {
+		sanitizeStats.clamped.Add(1)
+		tr.LazyPrintf("sanitize: clamping %d answers to %d",
+			len(answer), s.maxAnswers)
+		answer = answer[:s.maxAnswers]
+		reply.Truncated = true
+	}
+
+	reply.Answer = answer
+}
+
+// isRelated returns true if the given record is related to the question.
+func isRelated(rr dns.RR, qname string, related map[string]bool) bool {
+	if related[strings.ToLower(rr.Header().Name)] {
+		return true
+	}
+
+	// DNAMEs are related if the question is under the DNAME owner.
+	if _, ok := rr.(*dns.DNAME); ok {
+		return dns.IsSubDomain(rr.Header().Name, qname)
+	}
+
+	return false
+}
+
+// rrKey returns a string that identifies the record, ignoring the TTL and
+// the case of the name, so we can detect duplicates.
+func rrKey(rr dns.RR) string {
+	hdr := rr.Header()
+	data := rr.String()[len(hdr.String()):]
+	return fmt.Sprintf("%s %d %s", strings.ToLower(hdr.Name), hdr.Rrtype, data)
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &sanitizingResolver{}
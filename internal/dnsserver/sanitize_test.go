@@ -0,0 +1,158 @@
+package dnsserver
+
+// Tests for the sanitizing resolver.
+
+import (
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestSanitize(t *testing.T) {
+	cases := []struct {
+		answers   []string
+		expected  []string
+		truncated bool
+	}{
+		// Nothing to do.
+		{
+			[]string{"test. A 1.1.1.1", "test. A 2.2.2.2"},
+			[]string{"test. A 1.1.1.1", "test. A 2.2.2.2"},
+			false,
+		},
+
+		// Unrelated records are dropped, regardless of position.
+		{
+			[]string{"evil. A 6.6.6.6", "test. A 1.1.1.1", "x.test. A 6.6.6.6"},
+			[]string{"test. A 1.1.1.1"},
+			false,
+		},
+
+		// CNAME chains are kept, even if they're out of order.
+		{
+			[]string{
+				"b.test. A 1.1.1.1",
+				"a.test. CNAME b.test.",
+				"test. CNAME a.test.",
+				"evil. A 6.6.6.6",
+			},
+			[]string{
+				"b.test. A 1.1.1.1",
+				"a.test. CNAME b.test.",
+				"test. CNAME a.test.",
+			},
+			false,
+		},
+
+		// Names are compared case-insensitively.
+		{
+			[]string{"TeSt. CNAME Other.", "other. A 1.1.1.1"},
+			[]string{"TeSt. CNAME Other.", "other. A 1.1.1.1"},
+			false,
+		},
+
+		// DNAMEs are dropped if the question is not under them.
+		{
+			[]string{"dname. DNAME target.", "other. DNAME target."},
+			[]string{},
+			false,
+		},
+
+		// Duplicates are removed, even if they have different TTLs.
+		{
+			[]string{
+				"test. 300 A 1.1.1.1",
+				"test. 200 A 1.1.1.1",
+				"TEST. 300 A 1.1.1.1",
+				"test. A 2.2.2.2",
+			},
+			[]string{"test. 300 A 1.1.1.1", "test. A 2.2.2.2"},
+			false,
+		},
+
+		// Replies with too many answers are clamped, and marked as truncated.
+		{
+			[]string{
+				"test. A 1.1.1.1", "test. A 1.1.1.2", "test. A 1.1.1.3",
+				"test. A 1.1.1.4", "test. A 1.1.1.5",
+			},
+			[]string{
+				"test. A 1.1.1.1", "test. A 1.1.1.2", "test. A 1.1.1.3",
+				"test. A 1.1.1.4",
+			},
+			true,
+		},
+	}
+
+	s := NewSanitizingResolver(testutil.NewTestResolver(), 4)
+	tr := testutil.NewTestTrace(t)
+	q := dns.Question{Name: "test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	for _, c := range cases {
+		reply := &dns.Msg{}
+		for _, a := range c.answers {
+			reply.Answer = append(reply.Answer, mustNewRR(t, a))
+		}
+
+		s.sanitize(q, reply, tr)
+
+		if reply.Truncated != c.truncated {
+			t.Errorf("%v: expected truncated %v, got %v",
+				c.answers, c.truncated, reply.Truncated)
+		}
+
+		if len(reply.Answer) != len(c.expected) {
+			t.Errorf("%v: expected %v, got %v", c.answers, c.expected, reply.Answer)
+			continue
+		}
+		for i, e := range c.expected {
+			if rrKey(reply.Answer[i]) != rrKey(mustNewRR(t, e)) {
+				t.Errorf("%v: expected %v, got %v",
+					c.answers, c.expected, reply.Answer)
+				break
+			}
+		}
+	}
+}
+
+func TestSanitizeDNAME(t *testing.T) {
+	s := NewSanitizingResolver(testutil.NewTestResolver(), 0)
+	tr := testutil.NewTestTrace(t)
+	q := dns.Question{Name: "a.dname.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	reply := &dns.Msg{
+		Answer: []dns.RR{
+			mustNewRR(t, "dname. DNAME target."),
+			mustNewRR(t, "a.dname. CNAME a.target."),
+			mustNewRR(t, "a.target. A 1.1.1.1"),
+			mustNewRR(t, "other. DNAME target."),
+		},
+	}
+	s.sanitize(q, reply, tr)
+
+	if len(reply.Answer) != 3 {
+		t.Errorf("expected DNAME, CNAME and A, got %v", reply.Answer)
+	}
+}
+
+func TestSanitizeQuery(t *testing.T) {
+	r := testutil.NewTestResolver()
+	r.Response = &dns.Msg{
+		Answer: []dns.RR{
+			mustNewRR(t, "test. A 1.1.1.1"),
+			mustNewRR(t, "evil. A 6.6.6.6"),
+		},
+	}
+	s := NewSanitizingResolver(r, 0)
+
+	tr := testutil.NewTestTrace(t)
+	resp, err := s.Query(newQuery("test.", dns.TypeA), tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("expected only the related answer, got %v", resp.Answer)
+	}
+}
@@ -0,0 +1,129 @@
+package dnsserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a set of weekly periods, like "weekdays from 9 to 17".
+//
+// It's written as a ";"-separated list of periods, each one "days/times",
+// where days is a ","-separated list of days or day ranges (like "mon-fri"
+// or "sat,sun"), and times is a time range (like "09:00-17:00", which can wrap
+// around midnight, as in "22:00-07:00"). Either part can be missing, to mean
+// every day, or all day. For example: "mon-fri/09:00-17:00;sat/10:00-12:00".
+type Schedule struct {
+	// The original text, for display.
+	text string
+
+	periods []schedulePeriod
+}
+
+type schedulePeriod struct {
+	days [7]bool
+
+	// Minutes since midnight; from == to means all day.
+	from, to int
+}
+
+// ParseSchedule parses a schedule (see Schedule for the format).
+func ParseSchedule(s string) (*Schedule, error) {
+	sched := &Schedule{text: s}
+	for _, ps := range strings.Split(s, ";") {
+		p, err := parseSchedulePeriod(ps)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", ps, err)
+		}
+		sched.periods = append(sched.periods, p)
+	}
+	return sched, nil
+}
+
+func parseSchedulePeriod(s string) (schedulePeriod, error) {
+	p := schedulePeriod{}
+	days, times := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		days, times = s[:i], s[i+1:]
+	} else if strings.Contains(s, ":") {
+		days, times = "", s
+	}
+	if days == "" && times == "" {
+		return p, fmt.Errorf("empty period")
+	}
+
+	if days == "" {
+		days = "sun-sat"
+	}
+	for _, d := range strings.Split(days, ",") {
+		sp := strings.SplitN(d, "-", 2)
+		first, ok := policyWeekdays[strings.ToLower(sp[0])]
+		if !ok {
+			return p, fmt.Errorf("unknown day %q", sp[0])
+		}
+		last := first
+		if len(sp) == 2 {
+			last, ok = policyWeekdays[strings.ToLower(sp[1])]
+			if !ok {
+				return p, fmt.Errorf("unknown day %q", sp[1])
+			}
+		}
+		for wd := first; ; wd = (wd + 1) % 7 {
+			p.days[wd] = true
+			if wd == last {
+				break
+			}
+		}
+	}
+
+	if times != "" {
+		sp := strings.SplitN(times, "-", 2)
+		if len(sp) != 2 {
+			return p, fmt.Errorf("invalid time range %q", times)
+		}
+		var err error
+		if p.from, err = parseTimeOfDay(sp[0]); err != nil {
+			return p, err
+		}
+		if p.to, err = parseTimeOfDay(sp[1]); err != nil {
+			return p, err
+		}
+		if p.from == p.to {
+			return p, fmt.Errorf("empty time range %q", times)
+		}
+	}
+	return p, nil
+}
+
+// Active returns true if the given time is within the schedule. The time
+// is taken in its own location.
+func (s *Schedule) Active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	wd := t.Weekday()
+	for _, p := range s.periods {
+		switch {
+		case p.from == p.to:
+			if p.days[wd] {
+				return true
+			}
+		case p.from < p.to:
+			if p.days[wd] && p.from <= m && m < p.to {
+				return true
+			}
+		default:
+			// The range wraps around midnight: the part after it belongs
+			// to the day the period started.
+			if p.days[wd] && m >= p.from {
+				return true
+			}
+			if p.days[(wd+6)%7] && m < p.to {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Schedule) String() string {
+	return s.text
+}
@@ -0,0 +1,60 @@
+package dnsserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2026-10-12 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, 12+day, hour, minute, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		schedule string
+		active   []time.Time
+		inactive []time.Time
+	}{
+		{"mon-fri/09:00-17:00",
+			[]time.Time{at(0, 9, 0), at(4, 16, 59)},
+			[]time.Time{at(0, 8, 59), at(0, 17, 0), at(5, 12, 0)}},
+		{"sat,sun",
+			[]time.Time{at(5, 0, 0), at(6, 23, 59)},
+			[]time.Time{at(0, 12, 0), at(7, 0, 0)}},
+		{"22:00-07:00",
+			[]time.Time{at(0, 22, 0), at(1, 6, 59), at(0, 0, 0)},
+			[]time.Time{at(0, 7, 0), at(0, 21, 59)}},
+		// Sunday night to Monday morning, but not Saturday night.
+		{"sun/22:00-07:00;Sat/10:00-12:00",
+			[]time.Time{at(6, 23, 0), at(7, 6, 0), at(5, 11, 0)},
+			[]time.Time{at(5, 23, 0), at(6, 6, 0), at(0, 23, 0)}},
+		{"fri-mon/12:00-13:00",
+			[]time.Time{at(4, 12, 0), at(6, 12, 30), at(0, 12, 59)},
+			[]time.Time{at(1, 12, 0), at(3, 12, 0)}},
+	}
+	for _, c := range cases {
+		s, err := ParseSchedule(c.schedule)
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", c.schedule, err)
+			continue
+		}
+		for _, tm := range c.active {
+			if !s.Active(tm) {
+				t.Errorf("%q: not active at %v", c.schedule, tm)
+			}
+		}
+		for _, tm := range c.inactive {
+			if s.Active(tm) {
+				t.Errorf("%q: active at %v", c.schedule, tm)
+			}
+		}
+	}
+
+	for _, s := range []string{"", "mon;", "funday", "mon-funday",
+		"mon/09:00", "mon/09:00-25:00", "mon/09:00-09:00", "/"} {
+		if _, err := ParseSchedule(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package dnsserver
+
+import (
+	"expvar"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Search domains resolver.
+
+// searchResolver implements a Resolver which expands single-label queries
+// (like "nas.") with a list of search domains, like stub resolvers do with
+// the "search" option in resolv.conf.
+//
+// This is useful when dnss replaces a router's DNS server in a home network,
+// as the router would usually resolve the names of the local hosts.
+type searchResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Domains to try, in order, fully qualified.
+	domains []string
+}
+
+// NewSearchResolver returns a new resolver which expands single-label
+// queries with the given search domains, and uses back to resolve them.
+func NewSearchResolver(back Resolver, domains []string) *searchResolver {
+	s := &searchResolver{back: back}
+	for _, d := range domains {
+		s.domains = append(s.domains, util.CanonicalName(d))
+	}
+	return s
+}
+
+// Exported variables for statistics.
+var searchStats = struct {
+	// Queries that got an answer after being expanded.
+	expanded *expvar.Int
+}{}
+
+func init() {
+	searchStats.expanded = expvar.NewInt("search-expanded-queries")
+}
+
+func (s *searchResolver) Init() error {
+	return s.back.Init()
+}
+
+func (s *searchResolver) Maintain() {
+	s.back.Maintain()
+}
+
+func (s *searchResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 || !isSingleLabel(r.Question[0].Name) {
+		return s.back.Query(r, tr)
+	}
+
+	question := r.Question[0]
+	for _, d := range s.domains {
+		name := question.Name + d
+
+		q := r.Copy()
+		q.Question[0].Name = name
+		fromUp, err := s.back.Query(q, tr)
+		if err != nil || fromUp.Rcode != dns.RcodeSuccess ||
+			len(fromUp.Answer) == 0 {
+			tr.LazyPrintf("search: no answer for %q", name)
+			continue
+		}
+
+		tr.LazyPrintf("search: expanded to %q", name)
+		searchStats.expanded.Add(1)
+
+		// Reply with a CNAME to the expanded name, so the answers match the
+		// question, and clients can tell what name they got.
+		reply := newReplyTo(r)
+		reply.Answer = append([]dns.RR{&dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeCNAME,
+				Class:  question.Qclass,
+				Ttl:    lowestTTL(fromUp.Answer),
+			},
+			Target: name,
+		}}, fromUp.Answer...)
+		return reply, nil
+	}
+
+	// No luck with the search domains, try the name as-is.
+	return s.back.Query(r, tr)
+}
+
+// isSingleLabel returns true if the given (fully qualified) name has a single
+// label, like "nas.".
+func isSingleLabel(name string) bool {
+	return name != "." && strings.Count(name, ".") == 1 &&
+		strings.HasSuffix(name, ".")
+}
+
+// lowestTTL returns the lowest TTL of the given records.
+func lowestTTL(rrs []dns.RR) uint32 {
+	min := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < min {
+			min = rr.Header().Ttl
+		}
+	}
+	return min
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &searchResolver{}
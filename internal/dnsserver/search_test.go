@@ -0,0 +1,103 @@
+package dnsserver
+
+// Tests for the search domains resolver.
+
+import (
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// nameResolver is a Resolver for testing, which answers with the records
+// for the query name, or NXDOMAIN. It records the queried names.
+type nameResolver struct {
+	answers map[string][]dns.RR
+	queried []string
+}
+
+func (r *nameResolver) Init() error { return nil }
+func (r *nameResolver) Maintain()   {}
+
+func (r *nameResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	name := req.Question[0].Name
+	r.queried = append(r.queried, name)
+
+	reply := newReplyTo(req)
+	rrs, ok := r.answers[name]
+	if !ok {
+		reply.Rcode = dns.RcodeNameError
+	}
+	reply.Answer = rrs
+	return reply, nil
+}
+
+func TestSearch(t *testing.T) {
+	back := &nameResolver{answers: map[string][]dns.RR{
+		"nas.lan.":         {mustNewRR(t, "nas.lan. 300 A 192.168.1.10")},
+		"printer.home.":    {mustNewRR(t, "printer.home. 60 A 192.168.1.20")},
+		"com.":             {mustNewRR(t, "com. 60 A 1.1.1.1")},
+		"example.com.":     {mustNewRR(t, "example.com. 60 A 1.2.3.4")},
+		"example.com.lan.": {mustNewRR(t, "example.com.lan. 60 A 6.6.6.6")},
+	}}
+	s := NewSearchResolver(back, []string{"lan", "home."})
+
+	cases := []struct {
+		name    string
+		target  string
+		answer  int
+		queried []string
+	}{
+		{"nas.", "nas.lan.", 2, []string{"nas.lan."}},
+		{"printer.", "printer.home.", 2,
+			[]string{"printer.lan.", "printer.home."}},
+
+		// Not found in the search domains: try as-is.
+		{"com.", "", 1, []string{"com.lan.", "com.home.", "com."}},
+		{"unknown.", "", 0,
+			[]string{"unknown.lan.", "unknown.home.", "unknown."}},
+
+		// Not single-label, so not expanded.
+		{"example.com.", "", 1, []string{"example.com."}},
+	}
+
+	for _, c := range cases {
+		back.queried = nil
+		tr := testutil.NewTestTrace(t)
+		resp, err := s.Query(newQuery(c.name, dns.TypeA), tr)
+		if err != nil {
+			t.Errorf("%s: query failed: %v", c.name, err)
+			continue
+		}
+
+		if len(resp.Answer) != c.answer {
+			t.Errorf("%s: expected %d answers, got %v",
+				c.name, c.answer, resp.Answer)
+		}
+		if c.target != "" {
+			cname, ok := resp.Answer[0].(*dns.CNAME)
+			if !ok || cname.Hdr.Name != c.name || cname.Target != c.target {
+				t.Errorf("%s: expected CNAME to %q, got %v",
+					c.name, c.target, resp.Answer[0])
+			}
+		}
+		if !equalStrings(back.queried, c.queried) {
+			t.Errorf("%s: expected queries %v, got %v",
+				c.name, c.queried, back.queried)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,719 @@
+package dnsserver
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Secondary zones resolver.
+
+// secondaryResolver implements a Resolver which keeps copies of some zones,
+// transferred from their primaries (optionally authenticated with TSIG), and
+// answers authoritatively for them. Everything else is passed to the
+// backing resolver.
+//
+// This is useful for small setups with an internal zone, so the clients can
+// resolve it even when its primary is away.
+//
+// Like a standard secondary (RFC 1996 aside, as we don't take NOTIFYs), it
+// checks the SOA serial every refresh interval from the zone's SOA, and if
+// it changed it transfers the zone again (via IXFR if possible, falling
+// back to AXFR). If a check fails, it tries again every retry interval; and
+// if it can't confirm the zone for the expire interval, it stops answering
+// for it.
+type secondaryResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Zones, in the order given.
+	zones []*secondaryZone
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Functions to send a query to a server, and to transfer a zone from
+	// it; they are variables so tests can override them.
+	exchange func(m *dns.Msg, addr string, key *TSIGKey) (*dns.Msg, error)
+	transfer func(m *dns.Msg, addr string, key *TSIGKey) ([]dns.RR, error)
+}
+
+// SecondaryZone is a zone to transfer from its primaries.
+type SecondaryZone struct {
+	Zone string
+
+	// Addresses (host:port) of the primaries, tried in order.
+	Primaries []string
+
+	// Key to sign the queries and transfers with; nil if the primaries
+	// don't use TSIG.
+	Key *TSIGKey
+}
+
+// secondaryZone is our copy of a SecondaryZone.
+type secondaryZone struct {
+	SecondaryZone
+
+	// Protects the fields below.
+	mu *sync.RWMutex
+
+	// SOA of the zone (nil if we haven't loaded it yet).
+	soa *dns.SOA
+
+	// Records of the zone, by (lowercase) name.
+	records map[string][]dns.RR
+
+	// Names that exist in the zone: the ones with records, and the empty
+	// non-terminals between them and the apex.
+	names map[string]bool
+
+	// When we last confirmed the zone is up to date, and when to check it
+	// next.
+	confirmed time.Time
+	next      time.Time
+}
+
+// Constants that tune the secondary zones, declared as variables so we can
+// tweak them for testing.
+var (
+	// How often to see if the zones are due a check.
+	secondaryCheckPeriod = 30 * time.Second
+
+	// Timeout for the zone transfers.
+	secondaryTransferTimeout = 1 * time.Minute
+
+	// How often to retry loading a zone we don't have yet (afterwards, we
+	// use the retry interval from its SOA).
+	secondaryInitialRetry = 1 * time.Minute
+
+	// Maximum length of the CNAME chains we follow within the zones.
+	secondaryMaxCNAMEs = 8
+)
+
+// Exported variables for statistics.
+var secondaryStats = struct {
+	// Queries answered from the secondary zones, by zone.
+	answers *expvar.Map
+
+	// Zone transfers, by type ("axfr" or "ixfr").
+	transfers *expvar.Map
+
+	// Failed checks and transfers, by zone.
+	errors *expvar.Map
+
+	// Serial of the loaded zones, by zone.
+	serials *expvar.Map
+}{}
+
+func init() {
+	secondaryStats.answers = expvar.NewMap("secondary-zone-answers")
+	secondaryStats.transfers = expvar.NewMap("secondary-zone-transfers")
+	secondaryStats.errors = expvar.NewMap("secondary-zone-errors")
+	secondaryStats.serials = expvar.NewMap("secondary-zone-serials")
+}
+
+// ParseSecondaryZones parses a space-separated list of secondary zones, each
+// in the form "zone=primary1[;primary2...][,key=name]", with the primaries
+// as host:port, and the key one of the given ones (see LoadTSIGKeys).
+func ParseSecondaryZones(s string, keys map[string]*TSIGKey) ([]SecondaryZone, error) {
+	// Same syntax as the forwarded zones.
+	fzs, err := ParseForwardZones(s, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	zones := []SecondaryZone{}
+	for _, fz := range fzs {
+		zones = append(zones, SecondaryZone{
+			Zone:      fz.Zone,
+			Primaries: fz.Servers,
+			Key:       fz.Key,
+		})
+	}
+	return zones, nil
+}
+
+// NewSecondaryResolver returns a new resolver which answers for the given
+// zones from their copies, and uses back for everything else.
+func NewSecondaryResolver(back Resolver, zones []SecondaryZone) *secondaryResolver {
+	r := &secondaryResolver{
+		back:     back,
+		clock:    util.RealClock,
+		exchange: exchangeWithKey,
+		transfer: transferWithKey,
+	}
+	for _, z := range zones {
+		r.zones = append(r.zones, &secondaryZone{
+			SecondaryZone: z,
+			mu:            &sync.RWMutex{},
+		})
+	}
+	return r
+}
+
+// RegisterDebugHandlers registers http debug handlers, which can be accessed
+// from the monitoring server.
+// Note these are global by nature, if you try to register them multiple
+// times, you will get a panic.
+func (r *secondaryResolver) RegisterDebugHandlers() {
+	http.HandleFunc("/debug/dnsserver/secondary", r.HandleStatus)
+}
+
+// HandleStatus shows the zones, and their state.
+func (r *secondaryResolver) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	for _, z := range r.zones {
+		z.mu.RLock()
+		if z.soa == nil {
+			fmt.Fprintf(w, "%s\n  not loaded, next attempt: %v\n\n",
+				z.Zone, z.next)
+		} else {
+			fmt.Fprintf(w, "%s\n  serial %d, %d names, confirmed: %v,"+
+				" next check: %v\n\n",
+				z.Zone, z.soa.Serial, len(z.records), z.confirmed, z.next)
+		}
+		z.mu.RUnlock()
+	}
+}
+
+func (r *secondaryResolver) Init() error {
+	// Load the zones now, so we can answer for them from the start. If a
+	// primary is not reachable, we keep trying in the background.
+	r.checkZones()
+
+	return r.back.Init()
+}
+
+func (r *secondaryResolver) Maintain() {
+	go r.back.Maintain()
+
+	r.clock.Every(secondaryCheckPeriod, r.checkZones)
+}
+
+// checkZones checks the zones which are due, and transfers them if they
+// changed.
+func (r *secondaryResolver) checkZones() {
+	for _, z := range r.zones {
+		z.mu.RLock()
+		due := !r.clock.Now().Before(z.next)
+		z.mu.RUnlock()
+		if due {
+			r.refresh(z)
+		}
+	}
+}
+
+// refresh checks the serial of the zone in its primaries, and transfers it
+// if it changed, scheduling the next check accordingly.
+func (r *secondaryResolver) refresh(z *secondaryZone) {
+	tr := trace.New("dnsserver.Secondary", z.Zone)
+	defer tr.Finish()
+
+	err := errors.New("no primaries")
+	for _, addr := range z.Primaries {
+		if err = r.refreshFrom(z, addr, tr); err == nil {
+			break
+		}
+		secondaryStats.errors.Add(z.Zone, 1)
+		util.TraceErrorf(tr, "%s: %v", addr, err)
+	}
+
+	now := r.clock.Now()
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if err == nil {
+		z.confirmed = now
+		z.next = now.Add(time.Duration(z.soa.Refresh) * time.Second)
+		return
+	}
+
+	if z.soa == nil {
+		z.next = now.Add(secondaryInitialRetry)
+		log.Errorf("Could not load secondary zone %q, see traces", z.Zone)
+		return
+	}
+	z.next = now.Add(time.Duration(z.soa.Retry) * time.Second)
+	if z.expired(now) {
+		log.Errorf("Secondary zone %q expired, not answering for it",
+			z.Zone)
+	}
+}
+
+// refreshFrom checks the serial of the zone in the given primary, and
+// transfers it if it changed.
+func (r *secondaryResolver) refreshFrom(z *secondaryZone, addr string, tr trace.Trace) error {
+	m := &dns.Msg{}
+	m.SetQuestion(z.Zone, dns.TypeSOA)
+	if z.Key != nil {
+		m.SetTsig(z.Key.Name, z.Key.Algorithm, tsigFudge, r.clock.Now().Unix())
+	}
+	reply, err := r.exchange(m, addr, z.Key)
+	if err == nil && z.Key != nil && reply.IsTsig() == nil {
+		err = errUnsignedReply
+	}
+	if err != nil {
+		return err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("SOA query: %s", dns.RcodeToString[reply.Rcode])
+	}
+	var soa *dns.SOA
+	for _, rr := range reply.Answer {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+	if soa == nil {
+		return fmt.Errorf("no SOA in the reply")
+	}
+
+	z.mu.RLock()
+	current := z.soa
+	z.mu.RUnlock()
+
+	if current != nil {
+		// Serial number arithmetic (RFC 1982).
+		if diff := int32(soa.Serial - current.Serial); diff < 0 {
+			return fmt.Errorf("serial %d is older than ours (%d)",
+				soa.Serial, current.Serial)
+		} else if diff == 0 {
+			tr.LazyPrintf("%s: serial %d, up to date", addr, soa.Serial)
+			return nil
+		}
+
+		err := r.incrementalTransfer(z, addr, current, tr)
+		if err == nil {
+			return nil
+		}
+		tr.LazyPrintf("%s: IXFR failed, trying AXFR: %v", addr, err)
+	}
+
+	return r.fullTransfer(z, addr, tr)
+}
+
+// fullTransfer transfers the zone from the primary via AXFR.
+func (r *secondaryResolver) fullTransfer(z *secondaryZone, addr string, tr trace.Trace) error {
+	m := &dns.Msg{}
+	m.SetAxfr(z.Zone)
+	rrs, err := r.transferFrom(m, z, addr)
+	if err != nil {
+		return err
+	}
+	if len(rrs) < 2 {
+		return fmt.Errorf("AXFR: too short (%d records)", len(rrs))
+	}
+
+	// The transfer starts and ends with the SOA.
+	if err = z.set(rrs[:len(rrs)-1]); err != nil {
+		return err
+	}
+	secondaryStats.transfers.Add("axfr", 1)
+	tr.LazyPrintf("%s: AXFR, serial %d, %d records",
+		addr, z.soa.Serial, len(rrs)-1)
+	return nil
+}
+
+// incrementalTransfer gets the changes to the zone since the current SOA
+// from the primary via IXFR (RFC 1995), and applies them.
+func (r *secondaryResolver) incrementalTransfer(z *secondaryZone, addr string, current *dns.SOA, tr trace.Trace) error {
+	m := &dns.Msg{}
+	m.SetIxfr(z.Zone, current.Serial, current.Ns, current.Mbox)
+	rrs, err := r.transferFrom(m, z, addr)
+	if err != nil {
+		return err
+	}
+
+	// The primary may send the full zone instead, in AXFR format.
+	if len(rrs) >= 2 {
+		if _, isSOA := rrs[1].(*dns.SOA); !isSOA {
+			if err = z.set(rrs[:len(rrs)-1]); err != nil {
+				return err
+			}
+			secondaryStats.transfers.Add("axfr", 1)
+			tr.LazyPrintf("%s: IXFR got the full zone, serial %d",
+				addr, z.soa.Serial)
+			return nil
+		}
+	}
+
+	records, err := applyIXFR(z.allRecords(), rrs)
+	if err != nil {
+		return err
+	}
+	if err = z.set(records); err != nil {
+		return err
+	}
+	secondaryStats.transfers.Add("ixfr", 1)
+	tr.LazyPrintf("%s: IXFR, serial %d", addr, z.soa.Serial)
+	return nil
+}
+
+// applyIXFR applies the changes in the IXFR response to the records, and
+// returns the result. The response is the new SOA, followed by sequences of
+// the old SOA and the deleted records, and the new SOA and the added ones,
+// and ends with the new SOA again.
+func applyIXFR(records []dns.RR, rrs []dns.RR) ([]dns.RR, error) {
+	if len(rrs) < 2 {
+		return nil, fmt.Errorf("IXFR: too short (%d records)", len(rrs))
+	}
+	end, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, fmt.Errorf("IXFR: does not start with a SOA")
+	}
+	if last, ok := rrs[len(rrs)-1].(*dns.SOA); !ok || last.Serial != end.Serial {
+		return nil, fmt.Errorf("IXFR: does not end with the SOA")
+	}
+
+	deleting := false
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if soa, ok := rr.(*dns.SOA); ok {
+			// Each SOA switches between deletions and additions; the
+			// additions of each sequence include its new SOA.
+			deleting = !deleting
+			records = removeRR(records, soa)
+			if !deleting {
+				records = append(records, soa)
+			}
+			continue
+		}
+		if deleting {
+			records = removeRR(records, rr)
+		} else {
+			records = append(records, rr)
+		}
+	}
+	if deleting {
+		return nil, fmt.Errorf("IXFR: incomplete sequence")
+	}
+	return records, nil
+}
+
+// removeRR returns the records without the ones equal to rr (ignoring the
+// TTL). SOAs are removed regardless of their contents, as there's only one.
+func removeRR(records []dns.RR, rr dns.RR) []dns.RR {
+	_, isSOA := rr.(*dns.SOA)
+	var kept []dns.RR
+	for _, r := range records {
+		if _, ok := r.(*dns.SOA); ok && isSOA {
+			continue
+		}
+		if !dns.IsDuplicate(r, rr) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// transferFrom sends the transfer request to the primary, signed with the
+// zone's key if it has one.
+func (r *secondaryResolver) transferFrom(m *dns.Msg, z *secondaryZone, addr string) ([]dns.RR, error) {
+	if z.Key != nil {
+		m.SetTsig(z.Key.Name, z.Key.Algorithm, tsigFudge, r.clock.Now().Unix())
+	}
+	return r.transfer(m, addr, z.Key)
+}
+
+// transferWithKey performs the zone transfer, verifying the signatures with
+// the key, if given.
+func transferWithKey(m *dns.Msg, addr string, key *TSIGKey) ([]dns.RR, error) {
+	t := &dns.Transfer{
+		DialTimeout:  forwardTimeout,
+		ReadTimeout:  secondaryTransferTimeout,
+		WriteTimeout: forwardTimeout,
+	}
+	if key != nil {
+		t.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	envs, err := t.In(m, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs, nil
+}
+
+// set the records of the zone, after checking they belong to it.
+func (z *secondaryZone) set(rrs []dns.RR) error {
+	var soa *dns.SOA
+	records := map[string][]dns.RR{}
+	names := map[string]bool{}
+	for _, rr := range rrs {
+		name := util.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(z.Zone, name) {
+			return fmt.Errorf("record %q is out of the zone", name)
+		}
+		if s, ok := rr.(*dns.SOA); ok {
+			if name != z.Zone || soa != nil {
+				return fmt.Errorf("unexpected SOA for %q", name)
+			}
+			soa = s
+		}
+		records[name] = append(records[name], rr)
+
+		// The name, and its ancestors up to the apex, exist.
+		for n := name; !names[n]; {
+			names[n] = true
+			if n == z.Zone {
+				break
+			}
+			n = parentName(n)
+		}
+	}
+	if soa == nil {
+		return fmt.Errorf("no SOA for the zone")
+	}
+
+	z.mu.Lock()
+	z.soa = soa
+	z.records = records
+	z.names = names
+	z.mu.Unlock()
+
+	v := &expvar.Int{}
+	v.Set(int64(soa.Serial))
+	secondaryStats.serials.Set(z.Zone, v)
+	return nil
+}
+
+// allRecords returns all the records of the zone.
+func (z *secondaryZone) allRecords() []dns.RR {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var rrs []dns.RR
+	for _, name := range sortedNames(z.records) {
+		rrs = append(rrs, z.records[name]...)
+	}
+	return rrs
+}
+
+// expired tells if we haven't been able to confirm the zone for too long.
+// Must be called with the lock held.
+func (z *secondaryZone) expired(now time.Time) bool {
+	expire := time.Duration(z.soa.Expire) * time.Second
+	return now.After(z.confirmed.Add(expire))
+}
+
+// zoneFor returns the closest secondary zone containing the name, or nil.
+func (r *secondaryResolver) zoneFor(name string) *secondaryZone {
+	name = util.CanonicalName(name)
+	var found *secondaryZone
+	for _, z := range r.zones {
+		if dns.IsSubDomain(z.Zone, name) &&
+			(found == nil || len(z.Zone) > len(found.Zone)) {
+			found = z
+		}
+	}
+	return found
+}
+
+var errZoneNotLoaded = errors.New("secondary zone not loaded, or expired")
+
+func (r *secondaryResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return r.back.Query(req, tr)
+	}
+	question := req.Question[0]
+
+	z := r.zoneFor(question.Name)
+	if z == nil {
+		return r.back.Query(req, tr)
+	}
+
+	reply, target := z.answer(req, r.clock.Now())
+	if reply == nil {
+		// Don't pass the query along: the zone is (supposedly) internal,
+		// so the upstream can't answer it.
+		tr.LazyPrintf("secondary %q: not available", z.Zone)
+		return nil, errZoneNotLoaded
+	}
+	tr.LazyPrintf("answering from secondary zone %q", z.Zone)
+	secondaryStats.answers.Add(z.Zone, 1)
+
+	if target == "" {
+		return reply, nil
+	}
+
+	// The CNAME chain leaves the zone: resolve the target like any other
+	// query, so the clients get the full answer.
+	tq := &dns.Msg{}
+	tq.SetQuestion(target, question.Qtype)
+	tq.Id = req.Id
+	tq.RecursionDesired = req.RecursionDesired
+
+	fromUp, err := r.Query(tq, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The target is not ours, so we are not authoritative for the full
+	// answer.
+	reply.Authoritative = false
+	reply.Rcode = fromUp.Rcode
+	reply.Answer = append(reply.Answer, fromUp.Answer...)
+	return reply, nil
+}
+
+// answer the query from the zone, or return nil if we don't have it (or
+// it expired). If the answer is a CNAME chain which leaves the zone, it
+// also returns the name it leads to, for the caller to resolve.
+func (z *secondaryZone) answer(req *dns.Msg, now time.Time) (*dns.Msg, string) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if z.soa == nil || z.expired(now) {
+		return nil, ""
+	}
+
+	reply := newReplyTo(req)
+	reply.Authoritative = true
+	q := req.Question[0]
+
+	for i := 0; i < secondaryMaxCNAMEs; i++ {
+		name := util.CanonicalName(q.Name)
+		if !dns.IsSubDomain(z.Zone, name) {
+			return reply, q.Name
+		}
+
+		if ns := z.delegation(name, q.Qtype); ns != nil {
+			// The name was delegated away: refer to the zone's servers,
+			// as we are not authoritative for it.
+			if len(reply.Answer) == 0 {
+				reply.Authoritative = false
+				reply.Ns = ns
+				reply.Extra = z.glue(ns)
+				return reply, ""
+			}
+			return reply, q.Name
+		}
+
+		rrs := z.lookup(name)
+		if rrs == nil {
+			reply.Rcode = dns.RcodeNameError
+			reply.Ns = z.negativeSOA()
+			return reply, ""
+		}
+
+		answer := matchingRRs(rrs, q)
+		if len(answer) > 0 {
+			reply.Answer = append(reply.Answer, answer...)
+			return reply, ""
+		}
+
+		cname := findCNAME(rrs)
+		if cname == nil || q.Qtype == dns.TypeCNAME {
+			// No records of this type (NODATA).
+			reply.Ns = z.negativeSOA()
+			return reply, ""
+		}
+		reply.Answer = append(reply.Answer, renameRR(cname, q.Name))
+		q.Name = cname.Target
+	}
+
+	// Too long a chain; the clients can follow it if they want.
+	return reply, ""
+}
+
+// lookup returns the records for the name, including the ones synthesized
+// from a wildcard (RFC 4592), or nil if the name doesn't exist.
+// Must be called with the lock held.
+func (z *secondaryZone) lookup(name string) []dns.RR {
+	if z.names[name] {
+		// It may be an empty non-terminal, but then it's not nil.
+		if rrs := z.records[name]; rrs != nil {
+			return rrs
+		}
+		return []dns.RR{}
+	}
+
+	// The wildcard can only come from the closest encloser.
+	encloser := name
+	for !z.names[encloser] {
+		encloser = parentName(encloser)
+	}
+	return z.records["*."+encloser]
+}
+
+// delegation returns the NS records of the zone cut at or above the name (but
+// below the apex), or nil if it wasn't delegated. The DS records of a cut
+// are ours, though.
+// Must be called with the lock held.
+func (z *secondaryZone) delegation(name string, qtype uint16) []dns.RR {
+	var ns []dns.RR
+	for n := name; n != z.Zone; n = parentName(n) {
+		if n == name && qtype == dns.TypeDS {
+			continue
+		}
+		if found := lookupType(z.records[n], dns.TypeNS); len(found) > 0 {
+			ns = found
+		}
+	}
+	return ns
+}
+
+// glue returns the addresses of the given name servers that are in the zone.
+// Must be called with the lock held.
+func (z *secondaryZone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		target := util.CanonicalName(rr.(*dns.NS).Ns)
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			extra = append(extra, lookupType(z.records[target], t)...)
+		}
+	}
+	return extra
+}
+
+// negativeSOA returns the SOA to include in negative replies, with its TTL
+// capped to its minimum field, as it's how long they can be cached (RFC
+// 2308).
+// Must be called with the lock held.
+func (z *secondaryZone) negativeSOA() []dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return []dns.RR{soa}
+}
+
+// parentName returns the parent of the given (non-root) name.
+func parentName(name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 || i == len(name)-1 {
+		return "."
+	}
+	return name[i+1:]
+}
+
+// sortedNames returns the names of the records, sorted.
+func sortedNames(records map[string][]dns.RR) []string {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &secondaryResolver{}
@@ -0,0 +1,277 @@
+package dnsserver
+
+// Tests for the secondary zones resolver.
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func testSOA(serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: "corp.example.", Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: 3600},
+		Ns: "ns.corp.example.", Mbox: "admin.corp.example.",
+		Serial: serial, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 60,
+	}
+}
+
+// fakePrimary is a primary server for corp.example.
+type fakePrimary struct {
+	// Serial to reply to the SOA queries with, and the error to fail them
+	// with.
+	serial uint32
+	err    error
+
+	// Replies to the transfers, in order.
+	transfers [][]dns.RR
+
+	queries int
+}
+
+func (p *fakePrimary) exchange(m *dns.Msg, addr string, key *TSIGKey) (*dns.Msg, error) {
+	p.queries++
+	if p.err != nil {
+		return nil, p.err
+	}
+	reply := newReplyTo(m)
+	reply.Answer = []dns.RR{testSOA(p.serial)}
+	return reply, nil
+}
+
+func (p *fakePrimary) transfer(m *dns.Msg, addr string, key *TSIGKey) ([]dns.RR, error) {
+	if len(p.transfers) == 0 {
+		return nil, errors.New("unexpected transfer")
+	}
+	rrs := p.transfers[0]
+	p.transfers = p.transfers[1:]
+	return rrs, nil
+}
+
+func newTestSecondary(t *testing.T) (*secondaryResolver, *fakePrimary, *testutil.TestResolver) {
+	rr := func(s string) dns.RR { return mustNewRR(t, s) }
+	p := &fakePrimary{serial: 1}
+	p.transfers = [][]dns.RR{{
+		testSOA(1),
+		rr("corp.example. 3600 IN NS ns.corp.example."),
+		rr("ns.corp.example. 3600 IN A 10.0.0.53"),
+		rr("www.corp.example. 3600 IN A 10.0.0.80"),
+		rr("alias.corp.example. 3600 IN CNAME www.corp.example."),
+		rr("ext.corp.example. 3600 IN CNAME www.example.com."),
+		rr("a.b.corp.example. 3600 IN A 10.0.0.1"),
+		rr("*.wild.corp.example. 3600 IN A 10.0.0.2"),
+		rr("lab.corp.example. 3600 IN NS ns.lab.corp.example."),
+		rr("ns.lab.corp.example. 3600 IN A 10.1.0.53"),
+		testSOA(1),
+	}}
+
+	back := testutil.NewTestResolver()
+	r := NewSecondaryResolver(back, []SecondaryZone{{
+		Zone:      "corp.example.",
+		Primaries: []string{"10.0.0.53:53"},
+	}})
+	r.clock = testutil.NewFakeClock(time.Now())
+	r.exchange = p.exchange
+	r.transfer = p.transfer
+	if err := r.Init(); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	if !back.Initialized {
+		t.Errorf("backing resolver was not initialized")
+	}
+	return r, p, back
+}
+
+func TestParseSecondaryZones(t *testing.T) {
+	keys, _ := loadTestKeys(t, testTSIGKeys)
+	zones, err := ParseSecondaryZones(
+		"Corp.Example=10.0.0.53:53;10.0.0.54:53,key=corp-key", keys)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if len(zones) != 1 || zones[0].Zone != "corp.example." ||
+		len(zones[0].Primaries) != 2 || zones[0].Key != keys["corp-key."] {
+		t.Errorf("unexpected zones: %+v", zones)
+	}
+
+	for _, s := range []string{
+		"corp.example",
+		"corp.example=10.0.0.53",
+		"corp.example=10.0.0.53:53,key=unknown",
+	} {
+		if _, err := ParseSecondaryZones(s, keys); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestSecondaryAnswers(t *testing.T) {
+	r, _, back := newTestSecondary(t)
+	back.Response = newReply(mustNewRR(t, "www.example.com. A 1.2.3.4"))
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer int
+		ns     int
+		auth   bool
+		passed bool
+	}{
+		{"www.corp.example.", dns.TypeA, dns.RcodeSuccess, 1, 0, true, false},
+		{"WWW.Corp.Example.", dns.TypeA, dns.RcodeSuccess, 1, 0, true, false},
+		{"corp.example.", dns.TypeNS, dns.RcodeSuccess, 1, 0, true, false},
+
+		// NODATA, NXDOMAIN, and empty non-terminals.
+		{"www.corp.example.", dns.TypeMX, dns.RcodeSuccess, 0, 1, true, false},
+		{"nope.corp.example.", dns.TypeA, dns.RcodeNameError, 0, 1, true, false},
+		{"b.corp.example.", dns.TypeA, dns.RcodeSuccess, 0, 1, true, false},
+
+		// Wildcards, only from the closest encloser.
+		{"x.wild.corp.example.", dns.TypeA, dns.RcodeSuccess, 1, 0, true, false},
+		{"x.y.wild.corp.example.", dns.TypeA, dns.RcodeSuccess, 1, 0, true, false},
+
+		// CNAMEs, within the zone and out of it.
+		{"alias.corp.example.", dns.TypeA, dns.RcodeSuccess, 2, 0, true, false},
+		{"ext.corp.example.", dns.TypeA, dns.RcodeSuccess, 2, 0, false, true},
+
+		// Delegations.
+		{"www.lab.corp.example.", dns.TypeA, dns.RcodeSuccess, 0, 1, false, false},
+
+		// Not ours (the test resolver always sets the authoritative bit).
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, 1, 0, true, true},
+	}
+
+	for _, c := range cases {
+		back.LastQuery = nil
+		resp, err := r.Query(newQuery(c.name, c.qtype), testutil.NewTestTrace(t))
+		if err != nil {
+			t.Errorf("%s %d: query failed: %v", c.name, c.qtype, err)
+			continue
+		}
+		if resp.Rcode != c.rcode || len(resp.Answer) != c.answer ||
+			len(resp.Ns) != c.ns || resp.Authoritative != c.auth {
+			t.Errorf("%s %d: unexpected reply: %v", c.name, c.qtype, resp)
+		}
+		if len(resp.Answer) > 0 && resp.Answer[0].Header().Name != c.name &&
+			!c.passed {
+			t.Errorf("%s %d: answer does not preserve the name: %v",
+				c.name, c.qtype, resp.Answer[0])
+		}
+		if passed := back.LastQuery != nil; passed != c.passed {
+			t.Errorf("%s %d: expected passthrough %v, got %v",
+				c.name, c.qtype, c.passed, passed)
+		}
+	}
+
+	// The negative replies have the SOA, with the minimum TTL.
+	resp, _ := r.Query(newQuery("nope.corp.example.", dns.TypeA),
+		testutil.NewTestTrace(t))
+	if soa, ok := resp.Ns[0].(*dns.SOA); !ok || soa.Hdr.Ttl != 60 {
+		t.Errorf("unexpected authority section: %v", resp.Ns)
+	}
+
+	// The glue goes with the delegations.
+	resp, _ = r.Query(newQuery("www.lab.corp.example.", dns.TypeA),
+		testutil.NewTestTrace(t))
+	if len(resp.Extra) != 1 {
+		t.Errorf("unexpected additional section: %v", resp.Extra)
+	}
+}
+
+func TestSecondaryRefresh(t *testing.T) {
+	r, p, _ := newTestSecondary(t)
+	clock := r.clock.(*testutil.FakeClock)
+	query := func() (*dns.Msg, error) {
+		return r.Query(newQuery("new.corp.example.", dns.TypeA),
+			testutil.NewTestTrace(t))
+	}
+
+	// Not due for a check yet.
+	r.checkZones()
+	if p.queries != 1 {
+		t.Errorf("expected 1 SOA query, got %d", p.queries)
+	}
+
+	// Checked after the refresh interval; the serial didn't change.
+	clock.Advance(time.Hour)
+	r.checkZones()
+	if p.queries != 2 {
+		t.Errorf("expected 2 SOA queries, got %d", p.queries)
+	}
+
+	// The serial changes, and we get the changes via IXFR.
+	p.serial = 2
+	p.transfers = [][]dns.RR{{
+		testSOA(2),
+		testSOA(1),
+		mustNewRR(t, "www.corp.example. 3600 IN A 10.0.0.80"),
+		testSOA(2),
+		mustNewRR(t, "new.corp.example. 3600 IN A 10.0.0.81"),
+		testSOA(2),
+	}}
+	clock.Advance(time.Hour)
+	r.checkZones()
+	if resp, err := query(); err != nil || len(resp.Answer) != 1 {
+		t.Errorf("new record not found: %v, %v", resp, err)
+	}
+	resp, err := r.Query(newQuery("www.corp.example.", dns.TypeA),
+		testutil.NewTestTrace(t))
+	if err != nil || resp.Rcode != dns.RcodeNameError {
+		t.Errorf("deleted record still there: %v, %v", resp, err)
+	}
+	if soa := r.zones[0].soa; soa.Serial != 2 {
+		t.Errorf("unexpected serial: %d", soa.Serial)
+	}
+
+	// The primary goes away: we retry more often, and keep answering
+	// until the zone expires.
+	p.err = errors.New("unreachable")
+	queries := p.queries
+	clock.Advance(time.Hour)
+	r.checkZones()
+	clock.Advance(10 * time.Minute)
+	r.checkZones()
+	if p.queries != queries+2 {
+		t.Errorf("expected 2 more SOA queries, got %d", p.queries-queries)
+	}
+	if _, err := query(); err != nil {
+		t.Errorf("zone not answering before expiring: %v", err)
+	}
+
+	clock.Advance(24 * time.Hour)
+	r.checkZones()
+	if _, err := query(); err != errZoneNotLoaded {
+		t.Errorf("zone still answering after expiring: %v", err)
+	}
+
+	// And it comes back when the primary does.
+	p.err = nil
+	clock.Advance(10 * time.Minute)
+	r.checkZones()
+	if _, err := query(); err != nil {
+		t.Errorf("zone not answering after coming back: %v", err)
+	}
+}
+
+func TestApplyIXFR(t *testing.T) {
+	rr := func(s string) dns.RR { return mustNewRR(t, s) }
+	records := []dns.RR{testSOA(1), rr("www.corp.example. 3600 IN A 10.0.0.80")}
+
+	// Not a proper sequence.
+	for _, rrs := range [][]dns.RR{
+		{testSOA(2)},
+		{rr("www.corp.example. 3600 IN A 10.0.0.80"), testSOA(2)},
+		{testSOA(2), testSOA(1), testSOA(2)},
+		{testSOA(2), testSOA(1), testSOA(3)},
+	} {
+		if _, err := applyIXFR(records, rrs); err == nil {
+			t.Errorf("%v: no error", rrs)
+		}
+	}
+}
@@ -5,16 +5,24 @@ package dnsserver
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"expvar"
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/go-systemd/activation"
 	"github.com/miekg/dns"
 	"golang.org/x/net/trace"
 
+	"blitiri.com.ar/go/dnss/internal/proxyproto"
+	"blitiri.com.ar/go/dnss/internal/querystats"
+	"blitiri.com.ar/go/dnss/internal/upgrade"
 	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/dnss/internal/watchdog"
 	"blitiri.com.ar/go/log"
 )
 
@@ -43,6 +51,16 @@ func init() {
 	}()
 }
 
+// Exported variables for statistics.
+var serverStats = struct {
+	// Queries received, by any of the listeners.
+	queries *expvar.Int
+}{}
+
+func init() {
+	serverStats.queries = expvar.NewInt("dns-queries")
+}
+
 // Server implements a DNS proxy, which will (mostly) use the given resolver
 // to resolve queries.
 type Server struct {
@@ -52,8 +70,62 @@ type Server struct {
 
 	fallbackDomains  map[string]struct{}
 	fallbackUpstream string
+
+	// DSCP value to mark UDP replies with (0 means no marking).
+	dscp int
+
+	// Unix socket to also listen on (if any), and its permissions.
+	unixPath string
+	unixMode os.FileMode
+
+	// Maximum UDP payload size we advertise and send.
+	ednsUDPSize int
+
+	// Expect PROXY protocol headers on the TCP connections.
+	proxyProtocol bool
+
+	// Rate limiter for the UDP responses (nil means no limits).
+	rrl *rateLimiter
+
+	// DNS cookies checker (nil means cookies are not supported).
+	cookies *cookieChecker
+
+	// Strip the authority and additional sections from the replies (see
+	// minimal.go).
+	minimalResponses bool
+
+	// Our NSID (name server identifier), and whether to forward the NSID
+	// requests upstream.
+	nsid        string
+	nsidForward bool
+
+	// Whether to send the clients' identity upstream, and the function to
+	// get their names (see clientid.go).
+	clientID    bool
+	clientNames func(net.IP) string
+
+	// Forwarder for the dynamic updates (nil means they are refused).
+	update *updateForwarder
+
+	// Policy rules for the queries (nil if there are none).
+	policy *queryPolicy
+
+	// Questions to resolve at startup, to warm up the cache.
+	warmup []dns.Question
+
+	// Queries in progress, to cancel the ones abandoned by their clients,
+	// and to recognize the retransmitted ones.
+	abandon *abandonTracker
+	dups    *duplicateTracker
+
+	// Per-domain and per-client statistics (nil if disabled).
+	queryStats *querystats.Stats
 }
 
+// DefaultEDNSUDPSize is the default maximum size of UDP replies, as
+// recommended by the DNS flag day 2020 to avoid IP fragmentation.
+const DefaultEDNSUDPSize = 1232
+
 // New *Server, which will listen on addr, use resolver as the backend
 // resolver, and use unqUpstream to resolve unqualified queries.
 func New(addr string, resolver Resolver, unqUpstream string) *Server {
@@ -62,6 +134,9 @@ func New(addr string, resolver Resolver, unqUpstream string) *Server {
 		resolver:        resolver,
 		unqUpstream:     unqUpstream,
 		fallbackDomains: map[string]struct{}{},
+		ednsUDPSize:     DefaultEDNSUDPSize,
+		abandon:         newAbandonTracker(),
+		dups:            newDuplicateTracker(),
 	}
 }
 
@@ -69,18 +144,197 @@ func New(addr string, resolver Resolver, unqUpstream string) *Server {
 func (s *Server) SetFallback(upstream string, domains []string) {
 	s.fallbackUpstream = upstream
 	for _, d := range domains {
-		s.fallbackDomains[d] = struct{}{}
+		if d == "" {
+			continue
+		}
+		s.fallbackDomains[util.CanonicalName(d)] = struct{}{}
+	}
+}
+
+// isFallbackDomain returns true if the given name is one of the fallback
+// domains.
+func (s *Server) isFallbackDomain(name string) bool {
+	_, ok := s.fallbackDomains[util.CanonicalName(name)]
+	return ok
+}
+
+// SetDSCP sets the DSCP value to mark UDP replies with.
+func (s *Server) SetDSCP(dscp int) {
+	s.dscp = dscp
+}
+
+// SetUnixSocket makes the server also listen on a unix socket at the given
+// path, with the given permissions. The socket is a stream socket, which uses
+// the same framing as DNS over TCP.
+func (s *Server) SetUnixSocket(path string, mode os.FileMode) {
+	s.unixPath = path
+	s.unixMode = mode
+}
+
+// SetProxyProtocol makes the server expect PROXY protocol headers (see the
+// proxyproto package) at the start of the TCP connections, so the clients'
+// addresses are the real ones when we are behind a load balancer.
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.proxyProtocol = enabled
+}
+
+// listenerFor wraps the given TCP listener as needed.
+func (s *Server) listenerFor(l net.Listener) net.Listener {
+	if s.proxyProtocol {
+		l = proxyproto.NewListener(l)
+	}
+	return s.abandon.watchListener(l)
+}
+
+// SetRateLimit limits the UDP responses to each client netblock to the
+// given number per second. Once over the limit, queries are dropped, except
+// one in every slip which gets a truncated reply, so legitimate clients can
+// retry over TCP (slip 0 drops them all). See rateLimiter for details.
+func (s *Server) SetRateLimit(rate, slip int) {
+	s.rrl = newRateLimiter(rate, slip)
+}
+
+// SetCookies enables support for DNS cookies (RFC 7873), with the given
+// secret to generate the server cookies (nil means a random one). Clients
+// with a valid server cookie are not rate limited, as their address can't be
+// spoofed.
+func (s *Server) SetCookies(secret []byte) {
+	s.cookies = newCookieChecker(secret)
+}
+
+// SetNSID sets the identifier to give to the clients that ask for it via
+// NSID (RFC 5001), so operators can tell which instance answered. If
+// forward is true, the requests are forwarded upstream too, and the reply
+// has both identifiers.
+func (s *Server) SetNSID(id string, forward bool) {
+	s.nsid = id
+	s.nsidForward = forward
+}
+
+// SetQueryStats makes the server count the queries in the given per-domain
+// and per-client statistics.
+func (s *Server) SetQueryStats(qs *querystats.Stats) {
+	s.queryStats = qs
+}
+
+// countQuery adds the query to the per-domain and per-client statistics,
+// if enabled.
+func (s *Server) countQuery(w dns.ResponseWriter, r *dns.Msg, failed bool) {
+	if s.queryStats == nil || len(r.Question) != 1 {
+		return
+	}
+	client := "local"
+	if ip := addrIP(w.RemoteAddr()); ip != nil {
+		client = ip.String()
+	}
+	s.queryStats.Add(client, r.Question[0].Name, failed)
+}
+
+// SetEDNSUDPSize sets the maximum UDP payload size that we advertise to
+// clients. UDP replies are never larger than this, or than what the client
+// advertised (512 if it did not use EDNS).
+func (s *Server) SetEDNSUDPSize(size int) {
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if size > dns.MaxMsgSize {
+		size = dns.MaxMsgSize
+	}
+	s.ednsUDPSize = size
+}
+
+// markPacketConn applies the configured DSCP marking (if any) to the given
+// packet connection.
+func (s *Server) markPacketConn(pc net.PacketConn) {
+	if s.dscp == 0 {
+		return
+	}
+
+	if err := util.SetPacketDSCP(pc, s.dscp); err != nil {
+		log.Errorf("Error setting DSCP on %v: %v", pc.LocalAddr(), err)
 	}
 }
 
 // Handler for the incoming DNS queries.
 func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
+	defer upgrade.Track()()
+
 	tr := trace.New("dnsserver", "Handler")
 	defer tr.Finish()
 
-	tr.LazyPrintf("from:%v   id:%v", w.RemoteAddr(), r.Id)
+	// Give each query its own ID, to correlate our logs with the upstream's
+	// (see util.RequestID).
+	reqID := util.NewRequestID()
+	tr = util.WithRequestID(tr, reqID)
+	tr = util.WithClient(tr, addrIP(w.RemoteAddr()))
+
+	tr.LazyPrintf("from:%v   id:%v   req:%s", w.RemoteAddr(), r.Id, reqID)
 
 	util.TraceQuestion(tr, r.Question)
+	serverStats.queries.Add(1)
+
+	// When overloaded, drop the query, so the clients retry or go to
+	// another server while we recover.
+	if watchdog.Shed() {
+		tr.LazyPrintf("overloaded, dropping")
+		return
+	}
+
+	// Cancelled if the client abandons the query (see abandon.go).
+	ctx, done := s.abandon.track(w)
+	defer done()
+	tr = util.WithContext(tr, ctx)
+
+	co := &clientOptions{}
+	validCookie := false
+	if s.cookies != nil {
+		var status cookieStatus
+		co.cookie, status = s.cookies.takeCookie(r, addrIP(w.RemoteAddr()))
+		if status == cookieMalformed {
+			tr.LazyPrintf("malformed cookie, failing")
+			util.RecentErrors.Add(tr, "parse", r.Question, "malformed cookie")
+			reply := &dns.Msg{}
+			reply.SetRcodeFormatError(r)
+			w.WriteMsg(reply)
+			return
+		}
+		validCookie = status == cookieValid
+	}
+	if s.nsid != "" || s.nsidForward {
+		co.nsid = s.takeNSID(r)
+	}
+	s.handleClientID(r, addrIP(w.RemoteAddr()), tr)
+
+	if s.rrl != nil && !validCookie {
+		if _, isUDP := w.LocalAddr().(*net.UDPAddr); isUDP {
+			switch s.rrl.check(w.RemoteAddr()) {
+			case rrlDrop:
+				tr.LazyPrintf("rate limited, dropping")
+				return
+			case rrlSlip:
+				tr.LazyPrintf("rate limited, replying truncated")
+				reply := &dns.Msg{}
+				reply.SetReply(r)
+				reply.Truncated = true
+				w.WriteMsg(reply)
+				return
+			}
+		}
+	}
+
+	// Retransmissions of a query in progress get its reply, instead of
+	// being resolved again (see duplicates.go).
+	dup, w, queryDone := s.dups.handle(w, r, reqID, tr)
+	if dup {
+		return
+	}
+	defer queryDone()
+
+	// Dynamic updates never go to the resolver.
+	if r.Opcode == dns.OpcodeUpdate {
+		s.handleUpdate(w, r, tr)
+		return
+	}
 
 	// We only support single-question queries.
 	if len(r.Question) != 1 {
@@ -89,6 +343,22 @@ func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
+	if s.policy != nil {
+		reply, err := s.applyPolicy(w, r, tr)
+		if err != nil {
+			util.TraceErrorf(tr, "policy error: %v", err)
+			s.countQuery(w, r, true)
+			dns.HandleFailed(w, r)
+			return
+		}
+		if reply != nil {
+			reply.Id = r.Id
+			util.TraceAnswer(tr, reply)
+			s.writeReply(w, r, reply, co, tr)
+			return
+		}
+	}
+
 	// Forward to the unqualified upstream server if:
 	//  - We have one configured.
 	//  - There's only one question in the request, to keep things simple.
@@ -100,9 +370,12 @@ func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
 		if err == nil {
 			tr.LazyPrintf("used unqualified upstream")
 			util.TraceAnswer(tr, u)
-			w.WriteMsg(u)
+			s.writeReply(w, r, u, co, tr)
 		} else {
 			tr.LazyPrintf("unqualified upstream error: %v", err)
+			util.RecentErrors.Add(tr, "upstream", r.Question,
+				"unqualified upstream %s: %v", s.unqUpstream, err)
+			s.countQuery(w, r, true)
 			dns.HandleFailed(w, r)
 		}
 
@@ -110,14 +383,17 @@ func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	// Forward to the fallback server if the domain is on our list.
-	if _, ok := s.fallbackDomains[r.Question[0].Name]; ok {
+	if s.isFallbackDomain(r.Question[0].Name) {
 		u, err := dns.Exchange(r, s.fallbackUpstream)
 		if err == nil {
 			tr.LazyPrintf("used fallback upstream (%s)", s.fallbackUpstream)
 			util.TraceAnswer(tr, u)
-			w.WriteMsg(u)
+			s.writeReply(w, r, u, co, tr)
 		} else {
 			tr.LazyPrintf("fallback upstream error: %v", err)
+			util.RecentErrors.Add(tr, "upstream", r.Question,
+				"fallback upstream %s: %v", s.fallbackUpstream, err)
+			s.countQuery(w, r, true)
 			dns.HandleFailed(w, r)
 		}
 
@@ -129,13 +405,31 @@ func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
 	oldid := r.Id
 	r.Id = <-newID
 
+	start := time.Now()
 	fromUp, err := s.resolver.Query(r, tr)
+	if err == nil && fromUp == nil {
+		err = errNoReply
+	}
+	if util.TracedNames.Match(r.Question[0].Name) {
+		util.TraceDetail(tr, "%s: resolved in %v, error: %v, reply:\n%v",
+			r.Question[0].Name, time.Since(start), err, fromUp)
+	}
+	if err == errDropQuery {
+		tr.LazyPrintf("dropping query")
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		tr.LazyPrintf("query abandoned by the client, not replying")
+		return
+	}
 	if err != nil {
-		log.Infof("resolver query error: %v", err)
+		log.Infof("[%s] resolver query error: %v", reqID, err)
+		util.RecentErrors.Add(tr, "upstream", r.Question, "%v", err)
 		tr.LazyPrintf(err.Error())
 		tr.SetError()
 
 		r.Id = oldid
+		s.countQuery(w, r, true)
 		dns.HandleFailed(w, r)
 		return
 	}
@@ -143,7 +437,89 @@ func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
 	util.TraceAnswer(tr, fromUp)
 
 	fromUp.Id = oldid
-	w.WriteMsg(fromUp)
+	s.writeReply(w, r, fromUp, co, tr)
+}
+
+// errNoReply is used when a resolver returns neither a reply nor an error,
+// which they shouldn't do; we then reply with SERVFAIL.
+var errNoReply = errors.New("resolver returned no reply")
+
+// writeReply writes the reply to the given request, making sure it fits in
+// what the client can receive. Over UDP, replies that are too large are
+// truncated (with the TC bit set), so the client can retry over TCP.
+// It also replies to the EDNS options meant for us (see clientOptions).
+func (s *Server) writeReply(w dns.ResponseWriter, r, reply *dns.Msg, co *clientOptions, tr trace.Trace) {
+	// Always compress the names in replies, as resolvers do: it keeps the
+	// replies small, which avoids unnecessary truncation over UDP.
+	reply.Compress = true
+
+	if s.minimalResponses {
+		minimizeReply(reply)
+	}
+
+	// If the client used EDNS, advertise our own size, not the upstream's.
+	// If it didn't, the reply must not have an OPT (RFC 6891 section 7),
+	// even if the upstream's has one.
+	if opt := r.IsEdns0(); opt != nil {
+		if ropt := reply.IsEdns0(); ropt != nil {
+			ropt.SetUDPSize(uint16(s.ednsUDPSize))
+		} else {
+			reply.SetEdns0(uint16(s.ednsUDPSize), opt.Do())
+		}
+	} else {
+		removeOPT(reply)
+	}
+
+	if reply.Rcode == dns.RcodeRefused {
+		util.RecentErrors.Add(tr, "refused", r.Question, "replied REFUSED")
+	}
+	s.countQuery(w, r, reply.Rcode == dns.RcodeServerFailure)
+
+	if co.cookie != nil {
+		s.cookies.setCookie(reply, co.cookie, addrIP(w.RemoteAddr()))
+	}
+	if s.nsid != "" || s.nsidForward {
+		s.setNSID(reply, co.nsid)
+	}
+
+	if _, isUDP := w.LocalAddr().(*net.UDPAddr); isUDP {
+		size := s.maxUDPSize(r)
+		if reply.Len() > size {
+			tr.LazyPrintf("reply too large (%d > %d), truncating",
+				reply.Len(), size)
+			reply.Truncate(size)
+		}
+	}
+
+	w.WriteMsg(reply)
+}
+
+// maxUDPSize returns the maximum size of a UDP reply to the given request.
+func (s *Server) maxUDPSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > s.ednsUDPSize {
+		size = s.ednsUDPSize
+	}
+	return size
+}
+
+// removeOPT removes the OPT record from the reply, if it has one.
+func removeOPT(reply *dns.Msg) {
+	extra := reply.Extra[:0]
+	for _, rr := range reply.Extra {
+		if _, ok := rr.(*dns.OPT); !ok {
+			extra = append(extra, rr)
+		}
+	}
+	reply.Extra = extra
+
+	// Extended rcodes can only be given in the OPT.
+	if reply.Rcode > 0xF {
+		reply.Rcode = dns.RcodeServerFailure
+	}
 }
 
 // ListenAndServe launches the DNS proxy.
@@ -155,6 +531,18 @@ func (s *Server) ListenAndServe() {
 
 	go s.resolver.Maintain()
 
+	if len(s.warmup) > 0 {
+		go s.warmUp()
+	}
+
+	if s.rrl != nil {
+		go s.rrl.maintain()
+	}
+
+	if s.unixPath != "" {
+		go s.unixServe()
+	}
+
 	if s.Addr == "systemd" {
 		s.systemdServe()
 	} else {
@@ -169,20 +557,48 @@ func (s *Server) classicServe() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := dns.ListenAndServe(s.Addr, "udp", dns.HandlerFunc(s.Handler))
-		log.Fatalf("Exiting UDP: %v", err)
+		pc, err := upgrade.ListenPacket("udp", s.Addr)
+		if err != nil {
+			log.Fatalf("Error listening on UDP: %v%s", err,
+				util.PortConflictHint(s.Addr, err))
+		}
+		s.markPacketConn(pc)
+		srv := &dns.Server{
+			PacketConn:     pc,
+			Handler:        dns.HandlerFunc(s.Handler),
+			DecorateReader: upgrade.DecorateReader,
+		}
+		err = srv.ActivateAndServe()
+		upgrade.Fatalf("Exiting UDP: %v", err)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := dns.ListenAndServe(s.Addr, "tcp", dns.HandlerFunc(s.Handler))
-		log.Fatalf("Exiting TCP: %v", err)
+		l, err := upgrade.Listen("tcp", s.Addr)
+		if err != nil {
+			log.Fatalf("Error listening on TCP: %v%s", err,
+				util.PortConflictHint(s.Addr, err))
+		}
+		err = dns.ActivateAndServe(s.listenerFor(l), nil,
+			dns.HandlerFunc(s.Handler))
+		upgrade.Fatalf("Exiting TCP: %v", err)
 	}()
 
 	wg.Wait()
 }
 
+func (s *Server) unixServe() {
+	l, err := upgrade.ListenUnix(s.unixPath, s.unixMode)
+	if err != nil {
+		log.Fatalf("Error listening on unix socket: %v", err)
+	}
+
+	log.Infof("DNS listening on unix socket %s", s.unixPath)
+	err = dns.ActivateAndServe(l, nil, dns.HandlerFunc(s.Handler))
+	upgrade.Fatalf("Exiting unix socket listener: %v", err)
+}
+
 func (s *Server) systemdServe() {
 	// We will usually have at least one TCP socket and one UDP socket.
 	// PacketConns are UDP sockets, Listeners are TCP sockets.
@@ -209,6 +625,7 @@ func (s *Server) systemdServe() {
 		go func(c net.PacketConn) {
 			defer wg.Done()
 			log.Infof("Activate on packet connection (UDP): %v", c.LocalAddr())
+			s.markPacketConn(c)
 			err := dns.ActivateAndServe(nil, c, dns.HandlerFunc(s.Handler))
 			log.Fatalf("Exiting UDP listener: %v", err)
 		}(pconn)
@@ -223,7 +640,8 @@ func (s *Server) systemdServe() {
 		go func(l net.Listener) {
 			defer wg.Done()
 			log.Infof("Activate on listening socket (TCP): %v", l.Addr())
-			err := dns.ActivateAndServe(l, nil, dns.HandlerFunc(s.Handler))
+			err := dns.ActivateAndServe(s.listenerFor(l), nil,
+				dns.HandlerFunc(s.Handler))
 			log.Fatalf("Exiting TCP listener: %v", err)
 		}(lis)
 	}
@@ -1,7 +1,12 @@
 package dnsserver
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -79,3 +84,191 @@ func queryFailure(t *testing.T, srv, domain string) {
 		t.Errorf("query %q: expected SERVFAIL, got message: %v", domain, m)
 	}
 }
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 1.1.1.1")},
+	}
+
+	path := dir + "/dns.sock"
+	srv := New(testutil.GetFreePort(), res, "")
+	srv.SetUnixSocket(path, 0600)
+	go srv.ListenAndServe()
+	if err := testutil.WaitForUnixSocket(path); err != nil {
+		t.Fatalf("error waiting for the unix socket: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected socket permissions 0600, got %o", perm)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect to unix socket: %v", err)
+	}
+	defer conn.Close()
+
+	// The socket uses DNS over TCP framing: a 2-byte length prefix.
+	m := &dns.Msg{}
+	m.SetQuestion("response.test.", dns.TypeA)
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	binary.Write(conn, binary.BigEndian, uint16(len(packed)))
+	conn.Write(packed)
+
+	var l uint16
+	if err := binary.Read(conn, binary.BigEndian, &l); err != nil {
+		t.Fatalf("failed to read response length: %v", err)
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	reply := &dns.Msg{}
+	if err := reply.Unpack(buf); err != nil {
+		t.Fatalf("failed to unpack response: %v", err)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("unexpected response: %v", reply)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	res := testutil.NewTestResolver()
+	newResponse := func() *dns.Msg {
+		m := &dns.Msg{}
+		for i := 0; i < 100; i++ {
+			m.Answer = append(m.Answer, testutil.NewRR(t,
+				fmt.Sprintf("response.test. A 10.0.0.%d", i)))
+		}
+		return m
+	}
+
+	// The server must have a response to give before we wait for it, as
+	// that sends a query.
+	res.Response = newResponse()
+	srv := New(testutil.GetFreePort(), res, "")
+	srv.SetEDNSUDPSize(1024)
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	cases := []struct {
+		net       string
+		edns      uint16
+		maxSize   int
+		truncated bool
+	}{
+		// No EDNS: 512 bytes.
+		{"udp", 0, 512, true},
+		// EDNS, but our size is smaller than the client's.
+		{"udp", 4096, 1024, true},
+		// EDNS, with the client's size smaller than ours.
+		{"udp", 800, 800, true},
+		// TCP has no limits.
+		{"tcp", 0, dns.MaxMsgSize, false},
+	}
+
+	for _, c := range cases {
+		res.Response = newResponse()
+
+		m := &dns.Msg{}
+		m.SetQuestion("response.test.", dns.TypeA)
+		if c.edns != 0 {
+			m.SetEdns0(c.edns, false)
+		}
+
+		// Don't let the client retry over TCP on its own.
+		client := &dns.Client{Net: c.net, UDPSize: dns.MaxMsgSize}
+		reply, _, err := client.Exchange(m, srv.Addr)
+		if err != nil {
+			t.Errorf("%v: query failed: %v", c, err)
+			continue
+		}
+
+		if reply.Truncated != c.truncated {
+			t.Errorf("%v: expected truncated=%v, got %v",
+				c, c.truncated, reply.Truncated)
+		}
+		// We send the replies compressed, so measure them like that.
+		reply.Compress = true
+		if l := reply.Len(); l > c.maxSize {
+			t.Errorf("%v: reply too large: %d > %d", c, l, c.maxSize)
+		}
+		if !c.truncated && len(reply.Answer) != 100 {
+			t.Errorf("%v: expected 100 answers, got %d", c, len(reply.Answer))
+		}
+		if opt := reply.IsEdns0(); c.edns != 0 &&
+			(opt == nil || opt.UDPSize() != 1024) {
+			t.Errorf("%v: expected OPT with our size, got %v", c, opt)
+		}
+	}
+}
+
+func TestEDNSOptOnlyIfAsked(t *testing.T) {
+	res := testutil.NewTestResolver()
+	srv := New("", res, "")
+	srv.SetEDNSUDPSize(1232)
+
+	send := func(edns bool, rcode int) *dns.Msg {
+		t.Helper()
+		res.Response = newReply(testutil.NewRR(t, "www.example. 60 A 192.0.2.1"))
+		res.Response.Rcode = rcode
+		res.Response.SetEdns0(4096, true)
+
+		m := newQuery("www.example.", dns.TypeA)
+		if edns {
+			m.SetEdns0(4096, false)
+		}
+		w := &recordingWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 1234}}
+		srv.Handler(w, m)
+		if w.reply == nil {
+			t.Fatalf("edns %v: no reply", edns)
+		}
+		return w.reply
+	}
+
+	// The upstream's OPT doesn't reach the clients which didn't use EDNS.
+	if reply := send(false, dns.RcodeSuccess); reply.IsEdns0() != nil ||
+		len(reply.Answer) != 1 {
+		t.Errorf("no EDNS: unexpected reply %v", reply)
+	}
+
+	// And neither do the extended rcodes, which need it.
+	if reply := send(false, dns.RcodeBadVers); reply.IsEdns0() != nil ||
+		reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("no EDNS, extended rcode: unexpected reply %v", reply)
+	}
+
+	// The ones which did use EDNS get our size.
+	if reply := send(true, dns.RcodeSuccess); reply.IsEdns0() == nil ||
+		reply.IsEdns0().UDPSize() != 1232 {
+		t.Errorf("EDNS: unexpected reply %v", reply)
+	}
+}
+
+func TestNoReply(t *testing.T) {
+	// A resolver giving neither a reply nor an error gets us a SERVFAIL,
+	// also through the ones that look at the reply. The name is in upper
+	// case so the normalizing one does.
+	res := testutil.NewTestResolver()
+	srv := New("", NewNormalizingResolver(res), "")
+	w := &recordingWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 1234}}
+	srv.Handler(w, newQuery("WWW.Example.", dns.TypeA))
+	if w.reply == nil || w.reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", w.reply)
+	}
+}
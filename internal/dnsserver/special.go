@@ -0,0 +1,258 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Special-use domains resolver.
+
+// specialResolver implements a Resolver which handles special-use domains
+// (like .local, .onion or .home.arpa, see RFC 6761) locally, according to a
+// per-domain policy, so they never reach the upstream.
+// Everything else is forwarded to the backing resolver.
+type specialResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Policies, indexed by (lowercased, fully qualified) domain.
+	policies map[string]specialPolicy
+
+	negativeReplier
+}
+
+// specialPolicy is what to do with queries for a special-use domain.
+type specialPolicy int
+
+const (
+	// Reply with REFUSED.
+	specialRefuse specialPolicy = iota
+
+	// Reply with NXDOMAIN.
+	specialNXDomain
+
+	// Reply with the loopback addresses (RFC 6761 section 6.3).
+	specialLocalhost
+
+	// Send the query via multicast DNS (RFC 6762).
+	specialMDNS
+
+	// Forward the query to the backing resolver as usual.
+	specialForward
+)
+
+var specialPolicyFromString = map[string]specialPolicy{
+	"refuse":    specialRefuse,
+	"nxdomain":  specialNXDomain,
+	"localhost": specialLocalhost,
+	"mdns":      specialMDNS,
+	"forward":   specialForward,
+}
+
+func (p specialPolicy) String() string {
+	for s, sp := range specialPolicyFromString {
+		if sp == p {
+			return s
+		}
+	}
+	return fmt.Sprintf("unknown-%d", int(p))
+}
+
+// DefaultSpecialDomains are the special-use domains we handle by default, in
+// the format expected by ParseSpecialDomains.
+const DefaultSpecialDomains = "local.=nxdomain onion.=nxdomain" +
+	" invalid.=nxdomain test.=nxdomain home.arpa.=nxdomain" +
+	" localhost.=localhost"
+
+// ParseSpecialDomains parses a space-separated list of "domain=policy"
+// entries, where policy is one of: refuse, nxdomain, localhost, mdns, or
+// forward. It returns a map of domain -> policy, as expected by
+// NewSpecialResolver.
+func ParseSpecialDomains(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, entry := range strings.Fields(s) {
+		sp := strings.SplitN(entry, "=", 2)
+		if len(sp) != 2 || sp[0] == "" {
+			return nil, fmt.Errorf("invalid entry %q (expected domain=policy)",
+				entry)
+		}
+		if _, ok := specialPolicyFromString[sp[1]]; !ok {
+			return nil, fmt.Errorf("unknown policy %q for %q", sp[1], sp[0])
+		}
+		m[sp[0]] = sp[1]
+	}
+	return m, nil
+}
+
+// NewSpecialResolver returns a new resolver which handles the given domains
+// according to their policies (see ParseSpecialDomains), and uses back to
+// resolve everything else.
+func NewSpecialResolver(back Resolver, domains map[string]string) *specialResolver {
+	s := &specialResolver{
+		back:     back,
+		policies: map[string]specialPolicy{},
+
+		negativeReplier: newNegativeReplier(),
+	}
+	for d, p := range domains {
+		s.policies[util.CanonicalName(d)] = specialPolicyFromString[p]
+	}
+	return s
+}
+
+// Exported variables for statistics.
+var specialStats = struct {
+	// Queries for special-use domains, by policy.
+	queries *expvar.Map
+}{}
+
+func init() {
+	specialStats.queries = expvar.NewMap("special-domain-queries")
+}
+
+func (s *specialResolver) Init() error {
+	return s.back.Init()
+}
+
+func (s *specialResolver) Maintain() {
+	s.back.Maintain()
+}
+
+// policy returns the policy for the given name, the special-use domain it
+// is in, and whether it's in one at all.
+func (s *specialResolver) policy(name string) (specialPolicy, string, bool) {
+	name = util.CanonicalName(name)
+	for {
+		if p, ok := s.policies[name]; ok {
+			return p, name, true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return specialForward, "", false
+		}
+		name = name[i+1:]
+	}
+}
+
+func (s *specialResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return s.back.Query(r, tr)
+	}
+
+	question := r.Question[0]
+	policy, domain, ok := s.policy(question.Name)
+	if !ok || policy == specialForward {
+		return s.back.Query(r, tr)
+	}
+
+	tr.LazyPrintf("special-use domain, policy: %v", policy)
+	specialStats.queries.Add(policy.String(), 1)
+
+	reply := newReplyTo(r)
+	switch policy {
+	case specialRefuse:
+		reply.Rcode = dns.RcodeRefused
+	case specialNXDomain:
+		return s.negativeReply(r, dns.RcodeNameError, domain), nil
+	case specialLocalhost:
+		reply.Authoritative = true
+		reply.Answer = localhostAnswer(question)
+	case specialMDNS:
+		return mdnsQuery(r, tr)
+	}
+	return reply, nil
+}
+
+// localhostAnswer returns the answer to a question for a localhost name: the
+// loopback addresses.
+func localhostAnswer(q dns.Question) []dns.RR {
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Class:  dns.ClassINET,
+		Ttl:    300,
+		Rrtype: q.Qtype,
+	}
+
+	switch q.Qtype {
+	case dns.TypeA:
+		return []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)}}
+	case dns.TypeAAAA:
+		return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback}}
+	}
+	return nil
+}
+
+// Address of the mDNS multicast group, and how long we wait for a response.
+var (
+	mdnsAddr    = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsTimeout = 1 * time.Second
+)
+
+// mdnsQuery sends the query via multicast DNS, and returns the first reply.
+//
+// This is a "one-shot" query (RFC 6762 section 5.1): we send it from an
+// ephemeral port, and responders reply to us via unicast, from their own
+// address. That's why we can't use a connected socket (like dns.Exchange
+// does).
+func mdnsQuery(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("mdns listen error: %v", err)
+	}
+	defer conn.Close()
+
+	// mDNS queries don't use recursion.
+	q := r.Copy()
+	q.RecursionDesired = false
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("mdns pack error: %v", err)
+	}
+
+	if _, err := conn.WriteTo(packed, mdnsAddr); err != nil {
+		return nil, fmt.Errorf("mdns write error: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mdnsTimeout))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			// Nobody answered, so as far as we know it doesn't exist.
+			tr.LazyPrintf("mdns: no reply: %v", err)
+			reply := newReplyTo(r)
+			reply.Rcode = dns.RcodeNameError
+			return reply, nil
+		}
+
+		reply := &dns.Msg{}
+		if err := reply.Unpack(buf[:n]); err != nil || reply.Id != r.Id ||
+			!reply.Response {
+			continue
+		}
+
+		tr.LazyPrintf("mdns: reply from %v", from)
+
+		// Clear the cache-flush bit, which mDNS reuses from the class
+		// (RFC 6762 section 10.2).
+		for _, rr := range reply.Answer {
+			rr.Header().Class &^= 1 << 15
+		}
+		reply.Question = r.Question
+		reply.RecursionDesired = r.RecursionDesired
+		reply.RecursionAvailable = true
+		return reply, nil
+	}
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &specialResolver{}
@@ -0,0 +1,144 @@
+package dnsserver
+
+// Tests for the special-use domains resolver.
+
+import (
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseSpecialDomains(t *testing.T) {
+	m, err := ParseSpecialDomains(DefaultSpecialDomains)
+	if err != nil {
+		t.Fatalf("failed to parse the default: %v", err)
+	}
+	if m["local."] != "nxdomain" || m["localhost."] != "localhost" {
+		t.Errorf("unexpected parse result: %v", m)
+	}
+
+	for _, s := range []string{"local.", "=nxdomain", "local.=blah"} {
+		if _, err := ParseSpecialDomains(s); err == nil {
+			t.Errorf("%q: expected error, got nil", s)
+		}
+	}
+}
+
+func TestSpecial(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "upstream. A 1.2.3.4"))
+	s := NewSpecialResolver(back, map[string]string{
+		"local":         "nxdomain",
+		"onion.":        "refuse",
+		"localhost.":    "localhost",
+		"home.arpa.":    "nxdomain",
+		"my.home.arpa.": "forward",
+	})
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+		passed bool
+	}{
+		{"printer.local.", dns.TypeA, dns.RcodeNameError, "", false},
+		{"local.", dns.TypeA, dns.RcodeNameError, "", false},
+		{"Printer.LOCAL.", dns.TypeA, dns.RcodeNameError, "", false},
+		{"xyz.onion.", dns.TypeA, dns.RcodeRefused, "", false},
+		{"localhost.", dns.TypeA, dns.RcodeSuccess, "127.0.0.1", false},
+		{"a.localhost.", dns.TypeAAAA, dns.RcodeSuccess, "::1", false},
+		{"localhost.", dns.TypeMX, dns.RcodeSuccess, "", false},
+		{"nas.home.arpa.", dns.TypeA, dns.RcodeNameError, "", false},
+		{"nas.my.home.arpa.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4", true},
+		{"notlocal.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4", true},
+		{"example.com.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4", true},
+	}
+
+	for _, c := range cases {
+		back.LastQuery = nil
+		tr := testutil.NewTestTrace(t)
+		resp, err := s.Query(newQuery(c.name, c.qtype), tr)
+		if err != nil {
+			t.Errorf("%s: query failed: %v", c.name, err)
+			continue
+		}
+
+		if resp.Rcode != c.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", c.name, c.rcode, resp.Rcode)
+		}
+		answer := ""
+		if len(resp.Answer) == 1 {
+			switch rr := resp.Answer[0].(type) {
+			case *dns.A:
+				answer = rr.A.String()
+			case *dns.AAAA:
+				answer = rr.AAAA.String()
+			}
+		}
+		if answer != c.answer {
+			t.Errorf("%s: expected answer %q, got %v",
+				c.name, c.answer, resp.Answer)
+		}
+		if passed := back.LastQuery != nil; passed != c.passed {
+			t.Errorf("%s: expected passthrough %v, got %v",
+				c.name, c.passed, passed)
+		}
+
+		// The denials are for the whole special-use domain.
+		if c.rcode == dns.RcodeNameError {
+			_, domain, _ := s.policy(c.name)
+			if len(resp.Ns) != 1 || resp.Ns[0].Header().Name != domain {
+				t.Errorf("%s: expected an SOA for %q, got %v",
+					c.name, domain, resp.Ns)
+			}
+		}
+	}
+}
+
+func TestSpecialMDNS(t *testing.T) {
+	// Use a local "responder" instead of the multicast group.
+	addr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(addr, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "printer.local." && r.RecursionDesired {
+			t.Errorf("mDNS query with recursion desired: %v", r)
+		}
+		m := &dns.Msg{}
+		m.SetReply(r)
+		rr := testutil.NewRR(t, "printer.local. A 192.168.1.20")
+		rr.Header().Class |= 1 << 15 // Cache-flush bit.
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	testutil.WaitForDNSServer(addr)
+
+	oldAddr := mdnsAddr
+	defer func() { mdnsAddr = oldAddr }()
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		t.Fatalf("failed to resolve %q: %v", addr, err)
+	}
+	mdnsAddr = udpAddr
+
+	back := testutil.NewTestResolver()
+	s := NewSpecialResolver(back, map[string]string{"local.": "mdns"})
+
+	tr := testutil.NewTestTrace(t)
+	req := newQuery("printer.local.", dns.TypeA)
+	resp, err := s.Query(req, tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("unexpected answer: %v", resp)
+	}
+	if class := resp.Answer[0].Header().Class; class != dns.ClassINET {
+		t.Errorf("expected class IN, got %d", class)
+	}
+	if !resp.RecursionDesired || resp.Id != req.Id {
+		t.Errorf("reply does not match the request: %v", resp)
+	}
+}
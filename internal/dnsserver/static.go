@@ -0,0 +1,180 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Static records resolver.
+
+// staticResolver implements a Resolver which answers authoritatively for a
+// set of static records (loaded from a zone file), and forwards everything
+// else to its backing resolver.
+//
+// This is useful to serve a handful of local records, without needing a
+// separate authoritative server.
+type staticResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Zone file to load the records from.
+	path string
+
+	// Records, indexed by (lowercased) name.
+	records map[string][]dns.RR
+
+	negativeReplier
+}
+
+// NewStaticResolver returns a new resolver which answers with the records in
+// the given zone file, and uses back to resolve everything else.
+func NewStaticResolver(back Resolver, path string) *staticResolver {
+	return &staticResolver{
+		back:    back,
+		path:    path,
+		records: map[string][]dns.RR{},
+
+		negativeReplier: newNegativeReplier(),
+	}
+}
+
+// Exported variables for statistics.
+var staticStats = struct {
+	// Number of static records loaded.
+	records *expvar.Int
+
+	// Queries answered from the static records.
+	answers *expvar.Int
+}{}
+
+func init() {
+	staticStats.records = expvar.NewInt("static-records")
+	staticStats.answers = expvar.NewInt("static-answers")
+}
+
+func (s *staticResolver) Init() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("error loading static records: %v", err)
+	}
+	defer f.Close()
+
+	rrs, err := parseZone(f, s.path)
+	if err != nil {
+		return fmt.Errorf("error loading static records from %q: %v",
+			s.path, err)
+	}
+	s.load(rrs)
+
+	return s.back.Init()
+}
+
+// load the given records.
+func (s *staticResolver) load(rrs []dns.RR) {
+	s.records = map[string][]dns.RR{}
+	for _, rr := range rrs {
+		name := util.CanonicalName(rr.Header().Name)
+		s.records[name] = append(s.records[name], rr)
+	}
+	staticStats.records.Set(int64(len(rrs)))
+}
+
+func (s *staticResolver) Maintain() {
+	s.back.Maintain()
+}
+
+func (s *staticResolver) Query(r *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return s.back.Query(r, tr)
+	}
+
+	question := r.Question[0]
+	rrs, ok := s.records[util.CanonicalName(question.Name)]
+	if !ok {
+		return s.back.Query(r, tr)
+	}
+
+	tr.LazyPrintf("answering from static records")
+	staticStats.answers.Add(1)
+
+	reply := newReplyTo(r)
+	reply.Authoritative = true
+	reply.Answer = matchingRRs(rrs, question)
+	if len(reply.Answer) > 0 {
+		return reply, nil
+	}
+
+	// A CNAME, but the query is for another type: follow it.
+	cname := findCNAME(rrs)
+	if cname == nil || question.Qtype == dns.TypeCNAME {
+		// No records of this type (NODATA). The records don't come with
+		// their zones, so the SOA is for the name itself.
+		nodata := s.negativeReply(r, dns.RcodeSuccess, question.Name)
+		nodata.Authoritative = true
+		return nodata, nil
+	}
+	reply.Answer = []dns.RR{renameRR(cname, question.Name)}
+
+	// If the target is also static, we can answer directly. Note we don't
+	// follow CNAME chains within the static records, as they are meant for
+	// a handful of simple records.
+	target := dns.Question{
+		Name:   cname.Target,
+		Qtype:  question.Qtype,
+		Qclass: question.Qclass,
+	}
+	if trrs, ok := s.records[util.CanonicalName(target.Name)]; ok {
+		reply.Answer = append(reply.Answer, matchingRRs(trrs, target)...)
+		return reply, nil
+	}
+
+	tq := &dns.Msg{}
+	tq.SetQuestion(target.Name, target.Qtype)
+	tq.Id = r.Id
+	tq.RecursionDesired = r.RecursionDesired
+
+	fromUp, err := s.back.Query(tq, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The target is not ours, so we are not authoritative for the full
+	// answer.
+	reply.Authoritative = false
+	reply.Rcode = fromUp.Rcode
+	reply.Answer = append(reply.Answer, fromUp.Answer...)
+	return reply, nil
+}
+
+// matchingRRs returns the records that answer the given question, named as
+// in the question (to preserve its case).
+func matchingRRs(rrs []dns.RR, q dns.Question) []dns.RR {
+	var answer []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			answer = append(answer, renameRR(rr, q.Name))
+		}
+	}
+	return answer
+}
+
+// findCNAME returns the first CNAME in the given records, or nil if there
+// are none.
+func findCNAME(rrs []dns.RR) *dns.CNAME {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return cname
+		}
+	}
+	return nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &staticResolver{}
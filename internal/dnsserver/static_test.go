@@ -0,0 +1,136 @@
+package dnsserver
+
+// Tests for the static records resolver.
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+const testStatic = `
+$ORIGIN lan.
+$TTL 300
+nas		A	192.168.1.10
+nas		AAAA	fd00::10
+nas		TXT	"v=1" "storage"
+nas		MX	10 mail.lan.
+mail		CNAME	nas
+www		CNAME	www.example.com.
+_http._tcp	SRV	0 0 80 nas.lan.
+`
+
+func newTestStatic(t *testing.T) (*staticResolver, *testutil.TestResolver) {
+	rrs, err := parseZone(strings.NewReader(testStatic), "test")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+
+	back := testutil.NewTestResolver()
+	s := NewStaticResolver(back, "")
+	s.load(rrs)
+	return s, back
+}
+
+func TestStatic(t *testing.T) {
+	s, back := newTestStatic(t)
+	back.Response = newReply(mustNewRR(t, "www.example.com. A 1.2.3.4"))
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		answer int
+		auth   bool
+		passed bool
+	}{
+		{"nas.lan.", dns.TypeA, 1, true, false},
+		{"nas.lan.", dns.TypeAAAA, 1, true, false},
+		{"nas.lan.", dns.TypeTXT, 1, true, false},
+		{"nas.lan.", dns.TypeMX, 1, true, false},
+		{"nas.lan.", dns.TypeANY, 4, true, false},
+		{"_http._tcp.lan.", dns.TypeSRV, 1, true, false},
+
+		// NODATA.
+		{"nas.lan.", dns.TypeSRV, 0, true, false},
+
+		// Case-insensitive.
+		{"NAS.Lan.", dns.TypeA, 1, true, false},
+
+		// CNAME to a static record.
+		{"mail.lan.", dns.TypeA, 2, true, false},
+		{"mail.lan.", dns.TypeCNAME, 1, true, false},
+
+		// CNAME to a name we have to resolve.
+		{"www.lan.", dns.TypeA, 2, false, true},
+
+		// Not ours (the test resolver always sets the authoritative bit).
+		{"other.lan.", dns.TypeA, 1, true, true},
+	}
+
+	for _, c := range cases {
+		back.LastQuery = nil
+		tr := testutil.NewTestTrace(t)
+		resp, err := s.Query(newQuery(c.name, c.qtype), tr)
+		if err != nil {
+			t.Errorf("%s %d: query failed: %v", c.name, c.qtype, err)
+			continue
+		}
+
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s %d: unexpected rcode %d", c.name, c.qtype, resp.Rcode)
+		}
+		if len(resp.Answer) != c.answer {
+			t.Errorf("%s %d: expected %d answers, got %v",
+				c.name, c.qtype, c.answer, resp.Answer)
+		}
+		if len(resp.Answer) > 0 && resp.Answer[0].Header().Name != c.name &&
+			!c.passed {
+			t.Errorf("%s %d: answer does not preserve the name: %v",
+				c.name, c.qtype, resp.Answer[0])
+		}
+		if resp.Authoritative != c.auth {
+			t.Errorf("%s %d: expected authoritative %v, got %v",
+				c.name, c.qtype, c.auth, resp.Authoritative)
+		}
+		if passed := back.LastQuery != nil; passed != c.passed {
+			t.Errorf("%s %d: expected passthrough %v, got %v",
+				c.name, c.qtype, c.passed, passed)
+		}
+		if c.answer == 0 && (len(resp.Ns) != 1 ||
+			resp.Ns[0].Header().Rrtype != dns.TypeSOA) {
+			t.Errorf("%s %d: expected an SOA for the NODATA, got %v",
+				c.name, c.qtype, resp.Ns)
+		}
+	}
+}
+
+func TestStaticInit(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnss_static_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testStatic)
+	f.Close()
+
+	back := testutil.NewTestResolver()
+	s := NewStaticResolver(back, f.Name())
+	if err := s.Init(); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	if !back.Initialized {
+		t.Errorf("backing resolver was not initialized")
+	}
+	if len(s.records) != 4 {
+		t.Errorf("expected 4 names, got %v", s.records)
+	}
+
+	if err := NewStaticResolver(back, "/doesnotexist").Init(); err == nil {
+		t.Errorf("loading a missing file worked")
+	}
+}
@@ -0,0 +1,178 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Dynamic DNS updates (RFC 2136).
+
+// updateForwarder forwards dynamic updates to a designated server (usually
+// the internal primary of the zones, like an Active Directory domain
+// controller). They are never given to the resolver, as they make no sense
+// to the DoH upstream, and would leak internal names to it.
+//
+// Only the zones with an allow rule can be updated, and only from the
+// networks in it. If we have a key, the updates are signed with it, so the
+// server can require TSIG.
+//
+// Updates signed by the clients themselves (like Windows' GSS-TSIG) are
+// refused: we can't forward them without breaking the signature, as we
+// re-encode the messages. The server must accept the updates from us, either
+// signed with our key, or unsigned.
+type updateForwarder struct {
+	// Address (host:port) of the server to send the updates to.
+	server string
+
+	// Key to sign the updates with (nil if none).
+	key *TSIGKey
+
+	// Networks allowed to update each zone, indexed by (lowercased, fully
+	// qualified) zone.
+	rules map[string][]*net.IPNet
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Function to send the update to the server, so tests can fake it.
+	exchange func(m *dns.Msg, addr string, key *TSIGKey) (*dns.Msg, error)
+}
+
+// Exported variables for statistics.
+var updateStats = struct {
+	// Updates received, by result (forwarded, refused or failed).
+	updates *expvar.Map
+}{}
+
+func init() {
+	updateStats.updates = expvar.NewMap("dns-updates")
+}
+
+// ParseUpdateRules parses a space-separated list of "zone=net1[;net2...]"
+// entries, which allow the clients in the given networks to update the zone
+// (and the zones below it). It returns them as expected by
+// SetUpdateForwarding.
+func ParseUpdateRules(s string) (map[string][]*net.IPNet, error) {
+	rules := map[string][]*net.IPNet{}
+	for _, entry := range strings.Fields(s) {
+		sp := strings.SplitN(entry, "=", 2)
+		if len(sp) != 2 || sp[0] == "" || sp[1] == "" {
+			return nil, fmt.Errorf("invalid entry %q (expected zone=networks)",
+				entry)
+		}
+
+		zone := util.CanonicalName(sp[0])
+		for _, n := range strings.Split(sp[1], ";") {
+			_, ipnet, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q for %q", n, sp[0])
+			}
+			rules[zone] = append(rules[zone], ipnet)
+		}
+	}
+	return rules, nil
+}
+
+// SetUpdateForwarding makes the server forward the dynamic updates (RFC
+// 2136) for the zones in the rules (see ParseUpdateRules) to the given
+// server, signed with the key if it's not nil. Without it, all updates are
+// refused.
+func (s *Server) SetUpdateForwarding(server string, key *TSIGKey, rules map[string][]*net.IPNet) {
+	s.update = &updateForwarder{
+		server:   server,
+		key:      key,
+		rules:    rules,
+		clock:    util.RealClock,
+		exchange: exchangeWithKey,
+	}
+}
+
+// allowed returns true if the client can update the zone.
+func (u *updateForwarder) allowed(zone string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	zone = util.CanonicalName(zone)
+	for {
+		for _, n := range u.rules[zone] {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		i := strings.Index(zone, ".")
+		if i < 0 || i == len(zone)-1 {
+			return false
+		}
+		zone = zone[i+1:]
+	}
+}
+
+// handleUpdate handles a dynamic update message, forwarding it to the
+// configured server if the client can update the zone, or refusing it
+// otherwise.
+func (s *Server) handleUpdate(w dns.ResponseWriter, r *dns.Msg, tr trace.Trace) {
+	refuse := func(format string, a ...interface{}) {
+		tr.LazyPrintf("update refused: "+format, a...)
+		updateStats.updates.Add("refused", 1)
+		reply := &dns.Msg{}
+		reply.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(reply)
+	}
+
+	u := s.update
+	switch {
+	case u == nil:
+		refuse("updates are not enabled")
+		return
+	case len(r.Question) != 1:
+		refuse("%d zones", len(r.Question))
+		return
+	case r.IsTsig() != nil:
+		refuse("signed by the client")
+		return
+	}
+
+	zone := r.Question[0].Name
+	ip := addrIP(w.RemoteAddr())
+	if !u.allowed(zone, ip) {
+		refuse("%v can't update %q", ip, zone)
+		return
+	}
+
+	m := r.Copy()
+	if u.key != nil {
+		m.SetTsig(u.key.Name, u.key.Algorithm, tsigFudge, u.clock.Now().Unix())
+	}
+
+	start := time.Now()
+	reply, err := u.exchange(m, u.server, u.key)
+	if err == nil && u.key != nil && reply.IsTsig() == nil {
+		err = errUnsignedReply
+	}
+	if err != nil {
+		util.TraceErrorf(tr, "update for %q to %s failed: %v",
+			zone, u.server, err)
+		updateStats.updates.Add("failed", 1)
+		dns.HandleFailed(w, r)
+		return
+	}
+
+	tr.LazyPrintf("update for %q forwarded to %s in %v: rcode %d",
+		zone, u.server, time.Since(start), reply.Rcode)
+	updateStats.updates.Add("forwarded", 1)
+	if reply.IsTsig() != nil {
+		reply.Extra = reply.Extra[:len(reply.Extra)-1]
+	}
+	reply.Id = r.Id
+	w.WriteMsg(reply)
+}
@@ -0,0 +1,140 @@
+package dnsserver
+
+// Tests for the dynamic updates forwarding.
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// recordingWriter is a dns.ResponseWriter which records the reply.
+type recordingWriter struct {
+	remote net.Addr
+	reply  *dns.Msg
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *recordingWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error   { w.reply = m; return nil }
+func (w *recordingWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *recordingWriter) Close() error                { return nil }
+func (w *recordingWriter) TsigStatus() error           { return nil }
+func (w *recordingWriter) TsigTimersOnly(bool)         {}
+func (w *recordingWriter) Hijack()                     {}
+
+func newUpdate(t *testing.T, zone string) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(zone, dns.TypeSOA)
+	m.Opcode = dns.OpcodeUpdate
+	m.Ns = []dns.RR{mustNewRR(t, "host."+zone+" 300 A 10.0.0.7")}
+	return m
+}
+
+func TestParseUpdateRules(t *testing.T) {
+	rules, err := ParseUpdateRules(
+		"corp.example=10.0.0.0/8;fd00::/8 Lab.example.=192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if len(rules["corp.example."]) != 2 || len(rules["lab.example."]) != 1 {
+		t.Errorf("unexpected rules: %v", rules)
+	}
+
+	for _, s := range []string{"corp.example", "corp.example=", "=10.0.0.0/8",
+		"corp.example=10.0.0.1"} {
+		if _, err := ParseUpdateRules(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	res := testutil.NewTestResolver()
+	srv := New("", res, "")
+
+	send := func(m *dns.Msg, from string) *dns.Msg {
+		t.Helper()
+		w := &recordingWriter{remote: &net.UDPAddr{IP: net.ParseIP(from), Port: 1234}}
+		srv.Handler(w, m)
+		if res.LastQuery != nil {
+			t.Errorf("update given to the resolver: %v", res.LastQuery)
+		}
+		if w.reply == nil {
+			t.Fatalf("no reply")
+		}
+		return w.reply
+	}
+
+	// Updates are refused by default.
+	reply := send(newUpdate(t, "corp.example."), "10.0.0.7")
+	if reply.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED, got %v", reply)
+	}
+
+	rules, _ := ParseUpdateRules("corp.example=10.0.0.0/8")
+	key := &TSIGKey{Name: "dnss-key.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0"}
+	srv.SetUpdateForwarding("10.0.0.1:53", key, rules)
+
+	var forwarded []*dns.Msg
+	serverDown := false
+	srv.update.exchange = func(m *dns.Msg, addr string, k *TSIGKey) (*dns.Msg, error) {
+		if serverDown {
+			return nil, errors.New("timeout")
+		}
+		forwarded = append(forwarded, m)
+		reply := &dns.Msg{}
+		reply.SetReply(m)
+		reply.Extra = nil
+		reply.SetTsig(k.Name, k.Algorithm, 300, 0)
+		return reply, nil
+	}
+
+	cases := []struct {
+		zone, from string
+		rcode      int
+	}{
+		{"corp.example.", "10.0.0.7", dns.RcodeSuccess},
+		{"sub.corp.example.", "10.0.0.7", dns.RcodeSuccess},
+		{"corp.example.", "192.0.2.7", dns.RcodeRefused},
+		{"other.example.", "10.0.0.7", dns.RcodeRefused},
+	}
+	for _, c := range cases {
+		forwarded = nil
+		m := newUpdate(t, c.zone)
+		reply := send(m, c.from)
+		if reply.Rcode != c.rcode {
+			t.Errorf("%s from %s: got rcode %d, expected %d",
+				c.zone, c.from, reply.Rcode, c.rcode)
+		}
+		if c.rcode != dns.RcodeSuccess {
+			continue
+		}
+		if len(forwarded) != 1 || forwarded[0].IsTsig() == nil ||
+			forwarded[0].IsTsig().Hdr.Name != "dnss-key." {
+			t.Errorf("%s: update not forwarded signed: %v", c.zone, forwarded)
+		}
+		if reply.Id != m.Id || reply.IsTsig() != nil {
+			t.Errorf("%s: unexpected reply: %v", c.zone, reply)
+		}
+	}
+
+	// Updates signed by the client are refused, as we can't forward them.
+	m := newUpdate(t, "corp.example.")
+	m.SetTsig("client-key.", dns.HmacSHA256, 300, 0)
+	if reply := send(m, "10.0.0.7"); reply.Rcode != dns.RcodeRefused {
+		t.Errorf("signed update: expected REFUSED, got %v", reply)
+	}
+
+	serverDown = true
+	reply = send(newUpdate(t, "corp.example."), "10.0.0.7")
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("server down: expected SERVFAIL, got %v", reply)
+	}
+}
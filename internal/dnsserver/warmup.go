@@ -0,0 +1,118 @@
+package dnsserver
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Cache warm-up.
+
+// How many warm-up queries to have in flight at the same time, declared as
+// a variable so we can tweak it for testing.
+var warmupConcurrency = 8
+
+// Exported variables for statistics.
+var warmupStats = struct {
+	// Warm-up queries sent, and how many of them failed.
+	queries *expvar.Int
+	errors  *expvar.Int
+}{}
+
+func init() {
+	warmupStats.queries = expvar.NewInt("warmup-queries")
+	warmupStats.errors = expvar.NewInt("warmup-errors")
+}
+
+// LoadWarmupDomains loads the list of domains to resolve at startup from the
+// given file. It has one domain per line, optionally followed by the types
+// to query (A and AAAA by default), like "example.com A AAAA MX".
+// Empty lines and lines starting with # are ignored.
+func LoadWarmupDomains(path string) ([]dns.Question, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var qs []dns.Question
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		name := dns.Fqdn(fields[0])
+		types := fields[1:]
+		if len(types) == 0 {
+			types = []string{"A", "AAAA"}
+		}
+		for _, t := range types {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown type %q", n, t)
+			}
+			qs = append(qs, dns.Question{
+				Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+		}
+	}
+	return qs, scanner.Err()
+}
+
+// SetWarmup makes the server resolve the given questions when it starts, to
+// have them in the cache by the time the clients ask.
+func (s *Server) SetWarmup(qs []dns.Question) {
+	s.warmup = qs
+}
+
+// warmUp resolves the warm-up questions, a few at a time.
+func (s *Server) warmUp() {
+	tr := trace.New("dnsserver.Warmup", "warm up")
+	defer tr.Finish()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errors := 0
+
+	sem := make(chan bool, warmupConcurrency)
+	for _, q := range s.warmup {
+		sem <- true
+		wg.Add(1)
+		go func(q dns.Question) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			m := &dns.Msg{}
+			m.SetQuestion(q.Name, q.Qtype)
+			m.Id = <-newID
+			warmupStats.queries.Add(1)
+			if _, err := s.resolver.Query(m, tr); err != nil {
+				warmupStats.errors.Add(1)
+				tr.LazyPrintf("%s %s: %v", q.Name, dns.Type(q.Qtype), err)
+				mu.Lock()
+				errors++
+				mu.Unlock()
+			}
+		}(q)
+	}
+	wg.Wait()
+
+	tr.LazyPrintf("done: %d queries, %d errors", len(s.warmup), errors)
+	log.Infof("Cache warm-up: %d queries in %v (%d errors)",
+		len(s.warmup), time.Since(start), errors)
+}
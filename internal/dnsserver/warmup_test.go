@@ -0,0 +1,95 @@
+package dnsserver
+
+// Tests for the cache warm-up.
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// countingResolver is a Resolver which records the queries it gets, and the
+// most it had in flight at once.
+type countingResolver struct {
+	*testutil.TestResolver
+
+	mu          sync.Mutex
+	questions   []dns.Question
+	inflight    int
+	maxInflight int
+}
+
+func (r *countingResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	r.mu.Lock()
+	r.questions = append(r.questions, req.Question[0])
+	r.inflight++
+	if r.inflight > r.maxInflight {
+		r.maxInflight = r.inflight
+	}
+	r.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	r.mu.Lock()
+	r.inflight--
+	r.mu.Unlock()
+
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	return reply, nil
+}
+
+func TestWarmup(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnss_warmup_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+# Popular domains.
+example.com
+example.net.   mx Txt
+a.example
+  b.example
+c.example
+d.example
+	`)
+	f.Close()
+
+	qs, err := LoadWarmupDomains(f.Name())
+	if err != nil {
+		t.Fatalf("error loading domains: %v", err)
+	}
+	if len(qs) != 12 {
+		t.Fatalf("expected 12 questions, got %v", qs)
+	}
+	if qs[0].Name != "example.com." || qs[1].Qtype != dns.TypeAAAA ||
+		qs[3].Qtype != dns.TypeTXT {
+		t.Errorf("unexpected questions: %v", qs)
+	}
+
+	if _, err := LoadWarmupDomains("/doesnotexist"); err == nil {
+		t.Errorf("loading a missing file worked")
+	}
+
+	oldConcurrency := warmupConcurrency
+	warmupConcurrency = 2
+	defer func() { warmupConcurrency = oldConcurrency }()
+
+	res := &countingResolver{TestResolver: testutil.NewTestResolver()}
+	srv := New("", res, "")
+	srv.SetWarmup(qs)
+	srv.warmUp()
+
+	if len(res.questions) != 12 || res.maxInflight > 2 {
+		t.Errorf("unexpected warm-up: %d questions, %d max in flight",
+			len(res.questions), res.maxInflight)
+	}
+}
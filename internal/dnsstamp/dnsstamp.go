@@ -0,0 +1,277 @@
+// Package dnsstamp implements parsing of DNS stamps (sdns:// URLs), which
+// encode everything needed to connect to a DNS server: protocol, address,
+// hostname, certificate hashes and properties.
+//
+// They are used, among others, by the resolver lists published for
+// dnscrypt-proxy. The format is specified in
+// https://dnscrypt.info/stamps-specifications.
+package dnsstamp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Proto is the protocol a stamp refers to.
+type Proto byte
+
+// Known protocols.
+const (
+	ProtoPlain      = Proto(0x00)
+	ProtoDNSCrypt   = Proto(0x01)
+	ProtoDoH        = Proto(0x02)
+	ProtoDoT        = Proto(0x03)
+	ProtoDoQ        = Proto(0x04)
+	ProtoODoHTarget = Proto(0x05)
+)
+
+var protoToString = map[Proto]string{
+	ProtoPlain:      "plain DNS",
+	ProtoDNSCrypt:   "DNSCrypt",
+	ProtoDoH:        "DNS over HTTPS",
+	ProtoDoT:        "DNS over TLS",
+	ProtoDoQ:        "DNS over QUIC",
+	ProtoODoHTarget: "Oblivious DoH",
+}
+
+func (p Proto) String() string {
+	if s, ok := protoToString[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown protocol 0x%02x", byte(p))
+}
+
+// Props are the informal properties of the server, as announced by the stamp.
+type Props uint64
+
+// Known properties.
+const (
+	PropDNSSEC   = Props(1 << 0)
+	PropNoLogs   = Props(1 << 1)
+	PropNoFilter = Props(1 << 2)
+)
+
+// Stamp contains the information decoded from a DNS stamp.
+// Fields which are not relevant for the stamp's protocol are left empty.
+type Stamp struct {
+	Proto Proto
+	Props Props
+
+	// Server address, as "host:port". If the stamp did not include a port,
+	// the protocol's default one is used. May be empty if the stamp did not
+	// include an address (in which case the hostname should be resolved).
+	Addr string
+
+	// SHA256 digests of the TBS certificates in the server's validation
+	// chain. At least one of them must match, if not empty.
+	Hashes [][]byte
+
+	// Server hostname (with optional port), used for TLS and for HTTP.
+	Host string
+
+	// HTTP path, for DoH.
+	Path string
+
+	// Addresses that can be used to resolve the hostname.
+	Bootstrap []string
+
+	// DNSCrypt provider public key and name.
+	PublicKey    []byte
+	ProviderName string
+}
+
+// IsStamp returns true if the given string looks like a DNS stamp.
+func IsStamp(s string) bool {
+	return strings.HasPrefix(s, "sdns://")
+}
+
+var (
+	errNotStamp  = errors.New("not a DNS stamp (no sdns:// prefix)")
+	errTruncated = errors.New("stamp is truncated")
+	errTrailing  = errors.New("stamp has trailing garbage")
+)
+
+// Parse the given DNS stamp.
+func Parse(s string) (*Stamp, error) {
+	if !IsStamp(s) {
+		return nil, errNotStamp
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimPrefix(s, "sdns://"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 in stamp: %v", err)
+	}
+	if len(raw) < 1 {
+		return nil, errTruncated
+	}
+
+	st := &Stamp{Proto: Proto(raw[0])}
+	d := &decoder{buf: raw[1:]}
+
+	switch st.Proto {
+	case ProtoPlain:
+		st.Props = d.props()
+		st.Addr = d.lp()
+	case ProtoDNSCrypt:
+		st.Props = d.props()
+		st.Addr = d.lp()
+		st.PublicKey = []byte(d.lp())
+		st.ProviderName = d.lp()
+	case ProtoDoH:
+		st.Props = d.props()
+		st.Addr = d.lp()
+		st.Hashes = d.hashes()
+		st.Host = d.lp()
+		st.Path = d.lp()
+		if !d.empty() {
+			st.Bootstrap = d.vlp()
+		}
+	case ProtoDoT, ProtoDoQ:
+		st.Props = d.props()
+		st.Addr = d.lp()
+		st.Hashes = d.hashes()
+		st.Host = d.lp()
+		if !d.empty() {
+			st.Bootstrap = d.vlp()
+		}
+	case ProtoODoHTarget:
+		st.Props = d.props()
+		st.Host = d.lp()
+		st.Path = d.lp()
+	default:
+		return nil, fmt.Errorf("unsupported stamp: %v", st.Proto)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if !d.empty() {
+		return nil, errTrailing
+	}
+
+	if st.Addr != "" {
+		st.Addr, err = addDefaultPort(st.Addr, defaultPort[st.Proto])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// URL returns the URL to use for DoH stamps.
+func (s *Stamp) URL() *url.URL {
+	return &url.URL{
+		Scheme: "https",
+		Host:   s.Host,
+		Path:   s.Path,
+	}
+}
+
+var defaultPort = map[Proto]string{
+	ProtoPlain:    "53",
+	ProtoDNSCrypt: "443",
+	ProtoDoH:      "443",
+	ProtoDoT:      "853",
+	ProtoDoQ:      "853",
+}
+
+// addDefaultPort adds the given port to addr, if it does not have one.
+// IPv6 addresses are expected to be between brackets, as in URLs.
+func addDefaultPort(addr, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid address %q in stamp", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// decoder reads the different components of a stamp, keeping track of the
+// first error found so the callers don't have to check for each one.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) empty() bool {
+	return len(d.buf) == 0
+}
+
+func (d *decoder) props() Props {
+	if len(d.buf) < 8 {
+		d.fail()
+		return 0
+	}
+
+	// Little-endian 64 bit integer.
+	var p Props
+	for i := 7; i >= 0; i-- {
+		p = p<<8 | Props(d.buf[i])
+	}
+	d.buf = d.buf[8:]
+	return p
+}
+
+// lp reads a length-prefixed string.
+func (d *decoder) lp() string {
+	if len(d.buf) < 1 {
+		d.fail()
+		return ""
+	}
+
+	l := int(d.buf[0])
+	if len(d.buf) < 1+l {
+		d.fail()
+		return ""
+	}
+
+	s := string(d.buf[1 : 1+l])
+	d.buf = d.buf[1+l:]
+	return s
+}
+
+// vlp reads a variable length list of length-prefixed strings. Each element
+// has the high bit of the length set, except for the last one.
+func (d *decoder) vlp() []string {
+	var ss []string
+	for d.err == nil {
+		if len(d.buf) < 1 {
+			d.fail()
+			return nil
+		}
+
+		more := d.buf[0]&0x80 != 0
+		d.buf[0] &^= 0x80
+		if s := d.lp(); s != "" {
+			ss = append(ss, s)
+		}
+		if !more {
+			break
+		}
+	}
+	return ss
+}
+
+func (d *decoder) hashes() [][]byte {
+	var hs [][]byte
+	for _, h := range d.vlp() {
+		hs = append(hs, []byte(h))
+	}
+	return hs
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errTruncated
+	}
+	d.buf = nil
+}
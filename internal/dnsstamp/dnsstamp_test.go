@@ -0,0 +1,114 @@
+package dnsstamp
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	hash := mustHex(
+		"2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881")
+
+	cases := []struct {
+		stamp    string
+		expected Stamp
+	}{
+		{
+			"sdns://AgEAAAAAAAAABzEuMS4xLjEgLXEWQrcmsEQBYnyp-6wy9chTD7GQPMTbAiWHF5IaSIESY2xvdWRmbGFyZS1kbnMuY29tCi9kbnMtcXVlcnk",
+			Stamp{
+				Proto:  ProtoDoH,
+				Props:  PropDNSSEC,
+				Addr:   "1.1.1.1:443",
+				Hashes: [][]byte{hash},
+				Host:   "cloudflare-dns.com",
+				Path:   "/dns-query",
+			},
+		},
+		// IPv6 with port, multiple hashes, and bootstrap servers.
+		{
+			"sdns://AgcAAAAAAAAAFlsyNjA2OjQ3MDA6OjExMTFdOjg0NDOgLXEWQrcmsEQBYnyp-6wy9chTD7GQPMTbAiWHF5IaSIEgLXEWQrcmsEQBYnyp-6wy9chTD7GQPMTbAiWHF5IaSIEQZG9oLmV4YW1wbGU6ODQ0MwIvcQc5LjkuOS45",
+			Stamp{
+				Proto:     ProtoDoH,
+				Props:     PropDNSSEC | PropNoLogs | PropNoFilter,
+				Addr:      "[2606:4700::1111]:8443",
+				Hashes:    [][]byte{hash, hash},
+				Host:      "doh.example:8443",
+				Path:      "/q",
+				Bootstrap: []string{"9.9.9.9"},
+			},
+		},
+		{
+			"sdns://AAEAAAAAAAAABzguOC44Ljg",
+			Stamp{
+				Proto: ProtoPlain,
+				Props: PropDNSSEC,
+				Addr:  "8.8.8.8:53",
+			},
+		},
+		{
+			"sdns://AAAAAAAAAAAAElsyMDAxOmRiODo6MV06NTM1Mw",
+			Stamp{
+				Proto: ProtoPlain,
+				Addr:  "[2001:db8::1]:5353",
+			},
+		},
+		{
+			"sdns://AwAAAAAAAAAABzEuMS4xLjEAD29uZS5vbmUub25lLm9uZQ",
+			Stamp{
+				Proto: ProtoDoT,
+				Addr:  "1.1.1.1:853",
+				Host:  "one.one.one.one",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		st, err := Parse(c.stamp)
+		if err != nil {
+			t.Errorf("%q: error: %v", c.stamp, err)
+			continue
+		}
+		if !reflect.DeepEqual(*st, c.expected) {
+			t.Errorf("%q: expected %+v, got %+v", c.stamp, c.expected, *st)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"https://dns.google/dns-query",
+		"sdns://",
+		"sdns://!!!",
+		// Truncated: missing the path.
+		"sdns://AgEAAAAAAAAABzEuMS4xLjEAEmNsb3VkZmxhcmUtZG5zLmNvbQ",
+		// Unknown protocol.
+		"sdns://fwAAAAAAAAAA",
+		// Invalid address (not an IP).
+		"sdns://AAAAAAAAAAAAB2V4YW1wbGU",
+		// Trailing garbage.
+		"sdns://AAEAAAAAAAAABzguOC44LjgA",
+	}
+
+	for _, c := range cases {
+		if st, err := Parse(c); err == nil {
+			t.Errorf("%q: expected error, got %+v", c, st)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	st := &Stamp{Proto: ProtoDoH, Host: "dns.google", Path: "/dns-query"}
+	if u := st.URL().String(); u != "https://dns.google/dns-query" {
+		t.Errorf("unexpected URL: %q", u)
+	}
+}
@@ -0,0 +1,327 @@
+package httpresolver
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// autoResolver implements the dnsserver.Resolver interface by probing
+// different transports to the same upstream, and using the best one that
+// works.
+//
+// The transports are tried in order of preference: DoH over HTTP/2, DNS over
+// TLS, DoH over HTTP/1.1, and JSON. This helps on networks that block some
+// of them (e.g. port 853, or HTTP/2).
+//
+// Note HTTP/3 is not supported, as we have no QUIC implementation.
+type autoResolver struct {
+	transports []transport
+
+	// Fraction of the queries which are also sent over another transport,
+	// chosen at random, to compare their latencies (see
+	// autoStats.latency). 0 disables it.
+	SampleRate float64
+
+	// Protects the fields below.
+	mu *sync.Mutex
+
+	// Index of the transport in use.
+	current int
+
+	// Consecutive failures of the current transport.
+	failures int
+
+	// Are we probing right now?
+	probing bool
+
+	// Was it closed? If so, we don't probe anymore.
+	closed bool
+}
+
+// transport is one of the possible ways of reaching the upstream.
+type transport struct {
+	name string
+	r    dnsserver.Resolver
+}
+
+// NewAuto creates a new resolver which probes the upstream of the given one
+// over the different transports, and uses the best working one.
+// The given resolver is used as a template, and should not be used
+// directly.
+func NewAuto(base *httpsResolver) *autoResolver {
+	doh := *base
+	doh.mode = "DoH"
+
+	doh1 := *base
+	doh1.mode = "DoH"
+	doh1.http1Only = true
+
+	jsonr := *base
+	jsonr.mode = "JSON"
+
+	return &autoResolver{
+		transports: []transport{
+			{"DoH (HTTP/2)", &doh},
+			{"DoT", newDoT(base)},
+			{"DoH (HTTP/1.1)", &doh1},
+			{"JSON", &jsonr},
+		},
+		mu: &sync.Mutex{},
+	}
+}
+
+// Exported variables for statistics.
+var autoStats = struct {
+	// Transport in use.
+	transport *expvar.String
+
+	// Number of times we probed the transports.
+	probes *expvar.Int
+
+	// Latency of the queries, by transport (see latencyStats).
+	latency *expvar.Map
+}{}
+
+func init() {
+	autoStats.transport = expvar.NewString("upstream-transport")
+	autoStats.probes = expvar.NewInt("upstream-transport-probes")
+	autoStats.latency = expvar.NewMap("upstream-transport-latency")
+}
+
+// latencyStats keeps track of the latency of the queries over a transport.
+// It's exported as a JSON object, with the number of queries, how many of
+// them failed, and the average latency of the successful ones.
+type latencyStats struct {
+	mu     *sync.Mutex
+	count  int64
+	errors int64
+	total  time.Duration
+}
+
+func (l *latencyStats) add(d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	if err != nil {
+		l.errors++
+	} else {
+		l.total += d
+	}
+}
+
+func (l *latencyStats) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	avg := 0.0
+	if ok := l.count - l.errors; ok > 0 {
+		avg = l.total.Seconds() * 1000 / float64(ok)
+	}
+	return fmt.Sprintf(`{"count": %d, "errors": %d, "avg_ms": %.2f}`,
+		l.count, l.errors, avg)
+}
+
+// Protects the creation of the latency stats.
+var latencyMu sync.Mutex
+
+// recordLatency of a query over the given transport.
+func recordLatency(name string, d time.Duration, err error) {
+	latencyMu.Lock()
+	l, ok := autoStats.latency.Get(name).(*latencyStats)
+	if !ok {
+		l = &latencyStats{mu: &sync.Mutex{}}
+		autoStats.latency.Set(name, l)
+	}
+	latencyMu.Unlock()
+
+	l.add(d, err)
+}
+
+// How many consecutive failures of the current transport we tolerate before
+// probing them again.
+var maxTransportFailures = 5
+
+func (r *autoResolver) Init() error {
+	for _, t := range r.transports {
+		if err := t.r.Init(); err != nil {
+			return fmt.Errorf("error initializing %s: %v", t.name, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.probing = true
+	r.mu.Unlock()
+	r.probe()
+	return nil
+}
+
+func (r *autoResolver) Maintain() {
+	for _, t := range r.transports {
+		go t.r.Maintain()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of all the transports.
+func (r *autoResolver) CloseIdleConnections() {
+	for _, t := range r.transports {
+		if hr, ok := t.r.(*httpsResolver); ok {
+			hr.CloseIdleConnections()
+		}
+	}
+}
+
+// Close stops the resolver: no more probes are started, and the idle
+// connections of the transports are closed. It must not be used afterwards.
+func (r *autoResolver) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.CloseIdleConnections()
+}
+
+// NetworkChanged resets the connections of all the transports, and probes
+// them again, as the best one may be different on the new network.
+func (r *autoResolver) NetworkChanged() {
+	r.CloseIdleConnections()
+	r.Reprobe()
+}
+
+// Reprobe the transports (in the background), unless we are already doing
+// it. Useful when the network changes.
+func (r *autoResolver) Reprobe() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.probing || r.closed {
+		return
+	}
+	r.probing = true
+	go r.probe()
+}
+
+// probe the transports in order, and select the first one that works. If
+// none of them does, we keep the current one.
+// The caller must have set r.probing.
+func (r *autoResolver) probe() {
+	tr := trace.New("httpresolver.Auto", "probe")
+	defer tr.Finish()
+	autoStats.probes.Add(1)
+
+	selected := -1
+	for i, t := range r.transports {
+		req := &dns.Msg{}
+		req.SetQuestion(".", dns.TypeNS)
+		reply, err := t.r.Query(req, tr)
+		if err == nil && reply.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("rcode %s", dns.RcodeToString[reply.Rcode])
+		}
+		if err != nil {
+			tr.LazyPrintf("%s: %v", t.name, err)
+			log.Infof("Upstream probe: %s does not work: %v", t.name, err)
+			continue
+		}
+
+		tr.LazyPrintf("%s: ok", t.name)
+		selected = i
+		break
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probing = false
+	r.failures = 0
+
+	if selected < 0 {
+		tr.SetError()
+		log.Errorf("Upstream probe: no transport works, keeping %s",
+			r.transports[r.current].name)
+	} else {
+		r.current = selected
+		log.Infof("Upstream probe: using %s", r.transports[selected].name)
+	}
+	autoStats.transport.Set(r.transports[r.current].name)
+}
+
+func (r *autoResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	r.mu.Lock()
+	current := r.current
+	t := r.transports[current]
+	r.mu.Unlock()
+
+	start := time.Now()
+	reply, err := t.r.Query(req, tr)
+	abandoned := err != nil && util.Context(tr).Err() != nil
+	if err != errBusy && !abandoned {
+		recordLatency(t.name, time.Since(start), err)
+	}
+
+	if r.SampleRate > 0 && rand.Float64() < r.SampleRate {
+		r.sample(req, current)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.failures = 0
+		return reply, nil
+	}
+
+	// The transport is busy, or the client abandoned the query, but that
+	// doesn't mean it doesn't work.
+	if err == errBusy || abandoned {
+		return reply, err
+	}
+
+	r.failures++
+	if r.failures >= maxTransportFailures && !r.probing && !r.closed {
+		tr.LazyPrintf("%s failed %d times in a row, probing",
+			t.name, r.failures)
+		r.probing = true
+		go r.probe()
+	}
+	return reply, err
+}
+
+// sample sends the query over a transport other than the current one, chosen
+// at random, to compare their latencies. It's done in the background, and
+// the reply is discarded.
+func (r *autoResolver) sample(req *dns.Msg, current int) {
+	if len(r.transports) < 2 {
+		return
+	}
+	i := rand.Intn(len(r.transports) - 1)
+	if i >= current {
+		i++
+	}
+	t := r.transports[i]
+
+	m := req.Copy()
+	m.Id = dns.Id()
+	go func() {
+		tr := trace.New("httpresolver.Auto", "sample")
+		defer tr.Finish()
+		tr.LazyPrintf("sampling %s", t.name)
+
+		start := time.Now()
+		_, err := t.r.Query(m, tr)
+		if err == errBusy {
+			return
+		}
+		recordLatency(t.name, time.Since(start), err)
+		if err != nil {
+			tr.LazyPrintf("%s: %v", t.name, err)
+			tr.SetError()
+		}
+	}()
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ dnsserver.Resolver = &autoResolver{}
@@ -0,0 +1,253 @@
+package httpresolver
+
+// Tests for the automatic transport selection.
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func newTestAuto(n int) (*autoResolver, []*testutil.TestResolver) {
+	r := &autoResolver{mu: &sync.Mutex{}}
+	var backs []*testutil.TestResolver
+	for i := 0; i < n; i++ {
+		b := testutil.NewTestResolver()
+		b.Response = &dns.Msg{}
+		backs = append(backs, b)
+		r.transports = append(r.transports, transport{string(rune('a' + i)), b})
+	}
+	return r, backs
+}
+
+func (r *autoResolver) currentName() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.transports[r.current].name
+}
+
+func (r *autoResolver) waitProbe(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		r.mu.Lock()
+		probing := r.probing
+		r.mu.Unlock()
+		if !probing {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("probe did not finish")
+}
+
+func TestAutoSelection(t *testing.T) {
+	r, backs := newTestAuto(3)
+	backs[0].RespError = errors.New("blocked")
+
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	for _, b := range backs {
+		if !b.Initialized {
+			t.Errorf("transport not initialized")
+		}
+	}
+	if n := r.currentName(); n != "b" {
+		t.Errorf("expected b to be selected, got %q", n)
+	}
+
+	// Queries go to the selected transport.
+	tr := testutil.NewTestTrace(t)
+	req := &dns.Msg{}
+	req.SetQuestion("test.", dns.TypeA)
+	if _, err := r.Query(req, tr); err != nil {
+		t.Errorf("query error: %v", err)
+	}
+	if backs[1].LastQuery != req {
+		t.Errorf("query did not go to the selected transport")
+	}
+
+	// The selected transport breaks, and the first one comes back: after
+	// enough failures, we should switch to it.
+	backs[0].RespError = nil
+	backs[1].RespError = errors.New("broken")
+	for i := 0; i < maxTransportFailures; i++ {
+		if _, err := r.Query(req, tr); err == nil {
+			t.Errorf("expected query error")
+		}
+	}
+	r.waitProbe(t)
+	if n := r.currentName(); n != "a" {
+		t.Errorf("expected a to be selected, got %q", n)
+	}
+}
+
+func TestAutoNoneWorks(t *testing.T) {
+	r, backs := newTestAuto(2)
+	for _, b := range backs {
+		b.RespError = errors.New("blocked")
+	}
+
+	// Init should not fail, as the network may not be up yet.
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	if n := r.currentName(); n != "a" {
+		t.Errorf("expected to keep a, got %q", n)
+	}
+
+	// Once one works, a reprobe should find it.
+	backs[1].RespError = nil
+	r.Reprobe()
+	r.waitProbe(t)
+	if n := r.currentName(); n != "b" {
+		t.Errorf("expected b to be selected, got %q", n)
+	}
+}
+
+func TestAutoClose(t *testing.T) {
+	r, backs := newTestAuto(2)
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	r.Close()
+
+	// Once closed, neither failures nor reprobes start probes.
+	backs[0].RespError = errors.New("broken")
+	req := &dns.Msg{}
+	req.SetQuestion("test.", dns.TypeA)
+	for i := 0; i < maxTransportFailures; i++ {
+		r.Query(req, testutil.NewTestTrace(t))
+	}
+	r.Reprobe()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.probing {
+		t.Errorf("probing after being closed")
+	}
+}
+
+func TestNewAuto(t *testing.T) {
+	u, _ := url.Parse("https://dns.example/dns-query")
+	base := NewJSON(u, "")
+	base.UpstreamAddr = "192.0.2.1:443"
+	r := NewAuto(base)
+
+	expected := []string{"DoH (HTTP/2)", "DoT", "DoH (HTTP/1.1)", "JSON"}
+	if len(r.transports) != len(expected) {
+		t.Fatalf("unexpected transports: %v", r.transports)
+	}
+	for i, name := range expected {
+		if r.transports[i].name != name {
+			t.Errorf("transport %d: expected %q, got %q",
+				i, name, r.transports[i].name)
+		}
+	}
+
+	if doh1 := r.transports[2].r.(*httpsResolver); doh1.mode != "DoH" ||
+		!doh1.http1Only || doh1.UpstreamAddr != base.UpstreamAddr {
+		t.Errorf("bad DoH (HTTP/1.1) transport: %+v", doh1)
+	}
+
+	dot := r.transports[1].r.(*dotResolver)
+	if dot.Addr != "192.0.2.1:853" || dot.ServerName != "dns.example" {
+		t.Errorf("bad DoT transport: %+v", dot)
+	}
+}
+
+// closeCounter is an http.RoundTripper which counts how many times its idle
+// connections were closed.
+type closeCounter struct {
+	http.Transport
+	closed int
+}
+
+func (c *closeCounter) CloseIdleConnections() {
+	c.closed++
+}
+
+func TestAutoNetworkChanged(t *testing.T) {
+	r, backs := newTestAuto(2)
+	backs[0].RespError = errors.New("blocked")
+
+	cc := &closeCounter{}
+	hr := &httpsResolver{Upstream: &url.URL{}, Transport: cc}
+	hr.Init()
+	r.transports = append(r.transports, transport{"https", hr})
+
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	if n := r.currentName(); n != "b" {
+		t.Errorf("expected b to be selected, got %q", n)
+	}
+
+	// On the new network, a works (and b doesn't).
+	backs[0].RespError = nil
+	backs[1].RespError = errors.New("blocked")
+	r.NetworkChanged()
+	r.waitProbe(t)
+
+	if n := r.currentName(); n != "a" {
+		t.Errorf("expected a to be selected, got %q", n)
+	}
+	if cc.closed != 1 {
+		t.Errorf("idle connections closed %d times, expected 1", cc.closed)
+	}
+}
+
+func latencyCount(name string) string {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	l, ok := autoStats.latency.Get(name).(*latencyStats)
+	if !ok {
+		return ""
+	}
+	return l.String()
+}
+
+func TestAutoSampling(t *testing.T) {
+	autoStats.latency.Init()
+	r, backs := newTestAuto(2)
+	backs[1].RespError = errors.New("blocked")
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	// Without sampling, only the current transport sees the query.
+	tr := testutil.NewTestTrace(t)
+	req := &dns.Msg{}
+	req.SetQuestion("test.", dns.TypeA)
+	r.Query(req, tr)
+	if s := latencyCount("a"); !strings.HasPrefix(s, `{"count": 1, "errors": 0,`) {
+		t.Errorf("unexpected stats for a: %s", s)
+	}
+	if s := latencyCount("b"); s != "" {
+		t.Errorf("unexpected stats for b: %s", s)
+	}
+
+	// With sampling, the other one gets it too, in the background.
+	r.SampleRate = 1
+	backs[1].RespError = nil
+	r.Query(req, tr)
+	for i := 0; i < 100 && latencyCount("b") == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := latencyCount("b"); !strings.HasPrefix(s, `{"count": 1, "errors": 0,`) {
+		t.Errorf("unexpected stats for b: %s", s)
+	}
+	if s := latencyCount("a"); !strings.HasPrefix(s, `{"count": 2, "errors": 0,`) {
+		t.Errorf("unexpected stats for a: %s", s)
+	}
+	if backs[1].LastQuery == nil || backs[1].LastQuery == req {
+		t.Errorf("sampled query was not a copy: %v", backs[1].LastQuery)
+	}
+}
@@ -0,0 +1,144 @@
+package httpresolver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// do sends the HTTP request for the given DNS query. If the query is for one
+// of the names we trace in detail (util.TracedNames), the full HTTP request
+// and response, and a breakdown of the timing, are added to the trace and
+// logged.
+func (r *httpsResolver) do(hreq *http.Request, req *dns.Msg, tr trace.Trace) (*http.Response, error) {
+	// The request is cancelled if the client abandons the query.
+	hreq = hreq.WithContext(
+		httptrace.WithClientTrace(util.Context(tr), handshakeTrace))
+	r.tagDevice(hreq, tr)
+
+	if len(req.Question) != 1 || !util.TracedNames.Match(req.Question[0].Name) {
+		r.setAuthorization(hreq)
+		return r.client.Do(hreq)
+	}
+
+	t := &timings{start: time.Now()}
+	hreq = hreq.WithContext(
+		httptrace.WithClientTrace(hreq.Context(), t.clientTrace()))
+
+	if dump, err := httputil.DumpRequestOut(hreq, true); err == nil {
+		util.TraceDetail(tr, "%s: HTTP request: %q", req.Question[0].Name, dump)
+	}
+
+	// Only after dumping the request, so the secret doesn't end up in the
+	// traces and logs.
+	r.setAuthorization(hreq)
+
+	hr, err := r.client.Do(hreq)
+	t.now(&t.end)
+	util.TraceDetail(tr, "%s: HTTP timing: %s", req.Question[0].Name, t)
+	if err != nil {
+		util.TraceDetail(tr, "%s: HTTP error: %v", req.Question[0].Name, err)
+		return hr, err
+	}
+
+	if dump, err := httputil.DumpResponse(hr, true); err == nil {
+		util.TraceDetail(tr, "%s: HTTP response: %q", req.Question[0].Name, dump)
+	}
+	return hr, nil
+}
+
+// setAuthorization sets the Authorization header of the HTTP request, if the
+// upstream needs one.
+func (r *httpsResolver) setAuthorization(hreq *http.Request) {
+	if r.Authorization != "" {
+		hreq.Header.Set("Authorization", r.Authorization)
+	}
+}
+
+// timings of the different phases of an HTTP request.
+// The trace hooks can be called from other goroutines (e.g. when dialing),
+// so access is protected by the mutex.
+type timings struct {
+	mu sync.Mutex
+
+	start, end time.Time
+
+	reused bool
+
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn                   time.Time
+	wroteRequest              time.Time
+	firstByte                 time.Time
+}
+
+// now sets the given time to now.
+func (t *timings) now(p *time.Time) {
+	t.mu.Lock()
+	*p = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *timings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.now(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.now(&t.dnsDone) },
+		ConnectStart: func(network, addr string) {
+			t.now(&t.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.now(&t.connectDone)
+		},
+		TLSHandshakeStart: func() { t.now(&t.tlsStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.now(&t.tlsDone)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.now(&t.gotConn)
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.now(&t.wroteRequest)
+		},
+		GotFirstResponseByte: func() { t.now(&t.firstByte) },
+	}
+}
+
+func (t *timings) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := []string{}
+	if t.reused {
+		s = append(s, "conn reused")
+	}
+	s = appendPhase(s, "dns", t.dnsStart, t.dnsDone)
+	s = appendPhase(s, "connect", t.connectStart, t.connectDone)
+	s = appendPhase(s, "tls", t.tlsStart, t.tlsDone)
+	s = appendPhase(s, "got conn", t.start, t.gotConn)
+	s = appendPhase(s, "wrote request", t.start, t.wroteRequest)
+	s = appendPhase(s, "first byte", t.start, t.firstByte)
+	s = appendPhase(s, "total", t.start, t.end)
+	return strings.Join(s, ", ")
+}
+
+// appendPhase appends a string describing the duration between the given
+// times, if the phase happened.
+func appendPhase(s []string, name string, start, end time.Time) []string {
+	if start.IsZero() || end.IsZero() {
+		return s
+	}
+	return append(s, name+"="+end.Sub(start).String())
+}
@@ -0,0 +1,130 @@
+package httpresolver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"golang.org/x/net/trace"
+)
+
+// Device identification: some providers (like NextDNS) can tell the devices
+// behind a resolver apart, for their logs and per-device settings, if the
+// queries are tagged with a device name. NextDNS takes it as a path segment
+// after the profile ID (https://dns.nextdns.io/PROFILE/DEVICE), others in a
+// header.
+//
+// We map the clients (by address) to device names, and tag their queries
+// accordingly. Note that with the cache enabled, the provider only sees the
+// queries that miss it, under the name of the client which made them.
+
+// Devices maps the clients' addresses to device names.
+type Devices struct {
+	// Networks and their device names, with the most specific ones first.
+	entries []deviceEntry
+}
+
+type deviceEntry struct {
+	net  *net.IPNet
+	name string
+}
+
+// ParseDevices parses a space-separated list of client=name, where the client
+// is an address or a network, like "192.168.1.10=laptop 10.0.0.0/8=office".
+// When more than one matches a client, the most specific network wins.
+func ParseDevices(s string) (*Devices, error) {
+	d := &Devices{}
+	for _, f := range strings.Fields(s) {
+		sp := strings.SplitN(f, "=", 2)
+		if len(sp) != 2 || sp[1] == "" {
+			return nil, fmt.Errorf("%q: expected client=name", f)
+		}
+		if !validDeviceName(sp[1]) {
+			return nil, fmt.Errorf("%q: invalid device name %q", f, sp[1])
+		}
+
+		ipnet, err := parseClient(sp[0])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", f, err)
+		}
+		d.entries = append(d.entries, deviceEntry{ipnet, sp[1]})
+	}
+
+	sort.SliceStable(d.entries, func(i, j int) bool {
+		oi, _ := d.entries[i].net.Mask.Size()
+		oj, _ := d.entries[j].net.Mask.Size()
+		return oi > oj
+	})
+	return d, nil
+}
+
+// parseClient parses an address or a network.
+func parseClient(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// validDeviceName returns true if the name is safe to use in a URL path and
+// in a header: letters, digits, '-', '_' and '.'. NextDNS takes "--" as a
+// space.
+func validDeviceName(name string) bool {
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Name returns the device name for the given client, or "" if there is none.
+func (d *Devices) Name(client net.IP) string {
+	if d == nil || client == nil {
+		return ""
+	}
+	for _, e := range d.entries {
+		if e.net.Contains(client) {
+			return e.name
+		}
+	}
+	return ""
+}
+
+// tagDevice tags the HTTP request with the device name of the query's
+// client (see util.Client), if it has one: in DeviceHeader if set, or as an
+// extra path segment otherwise.
+func (r *httpsResolver) tagDevice(hreq *http.Request, tr trace.Trace) {
+	name := r.Devices.Name(util.Client(tr))
+	if name == "" {
+		return
+	}
+
+	if r.DeviceHeader != "" {
+		hreq.Header.Set(r.DeviceHeader, name)
+		return
+	}
+
+	// Copy the URL before changing it, as it can be the resolver's.
+	u := *hreq.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	u.RawPath = ""
+	hreq.URL = &u
+}
@@ -0,0 +1,107 @@
+package httpresolver
+
+// Tests for the device identification.
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseDevices(t *testing.T) {
+	d, err := ParseDevices("10.0.0.0/8=office 192.168.1.10=laptop" +
+		" 10.1.0.0/16=lab fd00::1=phone")
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+
+	cases := []struct {
+		ip   string
+		name string
+	}{
+		{"192.168.1.10", "laptop"},
+		{"192.168.1.11", ""},
+		{"10.2.3.4", "office"},
+		{"10.1.3.4", "lab"},
+		{"fd00::1", "phone"},
+		{"fd00::2", ""},
+	}
+	for _, c := range cases {
+		if got := d.Name(net.ParseIP(c.ip)); got != c.name {
+			t.Errorf("%s: got %q, expected %q", c.ip, got, c.name)
+		}
+	}
+
+	var nilD *Devices
+	if nilD.Name(net.ParseIP("192.168.1.10")) != "" {
+		t.Errorf("nil Devices gave a name")
+	}
+
+	for _, s := range []string{"laptop", "1.2.3.4=", "x=laptop",
+		"1.2.3.4=my/laptop", "10.0.0.0/99=x"} {
+		if _, err := ParseDevices(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestTagDevice(t *testing.T) {
+	u, _ := url.Parse("https://dns.nextdns.io/abc123")
+	var gotPath, gotHeader string
+	r := NewDoH(u, "")
+	r.Devices, _ = ParseDevices("192.168.1.10=laptop")
+	r.Transport = &fixedTransport{
+		contentType: "application/dns-message",
+		body: func(hreq *http.Request) []byte {
+			gotPath = hreq.URL.Path
+			gotHeader = hreq.Header.Get("X-Device-Name")
+			raw, _ := ioutil.ReadAll(hreq.Body)
+			req := &dns.Msg{}
+			req.Unpack(raw)
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+			packed, _ := reply.Pack()
+			return packed
+		},
+	}
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	query := func(client string) {
+		t.Helper()
+		tr := util.WithClient(testutil.NewTestTrace(t), net.ParseIP(client))
+		req := &dns.Msg{}
+		req.SetQuestion("test.blah.", dns.TypeA)
+		if _, err := r.Query(req, tr); err != nil {
+			t.Fatalf("query error: %v", err)
+		}
+	}
+
+	query("192.168.1.10")
+	if gotPath != "/abc123/laptop" {
+		t.Errorf("unexpected path: %q", gotPath)
+	}
+	if r.Upstream.Path != "/abc123" {
+		t.Errorf("upstream URL was changed: %v", r.Upstream)
+	}
+
+	// Unknown clients go as they are.
+	query("192.168.1.99")
+	if gotPath != "/abc123" {
+		t.Errorf("unexpected path for an unknown client: %q", gotPath)
+	}
+
+	r.DeviceHeader = "X-Device-Name"
+	query("192.168.1.10")
+	if gotPath != "/abc123" || gotHeader != "laptop" {
+		t.Errorf("unexpected path %q and header %q", gotPath, gotHeader)
+	}
+}
@@ -0,0 +1,106 @@
+package httpresolver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// dotResolver implements the dnsserver.Resolver interface by querying a
+// server via DNS over TLS (RFC 7858).
+//
+// It's only used as a fallback transport when probing (see autoResolver), so
+// it's kept simple: it does not support proxies, DSCP marking, or NAT64.
+type dotResolver struct {
+	// Address ("host:port") of the server, and the name to verify its
+	// certificate against.
+	Addr       string
+	ServerName string
+
+	CAFile     string
+	CertHashes [][]byte
+	KeyLog     io.Writer
+
+	// Resume the TLS sessions, like httpsResolver.SessionResumption. It
+	// matters more here, as we make a new connection for each query.
+	SessionResumption bool
+
+	client *dns.Client
+}
+
+// newDoT creates a new DoT resolver for the same server as the given HTTPS
+// resolver, on the standard DoT port.
+func newDoT(r *httpsResolver) *dotResolver {
+	host := r.Upstream.Hostname()
+	if r.UpstreamAddr != "" {
+		if h, _, err := net.SplitHostPort(r.UpstreamAddr); err == nil {
+			host = h
+		}
+	}
+
+	return &dotResolver{
+		Addr:       net.JoinHostPort(host, "853"),
+		ServerName: r.Upstream.Hostname(),
+		CAFile:     r.CAFile,
+		CertHashes: r.CertHashes,
+		KeyLog:     r.KeyLog,
+
+		SessionResumption: r.SessionResumption,
+	}
+}
+
+func (r *dotResolver) Init() error {
+	tlsConfig := &tls.Config{
+		ServerName:         r.ServerName,
+		KeyLogWriter:       r.KeyLog,
+		ClientSessionCache: newSessionCache(r.SessionResumption),
+	}
+
+	if r.CAFile != "" {
+		pool, err := loadCertPool(r.CAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(r.CertHashes) > 0 {
+		h := &httpsResolver{CertHashes: r.CertHashes}
+		tlsConfig.VerifyPeerCertificate = h.verifyCertHashes
+	}
+
+	r.client = &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		Timeout:   4 * time.Second,
+	}
+	return nil
+}
+
+func (r *dotResolver) Maintain() {
+}
+
+func (r *dotResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	tr.LazyPrintf("DoT query to %s", r.Addr)
+	reply, rtt, err := r.client.ExchangeContext(util.Context(tr), req, r.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("DoT exchange failed: %v", err)
+	}
+	if err := matchReply(req, reply); err != nil {
+		stats.mismatched.Add(1)
+		return nil, err
+	}
+	tr.LazyPrintf("DoT reply in %v", rtt)
+	return reply, nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ dnsserver.Resolver = &dotResolver{}
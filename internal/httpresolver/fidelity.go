@@ -0,0 +1,101 @@
+package httpresolver
+
+import (
+	"expvar"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/dnsjson"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// Fidelity of the JSON translation.
+//
+// The JSON API can't represent everything a DNS message can: the query only
+// has a name and a type, and the response only the answers and a few flags.
+// We count what gets lost in the translation, by reason, so operators can
+// tell how lossy it is for their clients, and decide if they should switch
+// to DoH (RFC 8484), which carries the messages as they are.
+
+// Exported variables for statistics.
+var jsonStats = struct {
+	// Queries sent in JSON mode.
+	queries *expvar.Int
+
+	// Queries that lost something in the translation (in either
+	// direction).
+	lossy *expvar.Int
+
+	// What was lost, by reason:
+	//  - "edns-options": the query had EDNS options (like client subnet or
+	//    cookies), which are not sent.
+	//  - "dnssec-ok", "checking-disabled": the query had the DO or CD bit,
+	//    which are not sent.
+	//  - "unsupported-type": the query type has no name we can send.
+	//  - "truncated": the response was truncated (TC bit).
+	//  - "authority", "additional": the response had records in those
+	//    sections, which are dropped.
+	//  - "unparseable-answer": an answer could not be turned back into a
+	//    DNS record, so the query fails.
+	losses *expvar.Map
+}{}
+
+func init() {
+	jsonStats.queries = expvar.NewInt("upstream-json-queries")
+	jsonStats.lossy = expvar.NewInt("upstream-json-lossy-queries")
+	jsonStats.losses = expvar.NewMap("upstream-json-losses")
+}
+
+// queryLosses returns what the query loses in its translation to JSON.
+func queryLosses(req *dns.Msg) []string {
+	var losses []string
+	if opt := req.IsEdns0(); opt != nil {
+		if len(opt.Option) > 0 {
+			losses = append(losses, "edns-options")
+		}
+		if opt.Do() {
+			losses = append(losses, "dnssec-ok")
+		}
+	}
+	if req.CheckingDisabled {
+		losses = append(losses, "checking-disabled")
+	}
+	if len(req.Question) == 1 {
+		if _, ok := dns.TypeToString[req.Question[0].Qtype]; !ok {
+			losses = append(losses, "unsupported-type")
+		}
+	}
+	return losses
+}
+
+// responseLosses returns what the JSON response loses in its translation
+// back to DNS.
+func responseLosses(jr *dnsjson.Response) []string {
+	var losses []string
+	if jr.TC {
+		losses = append(losses, "truncated")
+	}
+	if len(jr.Authority) > 0 {
+		losses = append(losses, "authority")
+	}
+	if len(jr.Additional) > 0 {
+		losses = append(losses, "additional")
+	}
+	return losses
+}
+
+// recordLosses counts a JSON query, and what it lost.
+func recordLosses(losses []string, tr trace.Trace) {
+	jsonStats.queries.Add(1)
+	if len(losses) == 0 {
+		return
+	}
+
+	jsonStats.lossy.Add(1)
+	for _, l := range losses {
+		jsonStats.losses.Add(l, 1)
+	}
+	tr.LazyPrintf("lost in the JSON translation: %s",
+		strings.Join(losses, " "))
+}
@@ -0,0 +1,96 @@
+package httpresolver
+
+// Tests for the JSON translation fidelity metrics.
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func lossCount(reason string) int64 {
+	if v := jsonStats.losses.Get(reason); v != nil {
+		return v.(interface{ Value() int64 }).Value()
+	}
+	return 0
+}
+
+func TestJSONLosses(t *testing.T) {
+	u, _ := url.Parse("https://dns.example/resolve")
+	body := ""
+	r := NewJSON(u, "")
+	r.Transport = &fixedTransport{
+		contentType: "application/dns-json",
+		body:        func(*http.Request) []byte { return []byte(body) },
+	}
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	reasons := []string{"edns-options", "dnssec-ok", "checking-disabled",
+		"truncated", "authority", "additional", "unparseable-answer"}
+	prev := map[string]int64{}
+	for _, reason := range reasons {
+		prev[reason] = lossCount(reason)
+	}
+	prevQueries, prevLossy := jsonStats.queries.Value(), jsonStats.lossy.Value()
+
+	// A plain query and response lose nothing.
+	body = `{"Status": 0, "Question": [{"name": "test.blah.", "type": 1}],
+		"Answer": [{"name": "test.blah.", "type": 1, "TTL": 60,
+			"data": "1.2.3.4"}]}`
+	req := &dns.Msg{}
+	req.SetQuestion("test.blah.", dns.TypeA)
+	if _, err := r.Query(req, testutil.NewTestTrace(t)); err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+	if jsonStats.queries.Value() != prevQueries+1 ||
+		jsonStats.lossy.Value() != prevLossy {
+		t.Errorf("plain query counted as lossy")
+	}
+
+	// But with EDNS options, DO and CD, and a truncated response with
+	// authority and additional records, they lose a lot.
+	body = `{"Status": 0, "TC": true,
+		"Question": [{"name": "test.blah.", "type": 1}],
+		"Answer": [{"name": "test.blah.", "type": 1, "TTL": 60,
+			"data": "1.2.3.4"}],
+		"Authority": [{"name": "blah.", "type": 2, "TTL": 60,
+			"data": "ns.blah."}],
+		"Additional": [{"name": "ns.blah.", "type": 1, "TTL": 60,
+			"data": "1.2.3.5"}]}`
+	req.CheckingDisabled = true
+	req.SetEdns0(1232, true)
+	req.IsEdns0().Option = append(req.IsEdns0().Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	if _, err := r.Query(req, testutil.NewTestTrace(t)); err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+
+	// And answers we can't parse fail the query.
+	body = `{"Status": 0, "Question": [{"name": "test.blah.", "type": 1}],
+		"Answer": [{"name": "test.blah.", "type": 1, "TTL": 60,
+			"data": "not-an-ip"}]}`
+	req = &dns.Msg{}
+	req.SetQuestion("test.blah.", dns.TypeA)
+	if _, err := r.Query(req, testutil.NewTestTrace(t)); err == nil {
+		t.Errorf("unparseable answer accepted")
+	}
+
+	if jsonStats.queries.Value() != prevQueries+3 ||
+		jsonStats.lossy.Value() != prevLossy+2 {
+		t.Errorf("unexpected counts: %d queries, %d lossy",
+			jsonStats.queries.Value()-prevQueries,
+			jsonStats.lossy.Value()-prevLossy)
+	}
+	for _, reason := range reasons {
+		if lossCount(reason) != prev[reason]+1 {
+			t.Errorf("%q: counted %d times, expected once", reason,
+				lossCount(reason)-prev[reason])
+		}
+	}
+}
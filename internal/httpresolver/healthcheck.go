@@ -0,0 +1,207 @@
+package httpresolver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// Health checks for the upstreams in the pool. Every upstream is sent a
+// probe query periodically, and after a number of consecutive failures it's
+// marked as down, and the queries go to the other upstreams until it passes
+// enough checks again.
+//
+// The probe is also used for the readiness check and to keep the idle
+// upstreams alive, as some private DoH servers refuse the default one.
+
+// HealthCheck is the configuration of the health checks of an upstream.
+type HealthCheck struct {
+	// The probe query.
+	Name string
+	Type uint16
+
+	// The expected rcode and, if not empty, a string one of the answers must
+	// contain (like an address).
+	Rcode  int
+	Answer string
+
+	// How often to check (0 means never), and how many consecutive
+	// failures mark the upstream as down, and successes bring it back.
+	Interval  time.Duration
+	Failures  int
+	Successes int
+}
+
+// DefaultHealthCheck is the health check used when none is given. The probe
+// is cheap, and every recursive server can answer it.
+var DefaultHealthCheck = HealthCheck{
+	Name:      ".",
+	Type:      dns.TypeNS,
+	Rcode:     dns.RcodeSuccess,
+	Failures:  3,
+	Successes: 1,
+}
+
+// How often to look for upstreams that are due a health check, declared as
+// a variable so we can tweak it for testing.
+var healthCheckTick = 1 * time.Second
+
+// ParseHealthCheck parses a health check, given as comma-separated
+// key=value, like "name=example.com,type=A,answer=192.0.2.1,interval=30s".
+// The keys are name, type, rcode, answer, interval, failures and successes;
+// the missing ones are taken from base.
+func ParseHealthCheck(s string, base HealthCheck) (HealthCheck, error) {
+	hc := base
+	if s == "" {
+		return hc, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		sp := strings.SplitN(kv, "=", 2)
+		if len(sp) != 2 {
+			return hc, fmt.Errorf("%q: expected key=value", kv)
+		}
+		k, v := sp[0], sp[1]
+
+		var err error
+		switch k {
+		case "name":
+			if !dns.IsFqdn(v) {
+				return hc, fmt.Errorf("name %q is not fully qualified", v)
+			}
+			hc.Name = v
+		case "type":
+			t, ok := dns.StringToType[strings.ToUpper(v)]
+			if !ok {
+				return hc, fmt.Errorf("unknown type %q", v)
+			}
+			hc.Type = t
+		case "rcode":
+			r, ok := dns.StringToRcode[strings.ToUpper(v)]
+			if !ok {
+				return hc, fmt.Errorf("unknown rcode %q", v)
+			}
+			hc.Rcode = r
+		case "answer":
+			hc.Answer = v
+		case "interval":
+			hc.Interval, err = time.ParseDuration(v)
+			if err == nil && hc.Interval < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "failures":
+			hc.Failures, err = parseThreshold(v)
+		case "successes":
+			hc.Successes, err = parseThreshold(v)
+		default:
+			return hc, fmt.Errorf("unknown key %q", k)
+		}
+		if err != nil {
+			return hc, fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return hc, nil
+}
+
+func parseThreshold(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 1 {
+		err = fmt.Errorf("must be at least 1")
+	}
+	return n, err
+}
+
+// query returns the probe query.
+func (hc HealthCheck) query() *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(hc.Name, hc.Type)
+	return req
+}
+
+// check returns an error if the reply to the probe is not the expected one.
+func (hc HealthCheck) check(reply *dns.Msg) error {
+	if reply.Rcode != hc.Rcode {
+		return fmt.Errorf("expected rcode %s, got %s",
+			dns.RcodeToString[hc.Rcode], dns.RcodeToString[reply.Rcode])
+	}
+	if hc.Answer == "" {
+		return nil
+	}
+	for _, rr := range reply.Answer {
+		if strings.Contains(rr.String(), hc.Answer) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no answer contains %q", hc.Answer)
+}
+
+// healthCheck returns the health check for the given upstream.
+func (p *poolResolver) healthCheck(upstream string) HealthCheck {
+	if p.HealthChecks == nil {
+		return DefaultHealthCheck
+	}
+	return p.HealthChecks(upstream)
+}
+
+// healthChecks checks the enabled upstreams which are due a check.
+func (p *poolResolver) healthChecks() {
+	us := p.allEnabled()
+	defer func() {
+		for _, u := range us {
+			u.inflight.Done()
+		}
+	}()
+
+	now := p.clock.Now()
+	for _, u := range us {
+		if u.hc.Interval == 0 || now.Sub(u.lastCheck) < u.hc.Interval {
+			continue
+		}
+		u.lastCheck = now
+		p.checkUpstream(u)
+	}
+}
+
+// checkUpstream sends the probe to the upstream, and marks it as down or up
+// once it reaches the thresholds.
+func (p *poolResolver) checkUpstream(u *poolUpstream) {
+	tr := trace.New("httpresolver.Pool", "health check")
+	defer tr.Finish()
+	tr.LazyPrintf("upstream %q", u.name)
+
+	reply, err := u.r.Query(u.hc.query(), tr)
+	if err == nil {
+		err = u.hc.check(reply)
+	}
+
+	down := atomic.LoadInt32(&u.down) == 1
+	if err != nil {
+		stats.healthChecks.Add("failed", 1)
+		tr.LazyPrintf("failed: %v", err)
+		tr.SetError()
+		u.checksOK = 0
+		u.checksFailed++
+		if !down && u.checksFailed >= u.hc.Failures {
+			atomic.StoreInt32(&u.down, 1)
+			log.Errorf("Upstream %q failed %d health checks, marking it"+
+				" as down: %v", u.name, u.checksFailed, err)
+		}
+		return
+	}
+
+	stats.healthChecks.Add("ok", 1)
+	u.checksFailed = 0
+	u.checksOK++
+	if down && u.checksOK >= u.hc.Successes {
+		atomic.StoreInt32(&u.down, 0)
+		log.Infof("Upstream %q passed %d health checks, marking it as up",
+			u.name, u.checksOK)
+	}
+}
@@ -0,0 +1,165 @@
+package httpresolver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	hc, err := ParseHealthCheck(
+		"name=example.com.,type=a,rcode=nxdomain,answer=192.0.2.1,"+
+			"interval=30s,failures=2,successes=5", DefaultHealthCheck)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	expected := HealthCheck{
+		Name:      "example.com.",
+		Type:      dns.TypeA,
+		Rcode:     dns.RcodeNameError,
+		Answer:    "192.0.2.1",
+		Interval:  30 * time.Second,
+		Failures:  2,
+		Successes: 5,
+	}
+	if hc != expected {
+		t.Errorf("expected %+v, got %+v", expected, hc)
+	}
+
+	// The missing ones come from the base.
+	hc, err = ParseHealthCheck("interval=1m", DefaultHealthCheck)
+	if err != nil || hc.Name != "." || hc.Type != dns.TypeNS ||
+		hc.Interval != time.Minute || hc.Failures != 3 {
+		t.Errorf("unexpected health check: %+v, %v", hc, err)
+	}
+
+	for _, s := range []string{
+		"name",
+		"name=example.com",
+		"type=NOTATYPE",
+		"rcode=MAYBE",
+		"interval=-1s",
+		"interval=soon",
+		"failures=0",
+		"successes=x",
+		"color=blue",
+	} {
+		if _, err := ParseHealthCheck(s, DefaultHealthCheck); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestHealthCheckReply(t *testing.T) {
+	hc := HealthCheck{Name: "example.com.", Type: dns.TypeA,
+		Rcode: dns.RcodeSuccess, Answer: "192.0.2.1"}
+	reply := &dns.Msg{}
+	reply.SetQuestion("example.com.", dns.TypeA)
+
+	if err := hc.check(reply); err == nil {
+		t.Errorf("reply without answers passed")
+	}
+	a, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	reply.Answer = []dns.RR{a}
+	if err := hc.check(reply); err != nil {
+		t.Errorf("expected reply failed: %v", err)
+	}
+	reply.Rcode = dns.RcodeRefused
+	if err := hc.check(reply); err == nil {
+		t.Errorf("REFUSED reply passed")
+	}
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	r1 := testutil.NewTestResolver()
+	r1.Response = &dns.Msg{}
+	r2 := testutil.NewTestResolver()
+	r2.Response = &dns.Msg{}
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1, "r2": r2})
+	clock := testutil.NewFakeClock(time.Now())
+	p.clock = clock
+	p.HealthChecks = func(upstream string) HealthCheck {
+		hc := DefaultHealthCheck
+		hc.Interval = time.Minute
+		hc.Failures = 2
+		hc.Successes = 2
+		if upstream == "r1" {
+			hc.Name = "probe.example."
+		}
+		return hc
+	}
+	p.Add("r1")
+	p.Add("r2")
+
+	// The probe is the one for the upstream, and it's only sent once per
+	// interval.
+	p.healthChecks()
+	if r1.LastQuery.Question[0].Name != "probe.example." ||
+		r2.LastQuery.Question[0].Name != "." {
+		t.Errorf("unexpected probes: %v, %v", r1.LastQuery, r2.LastQuery)
+	}
+	r1.LastQuery = nil
+	p.healthChecks()
+	if r1.LastQuery != nil {
+		t.Errorf("checked again before the interval")
+	}
+
+	isDown := func() bool { return p.Status()[0].Down }
+
+	// It takes 2 failures to be down.
+	r1.RespError = errors.New("r1 is broken")
+	clock.Advance(time.Minute)
+	p.healthChecks()
+	if isDown() {
+		t.Errorf("down after a single failure")
+	}
+	clock.Advance(time.Minute)
+	p.healthChecks()
+	if !isDown() {
+		t.Errorf("not down after 2 failures")
+	}
+
+	// While down, the queries go to the other upstream.
+	r1.LastQuery = nil
+	r2.LastQuery = nil
+	if _, err := poolQuery(p); err != nil {
+		t.Errorf("query failed: %v", err)
+	}
+	if r1.LastQuery != nil || r2.LastQuery == nil {
+		t.Errorf("query did not skip the upstream which is down")
+	}
+
+	// Unless they are all down.
+	p.SetEnabled("r2", false)
+	if _, err := poolQuery(p); err != r1.RespError {
+		t.Errorf("expected r1's error, got %v", err)
+	}
+	p.SetEnabled("r2", true)
+
+	// Wrong replies are failures too.
+	r1.RespError = nil
+	r1.Response.Rcode = dns.RcodeRefused
+	clock.Advance(time.Minute)
+	p.healthChecks()
+	if !isDown() {
+		t.Errorf("REFUSED probe brought the upstream back")
+	}
+
+	// And it takes 2 successes to come back.
+	r1.Response.Rcode = dns.RcodeSuccess
+	clock.Advance(time.Minute)
+	p.healthChecks()
+	if !isDown() {
+		t.Errorf("up after a single success")
+	}
+	clock.Advance(time.Minute)
+	p.healthChecks()
+	if isDown() {
+		t.Errorf("still down after 2 successes")
+	}
+}
@@ -0,0 +1,126 @@
+package httpresolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Support for IPv6-only networks: preferring the upstream's IPv6 addresses,
+// and reaching IPv4-only upstreams via NAT64 (RFC 6146), synthesizing the
+// IPv6 addresses from their IPv4 ones (RFC 6052).
+
+// ParseNAT64Prefix parses a NAT64 prefix, like "64:ff9b::/96". It must be an
+// IPv6 network, of one of the lengths allowed by RFC 6052 (32, 40, 48, 56, 64
+// or 96 bits).
+func ParseNAT64Prefix(s string) (*net.IPNet, error) {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("%q is not an IPv6 prefix", s)
+	}
+
+	ones, _ := prefix.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("%q: invalid prefix length %d", s, ones)
+	}
+	return prefix, nil
+}
+
+// synthesizeNAT64 returns the IPv6 address for the given IPv4 address under
+// the NAT64 prefix, as per RFC 6052 section 2.2: the address goes right
+// after the prefix, skipping bits 64 to 71 (which must be zero).
+func synthesizeNAT64(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// upstreamAddrs returns the addresses to try, in order, to connect to the
+// given "host:port". They include the synthesized NAT64 addresses (if we
+// have a prefix), and the IPv6 ones go first if PreferIPv6 is set.
+func (r *httpsResolver) upstreamAddrs(ctx context.Context, hostport string) ([]string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		lookup := r.lookupIPAddr
+		if lookup == nil {
+			lookup = net.DefaultResolver.LookupIPAddr
+		}
+		addrs, err := lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	candidates := []net.IP{}
+	for _, ip := range ips {
+		if r.NAT64Prefix != nil && ip.To4() != nil {
+			candidates = append(candidates, synthesizeNAT64(r.NAT64Prefix, ip))
+		}
+		candidates = append(candidates, ip)
+	}
+
+	if r.PreferIPv6 {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].To4() == nil && candidates[j].To4() != nil
+		})
+	}
+
+	hostports := []string{}
+	for _, ip := range candidates {
+		hostports = append(hostports, net.JoinHostPort(ip.String(), port))
+	}
+	return hostports, nil
+}
+
+// dialUpstream connects to the first of the upstream's addresses (see
+// upstreamAddrs) that works.
+func (r *httpsResolver) dialUpstream(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	addrs, err := r.upstreamAddrs(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %q", addr)
+	}
+
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := dialer.DialContext(ctx, network, a)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,78 @@
+package httpresolver
+
+// Tests for the IPv6-only network support.
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSynthesizeNAT64(t *testing.T) {
+	// Examples from RFC 6052, section 2.4.
+	cases := []struct {
+		prefix, expected string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, c := range cases {
+		prefix, err := ParseNAT64Prefix(c.prefix)
+		if err != nil {
+			t.Fatalf("%s: error parsing: %v", c.prefix, err)
+		}
+		ip := synthesizeNAT64(prefix, net.ParseIP("192.0.2.33"))
+		if !ip.Equal(net.ParseIP(c.expected)) {
+			t.Errorf("%s: got %v, expected %s", c.prefix, ip, c.expected)
+		}
+	}
+
+	for _, s := range []string{"", "64:ff9b::", "10.0.0.0/8", "64:ff9b::/80"} {
+		if _, err := ParseNAT64Prefix(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestUpstreamAddrs(t *testing.T) {
+	r := &httpsResolver{}
+	r.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{
+			{IP: net.ParseIP("192.0.2.1")},
+			{IP: net.ParseIP("2001:db8::1")},
+		}, nil
+	}
+
+	check := func(hostport string, expected ...string) {
+		t.Helper()
+		addrs, err := r.upstreamAddrs(context.Background(), hostport)
+		if err != nil {
+			t.Fatalf("%s: error: %v", hostport, err)
+		}
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Errorf("%s: got %v, expected %v", hostport, addrs, expected)
+		}
+	}
+
+	check("dns.example:443", "192.0.2.1:443", "[2001:db8::1]:443")
+	check("192.0.2.5:443", "192.0.2.5:443")
+
+	r.PreferIPv6 = true
+	check("dns.example:443", "[2001:db8::1]:443", "192.0.2.1:443")
+
+	r.NAT64Prefix, _ = ParseNAT64Prefix("64:ff9b::/96")
+	check("dns.example:443",
+		"[64:ff9b::c000:201]:443", "[2001:db8::1]:443", "192.0.2.1:443")
+	check("192.0.2.5:443", "[64:ff9b::c000:205]:443", "192.0.2.5:443")
+	check("[2001:db8::5]:443", "[2001:db8::5]:443")
+
+	if _, err := r.upstreamAddrs(context.Background(), "noport"); err == nil {
+		t.Errorf("noport: no error")
+	}
+}
@@ -1,13 +1,17 @@
 package httpresolver
 
 import (
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"blitiri.com.ar/go/dnss/internal/dnsserver"
 	"blitiri.com.ar/go/dnss/internal/testutil"
@@ -36,7 +40,7 @@ func TestSimple(t *testing.T) {
 		t.Errorf("unexpected result: %q", ans.(*dns.MX).Mx)
 	}
 
-	in, _, err := testutil.DNSQuery(DNSAddr, "unknown.", dns.TypeA)
+	in, _, err := testutil.DNSQuery(DNSAddr, "doesnotexist.", dns.TypeMX)
 	if err != nil {
 		t.Errorf("dns query returned error: %v", err)
 	}
@@ -45,6 +49,106 @@ func TestSimple(t *testing.T) {
 	}
 }
 
+func TestCasePreservation(t *testing.T) {
+	// The test server lowercases the names (and drops the trailing dot in
+	// some cases), as some real-world servers do; we must reply with the
+	// exact name from the query.
+	cases := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"TeSt.BlAh.", dns.TypeA},
+		{"TEST.BLAH.", dns.TypeMX},
+		{"NoDot.Blah.", dns.TypeA},
+		{"Chain.Blah.", dns.TypeA},
+	}
+
+	for _, c := range cases {
+		in, _, err := testutil.DNSQuery(DNSAddr, c.name, c.qtype)
+		if err != nil {
+			t.Errorf("%s: dns query returned error: %v", c.name, err)
+			continue
+		}
+		if len(in.Question) != 1 || in.Question[0].Name != c.name {
+			t.Errorf("%s: unexpected question: %v", c.name, in.Question)
+		}
+		if len(in.Answer) == 0 {
+			t.Errorf("%s: no answers: %v", c.name, in)
+			continue
+		}
+		if n := in.Answer[0].Header().Name; n != c.name {
+			t.Errorf("%s: unexpected answer name %q", c.name, n)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	conn, err := net.Dial("udp", DNSAddr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	m := &dns.Msg{}
+	m.SetQuestion("chain.blah.", dns.TypeA)
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(packed); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	reply := &dns.Msg{}
+	if err := reply.Unpack(buf[:n]); err != nil {
+		t.Fatalf("failed to unpack reply: %v", err)
+	}
+
+	// The whole chain must come back intact.
+	if len(reply.Answer) != 4 {
+		t.Fatalf("expected 4 answers, got %v", reply.Answer)
+	}
+	cname, ok := reply.Answer[0].(*dns.CNAME)
+	if !ok || cname.Target != "a.long.name.for.testing.compression.blah." {
+		t.Errorf("unexpected CNAME: %v", reply.Answer[0])
+	}
+	for _, rr := range reply.Answer[1:] {
+		if rr.Header().Name != cname.Target {
+			t.Errorf("unexpected answer name: %v", rr)
+		}
+	}
+
+	// And the names should have been compressed on the wire.
+	reply.Compress = false
+	uncompressed, err := reply.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack: %v", err)
+	}
+	if n >= len(uncompressed) {
+		t.Errorf("reply was not compressed: %d bytes, uncompressed %d",
+			n, len(uncompressed))
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	// The test server only replies to this name if we accept gzip, and
+	// compresses the response.
+	_, ans, err := testutil.DNSQuery(DNSAddr, "gzip.blah.", dns.TypeA)
+	if err != nil {
+		t.Fatalf("dns query returned error: %v", err)
+	}
+	if ans == nil || ans.(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("unexpected result: %q", ans)
+	}
+}
+
 //
 // === Benchmarks ===
 //
@@ -75,7 +179,9 @@ func DNSHandler(w http.ResponseWriter, r *http.Request) {
 
 	resp := jsonNXDOMAIN
 
-	if r.Form["name"][0] == "test.blah." {
+	// Names are case-insensitive.
+	switch strings.ToLower(r.Form["name"][0]) {
+	case "test.blah.":
 		switch r.Form["type"][0] {
 		case "1", "A":
 			resp = jsonA
@@ -84,6 +190,19 @@ func DNSHandler(w http.ResponseWriter, r *http.Request) {
 		default:
 			resp = jsonNXDOMAIN
 		}
+	case "nodot.blah.":
+		resp = jsonNoDot
+	case "chain.blah.":
+		resp = jsonChain
+	case "gzip.blah.":
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(
+				strings.Replace(jsonA, "test.blah.", "gzip.blah.", -1)))
+			gz.Close()
+			return
+		}
 	}
 
 	w.Write([]byte(resp))
@@ -106,6 +225,29 @@ const jsonMX = ` {
 	  "data": "10 mail.test.blah." } ] }
 `
 
+// A record, without trailing dots in the names.
+const jsonNoDot = ` {
+  "Status": 0, "TC": false, "RD": true, "RA": true, "AD": false, "CD": false,
+  "Question": [ { "name": "nodot.blah", "type": 1 } ],
+  "Answer": [ { "name": "nodot.blah", "type": 1, "TTL": 21599,
+	  "data": "1.2.3.4" } ] }
+`
+
+// CNAME chain, with long names that benefit from compression.
+const jsonChain = ` {
+  "Status": 0, "TC": false, "RD": true, "RA": true, "AD": false, "CD": false,
+  "Question": [ { "name": "chain.blah.", "type": 1 } ],
+  "Answer": [
+    { "name": "chain.blah.", "type": 5, "TTL": 21599,
+	  "data": "a.long.name.for.testing.compression.blah." },
+    { "name": "a.long.name.for.testing.compression.blah.", "type": 1,
+	  "TTL": 21599, "data": "1.2.3.4" },
+    { "name": "a.long.name.for.testing.compression.blah.", "type": 1,
+	  "TTL": 21599, "data": "1.2.3.5" },
+    { "name": "a.long.name.for.testing.compression.blah.", "type": 1,
+	  "TTL": 21599, "data": "1.2.3.6" } ] }
+`
+
 // NXDOMAIN error.
 const jsonNXDOMAIN = ` {
   "Status": 3, "TC": false, "RD": true, "RA": true, "AD": true, "CD": false,
@@ -0,0 +1,42 @@
+package httpresolver
+
+// Tests for the TLS key log.
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	u, _ := url.Parse("https://dns.example/dns-query")
+	buf := &bytes.Buffer{}
+
+	r := NewDoH(u, "")
+	r.KeyLog = buf
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	tc := r.client.Transport.(*http.Transport).TLSClientConfig
+	if tc == nil || tc.KeyLogWriter != buf {
+		t.Errorf("key log not set in the transport: %+v", tc)
+	}
+
+	dot := newDoT(r)
+	if err := dot.Init(); err != nil {
+		t.Fatalf("DoT Init error: %v", err)
+	}
+	if dot.client.TLSConfig.KeyLogWriter != buf {
+		t.Errorf("key log not set in the DoT client")
+	}
+
+	// Without it, we keep the default TLS configuration.
+	r = NewDoH(u, "")
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	if tc := r.client.Transport.(*http.Transport).TLSClientConfig; tc != nil {
+		t.Errorf("unexpected TLS configuration: %+v", tc)
+	}
+}
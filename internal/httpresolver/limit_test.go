@@ -0,0 +1,80 @@
+package httpresolver
+
+// Tests for the limit of outstanding requests.
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// stalledTransport is an http.RoundTripper which blocks requests until
+// released.
+type stalledTransport struct {
+	started chan bool
+	release chan bool
+}
+
+func (s *stalledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.started <- true
+	<-s.release
+	return nil, errors.New("stalled")
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	st := &stalledTransport{
+		started: make(chan bool),
+		release: make(chan bool),
+	}
+	u, _ := url.Parse("https://dns.example/resolve")
+	r := NewJSON(u, "")
+	r.Transport = st
+	r.MaxConcurrent = 2
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	query := func() error {
+		req := &dns.Msg{}
+		req.SetQuestion("test.", dns.TypeA)
+		_, err := r.Query(req, &testutil.NullTrace{})
+		return err
+	}
+
+	// Fill up the outstanding requests.
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- query() }()
+		<-st.started
+	}
+
+	// The next one should fail right away.
+	prev := stats.busy.Value()
+	if err := query(); err != errBusy {
+		t.Errorf("expected errBusy, got %v", err)
+	}
+	if stats.busy.Value() != prev+1 {
+		t.Errorf("busy rejection was not counted")
+	}
+
+	// Once one of them finishes, we can query again.
+	st.release <- true
+	if err := <-errs; err == nil || err == errBusy {
+		t.Errorf("unexpected error from stalled query: %v", err)
+	}
+
+	go func() { errs <- query() }()
+	<-st.started
+	st.release <- true
+	st.release <- true
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == errBusy {
+			t.Errorf("unexpected errBusy")
+		}
+	}
+}
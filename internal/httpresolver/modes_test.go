@@ -0,0 +1,113 @@
+package httpresolver
+
+// Benchmarks comparing the upstream modes (JSON, DoH and DoT) against the
+// same server, to help choose one.
+//
+// Run them with:
+//   go test -run=NONE -bench=Modes ./internal/httpresolver/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/httpserver"
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// modesEnv is the test environment for the benchmarks: a plain DNS server,
+// and our HTTPS-to-DNS server and a DoT server in front of it.
+type modesEnv struct {
+	https   *httptest.Server
+	dotAddr string
+}
+
+func newModesEnv(b *testing.B) *modesEnv {
+	handler := testutil.MakeStaticHandler(b, "test.blah. 3600 A 1.2.3.4")
+
+	dnsAddr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(dnsAddr, handler)
+	if err := testutil.WaitForDNSServer(dnsAddr); err != nil {
+		b.Fatalf("error starting DNS server: %v", err)
+	}
+
+	htod := &httpserver.Server{Upstream: dnsAddr}
+	env := &modesEnv{
+		https: httptest.NewTLSServer(http.HandlerFunc(htod.Resolve)),
+	}
+
+	env.dotAddr = testutil.GetFreePort()
+	started := make(chan bool)
+	dot := &dns.Server{
+		Addr:    env.dotAddr,
+		Net:     "tcp-tls",
+		Handler: dns.HandlerFunc(handler),
+		TLSConfig: &tls.Config{
+			Certificates: env.https.TLS.Certificates,
+		},
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go dot.ListenAndServe()
+	<-started
+
+	return env
+}
+
+func (env *modesEnv) resolver(b *testing.B, mode string) dnsserver.Resolver {
+	u, _ := url.Parse(env.https.URL + "/dns-query")
+
+	var r dnsserver.Resolver
+	switch mode {
+	case "JSON":
+		hr := NewJSON(u, "")
+		hr.Transport = env.https.Client().Transport
+		r = hr
+	case "DoH":
+		hr := NewDoH(u, "")
+		hr.Transport = env.https.Client().Transport
+		r = hr
+	case "DoT":
+		r = &dotResolver{Addr: env.dotAddr, ServerName: "example.com"}
+	}
+
+	if err := r.Init(); err != nil {
+		b.Fatalf("%s: Init error: %v", mode, err)
+	}
+
+	// Trust the test server's certificate.
+	if dot, ok := r.(*dotResolver); ok {
+		pool := x509.NewCertPool()
+		pool.AddCert(env.https.Certificate())
+		dot.client.TLSConfig.RootCAs = pool
+	}
+	return r
+}
+
+func BenchmarkModes(b *testing.B) {
+	env := newModesEnv(b)
+	defer env.https.Close()
+
+	for _, mode := range []string{"JSON", "DoH", "DoT"} {
+		r := env.resolver(b, mode)
+		b.Run(mode, func(b *testing.B) {
+			tr := &testutil.NullTrace{}
+			for i := 0; i < b.N; i++ {
+				req := &dns.Msg{}
+				req.SetQuestion("test.blah.", dns.TypeA)
+				reply, err := r.Query(req, tr)
+				if err != nil {
+					b.Fatalf("%s: query error: %v", mode, err)
+				}
+				if len(reply.Answer) != 1 {
+					b.Fatalf("%s: unexpected reply: %v", mode, reply)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package httpresolver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/dnss/internal/webhook"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// poolResolver implements the dnsserver.Resolver interface over a set of
+// upstreams, which can be added, disabled and removed at runtime.
+//
+// Queries go to the first enabled upstream, and fail over to the next ones
+// (in the order they were added) on errors, within the retry budget (see
+// MaxAttempts).
+type poolResolver struct {
+	// When the last query succeeded and failed (as a whole, that is, in all
+	// the upstreams), in Unix nanoseconds, updated atomically. They go first
+	// to keep them 64-bit aligned on 32-bit platforms.
+	lastOK, lastFailed int64
+
+	// Reset the upstream connections when the network changes.
+	ResetOnNetworkChange bool
+
+	// Maximum time to leave an upstream idle: if there are no queries to it
+	// for this long, we send a cheap one, so the NAT and firewall state of
+	// its connections doesn't expire (0 means never).
+	KeepAlive time.Duration
+
+	// Maximum number of attempts per query, across all the upstreams: on
+	// errors, we go to the next upstream (back to the first one after the
+	// last) until one replies, the budget runs out, or the client gives
+	// up. This keeps retries bounded when the upstreams are struggling, so
+	// we don't make things worse. 0 means one attempt per upstream.
+	MaxAttempts int
+
+	// Allow changing the upstreams via HandleUpstreams; otherwise it only
+	// shows them.
+	Admin bool
+
+	// Returns the health check for the given upstream (see
+	// healthcheck.go). If nil, DefaultHealthCheck is used for all of them.
+	HealthChecks func(upstream string) HealthCheck
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Creates a resolver for the given upstream.
+	newUpstream func(upstream string) (dnsserver.Resolver, error)
+
+	// Protects the upstreams.
+	mu *sync.RWMutex
+
+	upstreams []*poolUpstream
+}
+
+// poolUpstream is an upstream in the pool.
+type poolUpstream struct {
+	// Statistics, updated atomically. They go first to keep them 64-bit
+	// aligned on 32-bit platforms.
+	queries, failed, rejected, outstanding int64
+
+	// When the last query was sent to it, in Unix nanoseconds (0 if never),
+	// updated atomically.
+	lastQuery int64
+
+	// Whether the health checks marked it as down, updated atomically.
+	down int32
+
+	name    string
+	r       dnsserver.Resolver
+	enabled bool
+
+	// Health check, when it was last done, and how many of the last ones
+	// in a row passed and failed. Only used by the health checks.
+	hc                     HealthCheck
+	lastCheck              time.Time
+	checksOK, checksFailed int
+
+	// Queries in flight, to wait for them when the upstream is removed.
+	inflight *sync.WaitGroup
+}
+
+// UpstreamStatus is the status of an upstream in the pool.
+type UpstreamStatus struct {
+	Name        string
+	Enabled     bool
+	Queries     int64
+	Errors      int64
+	Outstanding int64
+
+	// Whether the health checks consider it down.
+	Down bool
+
+	// Queries the upstream rejected (see rejections.go); they are not
+	// errors.
+	Rejected int64
+}
+
+var (
+	errNoUpstreams     = errors.New("no upstreams available")
+	errUnknownUpstream = errors.New("unknown upstream")
+)
+
+// NewPool creates a new resolver over a pool of upstreams. newUpstream is
+// used to create the resolvers for them, given their names (usually the URL
+// or DNS stamp).
+func NewPool(newUpstream func(upstream string) (dnsserver.Resolver, error)) *poolResolver {
+	return &poolResolver{
+		newUpstream: newUpstream,
+		clock:       util.RealClock,
+		mu:          &sync.RWMutex{},
+	}
+}
+
+// Add an upstream to the pool. It's initialized, so it can be used right
+// away. Can be called before and after Init.
+func (p *poolResolver) Add(upstream string) error {
+	r, err := p.newUpstream(upstream)
+	if err != nil {
+		return err
+	}
+	if err := r.Init(); err != nil {
+		closeResolver(r)
+		return err
+	}
+
+	// Check for duplicates in the same critical section as the append, so
+	// concurrent adds of the same upstream can't both succeed.
+	p.mu.Lock()
+	for _, u := range p.upstreams {
+		if u.name == upstream {
+			p.mu.Unlock()
+			closeResolver(r)
+			return fmt.Errorf("upstream %q already exists", upstream)
+		}
+	}
+	p.upstreams = append(p.upstreams, &poolUpstream{
+		name:     upstream,
+		r:        r,
+		enabled:  true,
+		inflight: &sync.WaitGroup{},
+		hc:       p.healthCheck(upstream),
+	})
+	p.mu.Unlock()
+
+	go r.Maintain()
+	log.Infof("Added upstream %q", upstream)
+	return nil
+}
+
+// SetEnabled enables or disables the given upstream. Disabled upstreams are
+// not used for new queries.
+func (p *poolResolver) SetEnabled(upstream string, enabled bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range p.upstreams {
+		if u.name == upstream {
+			u.enabled = enabled
+			log.Infof("Upstream %q enabled: %v", upstream, enabled)
+			return nil
+		}
+	}
+	return errUnknownUpstream
+}
+
+// Remove the given upstream from the pool. New queries will not use it, and
+// once the queries in flight finish, its resolver is closed (see
+// closeResolver).
+func (p *poolResolver) Remove(upstream string) error {
+	p.mu.Lock()
+	var removed *poolUpstream
+	for i, u := range p.upstreams {
+		if u.name == upstream {
+			removed = u
+			p.upstreams = append(p.upstreams[:i], p.upstreams[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if removed == nil {
+		return errUnknownUpstream
+	}
+
+	log.Infof("Removed upstream %q, draining", upstream)
+	go func() {
+		removed.inflight.Wait()
+		closeResolver(removed.r)
+		log.Infof("Upstream %q drained", upstream)
+	}()
+	return nil
+}
+
+// Status returns the status of the upstreams, in order.
+func (p *poolResolver) Status() []UpstreamStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var st []UpstreamStatus
+	for _, u := range p.upstreams {
+		st = append(st, UpstreamStatus{
+			Name:        u.name,
+			Enabled:     u.enabled,
+			Queries:     atomic.LoadInt64(&u.queries),
+			Errors:      atomic.LoadInt64(&u.failed),
+			Outstanding: atomic.LoadInt64(&u.outstanding),
+			Rejected:    atomic.LoadInt64(&u.rejected),
+			Down:        atomic.LoadInt32(&u.down) == 1,
+		})
+	}
+	return st
+}
+
+// Healthy returns an error if the pool can't resolve queries at the moment:
+// because it has no enabled upstreams, or because the last query failed in
+// all of them. If there haven't been any queries in the last maxAge, it sends
+// one to find out.
+func (p *poolResolver) Healthy(maxAge time.Duration) error {
+	us := p.enabled()
+	for _, u := range us {
+		u.inflight.Done()
+	}
+	if len(us) == 0 {
+		return errNoUpstreams
+	}
+
+	last := atomic.LoadInt64(&p.lastOK)
+	failed := atomic.LoadInt64(&p.lastFailed)
+	if failed > last {
+		last = failed
+	}
+
+	if time.Since(time.Unix(0, last)) > maxAge {
+		tr := trace.New("httpresolver.Pool", "readiness check")
+		defer tr.Finish()
+
+		hc := us[0].hc
+		reply, err := p.Query(hc.query(), tr)
+		if err != nil {
+			return err
+		}
+		return hc.check(reply)
+	}
+
+	if failed > atomic.LoadInt64(&p.lastOK) {
+		return errors.New("last query failed in all upstreams")
+	}
+	return nil
+}
+
+// RegisterDebugHandlers registers http debug handlers, which can be accessed
+// from the monitoring server.
+// Note these are global by nature, if you try to register them multiple
+// times, you will get a panic.
+func (p *poolResolver) RegisterDebugHandlers() {
+	http.HandleFunc("/debug/httpresolver/upstreams", p.HandleUpstreams)
+}
+
+// HandleUpstreams is the HTTP handler to see and change the upstreams. POST
+// add=, remove=, enable= or disable= with the upstream to change them (only
+// if Admin is set, see util.CheckAdminRequest).
+func (p *poolResolver) HandleUpstreams(w http.ResponseWriter, r *http.Request) {
+	change := false
+	for _, k := range []string{"add", "remove", "enable", "disable"} {
+		if r.FormValue(k) != "" {
+			change = true
+		}
+	}
+	if change && !p.Admin {
+		http.Error(w, "changing the upstreams is disabled"+
+			" (see -monitoring_admin)", http.StatusForbidden)
+		return
+	}
+	if change && !util.CheckAdminRequest(w, r) {
+		return
+	}
+
+	var err error
+	if u := r.FormValue("add"); u != "" {
+		err = p.Add(u)
+	} else if u := r.FormValue("remove"); u != "" {
+		err = p.Remove(u)
+	} else if u := r.FormValue("enable"); u != "" {
+		err = p.SetEnabled(u, true)
+	} else if u := r.FormValue("disable"); u != "" {
+		err = p.SetEnabled(u, false)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, st := range p.Status() {
+		state := "enabled"
+		if !st.Enabled {
+			state = "disabled"
+		} else if st.Down {
+			state = "enabled, down"
+		}
+		fmt.Fprintf(w, "%s  (%s)\n", st.Name, state)
+		fmt.Fprintf(w, "   queries: %d   errors: %d   rejected: %d"+
+			"   outstanding: %d\n\n",
+			st.Queries, st.Errors, st.Rejected, st.Outstanding)
+	}
+}
+
+func (p *poolResolver) Init() error {
+	// The upstreams are initialized as they are added.
+	return nil
+}
+
+func (p *poolResolver) Maintain() {
+	// The upstreams are maintained as they are added.
+	if p.KeepAlive > 0 {
+		go p.clock.Every(p.KeepAlive/2, p.keepAlive)
+	}
+	if p.HealthChecks != nil {
+		go p.clock.Every(healthCheckTick, p.healthChecks)
+	}
+	if p.ResetOnNetworkChange {
+		util.WatchNetwork(p.networkChanged)
+	}
+}
+
+// keepAlive sends a query to the enabled upstreams which have been idle for
+// at least half the KeepAlive period, so they're never idle for longer than
+// it. Upstreams we never queried are left alone, as they have no
+// connections to keep.
+func (p *poolResolver) keepAlive() {
+	us := p.enabled()
+	defer func() {
+		for _, u := range us {
+			u.inflight.Done()
+		}
+	}()
+
+	now := p.clock.Now()
+	for _, u := range us {
+		last := atomic.LoadInt64(&u.lastQuery)
+		if last == 0 || now.Sub(time.Unix(0, last)) < p.KeepAlive/2 {
+			continue
+		}
+		atomic.StoreInt64(&u.lastQuery, now.UnixNano())
+
+		tr := trace.New("httpresolver.Pool", "keepalive")
+		tr.LazyPrintf("upstream %q idle since %v", u.name, time.Unix(0, last))
+		if _, err := u.r.Query(u.hc.query(), tr); err != nil {
+			stats.keepalives.Add("failed", 1)
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError()
+		} else {
+			stats.keepalives.Add("ok", 1)
+		}
+		tr.Finish()
+	}
+}
+
+// networkChanged resets the connections of all the upstreams.
+func (p *poolResolver) networkChanged() {
+	log.Infof("Network change detected, resetting upstream connections")
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, u := range p.upstreams {
+		if nc, ok := u.r.(interface{ NetworkChanged() }); ok {
+			nc.NetworkChanged()
+		} else {
+			closeIdleConnections(u.r)
+		}
+	}
+}
+
+// closeResolver stops the resolver once it's no longer used, so it doesn't
+// keep anything running in the background (like its Maintain). Resolvers
+// which have nothing to stop can just implement CloseIdleConnections, so
+// their connections get closed.
+func closeResolver(r dnsserver.Resolver) {
+	if c, ok := r.(interface{ Close() }); ok {
+		c.Close()
+	} else {
+		closeIdleConnections(r)
+	}
+}
+
+// closeIdleConnections closes the idle connections of the resolver, if it
+// supports it.
+func closeIdleConnections(r dnsserver.Resolver) {
+	if c, ok := r.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// enabled returns the enabled upstreams which are not down, marking them as
+// in use; the caller must call inflight.Done() on each of them when
+// finished. If the health checks consider all of them down, it returns them
+// all anyway, as trying is better than failing right away.
+func (p *poolResolver) enabled() []*poolUpstream {
+	var up, down []*poolUpstream
+	for _, u := range p.allEnabled() {
+		if atomic.LoadInt32(&u.down) == 1 {
+			down = append(down, u)
+		} else {
+			up = append(up, u)
+		}
+	}
+	if len(up) == 0 {
+		return down
+	}
+	for _, u := range down {
+		u.inflight.Done()
+	}
+	return up
+}
+
+// allEnabled is like enabled, but includes the upstreams which are down.
+func (p *poolResolver) allEnabled() []*poolUpstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var us []*poolUpstream
+	for _, u := range p.upstreams {
+		if u.enabled {
+			u.inflight.Add(1)
+			us = append(us, u)
+		}
+	}
+	return us
+}
+
+func (p *poolResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	us := p.enabled()
+	defer func() {
+		for _, u := range us {
+			u.inflight.Done()
+		}
+	}()
+
+	attempts := len(us)
+	if p.MaxAttempts > 0 && len(us) > 0 {
+		attempts = p.MaxAttempts
+	}
+
+	err := errNoUpstreams
+	for i := 0; i < attempts; i++ {
+		u := us[i%len(us)]
+		if attempts > 1 {
+			tr.LazyPrintf("querying upstream %q (attempt %d of %d)",
+				u.name, i+1, attempts)
+		}
+		if i > 0 {
+			stats.retries.Add(1)
+		}
+
+		atomic.AddInt64(&u.queries, 1)
+		atomic.StoreInt64(&u.lastQuery, p.clock.Now().UnixNano())
+		atomic.AddInt64(&u.outstanding, 1)
+		var reply *dns.Msg
+		reply, err = u.r.Query(req, tr)
+		atomic.AddInt64(&u.outstanding, -1)
+
+		if err == nil {
+			// Rejections are a reply like any other, we don't try the
+			// other upstreams to get around them.
+			if isRejection(reply) {
+				atomic.AddInt64(&u.rejected, 1)
+				recordRejection(u.name, req, reply, tr)
+			}
+			atomic.StoreInt64(&p.lastOK, time.Now().UnixNano())
+			return reply, nil
+		}
+
+		// The client abandoned the query, so the upstream didn't
+		// really fail, and there's no point in trying the others.
+		if util.Context(tr).Err() != nil {
+			tr.LazyPrintf("query abandoned: %v", err)
+			return nil, err
+		}
+
+		atomic.AddInt64(&u.failed, 1)
+		rejectionStats.failures.Add(1)
+		tr.LazyPrintf("upstream %q failed: %v", u.name, err)
+	}
+
+	if p.MaxAttempts > 0 && len(us) > 0 {
+		stats.retriesExhausted.Add(1)
+		tr.LazyPrintf("retry budget exhausted after %d attempts", attempts)
+	}
+
+	atomic.StoreInt64(&p.lastFailed, time.Now().UnixNano())
+	if len(us) > 0 {
+		webhook.Notify(webhook.UpstreamsDown, "",
+			"all upstreams failed, last error: %v", err)
+	}
+	return nil, err
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ dnsserver.Resolver = &poolResolver{}
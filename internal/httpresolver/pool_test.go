@@ -0,0 +1,486 @@
+package httpresolver
+
+// Tests for the pool of upstreams.
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// blockingResolver is a TestResolver which blocks queries until released,
+// and records when its connections are closed.
+type blockingResolver struct {
+	*testutil.TestResolver
+	started chan bool
+	release chan bool
+	closed  chan bool
+}
+
+func (r *blockingResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	r.started <- true
+	<-r.release
+	return r.TestResolver.Query(req, tr)
+}
+
+func (r *blockingResolver) CloseIdleConnections() {
+	r.closed <- true
+}
+
+// testPool returns a pool whose upstreams are the resolvers in the given
+// map, by name.
+func testPool(t *testing.T, rs map[string]dnsserver.Resolver) *poolResolver {
+	t.Helper()
+	p := NewPool(func(upstream string) (dnsserver.Resolver, error) {
+		r, ok := rs[upstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown test upstream %q", upstream)
+		}
+		return r, nil
+	})
+	if err := p.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	return p
+}
+
+func poolQuery(p *poolResolver) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion("test.", dns.TypeA)
+	return p.Query(req, &testutil.NullTrace{})
+}
+
+func TestPoolFailover(t *testing.T) {
+	r1 := testutil.NewTestResolver()
+	r1.RespError = errors.New("r1 is broken")
+	r2 := testutil.NewTestResolver()
+	r2.Response = &dns.Msg{}
+
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1, "r2": r2})
+
+	if _, err := poolQuery(p); err != errNoUpstreams {
+		t.Errorf("expected errNoUpstreams, got %v", err)
+	}
+
+	for _, u := range []string{"r1", "r2"} {
+		if err := p.Add(u); err != nil {
+			t.Fatalf("error adding %q: %v", u, err)
+		}
+	}
+	if !r1.Initialized || !r2.Initialized {
+		t.Errorf("upstreams were not initialized")
+	}
+
+	if _, err := poolQuery(p); err != nil {
+		t.Errorf("query failed: %v", err)
+	}
+	if r1.LastQuery == nil || r2.LastQuery == nil {
+		t.Errorf("query did not fail over")
+	}
+
+	st := p.Status()
+	if len(st) != 2 || st[0].Name != "r1" || st[0].Errors != 1 ||
+		st[1].Name != "r2" || st[1].Queries != 1 || st[1].Errors != 0 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+
+	// When all of them fail, we get the last error.
+	r2.RespError = errors.New("r2 is broken")
+	if _, err := poolQuery(p); err != r2.RespError {
+		t.Errorf("expected r2's error, got %v", err)
+	}
+}
+
+func TestPoolRetryBudget(t *testing.T) {
+	r1 := testutil.NewTestResolver()
+	r1.RespError = errors.New("r1 is broken")
+	r2 := testutil.NewTestResolver()
+	r2.RespError = errors.New("r2 is broken")
+
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1, "r2": r2})
+	p.Add("r1")
+	p.Add("r2")
+	p.MaxAttempts = 3
+
+	prevRetries := stats.retries.Value()
+	prevExhausted := stats.retriesExhausted.Value()
+
+	// We go back to the first upstream after the last one, and stop once
+	// the budget runs out.
+	if _, err := poolQuery(p); err != r1.RespError {
+		t.Errorf("expected r1's error, got %v", err)
+	}
+	st := p.Status()
+	if st[0].Queries != 2 || st[1].Queries != 1 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if v := stats.retries.Value(); v != prevRetries+2 {
+		t.Errorf("expected %d retries, got %d", prevRetries+2, v)
+	}
+	if v := stats.retriesExhausted.Value(); v != prevExhausted+1 {
+		t.Errorf("expected %d exhausted, got %d", prevExhausted+1, v)
+	}
+
+	// A smaller budget than upstreams leaves the last ones out.
+	p.MaxAttempts = 1
+	r2.RespError = nil
+	r2.Response = &dns.Msg{}
+	if _, err := poolQuery(p); err != r1.RespError {
+		t.Errorf("expected r1's error, got %v", err)
+	}
+	if st := p.Status(); st[0].Queries != 3 || st[1].Queries != 1 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+
+	// And once one of them replies, we stop.
+	p.MaxAttempts = 5
+	if _, err := poolQuery(p); err != nil {
+		t.Errorf("query failed: %v", err)
+	}
+	if st := p.Status(); st[0].Queries != 4 || st[1].Queries != 2 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestPoolRejections(t *testing.T) {
+	r1 := testutil.NewTestResolver()
+	r1.Response = &dns.Msg{}
+	r1.Response.Rcode = dns.RcodeRefused
+	r2 := testutil.NewTestResolver()
+	r2.Response = &dns.Msg{}
+
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1, "r2": r2})
+	p.Add("r1")
+	p.Add("r2")
+
+	prevRefused := expvarIntValue(rejectionStats.rejections.Get("REFUSED"))
+	prevFailures := rejectionStats.failures.Value()
+
+	// The rejection is passed on as-is, without trying the next upstream,
+	// and it's not an error.
+	reply, err := poolQuery(p)
+	if err != nil || reply.Rcode != dns.RcodeRefused {
+		t.Errorf("expected the REFUSED reply, got %v, %v", reply, err)
+	}
+	if r2.LastQuery != nil {
+		t.Errorf("rejection failed over to the next upstream")
+	}
+
+	st := p.Status()
+	if st[0].Rejected != 1 || st[0].Errors != 0 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if v := expvarIntValue(rejectionStats.rejections.Get("REFUSED")); v != prevRefused+1 {
+		t.Errorf("expected %d rejections, got %d", prevRefused+1, v)
+	}
+	if v := rejectionStats.failures.Value(); v != prevFailures {
+		t.Errorf("rejection counted as a failure")
+	}
+
+	// A failure is another matter.
+	r1.Response = nil
+	r1.RespError = errors.New("r1 is broken")
+	if _, err := poolQuery(p); err != nil {
+		t.Errorf("query failed: %v", err)
+	}
+	if v := rejectionStats.failures.Value(); v != prevFailures+1 {
+		t.Errorf("expected %d failures, got %d", prevFailures+1, v)
+	}
+}
+
+// expvarIntValue returns the value of the given expvar.Int (from a map), or
+// 0 if there is none.
+func expvarIntValue(v expvar.Var) int64 {
+	if i, ok := v.(*expvar.Int); ok {
+		return i.Value()
+	}
+	return 0
+}
+
+func TestPoolEnableDisable(t *testing.T) {
+	r1 := testutil.NewTestResolver()
+	r1.Response = &dns.Msg{}
+	r2 := testutil.NewTestResolver()
+	r2.Response = &dns.Msg{}
+
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1, "r2": r2})
+	p.Add("r1")
+	p.Add("r2")
+
+	if err := p.SetEnabled("r1", false); err != nil {
+		t.Fatalf("error disabling r1: %v", err)
+	}
+	poolQuery(p)
+	if r1.LastQuery != nil || r2.LastQuery == nil {
+		t.Errorf("query went to the disabled upstream")
+	}
+
+	p.SetEnabled("r1", true)
+	r2.LastQuery = nil
+	poolQuery(p)
+	if r1.LastQuery == nil || r2.LastQuery != nil {
+		t.Errorf("query did not go to the re-enabled upstream")
+	}
+
+	if err := p.SetEnabled("r3", false); err != errUnknownUpstream {
+		t.Errorf("expected errUnknownUpstream, got %v", err)
+	}
+}
+
+func TestPoolHealthy(t *testing.T) {
+	r1 := testutil.NewTestResolver()
+	r1.Response = &dns.Msg{}
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1})
+
+	if err := p.Healthy(time.Minute); err != errNoUpstreams {
+		t.Errorf("expected errNoUpstreams, got %v", err)
+	}
+
+	// Without a recent query, the check queries the upstreams itself.
+	p.Add("r1")
+	r1.LastQuery = nil
+	if err := p.Healthy(time.Minute); err != nil {
+		t.Errorf("expected healthy, got %v", err)
+	}
+	if r1.LastQuery == nil {
+		t.Errorf("health check did not query the upstreams")
+	}
+
+	// With a recent one, it uses the result.
+	r1.RespError = errors.New("r1 is broken")
+	poolQuery(p)
+	r1.LastQuery = nil
+	if err := p.Healthy(time.Minute); err == nil {
+		t.Errorf("expected unhealthy")
+	}
+	if r1.LastQuery != nil {
+		t.Errorf("health check queried the upstreams: %v", r1.LastQuery)
+	}
+
+	r1.RespError = nil
+	poolQuery(p)
+	if err := p.Healthy(time.Minute); err != nil {
+		t.Errorf("expected healthy, got %v", err)
+	}
+}
+
+func TestPoolKeepAlive(t *testing.T) {
+	r1 := testutil.NewTestResolver()
+	r1.Response = &dns.Msg{}
+	r2 := testutil.NewTestResolver()
+	r2.Response = &dns.Msg{}
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1, "r2": r2})
+	clock := testutil.NewFakeClock(time.Now())
+	p.clock = clock
+	p.KeepAlive = time.Minute
+	p.Add("r1")
+	p.Add("r2")
+	p.Maintain()
+	clock.WaitForTasks(1)
+
+	// Upstreams we never used are not kept alive.
+	clock.Advance(5 * time.Minute)
+	if r1.LastQuery != nil || r2.LastQuery != nil {
+		t.Errorf("unused upstreams were queried")
+	}
+
+	// With queries in the meantime, there's no need.
+	poolQuery(p)
+	clock.Advance(20 * time.Second)
+	r1.LastQuery = nil
+	poolQuery(p)
+	clock.Advance(20 * time.Second)
+	if r1.LastQuery.Question[0].Name != "test." {
+		t.Errorf("unexpected keepalive: %v", r1.LastQuery)
+	}
+
+	// Once idle, we query it at least once per period.
+	r1.LastQuery = nil
+	clock.Advance(time.Minute)
+	if r1.LastQuery == nil || r1.LastQuery.Question[0].Name != "." {
+		t.Errorf("idle upstream not kept alive: %v", r1.LastQuery)
+	}
+	if r2.LastQuery != nil {
+		t.Errorf("unused upstream was queried")
+	}
+
+	// Disabled upstreams are not kept alive.
+	p.SetEnabled("r1", false)
+	r1.LastQuery = nil
+	clock.Advance(5 * time.Minute)
+	if r1.LastQuery != nil {
+		t.Errorf("disabled upstream was queried")
+	}
+}
+
+func TestPoolAddErrors(t *testing.T) {
+	p := testPool(t, map[string]dnsserver.Resolver{
+		"r1": testutil.NewTestResolver(),
+	})
+	if err := p.Add("r1"); err != nil {
+		t.Fatalf("error adding r1: %v", err)
+	}
+	if err := p.Add("r1"); err == nil {
+		t.Errorf("duplicated upstream was added")
+	}
+	if err := p.Add("r2"); err == nil {
+		t.Errorf("invalid upstream was added")
+	}
+	if len(p.Status()) != 1 {
+		t.Errorf("unexpected status: %+v", p.Status())
+	}
+}
+
+func TestPoolRemoveDrains(t *testing.T) {
+	r1 := &blockingResolver{
+		TestResolver: testutil.NewTestResolver(),
+		started:      make(chan bool),
+		release:      make(chan bool),
+		closed:       make(chan bool, 1),
+	}
+	r1.Response = &dns.Msg{}
+
+	p := testPool(t, map[string]dnsserver.Resolver{"r1": r1})
+	p.Add("r1")
+
+	errs := make(chan error)
+	go func() {
+		_, err := poolQuery(p)
+		errs <- err
+	}()
+	<-r1.started
+
+	if err := p.Remove("r1"); err != nil {
+		t.Fatalf("error removing r1: %v", err)
+	}
+	if err := p.Remove("r1"); err != errUnknownUpstream {
+		t.Errorf("expected errUnknownUpstream, got %v", err)
+	}
+
+	// New queries don't use it anymore.
+	if _, err := poolQuery(p); err != errNoUpstreams {
+		t.Errorf("expected errNoUpstreams, got %v", err)
+	}
+
+	// The connections must not be closed until the query in flight is done.
+	select {
+	case <-r1.closed:
+		t.Errorf("connections closed before draining")
+	default:
+	}
+
+	r1.release <- true
+	if err := <-errs; err != nil {
+		t.Errorf("query in flight failed: %v", err)
+	}
+	<-r1.closed
+}
+
+// closingResolver is a TestResolver which records when it's closed.
+type closingResolver struct {
+	*testutil.TestResolver
+	closed chan bool
+}
+
+func (r *closingResolver) Close() {
+	r.closed <- true
+}
+
+func TestPoolRemoveCloses(t *testing.T) {
+	// A new resolver each time, like the real ones.
+	created := make(chan *closingResolver, 2)
+	p := NewPool(func(upstream string) (dnsserver.Resolver, error) {
+		r := &closingResolver{
+			TestResolver: testutil.NewTestResolver(),
+			closed:       make(chan bool, 1),
+		}
+		created <- r
+		return r, nil
+	})
+	if err := p.Add("r1"); err != nil {
+		t.Fatalf("error adding r1: %v", err)
+	}
+	r1 := <-created
+
+	// The resolver made for the duplicate is closed right away.
+	if err := p.Add("r1"); err == nil {
+		t.Errorf("duplicated upstream was added")
+	}
+	dup := <-created
+	select {
+	case <-dup.closed:
+	case <-time.After(time.Second):
+		t.Errorf("duplicated resolver not closed")
+	}
+	select {
+	case <-r1.closed:
+		t.Errorf("r1 closed while in the pool")
+	default:
+	}
+
+	if err := p.Remove("r1"); err != nil {
+		t.Fatalf("error removing r1: %v", err)
+	}
+	select {
+	case <-r1.closed:
+	case <-time.After(time.Second):
+		t.Errorf("r1 not closed after being removed")
+	}
+}
+
+func TestHandleUpstreams(t *testing.T) {
+	p := testPool(t, map[string]dnsserver.Resolver{
+		"r1": testutil.NewTestResolver(),
+		"r2": testutil.NewTestResolver(),
+	})
+	p.Add("r1")
+
+	// Changes are not allowed unless enabled.
+	req := httptest.NewRequest("POST", "/debug/httpresolver/upstreams?add=r2", nil)
+	w := httptest.NewRecorder()
+	p.HandleUpstreams(w, req)
+	if w.Code != 403 || len(p.Status()) != 1 {
+		t.Errorf("change allowed without Admin: %d %q", w.Code, w.Body.String())
+	}
+	p.Admin = true
+
+	cases := []struct {
+		method string
+		query  string
+		status int
+		expect string
+	}{
+		{"GET", "", 200, "r1  (enabled)"},
+		{"GET", "?add=r2", 405, "POST"},
+		{"POST", "?add=r2", 200, "r2  (enabled)"},
+		{"POST", "?add=r2", 400, "already exists"},
+		{"POST", "?disable=r1", 200, "r1  (disabled)"},
+		{"POST", "?enable=r1", 200, "r1  (enabled)"},
+		{"POST", "?remove=r3", 400, "unknown upstream"},
+		{"POST", "?remove=r1", 200, "r2  (enabled)"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/debug/httpresolver/upstreams"+c.query, nil)
+		w := httptest.NewRecorder()
+		p.HandleUpstreams(w, req)
+
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.expect) {
+			t.Errorf("%s %q: got %d %q, expected %d with %q",
+				c.method, c.query, w.Code, w.Body.String(), c.status, c.expect)
+		}
+	}
+
+	if st := p.Status(); len(st) != 1 || st[0].Name != "r2" {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
@@ -0,0 +1,110 @@
+package httpresolver
+
+// Tests for the formats of the real DoH providers, replaying the responses
+// in the golden files in testdata/.
+//
+// Note the golden files are synthetic: they were written by hand, following
+// the providers' documentation and the replies they gave at the time, not
+// recorded. Run with -record_golden to replace them with real recordings
+// (the answers, like the TTLs or the address of example.com, may then need
+// updating in the tests below).
+
+import (
+	"net/url"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func newReplayResolver(t *testing.T, mode, upstream, golden string) (*httpsResolver, *testutil.ReplayTransport) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		t.Fatalf("failed to parse URL: %v", err)
+	}
+
+	r := NewJSON(u, "")
+	if mode == "DoH" {
+		r = NewDoH(u, "")
+	}
+	rt := testutil.NewReplayTransport(t, "testdata/"+golden)
+	r.Transport = rt
+	if err := r.Init(); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	return r, rt
+}
+
+func providerQuery(t *testing.T, r *httpsResolver, name string, qtype uint16) *dns.Msg {
+	tr := testutil.NewTestTrace(t)
+	defer tr.Finish()
+
+	m := &dns.Msg{}
+	m.SetQuestion(name, qtype)
+	reply, err := r.Query(m, tr)
+	if err != nil {
+		t.Fatalf("%s %d: query failed: %v", name, qtype, err)
+	}
+	if reply.Id != m.Id {
+		t.Errorf("%s %d: expected id %d, got %d", name, qtype, m.Id, reply.Id)
+	}
+	if len(reply.Question) != 1 || reply.Question[0] != m.Question[0] {
+		t.Errorf("%s %d: unexpected question %v", name, qtype, reply.Question)
+	}
+	return reply
+}
+
+func checkA(t *testing.T, reply *dns.Msg, name, ip string) {
+	if len(reply.Answer) != 1 {
+		t.Fatalf("%s: expected 1 answer, got %v", name, reply.Answer)
+	}
+	a, ok := reply.Answer[0].(*dns.A)
+	if !ok || a.Hdr.Name != name || a.A.String() != ip {
+		t.Errorf("%s: unexpected answer %v", name, reply.Answer[0])
+	}
+}
+
+func TestGoogleJSON(t *testing.T) {
+	r, rt := newReplayResolver(t, "JSON",
+		"https://dns.google.com/resolve", "google_json.json")
+	defer rt.Save()
+
+	reply := providerQuery(t, r, "example.com.", dns.TypeA)
+	checkA(t, reply, "example.com.", "93.184.216.34")
+
+	// TXT data comes quoted, and must be parsed as such.
+	reply = providerQuery(t, r, "example.com.", dns.TypeTXT)
+	if len(reply.Answer) != 1 {
+		t.Fatalf("TXT: expected 1 answer, got %v", reply.Answer)
+	}
+	txt, ok := reply.Answer[0].(*dns.TXT)
+	if !ok || len(txt.Txt) != 1 || txt.Txt[0] != "v=spf1 -all" {
+		t.Errorf("TXT: unexpected answer %v", reply.Answer[0])
+	}
+
+	// Replies include a "Comment" field, which we must ignore.
+	reply = providerQuery(t, r, "doesnotexist.example.com.", dns.TypeA)
+	if reply.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %v", reply)
+	}
+}
+
+func TestCloudflareJSON(t *testing.T) {
+	r, rt := newReplayResolver(t, "JSON",
+		"https://cloudflare-dns.com/dns-query", "cloudflare_json.json")
+	defer rt.Save()
+
+	// Names in the replies don't have the trailing dot.
+	reply := providerQuery(t, r, "example.com.", dns.TypeA)
+	checkA(t, reply, "example.com.", "93.184.216.34")
+}
+
+func TestCloudflareDoH(t *testing.T) {
+	r, rt := newReplayResolver(t, "DoH",
+		"https://cloudflare-dns.com/dns-query", "cloudflare_doh.json")
+	defer rt.Save()
+
+	reply := providerQuery(t, r, "example.com.", dns.TypeA)
+	checkA(t, reply, "example.com.", "93.184.216.34")
+}
@@ -0,0 +1,59 @@
+package httpresolver
+
+import (
+	"expvar"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// Upstream rejections.
+//
+// An upstream replying REFUSED or NOTIMP is telling us it won't answer the
+// query (usually because of a policy, like a filtering provider blocking the
+// name, or because it doesn't support it), which is very different from us
+// not being able to get a reply. So the rejections are passed on to the
+// clients as they are (while failures become SERVFAIL), they don't count as
+// upstream errors, and they are counted and logged separately, to tell
+// "the provider blocked this" apart from "the network broke".
+
+// Exported variables for statistics.
+var rejectionStats = struct {
+	// Queries rejected by the upstreams, by rcode ("REFUSED" or "NOTIMP").
+	rejections *expvar.Map
+
+	// Queries that failed in an upstream (network or HTTP errors, invalid
+	// replies).
+	failures *expvar.Int
+}{}
+
+func init() {
+	rejectionStats.rejections = expvar.NewMap("upstream-rejections")
+	rejectionStats.failures = expvar.NewInt("upstream-failures")
+}
+
+// isRejection returns true if the reply is the upstream rejecting the query.
+func isRejection(reply *dns.Msg) bool {
+	return reply.Rcode == dns.RcodeRefused ||
+		reply.Rcode == dns.RcodeNotImplemented
+}
+
+// recordRejection counts, traces and logs the upstream's rejection of the
+// query.
+func recordRejection(upstream string, req, reply *dns.Msg, tr trace.Trace) {
+	rcode := dns.RcodeToString[reply.Rcode]
+	rejectionStats.rejections.Add(rcode, 1)
+	tr.LazyPrintf("upstream %q rejected the query: %s", upstream, rcode)
+	util.RecentErrors.Add(tr, "rejected", req.Question,
+		"upstream %s replied %s", upstream, rcode)
+
+	name := ""
+	if len(req.Question) > 0 {
+		name = util.DisplayName(req.Question[0].Name)
+	}
+	log.Infof("[%s] upstream rejected: %s replied %s to %s",
+		util.RequestID(tr), upstream, rcode, name)
+}
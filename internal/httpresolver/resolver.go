@@ -2,19 +2,28 @@ package httpresolver
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"blitiri.com.ar/go/dnss/internal/dnsjson"
 	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/proxyproto"
+	"blitiri.com.ar/go/dnss/internal/util"
 	"blitiri.com.ar/go/log"
 
 	"github.com/miekg/dns"
@@ -31,6 +40,79 @@ type httpsResolver struct {
 	CAFile   string
 	client   *http.Client
 	mode     string
+
+	// DSCP value to mark the upstream connections with (0 means no
+	// marking).
+	DSCP int
+
+	// Address ("host:port") to connect to, instead of resolving the
+	// upstream's hostname. Optional.
+	UpstreamAddr string
+
+	// SHA256 digests of certificates' TBS, one of which must be present in
+	// the upstream's validation chain. Optional, used for DNS stamps.
+	CertHashes [][]byte
+
+	// HTTP transport to use. Optional, we create our own by default; mostly
+	// useful for testing.
+	Transport http.RoundTripper
+
+	// Maximum number of outstanding requests to the upstream (0 means no
+	// limit). Queries beyond it fail right away, so a stalled upstream
+	// doesn't make us accumulate them.
+	MaxConcurrent int
+
+	// Semaphore to enforce MaxConcurrent.
+	sem chan struct{}
+
+	// Maximum size of the (decompressed) upstream responses, in bytes;
+	// larger ones are rejected, without reading them fully (see size.go).
+	// 0 means the default (64 KiB).
+	MaxResponseSize int64
+
+	// Disable HTTP/2, for networks where it doesn't work.
+	http1Only bool
+
+	// Where to write the TLS session keys, in NSS key log format, so the
+	// traffic can be decrypted for debugging. Optional, and dangerous.
+	KeyLog io.Writer
+
+	// Send the ID of each query (see util.RequestID) to the upstream in the
+	// X-Request-ID header, so its logs can be correlated with ours. Only
+	// useful if the upstream is ours too.
+	SendRequestID bool
+
+	// Value of the Authorization header to send, for upstreams which need
+	// authentication (see auth.go). Optional.
+	Authorization string
+
+	// Device names of the clients, to tag their queries with (see
+	// devices.go), and the header to send them in; if the header is empty,
+	// they go in the URL path, like NextDNS expects. Optional.
+	Devices      *Devices
+	DeviceHeader string
+
+	// Version of the PROXY protocol headers (1 or 2) to send at the start of
+	// the upstream connections, for upstreams behind load balancers that
+	// require them (0 means no headers). As the connections are shared by
+	// all queries, the headers have our own addresses, not the clients'.
+	ProxyProtocol int
+
+	// Try the upstream's IPv6 addresses before the IPv4 ones, for networks
+	// with poor (or no) IPv4 connectivity.
+	PreferIPv6 bool
+
+	// NAT64 prefix (like 64:ff9b::/96) to reach the upstream's IPv4
+	// addresses through, for IPv6-only networks. Optional.
+	NAT64Prefix *net.IPNet
+
+	// Resume the TLS sessions when making new connections to the upstream,
+	// to skip the full handshake (see resumption.go).
+	SessionResumption bool
+
+	// Function to resolve the upstream's name when we pick its addresses
+	// ourselves (see upstreamAddrs), so tests can fake it.
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
 }
 
 func loadCertPool(caFile string) (*x509.CertPool, error) {
@@ -67,10 +149,66 @@ func NewDoH(upstream *url.URL, caFile string) *httpsResolver {
 	}
 }
 
+// errBusy is returned when there are too many outstanding requests to the
+// upstream.
+var errBusy = errors.New("too many outstanding requests to the upstream")
+
+// Exported variables for statistics.
+var stats = struct {
+	// Queries rejected because of too many outstanding requests.
+	busy *expvar.Int
+
+	// Replies discarded because they don't match the query.
+	mismatched *expvar.Int
+
+	// Replies discarded because they are too large.
+	tooLarge *expvar.Int
+
+	// Queries sent to keep idle upstreams alive, by result ("ok" or
+	// "failed").
+	keepalives *expvar.Map
+
+	// Queries sent again to the pool's upstreams after an error, and
+	// queries which failed because they ran out of retry budget.
+	retries, retriesExhausted *expvar.Int
+
+	// Health checks of the pool's upstreams, by result ("ok" or "failed").
+	healthChecks *expvar.Map
+}{}
+
+func init() {
+	stats.busy = expvar.NewInt("upstream-busy-rejections")
+	stats.mismatched = expvar.NewInt("upstream-mismatched-replies")
+	stats.tooLarge = expvar.NewInt("upstream-oversized-replies")
+	stats.keepalives = expvar.NewMap("upstream-keepalives")
+	stats.retries = expvar.NewInt("upstream-retries")
+	stats.retriesExhausted = expvar.NewInt("upstream-retry-budget-exhausted")
+	stats.healthChecks = expvar.NewMap("upstream-health-checks")
+}
+
 func (r *httpsResolver) Init() error {
+	if r.MaxConcurrent > 0 {
+		r.sem = make(chan struct{}, r.MaxConcurrent)
+	}
+
 	transport := &http.Transport{
 		// Take the semi-standard proxy settings from the environment.
 		Proxy: http.ProxyFromEnvironment,
+
+		// Our own dialer and TLS configuration disable the automatic HTTP/2
+		// support, so we ask for it explicitly.
+		ForceAttemptHTTP2: !r.http1Only,
+	}
+
+	// Only use our own dialer if we need to.
+	if r.DSCP != 0 || r.UpstreamAddr != "" || r.ProxyProtocol != 0 ||
+		r.PreferIPv6 || r.NAT64Prefix != nil {
+		transport.DialContext = r.dialContext
+	}
+
+	// A non-nil empty map disables HTTP/2.
+	if r.http1Only {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
 	}
 
 	r.client = &http.Client{
@@ -81,28 +219,139 @@ func (r *httpsResolver) Init() error {
 		Transport: transport,
 	}
 
-	// If CAFile is empty, we're ok with the defaults (use the system default
-	// CA database).
-	if r.CAFile == "" {
+	if r.Transport != nil {
+		r.client.Transport = r.Transport
 		return nil
 	}
 
-	pool, err := loadCertPool(r.CAFile)
-	if err != nil {
-		return err
+	// If CAFile is empty and we have no hashes to check, we're ok with the
+	// defaults (use the system default CA database).
+	if r.CAFile == "" && len(r.CertHashes) == 0 && r.KeyLog == nil &&
+		!r.SessionResumption {
+		return nil
 	}
 
-	transport.TLSClientConfig = &tls.Config{
-		ClientCAs: pool,
+	tlsConfig := &tls.Config{
+		KeyLogWriter:       r.KeyLog,
+		ClientSessionCache: newSessionCache(r.SessionResumption),
 	}
 
+	if r.CAFile != "" {
+		pool, err := loadCertPool(r.CAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	if len(r.CertHashes) > 0 {
+		tlsConfig.VerifyPeerCertificate = r.verifyCertHashes
+	}
+
+	transport.TLSClientConfig = tlsConfig
 	return nil
 }
 
+// verifyCertHashes checks that at least one of the certificates in the
+// verified chains matches one of the expected hashes.
+func (r *httpsResolver) verifyCertHashes(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			h := sha256.Sum256(cert.RawTBSCertificate)
+			for _, expected := range r.CertHashes {
+				if bytes.Equal(h[:], expected) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("no certificate matches the expected hashes")
+}
+
+// dialContext dials like the default HTTP transport does, but connects to the
+// configured upstream address (if any), and marks the connections with the
+// configured DSCP value (and PROXY protocol version). With PreferIPv6 or a
+// NAT64 prefix, it also picks the upstream's addresses itself.
+func (r *httpsResolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// Connections to the upstream go to the fixed address, if we have one.
+	// Note we may be dialing a proxy, which we should leave alone.
+	toUpstream := addr == upstreamHostPort(r.Upstream)
+	if r.UpstreamAddr != "" && toUpstream {
+		addr = r.UpstreamAddr
+	}
+
+	var conn net.Conn
+	var err error
+	if toUpstream && (r.PreferIPv6 || r.NAT64Prefix != nil) {
+		conn, err = r.dialUpstream(ctx, dialer, network, addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.ProxyProtocol != 0 && toUpstream {
+		err = proxyproto.WriteHeader(conn, r.ProxyProtocol,
+			conn.LocalAddr(), conn.RemoteAddr())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error sending PROXY header: %v", err)
+		}
+	}
+
+	if r.DSCP != 0 {
+		if err := util.SetDSCP(conn, r.DSCP); err != nil {
+			log.Errorf("Error setting DSCP on connection to %s: %v", addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// upstreamHostPort returns the "host:port" the HTTP transport will dial to
+// reach the given URL.
+func upstreamHostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
 func (r *httpsResolver) Maintain() {
 }
 
+// CloseIdleConnections closes the idle connections to the upstream, so the
+// next queries use new ones (resolving the upstream's name again). Useful
+// when the network changes, to avoid getting stuck on connections that no
+// longer work.
+func (r *httpsResolver) CloseIdleConnections() {
+	t, ok := r.client.Transport.(interface{ CloseIdleConnections() })
+	if ok {
+		t.CloseIdleConnections()
+	}
+}
+
 func (r *httpsResolver) Query(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
+	if r.sem != nil {
+		select {
+		case r.sem <- struct{}{}:
+			defer func() { <-r.sem }()
+		default:
+			stats.busy.Add(1)
+			return nil, errBusy
+		}
+	}
+
 	if r.mode == "DoH" {
 		return r.queryDoH(req, tr)
 	}
@@ -121,10 +370,15 @@ func (r *httpsResolver) queryDoH(req *dns.Msg, tr trace.Trace) (*dns.Msg, error)
 
 	// TODO: Accept header.
 
-	hr, err := r.client.Post(
-		r.Upstream.String(),
-		"application/dns-message",
+	hreq, err := http.NewRequest("POST", r.Upstream.String(),
 		bytes.NewReader(packed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	hreq.Header.Set("Content-Type", "application/dns-message")
+	r.setRequestID(hreq, tr)
+
+	hr, err := r.do(hreq, req, tr)
 	if err != nil {
 		return nil, fmt.Errorf("POST failed: %v", err)
 	}
@@ -145,7 +399,11 @@ func (r *httpsResolver) queryDoH(req *dns.Msg, tr trace.Trace) (*dns.Msg, error)
 		return nil, fmt.Errorf("unknown response content type %q", ct)
 	}
 
-	respRaw, err := ioutil.ReadAll(io.LimitReader(hr.Body, 64*1024))
+	body, err := r.limitBody(hr, hr.Body)
+	if err != nil {
+		return nil, err
+	}
+	respRaw, err := ioutil.ReadAll(body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading from body: %v", err)
 	}
@@ -156,9 +414,72 @@ func (r *httpsResolver) queryDoH(req *dns.Msg, tr trace.Trace) (*dns.Msg, error)
 		return nil, fmt.Errorf("error unpacking response: %v", err)
 	}
 
+	if err := matchReply(req, respDNS); err != nil {
+		stats.mismatched.Add(1)
+		return nil, err
+	}
+
 	return respDNS, nil
 }
 
+// setRequestID sets the X-Request-ID header of the HTTP request to the ID of
+// the query, if we are configured to do so.
+func (r *httpsResolver) setRequestID(hreq *http.Request, tr trace.Trace) {
+	if !r.SendRequestID {
+		return
+	}
+	if id := util.RequestID(tr); id != "" {
+		hreq.Header.Set(util.RequestIDHeader, id)
+	}
+}
+
+// matchReply checks that the reply is for the given query: it must have the
+// same ID and question. Otherwise, it could be meant for another query, and
+// we could end up caching the wrong records.
+// Names are compared case-insensitively, as some servers change their case.
+func matchReply(req, reply *dns.Msg) error {
+	if !reply.Response {
+		return fmt.Errorf("reply mismatch: not a response")
+	}
+	if reply.Id != req.Id {
+		return fmt.Errorf("reply mismatch: id %d != %d", reply.Id, req.Id)
+	}
+	if len(reply.Question) != len(req.Question) {
+		return fmt.Errorf("reply mismatch: %d questions, expected %d",
+			len(reply.Question), len(req.Question))
+	}
+	for i, q := range req.Question {
+		if err := matchQuestion(q, reply.Question[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchQuestion checks that the question in the reply is the one we asked
+// for.
+func matchQuestion(q, got dns.Question) error {
+	if !strings.EqualFold(q.Name, got.Name) || q.Qtype != got.Qtype ||
+		q.Qclass != got.Qclass {
+		return fmt.Errorf("reply mismatch: asked %v, got %v", q, got)
+	}
+	return nil
+}
+
+// decodedBody returns a reader for the body of the response, decompressing
+// it according to its Content-Encoding.
+func decodedBody(hr *http.Response) (io.Reader, error) {
+	switch strings.ToLower(hr.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return hr.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(hr.Body)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q",
+			hr.Header.Get("Content-Encoding"))
+	}
+}
+
 func (r *httpsResolver) queryJSON(req *dns.Msg, tr trace.Trace) (*dns.Msg, error) {
 	// Only answer single-question queries.
 	// In practice, these are all we get, and almost no server supports
@@ -173,6 +494,9 @@ func (r *httpsResolver) queryJSON(req *dns.Msg, tr trace.Trace) (*dns.Msg, error
 		return nil, fmt.Errorf("query class != IN")
 	}
 
+	losses := queryLosses(req)
+	defer func() { recordLosses(losses, tr) }()
+
 	// Build the query and send the request.
 	url := *r.Upstream
 	vs := url.Query()
@@ -185,7 +509,21 @@ func (r *httpsResolver) queryJSON(req *dns.Msg, tr trace.Trace) (*dns.Msg, error
 		tr.LazyPrintf("JSON GET %v", url)
 	}
 
-	hr, err := r.client.Get(url.String())
+	hreq, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	// Some servers (like Cloudflare's) use the same URL for DoH and JSON,
+	// and need this to know we want JSON.
+	hreq.Header.Set("Accept", "application/dns-json")
+
+	// Ask for compressed responses explicitly, as the transport would only
+	// do it for us if it's the default one.
+	hreq.Header.Set("Accept-Encoding", "gzip")
+	r.setRequestID(hreq, tr)
+
+	hr, err := r.do(hreq, req, tr)
 	if err != nil {
 		return nil, fmt.Errorf("GET failed: %v", err)
 	}
@@ -197,13 +535,18 @@ func (r *httpsResolver) queryJSON(req *dns.Msg, tr trace.Trace) (*dns.Msg, error
 	}
 
 	// Read the HTTPS response, and parse the JSON.
-	body, err := ioutil.ReadAll(io.LimitReader(hr.Body, 64*1024))
+	bodyR, err := decodedBody(hr)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read body: %v", err)
 	}
+	bodyR, err = r.limitBody(hr, bodyR)
+	if err != nil {
+		return nil, err
+	}
 
+	// Decode as we read, so we can stop early on invalid responses.
 	jr := &dnsjson.Response{}
-	err = json.Unmarshal(body, jr)
+	err = json.NewDecoder(bodyR).Decode(jr)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to unmarshall: %v", err)
 	}
@@ -212,7 +555,36 @@ func (r *httpsResolver) queryJSON(req *dns.Msg, tr trace.Trace) (*dns.Msg, error
 		return nil, fmt.Errorf("Wrong number of questions in the response")
 	}
 
+	// The JSON reply has no ID or class, but we can still check the name
+	// (which may lack the trailing dot) and type.
+	got := dns.Question{
+		Name:   dns.Fqdn(jr.Question[0].Name),
+		Qtype:  jr.Question[0].Type,
+		Qclass: dns.ClassINET,
+	}
+	if err := matchQuestion(question, got); err != nil {
+		stats.mismatched.Add(1)
+		return nil, err
+	}
+	losses = append(losses, responseLosses(jr)...)
+
+	// Servers that support it (like dnss) can tell us more about how they
+	// got the response, which helps when debugging.
+	if md := jr.Metadata; md != nil {
+		tr.LazyPrintf("upstream metadata: upstream:%q time:%.1fms"+
+			" validated:%v truncated:%v retried-tcp:%v",
+			md.Upstream, md.ResponseTimeMs, md.Validated, md.Truncated,
+			md.RetriedTCP)
+		log.Debugf("%s %s: upstream:%q time:%.1fms validated:%v"+
+			" truncated:%v retried-tcp:%v", question.Name,
+			dns.Type(question.Qtype), md.Upstream, md.ResponseTimeMs,
+			md.Validated, md.Truncated, md.RetriedTCP)
+	}
+
 	// Build the DNS response.
+	// We use the question from the request and not the one from the JSON
+	// reply, because servers may change the case of the name (or drop the
+	// trailing dot), and clients expect to get back exactly what they sent.
 	resp := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Id:       req.Id,
@@ -226,22 +598,26 @@ func (r *httpsResolver) queryJSON(req *dns.Msg, tr trace.Trace) (*dns.Msg, error
 			AuthenticatedData:  jr.AD,
 			CheckingDisabled:   jr.CD,
 		},
-		Question: []dns.Question{
-			{
-				Name:   jr.Question[0].Name,
-				Qtype:  jr.Question[0].Type,
-				Qclass: dns.ClassINET,
-			}},
+		Question: []dns.Question{question},
 	}
 
 	for _, answer := range jr.Answer {
+		// Preserve the case of the question in the answers for it, like
+		// resolvers do (which usually point back to the question when
+		// compressing names).
+		name := answer.Name
+		if strings.EqualFold(dns.Fqdn(name), question.Name) {
+			name = question.Name
+		}
+
 		// TODO: This "works" but is quite hacky. Is there a better way,
 		// without doing lots of data parsing?
 		s := fmt.Sprintf("%s %d IN %s %s",
-			answer.Name, answer.TTL,
+			name, answer.TTL,
 			dns.TypeToString[answer.Type], answer.Data)
 		rr, err := dns.NewRR(s)
 		if err != nil {
+			losses = append(losses, "unparseable-answer")
 			return nil, fmt.Errorf("Error parsing answer: %v", err)
 		}
 
@@ -0,0 +1,162 @@
+package httpresolver
+
+// Tests for the checks on the upstream replies.
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+// fixedTransport is an http.RoundTripper which always returns the same
+// response.
+type fixedTransport struct {
+	contentType string
+	body        func(req *http.Request) []byte
+}
+
+func (f *fixedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {f.contentType}},
+		Body:       ioutil.NopCloser(bytes.NewReader(f.body(req))),
+		Request:    req,
+	}, nil
+}
+
+func TestMatchReply(t *testing.T) {
+	req := &dns.Msg{}
+	req.SetQuestion("test.blah.", dns.TypeA)
+
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	if err := matchReply(req, reply); err != nil {
+		t.Errorf("matching reply rejected: %v", err)
+	}
+
+	// The case of the name may change.
+	reply.Question[0].Name = "TEST.blah."
+	if err := matchReply(req, reply); err != nil {
+		t.Errorf("matching reply rejected: %v", err)
+	}
+
+	mismatches := []func(m *dns.Msg){
+		func(m *dns.Msg) { m.Id++ },
+		func(m *dns.Msg) { m.Response = false },
+		func(m *dns.Msg) { m.Question = nil },
+		func(m *dns.Msg) { m.Question[0].Name = "other.blah." },
+		func(m *dns.Msg) { m.Question[0].Qtype = dns.TypeAAAA },
+		func(m *dns.Msg) { m.Question[0].Qclass = dns.ClassCHAOS },
+	}
+	for i, f := range mismatches {
+		reply := &dns.Msg{}
+		reply.SetReply(req)
+		f(reply)
+		if err := matchReply(req, reply); err == nil {
+			t.Errorf("%d: mismatching reply accepted: %v", i, reply)
+		}
+	}
+}
+
+func TestMismatchedReplies(t *testing.T) {
+	u, _ := url.Parse("https://dns.example/dns-query")
+	tr := testutil.NewTestTrace(t)
+	query := func(r *httpsResolver) error {
+		if err := r.Init(); err != nil {
+			t.Fatalf("Init error: %v", err)
+		}
+		req := &dns.Msg{}
+		req.SetQuestion("test.blah.", dns.TypeA)
+		_, err := r.Query(req, tr)
+		return err
+	}
+
+	// JSON, for another name.
+	r := NewJSON(u, "")
+	r.Transport = &fixedTransport{
+		contentType: "application/dns-json",
+		body: func(*http.Request) []byte {
+			return []byte(`{"Status": 0, "Question": [{"name": "other.blah.", "type": 1}]}`)
+		},
+	}
+	prev := stats.mismatched.Value()
+	if err := query(r); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("expected mismatch error, got %v", err)
+	}
+	if stats.mismatched.Value() != prev+1 {
+		t.Errorf("mismatched replies not counted")
+	}
+
+	// DoH, with another ID.
+	r = NewDoH(u, "")
+	r.Transport = &fixedTransport{
+		contentType: "application/dns-message",
+		body: func(hreq *http.Request) []byte {
+			raw, _ := ioutil.ReadAll(hreq.Body)
+			req := &dns.Msg{}
+			req.Unpack(raw)
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+			reply.Id++
+			packed, _ := reply.Pack()
+			return packed
+		},
+	}
+	if err := query(r); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("expected mismatch error, got %v", err)
+	}
+	if stats.mismatched.Value() != prev+2 {
+		t.Errorf("mismatched replies not counted")
+	}
+}
+
+func TestSendRequestID(t *testing.T) {
+	u, _ := url.Parse("https://dns.example/dns-query")
+	var got string
+	r := NewDoH(u, "")
+	r.Transport = &fixedTransport{
+		contentType: "application/dns-message",
+		body: func(hreq *http.Request) []byte {
+			got = hreq.Header.Get(util.RequestIDHeader)
+			raw, _ := ioutil.ReadAll(hreq.Body)
+			req := &dns.Msg{}
+			req.Unpack(raw)
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+			packed, _ := reply.Pack()
+			return packed
+		},
+	}
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	tr := util.WithRequestID(testutil.NewTestTrace(t), "id-1234")
+	req := &dns.Msg{}
+	req.SetQuestion("test.blah.", dns.TypeA)
+
+	// Not sent by default.
+	if _, err := r.Query(req, tr); err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+	if got != "" {
+		t.Errorf("request ID sent without SendRequestID: %q", got)
+	}
+
+	r.SendRequestID = true
+	if _, err := r.Query(req, tr); err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+	if got != "id-1234" {
+		t.Errorf("expected request ID %q, got %q", "id-1234", got)
+	}
+}
@@ -0,0 +1,58 @@
+package httpresolver
+
+import (
+	"crypto/tls"
+	"expvar"
+	"net/http/httptrace"
+)
+
+// TLS session resumption (RFC 8446 section 2.2, and session tickets in
+// TLS 1.2), so new connections to the upstream (for example, after being
+// idle) skip the full handshake.
+//
+// Note 0-RTT (early data) is not used: Go's TLS library doesn't support it
+// on the client side, and it would need care anyway, as early data can be
+// replayed.
+
+// Number of TLS sessions to remember for each upstream, declared as a
+// variable so we can tweak it for testing. We usually only need one, but
+// keeping a few helps when we have several connections at once.
+var tlsSessionCacheSize = 16
+
+// Exported variables for statistics.
+var tlsStats = struct {
+	// TLS handshakes with the upstreams, by kind: "full", "resumed", or
+	// "failed". The resumption rate is resumed / (full + resumed).
+	handshakes *expvar.Map
+}{}
+
+func init() {
+	tlsStats.handshakes = expvar.NewMap("upstream-tls-handshakes")
+}
+
+// newSessionCache returns the TLS session cache to use for an upstream, or
+// nil if resumption is disabled.
+func newSessionCache(resumption bool) tls.ClientSessionCache {
+	if !resumption {
+		return nil
+	}
+	return tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+}
+
+// recordHandshake records the result of a TLS handshake in the statistics.
+func recordHandshake(cs tls.ConnectionState, err error) {
+	switch {
+	case err != nil:
+		tlsStats.handshakes.Add("failed", 1)
+	case cs.DidResume:
+		tlsStats.handshakes.Add("resumed", 1)
+	default:
+		tlsStats.handshakes.Add("full", 1)
+	}
+}
+
+// handshakeTrace is the HTTP client trace we use for all the requests, to
+// record the TLS handshakes.
+var handshakeTrace = &httptrace.ClientTrace{
+	TLSHandshakeDone: recordHandshake,
+}
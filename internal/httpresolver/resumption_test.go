@@ -0,0 +1,123 @@
+package httpresolver
+
+// Tests for the TLS session resumption, and the HTTP/2 negotiation.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"testing"
+)
+
+func handshakes(kind string) int64 {
+	v, ok := tlsStats.handshakes.Get(kind).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestSessionResumption(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	get := func(cache tls.ClientSessionCache) {
+		t.Helper()
+		// New connections every time, like after being idle.
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:            pool,
+				ClientSessionCache: cache,
+			},
+			DisableKeepAlives: true,
+		}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req = req.WithContext(
+			httptrace.WithClientTrace(req.Context(), handshakeTrace))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("GET error: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	full, resumed := handshakes("full"), handshakes("resumed")
+	cache := newSessionCache(true)
+	get(cache)
+	get(cache)
+	get(cache)
+	if n := handshakes("full") - full; n != 1 {
+		t.Errorf("%d full handshakes, expected 1", n)
+	}
+	if n := handshakes("resumed") - resumed; n != 2 {
+		t.Errorf("%d resumed handshakes, expected 2", n)
+	}
+
+	// Without a cache, all of them are full.
+	if newSessionCache(false) != nil {
+		t.Fatalf("got a session cache with resumption disabled")
+	}
+	full, resumed = handshakes("full"), handshakes("resumed")
+	get(nil)
+	get(nil)
+	if handshakes("full")-full != 2 || handshakes("resumed") != resumed {
+		t.Errorf("unexpected handshakes without resumption")
+	}
+}
+
+func TestHTTP2WithOwnDialer(t *testing.T) {
+	var proto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			proto = r.Proto
+			w.Write([]byte("ok"))
+		}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	get := func(http1Only bool) string {
+		t.Helper()
+		u, _ := url.Parse(srv.URL)
+		r := NewDoH(u, "")
+		r.http1Only = http1Only
+
+		// Connecting to a fixed address makes us use our own dialer.
+		r.UpstreamAddr = srv.Listener.Addr().String()
+		if err := r.Init(); err != nil {
+			t.Fatalf("Init error: %v", err)
+		}
+		r.client.Transport.(*http.Transport).TLSClientConfig =
+			&tls.Config{RootCAs: pool}
+
+		resp, err := r.client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET error: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return proto
+	}
+
+	if p := get(false); p != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2, got %q", p)
+	}
+	if p := get(true); p != "HTTP/1.1" {
+		t.Errorf("expected HTTP/1.1 with http1Only, got %q", p)
+	}
+}
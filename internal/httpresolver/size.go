@@ -0,0 +1,68 @@
+package httpresolver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Limits on the size of the upstream responses.
+//
+// We never buffer more than the limit of a response: we reject it right away
+// if its Content-Length is too large, and otherwise stop reading (and
+// decoding) as soon as it goes over. The limit applies to the decompressed
+// body, so it also protects us from compression bombs.
+
+// defaultMaxResponseSize is the limit on the size of the upstream responses,
+// unless configured otherwise. DNS messages can't be larger than 64 KiB, and
+// their JSON representation is rarely larger than that either.
+const defaultMaxResponseSize = 64 * 1024
+
+// errTooLarge is returned when an upstream response is over the limit.
+var errTooLarge = errors.New("upstream response too large")
+
+// maxResponseSize returns the limit on the size of the upstream responses.
+func (r *httpsResolver) maxResponseSize() int64 {
+	if r.MaxResponseSize > 0 {
+		return r.MaxResponseSize
+	}
+	return defaultMaxResponseSize
+}
+
+// limitBody returns a reader for the (decoded) body of the response, which
+// fails with errTooLarge once it goes over the limit.
+func (r *httpsResolver) limitBody(hr *http.Response, body io.Reader) (io.Reader, error) {
+	max := r.maxResponseSize()
+	if hr.ContentLength > max {
+		stats.tooLarge.Add(1)
+		return nil, errTooLarge
+	}
+	return &limitedReader{r: body, left: max}, nil
+}
+
+// limitedReader is like io.LimitedReader, but fails when the underlying
+// reader has more data than allowed, instead of just stopping there, so the
+// responses are not silently truncated.
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// Check if there is more, without taking more than one byte.
+		n, err := l.r.Read(make([]byte, 1))
+		if n > 0 {
+			stats.tooLarge.Add(1)
+			return 0, errTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,150 @@
+package httpresolver
+
+// Tests for the limits on the size of the upstream responses.
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+// endlessReader returns the same byte forever, and counts how many it
+// returned.
+type endlessReader struct {
+	b byte
+	n int
+}
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = e.b
+	}
+	e.n += len(p)
+	return len(p), nil
+}
+
+func TestLimitedReader(t *testing.T) {
+	// Exactly at the limit is fine.
+	l := &limitedReader{r: strings.NewReader("12345"), left: 5}
+	if b, err := ioutil.ReadAll(l); err != nil || string(b) != "12345" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	l = &limitedReader{r: strings.NewReader("123456"), left: 5}
+	if _, err := ioutil.ReadAll(l); err != errTooLarge {
+		t.Errorf("expected errTooLarge, got %v", err)
+	}
+
+	// We don't read much beyond the limit.
+	e := &endlessReader{b: ' '}
+	l = &limitedReader{r: e, left: 1000}
+	if _, err := ioutil.ReadAll(l); err != errTooLarge {
+		t.Errorf("expected errTooLarge, got %v", err)
+	}
+	if e.n > 1001 {
+		t.Errorf("read %d bytes, expected at most 1001", e.n)
+	}
+}
+
+// endlessTransport is an http.RoundTripper whose responses never end.
+type endlessTransport struct {
+	contentType   string
+	contentLength int64
+	body          *endlessReader
+}
+
+func (e *endlessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {e.contentType}},
+		ContentLength: e.contentLength,
+		Body:          ioutil.NopCloser(e.body),
+		Request:       req,
+	}, nil
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	u, _ := url.Parse("https://dns.example/dns-query")
+	tr := testutil.NewTestTrace(t)
+	query := func(r *httpsResolver) error {
+		t.Helper()
+		if err := r.Init(); err != nil {
+			t.Fatalf("Init error: %v", err)
+		}
+		req := &dns.Msg{}
+		req.SetQuestion("test.blah.", dns.TypeA)
+		_, err := r.Query(req, tr)
+		return err
+	}
+
+	prev := stats.tooLarge.Value()
+
+	// JSON: never-ending whitespace, which is valid until the end.
+	body := &endlessReader{b: ' '}
+	r := NewJSON(u, "")
+	r.MaxResponseSize = 4096
+	r.Transport = &endlessTransport{
+		contentType:   "application/dns-json",
+		contentLength: -1,
+		body:          body,
+	}
+	if err := query(r); err == nil || !strings.Contains(err.Error(), errTooLarge.Error()) {
+		t.Errorf("expected too large error, got %v", err)
+	}
+	if body.n > 2*4096 {
+		t.Errorf("read %d bytes of the body", body.n)
+	}
+
+	// DoH, with a large Content-Length: rejected without reading.
+	body = &endlessReader{}
+	r = NewDoH(u, "")
+	r.Transport = &endlessTransport{
+		contentType:   "application/dns-message",
+		contentLength: 1024 * 1024,
+		body:          body,
+	}
+	if err := query(r); err != errTooLarge {
+		t.Errorf("expected errTooLarge, got %v", err)
+	}
+	if body.n != 0 {
+		t.Errorf("read %d bytes of the body", body.n)
+	}
+
+	// DoH, without a Content-Length.
+	r.Transport.(*endlessTransport).contentLength = -1
+	if err := query(r); err == nil || !strings.Contains(err.Error(), errTooLarge.Error()) {
+		t.Errorf("expected too large error, got %v", err)
+	}
+	if body.n > defaultMaxResponseSize+1 {
+		t.Errorf("read %d bytes of the body", body.n)
+	}
+
+	if stats.tooLarge.Value() != prev+3 {
+		t.Errorf("oversized replies not counted: %d",
+			stats.tooLarge.Value()-prev)
+	}
+
+	// Responses within the limit work as usual.
+	r.Transport = &fixedTransport{
+		contentType: "application/dns-message",
+		body: func(hreq *http.Request) []byte {
+			raw, _ := ioutil.ReadAll(hreq.Body)
+			req := &dns.Msg{}
+			req.Unpack(raw)
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+			packed, _ := reply.Pack()
+			return packed
+		},
+	}
+	if err := query(r); err != nil {
+		t.Errorf("query error: %v", err)
+	}
+}
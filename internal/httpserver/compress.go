@@ -0,0 +1,75 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this are not worth compressing.
+const minCompressSize = 512
+
+// acceptsGzip returns true if the given Accept-Encoding header value allows
+// gzip-encoded responses.
+//
+// Note we don't support Brotli ("br"), as there is no implementation in the
+// standard library; clients which accept both will get gzip.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(p[2:], 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+
+		switch name {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+
+	// An explicit mention of gzip takes precedence over the wildcard.
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// writeBody writes the given body as the response, compressing it if the
+// client supports it and it's worth doing so.
+func writeBody(w http.ResponseWriter, req *http.Request, body []byte) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(body) < minCompressSize ||
+		!acceptsGzip(req.Header.Get("Accept-Encoding")) {
+		w.Write(body)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(body)
+	if err := gz.Close(); err != nil {
+		// Should not happen when writing to a buffer, but just in case,
+		// write it uncompressed.
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
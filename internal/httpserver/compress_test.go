@@ -0,0 +1,88 @@
+// Tests for the response compression.
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		header string
+		expect bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZip", true},
+		{"deflate, gzip, br", true},
+		{"br", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.5", true},
+		{"*", true},
+		{"*;q=0", false},
+		{"*, gzip;q=0", false},
+		{"gzip;q=invalid", false},
+		{"identity", false},
+	}
+	for _, c := range cases {
+		if got := acceptsGzip(c.header); got != c.expect {
+			t.Errorf("%q: got %v, expected %v", c.header, got, c.expect)
+		}
+	}
+}
+
+func TestWriteBody(t *testing.T) {
+	large := []byte(strings.Repeat("compress me ", 100))
+	small := []byte("tiny")
+
+	cases := []struct {
+		body       []byte
+		accept     string
+		compressed bool
+	}{
+		{large, "gzip, br", true},
+		{large, "", false},
+		{large, "br", false},
+		{small, "gzip", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/resolve?name=test", nil)
+		req.Header.Set("Accept-Encoding", c.accept)
+		w := httptest.NewRecorder()
+		writeBody(w, req, c.body)
+
+		enc := w.Header().Get("Content-Encoding")
+		if c.compressed != (enc == "gzip") {
+			t.Errorf("%d bytes, %q: unexpected encoding %q",
+				len(c.body), c.accept, enc)
+			continue
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%d bytes, %q: missing Vary header",
+				len(c.body), c.accept)
+		}
+
+		got, n := w.Body.Bytes(), w.Body.Len()
+		if c.compressed {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("error decompressing: %v", err)
+			}
+			got, err = ioutil.ReadAll(gz)
+			if err != nil {
+				t.Fatalf("error decompressing: %v", err)
+			}
+			if n >= len(c.body) {
+				t.Errorf("compressed body is not smaller: %d >= %d",
+					n, len(c.body))
+			}
+		}
+		if !bytes.Equal(got, c.body) {
+			t.Errorf("%d bytes, %q: body mismatch", len(c.body), c.accept)
+		}
+	}
+}
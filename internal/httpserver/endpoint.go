@@ -0,0 +1,132 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// Endpoint is an additional path the Server answers queries on, with its own
+// upstream and access control. This allows a single server to front several
+// DNS backends (for example, /resolve/internal and /resolve/public).
+type Endpoint struct {
+	Path string
+
+	// DNS servers to use, like Server.Upstream.
+	Upstream string
+
+	// Networks allowed to use the endpoint; if empty, anyone can.
+	Allowed []*net.IPNet
+
+	// Log every query (not just trace them), with the client and the result.
+	// The queries can be sampled, see LogSampling.
+	LogQueries bool
+
+	// Resolver to use instead of Upstream, if set (only for the default
+	// endpoints, see Server.Resolver).
+	resolver dnsserver.Resolver
+}
+
+// Paths the Server always handles, which can't be used for endpoints.
+var reservedPaths = map[string]bool{
+	"/dns-query": true,
+	"/resolve":   true,
+}
+
+// ParseEndpoints parses a space-separated list of endpoints, each in the
+// form "path=upstream1[;upstream2...][,allow=net1;net2...][,log]".
+func ParseEndpoints(s string) ([]Endpoint, error) {
+	eps := []Endpoint{}
+	seen := map[string]bool{}
+	for _, f := range strings.Fields(s) {
+		ep, err := parseEndpoint(f)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", f, err)
+		}
+		if reservedPaths[ep.Path] || seen[ep.Path] {
+			return nil, fmt.Errorf("%q: path %q is already in use",
+				f, ep.Path)
+		}
+		seen[ep.Path] = true
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+func parseEndpoint(s string) (Endpoint, error) {
+	ep := Endpoint{}
+	parts := strings.Split(s, ",")
+
+	kv := strings.SplitN(parts[0], "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return ep, fmt.Errorf("missing upstream")
+	}
+	ep.Path = kv[0]
+	if !strings.HasPrefix(ep.Path, "/") {
+		return ep, fmt.Errorf("path must start with /")
+	}
+	upstreams := strings.Split(kv[1], ";")
+	for _, u := range upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			return ep, fmt.Errorf("invalid upstream: %v", err)
+		}
+	}
+	ep.Upstream = strings.Join(upstreams, " ")
+
+	for _, opt := range parts[1:] {
+		switch {
+		case opt == "log":
+			ep.LogQueries = true
+		case strings.HasPrefix(opt, "allow="):
+			for _, n := range strings.Split(opt[len("allow="):], ";") {
+				_, ipnet, err := net.ParseCIDR(n)
+				if err != nil {
+					return ep, fmt.Errorf("invalid network %q", n)
+				}
+				ep.Allowed = append(ep.Allowed, ipnet)
+			}
+		default:
+			return ep, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	return ep, nil
+}
+
+// allows returns true if the client with the given address (as in
+// http.Request.RemoteAddr) can use the endpoint.
+func (ep *Endpoint) allows(remoteAddr string) bool {
+	if len(ep.Allowed) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range ep.Allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// query resolves the query with the endpoint's resolver or upstreams, and
+// returns how it was resolved. The resolver queries can't be cancelled, so
+// they ignore the context.
+func (ep *Endpoint) query(ctx context.Context, tr trace.Trace, r *dns.Msg) (*dns.Msg, queryInfo, error) {
+	if ep.resolver != nil {
+		reply, err := ep.resolver.Query(r, tr)
+		return reply, queryInfo{}, err
+	}
+	return queryUpstreams(ctx, tr, r, ep.Upstream)
+}
@@ -0,0 +1,89 @@
+// Tests for the additional endpoints.
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	eps, err := ParseEndpoints(
+		"/resolve/internal=10.0.0.1:53,allow=10.0.0.0/8;fd00::/8,log" +
+			"  /resolve/public=1.1.1.1:53;8.8.8.8:53")
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if len(eps) != 2 {
+		t.Fatalf("expected 2 endpoints, got %v", eps)
+	}
+	if eps[0].Path != "/resolve/internal" || eps[0].Upstream != "10.0.0.1:53" ||
+		len(eps[0].Allowed) != 2 || !eps[0].LogQueries {
+		t.Errorf("unexpected endpoint: %+v", eps[0])
+	}
+	if eps[1].Path != "/resolve/public" || eps[1].Upstream != "1.1.1.1:53 8.8.8.8:53" ||
+		len(eps[1].Allowed) != 0 || eps[1].LogQueries {
+		t.Errorf("unexpected endpoint: %+v", eps[1])
+	}
+
+	for _, s := range []string{
+		"/x",
+		"/x=",
+		"x=1.1.1.1:53",
+		"/x=1.1.1.1",
+		"/x=1.1.1.1:53,allow=10.0.0.1",
+		"/x=1.1.1.1:53;",
+		"/x=1.1.1.1:53,blah",
+		"/resolve=1.1.1.1:53",
+		"/x=1.1.1.1:53 /x=8.8.8.8:53",
+	} {
+		if _, err := ParseEndpoints(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	upstreams := []string{}
+	defer func(e func(context.Context, *dns.Msg, string) (*dns.Msg, error)) { exchange = e }(exchange)
+	exchange = func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+		upstreams = append(upstreams, addr)
+		reply := &dns.Msg{}
+		reply.SetReply(m)
+		return reply, nil
+	}
+
+	eps, _ := ParseEndpoints("/internal=10.0.0.1:53,allow=192.0.2.0/24,log")
+	s := &Server{Upstream: "1.1.1.1:53", Endpoints: eps}
+
+	resolve := func(ep *Endpoint, from string) int {
+		req := httptest.NewRequest("GET", "/?name=example.com&type=A", nil)
+		req.RemoteAddr = from
+		w := httptest.NewRecorder()
+		s.resolve(w, req, ep)
+		return w.Code
+	}
+
+	if code := resolve(&s.Endpoints[0], "192.0.2.5:1234"); code != http.StatusOK {
+		t.Errorf("allowed client got %d", code)
+	}
+	if code := resolve(&s.Endpoints[0], "198.51.100.5:1234"); code != http.StatusForbidden {
+		t.Errorf("forbidden client got %d", code)
+	}
+
+	req := httptest.NewRequest("GET", "/resolve?name=example.com", nil)
+	req.RemoteAddr = "198.51.100.5:1234"
+	w := httptest.NewRecorder()
+	s.Resolve(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("default endpoint got %d", w.Code)
+	}
+
+	if len(upstreams) != 2 || upstreams[0] != "10.0.0.1:53" ||
+		upstreams[1] != "1.1.1.1:53" {
+		t.Errorf("unexpected upstreams used: %v", upstreams)
+	}
+}
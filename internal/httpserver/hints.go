@@ -0,0 +1,72 @@
+package httpserver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// The HTTPS RR type (RFC 9460), defined here as older versions of the dns
+// library don't know about it; the records come back as unknown (RFC 3597)
+// ones, which is good enough to pass them along.
+const typeHTTPS uint16 = 65
+
+// Types we add as hints to the replies for A queries.
+var hintTypes = []uint16{dns.TypeAAAA, typeHTTPS}
+
+// addHints adds to the reply the records clients are likely to ask for
+// next, in the additional section, so they can avoid the round trips.
+// For now, that is the AAAA and HTTPS records when answering an A query.
+// They are queried via the endpoint that gave the reply.
+//
+// The hint queries are done in parallel, and errors are ignored, as the
+// reply is fine without them (so they are skipped when the workers are
+// busy).
+//
+// We don't use HTTP/2 server push for this (nor for OCSP): DoH clients
+// don't use pushed responses, and browsers have dropped support for it.
+func (s *Server) addHints(ctx context.Context, tr trace.Trace, ep *Endpoint, req, reply *dns.Msg) {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeA ||
+		req.Question[0].Qclass != dns.ClassINET ||
+		reply.Rcode != dns.RcodeSuccess || len(reply.Answer) == 0 {
+		return
+	}
+	name := req.Question[0].Name
+
+	var wg sync.WaitGroup
+	hints := make([][]dns.RR, len(hintTypes))
+	for i, qtype := range hintTypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			m := &dns.Msg{}
+			m.SetQuestion(name, qtype)
+			m.RecursionDesired = req.RecursionDesired
+			m.CheckingDisabled = req.CheckingDisabled
+
+			r, _, err := s.query(ctx, tr, ep, m)
+			if err != nil || r == nil || r.Rcode != dns.RcodeSuccess {
+				return
+			}
+
+			// Only take the records of the type we asked for; the rest
+			// (like CNAMEs) are already in the answer.
+			for _, rr := range r.Answer {
+				if rr.Header().Rrtype == qtype {
+					hints[i] = append(hints[i], rr)
+				}
+			}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	for i, rrs := range hints {
+		if len(rrs) > 0 {
+			tr.LazyPrintf("hint: %d %s records", len(rrs),
+				dns.Type(hintTypes[i]))
+		}
+		reply.Extra = append(reply.Extra, rrs...)
+	}
+}
@@ -0,0 +1,73 @@
+// Tests for the resolver hints.
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"github.com/miekg/dns"
+)
+
+// fakeExchange replies to the hint queries from the given records, by type.
+func fakeExchange(t *testing.T, records map[uint16][]string) func(context.Context, *dns.Msg, string) (*dns.Msg, error) {
+	return func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+		rrs, ok := records[m.Question[0].Qtype]
+		if !ok {
+			return nil, errors.New("fake exchange error")
+		}
+		reply := &dns.Msg{}
+		reply.SetReply(m)
+		for _, s := range rrs {
+			reply.Answer = append(reply.Answer, testutil.NewRR(t, s))
+		}
+		return reply, nil
+	}
+}
+
+func TestAddHints(t *testing.T) {
+	defer func(e func(context.Context, *dns.Msg, string) (*dns.Msg, error)) { exchange = e }(exchange)
+	exchange = fakeExchange(t, map[uint16][]string{
+		dns.TypeAAAA: {
+			"test.blah. 300 IN CNAME target.blah.",
+			"target.blah. 300 IN AAAA 2001:db8::1",
+		},
+		// HTTPS queries fail, which should not be a problem.
+	})
+
+	s := &Server{Upstream: "upstream:53", ResolverHints: true}
+	ep := &Endpoint{Upstream: s.Upstream}
+
+	req := &dns.Msg{}
+	req.SetQuestion("test.blah.", dns.TypeA)
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{testutil.NewRR(t, "test.blah. 300 IN A 1.2.3.4")}
+
+	s.addHints(context.Background(), testutil.NewTestTrace(t), ep, req, reply)
+	if len(reply.Extra) != 1 {
+		t.Fatalf("expected 1 hint, got %v", reply.Extra)
+	}
+	if aaaa, ok := reply.Extra[0].(*dns.AAAA); !ok || aaaa.AAAA.String() != "2001:db8::1" {
+		t.Errorf("unexpected hint: %v", reply.Extra[0])
+	}
+
+	// No hints for other types, or for failed replies.
+	req.SetQuestion("test.blah.", dns.TypeMX)
+	reply = &dns.Msg{}
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{testutil.NewRR(t, "test.blah. 300 IN MX 10 mail.blah.")}
+	s.addHints(context.Background(), testutil.NewTestTrace(t), ep, req, reply)
+	if len(reply.Extra) != 0 {
+		t.Errorf("unexpected hints for MX: %v", reply.Extra)
+	}
+
+	req.SetQuestion("test.blah.", dns.TypeA)
+	reply = &dns.Msg{}
+	reply.SetRcode(req, dns.RcodeNameError)
+	s.addHints(context.Background(), testutil.NewTestTrace(t), ep, req, reply)
+	if len(reply.Extra) != 0 {
+		t.Errorf("unexpected hints for NXDOMAIN: %v", reply.Extra)
+	}
+}
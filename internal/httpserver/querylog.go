@@ -0,0 +1,137 @@
+package httpserver
+
+import (
+	"expvar"
+	"math/rand"
+	"sync"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+)
+
+// LogSampling selects which queries go to the query log (see
+// Endpoint.LogQueries), so it stays useful without becoming the bottleneck
+// at high query rates: only a fraction of them are logged, up to a maximum
+// per second.
+//
+// Errors (failed queries and SERVFAIL replies) and blocked queries (clients
+// which are not allowed, and REFUSED replies) are always logged, as they are
+// the ones we usually need to look at.
+type LogSampling struct {
+	// Fraction of the queries to log, between 0 and 1.
+	Rate float64
+
+	// Maximum number of queries to log per second; 0 means no limit.
+	MaxPerSecond int
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Protects the fields below.
+	mu *sync.Mutex
+
+	// Current second (as a Unix time), and how many queries we logged in
+	// it.
+	second int64
+	count  int
+}
+
+// NewLogSampling returns a new LogSampling, which logs the given fraction
+// of the queries, up to maxPerSecond (0 for no limit).
+func NewLogSampling(rate float64, maxPerSecond int) *LogSampling {
+	return &LogSampling{
+		Rate:         rate,
+		MaxPerSecond: maxPerSecond,
+		clock:        util.RealClock,
+		mu:           &sync.Mutex{},
+	}
+}
+
+// Exported variables for statistics.
+var queryLogStats = struct {
+	// Queries considered for the query log, by result: "logged",
+	// "always" (logged because of the always-log rules), "sampled-out",
+	// and "rate-limited".
+	results *expvar.Map
+}{}
+
+func init() {
+	queryLogStats.results = expvar.NewMap("https-query-log")
+}
+
+// Function to get a random number in [0, 1), so tests can fake it.
+var randFloat64 = rand.Float64
+
+// sample returns true if a regular query (not one of the always logged)
+// should be logged. A nil LogSampling logs everything.
+func (ls *LogSampling) sample() bool {
+	if ls == nil {
+		return true
+	}
+
+	if ls.Rate < 1 && randFloat64() >= ls.Rate {
+		queryLogStats.results.Add("sampled-out", 1)
+		return false
+	}
+
+	if ls.MaxPerSecond > 0 {
+		now := ls.clock.Now().Unix()
+		ls.mu.Lock()
+		if now != ls.second {
+			ls.second = now
+			ls.count = 0
+		}
+		ls.count++
+		over := ls.count > ls.MaxPerSecond
+		ls.mu.Unlock()
+		if over {
+			queryLogStats.results.Add("rate-limited", 1)
+			return false
+		}
+	}
+	return true
+}
+
+// alwaysLog returns true if the query must be logged regardless of the
+// sampling: when it failed, or was blocked.
+func alwaysLog(reply *dns.Msg, err error) bool {
+	if err != nil || reply == nil {
+		return true
+	}
+	return reply.Rcode == dns.RcodeServerFailure ||
+		reply.Rcode == dns.RcodeRefused
+}
+
+// logQuery logs the query and its reply (or the error), if the endpoint is
+// configured to, and the sampling allows it. The query can be nil, for
+// requests which were rejected before parsing it.
+func (s *Server) logQuery(ep *Endpoint, remoteAddr string, r, reply *dns.Msg, err error) {
+	if !ep.LogQueries {
+		return
+	}
+
+	if alwaysLog(reply, err) {
+		queryLogStats.results.Add("always", 1)
+	} else if s.LogSampling.sample() {
+		queryLogStats.results.Add("logged", 1)
+	} else {
+		return
+	}
+
+	result := "no reply"
+	if err != nil {
+		result = "error: " + err.Error()
+	} else if reply != nil {
+		result = dns.RcodeToString[reply.Rcode]
+	}
+
+	if r == nil || len(r.Question) == 0 {
+		log.Infof("%s: %s -> %s", ep.Path, remoteAddr, result)
+		return
+	}
+	q := r.Question[0]
+	log.Infof("%s: %s %s %s -> %s", ep.Path, remoteAddr, q.Name,
+		dns.Type(q.Qtype), result)
+}
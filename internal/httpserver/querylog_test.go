@@ -0,0 +1,72 @@
+package httpserver
+
+// Tests for the query log sampling.
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestLogSampling(t *testing.T) {
+	// A nil sampling logs everything.
+	var nilLS *LogSampling
+	if !nilLS.sample() {
+		t.Errorf("nil sampling didn't log")
+	}
+
+	defer func(f func() float64) { randFloat64 = f }(randFloat64)
+	rnd := 0.0
+	randFloat64 = func() float64 { return rnd }
+
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	ls := NewLogSampling(0.1, 2)
+	ls.clock = clock
+
+	// Only 10% of the queries are logged.
+	rnd = 0.5
+	if ls.sample() {
+		t.Errorf("query logged outside of the sample")
+	}
+
+	// In the sample, but at most 2 per second.
+	rnd = 0.05
+	for i, expected := range []bool{true, true, false, false} {
+		if got := ls.sample(); got != expected {
+			t.Errorf("%d: got %v, expected %v", i, got, expected)
+		}
+	}
+	clock.Advance(time.Second)
+	if !ls.sample() {
+		t.Errorf("query not logged in the next second")
+	}
+}
+
+func TestAlwaysLog(t *testing.T) {
+	reply := func(rcode int) *dns.Msg {
+		m := &dns.Msg{}
+		m.Rcode = rcode
+		return m
+	}
+
+	cases := []struct {
+		reply    *dns.Msg
+		err      error
+		expected bool
+	}{
+		{reply(dns.RcodeSuccess), nil, false},
+		{reply(dns.RcodeNameError), nil, false},
+		{reply(dns.RcodeServerFailure), nil, true},
+		{reply(dns.RcodeRefused), nil, true},
+		{nil, errors.New("error"), true},
+	}
+	for i, c := range cases {
+		if got := alwaysLog(c.reply, c.err); got != c.expected {
+			t.Errorf("%d: got %v, expected %v", i, got, c.expected)
+		}
+	}
+}
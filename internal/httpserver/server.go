@@ -11,6 +11,7 @@
 package httpserver
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -22,9 +23,14 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"blitiri.com.ar/go/dnss/internal/dnsjson"
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/proxyproto"
+	"blitiri.com.ar/go/dnss/internal/upgrade"
 	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/dnss/internal/watchdog"
 	"blitiri.com.ar/go/log"
 	"github.com/miekg/dns"
 	"golang.org/x/net/trace"
@@ -34,9 +40,64 @@ import (
 // package-level documentation for more references.
 type Server struct {
 	Addr     string
-	Upstream string
 	CertFile string
 	KeyFile  string
+
+	// Additional certificates, selected by the name the clients ask for
+	// (SNI), to serve several names with different certificates. The one
+	// in CertFile is used for clients which ask for other names.
+	ExtraCerts []CertFiles
+
+	// DNS servers to send the queries to, as a space-separated list of
+	// host:port addresses, tried in order (see queryUpstreams).
+	Upstream string
+
+	// If set, the queries to the default endpoints are resolved with it
+	// instead of sent to Upstream (for example, to resolve them
+	// recursively).
+	Resolver dnsserver.Resolver
+
+	// Include likely follow-up records (like AAAA for A queries) in the
+	// additional section of the DoH replies.
+	ResolverHints bool
+
+	// TLS settings; the zero values mean the Go defaults. See tls.go for
+	// how to parse them.
+	TLSMinVersion uint16
+	CipherSuites  []uint16
+	Curves        []tls.CurveID
+
+	// How often to rotate the session ticket keys (0 to let Go handle it).
+	TicketKeyRotation time.Duration
+
+	// File with the OCSP response to staple (DER-encoded), reloaded
+	// periodically.
+	OCSPStapleFile string
+
+	// Expect PROXY protocol headers (see the proxyproto package) at the
+	// start of the connections, before the TLS handshake.
+	ProxyProtocol bool
+
+	// Include the metadata (see dnsjson.Metadata) in the JSON replies,
+	// like which upstream answered and how long it took.
+	JSONMetadata bool
+
+	// Additional endpoints, each with its own upstream. The default ones
+	// (/dns-query and /resolve) use Upstream.
+	Endpoints []Endpoint
+
+	// Sampling of the query log of the endpoints; if nil, all the queries
+	// are logged.
+	LogSampling *LogSampling
+
+	// Number of workers doing the upstream queries (0 means no limit, one
+	// per request), and of queries that can wait for one; beyond them,
+	// requests fail right away (see workers.go).
+	Workers   int
+	QueueSize int
+
+	// Pool of workers, created by ListenAndServe.
+	workers *workerPool
 }
 
 // InsecureForTesting = true will make Server.ListenAndServe will not use TLS.
@@ -45,33 +106,104 @@ var InsecureForTesting = false
 
 // ListenAndServe starts the HTTPS server.
 func (s *Server) ListenAndServe() {
+	if s.Resolver != nil {
+		if err := s.Resolver.Init(); err != nil {
+			log.Fatalf("Error initializing the resolver: %v", err)
+		}
+		go s.Resolver.Maintain()
+	}
+	s.workers = newWorkerPool(s.Workers, s.QueueSize)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/dns-query", s.Resolve)
 	mux.HandleFunc("/resolve", s.Resolve)
+	for _, ep := range s.Endpoints {
+		ep := ep
+		log.Infof("HTTPS endpoint %s -> %s", ep.Path, ep.Upstream)
+		mux.HandleFunc(ep.Path, func(w http.ResponseWriter, req *http.Request) {
+			s.resolve(w, req, &ep)
+		})
+	}
 	srv := http.Server{
 		Addr:    s.Addr,
 		Handler: mux,
 	}
 
 	log.Infof("HTTPS listening on %s", s.Addr)
-	var err error
 	if InsecureForTesting {
-		err = srv.ListenAndServe()
-	} else {
-		err = srv.ListenAndServeTLS(s.CertFile, s.KeyFile)
+		err := srv.ListenAndServe()
+		log.Fatalf("HTTPS exiting: %s", err)
+	}
+
+	conf, err := s.tlsConfig()
+	if err != nil {
+		log.Fatalf("Error loading TLS configuration: %v", err)
+	}
+
+	// We use our own listener instead of ListenAndServeTLS, as that would
+	// make a copy of the configuration, and we need to change the session
+	// ticket keys in the one in use.
+	ln, err := upgrade.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Fatalf("HTTPS exiting: %s%s", err,
+			util.PortConflictHint(s.Addr, err))
+	}
+	var l net.Listener = tcpKeepAliveListener{ln.(*net.TCPListener)}
+	if s.ProxyProtocol {
+		l = proxyproto.NewListener(l)
 	}
-	log.Fatalf("HTTPS exiting: %s", err)
+	err = srv.Serve(tls.NewListener(l, conf))
+	upgrade.Fatalf("HTTPS exiting: %s", err)
 }
 
 // Resolve implements the HTTP handler for incoming DNS resolution requests.
 // It handles "Google's DNS over HTTPS using JSON" requests, as well as "DoH"
 // request.
 func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
-	tr := trace.New("httpserver", "/resolve")
+	s.resolve(w, req, &Endpoint{
+		Path:     "/resolve",
+		Upstream: s.Upstream,
+		resolver: s.Resolver,
+	})
+}
+
+// resolve handles the requests for the given endpoint.
+func (s *Server) resolve(w http.ResponseWriter, req *http.Request, ep *Endpoint) {
+	defer upgrade.Track()()
+
+	tr := trace.New("httpserver", ep.Path)
 	defer tr.Finish()
-	tr.LazyPrintf("from:%v", req.RemoteAddr)
+
+	// Use the request ID given by the client (usually, a dnss in
+	// DNS-to-HTTPS mode), so the logs of both can be correlated; or make up
+	// our own. Either way, we give it back in the reply.
+	reqID := req.Header.Get(util.RequestIDHeader)
+	if !util.ValidRequestID(reqID) {
+		reqID = util.NewRequestID()
+	}
+	tr = util.WithRequestID(tr, reqID)
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		tr = util.WithClient(tr, net.ParseIP(host))
+	}
+	w.Header().Set(util.RequestIDHeader, reqID)
+
+	tr.LazyPrintf("from:%v   req:%s", req.RemoteAddr, reqID)
 	tr.LazyPrintf("method:%v", req.Method)
 
+	if watchdog.Shed() {
+		util.TraceErrorf(tr, "overloaded")
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !ep.allows(req.RemoteAddr) {
+		err := util.TraceErrorf(tr, "client not allowed")
+		util.RecentErrors.Add(tr, "refused", nil, "client not allowed")
+		s.logQuery(ep, req.RemoteAddr, nil, nil, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
 	req.ParseForm()
 
 	// Identify DoH requests:
@@ -83,11 +215,12 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 			req.FormValue("dns"))
 		if err != nil {
 			util.TraceError(tr, err)
+			util.RecentErrors.Add(tr, "parse", nil, "DoH GET: %v", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		s.resolveDoH(tr, w, dnsQuery)
+		s.resolveDoH(tr, w, req, ep, dnsQuery)
 		return
 	}
 
@@ -109,7 +242,7 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 
-			s.resolveDoH(tr, w, dnsQuery)
+			s.resolveDoH(tr, w, req, ep, dnsQuery)
 			return
 		}
 	}
@@ -118,23 +251,25 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 	// It MUST have a "name" query parameter, so we use that for detection.
 	if req.Method == "GET" && req.FormValue("name") != "" {
 		tr.LazyPrintf("Google-JSON")
-		s.resolveJSON(tr, w, req)
+		s.resolveJSON(tr, w, req, ep)
 		return
 	}
 
 	// Could not found how to handle this request.
 	util.TraceErrorf(tr, "unknown request type")
+	util.RecentErrors.Add(tr, "parse", nil, "unknown request type")
 	http.Error(w, "unknown request type", http.StatusUnsupportedMediaType)
 }
 
 // Resolve "Google's DNS over HTTPS using JSON" requests, and returns
 // responses as specified in
 // https://developers.google.com/speed/public-dns/docs/dns-over-https#api_specification.
-func (s *Server) resolveJSON(tr trace.Trace, w http.ResponseWriter, req *http.Request) {
+func (s *Server) resolveJSON(tr trace.Trace, w http.ResponseWriter, req *http.Request, ep *Endpoint) {
 	// Construct the DNS request from the http query.
 	q, err := parseQuery(req.URL)
 	if err != nil {
 		util.TraceError(tr, err)
+		util.RecentErrors.Add(tr, "parse", nil, "JSON: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -168,20 +303,29 @@ func (s *Server) resolveJSON(tr trace.Trace, w http.ResponseWriter, req *http.Re
 	util.TraceQuestion(tr, r.Question)
 
 	// Do the DNS request, get the reply.
-	fromUp, err := dns.Exchange(r, s.Upstream)
-	if err != nil {
-		err = util.TraceErrorf(tr, "dns exchange error: %v", err)
-		http.Error(w, err.Error(), http.StatusFailedDependency)
+	start := time.Now()
+	fromUp, info, err := s.query(req.Context(), tr, ep, r)
+	elapsed := time.Since(start)
+	if err == errOverloaded {
+		util.TraceError(tr, err)
+		s.logQuery(ep, req.RemoteAddr, r, nil, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
-	}
-
-	if fromUp == nil {
-		err = util.TraceErrorf(tr, "no response from upstream")
+	} else if err == errNoResponse {
+		util.TraceError(tr, err)
+		s.logQuery(ep, req.RemoteAddr, r, nil, err)
 		http.Error(w, err.Error(), http.StatusRequestTimeout)
 		return
+	} else if err != nil {
+		err = util.TraceErrorf(tr, "dns exchange error: %v", err)
+		util.RecentErrors.Add(tr, "upstream", r.Question, "%v", err)
+		s.logQuery(ep, req.RemoteAddr, r, nil, err)
+		http.Error(w, err.Error(), http.StatusFailedDependency)
+		return
 	}
 
 	util.TraceAnswer(tr, fromUp)
+	s.logQuery(ep, req.RemoteAddr, r, fromUp, nil)
 
 	// Convert the reply to json, and write it back.
 	jr := &dnsjson.Response{
@@ -193,6 +337,16 @@ func (s *Server) resolveJSON(tr trace.Trace, w http.ResponseWriter, req *http.Re
 		CD:     fromUp.CheckingDisabled,
 	}
 
+	if s.JSONMetadata {
+		jr.Metadata = &dnsjson.Metadata{
+			Upstream:       info.upstream,
+			ResponseTimeMs: elapsed.Seconds() * 1000,
+			Validated:      fromUp.AuthenticatedData,
+			Truncated:      fromUp.Truncated,
+			RetriedTCP:     info.retriedTCP,
+		}
+	}
+
 	for _, q := range fromUp.Question {
 		rr := dnsjson.RR{
 			Name: q.Name,
@@ -221,7 +375,10 @@ func (s *Server) resolveJSON(tr trace.Trace, w http.ResponseWriter, req *http.Re
 		return
 	}
 
-	w.Write(buf)
+	// Set the content type explicitly, otherwise it would be detected from
+	// the (maybe compressed) body.
+	w.Header().Set("Content-Type", "application/dns-json")
+	writeBody(w, req, buf)
 }
 
 type query struct {
@@ -327,11 +484,12 @@ func stringToBool(s string) (bool, error) {
 
 // Resolve DNS over HTTPS requests, as specified in
 // https://tools.ietf.org/html/draft-ietf-doh-dns-over-https-07.
-func (s *Server) resolveDoH(tr trace.Trace, w http.ResponseWriter, dnsQuery []byte) {
+func (s *Server) resolveDoH(tr trace.Trace, w http.ResponseWriter, req *http.Request, ep *Endpoint, dnsQuery []byte) {
 	r := &dns.Msg{}
 	err := r.Unpack(dnsQuery)
 	if err != nil {
 		util.TraceError(tr, err)
+		util.RecentErrors.Add(tr, "parse", nil, "DoH: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -339,20 +497,31 @@ func (s *Server) resolveDoH(tr trace.Trace, w http.ResponseWriter, dnsQuery []by
 	util.TraceQuestion(tr, r.Question)
 
 	// Do the DNS request, get the reply.
-	fromUp, err := dns.Exchange(r, s.Upstream)
-	if err != nil {
-		err = util.TraceErrorf(tr, "dns exchange error: %v", err)
-		http.Error(w, err.Error(), http.StatusFailedDependency)
+	fromUp, _, err := s.query(req.Context(), tr, ep, r)
+	if err == errOverloaded {
+		util.TraceError(tr, err)
+		s.logQuery(ep, req.RemoteAddr, r, nil, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
-	}
-
-	if fromUp == nil {
-		err = util.TraceErrorf(tr, "no response from upstream")
+	} else if err == errNoResponse {
+		util.TraceError(tr, err)
+		s.logQuery(ep, req.RemoteAddr, r, nil, err)
 		http.Error(w, err.Error(), http.StatusRequestTimeout)
 		return
+	} else if err != nil {
+		err = util.TraceErrorf(tr, "dns exchange error: %v", err)
+		util.RecentErrors.Add(tr, "upstream", r.Question, "%v", err)
+		s.logQuery(ep, req.RemoteAddr, r, nil, err)
+		http.Error(w, err.Error(), http.StatusFailedDependency)
+		return
 	}
 
 	util.TraceAnswer(tr, fromUp)
+	s.logQuery(ep, req.RemoteAddr, r, fromUp, nil)
+
+	if s.ResolverHints {
+		s.addHints(req.Context(), tr, ep, r, fromUp)
+	}
 
 	packed, err := fromUp.Pack()
 	if err != nil {
@@ -0,0 +1,87 @@
+// Tests for the request IDs and the JSON metadata.
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/dnsjson"
+	"blitiri.com.ar/go/dnss/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+func TestRequestID(t *testing.T) {
+	s := &Server{}
+	resolve := func(id string) string {
+		req := httptest.NewRequest("GET", "/resolve", nil)
+		if id != "" {
+			req.Header.Set(util.RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		s.Resolve(w, req)
+		return w.Header().Get(util.RequestIDHeader)
+	}
+
+	// The client's ID is given back.
+	if got := resolve("abcd-1234"); got != "abcd-1234" {
+		t.Errorf("expected the client's ID, got %q", got)
+	}
+
+	// Otherwise, we make up our own.
+	for _, id := range []string{"", "with space", "new\nline",
+		strings.Repeat("x", 100)} {
+		got := resolve(id)
+		if got == id || !util.ValidRequestID(got) {
+			t.Errorf("%q: got ID %q", id, got)
+		}
+	}
+	if resolve("") == resolve("") {
+		t.Errorf("request IDs are not unique")
+	}
+}
+
+func TestJSONMetadata(t *testing.T) {
+	defer func(e, et func(context.Context, *dns.Msg, string) (*dns.Msg, error)) {
+		exchange, exchangeTCP = e, et
+	}(exchange, exchangeTCP)
+	fake := func(truncated bool) func(context.Context, *dns.Msg, string) (*dns.Msg, error) {
+		return func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+			reply := &dns.Msg{}
+			reply.SetReply(m)
+			reply.AuthenticatedData = true
+			reply.Truncated = truncated
+			return reply, nil
+		}
+	}
+	exchange, exchangeTCP = fake(true), fake(false)
+
+	s := &Server{Upstream: "1.1.1.1:53"}
+	resolve := func() *dnsjson.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/resolve?name=example.com", nil)
+		w := httptest.NewRecorder()
+		s.Resolve(w, req)
+		jr := &dnsjson.Response{}
+		if err := json.Unmarshal(w.Body.Bytes(), jr); err != nil {
+			t.Fatalf("error parsing reply %q: %v", w.Body.String(), err)
+		}
+		return jr
+	}
+
+	// Not included unless enabled.
+	if jr := resolve(); jr.Metadata != nil {
+		t.Errorf("unexpected metadata: %+v", jr.Metadata)
+	}
+
+	s.JSONMetadata = true
+	jr := resolve()
+	md := jr.Metadata
+	if md == nil || md.Upstream != "1.1.1.1:53" || !md.Validated ||
+		md.Truncated || !md.RetriedTCP || md.ResponseTimeMs < 0 {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+}
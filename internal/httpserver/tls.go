@@ -0,0 +1,308 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/log"
+)
+
+// TLS 1.3, defined here as older versions of Go don't know about it.
+const versionTLS13 = 0x0304
+
+// TLS versions, by name.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": versionTLS13,
+}
+
+// Cipher suites, by their standard names. Note that the TLS 1.3 ones are not
+// configurable.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// Curves, by name.
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// How many session ticket keys we keep when rotating them, so tickets issued
+// with the previous keys can still be used for a while.
+const ticketKeysKept = 3
+
+// How often we reload the OCSP staple.
+var ocspReloadPeriod = 1 * time.Hour
+
+// ParseTLSVersion parses a TLS version ("1.0" to "1.3"). The empty string
+// means the default, and returns 0.
+func ParseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses a space-separated list of cipher suite names. An
+// empty list means the default.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range strings.Fields(s) {
+		id, ok := cipherSuites[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurves parses a space-separated list of curve names (X25519, P256,
+// P384 and P521), in order of preference. An empty list means the default.
+func ParseCurves(s string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range strings.Fields(s) {
+		id, ok := curves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// CertFiles are the files of a certificate and its key.
+type CertFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ParseCertFiles parses a space-separated list of certificates, each given
+// as "cert_file,key_file".
+func ParseCertFiles(s string) ([]CertFiles, error) {
+	var cfs []CertFiles
+	for _, f := range strings.Fields(s) {
+		sp := strings.Split(f, ",")
+		if len(sp) != 2 || sp[0] == "" || sp[1] == "" {
+			return nil, fmt.Errorf("%q: expected cert_file,key_file", f)
+		}
+		cfs = append(cfs, CertFiles{CertFile: sp[0], KeyFile: sp[1]})
+	}
+	return cfs, nil
+}
+
+// tlsConfig returns the TLS configuration for the server, according to its
+// settings. It also starts the background goroutines to rotate the session
+// ticket keys and reload the OCSP staple, if needed.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		MinVersion:       s.TLSMinVersion,
+		CipherSuites:     s.CipherSuites,
+		CurvePreferences: s.Curves,
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+	if len(s.CipherSuites) > 0 {
+		conf.PreferServerCipherSuites = true
+	}
+
+	if s.OCSPStapleFile == "" && len(s.ExtraCerts) == 0 {
+		conf.Certificates = []tls.Certificate{cert}
+	} else if s.OCSPStapleFile == "" {
+		conf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	} else {
+		sc := &stapledCert{
+			file: s.OCSPStapleFile,
+			mu:   &sync.Mutex{},
+			cert: cert,
+		}
+		if err := sc.reload(); err != nil {
+			return nil, err
+		}
+		go sc.reloadPeriodically()
+		conf.GetCertificate = sc.get
+	}
+
+	if len(s.ExtraCerts) > 0 {
+		sni, err := newSNICerts(s.ExtraCerts, conf.GetCertificate)
+		if err != nil {
+			return nil, err
+		}
+		conf.GetCertificate = sni.get
+	}
+
+	if s.TicketKeyRotation > 0 {
+		go rotateTicketKeys(conf, s.TicketKeyRotation)
+	}
+
+	return conf, nil
+}
+
+// rotateTicketKeys generates a new session ticket key every period, keeping
+// the previous ones around for a while. Never returns.
+func rotateTicketKeys(conf *tls.Config, period time.Duration) {
+	var keys [][32]byte
+	for {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			log.Errorf("Error generating session ticket key: %v", err)
+		} else {
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > ticketKeysKept {
+				keys = keys[:ticketKeysKept]
+			}
+			conf.SetSessionTicketKeys(keys)
+		}
+		time.Sleep(period)
+	}
+}
+
+// stapledCert is a certificate with an OCSP staple, which is reloaded
+// periodically from a file (e.g. maintained by a cron job).
+type stapledCert struct {
+	file string
+
+	mu   *sync.Mutex
+	cert tls.Certificate
+}
+
+func (sc *stapledCert) reload() error {
+	staple, err := ioutil.ReadFile(sc.file)
+	if err != nil {
+		return fmt.Errorf("error reading OCSP staple: %v", err)
+	}
+
+	sc.mu.Lock()
+	sc.cert.OCSPStaple = staple
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *stapledCert) reloadPeriodically() {
+	for range time.Tick(ocspReloadPeriod) {
+		if err := sc.reload(); err != nil {
+			// Keep the previous one, it may still be valid.
+			log.Errorf("%v", err)
+		}
+	}
+}
+
+func (sc *stapledCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	cert := sc.cert
+	return &cert, nil
+}
+
+// sniCerts selects the certificate to use by the name the client asks for
+// (SNI), among the additional ones, so a server can have different
+// certificates for each of its names. The names come from the certificates
+// themselves, and can be wildcards (like "*.example.com").
+type sniCerts struct {
+	// Certificates by (lowercased) name.
+	byName map[string]*tls.Certificate
+
+	// Function to get the default certificate, for clients which don't use
+	// SNI, or ask for other names.
+	def func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+func newSNICerts(cfs []CertFiles, def func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*sniCerts, error) {
+	sc := &sniCerts{
+		byName: map[string]*tls.Certificate{},
+		def:    def,
+	}
+	for _, cf := range cfs {
+		cert, err := tls.LoadX509KeyPair(cf.CertFile, cf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cf.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cf.CertFile, err)
+		}
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("%s: certificate has no names", cf.CertFile)
+		}
+		for _, n := range names {
+			n = strings.ToLower(n)
+			// The first one wins, like the order of the list.
+			if _, ok := sc.byName[n]; !ok {
+				sc.byName[n] = &cert
+			}
+		}
+		log.Infof("HTTPS certificate %s for %v", cf.CertFile, names)
+	}
+	return sc, nil
+}
+
+func (sc *sniCerts) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := sc.byName[name]; ok {
+		return cert, nil
+	}
+
+	// Wildcards only match a single label.
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := sc.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return sc.def(hello)
+}
+
+// tcpKeepAliveListener sets TCP keep-alive timeouts on accepted connections,
+// like http.ListenAndServeTLS does, so dead connections go away eventually.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
+	tc, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(3 * time.Minute)
+	return tc, nil
+}
@@ -0,0 +1,253 @@
+// Tests for the TLS configuration.
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	cases := []struct {
+		s      string
+		v      uint16
+		hasErr bool
+	}{
+		{"", 0, false},
+		{"1.0", tls.VersionTLS10, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", versionTLS13, false},
+		{"1.4", 0, true},
+		{"tls1.2", 0, true},
+	}
+	for _, c := range cases {
+		v, err := ParseTLSVersion(c.s)
+		if v != c.v || (err != nil) != c.hasErr {
+			t.Errorf("%q: got %v, %v", c.s, v, err)
+		}
+	}
+}
+
+func TestParseCipherSuitesAndCurves(t *testing.T) {
+	ids, err := ParseCipherSuites(
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 tls_ecdhe_ecdsa_with_chacha20_poly1305")
+	expected := []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+	if err != nil || !reflect.DeepEqual(ids, expected) {
+		t.Errorf("unexpected cipher suites: %v, %v", ids, err)
+	}
+	if ids, err := ParseCipherSuites(""); err != nil || ids != nil {
+		t.Errorf("unexpected cipher suites for empty list: %v, %v", ids, err)
+	}
+	if _, err := ParseCipherSuites("TLS_FAKE"); err == nil {
+		t.Errorf("unknown cipher suite was accepted")
+	}
+
+	curveIDs, err := ParseCurves("x25519 P384")
+	if err != nil || !reflect.DeepEqual(curveIDs,
+		[]tls.CurveID{tls.X25519, tls.CurveP384}) {
+		t.Errorf("unexpected curves: %v, %v", curveIDs, err)
+	}
+	if _, err := ParseCurves("P999"); err == nil {
+		t.Errorf("unknown curve was accepted")
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key in the given
+// directory, and returns their paths. The certificate is for the given
+// names, or for "localhost" (as its common name) if there are none.
+func writeTestCert(t *testing.T, dir string, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	base := "cert"
+	if len(names) > 0 {
+		tmpl.DNSNames = names
+		base = strings.Replace(names[0], "*", "_", -1)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshalling key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, base+".pem")
+	keyFile := filepath.Join(dir, base+".key")
+	ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	s := &Server{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		TLSMinVersion: tls.VersionTLS12,
+		Curves:        []tls.CurveID{tls.X25519},
+	}
+	conf, err := s.tlsConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	if conf.MinVersion != tls.VersionTLS12 || len(conf.Certificates) != 1 ||
+		!reflect.DeepEqual(conf.CurvePreferences, s.Curves) {
+		t.Errorf("unexpected config: %+v", conf)
+	}
+
+	// With an OCSP staple, which gets reloaded.
+	stapleFile := filepath.Join(dir, "ocsp.der")
+	ioutil.WriteFile(stapleFile, []byte("staple 1"), 0600)
+	s.OCSPStapleFile = stapleFile
+	conf, err = s.tlsConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	cert, _ := conf.GetCertificate(nil)
+	if string(cert.OCSPStaple) != "staple 1" {
+		t.Errorf("unexpected staple: %q", cert.OCSPStaple)
+	}
+
+	// Missing files are an error.
+	s.OCSPStapleFile = filepath.Join(dir, "doesnotexist")
+	if _, err := s.tlsConfig(); err == nil {
+		t.Errorf("missing staple file was accepted")
+	}
+	s.CertFile = s.OCSPStapleFile
+	if _, err := s.tlsConfig(); err == nil {
+		t.Errorf("missing certificate was accepted")
+	}
+}
+
+func TestSNICerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	dohCert, dohKey := writeTestCert(t, dir, "doh.example.com")
+	netCert, netKey := writeTestCert(t, dir, "dns.example.net", "*.example.net")
+	extra, err := ParseCertFiles(dohCert + "," + dohKey + " " +
+		netCert + "," + netKey)
+	if err != nil {
+		t.Fatalf("error parsing certificates: %v", err)
+	}
+
+	s := &Server{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ExtraCerts: extra,
+	}
+	conf, err := s.tlsConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"doh.example.com", "doh.example.com"},
+		{"DOH.example.com.", "doh.example.com"},
+		{"dns.example.net", "dns.example.net"},
+		{"other.example.net", "dns.example.net"},
+		{"a.b.example.net", "localhost"},
+		{"example.net", "localhost"},
+		{"", "localhost"},
+	}
+	for _, c := range cases {
+		cert, err := conf.GetCertificate(&tls.ClientHelloInfo{ServerName: c.name})
+		if err != nil {
+			t.Errorf("%q: error getting certificate: %v", c.name, err)
+			continue
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		got := leaf.Subject.CommonName
+		if len(leaf.DNSNames) > 0 {
+			got = leaf.DNSNames[0]
+		}
+		if got != c.expected {
+			t.Errorf("%q: got certificate for %q, expected %q",
+				c.name, got, c.expected)
+		}
+	}
+
+	for _, s := range []string{"a.pem", "a.pem,", "a.pem,a.key,b"} {
+		if _, err := ParseCertFiles(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+
+	// Missing files are an error.
+	s.ExtraCerts = []CertFiles{{filepath.Join(dir, "doesnotexist"), keyFile}}
+	if _, err := s.tlsConfig(); err == nil {
+		t.Errorf("missing extra certificate was accepted")
+	}
+}
+
+func TestStapleReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ocsp.der")
+	ioutil.WriteFile(file, []byte("staple 1"), 0600)
+	sc := &stapledCert{file: file, mu: &sync.Mutex{}}
+	if err := sc.reload(); err != nil {
+		t.Fatalf("error loading staple: %v", err)
+	}
+
+	ioutil.WriteFile(file, []byte("staple 2"), 0600)
+	sc.reload()
+	cert, _ := sc.get(nil)
+	if string(cert.OCSPStaple) != "staple 2" {
+		t.Errorf("staple was not reloaded: %q", cert.OCSPStaple)
+	}
+
+	// On errors, the previous one is kept.
+	os.Remove(file)
+	if err := sc.reload(); err == nil {
+		t.Errorf("missing staple file was accepted")
+	}
+	cert, _ = sc.get(nil)
+	if string(cert.OCSPStaple) != "staple 2" {
+		t.Errorf("staple was lost: %q", cert.OCSPStaple)
+	}
+}
@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// Constants that tune the queries to the upstreams, declared as variables
+// so we can tweak them for testing.
+var (
+	// Timeout for each query (over UDP or TCP).
+	upstreamTimeout = 2 * time.Second
+
+	// How many times to go over the list of upstreams before giving up.
+	upstreamRounds = 2
+)
+
+// exchange does the DNS request to the upstream over UDP, and exchangeTCP
+// over TCP, giving up early if the context is done; they are variables so
+// tests can override them.
+var (
+	exchange = func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+		c := &dns.Client{Timeout: upstreamTimeout}
+		r, _, err := c.ExchangeContext(ctx, m, addr)
+		return r, err
+	}
+
+	exchangeTCP = func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+		c := &dns.Client{Net: "tcp", Timeout: upstreamTimeout}
+		r, _, err := c.ExchangeContext(ctx, m, addr)
+		return r, err
+	}
+)
+
+var errNoResponse = errors.New("no response from upstream")
+
+// queryInfo describes how a query was resolved, for the JSON metadata (see
+// dnsjson.Metadata).
+type queryInfo struct {
+	// Address of the upstream that answered ("" if we used a resolver).
+	upstream string
+
+	// The upstream's reply over UDP was truncated, so we retried over TCP.
+	retriedTCP bool
+}
+
+// queryUpstreams sends the query to the upstreams (a space-separated list
+// of host:port addresses), in order, moving on to the next one on errors
+// and timeouts. Truncated replies are retried over TCP with the same
+// upstream. It stops when the context is done (for example, because the
+// client went away).
+func queryUpstreams(ctx context.Context, tr trace.Trace, r *dns.Msg, upstreams string) (*dns.Msg, queryInfo, error) {
+	servers := strings.Fields(upstreams)
+	err := errNoResponse
+	for round := 0; round < upstreamRounds; round++ {
+		for _, addr := range servers {
+			if ctx.Err() != nil {
+				return nil, queryInfo{}, ctx.Err()
+			}
+
+			info := queryInfo{upstream: addr}
+			var reply *dns.Msg
+			reply, err = exchange(ctx, r, addr)
+			if err == nil && reply == nil {
+				err = errNoResponse
+			}
+			if err == nil && reply.Truncated {
+				tr.LazyPrintf("%s: truncated reply, retrying over TCP", addr)
+				info.retriedTCP = true
+				reply, err = exchangeTCP(ctx, r, addr)
+				if err == nil && reply == nil {
+					err = errNoResponse
+				}
+			}
+			if err == nil {
+				return reply, info, nil
+			}
+			tr.LazyPrintf("%s: %v", addr, err)
+		}
+	}
+	return nil, queryInfo{}, err
+}
@@ -0,0 +1,87 @@
+// Tests for the queries to the upstreams.
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestQueryUpstreams(t *testing.T) {
+	defer func(e, tcp func(context.Context, *dns.Msg, string) (*dns.Msg, error)) {
+		exchange, exchangeTCP = e, tcp
+	}(exchange, exchangeTCP)
+
+	// Which upstreams are down, and which give truncated replies over UDP.
+	down := map[string]bool{}
+	truncated := map[string]bool{}
+	queried := []string{}
+	fake := func(proto string) func(context.Context, *dns.Msg, string) (*dns.Msg, error) {
+		return func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+			queried = append(queried, proto+":"+addr)
+			if down[addr] {
+				return nil, errors.New("timeout")
+			}
+			reply := &dns.Msg{}
+			reply.SetReply(m)
+			reply.Truncated = proto == "udp" && truncated[addr]
+			return reply, nil
+		}
+	}
+	exchange, exchangeTCP = fake("udp"), fake("tcp")
+
+	query := func(upstreams string) (*dns.Msg, error) {
+		queried = nil
+		r := &dns.Msg{}
+		r.SetQuestion("example.com.", dns.TypeA)
+		reply, _, err := queryUpstreams(context.Background(), testutil.NewTestTrace(t), r, upstreams)
+		return reply, err
+	}
+	expectQueried := func(expected ...string) {
+		t.Helper()
+		if len(queried) != len(expected) {
+			t.Errorf("queried %v, expected %v", queried, expected)
+			return
+		}
+		for i := range expected {
+			if queried[i] != expected[i] {
+				t.Errorf("queried %v, expected %v", queried, expected)
+				return
+			}
+		}
+	}
+
+	if _, err := query("a:53 b:53"); err != nil {
+		t.Errorf("error: %v", err)
+	}
+	expectQueried("udp:a:53")
+
+	// The first one is down, so we move on to the second.
+	down["a:53"] = true
+	if _, err := query("a:53 b:53"); err != nil {
+		t.Errorf("error: %v", err)
+	}
+	expectQueried("udp:a:53", "udp:b:53")
+
+	// Truncated replies are retried over TCP.
+	truncated["b:53"] = true
+	reply, err := query("a:53 b:53")
+	if err != nil || reply.Truncated {
+		t.Errorf("unexpected reply: %v, %v", reply, err)
+	}
+	expectQueried("udp:a:53", "udp:b:53", "tcp:b:53")
+
+	// All down: we go over the list upstreamRounds times.
+	down["b:53"] = true
+	if _, err := query("a:53 b:53"); err == nil {
+		t.Errorf("no error with all upstreams down")
+	}
+	expectQueried("udp:a:53", "udp:b:53", "udp:a:53", "udp:b:53")
+
+	if _, err := query(""); err != errNoResponse {
+		t.Errorf("unexpected error with no upstreams: %v", err)
+	}
+}
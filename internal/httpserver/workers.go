@@ -0,0 +1,122 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"expvar"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// The upstream queries are done by a fixed number of workers, instead of by
+// the goroutine of each request, so a slow upstream can't make us pile up
+// an unbounded number of them (along with their sockets and buffers).
+//
+// Requests wait in a bounded queue for a worker to be free, and fail right
+// away when it's full. Each query uses the context of its request, which is
+// done when the client disconnects: if that happens while the query is still
+// in the queue, it's skipped; if it's already running, the exchange with the
+// upstream is aborted.
+
+// errOverloaded is returned when all the workers are busy, and the queue is
+// full.
+var errOverloaded = errors.New("too many queries in progress")
+
+// Exported variables for statistics.
+var workerStats = struct {
+	// Queries that didn't go to the workers, by reason: "overloaded" (the
+	// queue was full), and "cancelled" (the client went away while the
+	// query was in the queue).
+	rejected *expvar.Map
+}{}
+
+func init() {
+	workerStats.rejected = expvar.NewMap("https-worker-rejections")
+}
+
+// workerPool runs functions in a fixed number of goroutines.
+type workerPool struct {
+	// Functions to run, taken by the workers.
+	jobs chan func()
+
+	// Slots for the functions running or waiting for a worker, to bound
+	// the queue.
+	slots chan struct{}
+}
+
+// newWorkerPool returns a pool with the given number of workers, and a queue
+// of the given size. If workers is 0, it returns nil, which runs the
+// functions right away.
+func newWorkerPool(workers, queue int) *workerPool {
+	if workers <= 0 {
+		return nil
+	}
+
+	p := &workerPool{
+		jobs:  make(chan func()),
+		slots: make(chan struct{}, workers+queue),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for f := range p.jobs {
+		f()
+	}
+}
+
+// run runs f in one of the workers, and waits for it to finish. It returns
+// errOverloaded if the queue is full, and the context's error if it was done
+// before f started; in both cases, f is not run.
+func (p *workerPool) run(ctx context.Context, f func()) error {
+	if p == nil {
+		f()
+		return nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		defer func() { <-p.slots }()
+	default:
+		workerStats.rejected.Add("overloaded", 1)
+		return errOverloaded
+	}
+
+	done := make(chan struct{})
+	job := func() {
+		f()
+		close(done)
+	}
+	select {
+	case p.jobs <- job:
+	case <-ctx.Done():
+		workerStats.rejected.Add("cancelled", 1)
+		return ctx.Err()
+	}
+
+	// Once started, we always wait for the job (even if the context is
+	// done), as it uses the request's trace, which must not be used after
+	// the request is finished. The exchanges with the upstreams are aborted
+	// via the context, so this is usually quick.
+	<-done
+	return nil
+}
+
+// query resolves the query via the endpoint (see Endpoint.query), in one of
+// the workers.
+func (s *Server) query(ctx context.Context, tr trace.Trace, ep *Endpoint, r *dns.Msg) (*dns.Msg, queryInfo, error) {
+	var reply *dns.Msg
+	var info queryInfo
+	var err error
+	perr := s.workers.run(ctx, func() {
+		reply, info, err = ep.query(ctx, tr, r)
+	})
+	if perr != nil {
+		return nil, queryInfo{}, perr
+	}
+	return reply, info, err
+}
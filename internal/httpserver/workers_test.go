@@ -0,0 +1,125 @@
+// Tests for the upstream query workers.
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool(1, 1)
+
+	// Block the only worker.
+	block := make(chan struct{})
+	started := make(chan struct{})
+	firstDone := make(chan error)
+	go func() {
+		firstDone <- p.run(context.Background(), func() {
+			close(started)
+			<-block
+		})
+	}()
+	<-started
+
+	// The next one waits in the queue.
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := false
+	queuedDone := make(chan error)
+	go func() {
+		queuedDone <- p.run(ctx, func() { ran = true })
+	}()
+	for len(p.slots) < 2 {
+		// Wait for it to be queued.
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so this one is rejected.
+	if err := p.run(context.Background(), func() {}); err != errOverloaded {
+		t.Errorf("expected errOverloaded, got %v", err)
+	}
+
+	// The client of the queued one goes away, so it's not run.
+	cancel()
+	if err := <-queuedDone; err != context.Canceled || ran {
+		t.Errorf("queued job: %v, ran: %v", err, ran)
+	}
+
+	close(block)
+	if err := <-firstDone; err != nil {
+		t.Errorf("first job error: %v", err)
+	}
+
+	// Now everything works again.
+	ran = false
+	if err := p.run(context.Background(), func() { ran = true }); err != nil || !ran {
+		t.Errorf("job error: %v, ran: %v", err, ran)
+	}
+
+	// A nil pool runs the jobs right away.
+	var nilP *workerPool
+	ran = false
+	if err := nilP.run(context.Background(), func() { ran = true }); err != nil || !ran {
+		t.Errorf("nil pool: %v, ran: %v", err, ran)
+	}
+}
+
+func TestQueryCancelled(t *testing.T) {
+	defer func(e func(context.Context, *dns.Msg, string) (*dns.Msg, error)) { exchange = e }(exchange)
+	queried := 0
+	exchange = func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+		queried++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	// The client goes away: we don't move on to the next upstream.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	_, _, err := queryUpstreams(ctx, testutil.NewTestTrace(t), r, "a:53 b:53")
+	if err != context.Canceled || queried != 0 {
+		t.Errorf("error %v, queried %d upstreams", err, queried)
+	}
+}
+
+func TestOverloaded(t *testing.T) {
+	defer func(e func(context.Context, *dns.Msg, string) (*dns.Msg, error)) { exchange = e }(exchange)
+	started := make(chan struct{})
+	block := make(chan struct{})
+	exchange = func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+		close(started)
+		<-block
+		reply := &dns.Msg{}
+		reply.SetReply(m)
+		return reply, nil
+	}
+
+	s := &Server{Upstream: "1.1.1.1:53"}
+	s.workers = newWorkerPool(1, 0)
+	resolve := func() int {
+		req := httptest.NewRequest("GET", "/resolve?name=example.com", nil)
+		w := httptest.NewRecorder()
+		s.Resolve(w, req)
+		return w.Code
+	}
+
+	// Keep the only worker busy, so the next query is rejected.
+	firstCode := make(chan int)
+	go func() { firstCode <- resolve() }()
+	<-started
+	if code := resolve(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while overloaded, got %d", code)
+	}
+
+	close(block)
+	if code := <-firstCode; code != http.StatusOK {
+		t.Errorf("first query got %d", code)
+	}
+}
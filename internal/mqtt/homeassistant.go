@@ -0,0 +1,86 @@
+package mqtt
+
+// Home Assistant MQTT discovery: on each connection we publish (retained) the
+// configuration of a sensor for each of the values in the state, and a
+// button for each command, all grouped under a device, so they show up in
+// Home Assistant without any configuration.
+//
+// Reference: https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// nodeID is the client identifier, in the restricted charset Home Assistant
+// allows for the discovery topics and unique ids.
+func (c *Client) nodeID() string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, c.clientID)
+}
+
+// discoveryConfigs returns the discovery configurations, by topic.
+func (c *Client) discoveryConfigs() map[string][]byte {
+	node := c.nodeID()
+	device := map[string]interface{}{
+		"identifiers": []string{node},
+		"name":        c.clientID,
+		"model":       "dnss",
+	}
+
+	configs := map[string][]byte{}
+	add := func(component, id string, config map[string]interface{}) {
+		config["unique_id"] = node + "_" + id
+		config["availability_topic"] = c.topic("availability")
+		config["device"] = device
+		buf, err := json.Marshal(config)
+		if err != nil {
+			// Can't really happen, the configuration is made of simple
+			// values.
+			panic(err)
+		}
+		topic := c.DiscoveryPrefix + "/" + component + "/" + node + "/" +
+			id + "/config"
+		configs[topic] = buf
+	}
+
+	for _, s := range c.Sensors {
+		config := map[string]interface{}{
+			"name":        s.Name,
+			"state_topic": c.topic("state"),
+		}
+		component := "sensor"
+		if s.Binary {
+			component = "binary_sensor"
+			config["value_template"] =
+				"{{ 'ON' if value_json." + s.Key + " else 'OFF' }}"
+		} else {
+			config["value_template"] = "{{ value_json." + s.Key + " }}"
+		}
+		if s.Unit != "" {
+			config["unit_of_measurement"] = s.Unit
+		}
+		if s.DeviceClass != "" {
+			config["device_class"] = s.DeviceClass
+		}
+		if s.StateClass != "" {
+			config["state_class"] = s.StateClass
+		}
+		add(component, s.Key, config)
+	}
+
+	for _, cmd := range c.Commands {
+		add("button", cmd.Name, map[string]interface{}{
+			"name":          cmd.Title,
+			"command_topic": c.topic("command/" + cmd.Name),
+			"payload_press": cmd.Payload,
+		})
+	}
+
+	return configs
+}
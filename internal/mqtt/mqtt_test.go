@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketEncoding(t *testing.T) {
+	for _, size := range []int{0, 1, 127, 128, 16383, 16384, maxPacketSize} {
+		p := &packet{typ: typePublish, flags: 1, body: make([]byte, size)}
+		got, err := readPacket(bufio.NewReader(bytes.NewReader(p.encode())))
+		if err != nil {
+			t.Errorf("%d: error reading: %v", size, err)
+			continue
+		}
+		if got.typ != p.typ || got.flags != p.flags || len(got.body) != size {
+			t.Errorf("%d: got %d %d %d", size, got.typ, got.flags, len(got.body))
+		}
+	}
+
+	p := &packet{typ: typePublish, body: make([]byte, maxPacketSize+1)}
+	_, err := readPacket(bufio.NewReader(bytes.NewReader(p.encode())))
+	if err != errPacketTooLarge {
+		t.Errorf("expected errPacketTooLarge, got %v", err)
+	}
+
+	p = publishPacket("a/b", []byte("payload"), true)
+	topic, payload, id, err := parsePublish(p)
+	if err != nil || topic != "a/b" || string(payload) != "payload" || id != 0 {
+		t.Errorf("unexpected publish: %q %q %d %v", topic, payload, id, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		broker, addr string
+		useTLS       bool
+		user, pass   string
+	}{
+		{"tcp://broker", "broker:1883", false, "", ""},
+		{"mqtt://u:p@broker:1234", "broker:1234", false, "u", "p"},
+		{"mqtts://broker", "broker:8883", true, "", ""},
+		{"ssl://u@[::1]", "[::1]:8883", true, "u", ""},
+	}
+	for _, c := range cases {
+		cl, err := New(c.broker, "dnss")
+		if err != nil {
+			t.Errorf("%q: error: %v", c.broker, err)
+			continue
+		}
+		if cl.addr != c.addr || cl.useTLS != c.useTLS ||
+			cl.username != c.user || cl.password != c.pass {
+			t.Errorf("%q: got %+v", c.broker, cl)
+		}
+	}
+
+	for _, broker := range []string{"http://broker", "tcp://", ":::"} {
+		if _, err := New(broker, "dnss"); err == nil {
+			t.Errorf("%q: expected error", broker)
+		}
+	}
+	if _, err := New("tcp://broker", "dnss/#"); err == nil {
+		t.Errorf("expected error on invalid prefix")
+	}
+}
+
+// fakeBroker accepts a single connection, and hands the packets over.
+type fakeBroker struct {
+	t    *testing.T
+	l    net.Listener
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	return &fakeBroker{t: t, l: l}
+}
+
+func (b *fakeBroker) accept() {
+	conn, err := b.l.Accept()
+	if err != nil {
+		b.t.Fatalf("error accepting: %v", err)
+	}
+	b.conn = conn
+	b.r = bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+}
+
+func (b *fakeBroker) read(typ byte) *packet {
+	b.t.Helper()
+	p, err := readPacket(b.r)
+	if err != nil {
+		b.t.Fatalf("error reading: %v", err)
+	}
+	if p.typ != typ {
+		b.t.Fatalf("expected packet type %d, got %d", typ, p.typ)
+	}
+	return p
+}
+
+func (b *fakeBroker) write(p *packet) {
+	b.t.Helper()
+	if _, err := b.conn.Write(p.encode()); err != nil {
+		b.t.Fatalf("error writing: %v", err)
+	}
+}
+
+// readPublishes reads publish packets, until one for the given topic.
+func (b *fakeBroker) readPublishes(topic string) map[string][]byte {
+	b.t.Helper()
+	got := map[string][]byte{}
+	for {
+		t, payload, _, err := parsePublish(b.read(typePublish))
+		if err != nil {
+			b.t.Fatalf("invalid publish: %v", err)
+		}
+		got[t] = payload
+		if t == topic {
+			return got
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	b := newFakeBroker(t)
+	defer b.l.Close()
+
+	c, err := New("tcp://user:pass@"+b.l.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DiscoveryPrefix = "homeassistant"
+	c.Interval = time.Hour
+	queries := 0
+	c.Status = func() map[string]interface{} {
+		return map[string]interface{}{"queries": queries}
+	}
+	c.Sensors = []Sensor{{Key: "queries", Name: "Queries"}}
+	args := []string{}
+	c.Commands = []Command{{
+		Name:  "flush",
+		Title: "Flush",
+		Run: func(arg string) error {
+			args = append(args, arg)
+			queries++
+			return nil
+		},
+	}}
+
+	errc := make(chan error)
+	go func() { errc <- c.session() }()
+	b.accept()
+
+	p := b.read(typeConnect)
+	if !bytes.Contains(p.body, []byte("test/availability")) ||
+		!bytes.Contains(p.body, []byte("pass")) {
+		t.Errorf("unexpected CONNECT: %q", p.body)
+	}
+	b.write(&packet{typ: typeConnAck, body: []byte{0, 0}})
+
+	p = b.read(typeSubscribe)
+	if !bytes.Contains(p.body, []byte("test/command/+")) {
+		t.Errorf("unexpected SUBSCRIBE: %q", p.body)
+	}
+	b.write(&packet{typ: typeSubAck, body: []byte{0, 1, 0}})
+
+	got := b.readPublishes("test/state")
+	if string(got["test/availability"]) != "online" {
+		t.Errorf("unexpected availability: %q", got["test/availability"])
+	}
+	if string(got["test/state"]) != `{"queries":0}` {
+		t.Errorf("unexpected state: %q", got["test/state"])
+	}
+	config := map[string]interface{}{}
+	err = json.Unmarshal(
+		got["homeassistant/button/"+c.nodeID()+"/flush/config"], &config)
+	if err != nil || config["command_topic"] != "test/command/flush" {
+		t.Errorf("unexpected button config: %v (%v)", config, err)
+	}
+	if _, ok := got["homeassistant/sensor/"+c.nodeID()+"/queries/config"]; !ok {
+		t.Errorf("missing sensor config: %v", got)
+	}
+
+	// Retained commands are ignored, the rest are run and the new state
+	// published.
+	b.write(publishPacket("test/command/flush", []byte("old"), true))
+	b.write(publishPacket("test/command/flush", []byte("arg"), false))
+	got = b.readPublishes("test/state")
+	if string(got["test/state"]) != `{"queries":1}` {
+		t.Errorf("unexpected state: %q", got["test/state"])
+	}
+	if strings.Join(args, " ") != "arg" {
+		t.Errorf("unexpected command arguments: %q", args)
+	}
+
+	b.conn.Close()
+	if err := <-errc; err == nil {
+		t.Errorf("session ended without an error")
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	b := newFakeBroker(t)
+	defer b.l.Close()
+
+	c, err := New("tcp://"+b.l.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error)
+	go func() { errc <- c.session() }()
+	b.accept()
+	b.read(typeConnect)
+	b.write(&packet{typ: typeConnAck, body: []byte{0, 4}})
+
+	err = <-errc
+	if err == nil || !strings.Contains(err.Error(), "bad user name") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
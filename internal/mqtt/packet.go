@@ -0,0 +1,214 @@
+package mqtt
+
+// The subset of MQTT 3.1.1 we use: CONNECT, PUBLISH (QoS 0 only),
+// SUBSCRIBE, PINGREQ and DISCONNECT, and their replies.
+//
+// Reference: https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Packet types (the high nibble of the first byte).
+const (
+	typeConnect    = 1
+	typeConnAck    = 2
+	typePublish    = 3
+	typePubAck     = 4
+	typeSubscribe  = 8
+	typeSubAck     = 9
+	typePingReq    = 12
+	typePingResp   = 13
+	typeDisconnect = 14
+)
+
+// Flags of the CONNECT packet.
+const (
+	connectCleanSession = 0x02
+	connectWill         = 0x04
+	connectWillRetain   = 0x20
+	connectPassword     = 0x40
+	connectUsername     = 0x80
+)
+
+// Largest packet we accept, to protect against misbehaving brokers. The
+// commands are tiny, so this is plenty.
+const maxPacketSize = 64 * 1024
+
+// packet is a control packet: its type and flags (the first byte), and the
+// rest of it.
+type packet struct {
+	typ, flags byte
+	body       []byte
+}
+
+var errPacketTooLarge = errors.New("packet too large")
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// The remaining length is a variable length integer, 7 bits per byte,
+	// up to 4 bytes.
+	length := 0
+	for i := uint(0); ; i++ {
+		if i == 4 {
+			return nil, fmt.Errorf("invalid remaining length")
+		}
+		lb, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(lb&0x7f) << (7 * i)
+		if lb&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxPacketSize {
+		return nil, errPacketTooLarge
+	}
+
+	p := &packet{typ: b >> 4, flags: b & 0x0f, body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *packet) encode() []byte {
+	buf := []byte{p.typ<<4 | p.flags}
+	n := len(p.body)
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(buf, p.body...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return string(buf[2 : 2+n]), buf[2+n:], nil
+}
+
+// connectPacket builds a CONNECT packet. The will is published (retained)
+// by the broker if we go away without disconnecting.
+func connectPacket(clientID, username, password string, keepAlive uint16,
+	willTopic, willMessage string) *packet {
+	flags := byte(connectCleanSession)
+	if willTopic != "" {
+		flags |= connectWill | connectWillRetain
+	}
+	if username != "" {
+		flags |= connectUsername
+		if password != "" {
+			flags |= connectPassword
+		}
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendString(body, clientID)
+	if willTopic != "" {
+		body = appendString(body, willTopic)
+		body = appendString(body, willMessage)
+	}
+	if flags&connectUsername != 0 {
+		body = appendString(body, username)
+	}
+	if flags&connectPassword != 0 {
+		body = appendString(body, password)
+	}
+	return &packet{typ: typeConnect, body: body}
+}
+
+// Connection refused reasons, from the CONNACK return code.
+var connAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+func checkConnAck(p *packet) error {
+	if p.typ != typeConnAck || len(p.body) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", p.typ)
+	}
+	if rc := p.body[1]; rc != 0 {
+		if msg, ok := connAckErrors[rc]; ok {
+			return fmt.Errorf("connection refused: %s", msg)
+		}
+		return fmt.Errorf("connection refused: code %d", rc)
+	}
+	return nil
+}
+
+// publishPacket builds a PUBLISH packet, with QoS 0.
+func publishPacket(topic string, payload []byte, retain bool) *packet {
+	p := &packet{typ: typePublish}
+	if retain {
+		p.flags = 0x01
+	}
+	p.body = append(appendString(nil, topic), payload...)
+	return p
+}
+
+// parsePublish returns the topic and payload of a PUBLISH packet. For QoS
+// above 0 it also returns the packet id, which must be acknowledged.
+func parsePublish(p *packet) (topic string, payload []byte, id uint16, err error) {
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if qos := (p.flags >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return "", nil, 0, io.ErrUnexpectedEOF
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return topic, rest, id, nil
+}
+
+// subscribePacket builds a SUBSCRIBE packet for the given topic filter, with
+// QoS 0.
+func subscribePacket(id uint16, filter string) *packet {
+	body := []byte{byte(id >> 8), byte(id)}
+	body = appendString(body, filter)
+	body = append(body, 0)
+	return &packet{typ: typeSubscribe, flags: 0x02, body: body}
+}
+
+func checkSubAck(p *packet, id uint16) error {
+	if len(p.body) != 3 || binary.BigEndian.Uint16(p.body) != id {
+		return fmt.Errorf("invalid SUBACK")
+	}
+	if p.body[2] == 0x80 {
+		return fmt.Errorf("subscription refused")
+	}
+	return nil
+}
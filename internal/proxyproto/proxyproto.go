@@ -0,0 +1,323 @@
+// Package proxyproto implements the HAProxy PROXY protocol (versions 1 and
+// 2), which load balancers use to tell the servers behind them the real
+// addresses of the connections they forward.
+//
+// See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt for the
+// specification.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signature of the version 2 headers.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Limits on the size of the headers, from the specification. For version
+// 2, we only care about the addresses, but have to skip the TLVs after them,
+// so we accept anything reasonable.
+const (
+	maxV1Len = 107
+	maxV2Len = 4096
+)
+
+// HeaderTimeout is how long we wait for the header when a connection is
+// established. Declared as a variable so we can tweak it for testing.
+var HeaderTimeout = 5 * time.Second
+
+// Exported variables for statistics.
+var stats = struct {
+	// Connections with missing or invalid headers.
+	errors *expvar.Int
+}{}
+
+func init() {
+	stats.errors = expvar.NewInt("proxy-protocol-errors")
+}
+
+// ReadHeader reads a PROXY header (of either version) from r, and returns
+// the source and destination addresses in it. They are nil if the header
+// doesn't have them (for example, for the load balancer's own health
+// checks).
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	default:
+		return nil, nil, errors.New("no PROXY header")
+	}
+}
+
+func readV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < maxV1Len {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if line[len(line)-1] != '\n' {
+		return nil, nil, errors.New("PROXY v1 header too long")
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	src, err = parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err = parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid address %q in PROXY header", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY header", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:12], v2Signature) {
+		return nil, nil, errors.New("invalid PROXY v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unknown PROXY version %d", hdr[12]>>4)
+	}
+
+	l := int(binary.BigEndian.Uint16(hdr[14:]))
+	if l > maxV2Len {
+		return nil, nil, errors.New("PROXY v2 header too long")
+	}
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections (like health checks) have no addresses for us.
+	if cmd := hdr[12] & 0xF; cmd == 0 {
+		return nil, nil, nil
+	} else if cmd != 1 {
+		return nil, nil, fmt.Errorf("unknown PROXY v2 command %d", cmd)
+	}
+
+	// We only care about the IP address families; the others (unix, and
+	// unspecified) are treated as if there were no addresses.
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY v2 addresses too short")
+	}
+
+	src = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// WriteHeader writes a PROXY header of the given version (1 or 2) with the
+// given TCP addresses to w.
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		return fmt.Errorf("PROXY headers need TCP addresses, not %v -> %v",
+			src, dst)
+	}
+
+	sIP, dIP := s.IP.To4(), d.IP.To4()
+	family := "TCP4"
+	var fam byte = 0x11 // INET, STREAM.
+	if sIP == nil || dIP == nil {
+		sIP, dIP = s.IP.To16(), d.IP.To16()
+		family = "TCP6"
+		fam = 0x21 // INET6, STREAM.
+	}
+
+	var buf []byte
+	switch version {
+	case 1:
+		buf = []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			family, s.IP, d.IP, s.Port, d.Port))
+	case 2:
+		buf = append(buf, v2Signature...)
+		buf = append(buf, 0x21, fam, 0, 0) // Version 2, PROXY command.
+		buf = append(buf, sIP...)
+		buf = append(buf, dIP...)
+		buf = append(buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(buf[14:], uint16(2*len(sIP)+4))
+		binary.BigEndian.PutUint16(buf[len(buf)-4:], uint16(s.Port))
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(d.Port))
+	default:
+		return fmt.Errorf("unknown PROXY version %d", version)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// NewListener returns a listener which expects a PROXY header at the start
+// of every connection accepted from l. The connections' addresses are the
+// ones given in the headers.
+//
+// The headers are required: connections without a valid one fail on their
+// first read. Note that they are trusted blindly, so only the load balancer
+// should be able to connect to l.
+func NewListener(l net.Listener) net.Listener {
+	return &listener{Listener: l}
+}
+
+type listener struct {
+	net.Listener
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// The header is read lazily, so a slow client doesn't block the
+	// accepting loop.
+	return &conn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+		once: &sync.Once{},
+		mu:   &sync.Mutex{},
+	}, nil
+}
+
+// conn is a connection which starts with a PROXY header.
+type conn struct {
+	net.Conn
+	r    *bufio.Reader
+	once *sync.Once
+
+	// Result of reading the header.
+	src, dst net.Addr
+	err      error
+
+	// mu protects the deadline, which is set by the users concurrently
+	// with the reading of the header.
+	mu           *sync.Mutex
+	readDeadline time.Time
+}
+
+// readHeader reads the header, once.
+func (c *conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(HeaderTimeout))
+		c.src, c.dst, c.err = ReadHeader(c.r)
+
+		// Restore the deadline the user may have set meanwhile.
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+
+		if c.err != nil {
+			stats.errors.Add(1)
+			c.err = fmt.Errorf("error reading PROXY header from %v: %v",
+				c.Conn.RemoteAddr(), c.err)
+
+			// Don't serve the connection at all, even if the user
+			// doesn't read from it.
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
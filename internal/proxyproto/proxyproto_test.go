@@ -0,0 +1,187 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpAddr(t *testing.T, s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		t.Fatalf("invalid address %q: %v", s, err)
+	}
+	return addr
+}
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct{ src, dst string }{
+		{"1.2.3.4:5678", "10.0.0.1:53"},
+		{"[2001:db8::1]:5678", "[2001:db8::2]:443"},
+	}
+	for _, version := range []int{1, 2} {
+		for _, c := range cases {
+			src, dst := tcpAddr(t, c.src), tcpAddr(t, c.dst)
+			buf := &bytes.Buffer{}
+			if err := WriteHeader(buf, version, src, dst); err != nil {
+				t.Fatalf("v%d %v: error writing: %v", version, c, err)
+			}
+			buf.WriteString("payload")
+
+			r := bufio.NewReader(buf)
+			gotSrc, gotDst, err := ReadHeader(r)
+			if err != nil {
+				t.Errorf("v%d %v: error reading: %v", version, c, err)
+				continue
+			}
+			if gotSrc.String() != src.String() || gotDst.String() != dst.String() {
+				t.Errorf("v%d %v: got %v -> %v", version, c, gotSrc, gotDst)
+			}
+
+			// The rest of the data must be left alone.
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("v%d %v: rest of the data is %q", version, c, rest)
+			}
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	cases := []struct {
+		header string
+		src    string
+		err    string
+	}{
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 53\r\n", "1.2.3.4:1111", ""},
+		{"PROXY UNKNOWN\r\n", "", ""},
+		{"PROXY UNKNOWN ffff:: ffff:: 1 2\r\n", "", ""},
+
+		// LOCAL command (health checks), with no addresses.
+		{"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00", "", ""},
+
+		// PROXY command, with an unspecified family.
+		{"\r\n\r\n\x00\r\nQUIT\n\x21\x00\x00\x00", "", ""},
+
+		// IPv4, with a TLV after the addresses.
+		{"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0f" +
+			"\x01\x02\x03\x04\x05\x06\x07\x08\x04\x57\x00\x35" +
+			"\x04\x00\x00", "1.2.3.4:1111", ""},
+
+		{"GET / HTTP/1.1\r\n", "", "no PROXY header"},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n", "", "invalid PROXY v1"},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 53\n", "", "invalid PROXY v1"},
+		{"PROXY TCP4 1.2.3.999 5.6.7.8 1111 53\r\n", "", "invalid address"},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 99999 53\r\n", "", "invalid port"},
+		{"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", "too long"},
+		{"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00", "", "unknown PROXY version"},
+		{"\r\n\r\n\x00\r\nQUIT\n\x22\x11\x00\x00", "", "unknown PROXY v2 command"},
+		{"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04", "",
+			"too short"},
+		{"\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00", "", "signature"},
+	}
+	for _, c := range cases {
+		src, _, err := ReadHeader(bufio.NewReader(strings.NewReader(c.header)))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: expected error %q, got %v", c.header, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.header, err)
+			continue
+		}
+		if (src == nil && c.src != "") || (src != nil && src.String() != c.src) {
+			t.Errorf("%q: expected source %q, got %v", c.header, c.src, src)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	pl := NewListener(l)
+	defer pl.Close()
+
+	HeaderTimeout = 100 * time.Millisecond
+
+	// A connection with a header, which the client sends in two parts.
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 53\r"))
+		time.Sleep(10 * time.Millisecond)
+		c.Write([]byte("\nhello"))
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	if got := c.RemoteAddr().String(); got != "1.2.3.4:1111" {
+		t.Errorf("unexpected remote address %q", got)
+	}
+	if got := c.LocalAddr().String(); got != "5.6.7.8:53" {
+		t.Errorf("unexpected local address %q", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	c.Close()
+
+	// A connection without a header, which must fail.
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("hello\r\n"))
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	prev := stats.errors.Value()
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	if _, err := c.Read(buf); err == nil {
+		t.Errorf("read from a connection without header worked")
+	}
+	if stats.errors.Value() != prev+1 {
+		t.Errorf("error not counted")
+	}
+
+	// A connection that doesn't send anything times out.
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		time.Sleep(time.Second)
+	}()
+
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	start := time.Now()
+	if _, err := c.Read(buf); err == nil {
+		t.Errorf("read from a silent connection worked")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("header timeout took too long: %v", time.Since(start))
+	}
+}
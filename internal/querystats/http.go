@@ -0,0 +1,114 @@
+package querystats
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default and maximum number of items per page.
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// TopResponse is the reply to the queries for the top domains or clients.
+type TopResponse struct {
+	// Size of the buckets.
+	Bucket string
+
+	// Total number of items, and the ones in this page.
+	Total  int
+	Offset int
+	Items  []Item
+}
+
+// SeriesResponse is the reply to the queries for the series of a domain or
+// client.
+type SeriesResponse struct {
+	Bucket string
+	Name   string
+	Points []Point
+}
+
+// RegisterDebugHandlers registers http debug handlers, which can be accessed
+// from the monitoring server.
+// Note these are global by nature, if you try to register them multiple
+// times, you will get a panic.
+func (s *Stats) RegisterDebugHandlers() {
+	http.HandleFunc("/debug/stats/domains", s.handler(Domains))
+	http.HandleFunc("/debug/stats/clients", s.handler(Clients))
+}
+
+// handler returns the HTTP handler for the given kind of statistics.
+// The parameters are:
+//
+//   bucket   size of the buckets: 5m, 1h (the default) or 1d
+//   range    how far back to look, like 24h (default: as far as we have)
+//   name     if given, return the series of this domain or client, instead
+//            of the top ones
+//   offset   for the top ones, how many to skip (for pagination)
+//   limit    for the top ones, how many to return (default 100, max 1000)
+func (s *Stats) handler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := r.FormValue("bucket")
+		if res == "" {
+			res = bucketsMedium.name
+		}
+		if s.resolution(res) == nil {
+			http.Error(w, "unknown bucket size (use 5m, 1h or 1d)",
+				http.StatusBadRequest)
+			return
+		}
+
+		var since time.Time
+		if v := r.FormValue("range"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid range", http.StatusBadRequest)
+				return
+			}
+			since = s.clock.Now().Add(-d)
+		}
+
+		var reply interface{}
+		if name := r.FormValue("name"); name != "" {
+			reply = &SeriesResponse{
+				Bucket: res,
+				Name:   name,
+				Points: s.Series(kind, res, name, since),
+			}
+		} else {
+			offset, err := formInt(r, "offset", 0)
+			if err != nil || offset < 0 {
+				http.Error(w, "invalid offset", http.StatusBadRequest)
+				return
+			}
+			limit, err := formInt(r, "limit", defaultLimit)
+			if err != nil || limit < 1 || limit > maxLimit {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+
+			items, total := s.Top(kind, res, since, offset, limit)
+			reply = &TopResponse{
+				Bucket: res,
+				Total:  total,
+				Offset: offset,
+				Items:  items,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	}
+}
+
+func formInt(r *http.Request, name string, def int) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
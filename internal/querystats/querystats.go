@@ -0,0 +1,272 @@
+// Package querystats keeps per-domain and per-client statistics of the
+// queries, in time buckets, and serves them as JSON, for external
+// dashboards (like Grafana's JSON datasource, or Home Assistant).
+//
+// The queries are counted in buckets of 5 minutes (for the last day), 1 hour
+// (for the last week) and 1 day (for the last month). To keep the memory
+// bounded, each bucket counts a limited number of different domains and
+// clients; once full, they are approximated with the Space-Saving algorithm
+// (see addTo), so the ones with the most queries are kept even if they show
+// up late.
+package querystats
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+)
+
+// Count of queries.
+type Count struct {
+	Queries int64
+
+	// Queries that failed (SERVFAIL).
+	Failed int64
+
+	// How many of the queries may have been for other names, which this one
+	// replaced once the bucket was full (so the counts are at most this
+	// over the real ones).
+	Overcount int64
+}
+
+func (c *Count) add(d Count) {
+	c.Queries += d.Queries
+	c.Failed += d.Failed
+	c.Overcount += d.Overcount
+}
+
+// A resolution is a set of buckets of the same size.
+type resolution struct {
+	name string
+	size time.Duration
+
+	// How many buckets to keep, and how many different names each one
+	// counts.
+	keep, maxNames int
+
+	// Oldest first.
+	buckets []*bucket
+}
+
+type bucket struct {
+	start   time.Time
+	domains map[string]*Count
+	clients map[string]*Count
+}
+
+// Constants that tune the buckets, declared as variables so we can tweak
+// them for testing.
+var (
+	// Buckets of 5 minutes, for the last day.
+	bucketsFine = resolution{name: "5m", size: 5 * time.Minute,
+		keep: 288, maxNames: 50}
+
+	// Buckets of 1 hour, for the last week.
+	bucketsMedium = resolution{name: "1h", size: time.Hour,
+		keep: 168, maxNames: 200}
+
+	// Buckets of 1 day, for the last month.
+	bucketsCoarse = resolution{name: "1d", size: 24 * time.Hour,
+		keep: 30, maxNames: 1000}
+)
+
+// Stats are the statistics of the queries.
+type Stats struct {
+	mu          sync.Mutex
+	resolutions []*resolution
+
+	// Clock, so tests can control time.
+	clock util.Clock
+}
+
+// New returns a new, empty, Stats.
+func New() *Stats {
+	s := &Stats{clock: util.RealClock}
+	for _, r := range []resolution{bucketsFine, bucketsMedium, bucketsCoarse} {
+		r := r
+		s.resolutions = append(s.resolutions, &r)
+	}
+	return s
+}
+
+// Add a query for the given domain, from the given client.
+func (s *Stats) Add(client, domain string, failed bool) {
+	c := Count{Queries: 1}
+	if failed {
+		c.Failed = 1
+	}
+	domain = util.CanonicalName(domain)
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.resolutions {
+		b := r.current(now)
+		addTo(b.domains, domain, c, r.maxNames)
+		addTo(b.clients, client, c, r.maxNames)
+	}
+}
+
+// addTo adds c to the count of name in m, which has at most maxNames names.
+//
+// Once it's full, it works like the Space-Saving algorithm (Metwally et al.,
+// 2005): a new name replaces the one with the fewest queries, and takes its
+// counts over, so a name needs more queries than the ones it replaces to
+// stay in. The total is kept, and the counts of the top names are close to
+// the real ones (off by at most their Overcount).
+//
+// Finding the smallest is linear, but it only happens for names not in the
+// bucket, and the buckets are small.
+func addTo(m map[string]*Count, name string, c Count, maxNames int) {
+	if m[name] == nil && len(m) >= maxNames {
+		min := ""
+		for n, mc := range m {
+			if min == "" || mc.Queries < m[min].Queries ||
+				(mc.Queries == m[min].Queries && n < min) {
+				min = n
+			}
+		}
+		replaced := m[min]
+		delete(m, min)
+		m[name] = &Count{
+			Queries:   replaced.Queries,
+			Failed:    replaced.Failed,
+			Overcount: replaced.Queries,
+		}
+	}
+	if m[name] == nil {
+		m[name] = &Count{}
+	}
+	m[name].add(c)
+}
+
+// current returns the bucket for the given time, starting a new one if
+// needed (and dropping the ones which are too old).
+func (r *resolution) current(now time.Time) *bucket {
+	start := now.Truncate(r.size)
+	if n := len(r.buckets); n > 0 && r.buckets[n-1].start.Equal(start) {
+		return r.buckets[n-1]
+	}
+
+	b := &bucket{
+		start:   start,
+		domains: map[string]*Count{},
+		clients: map[string]*Count{},
+	}
+	r.buckets = append(r.buckets, b)
+
+	// Drop the buckets which are too old, even if there were periods without
+	// queries in between.
+	oldest := start.Add(-time.Duration(r.keep-1) * r.size)
+	for len(r.buckets) > 0 && r.buckets[0].start.Before(oldest) {
+		r.buckets = r.buckets[1:]
+	}
+	return b
+}
+
+// Kinds of statistics.
+const (
+	Domains = "domains"
+	Clients = "clients"
+)
+
+func (b *bucket) names(kind string) map[string]*Count {
+	if kind == Clients {
+		return b.clients
+	}
+	return b.domains
+}
+
+func (s *Stats) resolution(name string) *resolution {
+	for _, r := range s.resolutions {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Item is the count of a domain or client.
+type Item struct {
+	Name string
+	Count
+}
+
+// Point is the count of a bucket.
+type Point struct {
+	Time time.Time
+	Count
+}
+
+// Top returns the domains or clients (depending on kind) with the most
+// queries, in the buckets of the given resolution which start at or after
+// since, most queries first. It also returns how many there are in total,
+// for pagination.
+func (s *Stats) Top(kind, res string, since time.Time, offset, limit int) ([]Item, int) {
+	s.mu.Lock()
+	totals := map[string]*Count{}
+	if r := s.resolution(res); r != nil {
+		for _, b := range r.buckets {
+			if b.start.Before(since) {
+				continue
+			}
+			for name, c := range b.names(kind) {
+				if totals[name] == nil {
+					totals[name] = &Count{}
+				}
+				totals[name].add(*c)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	items := make([]Item, 0, len(totals))
+	for name, c := range totals {
+		items = append(items, Item{Name: name, Count: *c})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Queries != items[j].Queries {
+			return items[i].Queries > items[j].Queries
+		}
+		return items[i].Name < items[j].Name
+	})
+
+	total := len(items)
+	if offset > len(items) {
+		offset = len(items)
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items, total
+}
+
+// Series returns the count of the given domain or client (depending on
+// kind) in each bucket of the given resolution which starts at or after
+// since, oldest first. The buckets without queries for it have a count of
+// 0 (periods without any queries have no bucket at all).
+func (s *Stats) Series(kind, res, name string, since time.Time) []Point {
+	if kind == Domains {
+		name = util.CanonicalName(name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	points := []Point{}
+	if r := s.resolution(res); r != nil {
+		for _, b := range r.buckets {
+			if b.start.Before(since) {
+				continue
+			}
+			p := Point{Time: b.start}
+			if c := b.names(kind)[name]; c != nil {
+				p.Count = *c
+			}
+			points = append(points, p)
+		}
+	}
+	return points
+}
@@ -0,0 +1,144 @@
+package querystats
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+)
+
+func newTestStats() (*Stats, *testutil.FakeClock) {
+	s := New()
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.clock = clock
+	return s, clock
+}
+
+func TestTop(t *testing.T) {
+	s, clock := newTestStats()
+	s.Add("10.0.0.1", "a.example.", false)
+	s.Add("10.0.0.1", "A.Example.", true)
+	s.Add("10.0.0.2", "b.example.", false)
+	clock.Advance(time.Hour)
+	s.Add("10.0.0.2", "b.example.", false)
+	s.Add("10.0.0.2", "b.example.", false)
+
+	items, total := s.Top(Domains, "1h", time.Time{}, 0, 10)
+	if total != 2 || len(items) != 2 {
+		t.Fatalf("unexpected items: %v (%d)", items, total)
+	}
+	if items[0].Name != "b.example." || items[0].Queries != 3 ||
+		items[1].Name != "a.example." || items[1].Queries != 2 ||
+		items[1].Failed != 1 {
+		t.Errorf("unexpected items: %v", items)
+	}
+
+	// Only the recent buckets.
+	items, _ = s.Top(Domains, "1h", clock.Now(), 0, 10)
+	if len(items) != 1 || items[0].Queries != 2 {
+		t.Errorf("unexpected recent items: %v", items)
+	}
+
+	// Pagination.
+	items, total = s.Top(Clients, "1d", time.Time{}, 1, 1)
+	if total != 2 || len(items) != 1 || items[0].Name != "10.0.0.1" {
+		t.Errorf("unexpected page: %v (%d)", items, total)
+	}
+	if items, _ = s.Top(Clients, "1d", time.Time{}, 5, 1); len(items) != 0 {
+		t.Errorf("unexpected page past the end: %v", items)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	s, clock := newTestStats()
+	for i := 0; i < 3; i++ {
+		s.Add("10.0.0.1", "a.example.", false)
+		s.Add("10.0.0.2", "b.example.", false)
+		clock.Advance(5 * time.Minute)
+	}
+	s.Add("10.0.0.2", "b.example.", false)
+
+	points := s.Series(Domains, "5m", "A.example", time.Time{})
+	if len(points) != 4 {
+		t.Fatalf("unexpected points: %v", points)
+	}
+	for i, p := range points[:3] {
+		if p.Queries != 1 || !p.Time.Equal(points[0].Time.Add(
+			time.Duration(i)*5*time.Minute)) {
+			t.Errorf("unexpected point %d: %v", i, p)
+		}
+	}
+	if points[3].Queries != 0 {
+		t.Errorf("expected an empty point, got %v", points[3])
+	}
+
+	// Old buckets are dropped.
+	clock.Advance(25 * time.Hour)
+	s.Add("10.0.0.1", "a.example.", false)
+	points = s.Series(Domains, "5m", "a.example.", time.Time{})
+	if len(points) != 1 || !points[0].Time.Equal(clock.Now().Truncate(5*time.Minute)) {
+		t.Errorf("unexpected points: %v", points)
+	}
+}
+
+func TestMaxNames(t *testing.T) {
+	s, _ := newTestStats()
+	s.resolutions[0].maxNames = 2
+	for _, name := range []string{"a.", "b.", "c.", "c.", "c.", "d."} {
+		s.Add("10.0.0.1", name, false)
+	}
+
+	// c. shows up once the bucket is full, but has the most queries, so it
+	// replaces a.; then d. replaces b., which has the fewest.
+	items, _ := s.Top(Domains, "5m", time.Time{}, 0, 10)
+	counts := map[string]Count{}
+	for _, it := range items {
+		counts[it.Name] = it.Count
+	}
+	if len(counts) != 2 ||
+		counts["c."] != (Count{Queries: 4, Overcount: 1}) ||
+		counts["d."] != (Count{Queries: 2, Overcount: 1}) {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, _ := newTestStats()
+	s.Add("10.0.0.1", "a.example.", false)
+	h := s.handler(Domains)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?bucket=5m&range=1h&limit=1", nil))
+	top := TopResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &top); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, w.Body.String())
+	}
+	if top.Bucket != "5m" || top.Total != 1 || len(top.Items) != 1 ||
+		top.Items[0].Name != "a.example." {
+		t.Errorf("unexpected reply: %+v", top)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?name=a.example.", nil))
+	series := SeriesResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &series); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, w.Body.String())
+	}
+	if series.Bucket != "1h" || len(series.Points) != 1 ||
+		series.Points[0].Queries != 1 {
+		t.Errorf("unexpected reply: %+v", series)
+	}
+
+	for _, q := range []string{
+		"bucket=1w", "range=soon", "range=-1h", "offset=-1", "limit=0",
+		"limit=5000",
+	} {
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?"+q, nil))
+		if w.Code != 400 {
+			t.Errorf("%q: expected 400, got %d", q, w.Code)
+		}
+	}
+}
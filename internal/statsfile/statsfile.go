@@ -0,0 +1,181 @@
+// Package statsfile persists counters across restarts, so the statistics
+// don't go back to zero every time the daemon is restarted or upgraded.
+//
+// The counters are expvar variables: expvar.Int, or expvar.Map of
+// expvar.Int (like the matches by rule). They are saved to a file
+// periodically, and on startup the saved values are added to the current
+// ones. Only counters should be persisted: gauges (like the number of rules
+// loaded) would be wrong after the restart.
+package statsfile
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+)
+
+// Store saves and loads the given counters to a file.
+type Store struct {
+	path  string
+	names []string
+
+	// Protects stopped, and serializes the saves.
+	mu      sync.Mutex
+	stopped bool
+
+	// Clock, so tests can control time.
+	clock util.Clock
+}
+
+// file is the contents of the file.
+type file struct {
+	// When it was saved, for information only.
+	Saved time.Time
+
+	// Values, by variable name: a number for expvar.Int, and an object
+	// for expvar.Map.
+	Vars map[string]json.RawMessage
+}
+
+// New returns a Store to persist the given variables in the file at path.
+func New(path string, names []string) *Store {
+	return &Store{
+		path:  path,
+		names: names,
+		clock: util.RealClock,
+	}
+}
+
+// Check returns an error if any of the variables can't be persisted: either
+// it doesn't exist, or it's not a counter we know how to handle.
+func Check(names []string) error {
+	for _, name := range names {
+		switch v := expvar.Get(name).(type) {
+		case *expvar.Int:
+		case *expvar.Map:
+		case nil:
+			return fmt.Errorf("unknown variable %q", name)
+		default:
+			return fmt.Errorf("variable %q is a %T, not a counter", name, v)
+		}
+	}
+	return nil
+}
+
+// Load the saved values, and add them to the variables. A missing file is
+// not an error, as it's what we get the first time.
+func (s *Store) Load() error {
+	buf, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f := &file{}
+	if err := json.Unmarshal(buf, f); err != nil {
+		return fmt.Errorf("error parsing %q: %v", s.path, err)
+	}
+
+	for _, name := range s.names {
+		raw, ok := f.Vars[name]
+		if !ok {
+			continue
+		}
+		switch v := expvar.Get(name).(type) {
+		case *expvar.Int:
+			var n int64
+			if err := json.Unmarshal(raw, &n); err != nil {
+				return fmt.Errorf("%q: %v", name, err)
+			}
+			v.Add(n)
+		case *expvar.Map:
+			m := map[string]int64{}
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return fmt.Errorf("%q: %v", name, err)
+			}
+			for k, n := range m {
+				v.Add(k, n)
+			}
+		}
+	}
+	return nil
+}
+
+// Save the current values to the file. It's written to a temporary file
+// first, and then renamed, so a crash doesn't leave a truncated one behind.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+
+	f := &file{
+		Saved: s.clock.Now(),
+		Vars:  map[string]json.RawMessage{},
+	}
+	for _, name := range s.names {
+		var raw []byte
+		switch v := expvar.Get(name).(type) {
+		case *expvar.Int:
+			raw, _ = json.Marshal(v.Value())
+		case *expvar.Map:
+			m := map[string]int64{}
+			v.Do(func(kv expvar.KeyValue) {
+				if i, ok := kv.Value.(*expvar.Int); ok {
+					m[kv.Key] = i.Value()
+				}
+			})
+			raw, _ = json.Marshal(m)
+		default:
+			continue
+		}
+		f.Vars[name] = raw
+	}
+
+	buf, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".stats-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Run saves the values every period. It never returns.
+func (s *Store) Run(period time.Duration) {
+	s.clock.Every(period, func() {
+		if err := s.Save(); err != nil {
+			log.Errorf("Error saving the statistics: %v", err)
+		}
+	})
+}
+
+// Stop saving, because another process took over the file (like after a
+// graceful upgrade, where the new process loaded the values we just saved,
+// and will keep saving them along with its own).
+func (s *Store) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+}
@@ -0,0 +1,109 @@
+package statsfile
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+)
+
+var (
+	testInt = expvar.NewInt("statsfile-test-int")
+	testMap = expvar.NewMap("statsfile-test-map")
+	_       = expvar.NewString("statsfile-test-string")
+)
+
+var testNames = []string{"statsfile-test-int", "statsfile-test-map"}
+
+func TestCheck(t *testing.T) {
+	if err := Check(testNames); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"statsfile-test-string", "doesnotexist"} {
+		if err := Check([]string{name}); err == nil {
+			t.Errorf("%q: no error", name)
+		}
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	s := New(path, testNames)
+	s.clock = testutil.NewFakeClock(time.Now())
+
+	// Nothing saved yet.
+	if err := s.Load(); err != nil {
+		t.Fatalf("error loading a missing file: %v", err)
+	}
+
+	testInt.Set(10)
+	testMap.Add("a", 3)
+	testMap.Add("b", 4)
+	if err := s.Save(); err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+
+	// After a restart, the counters start over, and the saved values are
+	// added to them.
+	testInt.Set(1)
+	testMap.Init()
+	testMap.Add("a", 1)
+	if err := s.Load(); err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	if v := testInt.Value(); v != 11 {
+		t.Errorf("expected int 11, got %d", v)
+	}
+	for k, expected := range map[string]int64{"a": 4, "b": 4} {
+		if v := testMap.Get(k).(*expvar.Int).Value(); v != expected {
+			t.Errorf("map[%q]: expected %d, got %d", k, expected, v)
+		}
+	}
+
+	// Once stopped, the file is left alone.
+	s.Stop()
+	testInt.Set(100)
+	if err := s.Save(); err != nil {
+		t.Fatalf("error saving after stopping: %v", err)
+	}
+	testInt.Set(0)
+	s.Load()
+	if v := testInt.Value(); v != 10 {
+		t.Errorf("saved after stopping: expected 10, got %d", v)
+	}
+
+	// No leftover temporary files.
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("unexpected files: %v", files)
+	}
+}
+
+func TestLoadBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	for _, contents := range []string{
+		"not json",
+		`{"Vars": {"statsfile-test-int": "text"}}`,
+		`{"Vars": {"statsfile-test-map": 3}}`,
+	} {
+		ioutil.WriteFile(path, []byte(contents), 0600)
+		if err := New(path, testNames).Load(); err == nil {
+			t.Errorf("%q: no error", contents)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package syslog implements sending logs to a remote syslog server, in the
+// RFC 5424 format, over UDP (RFC 5426), TCP (RFC 6587) or TLS (RFC 5425).
+//
+// The standard library's log/syslog only speaks the older BSD format, and
+// can't use TLS, which many log collectors require.
+package syslog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+)
+
+// Constants that tune the connections, declared as variables so we can
+// tweak them for testing.
+var (
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 5 * time.Second
+
+	// Delay before retrying after a failure, doubled on each consecutive
+	// one.
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 5 * time.Minute
+
+	// How many messages to queue while the server is slow or down; once
+	// full, new messages are dropped.
+	queueSize = 1000
+)
+
+// Exported variables for statistics.
+var stats = struct {
+	// Messages dropped because the queue was full.
+	dropped *expvar.Int
+
+	// Failures to connect or send the messages.
+	errors *expvar.Int
+}{}
+
+func init() {
+	stats.dropped = expvar.NewInt("syslog-dropped")
+	stats.errors = expvar.NewInt("syslog-errors")
+}
+
+// Facility and severity we use for all the messages: daemon.info. The logs
+// don't carry their level once formatted, so we can't tell them apart.
+const priority = 3*8 + 6
+
+// Maximum size of a UDP message; longer ones get truncated. RFC 5426 says
+// receivers must take at least 480 bytes, and should take up to 2048.
+const maxUDPLen = 2048
+
+// Writer sends what's written to it to a remote syslog server, one message
+// per line.
+//
+// Writes never block: the messages are queued, and sent by a goroutine which
+// reconnects as needed (waiting longer after each consecutive failure). A
+// server that is slow or down only causes the messages to be dropped once
+// the queue is full.
+type Writer struct {
+	network string
+	addr    string
+	tlsConf *tls.Config
+
+	hostname string
+	tag      string
+	pid      int
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Formatted messages to send.
+	queue chan []byte
+
+	// Closed to stop the goroutine, which then closes stopped.
+	done    chan struct{}
+	stopped chan struct{}
+	once    *sync.Once
+
+	// Connection to the server, only used by the goroutine.
+	conn net.Conn
+}
+
+// ParseURL parses the server URL, in the form udp://host:port,
+// tcp://host:port or tls://host:port, and returns the network and address.
+func ParseURL(s string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("unknown scheme %q (expected udp, tcp"+
+			" or tls)", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", "", err
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// New returns a Writer for the server at the given URL (see ParseURL). The
+// tag is used as the application name. It doesn't connect until the first
+// write, and must be closed to stop sending.
+func New(serverURL, tag string) (*Writer, error) {
+	network, addr, err := ParseURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		network:  network,
+		addr:     addr,
+		hostname: "-",
+		tag:      tag,
+		pid:      os.Getpid(),
+		clock:    util.RealClock,
+		queue:    make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		once:     &sync.Once{},
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(addr)
+		w.tlsConf = &tls.Config{ServerName: host}
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		w.hostname = h
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues each line of p to be sent as a separate message. It doesn't
+// wait for them to be sent, and never fails: if the queue is full, the
+// messages are dropped.
+func (w *Writer) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		select {
+		case w.queue <- w.format(line):
+		default:
+			stats.dropped.Add(1)
+		}
+	}
+	return len(p), nil
+}
+
+// Close stops sending, and closes the connection to the server, if any. The
+// messages still queued get one chance to be sent.
+func (w *Writer) Close() error {
+	w.once.Do(func() { close(w.done) })
+	<-w.stopped
+	return nil
+}
+
+// run sends the queued messages, until the writer is closed.
+func (w *Writer) run() {
+	defer close(w.stopped)
+	defer w.disconnect()
+
+	delay := minRetryDelay
+	for {
+		var msg []byte
+		select {
+		case msg = <-w.queue:
+		case <-w.done:
+			w.flush()
+			return
+		}
+
+		// Retry until it's sent, as the error is most likely about the
+		// server, not this message. Meanwhile, the new ones are queued.
+		for w.send(msg) != nil {
+			stats.errors.Add(1)
+			select {
+			case <-time.After(delay):
+			case <-w.done:
+				return
+			}
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+		delay = minRetryDelay
+	}
+}
+
+// flush tries to send the queued messages, without retrying.
+func (w *Writer) flush() {
+	for {
+		select {
+		case msg := <-w.queue:
+			if err := w.send(msg); err != nil {
+				stats.errors.Add(1)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// disconnect closes the connection to the server, if any.
+func (w *Writer) disconnect() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// format the line as an RFC 5424 message, without any framing.
+func (w *Writer) format(line []byte) []byte {
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - ",
+		priority, w.clock.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, w.tag, w.pid)
+	return append([]byte(msg), line...)
+}
+
+// send the message, connecting or reconnecting if needed. Must only be
+// called from the goroutine.
+func (w *Writer) send(msg []byte) error {
+	if w.network == "udp" {
+		if len(msg) > maxUDPLen {
+			msg = msg[:maxUDPLen]
+		}
+	} else {
+		// Octet counting framing (RFC 6587 section 3.4.1), which works with
+		// messages that contain newlines too.
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+
+	// If the connection was broken, we only find out when writing, so retry
+	// once with a new one.
+	var err error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			if w.conn, err = w.dial(); err != nil {
+				return err
+			}
+		}
+
+		w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err = w.conn.Write(msg); err == nil {
+			return nil
+		}
+		w.disconnect()
+	}
+	return err
+}
+
+func (w *Writer) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if w.network == "tls" {
+		// Avoid returning a nil *tls.Conn as a non-nil net.Conn.
+		conn, err := tls.DialWithDialer(dialer, "tcp", w.addr, w.tlsConf)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return dialer.Dial(w.network, w.addr)
+}
+
+// String returns the server's URL, for logging.
+func (w *Writer) String() string {
+	return w.network + "://" + w.addr
+}
@@ -0,0 +1,190 @@
+package syslog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+)
+
+func TestParseURL(t *testing.T) {
+	cases := []struct {
+		url, network, addr string
+	}{
+		{"udp://localhost:514", "udp", "localhost:514"},
+		{"tcp://1.2.3.4:514", "tcp", "1.2.3.4:514"},
+		{"tls://[::1]:6514", "tls", "[::1]:6514"},
+	}
+	for _, c := range cases {
+		network, addr, err := ParseURL(c.url)
+		if err != nil || network != c.network || addr != c.addr {
+			t.Errorf("%q: got %q %q %v", c.url, network, addr, err)
+		}
+	}
+
+	for _, u := range []string{"http://localhost:514", "udp://localhost",
+		"localhost:514", "%"} {
+		if _, _, err := ParseURL(u); err == nil {
+			t.Errorf("%q: no error", u)
+		}
+	}
+}
+
+func newTestWriter(t *testing.T, url string) *Writer {
+	w, err := New(url, "dnss")
+	if err != nil {
+		t.Fatalf("error creating writer: %v", err)
+	}
+	w.hostname = "host"
+	w.clock = testutil.NewFakeClock(
+		time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC))
+	return w
+}
+
+func expectedMsg(msg string) string {
+	return fmt.Sprintf("<30>1 2020-01-02T03:04:05.000006Z host dnss %d - - %s",
+		os.Getpid(), msg)
+}
+
+func TestUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer pc.Close()
+
+	w := newTestWriter(t, "udp://"+pc.LocalAddr().String())
+	defer w.Close()
+
+	fmt.Fprintf(w, "first line\nsecond line\n")
+
+	buf := make([]byte, 4096)
+	for _, msg := range []string{"first line", "second line"} {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("error reading: %v", err)
+		}
+		if got := string(buf[:n]); got != expectedMsg(msg) {
+			t.Errorf("got %q, expected %q", got, expectedMsg(msg))
+		}
+	}
+}
+
+// readFramed reads an octet-counted message.
+func readFramed(r *bufio.Reader) (string, error) {
+	l, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(l, " "))
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func TestTCPReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+
+	w := newTestWriter(t, "tcp://"+l.Addr().String())
+	defer w.Close()
+
+	// The server reads one message per connection, and then closes it.
+	received := make(chan string)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			msg, err := readFramed(bufio.NewReader(conn))
+			if err != nil {
+				msg = "error: " + err.Error()
+			}
+			conn.Close()
+			received <- msg
+		}
+	}()
+
+	for _, msg := range []string{"one", "two", "three"} {
+		// Writes may succeed on a connection the server already closed, so
+		// retry until it gets there.
+		var got string
+		for i := 0; i < 10 && got == ""; i++ {
+			if _, err := w.Write([]byte(msg + "\n")); err != nil {
+				t.Fatalf("error writing: %v", err)
+			}
+			select {
+			case got = <-received:
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+		if got != expectedMsg(msg) {
+			t.Errorf("got %q, expected %q", got, expectedMsg(msg))
+		}
+	}
+}
+
+func TestServerDown(t *testing.T) {
+	defer func(min, max time.Duration, size int) {
+		minRetryDelay, maxRetryDelay, queueSize = min, max, size
+	}(minRetryDelay, maxRetryDelay, queueSize)
+	minRetryDelay = 10 * time.Millisecond
+	maxRetryDelay = 50 * time.Millisecond
+	queueSize = 2
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	w := newTestWriter(t, "tcp://"+addr)
+	defer w.Close()
+
+	// Writes don't wait for the server, and once the queue is full (with
+	// one more message being retried), the new messages are dropped.
+	dropped := stats.dropped.Value()
+	start := time.Now()
+	if _, err := w.Write([]byte("0\n1\n2\n3\n4\n")); err != nil {
+		t.Errorf("write failed: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("write took %v", d)
+	}
+	if d := stats.dropped.Value() - dropped; d < 2 {
+		t.Errorf("expected at least 2 dropped messages, got %d", d)
+	}
+
+	// Once the server is up, the queued messages get there.
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("error listening again: %v", err)
+	}
+	defer l.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := readFramed(bufio.NewReader(conn))
+	if err != nil || got != expectedMsg("0") {
+		t.Errorf("got %q, %v, expected %q", got, err, expectedMsg("0"))
+	}
+}
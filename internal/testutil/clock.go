@@ -0,0 +1,94 @@
+package testutil
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+)
+
+// FakeClock is a util.Clock for testing, whose time only moves when
+// Advance is called.
+type FakeClock struct {
+	mu    *sync.Mutex
+	cond  *sync.Cond
+	now   time.Time
+	tasks []*fakeTask
+}
+
+// fakeTask is a periodic task registered with FakeClock.Every.
+type fakeTask struct {
+	period time.Duration
+	next   time.Time
+	f      func()
+}
+
+// NewFakeClock returns a new FakeClock, set at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now, mu: &sync.Mutex{}}
+	c.cond = sync.NewCond(c.mu)
+	return c
+}
+
+// Now returns the current (fake) time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Every registers f to run every period, as the time is advanced. Like the
+// real one, it never returns, so it has to run in a goroutine (as the
+// resolvers' Maintain methods usually do); use WaitForTasks before advancing
+// the time to make sure it's registered.
+func (c *FakeClock) Every(period time.Duration, f func()) {
+	c.mu.Lock()
+	c.tasks = append(c.tasks, &fakeTask{
+		period: period,
+		next:   c.now.Add(period),
+		f:      f,
+	})
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	select {}
+}
+
+// WaitForTasks waits until at least n periodic tasks are registered.
+func (c *FakeClock) WaitForTasks(n int) {
+	c.mu.Lock()
+	for len(c.tasks) < n {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+}
+
+// Advance moves the time forward by d, running the periodic tasks that were
+// due, in order. When it returns, all of them have run to completion.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.tasks, func(i, j int) bool {
+			return c.tasks[i].next.Before(c.tasks[j].next)
+		})
+		if len(c.tasks) == 0 || c.tasks[0].next.After(end) {
+			break
+		}
+
+		t := c.tasks[0]
+		c.now = t.next
+		t.next = t.next.Add(t.period)
+
+		// Run the task without the lock, as it will likely call Now.
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ util.Clock = &FakeClock{}
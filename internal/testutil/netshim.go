@@ -0,0 +1,336 @@
+package testutil
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// NetShim is a UDP and TCP proxy to a server, which injects latency, packet
+// loss and reordering (see NetConditions), to test the timeouts, retries and
+// failovers against something closer to a real network than localhost.
+//
+// It listens on the same port for UDP and TCP, so it can be used in place of
+// the server's address for both.
+type NetShim struct {
+	// Address to use instead of the server's.
+	Addr string
+
+	target string
+	udp    net.PacketConn
+	tcp    net.Listener
+
+	// Protects the fields below.
+	mu *sync.Mutex
+
+	conds NetConditions
+	rand  *rand.Rand
+
+	// UDP connections to the target, by client address.
+	sessions map[string]*net.UDPConn
+
+	// TCP connections, to close them when we are done.
+	conns []net.Conn
+
+	// Packets held back to be reordered, by direction.
+	held [2]*heldPacket
+
+	dropped, reordered int
+}
+
+// NetConditions of the network simulated by a NetShim. The zero value is a
+// perfect network.
+type NetConditions struct {
+	// Latency added to each packet, in each direction.
+	Latency time.Duration
+
+	// Maximum random latency on top of Latency; with it, UDP packets can
+	// overtake each other.
+	Jitter time.Duration
+
+	// Probability (0 to 1) of losing each UDP packet. TCP data is not lost,
+	// but delayed by RetransmitDelay, as it would be retransmitted.
+	Loss float64
+
+	// How long lost TCP data is delayed; 200ms if not set (the minimum
+	// retransmission timeout in Linux).
+	RetransmitDelay time.Duration
+
+	// Probability (0 to 1) of holding back each UDP packet to send it after
+	// the next one in the same direction (or after 100ms, if there is none).
+	Reorder float64
+}
+
+// Directions of the packets, to reorder them separately.
+const (
+	toServer = iota
+	toClient
+)
+
+// How long a packet is held back for reordering if no other comes.
+var netShimMaxHold = 100 * time.Millisecond
+
+type heldPacket struct {
+	b     []byte
+	write func([]byte)
+}
+
+// NewNetShim returns a new NetShim in front of the given server (host:port),
+// listening on localhost. It starts as a perfect network; use SetConditions
+// to make it worse.
+func NewNetShim(tb testing.TB, target string) *NetShim {
+	tb.Helper()
+	s := &NetShim{
+		target:   target,
+		mu:       &sync.Mutex{},
+		rand:     rand.New(rand.NewSource(1)),
+		sessions: map[string]*net.UDPConn{},
+	}
+
+	// Find a port that's free for both UDP and TCP.
+	var err error
+	for i := 0; i < 10; i++ {
+		s.tcp, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatalf("error listening on TCP: %v", err)
+		}
+		s.udp, err = net.ListenPacket("udp", s.tcp.Addr().String())
+		if err == nil {
+			break
+		}
+		s.tcp.Close()
+	}
+	if err != nil {
+		tb.Fatalf("error listening on UDP: %v", err)
+	}
+	s.Addr = s.tcp.Addr().String()
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+// SetConditions changes the conditions of the network, for the packets sent
+// from now on.
+func (s *NetShim) SetConditions(c NetConditions) {
+	s.mu.Lock()
+	s.conds = c
+	s.mu.Unlock()
+}
+
+// Dropped returns how many UDP packets were lost so far.
+func (s *NetShim) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Reordered returns how many UDP packets were held back so far.
+func (s *NetShim) Reordered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reordered
+}
+
+// Close the shim, and all the connections through it.
+func (s *NetShim) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.sessions {
+		c.Close()
+	}
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *NetShim) serveUDP() {
+	buf := make([]byte, 65536)
+	for {
+		n, client, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b := append([]byte(nil), buf[:n]...)
+
+		conn, err := s.session(client)
+		if err != nil {
+			continue
+		}
+		s.send(toServer, b, func(b []byte) { conn.Write(b) })
+	}
+}
+
+// session returns the connection to the target for the given client,
+// creating it if needed.
+func (s *NetShim) session(client net.Addr) (*net.UDPConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.sessions[client.String()]; ok {
+		return conn, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", s.target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.sessions[client.String()] = conn
+
+	// Replies from the target.
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			b := append([]byte(nil), buf[:n]...)
+			s.send(toClient, b, func(b []byte) { s.udp.WriteTo(b, client) })
+		}
+	}()
+	return conn, nil
+}
+
+// send the UDP packet in the given direction (via write), according to the
+// conditions.
+func (s *NetShim) send(dir int, b []byte, write func([]byte)) {
+	s.mu.Lock()
+	c := s.conds
+	if s.rand.Float64() < c.Loss {
+		s.dropped++
+		s.mu.Unlock()
+		return
+	}
+	delay := c.Latency
+	if c.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(c.Jitter)))
+	}
+	reorder := s.rand.Float64() < c.Reorder
+	s.mu.Unlock()
+
+	time.AfterFunc(delay, func() { s.deliver(dir, b, write, reorder) })
+}
+
+// deliver the UDP packet, unless it has to be held back; in that case, it's
+// delivered after the next one.
+func (s *NetShim) deliver(dir int, b []byte, write func([]byte), reorder bool) {
+	s.mu.Lock()
+	held := s.held[dir]
+	if reorder && held == nil {
+		h := &heldPacket{b, write}
+		s.held[dir] = h
+		s.reordered++
+		s.mu.Unlock()
+
+		time.AfterFunc(netShimMaxHold, func() {
+			s.mu.Lock()
+			stillHeld := s.held[dir] == h
+			if stillHeld {
+				s.held[dir] = nil
+			}
+			s.mu.Unlock()
+			if stillHeld {
+				h.write(h.b)
+			}
+		})
+		return
+	}
+	s.held[dir] = nil
+	s.mu.Unlock()
+
+	write(b)
+	if held != nil {
+		held.write(held.b)
+	}
+}
+
+func (s *NetShim) serveTCP() {
+	for {
+		client, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", s.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, client, server)
+		s.mu.Unlock()
+
+		go s.pipe(server, client)
+		go s.pipe(client, server)
+	}
+}
+
+// tcpChunk is data read from a TCP connection, to be written at the given
+// time.
+type tcpChunk struct {
+	b  []byte
+	at time.Time
+}
+
+// pipe copies the data from src to dst, delayed according to the conditions,
+// but in order.
+func (s *NetShim) pipe(dst, src net.Conn) {
+	chunks := make(chan tcpChunk, 1024)
+	go func() {
+		var err error
+		for c := range chunks {
+			// After an error, keep draining so the reader doesn't block.
+			if err == nil {
+				time.Sleep(time.Until(c.at))
+				_, err = dst.Write(c.b)
+			}
+		}
+		// Pass the end of the data along, if the connection supports it.
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}()
+	defer close(chunks)
+
+	var last time.Time
+	buf := make([]byte, 65536)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			c := s.conds
+			at := time.Now().Add(c.Latency)
+			if c.Jitter > 0 {
+				at = at.Add(time.Duration(s.rand.Int63n(int64(c.Jitter))))
+			}
+			if s.rand.Float64() < c.Loss {
+				if c.RetransmitDelay == 0 {
+					c.RetransmitDelay = 200 * time.Millisecond
+				}
+				at = at.Add(c.RetransmitDelay)
+			}
+			s.mu.Unlock()
+
+			// TCP delivers in order, so nothing overtakes the previous data.
+			if at.Before(last) {
+				at = last
+			}
+			last = at
+			chunks <- tcpChunk{append([]byte(nil), buf[:n]...), at}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package testutil
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpSink returns a UDP socket, and a channel with the packets it receives.
+func udpSink(t *testing.T) (net.PacketConn, chan string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	c := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				close(c)
+				return
+			}
+			c <- string(buf[:n])
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc, c
+}
+
+func receive(t *testing.T, c chan string) string {
+	t.Helper()
+	select {
+	case s := <-c:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a packet")
+	}
+	return ""
+}
+
+func TestNetShimUDP(t *testing.T) {
+	server, received := udpSink(t)
+	defer server.Close()
+	shim := NewNetShim(t, server.LocalAddr().String())
+	defer shim.Close()
+
+	client, err := net.Dial("udp", shim.Addr)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer client.Close()
+
+	// Perfect network: the packets go through, and the replies come back.
+	client.Write([]byte("hello"))
+	if got := receive(t, received); got != "hello" {
+		t.Errorf("server got %q", got)
+	}
+	buf := make([]byte, 1024)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("client got %q, %v", buf[:n], err)
+	}
+
+	// Latency, in both directions.
+	shim.SetConditions(NetConditions{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	client.Write([]byte("slow"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "slow" {
+		t.Errorf("client got %q, %v", buf[:n], err)
+	}
+	if rtt := time.Since(start); rtt < 100*time.Millisecond {
+		t.Errorf("round trip took %v, expected at least 100ms", rtt)
+	}
+	receive(t, received)
+
+	// Reordering: the first packet is held back, and goes after the second.
+	shim.SetConditions(NetConditions{Reorder: 1})
+	client.Write([]byte("first"))
+	time.Sleep(10 * time.Millisecond)
+	client.Write([]byte("second"))
+	if a, b := receive(t, received), receive(t, received); a != "second" || b != "first" {
+		t.Errorf("server got %q, %q", a, b)
+	}
+	if shim.Reordered() == 0 {
+		t.Errorf("no packets reordered")
+	}
+	for i := 0; i < 2; i++ {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(buf); err != nil {
+			t.Errorf("error reading the replies: %v", err)
+		}
+	}
+
+	// Loss.
+	shim.SetConditions(NetConditions{Loss: 1})
+	client.Write([]byte("lost"))
+	select {
+	case s := <-received:
+		t.Errorf("server got %q through a lossy network", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if shim.Dropped() != 1 {
+		t.Errorf("dropped %d packets, expected 1", shim.Dropped())
+	}
+}
+
+func TestNetShimTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			conn.Write([]byte(scanner.Text() + "\n"))
+		}
+	}()
+
+	shim := NewNetShim(t, ln.Addr().String())
+	defer shim.Close()
+
+	// TCP data is delayed, even when "lost", but it all arrives in order.
+	shim.SetConditions(NetConditions{
+		Latency:         20 * time.Millisecond,
+		Jitter:          20 * time.Millisecond,
+		Loss:            0.5,
+		RetransmitDelay: 50 * time.Millisecond,
+	})
+	conn, err := net.Dial("tcp", shim.Addr)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	lines := []string{"one", "two", "three", "four"}
+	for _, l := range lines {
+		conn.Write([]byte(l + "\n"))
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	for _, l := range lines {
+		if !scanner.Scan() || scanner.Text() != l {
+			t.Fatalf("expected %q, got %q (%v)", l, scanner.Text(), scanner.Err())
+		}
+	}
+	if rtt := time.Since(start); rtt < 40*time.Millisecond {
+		t.Errorf("round trip took %v, expected at least 40ms", rtt)
+	}
+}
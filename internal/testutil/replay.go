@@ -0,0 +1,187 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// recordGolden makes the replay transports record the interactions with the
+// real servers, instead of replaying them from the golden files.
+var recordGolden = flag.Bool("record_golden", false,
+	"record HTTP interactions against the real servers, and update the"+
+		" golden files")
+
+// Interaction is a single HTTP request and its response, as stored in the
+// golden files.
+type Interaction struct {
+	Method string
+	URL    string
+	Body   []byte `json:",omitempty"`
+
+	Status      int
+	ContentType string
+
+	// The response body is stored as text if it's valid UTF-8 (to make the
+	// golden files readable), and as binary otherwise.
+	RespText string `json:",omitempty"`
+	RespBody []byte `json:",omitempty"`
+}
+
+// ReplayTransport is an http.RoundTripper which replays the responses stored
+// in a golden file, so tests can use the real servers' replies without
+// network access.
+//
+// If the -record_golden flag is given, it issues the requests to the real
+// servers instead, and Save writes them to the golden file.
+type ReplayTransport struct {
+	tb   testing.TB
+	file string
+
+	mu           sync.Mutex
+	interactions []*Interaction
+}
+
+// NewReplayTransport creates a new ReplayTransport for the given golden file.
+func NewReplayTransport(tb testing.TB, file string) *ReplayTransport {
+	t := &ReplayTransport{tb: tb, file: file}
+	if *recordGolden {
+		return t
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		tb.Fatalf("Error reading golden file: %v", err)
+	}
+	if err := json.Unmarshal(buf, &t.interactions); err != nil {
+		tb.Fatalf("Error parsing golden file %q: %v", file, err)
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if *recordGolden {
+		return t.record(req, body)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, i := range t.interactions {
+		if i.Method == req.Method && i.URL == req.URL.String() &&
+			bytes.Equal(withoutID(i.Body), withoutID(body)) {
+			return i.response(req, body), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no recorded response for %s %s (%q)",
+		req.Method, req.URL, body)
+}
+
+func (t *ReplayTransport) record(req *http.Request, body []byte) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Interaction{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		Body:        body,
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if utf8.Valid(respBody) {
+		i.RespText = string(respBody)
+	} else {
+		i.RespBody = respBody
+	}
+
+	t.mu.Lock()
+	t.interactions = append(t.interactions, i)
+	t.mu.Unlock()
+
+	return i.response(req, body), nil
+}
+
+// Save the recorded interactions to the golden file. It does nothing when
+// replaying.
+func (t *ReplayTransport) Save() {
+	if !*recordGolden {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buf, err := json.MarshalIndent(t.interactions, "", "  ")
+	if err != nil {
+		t.tb.Fatalf("Error marshalling interactions: %v", err)
+	}
+	if err := ioutil.WriteFile(t.file, append(buf, '\n'), 0664); err != nil {
+		t.tb.Fatalf("Error writing golden file: %v", err)
+	}
+}
+
+// response builds the HTTP response for the given request.
+func (i *Interaction) response(req *http.Request, body []byte) *http.Response {
+	respBody := i.RespBody
+	if i.RespText != "" {
+		respBody = []byte(i.RespText)
+	}
+	if i.ContentType == "application/dns-message" && len(body) >= 2 &&
+		len(respBody) >= 2 {
+		// DNS messages have random IDs, so the recorded ones won't match;
+		// make the response's ID match the request's.
+		respBody = append([]byte{body[0], body[1]}, respBody[2:]...)
+	}
+
+	header := http.Header{}
+	if i.ContentType != "" {
+		header.Set("Content-Type", i.ContentType)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Status, http.StatusText(i.Status)),
+		StatusCode:    i.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}
+}
+
+// withoutID returns the given request body with the first two bytes zeroed,
+// so we can compare DNS messages ignoring their (random) IDs. Bodies too
+// short to be DNS messages are returned as-is.
+func withoutID(body []byte) []byte {
+	if len(body) < 12 {
+		return body
+	}
+	return append([]byte{0, 0}, body[2:]...)
+}
@@ -64,6 +64,23 @@ func WaitForHTTPServer(addr string) error {
 	return fmt.Errorf("timed out")
 }
 
+// WaitForUnixSocket waits 5 seconds for a server to listen on the unix
+// socket at the given path, and returns an error if it fails to do so.
+func WaitForUnixSocket(path string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	tick := time.Tick(10 * time.Millisecond)
+
+	for (<-tick).Before(deadline) {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("timed out")
+}
+
 // GetFreePort returns a free TCP port. This is hacky and not race-free, but
 // it works well enough for testing purposes.
 func GetFreePort() string {
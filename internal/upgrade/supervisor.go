@@ -0,0 +1,56 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Function to get our PID, so tests can fake it.
+var getpid = os.Getpid
+
+// Supported returns an error if our exit at the end of an upgrade would
+// stop the service, instead of leaving the new process running.
+//
+// That's the case if we are PID 1 (like the only process of a container),
+// as the new process would be killed with us; and if we run as a systemd
+// service without a notification socket (NotifyAccess=main in the unit, or
+// Type=notify), as we can't tell systemd the new process is the main one
+// now, and it would stop the service when we exit.
+func Supported() error {
+	if getpid() == 1 {
+		return errors.New("we are PID 1 (the init of a container?)," +
+			" the new process would be killed when we exit")
+	}
+	if os.Getenv("INVOCATION_ID") != "" && os.Getenv("NOTIFY_SOCKET") == "" {
+		return errors.New("running under systemd without a notification" +
+			" socket, the service would be stopped when we exit;" +
+			" set NotifyAccess=main in the unit")
+	}
+	return nil
+}
+
+// notifyMainPID tells systemd (if we run under it) that pid is the main
+// process of the service now, see sd_notify(3).
+func notifyMainPID(pid int) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Paths starting with "@" are in the abstract namespace, which the net
+	// package handles for us.
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("error notifying systemd: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(fmt.Sprintf("MAINPID=%d\n", pid)))
+	if err != nil {
+		return fmt.Errorf("error notifying systemd: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+// Package upgrade implements graceful binary upgrades: the running process
+// starts a new one (usually, a new version of the binary), passing it the
+// listening sockets; once the new process has taken all of them over, the
+// old one stops listening, waits for the requests in flight, and exits.
+//
+// That way, no query is dropped during the upgrade, as the sockets are
+// never closed: for some time both processes are listening on them, and
+// the kernel hands each query to one of them.
+//
+// The sockets must be created with the functions in this package, which
+// keep track of them, and take them over from the parent process when
+// they're inherited.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+
+	"github.com/miekg/dns"
+)
+
+// Environment variables used to pass the sockets to the new process: the
+// file descriptor of the pipe to tell the parent when it's ready, and the
+// keys (see socketKey) of the sockets, one per line, for each file
+// descriptor after the pipe.
+const (
+	envReadyFD = "DNSS_UPGRADE_READY_FD"
+	envSockets = "DNSS_UPGRADE_SOCKETS"
+)
+
+// Timeouts, declared as variables so we can tweak them for testing.
+var (
+	// How long to wait for the new process to take over the sockets.
+	ReadyTimeout = 30 * time.Second
+
+	// How long to wait for the requests in flight when draining.
+	DrainTimeout = 10 * time.Second
+)
+
+// Requests in flight, see Track. Only used atomically.
+var inflight int64
+
+// UDP readers which stopped reading because we are draining, see
+// DecorateReader. Only used atomically.
+var parked int64
+
+// Closed when we start draining, so the UDP readers stop reading.
+var drainingC = make(chan struct{})
+
+var (
+	// mu protects the variables below.
+	mu = &sync.Mutex{}
+
+	// Sockets we are listening on, by key, which we would pass to a new
+	// process.
+	sockets = map[string]socket{}
+
+	// Sockets inherited from the parent process, by key, which are not yet
+	// taken over.
+	inherited = map[string]*os.File{}
+
+	// Pipe to tell the parent we are ready, if we are the result of an
+	// upgrade.
+	readyPipe *os.File
+
+	// Whether we are draining, see Drain.
+	draining bool
+)
+
+// socket is a listening socket: a net.Listener or a net.PacketConn.
+type socket interface {
+	Close() error
+}
+
+// filer is implemented by the sockets that can give us a copy of their file
+// descriptor (which is all of the ones we create).
+type filer interface {
+	File() (*os.File, error)
+}
+
+func socketKey(network, addr string) string {
+	return network + "/" + addr
+}
+
+func init() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return
+	}
+	readyPipe = os.NewFile(uintptr(fd), "upgrade-ready")
+
+	if keys := os.Getenv(envSockets); keys != "" {
+		for i, key := range strings.Split(keys, "\n") {
+			inherited[key] = os.NewFile(uintptr(fd+1+i), key)
+		}
+	}
+
+	// Don't pass them on to our own children, if any.
+	os.Unsetenv(envReadyFD)
+	os.Unsetenv(envSockets)
+
+	maybeReady()
+}
+
+// maybeReady tells the parent process we are ready, once we have taken over
+// all the sockets. Must be called with mu held, or from init.
+func maybeReady() {
+	if readyPipe == nil || len(inherited) > 0 {
+		return
+	}
+	readyPipe.Write([]byte{1})
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// takeOver returns the inherited file for the given key, if any. Must be
+// called with mu held.
+func takeOver(key string) *os.File {
+	f, ok := inherited[key]
+	if ok {
+		delete(inherited, key)
+	}
+	return f
+}
+
+// register the socket as listening on the given key, and tell the parent if
+// we're ready. Must be called with mu held.
+func register(key string, s socket) {
+	sockets[key] = s
+	maybeReady()
+}
+
+// Listen is like net.Listen, but takes the listener over from the parent
+// process if it was inherited in an upgrade.
+func Listen(network, addr string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := socketKey(network, addr)
+	var l net.Listener
+	var err error
+	if f := takeOver(key); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	register(key, l)
+	return l, nil
+}
+
+// ListenPacket is like net.ListenPacket, but takes the connection over from
+// the parent process if it was inherited in an upgrade.
+func ListenPacket(network, addr string) (net.PacketConn, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := socketKey(network, addr)
+	var pc net.PacketConn
+	var err error
+	if f := takeOver(key); f != nil {
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		pc, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	register(key, pc)
+	return pc, nil
+}
+
+// ListenUnix is like util.ListenUnix, but takes the listener over from the
+// parent process if it was inherited in an upgrade.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := socketKey("unix", path)
+	var l net.Listener
+	var err error
+	if f := takeOver(key); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = util.ListenUnix(path, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	register(key, l)
+	return l, nil
+}
+
+// Track a request in flight, so Drain waits for it. Call the returned
+// function when it's done.
+func Track() func() {
+	atomic.AddInt64(&inflight, 1)
+	return func() { atomic.AddInt64(&inflight, -1) }
+}
+
+// DecorateReader is a dns.DecorateReader for the servers of the UDP sockets
+// created with ListenPacket. When we are draining, it stops reading queries
+// (blocking forever), so the new process gets all of them, and the socket
+// can be closed once the ones we read are answered.
+func DecorateReader(r dns.Reader) dns.Reader {
+	return drainReader{r}
+}
+
+type drainReader struct {
+	dns.Reader
+}
+
+func (r drainReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	select {
+	case <-drainingC:
+		park()
+	default:
+	}
+
+	m, s, err := r.Reader.ReadUDP(conn, timeout)
+	if err != nil {
+		// Drain interrupts the reads in progress with a deadline.
+		select {
+		case <-drainingC:
+			park()
+		default:
+		}
+	}
+	return m, s, err
+}
+
+func park() {
+	atomic.AddInt64(&parked, 1)
+	select {}
+}
+
+// Upgrade starts a new process, running the same binary with the same
+// arguments, and passes it our sockets. It returns once the new process has
+// taken all of them over, at which point the caller should Drain and exit.
+//
+// If the new process fails to do so (for example, because it exits, or its
+// configuration does not use the same sockets), it's killed, and an error
+// is returned. In that case the caller can just continue as usual.
+//
+// It also fails if our exit would stop the service (see Supported).
+func Upgrade() error {
+	if err := Supported(); err != nil {
+		return err
+	}
+
+	bin, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding our binary: %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	mu.Lock()
+	files := []*os.File{w}
+	keys := []string{}
+	for key, s := range sockets {
+		f, err := s.(filer).File()
+		if err != nil {
+			mu.Unlock()
+			closeAll(files)
+			return fmt.Errorf("error getting the file of %s: %v", key, err)
+		}
+		files = append(files, f)
+		keys = append(keys, key)
+	}
+	mu.Unlock()
+
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		// The extra files start at 3, after stdin, stdout and stderr.
+		envReadyFD+"=3",
+		envSockets+"="+strings.Join(keys, "\n"))
+
+	err = cmd.Start()
+
+	// Passing the files puts the sockets in blocking mode (they share it
+	// with our copies), which would keep reads and closes from being
+	// interrupted; put them back as the net package expects them.
+	for _, f := range files[1:] {
+		syscall.SetNonblock(int(f.Fd()), true)
+	}
+	closeAll(files)
+	if err != nil {
+		return fmt.Errorf("error starting %q: %v", bin, err)
+	}
+	log.Infof("Upgrade: started new process (pid %d)", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+		if err != nil {
+			// The new process closed the pipe without telling us it was
+			// ready, likely because it exited.
+			err = errors.New("new process exited before taking over")
+		}
+	case <-time.After(ReadyTimeout):
+		err = fmt.Errorf("new process did not take over the sockets"+
+			" after %v", ReadyTimeout)
+	}
+
+	if err == nil {
+		// Tell systemd the new process is the main one now, so it doesn't
+		// stop the service when we exit.
+		err = notifyMainPID(cmd.Process.Pid)
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// Drain stops listening, and waits (up to DrainTimeout) for the requests in
+// flight to finish.
+//
+// The stream listeners are closed right away, as the connections already
+// accepted are not affected. The UDP sockets are closed last, once the
+// queries we read have been answered, as otherwise the replies would be
+// lost: until then, we just stop reading from them (see DecorateReader).
+func Drain() {
+	mu.Lock()
+	if !draining {
+		close(drainingC)
+	}
+	draining = true
+	conns := []*net.UDPConn{}
+	for key, s := range sockets {
+		if uc, ok := s.(*net.UDPConn); ok {
+			// Interrupt the read in progress, if any.
+			uc.SetReadDeadline(time.Now())
+			conns = append(conns, uc)
+			continue
+		}
+
+		// Closing a unix listener removes the socket file by default, but
+		// the new process is still using it.
+		if ul, ok := s.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		s.Close()
+		delete(sockets, key)
+	}
+	mu.Unlock()
+
+	deadline := time.Now().Add(DrainTimeout)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt64(&parked) >= int64(len(conns)) &&
+			atomic.LoadInt64(&inflight) == 0 {
+			// The readers hand the queries over to a new goroutine, which
+			// may not have started tracking them yet.
+			time.Sleep(10 * time.Millisecond)
+			if atomic.LoadInt64(&inflight) == 0 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&inflight); n > 0 {
+		log.Infof("Upgrade: %d requests still in flight after %v",
+			n, DrainTimeout)
+	}
+
+	// Closing waits for the reads in progress, which could be stuck in the
+	// kernel if they started while the sockets were in blocking mode (see
+	// Upgrade). We are about to exit anyway, so don't wait for too long.
+	closed := make(chan bool)
+	go func() {
+		for _, uc := range conns {
+			uc.Close()
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		log.Infof("Upgrade: timed out closing the UDP sockets")
+	}
+
+	mu.Lock()
+	sockets = map[string]socket{}
+	mu.Unlock()
+}
+
+// Fatalf is like log.Fatalf, for the errors that end the serving loops.
+// If we are draining, those are expected (as we closed the sockets), so it
+// blocks instead, and lets the draining finish and exit.
+func Fatalf(format string, a ...interface{}) {
+	mu.Lock()
+	d := draining
+	mu.Unlock()
+
+	if d {
+		select {}
+	}
+	log.Fatalf(format, a...)
+}
@@ -0,0 +1,203 @@
+package upgrade
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The test binary is also the new process in the upgrades: we tell it how
+// to behave using this environment variable.
+const envTestMode = "UPGRADE_TEST_MODE"
+
+func TestMain(m *testing.M) {
+	if len(inherited) > 0 {
+		runChild(os.Getenv(envTestMode))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runChild is what the new process does, depending on the mode.
+func runChild(mode string) {
+	switch mode {
+	case "exit":
+		// Exit without taking over.
+		os.Exit(1)
+	case "hang":
+		// Don't take over, and don't exit either.
+		time.Sleep(time.Minute)
+	case "serve":
+		// Take over the sockets, and answer one connection.
+		keys := []string{}
+		for key := range inherited {
+			keys = append(keys, key)
+		}
+		var l net.Listener
+		for _, key := range keys {
+			var err error
+			if strings.HasPrefix(key, "udp/") {
+				_, err = ListenPacket("udp", strings.TrimPrefix(key, "udp/"))
+			} else {
+				l, err = Listen("tcp", strings.TrimPrefix(key, "tcp/"))
+			}
+			if err != nil {
+				os.Exit(2)
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(3)
+		}
+		conn.Write([]byte("child\n"))
+		conn.Close()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	ReadyTimeout = 500 * time.Millisecond
+	DrainTimeout = 500 * time.Millisecond
+
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := l.Addr().String()
+
+	pc, err := ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	// If the new process doesn't take over, the upgrade fails, and we can
+	// continue.
+	for _, mode := range []string{"exit", "hang"} {
+		os.Setenv(envTestMode, mode)
+		if err := Upgrade(); err == nil {
+			t.Errorf("%s: upgrade did not fail", mode)
+		}
+	}
+
+	os.Setenv(envTestMode, "serve")
+	if err := Upgrade(); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	// A UDP reader, which must stop when draining.
+	go func() {
+		r := DecorateReader(udpReader{})
+		for {
+			if _, _, err := r.ReadUDP(pc.(*net.UDPConn), time.Minute); err != nil {
+				break
+			}
+		}
+	}()
+
+	// Wait for a request in flight while draining.
+	done := Track()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+	Drain()
+	if n := atomic.LoadInt64(&inflight); n != 0 {
+		t.Errorf("drained with %d requests in flight", n)
+	}
+
+	// The UDP reader must have stopped, and only then the socket closed.
+	if n := atomic.LoadInt64(&parked); n != 1 {
+		t.Errorf("expected the UDP reader to be parked, got %d", n)
+	}
+	if _, err := pc.WriteTo([]byte("x"), pc.LocalAddr()); err == nil {
+		t.Errorf("UDP socket still open after draining")
+	}
+
+	// We don't listen anymore, so the new process gets the connection.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "child\n" {
+		t.Errorf("expected a reply from the new process, got %q (%v)",
+			reply, err)
+	}
+}
+
+// udpReader is a dns.Reader which just reads the packets.
+type udpReader struct{}
+
+func (udpReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	return nil, nil
+}
+
+func (udpReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	return buf[:n], nil, err
+}
+
+func TestSupported(t *testing.T) {
+	defer func(p string, n string) {
+		os.Setenv("INVOCATION_ID", p)
+		os.Setenv("NOTIFY_SOCKET", n)
+		getpid = os.Getpid
+	}(os.Getenv("INVOCATION_ID"), os.Getenv("NOTIFY_SOCKET"))
+
+	cases := []struct {
+		pid                int
+		invocation, notify string
+		ok                 bool
+	}{
+		{1234, "", "", true},
+		{1, "", "", false},
+		{1234, "abcd", "", false},
+		{1234, "abcd", "/run/systemd/notify", true},
+	}
+	for _, c := range cases {
+		getpid = func() int { return c.pid }
+		os.Setenv("INVOCATION_ID", c.invocation)
+		os.Setenv("NOTIFY_SOCKET", c.notify)
+		if err := Supported(); (err == nil) != c.ok {
+			t.Errorf("%+v: got %v", c, err)
+		}
+	}
+}
+
+func TestNotifyMainPID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/notify"
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer conn.Close()
+
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Setenv("NOTIFY_SOCKET", path)
+	if err := notifyMainPID(1234); err != nil {
+		t.Fatalf("error notifying: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "MAINPID=1234\n" {
+		t.Errorf("unexpected notification: %q (%v)", buf[:n], err)
+	}
+}
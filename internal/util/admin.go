@@ -0,0 +1,39 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// CheckAdminRequest checks that the request can change the server's state
+// (like the upstreams, or the profile in use), writing the error if it
+// can't. These come to the monitoring server, which has no authentication,
+// so they must be POSTs (which web pages can't send with an <img> or a
+// link), and not come from other sites: any page a user on the network
+// opens could send them otherwise.
+func CheckAdminRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "changes must be POSTed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	// Browsers tell us where the request comes from with Sec-Fetch-Site,
+	// and the older ones with Origin. Tools like curl send neither.
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		http.Error(w, "cross-origin requests are not allowed",
+			http.StatusForbidden)
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			http.Error(w, "cross-origin requests are not allowed",
+				http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
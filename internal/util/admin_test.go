@@ -0,0 +1,36 @@
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckAdminRequest(t *testing.T) {
+	cases := []struct {
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"POST", nil, 200},
+		{"GET", nil, 405},
+		{"POST", map[string]string{"Sec-Fetch-Site": "same-origin"}, 200},
+		{"POST", map[string]string{"Sec-Fetch-Site": "none"}, 200},
+		{"POST", map[string]string{"Sec-Fetch-Site": "cross-site"}, 403},
+		{"POST", map[string]string{"Sec-Fetch-Site": "same-site"}, 403},
+		{"POST", map[string]string{"Origin": "http://example.com"}, 200},
+		{"POST", map[string]string{"Origin": "http://evil.example"}, 403},
+		{"POST", map[string]string{"Origin": "null"}, 403},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "http://example.com/debug/x", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		ok := CheckAdminRequest(w, r)
+		if ok != (c.status == 200) || (!ok && w.Code != c.status) {
+			t.Errorf("%s %v: got %v %d, expected %d",
+				c.method, c.headers, ok, w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package util
+
+import "time"
+
+// Clock tells the time, and runs periodic tasks. Code that depends on time
+// passing (like cache TTLs, rate limits and periodic checks) uses it instead
+// of the time package, so tests can use a fake one and advance time
+// deterministically, instead of relying on sleeps (see testutil.FakeClock).
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Every calls f every period, until the end of time; it never returns.
+	// The calls are not concurrent: if f takes longer than the period,
+	// the next call is delayed.
+	Every(period time.Duration, f func())
+}
+
+// RealClock is the Clock of the real world.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Every(period time.Duration, f func()) {
+	for range time.Tick(period) {
+		f()
+	}
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ValidDSCP checks that the given value is a valid DSCP (Differentiated
+// Services Code Point), which is a 6-bit value.
+func ValidDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP value %d, must be in [0, 63]", dscp)
+	}
+	return nil
+}
+
+// SetDSCP marks the traffic sent over the given connection with the DSCP
+// value.
+//
+// The DSCP is stored in the upper 6 bits of the IPv4 TOS field and of the
+// IPv6 traffic class field. We try to set both, as dual-stack sockets may
+// carry either kind of traffic; it's only an error if both fail.
+func SetDSCP(c net.Conn, dscp int) error {
+	tos := dscp << 2
+	err4 := ipv4.NewConn(c).SetTOS(tos)
+	err6 := ipv6.NewConn(c).SetTrafficClass(tos)
+	if err4 != nil && err6 != nil {
+		return fmt.Errorf("error setting DSCP: %v / %v", err4, err6)
+	}
+	return nil
+}
+
+// SetPacketDSCP is like SetDSCP, but for packet connections.
+func SetPacketDSCP(c net.PacketConn, dscp int) error {
+	tos := dscp << 2
+	err4 := ipv4.NewPacketConn(c).SetTOS(tos)
+	err6 := ipv6.NewPacketConn(c).SetTrafficClass(tos)
+	if err4 != nil && err6 != nil {
+		return fmt.Errorf("error setting DSCP: %v / %v", err4, err6)
+	}
+	return nil
+}
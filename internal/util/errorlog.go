@@ -0,0 +1,108 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+// ErrorLog keeps the most recent errors (upstream failures, queries we
+// could not parse, refused queries), in memory, so transient problems can be
+// looked at after the fact, without having to run with verbose logging.
+// It's a ring buffer: once full, the new errors replace the oldest ones.
+type ErrorLog struct {
+	mu     sync.Mutex
+	errors []RecentError
+
+	// Where the next error goes, and how many there are.
+	next, count int
+
+	// Clock, so tests can control time.
+	clock Clock
+}
+
+// RecentError is an error in the ErrorLog.
+type RecentError struct {
+	Time time.Time
+
+	// Kind of error: "upstream" (failures), "rejected" (the upstream
+	// replied REFUSED or NOTIMP), "parse", or "refused" (we replied
+	// REFUSED).
+	Kind string
+
+	// The request ID and client, if known.
+	RequestID string `json:",omitempty"`
+	Client    string `json:",omitempty"`
+
+	// The question, as "name type", if there was one.
+	Question string `json:",omitempty"`
+
+	Error string
+}
+
+// RecentErrors is the log of recent errors used by the servers.
+var RecentErrors = NewErrorLog(100)
+
+// NewErrorLog returns a new ErrorLog that keeps the last size errors.
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{
+		errors: make([]RecentError, size),
+		clock:  RealClock,
+	}
+}
+
+// SetSize changes how many errors are kept (0 to keep none). The ones
+// already there are dropped.
+func (l *ErrorLog) SetSize(size int) {
+	l.mu.Lock()
+	l.errors = make([]RecentError, size)
+	l.next, l.count = 0, 0
+	l.mu.Unlock()
+}
+
+// Add an error of the given kind, for the query with the given questions
+// (can be nil). The request ID and the client come from the trace.
+func (l *ErrorLog) Add(tr trace.Trace, kind string, qs []dns.Question, format string, a ...interface{}) {
+	e := RecentError{
+		Time:      l.clock.Now(),
+		Kind:      kind,
+		RequestID: RequestID(tr),
+		Error:     fmt.Sprintf(format, a...),
+	}
+	if ip := Client(tr); ip != nil {
+		e.Client = ip.String()
+	}
+	if len(qs) > 0 {
+		e.Question = qs[0].Name + " " + dns.TypeToString[qs[0].Qtype]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errors) == 0 {
+		return
+	}
+	l.errors[l.next] = e
+	l.next = (l.next + 1) % len(l.errors)
+	if l.count < len(l.errors) {
+		l.count++
+	}
+}
+
+// Errors returns the errors in the log of the given kind (all of them, if
+// kind is ""), newest first.
+func (l *ErrorLog) Errors(kind string) []RecentError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	errs := []RecentError{}
+	for i := 1; i <= l.count; i++ {
+		e := l.errors[(l.next-i+len(l.errors))%len(l.errors)]
+		if kind == "" || e.Kind == kind {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+func TestErrorLog(t *testing.T) {
+	l := NewErrorLog(3)
+	tr := trace.New("test", "TestErrorLog")
+	defer tr.Finish()
+	tr = WithClient(WithRequestID(tr, "id1"), net.ParseIP("192.0.2.1"))
+
+	qs := []dns.Question{{Name: "example.com.", Qtype: dns.TypeAAAA}}
+	l.Add(tr, "upstream", qs, "error %d", 1)
+	errs := l.Errors("")
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	e := errs[0]
+	if e.Kind != "upstream" || e.RequestID != "id1" || e.Client != "192.0.2.1" ||
+		e.Question != "example.com. AAAA" || e.Error != "error 1" {
+		t.Errorf("unexpected error: %+v", e)
+	}
+
+	// Once full, the oldest ones go away; they are returned newest first.
+	for i := 2; i <= 5; i++ {
+		kind := "parse"
+		if i%2 == 0 {
+			kind = "refused"
+		}
+		l.Add(tr, kind, nil, "error %d", i)
+	}
+	errs = l.Errors("")
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", errs)
+	}
+	for i, e := range errs {
+		if expected := fmt.Sprintf("error %d", 5-i); e.Error != expected {
+			t.Errorf("%d: expected %q, got %q", i, expected, e.Error)
+		}
+	}
+
+	if errs := l.Errors("refused"); len(errs) != 1 || errs[0].Error != "error 4" {
+		t.Errorf("unexpected refused errors: %v", errs)
+	}
+
+	// With no room, nothing is kept.
+	l.SetSize(0)
+	l.Add(tr, "parse", nil, "error")
+	if errs := l.Errors(""); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
@@ -0,0 +1,129 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// UnicodeNames makes DisplayName show internationalized names in their
+// Unicode form, instead of punycode.
+var UnicodeNames = false
+
+// NormalizeName returns the canonical form of the given domain name, which is
+// what we use to match it against filters, routes and caches: fully
+// qualified, lowercase, and with the internationalized labels converted to
+// their ASCII (punycode) form, as per IDNA2008.
+//
+// Non-ASCII characters can be given directly, or escaped like the dns
+// library does when parsing them from the wire (e.g. "\195\177" for "ñ").
+func NormalizeName(name string) (string, error) {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	name = unescapeHighBytes(name)
+	if isASCII(name) {
+		return name, nil
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("invalid UTF-8 in %q", name)
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, l := range labels {
+		// Only convert the labels which need it, as the idna lookup rules
+		// are stricter than DNS' (e.g. they don't allow "_").
+		if isASCII(l) {
+			continue
+		}
+		a, err := idna.Lookup.ToASCII(l)
+		if err != nil {
+			return "", fmt.Errorf("invalid label %q: %v", l, err)
+		}
+		labels[i] = a
+	}
+	return strings.Join(labels, ".") + ".", nil
+}
+
+// CanonicalName returns the form of the given domain name to match it with:
+// all the names in the configuration (zones, filters, routes), and the query
+// names they are matched against, go through it, so "Corp.Example",
+// "corp.example." and their Unicode and punycode forms are all the same.
+//
+// It's the normalized name (see NormalizeName); if the name can't be
+// normalized (like when it has invalid UTF-8), it's just lowercased and fully
+// qualified, so it still matches the names like it.
+func CanonicalName(name string) string {
+	if n, err := NormalizeName(name); err == nil {
+		return n
+	}
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// DisplayName returns the given domain name in a form suitable for logs and
+// debug pages: if UnicodeNames is set, the punycode labels are shown in
+// their Unicode form; otherwise, the name is returned as-is.
+func DisplayName(name string) string {
+	if !UnicodeNames || !strings.Contains(strings.ToLower(name), "xn--") {
+		return name
+	}
+
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if !strings.HasPrefix(strings.ToLower(l), "xn--") {
+			continue
+		}
+		if u, err := idna.Display.ToUnicode(l); err == nil {
+			labels[i] = u
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// unescapeHighBytes replaces the "\DDD" escapes of non-ASCII bytes with the
+// bytes themselves. Other escapes are left alone, as they have special
+// meaning in names (like "\." for a dot within a label).
+func unescapeHighBytes(name string) string {
+	if !strings.Contains(name, `\`) {
+		return name
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) {
+			if v, err := strconv.Atoi(name[i+1 : i+4]); err == nil &&
+				v >= utf8.RuneSelf && v <= 255 {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		if name[i] == '\\' && i+1 < len(name) {
+			// Copy the escaped character too, so we don't mistake it for
+			// the start of another escape.
+			b.WriteByte(name[i])
+			i++
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
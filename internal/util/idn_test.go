@@ -0,0 +1,28 @@
+package util
+
+import "testing"
+
+func TestCanonicalName(t *testing.T) {
+	cases := []struct {
+		name, canonical string
+	}{
+		{"example.com", "example.com."},
+		{"Example.COM.", "example.com."},
+		{".", "."},
+		{"ñandú.com", "xn--and-6ma2c.com."},
+		{"ÑANDÚ.com.", "xn--and-6ma2c.com."},
+		{"XN--AND-6MA2C.com", "xn--and-6ma2c.com."},
+		{`\195\177and\195\186.com.`, "xn--and-6ma2c.com."},
+		{"_DMARC.Example.com", "_dmarc.example.com."},
+		{`A\.B.example.com`, `a\.b.example.com.`},
+
+		// Can't be normalized, but still canonical.
+		{`\255.COM`, `\255.com.`},
+	}
+	for _, c := range cases {
+		if got := CanonicalName(c.name); got != c.canonical {
+			t.Errorf("CanonicalName(%q) = %q, expected %q",
+				c.name, got, c.canonical)
+		}
+	}
+}
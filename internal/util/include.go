@@ -0,0 +1,277 @@
+package util
+
+// Include directives, so the configuration files (hosts, policy rules,
+// profiles, ...) can be split across files managed by different tools, like
+// configuration management fragments or per-service drop-ins:
+//
+//   include /etc/dnss/hosts.d/*.hosts
+//   include policy.d/
+//
+// The argument is a glob (see filepath.Match), or a directory to include all
+// the (non-hidden) files in it; relative paths are relative to the directory
+// of the file with the directive. The files are included in lexical order. A
+// glob that matches nothing is not an error, so drop-in directories can be
+// empty; a plain path that doesn't exist is.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Maximum nesting of the includes.
+const maxIncludeDepth = 10
+
+// LineScanner reads a file line by line, like bufio.Scanner, replacing the
+// include directives with the lines of the files they name.
+type LineScanner struct {
+	// Files being read, the current one last.
+	stack []*lineFile
+
+	// If we should follow the include directives.
+	includes bool
+
+	// Files and directories we looked at, for Files.
+	files []string
+
+	text string
+	pos  string
+	line int
+	err  error
+}
+
+// lineFile is a file being read.
+type lineFile struct {
+	// Path to the file ("" when reading from a reader), and if it's the
+	// one the scanner was created with.
+	path string
+	main bool
+
+	// Directory for the relative includes.
+	dir string
+
+	scanner *bufio.Scanner
+	closer  io.Closer
+	n       int
+
+	// Files to read after this one, from the same include directive.
+	next []string
+}
+
+// NewLineScanner returns a scanner for the given reader, which does not
+// follow the include directives.
+func NewLineScanner(r io.Reader) *LineScanner {
+	return &LineScanner{
+		stack: []*lineFile{{main: true, scanner: bufio.NewScanner(r)}},
+	}
+}
+
+// OpenLineScanner opens the file at path, and returns a scanner for it which
+// follows the include directives. It must be closed after use.
+func OpenLineScanner(path string) (*LineScanner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	return &LineScanner{
+		stack: []*lineFile{{
+			path:    path,
+			main:    true,
+			dir:     filepath.Dir(path),
+			scanner: bufio.NewScanner(f),
+			closer:  f,
+		}},
+		includes: true,
+		files:    []string{path},
+	}, nil
+}
+
+// Scan advances to the next line, which is then available via Text. It
+// returns false at the end of the input, or on errors (see Err).
+func (s *LineScanner) Scan() bool {
+	for len(s.stack) > 0 && s.err == nil {
+		f := s.stack[len(s.stack)-1]
+		if !f.scanner.Scan() {
+			s.err = f.scanner.Err()
+			s.pop()
+			continue
+		}
+		f.n++
+
+		if arg, ok := includeDirective(f.scanner.Text()); ok && s.includes {
+			if err := s.include(f.dir, arg); err != nil {
+				s.err = fmt.Errorf("%s: %v", f.pos(), err)
+			}
+			continue
+		}
+
+		s.text, s.pos, s.line = f.scanner.Text(), f.pos(), f.n
+		return true
+	}
+	return false
+}
+
+// pop finishes with the current file, and moves on to the next one from the
+// same include, if any.
+func (s *LineScanner) pop() {
+	f := s.stack[len(s.stack)-1]
+	if f.closer != nil {
+		f.closer.Close()
+	}
+	s.stack = s.stack[:len(s.stack)-1]
+
+	if len(f.next) > 0 && s.err == nil {
+		s.err = s.push(f.next[0], f.next[1:])
+	}
+}
+
+func (s *LineScanner) push(path string, next []string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	s.stack = append(s.stack, &lineFile{
+		path:    path,
+		dir:     filepath.Dir(path),
+		scanner: bufio.NewScanner(fd),
+		closer:  fd,
+		next:    next,
+	})
+	s.files = append(s.files, path)
+	return nil
+}
+
+// includeDirective returns the argument of the include directive, if the
+// line is one.
+func includeDirective(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "include" {
+		return "", false
+	}
+	return strings.Trim(fields[1], `"'`), true
+}
+
+// include the files given by arg, relative to dir.
+func (s *LineScanner) include(dir, arg string) error {
+	if len(s.stack) >= maxIncludeDepth {
+		return fmt.Errorf("includes nested too deeply")
+	}
+	if !filepath.IsAbs(arg) {
+		arg = filepath.Join(dir, arg)
+	}
+
+	var paths []string
+	if strings.ContainsAny(arg, `*?[\`) {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return fmt.Errorf("include %q: %v", arg, err)
+		}
+		// Watch the directory too, to notice new files.
+		s.files = append(s.files, filepath.Dir(arg))
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err == nil && fi.Mode().IsRegular() &&
+				!strings.HasPrefix(filepath.Base(m), ".") {
+				paths = append(paths, m)
+			}
+		}
+	} else {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return fmt.Errorf("include: %v", err)
+		}
+		if !fi.IsDir() {
+			paths = []string{arg}
+		} else {
+			entries, err := ioutil.ReadDir(arg)
+			if err != nil {
+				return fmt.Errorf("include: %v", err)
+			}
+			s.files = append(s.files, arg)
+			for _, e := range entries {
+				path := filepath.Join(arg, e.Name())
+				if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() &&
+					!strings.HasPrefix(e.Name(), ".") {
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		for _, f := range s.stack {
+			if p == f.path {
+				return fmt.Errorf("include %q: include loop", p)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return s.push(paths[0], paths[1:])
+}
+
+func (f *lineFile) pos() string {
+	if f.main {
+		return fmt.Sprintf("line %d", f.n)
+	}
+	return fmt.Sprintf("line %d of %q", f.n, f.path)
+}
+
+// Text returns the current line.
+func (s *LineScanner) Text() string {
+	return s.text
+}
+
+// Pos returns where the current line is, for the error messages: like "line
+// 3" for the main file, and "line 3 of "included.conf"" for the included
+// ones.
+func (s *LineScanner) Pos() string {
+	return s.pos
+}
+
+// Line returns the number of the current line, in its file.
+func (s *LineScanner) Line() int {
+	return s.line
+}
+
+// Err returns the first error found, if any.
+func (s *LineScanner) Err() error {
+	return s.err
+}
+
+// Files returns the files read so far, and the directories included, so the
+// callers can notice when they change (see FilesVersion).
+func (s *LineScanner) Files() []string {
+	return s.files
+}
+
+// Close the files still open.
+func (s *LineScanner) Close() {
+	for _, f := range s.stack {
+		if f.closer != nil {
+			f.closer.Close()
+		}
+	}
+	s.stack = nil
+}
+
+// FilesVersion returns a string which changes when any of the given files
+// (or directories) is modified, added or removed.
+func FilesVersion(paths []string) string {
+	v := ""
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			v += fmt.Sprintf("%s %d %d\n", p, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			v += p + " missing\n"
+		}
+	}
+	return v
+}
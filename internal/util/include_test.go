@@ -0,0 +1,129 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readLines(t *testing.T, path string) ([]string, error) {
+	t.Helper()
+	s, err := OpenLineScanner(path)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	lines := []string{}
+	for s.Scan() {
+		lines = append(lines, s.Text()+" @ "+s.Pos())
+	}
+	return lines, s.Err()
+}
+
+func TestLineScannerIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "include_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"main":        "one\ninclude d/*.conf\ntwo\ninclude dir/\ninclude 'empty/*'\n",
+		"d/a.conf":    "a\n",
+		"d/b.conf":    "b1\ninclude ../other\nb2\n",
+		"d/.hidden":   "hidden\n",
+		"d/c.txt":     "not matched\n",
+		"other":       "other\n",
+		"dir/1":       "dir1\n",
+		"dir/2":       "dir2\n",
+		"dir/.swp":    "hidden\n",
+		"empty/.keep": "",
+		"loop":        "include loop.d/\n",
+		"loop.d/x":    "include ../loop\n",
+		"missing":     "include nope\n",
+		"badpattern":  "include [\n",
+		"in-the/less": "include less\n",
+	})
+
+	lines, err := readLines(t, filepath.Join(dir, "main"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expected := []string{
+		"one @ line 1",
+		"a @ line 1 of \"" + filepath.Join(dir, "d/a.conf") + "\"",
+		"b1 @ line 1 of \"" + filepath.Join(dir, "d/b.conf") + "\"",
+		"other @ line 1 of \"" + filepath.Join(dir, "other") + "\"",
+		"b2 @ line 3 of \"" + filepath.Join(dir, "d/b.conf") + "\"",
+		"two @ line 3",
+		"dir1 @ line 1 of \"" + filepath.Join(dir, "dir/1") + "\"",
+		"dir2 @ line 1 of \"" + filepath.Join(dir, "dir/2") + "\"",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected lines:\n%s\nexpected:\n%s",
+			strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+
+	errors := map[string]string{
+		"loop":        "include loop",
+		"missing":     "no such file",
+		"badpattern":  "syntax error in pattern",
+		"in-the/less": "include loop",
+	}
+	for name, msg := range errors {
+		_, err := readLines(t, filepath.Join(dir, name))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error with %q, got %v", name, msg, err)
+		}
+	}
+}
+
+func TestLineScannerNoIncludes(t *testing.T) {
+	s := NewLineScanner(strings.NewReader("a\ninclude /etc/passwd\n"))
+	lines := []string{}
+	for s.Scan() {
+		lines = append(lines, s.Pos()+": "+s.Text())
+	}
+	if s.Err() != nil || strings.Join(lines, ", ") !=
+		"line 1: a, line 2: include /etc/passwd" {
+		t.Errorf("unexpected lines: %q (%v)", lines, s.Err())
+	}
+}
+
+func TestFilesVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "include_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f")
+	writeFiles(t, dir, map[string]string{"f": "1"})
+
+	v := FilesVersion([]string{path, dir})
+	if v != FilesVersion([]string{path, dir}) {
+		t.Errorf("version changed without changes")
+	}
+	writeFiles(t, dir, map[string]string{"f": "22"})
+	if v == FilesVersion([]string{path, dir}) {
+		t.Errorf("version did not change")
+	}
+	os.Remove(path)
+	if !strings.Contains(FilesVersion([]string{path}), "missing") {
+		t.Errorf("missing file not noticed")
+	}
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/log"
+)
+
+// How often to poll the network interfaces when we can't get notified of
+// changes, and how long to wait for changes to settle before reporting them.
+var (
+	netPollPeriod  = 10 * time.Second
+	netSettleDelay = 2 * time.Second
+)
+
+// WatchNetwork calls f every time the network configuration changes:
+// interfaces going up or down, addresses being added or removed, and (on
+// Linux) routes changing. Changes that come in quick succession are
+// coalesced into a single call.
+//
+// On Linux we get notified via netlink; elsewhere (or if that fails), we
+// poll the interfaces periodically.
+// It runs forever, so it should be called in its own goroutine.
+func WatchNetwork(f func()) {
+	events := make(chan struct{}, 1)
+	if err := watchNetlink(events); err != nil {
+		log.Infof("Can't get network change notifications (%v), polling", err)
+		go pollInterfaces(events)
+	}
+
+	for range events {
+		// Wait for things to settle, as a network change usually comes
+		// with a burst of events.
+		time.Sleep(netSettleDelay)
+		select {
+		case <-events:
+		default:
+		}
+		f()
+	}
+}
+
+// notify sends an event on the channel, unless there's one pending already.
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// pollInterfaces checks the network interfaces periodically, and sends an
+// event when they change.
+func pollInterfaces(events chan<- struct{}) {
+	prev := interfacesSnapshot()
+	for range time.Tick(netPollPeriod) {
+		snap := interfacesSnapshot()
+		if snap != prev {
+			notify(events)
+			prev = snap
+		}
+	}
+}
+
+// interfacesSnapshot returns a string describing the interfaces that are up,
+// and their addresses.
+func interfacesSnapshot() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	var lines []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, _ := iface.Addrs()
+		s := iface.Name
+		for _, addr := range addrs {
+			s += " " + addr.String()
+		}
+		lines = append(lines, s)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
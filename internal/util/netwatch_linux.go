@@ -0,0 +1,57 @@
+package util
+
+import (
+	"syscall"
+
+	"blitiri.com.ar/go/log"
+)
+
+// Netlink multicast groups (from linux/rtnetlink.h), which the syscall
+// package does not have.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// watchNetlink subscribes to link, address and route changes via netlink,
+// and sends an event for each notification we get.
+func watchNetlink(events chan<- struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr |
+			rtmgrpIPv4Route | rtmgrpIPv6Route,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 16*1024)
+		for {
+			_, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil && err != syscall.ENOBUFS {
+				// ENOBUFS means we missed some messages, which is fine as
+				// we only care about something having changed.
+				log.Errorf("Error reading netlink notifications: %v", err)
+				go pollInterfaces(events)
+				return
+			}
+			notify(events)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import "fmt"
+
+// watchNetlink is only supported on Linux.
+func watchNetlink(events chan<- struct{}) error {
+	return fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PortOwner is a socket bound to a port, and the process that owns it.
+type PortOwner struct {
+	// Protocol ("tcp", "udp", "tcp6" or "udp6") and local address.
+	Proto string
+	Addr  string
+
+	// Process owning the socket. They are unknown (0 and "") if we can't
+	// find it, usually because we don't have permission to look at it.
+	PID     int
+	Command string
+
+	// Kernel identifier of the socket, used to find the process.
+	inode string
+}
+
+func (o PortOwner) String() string {
+	s := fmt.Sprintf("%s %s", o.Proto, o.Addr)
+	if o.Command != "" {
+		s += fmt.Sprintf(" (%s, pid %d)", o.Command, o.PID)
+	}
+	return s
+}
+
+// Guidance for the usual programs that listen on the DNS port, by command
+// name (as in /proc/<pid>/comm, which is truncated to 15 characters).
+var portOwnerAdvice = map[string]string{
+	"systemd-resolve": "disable systemd-resolved's stub listener (set" +
+		" DNSStubListener=no in /etc/systemd/resolved.conf, and restart" +
+		" it), or run dnss with --takeover=resolved",
+	"dnsmasq": "disable dnsmasq's DNS server (set port=0 in its" +
+		" configuration, if you only need it for DHCP), or make one of" +
+		" them listen on a different address",
+	"named":   "stop BIND, or make one of them listen on a different address",
+	"unbound": "stop unbound, or make one of them listen on a different address",
+	"dnss":    "another dnss is already running",
+}
+
+// PortConflictHint returns a diagnostic for an error listening on the given
+// address, explaining who is using it and what to do about it, if that's the
+// problem (otherwise, it returns "").
+func PortConflictHint(addr string, err error) string {
+	if !isAddrInUse(err) {
+		return ""
+	}
+
+	_, p, perr := net.SplitHostPort(addr)
+	port, aerr := strconv.Atoi(p)
+	if perr != nil || aerr != nil {
+		return ""
+	}
+
+	owners, err := FindPortOwners(port)
+	if err != nil || len(owners) == 0 {
+		return fmt.Sprintf(
+			"; something else is listening on port %d (can't tell what: %v)",
+			port, err)
+	}
+
+	s := fmt.Sprintf("; port %d is in use by:", port)
+	advice := []string{}
+	seen := map[string]bool{}
+	for _, o := range owners {
+		s += "\n  " + o.String()
+		if a, ok := portOwnerAdvice[o.Command]; ok && !seen[a] {
+			seen[a] = true
+			advice = append(advice, a)
+		}
+	}
+	for _, a := range advice {
+		s += "\nTo fix it: " + a
+	}
+	return s
+}
+
+// isAddrInUse returns true if the error is because the address is already
+// in use.
+func isAddrInUse(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.EADDRINUSE
+}
+
+// parseProcNet parses a /proc/net/{tcp,udp}{,6} file, and returns the
+// sockets bound to the given port (for TCP, only the listening ones).
+func parseProcNet(r io.Reader, proto string, port int) ([]PortOwner, error) {
+	owners := []PortOwner{}
+	scanner := bufio.NewScanner(r)
+
+	// Skip the header.
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st ... uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		// TCP listening sockets have state 0A; for UDP, any bound socket
+		// counts.
+		if strings.HasPrefix(proto, "tcp") && fields[3] != "0A" {
+			continue
+		}
+
+		ip, p, err := parseProcAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if p != port {
+			continue
+		}
+
+		owners = append(owners, PortOwner{
+			Proto: proto,
+			Addr:  net.JoinHostPort(ip.String(), strconv.Itoa(p)),
+			inode: fields[9],
+		})
+	}
+	return owners, scanner.Err()
+}
+
+// parseProcAddr parses an address in /proc/net format: the IP in hex, as
+// 32-bit words in host (little endian) order, and the port in hex.
+func parseProcAddr(s string) (net.IP, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in %q", s)
+	}
+	return net.IP(b), int(port), nil
+}
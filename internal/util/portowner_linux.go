@@ -0,0 +1,63 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FindPortOwners returns the sockets bound to the given port (TCP or UDP,
+// over IPv4 or IPv6), and the processes that own them, as far as we can
+// tell from /proc.
+func FindPortOwners(port int) ([]PortOwner, error) {
+	owners := []PortOwner{}
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open("/proc/net/" + proto)
+		if err != nil {
+			// IPv6 may be disabled.
+			continue
+		}
+		found, err := parseProcNet(f, proto, port)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, found...)
+	}
+
+	if len(owners) > 0 {
+		findProcesses(owners)
+	}
+	return owners, nil
+}
+
+// findProcesses fills in the processes of the given sockets, by looking for
+// their inodes among the open files of all the processes. Without enough
+// permissions, we can only see our user's.
+func findProcesses(owners []PortOwner) {
+	// Keyed by the link of their file descriptors, "socket:[<inode>]".
+	byInode := map[string][]*PortOwner{}
+	for i := range owners {
+		link := "socket:[" + owners[i].inode + "]"
+		byInode[link] = append(byInode[link], &owners[i])
+	}
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || byInode[link] == nil {
+			continue
+		}
+
+		// fd is /proc/<pid>/fd/<n>.
+		pidDir := filepath.Dir(filepath.Dir(fd))
+		pid, _ := strconv.Atoi(filepath.Base(pidDir))
+		comm, _ := ioutil.ReadFile(filepath.Join(pidDir, "comm"))
+		for _, o := range byInode[link] {
+			o.PID = pid
+			o.Command = strings.TrimSpace(string(comm))
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import "fmt"
+
+// FindPortOwners is only supported on Linux.
+func FindPortOwners(port int) ([]PortOwner, error) {
+	return nil, fmt.Errorf("not supported on this platform")
+}
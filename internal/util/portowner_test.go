@@ -0,0 +1,67 @@
+package util
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// Excerpts from /proc/net/{tcp,udp6}.
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 3500007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000   991        0 21234 1 0000000000000000 100 0 0 10 5
+   1: 0100007F:0277 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 23456 1 0000000000000000 100 0 0 10 0
+   2: 0F02000A:0035 0100000A:C350 01 00000000:00000000 00:00000000 00000000     0        0 34567 1 0000000000000000 20 4 30 10 -1
+`
+
+const procNetUDP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  100: 00000000000000000000000001000000:0035 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000   110        0 45678 2 0000000000000000 0
+`
+
+func TestParseProcNet(t *testing.T) {
+	owners, err := parseProcNet(strings.NewReader(procNetTCP), "tcp", 53)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	// The connected socket on port 53 is not listening, so it doesn't count.
+	if len(owners) != 1 || owners[0].Addr != "127.0.0.53:53" ||
+		owners[0].inode != "21234" {
+		t.Errorf("unexpected owners: %+v", owners)
+	}
+
+	owners, err = parseProcNet(strings.NewReader(procNetUDP6), "udp6", 53)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if len(owners) != 1 || owners[0].Addr != "[::1]:53" {
+		t.Errorf("unexpected owners: %+v", owners)
+	}
+
+	_, err = parseProcNet(strings.NewReader(
+		"header\n 0: zz:0035 00000000:0000 0A 0 0 0 0 0 1234\n"), "tcp", 53)
+	if err == nil {
+		t.Errorf("invalid address parsed")
+	}
+}
+
+func TestPortConflictHint(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+
+	addr := l.Addr().String()
+	_, err = net.Listen("tcp", addr)
+	if err == nil {
+		t.Fatalf("listening twice on %s worked", addr)
+	}
+
+	hint := PortConflictHint(addr, err)
+	if !strings.Contains(hint, "in use by") && !strings.Contains(hint, "can't tell") {
+		t.Errorf("unexpected hint: %q", hint)
+	}
+
+	if hint := PortConflictHint(addr, net.UnknownNetworkError("x")); hint != "" {
+		t.Errorf("hint for an unrelated error: %q", hint)
+	}
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+
+	"golang.org/x/net/trace"
+)
+
+// RequestIDHeader is the HTTP header used to pass the request IDs along, so
+// the logs of the different components handling a query can be correlated.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the maximum length of the request IDs we accept from
+// others; longer ones are replaced with our own.
+const maxRequestIDLen = 64
+
+// NewRequestID returns a new random request ID.
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// ValidRequestID returns true if the given request ID (usually received from
+// a client) is safe to use: not too long, and with only printable ASCII
+// characters, so it can't mess up the logs.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// idTrace is a trace which carries the ID of the request it's for, the
+// address of the client that made it, and its context. The resolvers pass
+// the traces along, so this lets the ones deep in the chain (like the HTTPS
+// resolver) know them without changing their interface.
+type idTrace struct {
+	trace.Trace
+	id     string
+	client net.IP
+	ctx    context.Context
+}
+
+// withInfo returns a copy of the trace's information, to change it.
+func withInfo(tr trace.Trace) *idTrace {
+	if it, ok := tr.(*idTrace); ok {
+		c := *it
+		return &c
+	}
+	return &idTrace{Trace: tr}
+}
+
+// WithRequestID returns a trace which wraps the given one, and carries the
+// given request ID (see RequestID).
+func WithRequestID(tr trace.Trace, id string) trace.Trace {
+	it := withInfo(tr)
+	it.id = id
+	return it
+}
+
+// RequestID returns the request ID carried by the trace, or "" if there is
+// none.
+func RequestID(tr trace.Trace) string {
+	if it, ok := tr.(*idTrace); ok {
+		return it.id
+	}
+	return ""
+}
+
+// WithClient returns a trace which wraps the given one, and carries the
+// given client address (see Client).
+func WithClient(tr trace.Trace, client net.IP) trace.Trace {
+	it := withInfo(tr)
+	it.client = client
+	return it
+}
+
+// Client returns the client address carried by the trace, or nil if there
+// is none.
+func Client(tr trace.Trace) net.IP {
+	if it, ok := tr.(*idTrace); ok {
+		return it.client
+	}
+	return nil
+}
+
+// WithContext returns a trace which wraps the given one, and carries the
+// given context (see Context).
+func WithContext(tr trace.Trace, ctx context.Context) trace.Trace {
+	it := withInfo(tr)
+	it.ctx = ctx
+	return it
+}
+
+// Context returns the context carried by the trace, which is done when the
+// client abandons the query, so the work on it can be cancelled. If there is
+// none, it returns context.Background().
+func Context(tr trace.Trace) context.Context {
+	if it, ok := tr.(*idTrace); ok && it.ctx != nil {
+		return it.ctx
+	}
+	return context.Background()
+}
@@ -22,7 +22,7 @@ func TraceQuestion(tr trace.Trace, qs []dns.Question) {
 func questionsToString(qs []dns.Question) string {
 	var s []string
 	for _, q := range qs {
-		s = append(s, fmt.Sprintf("(%s %s %s)", q.Name,
+		s = append(s, fmt.Sprintf("(%s %s %s)", DisplayName(q.Name),
 			dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass]))
 	}
 	return "Q: " + strings.Join(s, " ; ")
@@ -40,9 +40,14 @@ func TraceAnswer(tr trace.Trace, m *dns.Msg) {
 	}
 }
 
-// TraceError adds the given error to the trace.
+// TraceError adds the given error to the trace, and logs it (with the
+// request ID, if the trace has one).
 func TraceError(tr trace.Trace, err error) {
-	log.Infof(err.Error())
+	if id := RequestID(tr); id != "" {
+		log.Infof("[%s] %v", id, err)
+	} else {
+		log.Infof(err.Error())
+	}
 	tr.LazyPrintf(err.Error())
 	tr.SetError()
 }
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"blitiri.com.ar/go/log"
+
+	"golang.org/x/net/trace"
+)
+
+// NameSet is a set of domains, safe for concurrent use. A name matches the
+// set if it, or any of its parent domains, is in it.
+type NameSet struct {
+	mu    sync.RWMutex
+	names map[string]bool
+	all   bool
+}
+
+// NewNameSet returns a new, empty NameSet.
+func NewNameSet() *NameSet {
+	return &NameSet{names: map[string]bool{}}
+}
+
+// Add the given domain to the set.
+func (s *NameSet) Add(name string) {
+	s.mu.Lock()
+	s.names[CanonicalName(name)] = true
+	s.mu.Unlock()
+}
+
+// Remove the given domain from the set.
+func (s *NameSet) Remove(name string) {
+	s.mu.Lock()
+	delete(s.names, CanonicalName(name))
+	s.mu.Unlock()
+}
+
+// SetAll makes the set match all names (or go back to matching only the
+// ones in it).
+func (s *NameSet) SetAll(all bool) {
+	s.mu.Lock()
+	s.all = all
+	s.mu.Unlock()
+}
+
+// Match returns true if the given name, or any of its parents, is in the set.
+func (s *NameSet) Match(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.all {
+		return true
+	}
+	if len(s.names) == 0 {
+		return false
+	}
+
+	name = CanonicalName(name)
+	for {
+		if s.names[name] {
+			return true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// String returns a human-readable representation of the set.
+func (s *NameSet) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.all {
+		return "(all names)"
+	}
+
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// TracedNames are the domains whose queries we trace in detail.
+var TracedNames = NewNameSet()
+
+// TraceDetail adds the given message to the trace, and also logs it, for
+// queries which are being traced in detail (see TracedNames).
+func TraceDetail(tr trace.Trace, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	tr.LazyPrintf("%s", msg)
+	log.Infof("trace: %s", msg)
+}
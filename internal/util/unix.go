@@ -0,0 +1,50 @@
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// ListenUnix listens on a unix stream socket at the given path, and sets its
+// permissions to the given mode.
+// If there's a stale socket file at the path (e.g. from a previous run that
+// did not exit cleanly), it gets removed first.
+//
+// The socket is created in a private directory next to the path, and moved
+// to it once it has the right permissions, so nobody can connect to it
+// before that.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".dnss-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	// The listener would remove the file at the temporary path on close,
+	// which is gone by then; leaving it behind matches what happens on exit,
+	// and it gets removed on the next run, as above.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
@@ -0,0 +1,227 @@
+// Package watchdog monitors the health of the process, for long-running
+// unattended deployments (like on a home router), where nobody is around to
+// notice a leak and restart it.
+//
+// It periodically checks the heap usage, the number of goroutines, and how
+// late the checks themselves run (as a sign of the process being stalled:
+// the Go runtime not scheduling us, or the machine swapping). When any of
+// them is over its limit, it sheds load (the servers drop the new queries,
+// see Shed) until things are back to normal, dumps diagnostics once, and, if
+// the problem persists, can restart the process.
+package watchdog
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+)
+
+// Constants that tune the watchdog, declared as variables so we can tweak
+// them for testing.
+var (
+	// How often to check.
+	checkPeriod = 5 * time.Second
+
+	// How many consecutive checks over the limits before restarting (if
+	// enabled).
+	restartAfter = 12
+)
+
+// Exported variables for statistics.
+var stats = struct {
+	// Heap in use, and number of goroutines, as of the last check.
+	heap       *expvar.Int
+	goroutines *expvar.Int
+
+	// How late the last check ran.
+	stall *expvar.Int
+
+	// Whether we are shedding load (0 or 1).
+	shedding *expvar.Int
+
+	// Number of times the limits were exceeded, by limit: "heap",
+	// "goroutines" and "stall".
+	exceeded *expvar.Map
+
+	// Requests dropped while shedding load.
+	shed *expvar.Int
+
+	// Number of restarts attempted.
+	restarts *expvar.Int
+}{}
+
+func init() {
+	stats.heap = expvar.NewInt("watchdog-heap-bytes")
+	stats.goroutines = expvar.NewInt("watchdog-goroutines")
+	stats.stall = expvar.NewInt("watchdog-stall-ms")
+	stats.shedding = expvar.NewInt("watchdog-shedding")
+	stats.exceeded = expvar.NewMap("watchdog-exceeded")
+	stats.shed = expvar.NewInt("watchdog-shed-requests")
+	stats.restarts = expvar.NewInt("watchdog-restarts")
+}
+
+// Whether we are shedding load. Only used atomically, see Shed.
+var shedding int32
+
+// Shed returns true if the caller should drop the new request, because the
+// process is overloaded. It's cheap, so it can be called for every query.
+func Shed() bool {
+	if atomic.LoadInt32(&shedding) == 0 {
+		return false
+	}
+	stats.shed.Add(1)
+	return true
+}
+
+// Watchdog checks the health of the process. The zero value for a limit
+// means there is no limit.
+type Watchdog struct {
+	// Maximum heap in use, in bytes.
+	MaxHeap uint64
+
+	// Maximum number of goroutines.
+	MaxGoroutines int
+
+	// Maximum delay of the periodic checks.
+	MaxStall time.Duration
+
+	// Directory to write the diagnostics to (goroutine and heap profiles)
+	// when the limits are exceeded. If empty, they are only logged.
+	DumpDir string
+
+	// Function to restart the process, called when the limits have been
+	// exceeded for a while. If nil, we never restart. If it returns, the
+	// restart failed, and we keep going.
+	Restart func()
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	// Time of the last check.
+	last time.Time
+
+	// Number of consecutive checks over the limits.
+	bad int
+}
+
+// New returns a new Watchdog, without limits.
+func New() *Watchdog {
+	return &Watchdog{
+		clock: util.RealClock,
+	}
+}
+
+// Enabled returns true if the watchdog has any limits.
+func (w *Watchdog) Enabled() bool {
+	return w.MaxHeap > 0 || w.MaxGoroutines > 0 || w.MaxStall > 0
+}
+
+// Function to read the heap in use and the number of goroutines, so tests
+// can fake it.
+var readUsage = func() (uint64, int) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse, runtime.NumGoroutine()
+}
+
+// Run the watchdog. It never returns.
+func (w *Watchdog) Run() {
+	log.Infof("Watchdog: heap %d MB, %d goroutines, stall %v (0 = no limit)",
+		w.MaxHeap>>20, w.MaxGoroutines, w.MaxStall)
+	w.last = w.clock.Now()
+	w.clock.Every(checkPeriod, w.check)
+}
+
+func (w *Watchdog) check() {
+	now := w.clock.Now()
+	stall := now.Sub(w.last) - checkPeriod
+	if stall < 0 {
+		stall = 0
+	}
+	w.last = now
+
+	heap, goroutines := readUsage()
+	stats.heap.Set(int64(heap))
+	stats.goroutines.Set(int64(goroutines))
+	stats.stall.Set(int64(stall / time.Millisecond))
+
+	problems := []string{}
+	if w.MaxHeap > 0 && heap > w.MaxHeap {
+		stats.exceeded.Add("heap", 1)
+		problems = append(problems, fmt.Sprintf("heap %d MB", heap>>20))
+	}
+	if w.MaxGoroutines > 0 && goroutines > w.MaxGoroutines {
+		stats.exceeded.Add("goroutines", 1)
+		problems = append(problems,
+			fmt.Sprintf("%d goroutines", goroutines))
+	}
+	if w.MaxStall > 0 && stall > w.MaxStall {
+		stats.exceeded.Add("stall", 1)
+		problems = append(problems, fmt.Sprintf("stalled %v", stall))
+	}
+
+	if len(problems) == 0 {
+		if w.bad > 0 {
+			log.Infof("Watchdog: back to normal, accepting queries")
+		}
+		w.bad = 0
+		atomic.StoreInt32(&shedding, 0)
+		stats.shedding.Set(0)
+		return
+	}
+
+	w.bad++
+	atomic.StoreInt32(&shedding, 1)
+	stats.shedding.Set(1)
+
+	if w.bad == 1 {
+		log.Errorf("Watchdog: over the limits (%s), shedding load",
+			strings.Join(problems, ", "))
+		w.dump(now)
+	}
+
+	if w.Restart != nil && w.bad >= restartAfter {
+		log.Errorf("Watchdog: over the limits for %v (%s), restarting",
+			time.Duration(w.bad)*checkPeriod, strings.Join(problems, ", "))
+		stats.restarts.Add(1)
+		w.bad = 0
+		w.Restart()
+	}
+}
+
+// dump the diagnostics: the goroutine and heap profiles, in DumpDir.
+func (w *Watchdog) dump(now time.Time) {
+	if w.DumpDir == "" {
+		return
+	}
+
+	for _, name := range []string{"goroutine", "heap"} {
+		path := filepath.Join(w.DumpDir, fmt.Sprintf("dnss-%s-%s.txt",
+			name, now.Format("20060102-150405")))
+		f, err := os.Create(path)
+		if err != nil {
+			log.Errorf("Watchdog: error dumping %s: %v", name, err)
+			continue
+		}
+		// Debug level 1 gives text, which is more useful than the
+		// compressed protocol buffers on a machine without the tools.
+		err = pprof.Lookup(name).WriteTo(f, 1)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Errorf("Watchdog: error dumping %s: %v", name, err)
+			continue
+		}
+		log.Infof("Watchdog: dumped %s to %q", name, path)
+	}
+}
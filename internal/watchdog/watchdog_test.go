@@ -0,0 +1,99 @@
+package watchdog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+)
+
+func TestWatchdog(t *testing.T) {
+	defer func(f func() (uint64, int)) { readUsage = f }(readUsage)
+	heap, goroutines := uint64(10<<20), 10
+	readUsage = func() (uint64, int) { return heap, goroutines }
+
+	dir, err := ioutil.TempDir("", "dnss_watchdog_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	restarts := 0
+	w := New()
+	w.clock = clock
+	w.MaxHeap = 100 << 20
+	w.MaxGoroutines = 100
+	w.MaxStall = time.Second
+	w.DumpDir = dir
+	w.Restart = func() { restarts++ }
+	if !w.Enabled() {
+		t.Fatalf("watchdog with limits is not enabled")
+	}
+	go w.Run()
+	clock.WaitForTasks(1)
+
+	clock.Advance(checkPeriod)
+	if Shed() {
+		t.Errorf("shedding load under the limits")
+	}
+
+	// Over the heap limit, we shed load and dump the diagnostics.
+	heap = 200 << 20
+	clock.Advance(checkPeriod)
+	if !Shed() {
+		t.Errorf("not shedding load over the heap limit")
+	}
+	dumps, _ := filepath.Glob(filepath.Join(dir, "dnss-*"))
+	if len(dumps) != 2 {
+		t.Errorf("expected 2 dumps, got %v", dumps)
+	}
+	if restarts != 0 {
+		t.Errorf("restarted too soon")
+	}
+
+	// If it persists, we restart.
+	clock.Advance(time.Duration(restartAfter-1) * checkPeriod)
+	if restarts != 1 {
+		t.Errorf("expected 1 restart, got %d", restarts)
+	}
+
+	// Once back to normal, we accept queries again.
+	heap = 10 << 20
+	clock.Advance(checkPeriod)
+	if Shed() {
+		t.Errorf("still shedding load after recovering")
+	}
+
+	// Too many goroutines.
+	goroutines = 1000
+	clock.Advance(checkPeriod)
+	if !Shed() {
+		t.Errorf("not shedding load over the goroutines limit")
+	}
+	goroutines = 10
+	clock.Advance(checkPeriod)
+
+	// A late check means we were stalled.
+	w.last = clock.Now().Add(-checkPeriod - 2*time.Second)
+	w.check()
+	if !Shed() {
+		t.Errorf("not shedding load after a stall")
+	}
+	w.check()
+	if Shed() {
+		t.Errorf("still shedding load after the stall")
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	w := New()
+	w.DumpDir = "/tmp"
+	w.Restart = func() {}
+	if w.Enabled() {
+		t.Errorf("watchdog without limits is enabled")
+	}
+}
@@ -0,0 +1,236 @@
+// Package webhook sends notifications about relevant events (like all the
+// upstreams being down) to HTTP endpoints, so small deployments can get
+// alerts without a full monitoring system.
+//
+// Events are sent as a JSON POST, either in a generic format, or in the one
+// Slack (and compatible services) expect for incoming webhooks.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+)
+
+// Kinds of events.
+const (
+	// All the upstreams failed to answer a query.
+	UpstreamsDown = "upstreams-down"
+
+	// A blocklist (RPZ) could not be updated.
+	BlocklistFailed = "blocklist-failed"
+
+	// A client started being rate limited.
+	RateLimited = "rate-limited"
+)
+
+// All the known kinds of events.
+var allKinds = []string{UpstreamsDown, BlocklistFailed, RateLimited}
+
+// Minimum time between notifications of the same event (same kind and
+// subject), so there are no floods of them when something breaks. Declared
+// as a variable so we can tweak it for testing.
+var minInterval = 10 * time.Minute
+
+// Exported variables for statistics.
+var stats = struct {
+	// Notifications sent successfully.
+	sent *expvar.Int
+
+	// Notifications we failed to send.
+	errors *expvar.Int
+
+	// Events not notified because a recent one was already sent.
+	suppressed *expvar.Int
+}{}
+
+func init() {
+	stats.sent = expvar.NewInt("webhook-sent")
+	stats.errors = expvar.NewInt("webhook-errors")
+	stats.suppressed = expvar.NewInt("webhook-suppressed")
+}
+
+// Event is the generic JSON notification.
+type Event struct {
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject,omitempty"`
+	Message string    `json:"message"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+}
+
+type hook struct {
+	url   string
+	slack bool
+}
+
+type notifier struct {
+	hooks []hook
+
+	// Kinds of events to notify; if nil, all of them.
+	kinds map[string]bool
+
+	// Clock, so tests can control time.
+	clock util.Clock
+
+	client *http.Client
+
+	mu       *sync.Mutex
+	lastSent map[string]time.Time
+}
+
+var global = &notifier{
+	clock:    util.RealClock,
+	client:   &http.Client{Timeout: 10 * time.Second},
+	mu:       &sync.Mutex{},
+	lastSent: map[string]time.Time{},
+}
+
+// ParseURL checks the webhook URL, and returns true if it's a Slack-style
+// one. Those can be given as "slack+https://...", and URLs for
+// hooks.slack.com are detected automatically.
+func ParseURL(s string) (string, bool, error) {
+	slack := false
+	if strings.HasPrefix(s, "slack+") {
+		slack = true
+		s = strings.TrimPrefix(s, "slack+")
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", false, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", false, fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", false, fmt.Errorf("missing host")
+	}
+	if u.Host == "hooks.slack.com" {
+		slack = true
+	}
+	return s, slack, nil
+}
+
+// Add a webhook to send the notifications to. See ParseURL for the format.
+// Not safe to call concurrently with Notify, so it should be done at
+// initialization.
+func Add(s string) error {
+	u, slack, err := ParseURL(s)
+	if err != nil {
+		return err
+	}
+	global.hooks = append(global.hooks, hook{url: u, slack: slack})
+	return nil
+}
+
+// SetKinds limits the events to notify to the given kinds (by default, all
+// of them are notified). Not safe to call concurrently with Notify.
+func SetKinds(kinds []string) error {
+	global.kinds = map[string]bool{}
+	for _, k := range kinds {
+		if !IsKnown(k) {
+			return fmt.Errorf("unknown event %q", k)
+		}
+		global.kinds[k] = true
+	}
+	return nil
+}
+
+// IsKnown returns true if the given kind of event is known.
+func IsKnown(kind string) bool {
+	for _, k := range allKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify the event to all the webhooks, in the background. The subject is
+// what the event is about (like the client that got rate limited), if it
+// applies; events of the same kind and subject are only notified once every
+// minInterval.
+func Notify(kind, subject, format string, a ...interface{}) {
+	global.notify(kind, subject, fmt.Sprintf(format, a...))
+}
+
+func (n *notifier) notify(kind, subject, msg string) {
+	if len(n.hooks) == 0 || (n.kinds != nil && !n.kinds[kind]) {
+		return
+	}
+
+	now := n.clock.Now()
+	key := kind + "/" + subject
+
+	n.mu.Lock()
+	if last, ok := n.lastSent[key]; ok && now.Sub(last) < minInterval {
+		n.mu.Unlock()
+		stats.suppressed.Add(1)
+		return
+	}
+	n.lastSent[key] = now
+
+	// Forget about the old events, so the map doesn't grow forever.
+	for k, last := range n.lastSent {
+		if now.Sub(last) >= minInterval {
+			delete(n.lastSent, k)
+		}
+	}
+	n.mu.Unlock()
+
+	hostname, _ := os.Hostname()
+	ev := Event{
+		Kind:    kind,
+		Subject: subject,
+		Message: msg,
+		Host:    hostname,
+		Time:    now,
+	}
+	for _, h := range n.hooks {
+		go n.send(h, ev)
+	}
+}
+
+func (n *notifier) send(h hook, ev Event) {
+	var body interface{} = ev
+	if h.slack {
+		body = map[string]string{
+			"text": fmt.Sprintf("dnss on %s: %s", ev.Host, ev.Message),
+		}
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		// Can't really happen, the types are always valid.
+		panic(err)
+	}
+
+	resp, err := n.client.Post(h.url, "application/json", bytes.NewReader(buf))
+	if ue, ok := err.(*url.Error); ok {
+		// Don't log the URL, as they often contain credentials.
+		err = ue.Err
+	}
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("response status: %s", resp.Status)
+		}
+	}
+	if err != nil {
+		stats.errors.Add(1)
+		log.Errorf("Error sending %s notification to webhook: %v",
+			ev.Kind, err)
+		return
+	}
+	stats.sent.Add(1)
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+)
+
+func TestParseURL(t *testing.T) {
+	cases := []struct {
+		in, url string
+		slack   bool
+	}{
+		{"https://example.com/hook", "https://example.com/hook", false},
+		{"http://localhost:8080/", "http://localhost:8080/", false},
+		{"https://hooks.slack.com/services/X/Y/Z",
+			"https://hooks.slack.com/services/X/Y/Z", true},
+		{"slack+https://chat.example/hooks/1", "https://chat.example/hooks/1",
+			true},
+	}
+	for _, c := range cases {
+		url, slack, err := ParseURL(c.in)
+		if err != nil || url != c.url || slack != c.slack {
+			t.Errorf("%q: got %q %v %v", c.in, url, slack, err)
+		}
+	}
+
+	for _, s := range []string{"ftp://example.com/", "https:///path", "%"} {
+		if _, _, err := ParseURL(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+// newTestNotifier returns a notifier sending to a test server, and a
+// channel with the bodies the server receives.
+func newTestNotifier(t *testing.T, slack bool) (*notifier, chan string, *testutil.FakeClock, func()) {
+	received := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("unexpected content type %q", ct)
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			received <- string(b)
+		}))
+
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	n := &notifier{
+		hooks:    []hook{{url: srv.URL, slack: slack}},
+		clock:    clock,
+		client:   srv.Client(),
+		mu:       &sync.Mutex{},
+		lastSent: map[string]time.Time{},
+	}
+	return n, received, clock, srv.Close
+}
+
+func receive(t *testing.T, c chan string) string {
+	t.Helper()
+	select {
+	case b := <-c:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the notification")
+		return ""
+	}
+}
+
+func TestNotify(t *testing.T) {
+	n, received, clock, done := newTestNotifier(t, false)
+	defer done()
+
+	n.notify(RateLimited, "192.0.2.0", "rate limit triggered")
+	ev := Event{}
+	if err := json.Unmarshal([]byte(receive(t, received)), &ev); err != nil {
+		t.Fatalf("error parsing the notification: %v", err)
+	}
+	if ev.Kind != RateLimited || ev.Subject != "192.0.2.0" ||
+		ev.Message != "rate limit triggered" || !ev.Time.Equal(clock.Now()) {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	// The same event again is suppressed, until minInterval passes; other
+	// subjects are independent.
+	suppressed := stats.suppressed.Value()
+	n.notify(RateLimited, "192.0.2.0", "rate limit triggered")
+	if stats.suppressed.Value() != suppressed+1 {
+		t.Errorf("repeated event was not suppressed")
+	}
+
+	n.notify(RateLimited, "198.51.100.0", "rate limit triggered")
+	receive(t, received)
+
+	clock.Advance(minInterval)
+	n.notify(RateLimited, "192.0.2.0", "rate limit triggered")
+	receive(t, received)
+	if len(n.lastSent) != 1 {
+		t.Errorf("old events were not forgotten: %v", n.lastSent)
+	}
+}
+
+func TestKinds(t *testing.T) {
+	n, received, _, done := newTestNotifier(t, false)
+	defer done()
+
+	n.kinds = map[string]bool{UpstreamsDown: true}
+	n.notify(BlocklistFailed, "", "not wanted")
+	n.notify(UpstreamsDown, "", "wanted")
+
+	ev := Event{}
+	json.Unmarshal([]byte(receive(t, received)), &ev)
+	if ev.Kind != UpstreamsDown {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
+
+func TestSlack(t *testing.T) {
+	n, received, _, done := newTestNotifier(t, true)
+	defer done()
+
+	n.notify(UpstreamsDown, "", "all upstreams failed")
+	body := map[string]string{}
+	if err := json.Unmarshal([]byte(receive(t, received)), &body); err != nil {
+		t.Fatalf("error parsing the notification: %v", err)
+	}
+	if len(body) != 1 || !strings.HasSuffix(body["text"], ": all upstreams failed") {
+		t.Errorf("unexpected body: %v", body)
+	}
+}
+
+func TestSetKinds(t *testing.T) {
+	defer func() { global.kinds = nil }()
+
+	if err := SetKinds([]string{UpstreamsDown, RateLimited}); err != nil {
+		t.Errorf("error setting kinds: %v", err)
+	}
+	if err := SetKinds([]string{"disk-full"}); err == nil {
+		t.Errorf("unknown kind accepted")
+	}
+}
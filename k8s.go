@@ -0,0 +1,193 @@
+package main
+
+// Support for running in Kubernetes (or similar environments): loading the
+// flags from a mounted ConfigMap (and reloading when it changes, if we can),
+// and health checks for the liveness and readiness probes.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/upgrade"
+	"blitiri.com.ar/go/log"
+)
+
+// Constants that tune the config directory and health checks, declared as
+// variables so we can tweak them for testing.
+var (
+	// How often to check the config directory for changes.
+	configDirPollPeriod = 10 * time.Second
+
+	// If the upstreams haven't been used for this long, the readiness check
+	// queries them to see if they work.
+	readinessMaxAge = 30 * time.Second
+)
+
+// loadConfigDir sets the flags in fs from the files in dir: each file is
+// named after a flag, and contains its value (surrounding whitespace is
+// removed).
+// Flags already set (usually, given on the command line) take precedence.
+//
+// Hidden files are ignored; this includes the "..data" symlink and the
+// timestamped directories Kubernetes uses to update ConfigMap volumes
+// atomically.
+func loadConfigDir(fs *flag.FlagSet, dir string) error {
+	values, err := readConfigDir(dir)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q",
+				filepath.Join(dir, name), name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Join(dir, name), err)
+		}
+	}
+	return nil
+}
+
+// readConfigDir returns the contents of the (non-hidden) files in dir, by
+// name.
+func readConfigDir(dir string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		// The entries come from Lstat, and in ConfigMap volumes the files
+		// are symlinks, so we need to look at what they point to.
+		path := filepath.Join(dir, e.Name())
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		values[e.Name()] = strings.TrimSpace(string(buf))
+	}
+	return values, nil
+}
+
+// watchConfigDir checks dir periodically, and when its contents change, does
+// a graceful upgrade (if enabled), so the new process starts with the new
+// configuration. If that configuration is invalid, the new process fails to
+// start, and we keep going with the one we have.
+//
+// The flags are used all over at startup, so we can't apply them in place;
+// when we can't upgrade (usually because we are the PID 1 of a container,
+// and exiting would restart it), we just log that a restart is needed.
+func watchConfigDir(dir string) {
+	last, err := readConfigDir(dir)
+	if err != nil {
+		log.Errorf("Error reading -config_dir: %v", err)
+	}
+
+	for range time.Tick(configDirPollPeriod) {
+		values, err := readConfigDir(dir)
+		if err != nil {
+			log.Errorf("Error reading -config_dir: %v", err)
+			continue
+		}
+		if reflect.DeepEqual(values, last) {
+			continue
+		}
+
+		last = values
+		if !*gracefulUpgrade {
+			log.Infof("Configuration in %q changed, restart to apply it"+
+				" (or use -graceful_upgrade)", dir)
+			continue
+		}
+		if err := upgrade.Supported(); err != nil {
+			log.Infof("Configuration in %q changed, restart to apply it"+
+				" (can't upgrade: %v)", dir, err)
+			continue
+		}
+		log.Infof("Configuration in %q changed, reloading", dir)
+		upgradeNow()
+	}
+}
+
+// Readiness state, see setReady and handleReadyz.
+var readiness = struct {
+	mu *sync.Mutex
+
+	// Have we finished starting up?
+	ready bool
+
+	// Check to run on each request once we're ready; nil if there is none.
+	check func() error
+}{
+	mu: &sync.Mutex{},
+}
+
+// setReady marks the start up as finished, so the readiness check passes as
+// long as check (if not nil) does.
+func setReady(check func() error) {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+	readiness.ready = true
+	readiness.check = check
+}
+
+// handleHealthz is the liveness check: if we can answer, we're alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz is the readiness check: it fails while we're starting up, and
+// when the upstreams don't work, so the traffic goes elsewhere.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness.mu.Lock()
+	ready, check := readiness.ready, readiness.check
+	readiness.mu.Unlock()
+
+	if !ready {
+		http.Error(w, "starting up", http.StatusServiceUnavailable)
+		return
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			http.Error(w, "not ready: "+err.Error(),
+				http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
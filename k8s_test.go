@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigMap writes the values to dir, laid out like Kubernetes does with
+// ConfigMap volumes.
+func writeConfigMap(t *testing.T, dir string, values map[string]string) {
+	t.Helper()
+	data := filepath.Join(dir, "..2026_10_14_12_00_00.000000001")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatalf("error creating data dir: %v", err)
+	}
+	if err := os.Symlink(filepath.Base(data), filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("error creating ..data: %v", err)
+	}
+	for name, v := range values {
+		err := ioutil.WriteFile(filepath.Join(data, name), []byte(v), 0644)
+		if err != nil {
+			t.Fatalf("error writing %q: %v", name, err)
+		}
+		err = os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("error linking %q: %v", name, err)
+		}
+	}
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigMap(t, dir, map[string]string{
+		"trace_names": "  example.com example.net\n",
+		"nsid":        "from-config-dir",
+	})
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	traceNames := fs.String("trace_names", "", "")
+	nsid := fs.String("nsid", "", "")
+	fs.Parse([]string{"-nsid=from-command-line"})
+
+	if err := loadConfigDir(fs, dir); err != nil {
+		t.Fatalf("error loading config dir: %v", err)
+	}
+	if *traceNames != "example.com example.net" {
+		t.Errorf("unexpected -trace_names: %q", *traceNames)
+	}
+	// Flags given on the command line take precedence.
+	if *nsid != "from-command-line" {
+		t.Errorf("command line flag was overridden: %q", *nsid)
+	}
+
+	// Unknown flags are an error.
+	ioutil.WriteFile(filepath.Join(dir, "no_such_flag"), []byte("1"), 0644)
+	err = loadConfigDir(fs, dir)
+	if err == nil || !strings.Contains(err.Error(), `unknown flag "no_such_flag"`) {
+		t.Errorf("expected unknown flag error, got %v", err)
+	}
+
+	if err := loadConfigDir(fs, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("missing dir: no error")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer func() { readiness.ready, readiness.check = false, nil }()
+
+	status := func(h http.HandlerFunc) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	if c := status(handleHealthz); c != http.StatusOK {
+		t.Errorf("healthz: got %d", c)
+	}
+	if c := status(handleReadyz); c != http.StatusServiceUnavailable {
+		t.Errorf("readyz while starting: got %d", c)
+	}
+
+	var checkErr error
+	setReady(func() error { return checkErr })
+	if c := status(handleReadyz); c != http.StatusOK {
+		t.Errorf("readyz when ready: got %d", c)
+	}
+
+	checkErr = errors.New("upstreams down")
+	if c := status(handleReadyz); c != http.StatusServiceUnavailable {
+		t.Errorf("readyz with upstreams down: got %d", c)
+	}
+	if c := status(handleHealthz); c != http.StatusOK {
+		t.Errorf("healthz with upstreams down: got %d", c)
+	}
+}
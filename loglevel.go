@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"blitiri.com.ar/go/log"
+)
+
+// Limits for the log level when adjusting it at runtime. The upper one is
+// arbitrary, but nothing logs at higher verbosity than this.
+const (
+	minLogLevel = log.Error
+	maxLogLevel = log.Level(10)
+)
+
+// logLevelMu serializes the changes to the log level, which come from the
+// signals and the monitoring server, so the relative ones (which read it and
+// then write it) don't race with each other.
+//
+// The log package reads the level without synchronization, and has no way
+// to set it that would; so this is as far as we can go, but luckily it's a
+// single word, and the level is rarely changed.
+var logLevelMu sync.Mutex
+
+// getLogLevel returns the current log level.
+func getLogLevel() log.Level {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	return log.Default.Level
+}
+
+// adjustLogLevel changes the log level by delta (see setLogLevel), and
+// returns the new level.
+func adjustLogLevel(delta int) log.Level {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	return setLogLevelLocked(log.Default.Level + log.Level(delta))
+}
+
+// setLogLevel changes the log level, clamping it to the valid range, and
+// returns the new level.
+func setLogLevel(l log.Level) log.Level {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	return setLogLevelLocked(l)
+}
+
+func setLogLevelLocked(l log.Level) log.Level {
+	if l < minLogLevel {
+		l = minLogLevel
+	}
+	if l > maxLogLevel {
+		l = maxLogLevel
+	}
+
+	if l != log.Default.Level {
+		log.Infof("Changing log level: %d -> %d", log.Default.Level, l)
+		log.Default.Level = l
+	}
+	return l
+}
+
+// handleLogSignals raises the log level by one on SIGUSR1, and lowers it on
+// SIGUSR2 (unless it's used for graceful upgrades).
+func handleLogSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	if !*gracefulUpgrade {
+		signal.Notify(signals, syscall.SIGUSR2)
+	}
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				adjustLogLevel(+1)
+			} else {
+				adjustLogLevel(-1)
+			}
+		}
+	}()
+}
+
+// handleLogLevel is the monitoring HTTP handler to see and change the log
+// level. Use ?level=N to set it, or ?delta=N to raise (or lower, if negative)
+// it relative to the current one. It returns the resulting level.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	for _, param := range []string{"level", "delta"} {
+		s := r.FormValue(param)
+		if s == "" {
+			continue
+		}
+
+		l, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", param, err),
+				http.StatusBadRequest)
+			return
+		}
+
+		if param == "delta" {
+			adjustLogLevel(l)
+		} else {
+			setLogLevel(log.Level(l))
+		}
+	}
+
+	fmt.Fprintf(w, "%d\n", getLogLevel())
+}
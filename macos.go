@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Where we configure the macOS resolver: the per-domain configuration files,
+// and the backup of the system-wide DNS servers, so we can restore them.
+const (
+	macosResolverDir = "/etc/resolver"
+	macosDNSBackup   = "/var/db/dnss.dns-backup"
+)
+
+// Marker for the files we write in macosResolverDir, so we only remove our
+// own when uninstalling.
+const macosResolverMarker = "# Written by dnss --install_macos_resolver.\n"
+
+// installMacOSResolver configures macOS to use our DNS server: for the given
+// domains, via /etc/resolver files; or, if there are none, for everything,
+// setting the DNS servers of all the network services via networksetup.
+func installMacOSResolver(listenAddr string, domains []string) error {
+	if runtime.GOOS != "darwin" {
+		return fmt.Errorf("only supported on macOS")
+	}
+
+	host, port, err := localDNSAddr(listenAddr)
+	if err != nil {
+		return err
+	}
+
+	if len(domains) > 0 {
+		if err := os.MkdirAll(macosResolverDir, 0755); err != nil {
+			return err
+		}
+		for _, d := range domains {
+			path := filepath.Join(macosResolverDir, strings.TrimSuffix(d, "."))
+			err := ioutil.WriteFile(path, resolverFile(host, port), 0644)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %s\n", path)
+		}
+		return nil
+	}
+
+	if port != 53 {
+		return fmt.Errorf("the system DNS servers must use port 53" +
+			" (use domains for other ports)")
+	}
+
+	services, err := networkServices()
+	if err != nil {
+		return err
+	}
+
+	// Back up the current servers, unless we already did (in which case
+	// they are likely ours).
+	if _, err := os.Stat(macosDNSBackup); os.IsNotExist(err) {
+		backup := &bytes.Buffer{}
+		for _, s := range services {
+			servers, err := dnsServers(s)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(backup, "%s\t%s\n", s, strings.Join(servers, " "))
+		}
+		err = ioutil.WriteFile(macosDNSBackup, backup.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range services {
+		if err := setDNSServers(s, []string{host}); err != nil {
+			return err
+		}
+		fmt.Printf("%s: DNS server set to %s\n", s, host)
+	}
+	return nil
+}
+
+// uninstallMacOSResolver undoes installMacOSResolver: it removes our
+// /etc/resolver files, and restores the DNS servers we backed up.
+func uninstallMacOSResolver() error {
+	if runtime.GOOS != "darwin" {
+		return fmt.Errorf("only supported on macOS")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(macosResolverDir, "*"))
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.HasPrefix(data, []byte(macosResolverMarker)) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", path)
+	}
+
+	backup, err := ioutil.ReadFile(macosDNSBackup)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for service, servers := range parseDNSBackup(backup) {
+		if err := setDNSServers(service, servers); err != nil {
+			return err
+		}
+		fmt.Printf("%s: DNS servers restored\n", service)
+	}
+	return os.Remove(macosDNSBackup)
+}
+
+// localDNSAddr returns the address clients on this machine should use to
+// reach our DNS server listening on the given address.
+func localDNSAddr(listenAddr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", 0, fmt.Errorf("-dns_listen_addr: %v", err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("-dns_listen_addr: invalid port %q", p)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return host, port, nil
+}
+
+// resolverFile returns the contents of an /etc/resolver file pointing to the
+// given server.
+func resolverFile(host string, port int) []byte {
+	return []byte(fmt.Sprintf("%snameserver %s\nport %d\n",
+		macosResolverMarker, host, port))
+}
+
+func networksetup(args ...string) (string, error) {
+	out, err := exec.Command("networksetup", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("networksetup %s: %v (%s)",
+			strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+// networkServices returns the enabled network services (like "Wi-Fi").
+func networkServices() ([]string, error) {
+	out, err := networksetup("-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	return parseNetworkServices(out), nil
+}
+
+// parseNetworkServices parses the output of
+// "networksetup -listallnetworkservices": a note in the first line, and a
+// service per line, with an asterisk in front of the disabled ones.
+func parseNetworkServices(out string) []string {
+	services := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Scan()
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "*") {
+			continue
+		}
+		services = append(services, s)
+	}
+	return services
+}
+
+// dnsServers returns the DNS servers configured for the given service, or
+// "Empty" if there are none (which is what networksetup uses to go back to
+// the ones given by DHCP).
+func dnsServers(service string) ([]string, error) {
+	out, err := networksetup("-getdnsservers", service)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSServers(out), nil
+}
+
+// parseDNSServers parses the output of "networksetup -getdnsservers": a
+// server per line, or a sentence saying there are none.
+func parseDNSServers(out string) []string {
+	servers := []string{}
+	for _, l := range strings.Split(out, "\n") {
+		l = strings.TrimSpace(l)
+		if net.ParseIP(l) != nil {
+			servers = append(servers, l)
+		}
+	}
+	if len(servers) == 0 {
+		return []string{"Empty"}
+	}
+	return servers
+}
+
+func setDNSServers(service string, servers []string) error {
+	_, err := networksetup(append(
+		[]string{"-setdnsservers", service}, servers...)...)
+	return err
+}
+
+// parseDNSBackup parses our backup of the DNS servers: a line per service,
+// with its name and servers separated by a tab.
+func parseDNSBackup(data []byte) map[string][]string {
+	servers := map[string][]string{}
+	for _, l := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(l, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		servers[parts[0]] = strings.Fields(parts[1])
+	}
+	return servers
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworkServices(t *testing.T) {
+	out := "An asterisk (*) denotes that a network service is disabled.\n" +
+		"USB 10/100/1000 LAN\n" +
+		"*Thunderbolt Bridge\n" +
+		"Wi-Fi\n"
+	expected := []string{"USB 10/100/1000 LAN", "Wi-Fi"}
+	if got := parseNetworkServices(out); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+func TestParseDNSServers(t *testing.T) {
+	cases := []struct {
+		out      string
+		expected []string
+	}{
+		{"There aren't any DNS Servers set on Wi-Fi.\n", []string{"Empty"}},
+		{"1.1.1.1\n2606:4700:4700::1111\n",
+			[]string{"1.1.1.1", "2606:4700:4700::1111"}},
+	}
+	for _, c := range cases {
+		if got := parseDNSServers(c.out); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%q: got %q, expected %q", c.out, got, c.expected)
+		}
+	}
+}
+
+func TestParseDNSBackup(t *testing.T) {
+	data := "Wi-Fi\tEmpty\nUSB LAN\t8.8.8.8 8.8.4.4\n\n"
+	expected := map[string][]string{
+		"Wi-Fi":   {"Empty"},
+		"USB LAN": {"8.8.8.8", "8.8.4.4"},
+	}
+	if got := parseDNSBackup([]byte(data)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+func TestLocalDNSAddr(t *testing.T) {
+	cases := []struct {
+		addr string
+		host string
+		port int
+	}{
+		{":53", "127.0.0.1", 53},
+		{"0.0.0.0:5353", "127.0.0.1", 5353},
+		{"[::]:53", "127.0.0.1", 53},
+		{"127.0.0.2:53", "127.0.0.2", 53},
+	}
+	for _, c := range cases {
+		host, port, err := localDNSAddr(c.addr)
+		if err != nil || host != c.host || port != c.port {
+			t.Errorf("%q: got %q %d %v", c.addr, host, port, err)
+		}
+	}
+
+	if _, _, err := localDNSAddr("systemd"); err == nil {
+		t.Errorf("systemd: no error")
+	}
+}
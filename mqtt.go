@@ -0,0 +1,130 @@
+package main
+
+// MQTT integration, for home-automation setups: the status (health, queries
+// per second, and blocked queries) is published to the -mqtt_broker, and
+// the blocking can be paused and the cache flushed from it. With Home
+// Assistant, the sensors and buttons are discovered automatically.
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/mqtt"
+)
+
+// How long to pause the blocking for, if the command doesn't say.
+const mqttDefaultPause = 10 * time.Minute
+
+// startMQTT starts publishing the status to the broker, in the background.
+// flushCache can be nil, if there is no cache.
+func startMQTT(readiness func() error, flushCache func()) error {
+	c, err := mqtt.New(*mqttBroker, *mqttTopic)
+	if err != nil {
+		return err
+	}
+	c.DiscoveryPrefix = *mqttDiscovery
+	c.Interval = *mqttInterval
+	c.Status = mqttStatus(readiness)
+
+	c.Sensors = []mqtt.Sensor{
+		{Key: "healthy", Name: "Upstreams healthy", Binary: true,
+			DeviceClass: "connectivity"},
+		{Key: "qps", Name: "Queries per second", Unit: "queries/s",
+			StateClass: "measurement"},
+		{Key: "queries", Name: "Queries", StateClass: "total_increasing"},
+		{Key: "blocked", Name: "Blocked queries",
+			StateClass: "total_increasing"},
+		{Key: "blocking_paused", Name: "Blocking paused", Binary: true},
+	}
+	c.Commands = []mqtt.Command{
+		{Name: "pause_blocking", Title: "Pause blocking",
+			Payload: mqttDefaultPause.String(), Run: mqttPauseBlocking},
+		{Name: "resume_blocking", Title: "Resume blocking",
+			Run: func(string) error {
+				dnsserver.ResumeBlocking()
+				return nil
+			}},
+	}
+	if flushCache != nil {
+		c.Commands = append(c.Commands, mqtt.Command{
+			Name: "flush_cache", Title: "Flush cache",
+			Run: func(string) error {
+				flushCache()
+				return nil
+			}})
+	}
+
+	go c.Run()
+	return nil
+}
+
+// mqttPauseBlocking pauses the blocking for the duration given as argument
+// (like "30m"), or for mqttDefaultPause if it's empty.
+func mqttPauseBlocking(arg string) error {
+	d := mqttDefaultPause
+	if arg != "" {
+		var err error
+		d, err = time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("duration must be positive")
+		}
+	}
+	dnsserver.PauseBlocking(d)
+	return nil
+}
+
+// mqttStatus returns the function to get the status, which keeps track of
+// the number of queries to calculate the rate since the previous call. It
+// can be called concurrently.
+func mqttStatus(readiness func() error) func() map[string]interface{} {
+	mu := &sync.Mutex{}
+	lastQueries, lastTime := expvarInt("dns-queries"), time.Now()
+
+	return func() map[string]interface{} {
+		mu.Lock()
+		queries, now := expvarInt("dns-queries"), time.Now()
+		qps := 0.0
+		if elapsed := now.Sub(lastTime).Seconds(); elapsed > 0 {
+			qps = float64(queries-lastQueries) / elapsed
+		}
+		lastQueries, lastTime = queries, now
+		mu.Unlock()
+
+		// Blocked queries are the ones matching the compiled blocklists,
+		// and the RPZ rules other than PASSTHRU.
+		blocked := expvarInt("blocklist-matches")
+		if m, ok := expvar.Get("rpz-matches").(*expvar.Map); ok {
+			m.Do(func(kv expvar.KeyValue) {
+				if i, ok := kv.Value.(*expvar.Int); ok && kv.Key != "PASSTHRU" {
+					blocked += i.Value()
+				}
+			})
+		}
+
+		status := map[string]interface{}{
+			"healthy":         readiness == nil || readiness() == nil,
+			"qps":             float64(int(qps*100)) / 100,
+			"queries":         queries,
+			"blocked":         blocked,
+			"blocking_paused": false,
+		}
+		if until := dnsserver.BlockingPausedUntil(); !until.IsZero() {
+			status["blocking_paused"] = true
+			status["blocking_paused_until"] = until.Format(time.RFC3339)
+		}
+		return status
+	}
+}
+
+func expvarInt(name string) int64 {
+	if i, ok := expvar.Get(name).(*expvar.Int); ok {
+		return i.Value()
+	}
+	return 0
+}
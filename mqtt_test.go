@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+)
+
+func TestMQTTPauseBlocking(t *testing.T) {
+	defer dnsserver.ResumeBlocking()
+
+	for _, arg := range []string{"soon", "-5m", "0s"} {
+		if err := mqttPauseBlocking(arg); err == nil {
+			t.Errorf("%q: expected error", arg)
+		}
+	}
+	if !dnsserver.BlockingPausedUntil().IsZero() {
+		t.Errorf("blocking paused after invalid commands")
+	}
+
+	status := mqttStatus(nil)
+	for _, arg := range []string{"", "1h"} {
+		if err := mqttPauseBlocking(arg); err != nil {
+			t.Errorf("%q: error: %v", arg, err)
+		}
+		if s := status(); s["blocking_paused"] != true ||
+			s["blocking_paused_until"] == nil {
+			t.Errorf("%q: unexpected status: %v", arg, s)
+		}
+		dnsserver.ResumeBlocking()
+	}
+}
+
+func TestMQTTStatus(t *testing.T) {
+	status := mqttStatus(func() error { return errors.New("down") })
+	s := status()
+	for _, key := range []string{"qps", "queries", "blocked"} {
+		if _, ok := s[key]; !ok {
+			t.Errorf("missing %q: %v", key, s)
+		}
+	}
+	if s["healthy"] != false || s["blocking_paused"] != false {
+		t.Errorf("unexpected status: %v", s)
+	}
+}
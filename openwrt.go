@@ -0,0 +1,173 @@
+package main
+
+// Support for running on OpenWrt: loading the flags from the UCI
+// configuration (/etc/config/dnss), so dnss can be configured like the rest
+// of the router, with uci(1) or LuCI. See etc/openwrt for the procd init
+// script and an example configuration.
+//
+// The options of the "dnss" sections are the flags, with the same names;
+// lists are joined with spaces, for the flags which take space-separated
+// lists:
+//
+//   config dnss 'main'
+//   	option enabled '1'
+//   	option dns_listen_addr '127.0.0.1:5353'
+//   	option https_upstream 'https://dns.google/dns-query'
+//   	list blocklists '/etc/dnss/ads.dnssbl'
+//   	list blocklists '/etc/dnss/malware.dnssbl'
+//
+// The "enabled" option is for the init script, and is ignored here. Other
+// files can be included with "include <glob>" lines (see util.LineScanner),
+// which uci(1) itself doesn't understand, so they're better kept for files
+// managed by hand.
+//
+// procd supervises the process, so the configuration changes are applied by
+// restarting it (see the init script), rather than with the graceful
+// upgrades, which would leave the new process outside of procd's control.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+)
+
+// Options of the UCI "dnss" sections which are not flags.
+var uciIgnoredOptions = map[string]bool{
+	"enabled": true,
+}
+
+// parseUCI parses a UCI configuration file, and returns the values of the
+// options of the sections of the given type. Options (and lists) in more
+// than one section are combined, with the later ones taking precedence.
+func parseUCI(r io.Reader, sectionType string) (map[string]string, error) {
+	return parseUCILines(util.NewLineScanner(r), sectionType)
+}
+
+func parseUCILines(lines *util.LineScanner, sectionType string) (map[string]string, error) {
+	values := map[string]string{}
+	lists := map[string][]string{}
+
+	inSection := false
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		words, err := uciWords(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", lines.Pos(), err)
+		}
+
+		switch words[0] {
+		case "package":
+		case "config":
+			if len(words) < 2 || len(words) > 3 {
+				return nil, fmt.Errorf("%s: expected config type [name]",
+					lines.Pos())
+			}
+			inSection = words[1] == sectionType
+		case "option", "list":
+			if len(words) != 3 {
+				return nil, fmt.Errorf("%s: expected %s name value",
+					lines.Pos(), words[0])
+			}
+			if !inSection || uciIgnoredOptions[words[1]] {
+				continue
+			}
+			if words[0] == "option" {
+				values[words[1]] = words[2]
+			} else {
+				lists[words[1]] = append(lists[words[1]], words[2])
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown keyword %q",
+				lines.Pos(), words[0])
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, l := range lists {
+		values[name] = strings.Join(l, " ")
+	}
+	return values, nil
+}
+
+// uciWords splits the line in words, which can be quoted with ' or ", and
+// can have comments at the end.
+func uciWords(line string) ([]string, error) {
+	words := []string{}
+	var cur []byte
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(line[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			cur = append(cur, line[i+1:i+1+end]...)
+			inWord = true
+			i += end + 1
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, string(cur))
+				cur, inWord = nil, false
+			}
+		case c == '#' && !inWord:
+			i = len(line)
+		default:
+			cur = append(cur, c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, string(cur))
+	}
+	return words, nil
+}
+
+// loadUCIConfig sets the flags in fs from the "dnss" sections of the UCI
+// configuration file at path. Like with loadConfigDir, flags already set
+// take precedence.
+func loadUCIConfig(fs *flag.FlagSet, path string) error {
+	lines, err := util.OpenLineScanner(path)
+	if err != nil {
+		return err
+	}
+	defer lines.Close()
+
+	values, err := parseUCILines(lines, "dnss")
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: option %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
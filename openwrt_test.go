@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testUCI = `
+package dnss
+
+# Comment.
+config dnss 'main'
+	option enabled '1'
+	option dns_listen_addr '127.0.0.1:5353'
+	option https_upstream "https://dns.example/dns-query" # Trailing comment.
+	list blocklists '/etc/dnss/a list.dnssbl'
+	list blocklists /etc/dnss/b.dnssbl
+
+config other
+	option dns_listen_addr ':53'
+
+config dnss
+	option dns_listen_addr '127.0.0.1:5300'
+`
+
+func TestParseUCI(t *testing.T) {
+	values, err := parseUCI(strings.NewReader(testUCI), "dnss")
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	expected := map[string]string{
+		"dns_listen_addr": "127.0.0.1:5300",
+		"https_upstream":  "https://dns.example/dns-query",
+		"blocklists":      "/etc/dnss/a list.dnssbl /etc/dnss/b.dnssbl",
+	}
+	if len(values) != len(expected) {
+		t.Errorf("unexpected values: %v", values)
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, values[k])
+		}
+	}
+
+	for _, s := range []string{
+		"config",
+		"config dnss 'main' extra",
+		"config dnss\n option name",
+		"config dnss\n option name 'unterminated",
+		"something else",
+	} {
+		if _, err := parseUCI(strings.NewReader(s), "dnss"); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestLoadUCIConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnss")
+	ioutil.WriteFile(path, []byte(testUCI), 0644)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("dns_listen_addr", "", "")
+	upstream := fs.String("https_upstream", "", "")
+	blocklists := fs.String("blocklists", "", "")
+	fs.Parse([]string{"-https_upstream=https://other.example/"})
+
+	if err := loadUCIConfig(fs, path); err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	if *listen != "127.0.0.1:5300" || *blocklists == "" {
+		t.Errorf("flags not loaded: %q %q", *listen, *blocklists)
+	}
+	// The command line takes precedence.
+	if *upstream != "https://other.example/" {
+		t.Errorf("-https_upstream overridden: %q", *upstream)
+	}
+
+	// Unknown options are errors, so typos don't go unnoticed.
+	ioutil.WriteFile(path, []byte("config dnss\n option nope '1'\n"), 0644)
+	if err := loadUCIConfig(fs, path); err == nil {
+		t.Errorf("unknown option loaded without errors")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+// Profiles: named sets of flags (like "home", "travel" or "work"), to switch
+// between configurations easily, for example on a laptop that moves between
+// networks with different upstreams, routes and filters.
+//
+// They are defined in a file, like:
+//
+//   # Comments start with #.
+//   [home]
+//   https_upstream = https://dns.google/dns-query
+//   fallback_domains = lan.
+//   fallback_upstream = 192.168.1.1:53
+//
+//   # A profile can inherit the flags of another, and override some.
+//   [work : home]
+//   forward_zones = corp.example=10.0.0.53:53
+//
+//   # Profiles can also come from other files.
+//   include profiles.d/*.conf
+//
+// The active profile is given with -profile, and can be switched at runtime
+// via the monitoring server (see handleProfile), which does a graceful
+// upgrade to a new process using the new profile.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+)
+
+// Environment variable to pass the profile to use to the new process, when
+// switching at runtime. It takes precedence over -profile.
+const envProfile = "DNSS_PROFILE"
+
+// Flags that can't be set from a profile, as they select the profile.
+var profileReservedFlags = map[string]bool{
+	"profile":    true,
+	"profiles":   true,
+	"config_dir": true,
+}
+
+// profile is a named set of flags.
+type profile struct {
+	// Name of the profile we inherit from, if any.
+	parent string
+
+	// Values of the flags, by name.
+	values map[string]string
+}
+
+// parseProfiles parses the profiles from the given reader.
+func parseProfiles(r io.Reader) (map[string]*profile, error) {
+	return parseProfileLines(util.NewLineScanner(r))
+}
+
+func parseProfileLines(lines *util.LineScanner) (map[string]*profile, error) {
+	profiles := map[string]*profile{}
+	var cur *profile
+
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sp := strings.SplitN(line[1:len(line)-1], ":", 2)
+			name := strings.TrimSpace(sp[0])
+			if name == "" {
+				return nil, fmt.Errorf("%s: missing profile name", lines.Pos())
+			}
+			if _, ok := profiles[name]; ok {
+				return nil, fmt.Errorf("%s: profile %q defined twice",
+					lines.Pos(), name)
+			}
+			cur = &profile{values: map[string]string{}}
+			if len(sp) == 2 {
+				cur.parent = strings.TrimSpace(sp[1])
+			}
+			profiles[name] = cur
+			continue
+		}
+
+		if cur == nil {
+			return nil, fmt.Errorf("%s: flag outside of a profile", lines.Pos())
+		}
+		sp := strings.SplitN(line, "=", 2)
+		if len(sp) != 2 {
+			return nil, fmt.Errorf("%s: expected flag = value", lines.Pos())
+		}
+		name := strings.TrimPrefix(strings.TrimSpace(sp[0]), "-")
+		if profileReservedFlags[name] {
+			return nil, fmt.Errorf("%s: -%s can't be set in a profile",
+				lines.Pos(), name)
+		}
+		cur.values[name] = strings.TrimSpace(sp[1])
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, p := range profiles {
+		if p.parent != "" && profiles[p.parent] == nil {
+			return nil, fmt.Errorf("profile %q: unknown parent %q",
+				name, p.parent)
+		}
+	}
+	return profiles, nil
+}
+
+// profileValues returns the values of the flags of the given profile,
+// including the inherited ones.
+func profileValues(profiles map[string]*profile, name string) (map[string]string, error) {
+	// The chain of profiles, from the given one to the root.
+	chain := []*profile{}
+	seen := map[string]bool{}
+	for n := name; n != ""; n = profiles[n].parent {
+		if profiles[n] == nil {
+			return nil, fmt.Errorf("unknown profile %q", n)
+		}
+		if seen[n] {
+			return nil, fmt.Errorf("profile %q: inheritance loop", name)
+		}
+		seen[n] = true
+		chain = append(chain, profiles[n])
+	}
+
+	values := map[string]string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for k, v := range chain[i].values {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+// readProfiles reads the profiles from the given file.
+func readProfiles(path string) (map[string]*profile, error) {
+	lines, err := util.OpenLineScanner(path)
+	if err != nil {
+		return nil, err
+	}
+	defer lines.Close()
+	return parseProfileLines(lines)
+}
+
+// loadProfile sets the flags in fs from the given profile, in the file at
+// path. Like with loadConfigDir, flags already set take precedence.
+func loadProfile(fs *flag.FlagSet, path, name string) error {
+	profiles, err := readProfiles(path)
+	if err != nil {
+		return err
+	}
+	values, err := profileValues(profiles, name)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := []string{}
+	for n := range values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if fs.Lookup(n) == nil {
+			return fmt.Errorf("profile %q: unknown flag %q", name, n)
+		}
+		if set[n] {
+			continue
+		}
+		if err := fs.Set(n, values[n]); err != nil {
+			return fmt.Errorf("profile %q: -%s: %v", name, n, err)
+		}
+	}
+	return nil
+}
+
+// activeProfile returns the name of the profile to use: the one we switched
+// to at runtime, if any, or the one given with -profile.
+func activeProfile() string {
+	if p := os.Getenv(envProfile); p != "" {
+		return p
+	}
+	return *profileName
+}
+
+// handleProfile is the monitoring HTTP handler to see the profiles, and
+// switch to another one by POSTing set=name (with -monitoring_admin).
+// Switching is done with a graceful upgrade, so if the new configuration is
+// invalid, we keep using the current one, and reply with the error.
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	profiles, err := readProfiles(*profilesFile)
+	if err != nil {
+		http.Error(w, "error reading the profiles: "+err.Error(),
+			http.StatusInternalServerError)
+		return
+	}
+
+	if name := r.FormValue("set"); name != "" {
+		if !*monitoringAdmin {
+			http.Error(w, "switching profiles is disabled"+
+				" (see -monitoring_admin)", http.StatusForbidden)
+			return
+		}
+		if !util.CheckAdminRequest(w, r) {
+			return
+		}
+		if _, err := profileValues(profiles, name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Infof("Switching to profile %q", name)
+		prev, hadPrev := os.LookupEnv(envProfile)
+		os.Setenv(envProfile, name)
+		if err := startUpgrade(); err != nil {
+			log.Errorf("Error switching to profile %q: %v", name, err)
+			if hadPrev {
+				os.Setenv(envProfile, prev)
+			} else {
+				os.Unsetenv(envProfile)
+			}
+			http.Error(w, "error switching profiles: "+err.Error(),
+				http.StatusInternalServerError)
+			return
+		}
+
+		// The new process is serving already; reply before we exit.
+		fmt.Fprintf(w, "switched to profile %q\n", name)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go finishUpgrade()
+		return
+	}
+
+	names := []string{}
+	for n := range profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		mark := " "
+		if n == activeProfile() {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s %s\n", mark, n)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testProfiles = `
+# Test profiles.
+[home]
+fallback_upstream = 192.168.1.1:53
+trace_names = home.example
+
+[travel]
+-trace_names = travel.example
+
+[work : home]
+trace_names = work.example
+nsid=work
+`
+
+func TestProfileValues(t *testing.T) {
+	profiles, err := parseProfiles(strings.NewReader(testProfiles))
+	if err != nil {
+		t.Fatalf("error parsing profiles: %v", err)
+	}
+
+	values, err := profileValues(profiles, "work")
+	if err != nil {
+		t.Fatalf("error getting values: %v", err)
+	}
+	expected := map[string]string{
+		"fallback_upstream": "192.168.1.1:53",
+		"trace_names":       "work.example",
+		"nsid":              "work",
+	}
+	if len(values) != len(expected) {
+		t.Errorf("got %v, expected %v", values, expected)
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("%s: got %q, expected %q", k, values[k], v)
+		}
+	}
+
+	if _, err := profileValues(profiles, "moon"); err == nil {
+		t.Errorf("unknown profile accepted")
+	}
+
+	loop := "[a : b]\n[b : a]\n"
+	profiles, _ = parseProfiles(strings.NewReader(loop))
+	if _, err := profileValues(profiles, "a"); err == nil {
+		t.Errorf("inheritance loop accepted")
+	}
+
+	for _, s := range []string{
+		"nsid = x\n",
+		"[a]\nnsid\n",
+		"[]\n",
+		"[a]\n[a]\n",
+		"[a : b]\n",
+		"[a]\nprofile = b\n",
+	} {
+		if _, err := parseProfiles(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnss_test")
+	if err != nil {
+		t.Fatalf("error creating temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testProfiles + "[bad]\nunknown = 1\n")
+	f.Close()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fallback := fs.String("fallback_upstream", "", "")
+	traceNames := fs.String("trace_names", "", "")
+	nsid := fs.String("nsid", "", "")
+	fs.Parse([]string{"-nsid=from-command-line"})
+
+	if err := loadProfile(fs, f.Name(), "work"); err != nil {
+		t.Fatalf("error loading profile: %v", err)
+	}
+	if *fallback != "192.168.1.1:53" || *traceNames != "work.example" {
+		t.Errorf("unexpected flags: %q %q", *fallback, *traceNames)
+	}
+	if *nsid != "from-command-line" {
+		t.Errorf("command line flag overridden: %q", *nsid)
+	}
+
+	if err := loadProfile(fs, f.Name(), "bad"); err == nil {
+		t.Errorf("unknown flag accepted")
+	}
+}
+
+func TestHandleProfile(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnss_test")
+	if err != nil {
+		t.Fatalf("error creating temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testProfiles)
+	f.Close()
+
+	defer withFlags(t, map[string]string{"profiles": f.Name()})()
+
+	do := func(method, query string) (int, string) {
+		r := httptest.NewRequest(method, "/debug/profile?"+query, nil)
+		w := httptest.NewRecorder()
+		handleProfile(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := do("GET", ""); code != 200 || !strings.Contains(body, "work") {
+		t.Errorf("listing: %d %q", code, body)
+	}
+
+	// Switching needs -monitoring_admin, and a POST.
+	if code, _ := do("POST", "set=work"); code != http.StatusForbidden {
+		t.Errorf("switch without -monitoring_admin: %d", code)
+	}
+	defer withFlags(t, map[string]string{"monitoring_admin": "true"})()
+	if code, _ := do("GET", "set=work"); code != http.StatusMethodNotAllowed {
+		t.Errorf("switch with GET: %d", code)
+	}
+	if code, _ := do("POST", "set=unknown"); code != http.StatusBadRequest {
+		t.Errorf("switch to an unknown profile: %d", code)
+	}
+}
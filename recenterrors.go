@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+)
+
+// handleRecentErrors is the monitoring HTTP handler to see the recent errors
+// (see util.ErrorLog), newest first. Use ?kind=upstream (or rejected, parse,
+// or refused) to see only those, and ?format=json to get them as JSON, for
+// scripts.
+func handleRecentErrors(w http.ResponseWriter, r *http.Request) {
+	errs := util.RecentErrors.Errors(r.FormValue("kind"))
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(errs)
+		return
+	}
+
+	if len(errs) == 0 {
+		fmt.Fprintf(w, "No recent errors\n")
+		return
+	}
+	for _, e := range errs {
+		who := []string{}
+		if e.RequestID != "" {
+			who = append(who, "["+e.RequestID+"]")
+		}
+		if e.Client != "" {
+			who = append(who, e.Client)
+		}
+		if e.Question != "" {
+			who = append(who, util.DisplayName(e.Question))
+		}
+		fmt.Fprintf(w, "%s  %-8s  %s: %s\n",
+			e.Time.Format("2006-01-02 15:04:05.000"), e.Kind,
+			strings.Join(who, " "), e.Error)
+	}
+}
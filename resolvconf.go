@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/log"
+)
+
+// Paths and tunables for managing /etc/resolv.conf, declared as variables so
+// we can tweak them for testing.
+var (
+	resolvConfPath   = "/etc/resolv.conf"
+	resolvConfBackup = "/etc/resolv.conf.dnss-backup"
+
+	// How often to check if someone else has overwritten it.
+	resolvConfCheckPeriod = 10 * time.Second
+)
+
+// resolvConfManager points /etc/resolv.conf to us while we run, and puts the
+// original back when we exit.
+//
+// The original is moved aside (as-is, so symlinks and the immutable flag are
+// preserved), and if it's there already from a previous run that didn't exit
+// cleanly, we keep it.
+type resolvConfManager struct {
+	// Contents of the resolv.conf we write.
+	data []byte
+
+	// Have we told the user about NetworkManager already?
+	nmHintGiven bool
+}
+
+// manageResolvConf installs our resolv.conf pointing to the given server,
+// keeps it there, and restores the original on SIGINT or SIGTERM (see
+// onShutdown).
+func manageResolvConf(host string) error {
+	m := &resolvConfManager{}
+	if err := m.install(host); err != nil {
+		return err
+	}
+	log.Infof("%s now points to %s (original in %s)",
+		resolvConfPath, host, resolvConfBackup)
+
+	go func() {
+		for range time.Tick(resolvConfCheckPeriod) {
+			m.check()
+		}
+	}()
+
+	onShutdown("restoring "+resolvConfPath, func() error {
+		log.Infof("Restoring %s", resolvConfPath)
+		return m.restore()
+	})
+
+	return nil
+}
+
+func (m *resolvConfManager) install(host string) error {
+	// Keep the search domains and options from the original, as they are
+	// not about which server to use.
+	original, _ := ioutil.ReadFile(resolvConfPath)
+	m.data = ourResolvConf(original, host)
+
+	if _, err := os.Lstat(resolvConfBackup); os.IsNotExist(err) {
+		if err := moveAside(resolvConfPath, resolvConfBackup); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		log.Infof("%s exists from a previous run, keeping it",
+			resolvConfBackup)
+	}
+
+	return m.write()
+}
+
+// write our resolv.conf atomically, replacing whatever is there.
+func (m *resolvConfManager) write() error {
+	if isImmutable(resolvConfPath) {
+		if err := chattr(resolvConfPath, "-i"); err != nil {
+			return err
+		}
+	}
+
+	tmp := resolvConfPath + ".dnss-tmp"
+	if err := ioutil.WriteFile(tmp, m.data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, resolvConfPath)
+}
+
+// check that our resolv.conf is still in place, and put it back if not.
+func (m *resolvConfManager) check() {
+	data, err := ioutil.ReadFile(resolvConfPath)
+	if err == nil && bytes.Equal(data, m.data) {
+		return
+	}
+
+	log.Infof("%s was changed by someone else, rewriting it", resolvConfPath)
+	if !m.nmHintGiven && isNetworkManagerRunning() {
+		m.nmHintGiven = true
+		log.Infof("NetworkManager is running, and is likely the one" +
+			" rewriting it; set dns=none in the [main] section of" +
+			" its configuration to prevent that")
+	}
+	if err := m.write(); err != nil {
+		log.Errorf("Error rewriting %s: %v", resolvConfPath, err)
+	}
+}
+
+// restore the original resolv.conf.
+func (m *resolvConfManager) restore() error {
+	// Only remove ours: if it's been replaced, leave the new one.
+	data, err := ioutil.ReadFile(resolvConfPath)
+	if err == nil && bytes.Equal(data, m.data) {
+		if err := os.Remove(resolvConfPath); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Lstat(resolvConfBackup); os.IsNotExist(err) {
+		// There was no original.
+		return nil
+	}
+	return moveAside(resolvConfBackup, resolvConfPath)
+}
+
+// moveAside renames from to "to", if it exists, keeping its immutable flag.
+func moveAside(from, to string) error {
+	if _, err := os.Lstat(from); os.IsNotExist(err) {
+		return nil
+	}
+
+	// Immutable files can't be renamed, so drop the flag and put it back
+	// once it's been moved. The flag goes with the file, so we know what to
+	// do on restore even after a crash.
+	immutable := isImmutable(from)
+	if immutable {
+		if err := chattr(from, "-i"); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if immutable {
+		return chattr(to, "+i")
+	}
+	return nil
+}
+
+// ourResolvConf returns the contents of our resolv.conf, pointing to the
+// given server, keeping the search and options lines of the original.
+func ourResolvConf(original []byte, host string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# Written by dnss --manage_resolv_conf, the original"+
+		" is in %s.\n", resolvConfBackup)
+	fmt.Fprintf(buf, "nameserver %s\n", host)
+
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "search", "domain", "options":
+			fmt.Fprintf(buf, "%s\n", strings.Join(fields, " "))
+		}
+	}
+	return buf.Bytes()
+}
+
+// isImmutable returns true if the file has the immutable attribute. On
+// errors (for example, because the filesystem doesn't support attributes,
+// or it's a symlink), it returns false.
+func isImmutable(path string) bool {
+	out, err := exec.Command("lsattr", "-d", path).Output()
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(out))
+	return len(fields) > 0 && strings.Contains(fields[0], "i")
+}
+
+func chattr(path, attr string) error {
+	out, err := exec.Command("chattr", attr, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("chattr %s %s: %v (%s)",
+			attr, path, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func isNetworkManagerRunning() bool {
+	_, err := os.Stat("/run/NetworkManager")
+	return err == nil
+}
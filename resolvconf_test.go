@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManageResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldPath, oldBackup := resolvConfPath, resolvConfBackup
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	resolvConfBackup = filepath.Join(dir, "resolv.conf.dnss-backup")
+	defer func() {
+		resolvConfPath, resolvConfBackup = oldPath, oldBackup
+	}()
+
+	original := "# Original.\nnameserver 192.168.1.1\n" +
+		"search  lan.example\noptions edns0\n"
+	if err := ioutil.WriteFile(resolvConfPath, []byte(original), 0644); err != nil {
+		t.Fatalf("error writing resolv.conf: %v", err)
+	}
+
+	m := &resolvConfManager{}
+	if err := m.install("127.0.0.1"); err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+
+	data, _ := ioutil.ReadFile(resolvConfPath)
+	if !strings.Contains(string(data), "nameserver 127.0.0.1\n") ||
+		!strings.Contains(string(data), "search lan.example\n") ||
+		!strings.Contains(string(data), "options edns0\n") ||
+		strings.Contains(string(data), "192.168.1.1") {
+		t.Errorf("unexpected resolv.conf: %q", data)
+	}
+	if data, _ := ioutil.ReadFile(resolvConfBackup); string(data) != original {
+		t.Errorf("unexpected backup: %q", data)
+	}
+
+	// Someone else (like NetworkManager) overwrites it, we put it back.
+	ioutil.WriteFile(resolvConfPath, []byte("nameserver 10.0.0.1\n"), 0644)
+	m.check()
+	if data, _ := ioutil.ReadFile(resolvConfPath); string(data) != string(m.data) {
+		t.Errorf("resolv.conf not rewritten: %q", data)
+	}
+
+	// A second install (like after a crash) keeps the original backup.
+	m2 := &resolvConfManager{}
+	if err := m2.install("127.0.0.1"); err != nil {
+		t.Fatalf("error installing again: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(resolvConfBackup); string(data) != original {
+		t.Errorf("backup overwritten: %q", data)
+	}
+
+	if err := m2.restore(); err != nil {
+		t.Fatalf("error restoring: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(resolvConfPath); string(data) != original {
+		t.Errorf("original not restored: %q", data)
+	}
+	if _, err := os.Stat(resolvConfBackup); !os.IsNotExist(err) {
+		t.Errorf("backup still there: %v", err)
+	}
+}
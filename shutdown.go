@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"blitiri.com.ar/go/log"
+)
+
+// Things to do before exiting on SIGINT or SIGTERM (like saving the
+// counters, or restoring /etc/resolv.conf), see onShutdown.
+var shutdown = struct {
+	mu *sync.Mutex
+
+	// Functions to run, in the order they were added.
+	hooks []shutdownHook
+
+	// Set once a new process took over in a graceful upgrade: from then on,
+	// cleaning up is its job, not ours.
+	handedOver bool
+}{
+	mu: &sync.Mutex{},
+}
+
+type shutdownHook struct {
+	name string
+	f    func() error
+}
+
+// onShutdown adds f to the functions to run before exiting on a signal. The
+// name is used for logging.
+func onShutdown(name string, f func() error) {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	shutdown.hooks = append(shutdown.hooks, shutdownHook{name, f})
+}
+
+// handOverShutdown tells us a new process took over (see shutdown).
+func handOverShutdown() {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	shutdown.handedOver = true
+}
+
+// runShutdownHooks runs the shutdown functions, and returns false if any of
+// them failed.
+func runShutdownHooks() bool {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	if shutdown.handedOver {
+		return true
+	}
+
+	ok := true
+	for _, h := range shutdown.hooks {
+		if err := h.f(); err != nil {
+			log.Errorf("Error %s: %v", h.name, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// handleShutdownSignals exits on SIGINT and SIGTERM, after running the
+// shutdown functions.
+func handleShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Infof("Got %v, exiting", sig)
+		if !runShutdownHooks() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+}
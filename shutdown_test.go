@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestShutdownHooks(t *testing.T) {
+	defer func(hooks []shutdownHook) {
+		shutdown.hooks = hooks
+		shutdown.handedOver = false
+	}(shutdown.hooks)
+	shutdown.hooks = nil
+
+	ran := []string{}
+	onShutdown("one", func() error {
+		ran = append(ran, "one")
+		return errors.New("failed")
+	})
+	onShutdown("two", func() error {
+		ran = append(ran, "two")
+		return nil
+	})
+
+	// All of them run, even if one fails.
+	if runShutdownHooks() {
+		t.Errorf("failed hook not reported")
+	}
+	if len(ran) != 2 || ran[0] != "one" || ran[1] != "two" {
+		t.Errorf("unexpected hooks run: %v", ran)
+	}
+
+	// Once a new process took over, cleaning up is its job.
+	ran = nil
+	handOverShutdown()
+	if !runShutdownHooks() || len(ran) != 0 {
+		t.Errorf("hooks run after handing over: %v", ran)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+// Low-memory mode, for OpenWrt-class devices (ARM or MIPS routers with 64 to
+// 128 MB of RAM): -small sets tighter defaults for the flags that use
+// memory (a smaller cache, fewer concurrent requests and workers), and makes
+// the garbage collector run more often, trading a bit of CPU for a smaller
+// heap.
+//
+// Like with the profiles, flags set explicitly take precedence, so any of
+// the defaults can be changed, including turning the cache off entirely
+// with -enable_cache=false.
+//
+// Large blocklists should be compiled (see -blocklists) rather than loaded
+// as RPZ zones, which are kept in the heap. The memory benchmarks in the
+// dnsserver package show the difference.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+)
+
+// Flag defaults in low-memory mode.
+var smallDefaults = map[string]string{
+	"cache_partitions":      "other=500",
+	"max_upstream_requests": "20",
+	"https_workers":         "10",
+	"https_worker_queue":    "100",
+	"recent_errors":         "20",
+}
+
+// GOGC to use in low-memory mode, unless the environment sets one: the heap
+// can grow by half before a collection, instead of doubling.
+const smallGCPercent = 50
+
+// applySmall sets the low-memory defaults in fs, for the flags which were not
+// set, and tunes the garbage collector.
+func applySmall(fs *flag.FlagSet) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := []string{}
+	for name := range smallDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, smallDefaults[name]); err != nil {
+			return fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(smallGCPercent)
+	}
+	return nil
+}
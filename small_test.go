@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"runtime/debug"
+	"testing"
+)
+
+func TestApplySmall(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	values := map[string]*string{}
+	for name := range smallDefaults {
+		values[name] = fs.String(name, "default", "")
+	}
+	fs.Parse([]string{"-https_workers=50"})
+
+	prev := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(prev)
+
+	if err := applySmall(fs); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// Flags set explicitly take precedence.
+	if *values["https_workers"] != "50" {
+		t.Errorf("-https_workers overridden: %q", *values["https_workers"])
+	}
+	if *values["cache_partitions"] != "other=500" {
+		t.Errorf("-cache_partitions not set: %q", *values["cache_partitions"])
+	}
+
+	// Setting it again returns the one applySmall set.
+	if gc := debug.SetGCPercent(100); gc != smallGCPercent {
+		t.Errorf("expected GOGC %d, got %d", smallGCPercent, gc)
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+// Subcommands, to make the different things dnss can do discoverable:
+//
+//   dnss proxy [flags]                  DNS-to-HTTPS proxy (the DNS front-end)
+//   dnss serve-doh [flags]              HTTPS-to-DNS proxy (the DoH server)
+//   dnss query [flags] name [type]      resolve a name like the proxy would
+//   dnss doctor [flags]                 check the configuration and upstreams
+//   dnss compile-blocklist out in...    compile blocklists for -blocklists
+//
+// Each one only takes the flags that apply to it (plus the common ones, like
+// logging and monitoring), so "dnss <subcommand> -help" shows just those.
+//
+// The query and doctor subcommands print their results as text, or as JSON
+// with -output=json, for scripts and monitoring (see queryOutput and
+// doctorOutput for the schemas).
+//
+// For backwards compatibility, running dnss without a subcommand takes all
+// the flags, and the proxies are selected with -mode or the -enable_* flags,
+// as before.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/blocklist"
+	"blitiri.com.ar/go/dnss/internal/dnsjson"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/trace"
+)
+
+type subcommand struct {
+	name    string
+	aliases []string
+	help    string
+
+	// Arguments after the flags, for the usage message.
+	args string
+
+	// Does the subcommand take the given flag (of flag.CommandLine)?
+	takesFlag func(name string) bool
+
+	// Extra flags, only for this subcommand.
+	extraFlags func(fs *flag.FlagSet)
+
+	// Enable the proxies before running.
+	enable func()
+
+	// Run the subcommand, with the arguments after the flags, and return
+	// the exit code. If nil, the selected proxies are run as usual.
+	run func(args []string) int
+}
+
+var subcommands = []*subcommand{
+	{
+		name:      "proxy",
+		aliases:   []string{"dns-to-https"},
+		help:      "run the DNS-to-HTTPS proxy",
+		takesFlag: isProxyFlag,
+		enable:    func() { *enableDNStoHTTPS = true },
+	},
+	{
+		name:      "serve-doh",
+		aliases:   []string{"https-to-dns"},
+		help:      "run the HTTPS-to-DNS proxy (a DoH and JSON server)",
+		takesFlag: isServeDoHFlag,
+		enable:    func() { *enableHTTPStoDNS = true },
+	},
+	{
+		name:      "query",
+		help:      "resolve a name via the upstream, like the proxy would",
+		args:      "name [type]",
+		takesFlag: isProxyFlag,
+		extraFlags: func(fs *flag.FlagSet) {
+			queryServer = fs.String("server", "",
+				"plain DNS server (host:port) to query instead of"+
+					" -https_upstream")
+			outputFlag(fs)
+		},
+		run: runQuery,
+	},
+	{
+		name:       "doctor",
+		help:       "check the configuration, and that the upstreams work",
+		takesFlag:  func(name string) bool { return true },
+		extraFlags: outputFlag,
+		run:        runDoctor,
+	},
+	{
+		name:      "compile-blocklist",
+		help:      "compile blocklists to the compact format of -blocklists",
+		args:      "output input...",
+		takesFlag: func(name string) bool { return commonFlags[name] },
+		run:       runCompileBlocklist,
+	},
+}
+
+// Flags of the query and doctor subcommands.
+var (
+	queryServer  = new(string)
+	outputFormat = new(string)
+)
+
+func outputFlag(fs *flag.FlagSet) {
+	outputFormat = fs.String("output", "text",
+		"format of the results: text, or json (for scripts)")
+}
+
+// Where the subcommands print their results; a variable so tests can
+// capture them.
+var stdout io.Writer = os.Stdout
+
+// How long the query and doctor subcommands wait for the upstreams.
+var upstreamCheckTimeout = 5 * time.Second
+
+// Flags taken by all the subcommands.
+var commonFlags = map[string]bool{
+	"enable_cache":            true,
+	"dscp":                    true,
+	"monitoring_listen_addr":  true,
+	"monitoring_unix_socket":  true,
+	"unix_socket_mode":        true,
+	"graceful_upgrade":        true,
+	"testing__insecure_http":  true,
+	"syslog_remote":           true,
+	"webhooks":                true,
+	"webhook_events":          true,
+	"trace_names":             true,
+	"config_dir":              true,
+	"uci_config":              true,
+	"watchdog_max_heap_mb":    true,
+	"watchdog_max_goroutines": true,
+	"watchdog_max_stall":      true,
+	"watchdog_dump_dir":       true,
+	"watchdog_restart":        true,
+	"profiles":                true,
+	"profile":                 true,
+	"check_config":            true,
+	"small":                   true,
+	"log_flush_every":         true,
+	"logtostderr":             true,
+	"unicode_names":           true,
+
+	// Flags of the log package.
+	"logfile":         true,
+	"logtime":         true,
+	"logtosyslog":     true,
+	"alsologtostderr": true,
+	"v":               true,
+}
+
+// Flags of the HTTPS-to-DNS proxy. The ones that are neither these nor the
+// common ones are the DNS-to-HTTPS proxy's.
+var serveDoHFlags = map[string]bool{
+	"dns_upstream":                       true,
+	"https_cert":                         true,
+	"https_key":                          true,
+	"https_extra_certs":                  true,
+	"https_server_addr":                  true,
+	"https_tls_min_version":              true,
+	"https_tls_ciphers":                  true,
+	"https_tls_curves":                   true,
+	"https_ticket_key_rotation":          true,
+	"https_ocsp_staple":                  true,
+	"https_resolver_hints":               true,
+	"https_json_metadata":                true,
+	"https_recursive":                    true,
+	"https_recursive_qname_minimization": true,
+	"https_recursive_local_root":         true,
+	"https_recursive_root_sources":       true,
+	"https_endpoints":                    true,
+	"https_log_sample_rate":              true,
+	"https_log_max_qps":                  true,
+	"https_workers":                      true,
+	"https_worker_queue":                 true,
+	"proxy_protocol":                     true,
+}
+
+// Flags that select what to run, replaced by the subcommands.
+var modeFlags = map[string]bool{
+	"mode":                true,
+	"enable_dns_to_https": true,
+	"enable_https_to_dns": true,
+}
+
+func isServeDoHFlag(name string) bool {
+	return serveDoHFlags[name] || commonFlags[name]
+}
+
+func isProxyFlag(name string) bool {
+	return !serveDoHFlags[name] && !modeFlags[name]
+}
+
+// findSubcommand returns the subcommand with the given name (or alias), or
+// nil if there is none.
+func findSubcommand(name string) *subcommand {
+	for _, cmd := range subcommands {
+		if cmd.name == name {
+			return cmd
+		}
+		for _, a := range cmd.aliases {
+			if a == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// flagSet returns the flags of the subcommand. They share the values with
+// flag.CommandLine, so the rest of the code can use them as usual.
+func (cmd *subcommand) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("dnss "+cmd.name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if cmd.takesFlag(f.Name) {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	if cmd.extraFlags != nil {
+		cmd.extraFlags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: dnss %s [flags] %s\n\n"+
+			"dnss %s: %s.\n\nFlags:\n", cmd.name, cmd.args, cmd.name, cmd.help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandLine parses the arguments (without the program name), and
+// returns the subcommand to run (nil if none was given), and the arguments
+// after the flags.
+func parseCommandLine(args []string) (*subcommand, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		flag.CommandLine.Parse(args)
+		return nil, flag.Args()
+	}
+
+	cmd := findSubcommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %q\n\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+
+	fs := cmd.flagSet()
+	fs.Parse(args[1:])
+
+	// Mark them as set in flag.CommandLine too, as the configuration
+	// directory and the profiles don't override the flags set there.
+	fs.Visit(func(f *flag.Flag) {
+		if flag.Lookup(f.Name) != nil {
+			flag.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if cmd.enable != nil {
+		cmd.enable()
+	}
+	return cmd, fs.Args()
+}
+
+// usage prints the usage message, with the subcommands.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: dnss <subcommand> [flags]\n\nSubcommands:\n")
+	for _, cmd := range subcommands {
+		name := cmd.name
+		if len(cmd.aliases) > 0 {
+			name += " (" + strings.Join(cmd.aliases, ", ") + ")"
+		}
+		fmt.Fprintf(os.Stderr, "  %-29s %s\n", name, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\n"+
+		"Use \"dnss <subcommand> -help\" for the flags of each one.\n"+
+		"Without a subcommand, all the flags are taken, and -mode (or the\n"+
+		"-enable_* flags) select what to run.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// queryOutput is the result of the query subcommand, in JSON.
+type queryOutput struct {
+	// Where the query was sent to: the -server, or the -https_upstream.
+	Server string
+
+	// How long it took to get the reply.
+	TimeMs float64
+
+	// The reply, like the JSON API returns it (but always including the
+	// authority and additional sections, if they have records).
+	Response *dnsjson.Response `json:",omitempty"`
+
+	// Error resolving the query, if any (in which case there is no
+	// response).
+	Error string `json:",omitempty"`
+}
+
+// runQuery resolves the name given in the arguments, with the upstream of
+// the DNS-to-HTTPS proxy (or a plain DNS server, with -server), and prints
+// the reply.
+func runQuery(args []string) int {
+	if len(args) < 1 || len(args) > 2 || !validOutputFormat() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: dnss query [-output=text|json] [flags] name [type]\n")
+		return 2
+	}
+	qtype := dns.TypeA
+	if len(args) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown type %q\n", args[1])
+			return 2
+		}
+		qtype = t
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(args[0]), qtype)
+	req.RecursionDesired = true
+
+	out := queryOutput{Server: *queryServer}
+	var reply *dns.Msg
+	var err error
+	start := time.Now()
+	if *queryServer != "" {
+		c := &dns.Client{Timeout: upstreamCheckTimeout}
+		reply, _, err = c.Exchange(req, *queryServer)
+	} else {
+		out.Server = *httpsUpstream
+		reply, err = queryUpstream(*httpsUpstream, req)
+	}
+	elapsed := time.Since(start)
+	out.TimeMs = elapsed.Seconds() * 1000
+
+	if *outputFormat == "json" {
+		if err != nil {
+			out.Error = err.Error()
+		} else {
+			out.Response = jsonResponse(reply)
+		}
+		printJSON(out)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	} else {
+		fmt.Fprintf(stdout, "%v\n;; Query time: %v\n", reply, elapsed)
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// queryUpstream sends the query to the given HTTPS upstream, set up like
+// the DNS-to-HTTPS proxy does, waiting at most upstreamCheckTimeout.
+func queryUpstream(upstream string, req *dns.Msg) (*dns.Msg, error) {
+	r, err := newUpstreamResolver(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Init(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		reply *dns.Msg
+		err   error
+	}
+	c := make(chan result, 1)
+	go func() {
+		tr := trace.New("dnss.query", req.Question[0].Name)
+		defer tr.Finish()
+		reply, err := r.Query(req, tr)
+		c <- result{reply, err}
+	}()
+
+	select {
+	case res := <-c:
+		return res.reply, res.err
+	case <-time.After(upstreamCheckTimeout):
+		return nil, fmt.Errorf("timed out after %v", upstreamCheckTimeout)
+	}
+}
+
+// doctorOutput is the result of the doctor subcommand, in JSON.
+type doctorOutput struct {
+	// Whether all the checks passed.
+	OK bool
+
+	// The checks, in the order they were run.
+	Checks []doctorCheck
+}
+
+type doctorCheck struct {
+	// What was checked, like "configuration" or "https upstream <url>".
+	Check string
+
+	OK bool
+
+	// Why the check failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+// runDoctor checks the configuration and, if it's valid, that the upstreams
+// of the enabled proxies can resolve a well-known name. It prints the result
+// of each check.
+func runDoctor(args []string) int {
+	if len(args) > 0 || !validOutputFormat() {
+		fmt.Fprintf(os.Stderr, "Usage: dnss doctor [-output=text|json] [flags]\n")
+		return 2
+	}
+
+	out := doctorOutput{OK: true}
+	report := func(what string, err error) {
+		check := doctorCheck{Check: what, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+			out.OK = false
+		}
+		out.Checks = append(out.Checks, check)
+
+		if *outputFormat == "json" {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "FAIL  %s: %v\n", what, err)
+		} else {
+			fmt.Fprintf(stdout, "ok    %s\n", what)
+		}
+	}
+
+	if errs := checkConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			report("configuration", err)
+		}
+	} else {
+		report("configuration", nil)
+
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.RecursionDesired = true
+
+		if *enableDNStoHTTPS {
+			_, err := queryUpstream(*httpsUpstream, req)
+			report("https upstream "+*httpsUpstream, err)
+		}
+		if *enableHTTPStoDNS && !*httpsRecursive {
+			c := &dns.Client{Timeout: upstreamCheckTimeout}
+			for _, addr := range strings.Fields(plainDNSAddrs("dns_upstream", *dnsUpstream)) {
+				_, _, err := c.Exchange(req, addr)
+				report("dns upstream "+addr, err)
+			}
+		}
+	}
+
+	if *outputFormat == "json" {
+		printJSON(out)
+	}
+	if !out.OK {
+		return 1
+	}
+	return 0
+}
+
+func validOutputFormat() bool {
+	return *outputFormat == "text" || *outputFormat == "json"
+}
+
+// printJSON prints the value as indented JSON.
+func printJSON(v interface{}) {
+	buf, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintf(stdout, "%s\n", buf)
+}
+
+// jsonResponse converts the DNS message to its JSON API form, like the
+// HTTPS-to-DNS proxy does.
+func jsonResponse(m *dns.Msg) *dnsjson.Response {
+	jr := &dnsjson.Response{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+	for _, q := range m.Question {
+		jr.Question = append(jr.Question, dnsjson.RR{Name: q.Name, Type: q.Qtype})
+	}
+	jr.Answer = jsonRRs(m.Answer)
+	jr.Authority = jsonRRs(m.Ns)
+	jr.Additional = jsonRRs(m.Extra)
+	return jr
+}
+
+func jsonRRs(rrs []dns.RR) []dnsjson.RR {
+	var jrrs []dnsjson.RR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		jrrs = append(jrrs, dnsjson.RR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: rr.String()[len(hdr.String()):],
+		})
+	}
+	return jrrs
+}
+
+// runCompileBlocklist compiles the blocklists given as inputs (in text
+// format, "-" for the standard input) into a single compiled one.
+func runCompileBlocklist(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr,
+			"Usage: dnss compile-blocklist [flags] output input...\n")
+		return 2
+	}
+
+	b := blocklist.NewBuilder()
+	for _, path := range args[1:] {
+		var err error
+		if path == "-" {
+			err = b.AddList(os.Stdin)
+		} else {
+			var f *os.File
+			f, err = os.Open(path)
+			if err == nil {
+				err = b.AddList(f)
+				f.Close()
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %q: %v\n", path, err)
+			return 1
+		}
+	}
+
+	if err := b.WriteFile(args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %q: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: %d domains (%d invalid entries skipped)\n",
+		args[0], b.Len(), b.Skipped)
+	return 0
+}
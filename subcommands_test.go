@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/blocklist"
+
+	"github.com/miekg/dns"
+)
+
+func TestSubcommandFlags(t *testing.T) {
+	cases := []struct {
+		cmd      string
+		has, not []string
+	}{
+		{"proxy",
+			[]string{"https_upstream", "dns_listen_addr", "monitoring_listen_addr"},
+			[]string{"https_cert", "dns_upstream", "mode", "enable_dns_to_https"}},
+		{"serve-doh",
+			[]string{"https_cert", "dns_upstream", "monitoring_listen_addr"},
+			[]string{"https_upstream", "dns_listen_addr", "enable_https_to_dns"}},
+		{"query",
+			[]string{"https_upstream", "server"},
+			[]string{"https_cert"}},
+		{"doctor",
+			[]string{"https_upstream", "https_cert", "mode"},
+			[]string{"server"}},
+		{"compile-blocklist",
+			[]string{"logtostderr"},
+			[]string{"https_upstream", "https_cert", "blocklists"}},
+	}
+	for _, c := range cases {
+		fs := findSubcommand(c.cmd).flagSet()
+		for _, name := range c.has {
+			if fs.Lookup(name) == nil {
+				t.Errorf("%s: missing -%s", c.cmd, name)
+			}
+		}
+		for _, name := range c.not {
+			if fs.Lookup(name) != nil {
+				t.Errorf("%s: unexpected -%s", c.cmd, name)
+			}
+		}
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	restore := withFlags(t, map[string]string{
+		"https_server_addr": *httpsAddr,
+	})
+	defer restore()
+	defer func() { *enableHTTPStoDNS = false }()
+
+	// The aliases work like the subcommands.
+	cmd, args := parseCommandLine(
+		[]string{"https-to-dns", "-https_server_addr=:8443", "extra"})
+	if cmd == nil || cmd.name != "serve-doh" {
+		t.Fatalf("unexpected subcommand: %v", cmd)
+	}
+	if len(args) != 1 || args[0] != "extra" {
+		t.Errorf("unexpected arguments: %v", args)
+	}
+	if !*enableHTTPStoDNS || *enableDNStoHTTPS {
+		t.Errorf("serve-doh enabled the wrong proxies")
+	}
+	if *httpsAddr != ":8443" {
+		t.Errorf("flag not set: %q", *httpsAddr)
+	}
+
+	// And the flags count as set for flag.CommandLine, so the profiles
+	// don't override them.
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == "https_server_addr" })
+	if !set {
+		t.Errorf("flag not marked as set")
+	}
+}
+
+// parseSubcommandFlags parses the flags of the given subcommand.
+func parseSubcommandFlags(t *testing.T, name string, args ...string) {
+	t.Helper()
+	if err := findSubcommand(name).flagSet().Parse(args); err != nil {
+		t.Fatalf("error parsing the flags: %v", err)
+	}
+}
+
+// captureStdout makes the subcommands print to the returned buffer, until
+// the returned function is called.
+func captureStdout() (*bytes.Buffer, func()) {
+	buf := &bytes.Buffer{}
+	stdout = buf
+	return buf, func() { stdout = os.Stdout }
+}
+
+func TestRunQueryArgs(t *testing.T) {
+	parseSubcommandFlags(t, "query")
+	for _, args := range [][]string{
+		{},
+		{"example.com", "A", "extra"},
+		{"example.com", "NOTATYPE"},
+	} {
+		if code := runQuery(args); code != 2 {
+			t.Errorf("%v: expected exit code 2, got %d", args, code)
+		}
+	}
+
+	parseSubcommandFlags(t, "query", "-output=yaml")
+	if code := runQuery([]string{"example.com"}); code != 2 {
+		t.Errorf("unknown output format: expected exit code 2, got %d", code)
+	}
+}
+
+func TestRunDoctorBadConfig(t *testing.T) {
+	buf, restore := captureStdout()
+	defer restore()
+
+	// Nothing enabled, so the configuration is invalid, and we don't get
+	// to contacting the upstreams.
+	parseSubcommandFlags(t, "doctor")
+	if code := runDoctor(nil); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.HasPrefix(buf.String(), "FAIL  configuration: ") {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+
+	buf.Reset()
+	parseSubcommandFlags(t, "doctor", "-output=json")
+	if code := runDoctor(nil); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	out := doctorOutput{}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, buf.String())
+	}
+	if out.OK || len(out.Checks) != 1 || out.Checks[0].Check != "configuration" ||
+		out.Checks[0].OK || out.Checks[0].Error == "" {
+		t.Errorf("unexpected output: %+v", out)
+	}
+}
+
+func TestRunCompileBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnss_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "hosts")
+	out := filepath.Join(dir, "list.dnssbl")
+	ioutil.WriteFile(in, []byte("0.0.0.0 ads.example\nbad..name\n"), 0644)
+
+	buf, restore := captureStdout()
+	defer restore()
+
+	if code := runCompileBlocklist([]string{out}); code != 2 {
+		t.Errorf("missing inputs: expected exit code 2, got %d", code)
+	}
+	if code := runCompileBlocklist([]string{out, "/doesnotexist"}); code != 1 {
+		t.Errorf("missing file: expected exit code 1, got %d", code)
+	}
+
+	if code := runCompileBlocklist([]string{out, in}); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if buf.String() != out+": 1 domains (1 invalid entries skipped)\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	l, err := blocklist.Open(out)
+	if err != nil {
+		t.Fatalf("error opening the compiled list: %v", err)
+	}
+	defer l.Close()
+	if !l.Contains("ads.example.") {
+		t.Errorf("compiled list is missing ads.example")
+	}
+}
+
+func TestJSONResponse(t *testing.T) {
+	m := &dns.Msg{}
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeSuccess
+	m.RecursionAvailable = true
+	a, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	ns, _ := dns.NewRR("example.com. 300 IN NS ns.example.com.")
+	m.Answer = []dns.RR{a}
+	m.Ns = []dns.RR{ns}
+	m.SetEdns0(1232, false)
+
+	jr := jsonResponse(m)
+	if jr.Status != 0 || !jr.RA || len(jr.Question) != 1 ||
+		jr.Question[0].Type != dns.TypeA {
+		t.Errorf("unexpected response: %+v", jr)
+	}
+	if len(jr.Answer) != 1 || jr.Answer[0].Data != "1.2.3.4" ||
+		jr.Answer[0].TTL != 300 {
+		t.Errorf("unexpected answer: %+v", jr.Answer)
+	}
+	if len(jr.Authority) != 1 || jr.Authority[0].Data != "ns.example.com." {
+		t.Errorf("unexpected authority: %+v", jr.Authority)
+	}
+	// The OPT record is not a record, and is left out.
+	if len(jr.Additional) != 0 {
+		t.Errorf("unexpected additional: %+v", jr.Additional)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+)
+
+// Drop-in configuration to disable systemd-resolved's stub listener.
+const (
+	resolvedDropIn     = "/etc/systemd/resolved.conf.d/dnss.conf"
+	resolvedDropInData = "# Written by dnss --takeover=resolved, so it can " +
+		"listen on the DNS port.\n" +
+		"[Resolve]\nDNSStubListener=no\n"
+)
+
+// takeOverResolved disables systemd-resolved's stub listener if it's
+// listening on the port of the given address, on the same IP or on one that
+// overlaps with it (when either is a wildcard), so we can listen on it.
+//
+// resolved has no way to do that at runtime (neither via D-Bus nor
+// resolvectl), so we write a drop-in configuration file and restart it via
+// systemctl. The drop-in is left in place (so it doesn't take the port back
+// on every restart of resolved); remove it and restart resolved to undo
+// this. Note that if /etc/resolv.conf points to the stub listener
+// (127.0.0.53), it will need to be changed to point to us.
+func takeOverResolved(addr string) error {
+	if !resolvedConflicts(addr) {
+		return nil
+	}
+
+	log.Infof("Takeover: disabling systemd-resolved's stub listener (%s)",
+		resolvedDropIn)
+	err := os.MkdirAll(filepath.Dir(resolvedDropIn), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(resolvedDropIn, []byte(resolvedDropInData), 0644)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("systemctl", "try-restart",
+		"systemd-resolved.service").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error restarting systemd-resolved: %v (%s)",
+			err, out)
+	}
+
+	// The restart is synchronous, but give it some time anyway.
+	for i := 0; i < 50 && resolvedConflicts(addr); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if resolvedConflicts(addr) {
+		return fmt.Errorf("systemd-resolved is still using %s", addr)
+	}
+
+	log.Infof("Takeover: done; check that /etc/resolv.conf does not point" +
+		" to 127.0.0.53")
+	return nil
+}
+
+// resolvedConflicts returns true if systemd-resolved is listening on an
+// address that overlaps with the given one.
+func resolvedConflicts(addr string) bool {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return false
+	}
+
+	owners, _ := util.FindPortOwners(port)
+	for _, o := range owners {
+		// /proc/<pid>/comm is truncated to 15 characters.
+		if o.Command == "systemd-resolve" && addrsOverlap(addr, o.Addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrsOverlap returns true if the two addresses (with the same port) can't
+// be listened on at the same time: if their IPs are the same, or either is
+// a wildcard (like 0.0.0.0, or an empty host).
+func addrsOverlap(a, b string) bool {
+	ha, _, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hb, _, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+
+	ipa, ipb := net.ParseIP(ha), net.ParseIP(hb)
+	if ha == "" || hb == "" || ipa.IsUnspecified() || ipb.IsUnspecified() {
+		return true
+	}
+	if ipa == nil || ipb == nil {
+		// Host names, we can't really tell.
+		return ha == hb
+	}
+	return ipa.Equal(ipb)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestAddrsOverlap(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"127.0.0.53:53", "127.0.0.53:53", true},
+		{"0.0.0.0:53", "127.0.0.53:53", true},
+		{":53", "127.0.0.53:53", true},
+		{"[::]:53", "127.0.0.54:53", true},
+		{"127.0.0.1:53", "0.0.0.0:53", true},
+		{"127.0.0.1:53", "127.0.0.53:53", false},
+		{"192.168.1.1:53", "127.0.0.54:53", false},
+		{"[::1]:53", "127.0.0.53:53", false},
+		{"localhost:53", "127.0.0.53:53", false},
+	}
+	for _, c := range cases {
+		if got := addrsOverlap(c.a, c.b); got != c.expected {
+			t.Errorf("addrsOverlap(%q, %q) = %v, expected %v",
+				c.a, c.b, got, c.expected)
+		}
+	}
+}
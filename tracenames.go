@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"blitiri.com.ar/go/dnss/internal/util"
+	"blitiri.com.ar/go/log"
+)
+
+// handleTraceNames is the monitoring HTTP handler to see and change the names
+// we trace in detail. Use ?add=name and ?remove=name to change the list, and
+// ?all=true to trace all queries (or ?all=false to go back to using the
+// list).
+func handleTraceNames(w http.ResponseWriter, r *http.Request) {
+	if name := r.FormValue("add"); name != "" {
+		util.TracedNames.Add(name)
+		log.Infof("Tracing %q in detail", name)
+	}
+	if name := r.FormValue("remove"); name != "" {
+		util.TracedNames.Remove(name)
+		log.Infof("No longer tracing %q in detail", name)
+	}
+	if s := r.FormValue("all"); s != "" {
+		all, err := strconv.ParseBool(s)
+		if err != nil {
+			http.Error(w, "invalid all: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		util.TracedNames.SetAll(all)
+		log.Infof("Tracing all queries in detail: %v", all)
+	}
+
+	fmt.Fprintf(w, "%s\n", util.TracedNames)
+}
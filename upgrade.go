@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"blitiri.com.ar/go/dnss/internal/statsfile"
+	"blitiri.com.ar/go/dnss/internal/upgrade"
+	"blitiri.com.ar/go/log"
+)
+
+// Persisted counters (see -stats_file), if enabled.
+var statsStore *statsfile.Store
+
+// handleUpgradeSignal does a graceful upgrade on SIGUSR2 (see upgradeNow).
+func handleUpgradeSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			log.Infof("Upgrade requested, starting new process")
+			upgradeNow()
+		}
+	}()
+}
+
+// upgradeNow does a graceful upgrade: it starts a new process (with the
+// binary currently installed), passes it our sockets, and once it has taken
+// them over, waits for the queries in flight and exits.
+// If the new process fails to start, we just keep going.
+func upgradeNow() {
+	if err := startUpgrade(); err != nil {
+		log.Errorf("Upgrade failed, continuing: %v", err)
+		return
+	}
+	finishUpgrade()
+}
+
+// startUpgrade starts the new process, and returns once it has taken our
+// sockets over; if it returns nil, the caller must call finishUpgrade.
+//
+// The counters are saved before starting it, so it loads them; from then
+// on, it's the one saving them.
+func startUpgrade() error {
+	if *dnsListenAddr == "systemd" {
+		return errors.New("not supported when the sockets come from systemd")
+	}
+
+	if statsStore != nil {
+		if err := statsStore.Save(); err != nil {
+			log.Errorf("Upgrade: error saving the statistics: %v", err)
+		}
+	}
+
+	if err := upgrade.Upgrade(); err != nil {
+		return err
+	}
+	if statsStore != nil {
+		statsStore.Stop()
+	}
+	handOverShutdown()
+	return nil
+}
+
+// finishUpgrade waits for the queries in flight, and exits.
+func finishUpgrade() {
+	log.Infof("Upgrade: new process took over, draining")
+	upgrade.Drain()
+	log.Infof("Upgrade: done, exiting")
+	os.Exit(0)
+}